@@ -0,0 +1,88 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/smileyfaceskobochka/trashbin-daemon/internal/server"
+	wod "github.com/smileyfaceskobochka/trashbin-daemon/pkg/client"
+)
+
+// --- Client Mode ---
+
+func (cli *CLI) runAction(args []string) {
+	espID, opts := cli.parseCommandArgs("action", args)
+	espID = cli.resolveAlias(espID)
+	if opts.Action == "" {
+		cli.listActions(espID)
+		return
+	}
+	if name, ok := server.GroupRef(espID); ok {
+		cli.sendGroupCommand("action "+opts.Action, name, wod.CommandAction, opts)
+		return
+	}
+
+	result := cli.setCommand(espID, wod.CommandAction, opts)
+	switch cli.outputMode {
+	case outputJSON:
+		printJSON(result)
+		return
+	case outputPlain:
+		printRecord(result.ID, result.Command, result.Status, result.Delivery, result.CommandID)
+		return
+	}
+	switch {
+	case result.Status == "sent":
+		fmt.Printf("Action '%s' sent to %s via %s\n", opts.Action, espID, result.Delivery)
+	case result.Status == "duplicate":
+		fmt.Printf("Action '%s' already queued for %s\n", opts.Action, espID)
+	case result.Offline:
+		fmt.Printf("%s is offline; action '%s' queued for when it polls again\n", espID, opts.Action)
+	default:
+		fmt.Printf("Action '%s' queued for %s\n", opts.Action, espID)
+	}
+	fmt.Printf("Command ID: %s (check with: wake-on-demand result %s)\n", result.CommandID, result.CommandID)
+}
+
+func (cli *CLI) listActions(espID string) {
+	d, err := cli.apiClient().Info(cli.clientCtx, espID)
+	if errors.Is(err, wod.ErrNotFound) {
+		fmt.Printf("ESP '%s' not registered\n", espID)
+		os.Exit(cli.exitStatus(err))
+	} else if err != nil {
+		cli.exitOnClientError(err)
+	}
+	switch cli.outputMode {
+	case outputJSON:
+		printJSON(d.Actions)
+		return
+	case outputPlain:
+		for _, a := range d.Actions {
+			printRecord(a.Name, a.Description)
+		}
+		return
+	}
+	if len(d.Actions) == 0 {
+		fmt.Printf("%s declares no actions\n", espID)
+		return
+	}
+	fmt.Printf("Actions of %s:\n", espID)
+	for _, a := range d.Actions {
+		if a.Description != "" {
+			fmt.Printf("  %-16s %s\n", a.Name, a.Description)
+		} else {
+			fmt.Printf("  %s\n", a.Name)
+		}
+	}
+}
+
+// formatActions is the action list shown by info.
+func formatActions(actions []wod.Action) string {
+	names := make([]string, len(actions))
+	for i, a := range actions {
+		names[i] = a.Name
+	}
+	return strings.Join(names, ", ")
+}
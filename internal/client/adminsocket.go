@@ -0,0 +1,49 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// --- Client Mode ---
+
+// serverLabel is where client commands say they connect to.
+func (cli *CLI) serverLabel() string {
+	if cli.unixServerPath != "" {
+		return "unix://" + cli.unixServerPath
+	}
+	return cli.serverURL
+}
+
+// adminsocketState holds the CLI state kept in adminsocket.go.
+type adminsocketState struct {
+	// unixServerPath is set when -server is a unix:// URL.
+	unixServerPath string
+}
+
+// setupUnixClient points the HTTP client at the socket in a
+// unix:///path/to.sock server URL.
+func (cli *CLI) setupUnixClient() error {
+	path, ok := strings.CutPrefix(cli.serverURL, "unix://")
+	if !ok {
+		return nil
+	}
+	if path == "" {
+		return fmt.Errorf("-server %q has no socket path", cli.serverURL)
+	}
+	cli.unixServerPath = path
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", path)
+	}
+	cli.clientTransport = transport
+	cli.httpClient = &http.Client{Transport: retryTransport{base: cli.clientTransport, cli: cli}}
+	// Any host will do; it only ends up in the Host header
+	cli.serverURL = "http://localhost"
+	return nil
+}
@@ -0,0 +1,123 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/smileyfaceskobochka/trashbin-daemon/internal/server"
+)
+
+// --- Agent Mode ---
+
+func defaultShutdownCommand() string {
+	switch runtime.GOOS {
+	case "windows":
+		return "shutdown /s /t 0"
+	case "linux":
+		if _, err := exec.LookPath("systemctl"); err == nil {
+			return "systemctl poweroff"
+		}
+	}
+	return "shutdown -h now"
+}
+
+func (cli *CLI) runAgent(args []string) {
+	fs := flag.NewFlagSet("agent", flag.ExitOnError)
+	interval := fs.Duration("interval", 5*time.Second, "How often to check in with the server")
+	token := fs.String("token", "", "The ESP's registration token, if it has one")
+	shutdownCmd := fs.String("shutdown-command", defaultShutdownCommand(), "Command that powers the machine off")
+	dryRun := fs.Bool("dry-run", false, "Acknowledge soft-off without shutting down")
+	fs.Usage = func() {
+		fmt.Println("Usage: wake-on-demand [-server <url>] agent [-interval 5s] [-token <t>] [-shutdown-command <cmd>] [-dry-run] <esp_id>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	espID := cli.resolveAlias(fs.Arg(0))
+
+	hostname, _ := os.Hostname()
+	var activity activitySampler
+	alog := cli.logger("agent").With("esp_id", espID)
+	alog.Info("Agent started", "server", cli.serverURL, "interval", interval.String(), "shutdown_command", *shutdownCmd)
+
+	for ; ; time.Sleep(*interval) {
+		query := activity.sample()
+		query.Set("id", espID)
+		query.Set("hostname", hostname)
+		query.Set("os", runtime.GOOS)
+		cmd, err := cli.agentPoll(query.Encode(), *token)
+		if err != nil {
+			alog.Warn("Check-in failed", "error", err)
+			continue
+		}
+		if cmd.Command != string(server.CommandSoftOff) {
+			continue
+		}
+
+		alog.Info("Soft-off requested", "command_id", cmd.CommandID)
+		if *dryRun {
+			cli.agentAck(espID, cmd.CommandID, *token, nil)
+			continue
+		}
+		// Ack as soon as the shutdown starts; the network may be gone before it exits
+		fields := strings.Fields(*shutdownCmd)
+		shutdown := exec.Command(fields[0], fields[1:]...)
+		if err := shutdown.Start(); err != nil {
+			alog.Error("Shutdown command failed", "error", err)
+			cli.agentAck(espID, cmd.CommandID, *token, err)
+			continue
+		}
+		cli.agentAck(espID, cmd.CommandID, *token, nil)
+		if err := shutdown.Wait(); err != nil {
+			alog.Error("Shutdown command failed", "error", err)
+		}
+	}
+}
+
+func (cli *CLI) agentPoll(query, token string) (server.AgentCommand, error) {
+	var cmd server.AgentCommand
+	req, _ := http.NewRequest(http.MethodGet, cli.serverURL+server.APIPrefix+"/agent?"+query, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := cli.httpClient.Do(req)
+	if err != nil {
+		return cmd, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return cmd, errors.New(responseError(resp))
+	}
+	return cmd, json.NewDecoder(resp.Body).Decode(&cmd)
+}
+
+func (cli *CLI) agentAck(espID, commandID, token string, failure error) {
+	data := map[string]interface{}{"id": espID, "command_id": commandID, "success": failure == nil}
+	if failure != nil {
+		data["error"] = failure.Error()
+	}
+	body, _ := json.Marshal(data)
+	req, _ := http.NewRequest(http.MethodPost, cli.serverURL+server.APIPrefix+"/command-ack", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := cli.httpClient.Do(req)
+	if err != nil {
+		cli.logger("agent").Warn("Ack failed", "command_id", commandID, "error", err)
+		return
+	}
+	resp.Body.Close()
+}
@@ -0,0 +1,11 @@
+package client
+
+import (
+	"net/http"
+)
+
+func (cli *CLI) setAuthHeader(req *http.Request) {
+	if cli.adminKey != "" {
+		req.Header.Set("Authorization", "Bearer "+cli.adminKey)
+	}
+}
@@ -0,0 +1,144 @@
+package client
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/smileyfaceskobochka/trashbin-daemon/internal/server"
+)
+
+// --- Client Mode ---
+
+func (cli *CLI) runBackupCommand(args []string) {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	out := fs.String("o", "", "Write to this file, or - for stdout (default: the server's file name)")
+	fs.Usage = func() {
+		fmt.Println("Usage: wake-on-demand backup [-o <file|->]")
+		fmt.Println("The backup holds token hashes and device secrets; keep it private")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	resp := cli.backupRequest("/admin/backup", nil)
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		fmt.Printf("Error: Could not read backup: %v\n", err)
+		os.Exit(1)
+	}
+	if *out == "-" {
+		os.Stdout.Write(data)
+		return
+	}
+	name := *out
+	if name == "" {
+		_, params, _ := mime.ParseMediaType(resp.Header.Get("Content-Disposition"))
+		name = filepath.Base(cmp.Or(params["filename"], server.BackupPrefix+cli.now().UTC().Format("20060102T150405Z")+server.BackupSuffix))
+	}
+	if err := os.WriteFile(name, data, 0o600); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Backup written to %s (%d bytes)\n", name, len(data))
+}
+
+func (cli *CLI) runRestoreCommand(args []string) {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "Only report what would change")
+	fs.Usage = func() {
+		fmt.Println("Usage: wake-on-demand restore [-dry-run] <file|->")
+		fmt.Println("Replaces the server's configuration and event log with the backup's")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	var data []byte
+	var err error
+	if fs.Arg(0) == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(fs.Arg(0))
+	}
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if _, _, _, err := server.ReadBackup(data); err != nil {
+		fmt.Printf("Error: %s is not a valid backup: %v\n", fs.Arg(0), err)
+		os.Exit(1)
+	}
+
+	path := "/admin/restore"
+	if *dryRun {
+		path += "?dry_run=true"
+	}
+	resp := cli.backupRequest(path, data)
+	defer resp.Body.Close()
+	var result server.RestoreResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		fmt.Println("Error decoding response")
+		os.Exit(1)
+	}
+
+	switch cli.outputMode {
+	case outputJSON:
+		printJSON(result)
+		return
+	case outputPlain:
+		printRecord(result)
+		return
+	}
+	verb := "Restored"
+	if result.DryRun {
+		verb = "Would restore"
+	}
+	fmt.Printf("%s the backup from %s:\n", verb, result.CreatedAt.Local().Format(time.DateTime))
+	for _, p := range result.Parts() {
+		fmt.Printf("  %-10s %d added, %d updated, %d removed\n", p.Name+":", p.Added, p.Updated, p.Removed)
+	}
+	fmt.Printf("  %-10s %d\n", "events:", result.Events)
+}
+
+func (cli *CLI) backupRequest(path string, body []byte) *http.Response {
+	req, _ := http.NewRequest(http.MethodPost, cli.serverURL+server.APIPrefix+path, bytes.NewReader(body))
+	if body != nil {
+		req.Header.Set("Content-Type", "application/gzip")
+	}
+	cli.setAuthHeader(req)
+
+	resp, err := cli.httpClient.Do(req)
+	if err != nil {
+		cli.exitOnRequestError(err)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp
+	case http.StatusUnauthorized:
+		fmt.Println("Error: Unauthorized (check -admin-key)")
+	case http.StatusForbidden:
+		fmt.Println("Error: Backup and restore require the admin role")
+	default:
+		fmt.Printf("Error: %s\n", responseError(resp))
+	}
+	resp.Body.Close()
+	os.Exit(httpExitStatus(resp.StatusCode))
+	return nil
+}
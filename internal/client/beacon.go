@@ -0,0 +1,14 @@
+package client
+
+import (
+	"fmt"
+	"time"
+
+	wod "github.com/smileyfaceskobochka/trashbin-daemon/pkg/client"
+)
+
+// --- Client Mode ---
+
+func (cli *CLI) formatBeacon(b *wod.Beacon) string {
+	return fmt.Sprintf("%s ago from %s", cli.now().Sub(b.LastSeen).Round(time.Second), b.Addr)
+}
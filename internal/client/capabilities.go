@@ -0,0 +1,17 @@
+package client
+
+import (
+	"fmt"
+	"strings"
+
+	wod "github.com/smileyfaceskobochka/trashbin-daemon/pkg/client"
+)
+
+// --- Client Mode ---
+
+func formatCapabilities(c *wod.Capabilities) string {
+	if len(c.Features) == 0 {
+		return fmt.Sprintf("%d, no features", c.Protocol)
+	}
+	return fmt.Sprintf("%d, %s", c.Protocol, strings.Join(c.Features, ", "))
+}
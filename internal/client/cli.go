@@ -0,0 +1,348 @@
+// Package client is the wake-on-demand command line client: every command
+// other than server and healthcheck, from listing devices to installing
+// the service. main builds one with New and hands it the command with Run.
+package client
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/smileyfaceskobochka/trashbin-daemon/internal/server"
+)
+
+// CLI runs the client commands against a server: the settings they share,
+// like the server URL, credentials and output format, and the HTTP client
+// they use. Make one with New.
+type CLI struct {
+	// now is the client's clock, see WithClock
+	now func() time.Time
+
+	adminsocketState
+	cliState
+	controlState
+	httpclientState
+	loggingState
+	namespaceState
+	outputState
+	tlsState
+}
+
+// Option changes how New builds a CLI.
+type Option func(*CLI)
+
+// WithClock makes the client read the time from now instead of the wall
+// clock, for tests.
+func WithClock(now func() time.Time) Option {
+	return func(cli *CLI) { cli.now = now }
+}
+
+// WithLogger sets the logger that the commands that log, like the agent
+// and the simulator, derive theirs from, slog.Default() otherwise.
+func WithLogger(l *slog.Logger) Option {
+	return func(cli *CLI) { cli.baseLogger = l }
+}
+
+// New returns a client set up from fs and cfg; see configure. fs must have
+// been parsed, with the client's flags defined by RegisterFlags.
+func New(fs *flag.FlagSet, cfg *server.Config, opts ...Option) (*CLI, error) {
+	cli := newCLI()
+	for _, opt := range opts {
+		opt(cli)
+	}
+	if err := cli.configure(fs, cfg); err != nil {
+		return nil, err
+	}
+	return cli, nil
+}
+
+// newCLI returns a CLI in its initial state, with no flags applied.
+func newCLI() *CLI {
+	cli := &CLI{now: time.Now}
+	cli.config = &server.Config{}
+	cli.requestTimeout = defaultRequestTimeout
+	cli.requestRetries = defaultRetries
+	cli.clientCtx = context.Background()
+	cli.baseLogger = slog.Default()
+	cli.outputMode = outputTable
+	cli.httpClient = http.DefaultClient
+	cli.clientTransport = http.DefaultTransport
+	return cli
+}
+
+// RegisterFlags defines the flags of client commands.
+func RegisterFlags(fs *flag.FlagSet) {
+	fs.String("server", "http://localhost:8080", "Server URL for client commands, or auto to find one over mDNS")
+	fs.String("ca-cert", "", "CA certificate the client trusts for https:// servers")
+	fs.Bool("insecure", false, "Skip TLS certificate verification in the client")
+	fs.Duration("request-timeout", defaultRequestTimeout, "Client timeout for each request to the server (0 waits forever)")
+	fs.Int("retries", defaultRetries, "How many times the client retries a failed read-only request")
+	fs.String("o", "table", "Client output format: table, plain or json")
+	fs.String("namespace", "", "Client namespace that bare ESP IDs belong to")
+	fs.Bool("q", false, "Print nothing; report the result through the exit code only")
+}
+
+// cliState holds the CLI state kept in cli.go.
+type cliState struct {
+	// config is the config file client commands were started with
+	config     *server.Config
+	configPath string
+
+	// adminKey authenticates client commands: -admin-key, auth.admin_key
+	// or the admin_key in -auth-file, in that order
+	adminKey string
+
+	// servicePort is the -port the service installers start the server
+	// with
+	servicePort string
+	// drainTimeout is the server's -drain-timeout, which the Windows
+	// service commands wait out
+	drainTimeout time.Duration
+}
+
+// flagValue returns the value of the named flag, or its zero value when fs
+// doesn't define it.
+func flagValue[T any](fs *flag.FlagSet, name string) T {
+	var v T
+	if f := fs.Lookup(name); f != nil {
+		v, _ = f.Value.(flag.Getter).Get().(T)
+	}
+	return v
+}
+
+// configure resolves the client's settings from fs, which must have been
+// parsed, and cfg. Flags that were set take precedence over cfg.
+func (cli *CLI) configure(fs *flag.FlagSet, cfg *server.Config) error {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	cli.config, cli.configPath = cfg, flagValue[string](fs, "config")
+
+	format, err := parseOutputFormat(flagValue[string](fs, "o"))
+	if err != nil {
+		return err
+	}
+	cli.outputMode = format
+	if ns := flagValue[string](fs, "namespace"); ns != "" {
+		if err := server.ValidateNamespace(ns); err != nil {
+			return fmt.Errorf("-namespace: %v", err)
+		}
+		cli.clientNamespace = ns
+	}
+	if flagValue[bool](fs, "q") {
+		setQuiet()
+	}
+
+	cli.serverURL = flagValue[string](fs, "server")
+	if !set["server"] && cfg.Server != "" {
+		cli.serverURL = cfg.Server
+	}
+	cli.servicePort = flagValue[string](fs, "port")
+	if !set["port"] && cfg.Port != "" {
+		cli.servicePort = cfg.Port
+	}
+	cli.drainTimeout = flagValue[time.Duration](fs, "drain-timeout")
+	if !set["drain-timeout"] && cfg.DrainTimeout > 0 {
+		cli.drainTimeout = cfg.DrainTimeout
+	}
+	cli.adminKey = cmp.Or(flagValue[string](fs, "admin-key"), cfg.Auth.AdminKey)
+	if path := flagValue[string](fs, "auth-file"); path != "" {
+		file := server.AuthConfig{AdminKey: cli.adminKey, ESPTokens: make(map[string]string), NamespaceTokens: make(map[string]string)}
+		if err := server.LoadAuthFile(path, &file); err != nil {
+			return fmt.Errorf("could not load auth file: %v", err)
+		}
+		cli.adminKey = file.AdminKey
+	}
+	cli.clientCAFile = flagValue[string](fs, "ca-cert")
+	if !set["ca-cert"] {
+		cli.clientCAFile = cfg.TLS.CA
+	}
+	cli.clientInsecure = flagValue[bool](fs, "insecure")
+	if !set["insecure"] {
+		cli.clientInsecure = cfg.TLS.Insecure
+	}
+	cli.requestTimeout, cli.requestRetries = flagValue[time.Duration](fs, "request-timeout"), flagValue[int](fs, "retries")
+	if cli.requestTimeout < 0 || cli.requestRetries < 0 {
+		return errors.New("-request-timeout and -retries cannot be negative")
+	}
+	if err := cli.setupHTTPClient(); err != nil {
+		return fmt.Errorf("could not load CA certificate: %v", err)
+	}
+	return cli.setupUnixClient()
+}
+
+// Run runs cmd, any command but server and healthcheck, with args[0] being
+// cmd itself.
+func (cli *CLI) Run(cmd string, args []string) {
+	switch {
+	case cli.serverURL != "auto":
+	case cmd == "discover", cmd == "completion", cmd == "wol", cmd == "config":
+	default:
+		cli.resolveAutoServer()
+	}
+	if cmd != "agent" {
+		cli.watchInterrupt()
+	}
+
+	switch cmd {
+	case "config":
+		cli.runConfigCommand(args[1:])
+	case "on", "off", "status", "soft-off":
+		espID, opts := cli.parseCommandArgs(cmd, args[1:])
+		cli.sendCommand(cmd, cli.resolveAlias(espID), opts)
+	case "action":
+		cli.runAction(args[1:])
+	case "up":
+		cli.runUp(args[1:])
+	case "wait":
+		cli.runWait(args[1:])
+	case "timeout":
+		if len(args) < 3 {
+			fmt.Println("Usage: wake-on-demand timeout <esp_id> <duration|auto>")
+			os.Exit(1)
+		}
+		cli.setTimeout(cli.resolveAlias(args[1]), args[2])
+	case "pulse":
+		if len(args) < 3 {
+			fmt.Println("Usage: wake-on-demand pulse <esp_id> <on_duration|default> [off_duration|default]")
+			os.Exit(1)
+		}
+		cli.setPulse(cli.resolveAlias(args[1]), args[2:])
+	case "wol":
+		if len(args) < 2 {
+			fmt.Println("Usage: wake-on-demand wol <mac> [broadcast]")
+			os.Exit(1)
+		}
+		sendWoL(args[1], optionalArg(args, 2))
+	case "add-wol":
+		if len(args) < 3 {
+			fmt.Println("Usage: wake-on-demand add-wol <id> <mac> [broadcast]")
+			os.Exit(1)
+		}
+		cli.addWoLDevice(args[1], args[2], optionalArg(args, 3))
+	case "add-device":
+		cli.addDriverDevice(args[1:])
+	case "list":
+		cli.listESPs(args[1:])
+	case "info":
+		if len(args) < 2 {
+			fmt.Println("Usage: wake-on-demand info <esp_id>")
+			os.Exit(1)
+		}
+		cli.showInfo(cli.resolveAlias(args[1]))
+	case "queue", "flush":
+		if len(args) < 2 {
+			fmt.Printf("Usage: wake-on-demand %s <esp_id>\n", cmd)
+			os.Exit(1)
+		}
+		if cmd == "queue" {
+			cli.showQueue(cli.resolveAlias(args[1]))
+		} else {
+			cli.flushESPQueue(cli.resolveAlias(args[1]))
+		}
+	case "target":
+		if len(args) < 3 {
+			fmt.Println("Usage: wake-on-demand target <esp_id> <host> [icmp|tcp:<port>|ssh[:<port>]] [-verify <window>] [-retries <n>]")
+			fmt.Println("       wake-on-demand target <esp_id> none")
+			os.Exit(1)
+		}
+		cli.setTarget(cli.resolveAlias(args[1]), args[2:])
+	case "schedule":
+		cli.runScheduleCommand(args[1:])
+	case "user":
+		cli.runUserCommand(args[1:])
+	case "secret":
+		cli.runSecretCommand(args[1:])
+	case "group":
+		cli.runGroupCommand(args[1:])
+	case "unpin":
+		if len(args) < 2 {
+			fmt.Println("Usage: wake-on-demand unpin <esp_id>")
+			os.Exit(1)
+		}
+		cli.resetPin(cli.resolveAlias(args[1]))
+	case "approve":
+		cli.runApprove(args[1:])
+	case "maintenance":
+		cli.runMaintenance(args[1:])
+	case "edit":
+		cli.runEdit(args[1:])
+	case "watch":
+		cli.runWatch(args[1:])
+	case "tui":
+		cli.runTUI(args[1:])
+	case "remove":
+		if len(args) < 2 {
+			fmt.Println("Usage: wake-on-demand remove <esp_id>")
+			os.Exit(1)
+		}
+		cli.removeDevice(cli.resolveAlias(args[1]))
+	case "events":
+		cli.runEventsCommand(args[1:])
+	case "ota":
+		cli.runOTACommand(args[1:])
+	case "agent":
+		cli.runAgent(args[1:])
+	case "simulate-esp":
+		cli.runSimulateESP(args[1:])
+	case "simulate":
+		cli.runSimulate(args[1:])
+	case "notify":
+		cli.runNotifyCommand(args[1:])
+	case "webhooks":
+		cli.runWebhooksCommand(args[1:])
+	case "hooks":
+		cli.runHooksCommand(args[1:])
+	case "run":
+		cli.runMacroCommand(args[1:])
+	case "macros":
+		cli.runMacrosCommand(args[1:])
+	case "quota":
+		cli.runQuotaCommand(args[1:])
+	case "reload":
+		cli.runReload()
+	case "export":
+		cli.runExport(args[1:])
+	case "import":
+		cli.runImport(args[1:])
+	case "backup":
+		cli.runBackupCommand(args[1:])
+	case "restore":
+		cli.runRestoreCommand(args[1:])
+	case "discover":
+		cli.runDiscover(args[1:])
+	case "ups":
+		cli.runUPS()
+	case "install-service":
+		cli.runInstallService(args[1:])
+	case "uninstall-service", "start-service", "stop-service":
+		cli.runServiceControl(cmd)
+	case "completion":
+		cli.runCompletion(args[1:])
+	case "proxy":
+		cli.runProxy(args[1:])
+	case "history":
+		cli.runHistory(args[1:])
+	case "telemetry":
+		cli.runTelemetry(args[1:])
+	case "uptime":
+		cli.runUptime(args[1:])
+	case "self-update":
+		cli.runSelfUpdate(args[1:])
+	case "result":
+		if len(args) < 2 {
+			fmt.Println("Usage: wake-on-demand result <command_id>")
+			os.Exit(1)
+		}
+		cli.showResult(args[1])
+	default:
+		fmt.Printf("Unknown command: %s\n", cmd)
+		PrintUsage()
+		os.Exit(1)
+	}
+}
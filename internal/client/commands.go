@@ -0,0 +1,176 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/smileyfaceskobochka/trashbin-daemon/internal/server"
+	wod "github.com/smileyfaceskobochka/trashbin-daemon/pkg/client"
+)
+
+// --- Client Mode ---
+
+// statusResultWait is how long 'status' waits for the ESP to report back.
+const statusResultWait = 15 * time.Second
+
+func (cli *CLI) showResult(commandID string) {
+	rec, err := cli.apiClient().CommandResult(cli.clientCtx, commandID)
+	if errors.Is(err, wod.ErrNotFound) {
+		fmt.Printf("Command '%s' not found\n", commandID)
+		os.Exit(cli.exitStatus(err))
+	} else if err != nil {
+		cli.exitOnClientError(err)
+	}
+
+	switch cli.outputMode {
+	case outputJSON:
+		printJSON(rec)
+	case outputPlain:
+		printRecord(rec.ID, rec.ESPID, rec.Command, rec.Status, rec.QueuedAt, rec.DeliveredAt, rec.CompletedAt, rec.Error, formatCommandResult(rec.Result))
+	default:
+		printResult(rec)
+	}
+	if rec.Status == wod.StateFailed || rec.Status == wod.StateExpired {
+		os.Exit(1)
+	}
+}
+
+// showStatusResult waits for the ESP's report on a status command and
+// prints what it measured.
+func (cli *CLI) showStatusResult(espID string, resp *wod.CommandResponse) {
+	if cli.outputMode == outputTable {
+		fmt.Printf("Status requested from %s, waiting for its report...\n", espID)
+	}
+	ctx, cancel := context.WithTimeout(cli.clientCtx, statusResultWait)
+	defer cancel()
+	rec, err := cli.apiClient().WaitForCommand(ctx, resp.CommandID, 500*time.Millisecond)
+	if errors.Is(err, context.DeadlineExceeded) {
+		if cli.outputMode == outputJSON {
+			printJSON(resp)
+		} else {
+			fmt.Printf("No report from %s within %s (check later with: wake-on-demand result %s)\n", espID, statusResultWait, resp.CommandID)
+		}
+		os.Exit(1)
+	} else if err != nil {
+		cli.exitOnClientError(err)
+	}
+
+	switch cli.outputMode {
+	case outputJSON:
+		printJSON(rec)
+	case outputPlain:
+		printRecord(rec.ID, rec.ESPID, rec.Status, formatCommandResult(rec.Result))
+	default:
+		switch {
+		case rec.Status != wod.StateAcked:
+			fmt.Printf("Status %s on %s: %s\n", rec.Status, espID, rec.Error)
+		case len(rec.Result) == 0:
+			fmt.Printf("%s acknowledged status without reporting anything\n", espID)
+		default:
+			fmt.Printf("%s reported:\n", espID)
+			printResultFields("  ", rec.Result)
+		}
+	}
+	if rec.Status != wod.StateAcked {
+		os.Exit(1)
+	}
+}
+
+// formatCommandResult joins a result payload as sorted key=value pairs.
+func formatCommandResult(result map[string]interface{}) string {
+	keys := slices.Sorted(maps.Keys(result))
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = fmt.Sprintf("%s=%v", k, result[k])
+	}
+	return strings.Join(pairs, " ")
+}
+
+func printResultFields(indent string, result map[string]interface{}) {
+	for _, k := range slices.Sorted(maps.Keys(result)) {
+		fmt.Printf("%s%-10s %v\n", indent, k+":", result[k])
+	}
+}
+
+func printResult(rec *wod.CommandRecord) {
+	fmt.Printf("Command %s (%s → %s): %s\n", rec.ID, rec.Command, rec.ESPID, rec.Status)
+	fmt.Printf("  Queued:    %s\n", rec.QueuedAt.Local().Format(time.DateTime))
+	if rec.ExpiresAt != nil && (rec.Status == wod.StateQueued || rec.Status == wod.StateExpired) {
+		fmt.Printf("  Expires:   %s\n", rec.ExpiresAt.Local().Format(time.DateTime))
+	}
+	if rec.DeliveredAt != nil {
+		fmt.Printf("  Delivered: %s\n", rec.DeliveredAt.Local().Format(time.DateTime))
+	}
+	if rec.CompletedAt != nil {
+		fmt.Printf("  Completed: %s\n", rec.CompletedAt.Local().Format(time.DateTime))
+	}
+	if v := rec.Verify; v != nil {
+		fmt.Printf("  Verify:    %d of %d pulse(s), %s each", v.Attempts, v.Retries+1, time.Duration(v.WindowMS)*time.Millisecond)
+		if v.UpAt != nil {
+			fmt.Printf(", target up at %s", v.UpAt.Local().Format(time.DateTime))
+		}
+		fmt.Println()
+	}
+	if rec.Error != "" {
+		fmt.Printf("  Error:     %s\n", rec.Error)
+	}
+	if len(rec.Result) > 0 {
+		fmt.Println("  Result:")
+		printResultFields("    ", rec.Result)
+	}
+}
+
+func (cli *CLI) runHistory(args []string) {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	limit := fs.Int("limit", server.CommandHistorySize, "Maximum number of commands")
+	fs.Usage = func() {
+		fmt.Println("Usage: wake-on-demand history [-limit 50] <esp_id>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() < 1 || *limit < 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	espID := cli.resolveAlias(fs.Arg(0))
+
+	history, err := cli.apiClient().History(cli.clientCtx, espID, *limit)
+	if errors.Is(err, wod.ErrNotFound) {
+		fmt.Printf("ESP '%s' not registered\n", espID)
+		os.Exit(cli.exitStatus(err))
+	} else if err != nil {
+		cli.exitOnClientError(err)
+	}
+
+	switch cli.outputMode {
+	case outputJSON:
+		printJSON(history)
+		return
+	case outputPlain:
+		for _, rec := range history {
+			printRecord(rec.QueuedAt, rec.ID, rec.Command, rec.Status, rec.Actor, rec.Error, formatCommandResult(rec.Result))
+		}
+		return
+	}
+
+	if len(history) == 0 {
+		fmt.Printf("No commands sent to %s yet\n", espID)
+		return
+	}
+	fmt.Printf("Commands sent to %s, newest first:\n", espID)
+	for _, rec := range history {
+		outcome := rec.Error
+		if outcome == "" {
+			outcome = formatCommandResult(rec.Result)
+		}
+		line := fmt.Sprintf("  %s  %-8s %-9s %-24s %s  %s", rec.QueuedAt.Local().Format(time.DateTime), rec.Command, rec.Status, rec.Actor, rec.ID, outcome)
+		fmt.Println(strings.TrimRight(line, " "))
+	}
+}
@@ -0,0 +1,336 @@
+package client
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Completion scripts are generated from the command and flag tables below,
+// and complete device names by running 'completion devices', which asks
+// the server for its device list.
+
+// deviceCommands take an ESP ID or alias as their first argument.
+var deviceCommands = []string{
+	"on", "off", "status", "soft-off", "action", "up", "wait", "pulse", "timeout", "info", "queue", "flush",
+	"target", "unpin", "approve", "maintenance", "edit", "remove", "events", "history", "uptime", "telemetry", "agent", "simulate-esp",
+}
+
+// subcommands lists each command's subcommands. The scripts also complete
+// ESP IDs for schedule add and the group and user member arguments.
+var subcommands = map[string][]string{
+	"schedule":   {"add", "list", "remove"},
+	"group":      {"create", "list", "delete", "add", "remove"},
+	"user":       {"add", "list", "remove", "grant", "revoke", "passwd"},
+	"secret":     {"issue", "list", "revoke"},
+	"ota":        {"upload", "list", "remove"},
+	"config":     {"validate"},
+	"notify":     {"test"},
+	"webhooks":   {"list", "deliveries", "test"},
+	"hooks":      {"runs", "run"},
+	"macros":     {"list", "runs"},
+	"quota":      {"reset"},
+	"completion": {"bash", "zsh", "fish"},
+}
+
+var otherCommands = []string{
+	"server", "list", "tui", "watch", "wol", "add-wol", "add-device", "result",
+	"install-service", "start-service", "stop-service", "uninstall-service", "healthcheck", "reload", "export", "import", "backup", "restore", "proxy", "discover", "ups", "simulate", "self-update", "run",
+}
+
+// forwardFlags are passed on to 'completion devices' so it reaches the
+// same server as the command being completed.
+var forwardFlags = []string{"server", "admin-key", "config", "ca-cert", "insecure"}
+
+func (cli *CLI) runCompletion(args []string) {
+	if len(args) < 1 {
+		fmt.Println("Usage: wake-on-demand completion <bash|zsh|fish>")
+		os.Exit(1)
+	}
+	switch args[0] {
+	case "bash":
+		fmt.Print(completionScript(bashCompletion))
+	case "zsh":
+		fmt.Print(completionScript(zshCompletion))
+	case "fish":
+		fmt.Print(completionScript(fishCompletion))
+	case "devices":
+		cli.printDeviceNames()
+	default:
+		fmt.Printf("Error: Unknown shell %q (use bash, zsh or fish)\n", args[0])
+		os.Exit(1)
+	}
+}
+
+// printDeviceNames prints every device ID and alias, one per line. Errors
+// print nothing: the shell just offers no names.
+func (cli *CLI) printDeviceNames() {
+	devices, err := cli.apiClient().List(cli.clientCtx)
+	if err != nil {
+		os.Exit(1)
+	}
+	var names []string
+	for _, d := range devices {
+		names = append(names, d.ID)
+		if d.Alias != "" {
+			names = append(names, d.Alias)
+		}
+	}
+	for alias := range cli.config.Aliases {
+		names = append(names, alias)
+	}
+	slices.Sort(names)
+	for _, name := range slices.Compact(names) {
+		fmt.Println(name)
+	}
+}
+
+func completionScript(script string) string {
+	commands := append(slices.Clone(deviceCommands), otherCommands...)
+	var subcases, fishSubs []string
+	for cmd, subs := range subcommands {
+		commands = append(commands, cmd)
+		subcases = append(subcases, fmt.Sprintf("        %s) choices=%q ;;", cmd, strings.Join(subs, " ")))
+		fishSubs = append(fishSubs, fmt.Sprintf("complete -c wake-on-demand -n '__wod_command_is %s; and __wod_arg_count 0' -a '%s'", cmd, strings.Join(subs, " ")))
+	}
+	slices.Sort(commands)
+	slices.Sort(subcases)
+	slices.Sort(fishSubs)
+
+	var flags, valueFlags, forwardValue, forwardBool, fishFlags []string
+	flag.CommandLine.VisitAll(func(f *flag.Flag) {
+		flags = append(flags, "-"+f.Name)
+		isBool := false
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok {
+			isBool = b.IsBoolFlag()
+		}
+		fishFlag := fmt.Sprintf("complete -c wake-on-demand -n 'test (count (__wod_command)) -eq 0' -o %s -d '%s'", f.Name, strings.ReplaceAll(f.Usage, "'", `\'`))
+		if !isBool {
+			valueFlags = append(valueFlags, "-"+f.Name)
+			fishFlag += " -r -F"
+		}
+		fishFlags = append(fishFlags, fishFlag)
+		if slices.Contains(forwardFlags, f.Name) {
+			if isBool {
+				forwardBool = append(forwardBool, "-"+f.Name)
+			} else {
+				forwardValue = append(forwardValue, "-"+f.Name)
+			}
+		}
+	})
+
+	return strings.NewReplacer(
+		"@COMMANDS@", strings.Join(commands, " "),
+		"@DEVICE_COMMANDS@", strings.Join(deviceCommands, "|"),
+		"@DEVICE_COMMANDS_FISH@", strings.Join(deviceCommands, " "),
+		"@SUBCOMMAND_CASES@", strings.Join(subcases, "\n"),
+		"@FISH_SUBCOMMANDS@", strings.Join(fishSubs, "\n"),
+		"@FLAGS@", strings.Join(flags, " "),
+		"@FISH_FLAGS@", strings.Join(fishFlags, "\n"),
+		"@VALUE_FLAGS@", strings.Join(valueFlags, "|"),
+		"@VALUE_FLAGS_FISH@", strings.Join(valueFlags, " "),
+		"@FORWARD_VALUE@", strings.Join(forwardValue, "|"),
+		"@FORWARD_VALUE_FISH@", strings.Join(forwardValue, " "),
+		"@FORWARD_BOOL@", strings.Join(forwardBool, "|"),
+		"@FORWARD_BOOL_FISH@", strings.Join(forwardBool, " "),
+	).Replace(script)
+}
+
+// The scripts share one idea: skip global flags (and their values) to find
+// the command, collect the flags that pick the server, and then complete
+// subcommands or device names by the argument's position.
+
+const bashCompletion = `# bash completion for wake-on-demand
+# Load with: source <(wake-on-demand completion bash)
+
+_wake_on_demand_devices() {
+    "${_wod_words[0]}" "${_wod_forward[@]}" -request-timeout 2s -retries 0 completion devices 2>/dev/null
+}
+
+_wake_on_demand() {
+    # COMP_WORDS splits server URLs and vm: IDs at the colon, so split the
+    # line on spaces instead
+    local -a _wod_words
+    read -ra _wod_words <<<"${COMP_LINE:0:COMP_POINT}"
+    [[ ${COMP_LINE:COMP_POINT-1:1} == " " ]] && _wod_words+=("")
+    local cword=$((${#_wod_words[@]} - 1))
+    local cur=${_wod_words[cword]} prev=${_wod_words[cword-1]}
+    local i word cmd= cmdpos=0 choices=
+    _wod_forward=()
+    for ((i = 1; i < cword; i++)); do
+        word=${_wod_words[i]}
+        case $word in
+        @FORWARD_VALUE@) _wod_forward+=("$word" "${_wod_words[i+1]}"); ((i++)) ;;
+        @FORWARD_BOOL@) _wod_forward+=("$word") ;;
+        @VALUE_FLAGS@) ((i++)) ;;
+        -*) ;;
+        *) cmd=$word; cmdpos=$i; break ;;
+        esac
+    done
+
+    if [[ -z $cmd ]]; then
+        case $prev in
+        @VALUE_FLAGS@) COMPREPLY=($(compgen -f -- "$cur")); return ;;
+        esac
+        if [[ $cur == -* ]]; then
+            COMPREPLY=($(compgen -W "@FLAGS@" -- "$cur"))
+        else
+            COMPREPLY=($(compgen -W "@COMMANDS@" -- "$cur"))
+        fi
+        return
+    fi
+
+    local arg=$((cword - cmdpos)) sub=${_wod_words[cmdpos+1]}
+    [[ $cur == -* ]] && return
+    case $cmd in
+    @DEVICE_COMMANDS@)
+        [[ $arg == 1 ]] && choices=$(_wake_on_demand_devices) ;;
+    schedule)
+        [[ $arg == 2 && $sub == add ]] && choices=$(_wake_on_demand_devices) ;;
+    group | user)
+        case $sub in
+        create | add | remove | grant | revoke) [[ $arg -ge 3 ]] && choices=$(_wake_on_demand_devices) ;;
+        esac ;;
+    esac
+    if [[ $arg == 1 ]]; then
+        case $cmd in
+@SUBCOMMAND_CASES@
+        esac
+    fi
+    COMPREPLY=($(compgen -W "$choices" -- "$cur"))
+    # Readline only replaces the part after the last colon
+    if [[ $cur == *:* ]]; then
+        COMPREPLY=("${COMPREPLY[@]#"${cur%"${cur##*:}"}"}")
+    fi
+}
+
+complete -o default -F _wake_on_demand wake-on-demand
+`
+
+const zshCompletion = `#compdef wake-on-demand
+# zsh completion for wake-on-demand
+# Load with: source <(wake-on-demand completion zsh), or save as _wake-on-demand in $fpath
+
+_wake_on_demand_devices() {
+    local -a names
+    names=(${(f)"$("${words[1]}" "${forward[@]}" -request-timeout 2s -retries 0 completion devices 2>/dev/null)"})
+    compadd -a names
+}
+
+_wake_on_demand() {
+    local i word cmd= cmdpos=0
+    local -a forward
+    for ((i = 2; i < CURRENT; i++)); do
+        word=${words[i]}
+        case $word in
+        @FORWARD_VALUE@) forward+=("$word" "${words[i+1]}"); ((i++)) ;;
+        @FORWARD_BOOL@) forward+=("$word") ;;
+        @VALUE_FLAGS@) ((i++)) ;;
+        -*) ;;
+        *) cmd=$word; cmdpos=$i; break ;;
+        esac
+    done
+
+    if [[ -z $cmd ]]; then
+        case ${words[CURRENT-1]} in
+        @VALUE_FLAGS@) _files; return ;;
+        esac
+        if [[ ${words[CURRENT]} == -* ]]; then
+            compadd -- @FLAGS@
+        else
+            compadd -- @COMMANDS@
+        fi
+        return
+    fi
+
+    local arg=$((CURRENT - cmdpos)) sub=${words[cmdpos+1]} choices=
+    [[ ${words[CURRENT]} == -* ]] && return
+    case $cmd in
+    @DEVICE_COMMANDS@)
+        [[ $arg == 1 ]] && _wake_on_demand_devices ;;
+    schedule)
+        [[ $arg == 2 && $sub == add ]] && _wake_on_demand_devices ;;
+    group | user)
+        case $sub in
+        create | add | remove | grant | revoke) [[ $arg -ge 3 ]] && _wake_on_demand_devices ;;
+        esac ;;
+    esac
+    if [[ $arg == 1 ]]; then
+        case $cmd in
+@SUBCOMMAND_CASES@
+        esac
+        [[ -n $choices ]] && compadd -- ${=choices}
+    fi
+}
+
+# Autoloaded from $fpath, this file's body runs as the completion function
+if [[ $zsh_eval_context[-1] == loadautofunc ]]; then
+    _wake_on_demand "$@"
+else
+    compdef _wake_on_demand wake-on-demand
+fi
+`
+
+const fishCompletion = `# fish completion for wake-on-demand
+# Load with: wake-on-demand completion fish | source
+
+# __wod_command prints the command and the arguments after it
+function __wod_command
+    set -l args (commandline -opc)
+    set -e args[1]
+    while set -q args[1]
+        switch $args[1]
+            case @VALUE_FLAGS_FISH@
+                set -e args[1..2]
+            case '-*'
+                set -e args[1]
+            case '*'
+                printf '%s\n' $args
+                return
+        end
+    end
+end
+
+function __wod_command_is
+    contains -- (__wod_command)[1] $argv
+end
+
+function __wod_arg_count
+    test (count (__wod_command)) -eq (math $argv[1] + 1)
+end
+
+function __wod_devices
+    set -l forward
+    set -l args (commandline -opc)
+    for i in (seq 2 (count $args))
+        if contains -- $args[$i] @FORWARD_VALUE_FISH@
+            set -a forward $args[$i] $args[(math $i + 1)]
+        else if contains -- $args[$i] @FORWARD_BOOL_FISH@
+            set -a forward $args[$i]
+        end
+    end
+    $args[1] $forward -request-timeout 2s -retries 0 completion devices 2>/dev/null
+end
+
+function __wod_wants_device
+    set -l cmd (__wod_command)
+    switch "$cmd[1]"
+        case @DEVICE_COMMANDS_FISH@
+            test (count $cmd) -eq 1
+        case schedule
+            test (count $cmd) -eq 2 -a "$cmd[2]" = add
+        case group user
+            contains -- "$cmd[2]" create add remove grant revoke; and test (count $cmd) -ge 3
+        case '*'
+            return 1
+    end
+end
+
+complete -c wake-on-demand -f
+complete -c wake-on-demand -n 'test (count (__wod_command)) -eq 0' -a '@COMMANDS@'
+@FISH_FLAGS@
+@FISH_SUBCOMMANDS@
+complete -c wake-on-demand -n __wod_wants_device -a '(__wod_devices)'
+`
@@ -0,0 +1,61 @@
+package client
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/smileyfaceskobochka/trashbin-daemon/internal/server"
+)
+
+const defaultConfigPath = "/etc/wake-on-demand/config.yaml"
+
+// resolveAlias maps an alias from the client's config to its ESP ID;
+// unknown names pass through, qualified with the -namespace. The server
+// resolves aliases set with 'edit' itself.
+func (cli *CLI) resolveAlias(name string) string {
+	if id, exists := cli.config.Aliases[name]; exists {
+		return id
+	}
+	return cli.qualifyID(name)
+}
+
+// aliasFor returns the alias the client's config gives id.
+func (cli *CLI) aliasFor(id string) string {
+	for alias, target := range cli.config.Aliases {
+		if target == id {
+			return alias
+		}
+	}
+	return ""
+}
+
+func (cli *CLI) runConfigCommand(args []string) {
+	if len(args) < 1 || args[0] != "validate" {
+		fmt.Println("Usage: wake-on-demand config validate [file]")
+		os.Exit(1)
+	}
+
+	path := cli.configPath
+	if len(args) > 1 {
+		path = args[1]
+	}
+	if path == "" {
+		path = defaultConfigPath
+	}
+
+	cfg, err := server.LoadConfig(path)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if errs := cfg.Validate(); len(errs) > 0 {
+		fmt.Printf("Config %s is invalid:\n", path)
+		for _, err := range errs {
+			fmt.Printf("  - %v\n", err)
+		}
+		os.Exit(1)
+	}
+
+	fmt.Printf("Config %s is valid\n", path)
+}
@@ -0,0 +1,31 @@
+package client
+
+import (
+	"flag"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/smileyfaceskobochka/trashbin-daemon/internal/server"
+)
+
+// The checks behind simulate-esp -check, run against an in-process server
+// so a protocol change that breaks the firmware fails go test.
+func TestConformance(t *testing.T) {
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	server.RegisterFlags(fs)
+	fs.Parse(nil)
+	srv, err := server.New(fs, &server.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(srv.Handler())
+	t.Cleanup(ts.Close)
+
+	cli := newCLI()
+	cli.serverURL = ts.URL
+	s := &simulatedESP{id: "conformance", firmware: "sim-1.0.0", model: "simulator", power: "off", features: server.ServerFeatures, cli: cli}
+	s.log = cli.logger("simulator").With("esp_id", s.id)
+	if failed := cli.runConformance(s); failed != 0 {
+		t.Fatal("protocol conformance checks failed, see the output above")
+	}
+}
@@ -0,0 +1,885 @@
+package client
+
+import (
+	"bufio"
+	"cmp"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/smileyfaceskobochka/trashbin-daemon/internal/server"
+	wod "github.com/smileyfaceskobochka/trashbin-daemon/pkg/client"
+	"golang.org/x/term"
+)
+
+// controlState holds the CLI state kept in control.go.
+type controlState struct {
+	serverURL string
+
+	// assumeYes skips confirmCommand's prompt.
+	assumeYes bool
+}
+
+func optionalArg(args []string, i int) string {
+	if len(args) > i {
+		return args[i]
+	}
+	return ""
+}
+
+// PrintUsage prints the commands and flags, for -help.
+func PrintUsage() {
+	fmt.Printf(`wake-on-demand v%s - Remote server power control
+
+USAGE:
+    wake-on-demand [OPTIONS] <COMMAND> [ARGS]
+
+COMMANDS:
+    server              Start the server
+    on <esp_id> [-pulse <duration>] [-ttl <duration>] [-queue] [-priority <p>] [-force]
+                        Send power on command (short pulse); refused when
+                        the target is already up or booting unless -force.
+                        -ttl expires the command if the ESP hasn't picked
+                        it up in time; -queue keeps it for an offline ESP's
+                        next poll; -priority low|normal|urgent orders the
+                        queue (all also for off, status and soft-off)
+    up <esp_id> [-wait <duration>] [-pulse <duration>] [-force]
+                        Power on and wait until the target is confirmed up
+                        (default wait: 5m, 0 returns once sent)
+    wait <esp_id> [-online|-offline] [-target-up|-target-down] [-power <state>] [-timeout 5m]
+                        Block until the ESP or its target is in that state
+                        (default: -online); exits 1 on timeout
+    off <esp_id> [-pulse <duration>] [-override] [-yes]
+                        Send force shutdown command (long pulse); asks first
+                        on a terminal unless -yes, and needs -override for a
+                        protected device. Commands take -dry-run to show
+                        what the server would do without sending; on and
+                        off take -after-cooldown to queue one refused during
+                        the device's cooldown until it is over
+    soft-off <esp_id> [-override]
+                        Shut the target's OS down through its agent, or over
+                        SSH when it has ssh: settings (falls back to a force
+                        shutdown when neither works)
+    status <esp_id>     Ask the ESP for the target's state and print its report
+    action <esp_id> [<action>] [-ttl <duration>] [-queue]
+                        Run a custom action the ESP declared (e.g. reset), or
+                        list its actions
+    pulse <esp_id> <on_duration|default> [off_duration|default]
+                        Set the ESP's default pulse lengths (e.g. 750ms 8s)
+    timeout <esp_id> <duration|auto>
+                        Set how long the ESP may go unseen before it counts
+                        as offline, or go back to learning it from its polls
+    list [-group <name>] [-online|-offline] [-prefix <p>] [-sort <key>] [-limit <n>] [-all]
+                        List registered ESPs, optionally only some of them,
+                        sorted by id, name or last_seen (-last_seen for
+                        newest first)
+    info <esp_id>       Show device details and reported telemetry
+    tui [-refresh <d>]  Live device table; select a device with the arrow
+                        keys and press o (on), f (off), d (soft-off) or
+                        s (status)
+    watch [-group <name>] [-online|-offline] [-prefix <p>] [-highlight <d>]
+                        Live device list over one connection; devices that
+                        change are highlighted
+    events [-since <d>] [-type <t,...>] [-limit <n>] [-all] [esp_id]
+                        Show the audit log (registrations, polls, commands,
+                        state changes), newest first
+    result <command_id> Show delivery and execution status of a command
+    uptime <esp_id> [-since 30d] [-by day|week] [-csv]
+                        Show how much of each day or week the target was up
+    telemetry <esp_id> [-metric rssi] [-since 24h] [-step 1h] [-list]
+                        Show the RSSI, temperature, heap and battery a device
+                        reported over time
+    history [-limit <n>] <esp_id>
+                        Show the last 50 commands sent to an ESP, who sent
+                        them and how they ended
+    queue <esp_id>      Show commands waiting for an ESP
+    flush <esp_id>      Drop all commands waiting for an ESP
+    unpin <esp_id>      Forget the address an ESP is pinned to
+    approve <esp_id> [-code <code>]
+                        Let an ESP held by -pairing receive commands; list
+                        -pending shows the waiting ones, remove rejects one
+    maintenance <esp_id> on|off [-for 2h] [-reason <text>]
+                        Freeze a device: every command but status is
+                        refused, from users, schedules and idle policies
+                        alike, unless an admin sends it with -override
+    edit <esp_id> [-alias <name>] [-description <text>] [-location <text>]
+         [-hostname <name>] [-protected[=false]] [-cooldown <duration>]
+                        Name a device and describe it; the alias works
+                        wherever an ESP ID is accepted. -protected refuses
+                        off without -override; -cooldown refuses on and off
+                        for that long after one reached the device
+    remove <esp_id>     Delete a device from the registry, dropping its
+                        queued commands and group memberships
+    target <esp_id> <host> [icmp|tcp:<port>|ssh[:<port>]] [-verify <window>] [-retries <n>]
+                        Probe the machine an ESP controls (default: icmp);
+                        -verify pulses again when 'on' doesn't bring it up
+    target <esp_id> none
+                        Stop probing the ESP's target
+    schedule add <esp_id> "<cron>" <on|off|soft-off|status>
+                        Run an action on a cron schedule (server time)
+    schedule list       List schedules with their next run
+    schedule remove <schedule_id>
+                        Delete a schedule
+    group create <name> [esp_id...]
+                        Create a group; use @<name> in place of an ESP ID to
+                        command all its members (e.g. on @lab)
+    group list          List groups and their members
+    group delete <name> Delete a group
+    group add|remove <name> <esp_id>...
+                        Change a group's members
+    user add <name> <admin|operator|viewer> [namespace]
+                        Create a user and print its token; a namespace
+                        limits the user to that site's ESPs
+    user list           List users, roles and granted ESPs
+    user remove <name>  Delete a user
+    user grant <name> <esp_id|*>
+                        Let a user see and control an ESP
+    user revoke <name> <esp_id|*>
+                        Take back access to an ESP
+    user passwd <name> [-clear]
+                        Set (or clear) a user's dashboard password
+    secret issue <esp_id>
+                        Issue a secret the ESP signs its requests with;
+                        its unsigned requests are rejected from then on
+    secret list         List ESPs with a secret and when each last signed
+    secret revoke <esp_id>
+                        Drop an ESP's secret
+    wol <mac> [broadcast]
+                        Send a Wake-on-LAN magic packet from this machine
+    add-wol <id> <mac> [broadcast]
+                        Register a WoL device on the server (woken by 'on')
+    add-device <id> <tasmota|shelly|ipmi> <addr> [-user <name>] [-password <pass>] [-relay <n>]
+                        Register a smart plug or server BMC the server switches itself
+    ota upload <model> <version> <file.bin>
+                        Publish a firmware image for ESPs of a hardware model
+    ota list            List uploaded firmware images
+    ota remove <model> <version>
+                        Delete a firmware image
+    config validate [file]
+                        Check a config file for errors
+    notify test         Send a test message through every notification sink
+    webhooks [list]     List the configured webhooks
+    webhooks deliveries [-webhook <name>] [-status <status>] [-limit 50] [esp_id]
+                        Show recent webhook deliveries and their results
+    webhooks test [name]
+                        Send a test event to every webhook, or to one
+    hooks [runs] [-limit 20] [esp_id]
+                        Show recent wake hook runs and how each step went
+    hooks run <esp_id>  Run a device's wake hooks now
+    run [-detach] <macro>
+                        Run a macro on the server and follow its steps
+    macros [list]       List the macros you may run
+    macros runs [-limit 20] [macro]
+                        Show recent macro runs and how each step went
+    quota [esp_id]      Show command quota usage
+    quota reset <esp_id> | -namespace <name>
+                        Forget a device's or namespace's quota usage
+    ups                 Show the UPS the server follows: mains or battery,
+                        charge and runtime left
+    reload              Make the server re-read its config file (same as
+                        sending it SIGHUP)
+    export [-format yaml|json] [-o <file>]
+                        Dump devices, groups, schedules, users and secrets
+    import [-replace] [-dry-run] <file|->
+                        Merge an export into the server, or replace its
+                        configuration with -replace
+    backup [-o <file|->]
+                        Save a snapshot of the server's state: devices,
+                        groups, schedules, users, secrets and events
+    restore [-dry-run] <file|->
+                        Put a backup back, replacing the configuration and
+                        the event log
+    agent [-interval <d>] [-token <t>] [-shutdown-command <cmd>] <esp_id>
+                        Run on the target machine to handle soft-off
+    simulate-esp [-interval <d>] [-boot-time <d>] [-fail-rate <f>] [-battery <volts>] [-check] <esp_id>
+                        Act as an ESP with a simulated machine, or check the
+                        server against the ESP protocol with -check
+    simulate [-count <n>] [-poll-interval <d>] [-fail-rate <f>] [-latency <d>] [-duration <d>] [-remove]
+                        Run a fleet of simulated ESPs for load testing and
+                        print poll rate, latency and command counts
+    install-service [-socket] [-user <user>] [-dir <dir>] [-- server flags]
+                        Write a systemd unit (Type=notify) for the server;
+                        on Windows, register a service ([-manual] [-start])
+    start-service, stop-service, uninstall-service
+                        Control the Windows service
+    healthcheck         Exit 0 if the server on this host is ready (for
+                        container health checks)
+    proxy -listen <addr> -target <host:port> -device <esp_id> [-wake-timeout 3m]
+                        Forward TCP connections to the target, waking it
+                        through the device when its port doesn't answer
+    discover [-timeout 2s]
+                        List the servers advertising themselves over mDNS
+    completion <bash|zsh|fish>
+                        Print a shell completion script; device names are
+                        completed from the server's device list
+    self-update [-check] [-force] [-url <dir>] [-public-key <key>] [-checksum-only]
+                        Replace this binary with the newest release from
+                        GitHub or a release directory, after checking its
+                        signature and checksum
+
+OPTIONS:
+    -port <port>        Server port (default: 8080)
+    -listen <addrs>     Comma-separated addresses to listen on instead of
+                        :<port>, e.g. 127.0.0.1:8080,[fd7a::1]:8080 or
+                        unix:/run/wod/http.sock
+    -grpc-port <port>   Serve the gRPC API (proto/wod.proto) on this port
+                        (default: disabled)
+    -server <url>       Server URL for client commands, unix:///<path> for
+                        the admin socket, or auto to find the server over
+                        mDNS (default: http://localhost:8080)
+    -mdns               Advertise the server as _wake-on-demand._tcp over
+                        mDNS (default: true, -mdns=false disables)
+    -admin-socket <path>
+                        Serve the control API only on this unix socket; the
+                        TCP port keeps ESP endpoints and health probes
+    -timeout <duration> ESP timeout duration, the minimum of the adaptive
+                        per-device one (default: 30s)
+    -probe-interval <duration>
+                        Interval between target host probes (default: 30s)
+    -queue-depth <n>    Maximum number of queued commands per ESP (default: 8)
+    -command-ttl <duration>
+                        Expire queued commands not delivered within this
+                        long (default: 10m, 0 never expires)
+    -command-max-age <duration>
+                        How long after delivery a device may still act on
+                        a command; older ones it refuses (default: 2m, 0
+                        disables the check)
+    -command-cooldown <duration>
+                        How long after an on or off reaches a device further
+                        ones are refused, unless sent with -after-cooldown;
+                        'edit -cooldown' sets it per device (default: 0,
+                        off)
+    -monitor-granularity <duration>
+                        Offline checks run up to this late, at random, so
+                        they don't all happen at once (default: 1s)
+    -drain-timeout <duration>
+                        Time to wait for in-flight requests on shutdown
+                        (default: 10s)
+    -idempotency-window <duration>
+                        How long a repeated /set-command with the same
+                        Idempotency-Key gets the first response instead of
+                        sending again (default: 24h, 0 ignores the header)
+    -store <backend>    Where ESPs, queued commands, schedules and events are
+                        kept: file (the files below), memory, or
+                        sqlite://<path> (sqlite alone uses the data dir)
+    -registry <file>    Registry file for persisting ESPs (default: in-memory)
+    -schedules <file>   File for persisting schedules (default: in-memory)
+    -users <file>       File for persisting user accounts (default: in-memory)
+    -secrets <file>     File for persisting device secrets (default: in-memory)
+    -require-signed     Reject unsigned requests from ESPs without a secret too
+    -groups <file>      File for persisting ESP groups (default: in-memory)
+    -events <file>      Append-only JSON lines event log (default: in-memory)
+    -uptime-dir <dir>   Directory for target uptime history (default: in-memory)
+    -telemetry-dir <dir>
+                        Directory for device telemetry history (default: in-memory)
+    -data-dir <dir>     Keep registry.json, schedules.json, users.json,
+                        secrets.json, events.jsonl, uptime/, telemetry/, firmware/ and acme/ here
+                        unless their own option is set
+    -ota-dir <dir>      Directory for OTA firmware images (default: OTA disabled)
+    -admin-key <key>    Admin API key; required by the server for control
+                        endpoints and sent by the client as a Bearer token
+                        (clients may pass a user token instead)
+    -esp-token <id>=<token>
+                        Per-ESP registration token (repeatable)
+    -auth-file <file>   JSON file with admin_key and esp_tokens
+    -config <file>      YAML config file; flags take precedence
+    -tls-cert <file>    TLS certificate for serving HTTPS
+    -tls-key <file>     TLS private key for serving HTTPS
+    -acme-domain <name> Obtain a Let's Encrypt certificate for this domain
+                        (needs ports 80 and 443 reachable)
+    -acme-cache <dir>   ACME certificate cache
+                        (default: /var/lib/wake-on-demand/acme)
+    -acme-email <addr>  Contact email for the ACME account
+    -ca-cert <file>     CA certificate trusted by the client (self-signed servers)
+    -insecure           Skip TLS verification in the client
+    -request-timeout <duration>
+                        Client timeout for each request to the server
+                        (default: 30s, 0 waits forever)
+    -retries <n>        Times the client retries a failed read-only request,
+                        with exponential backoff (default: 2)
+    -rate-limit-ip <n>  Requests per minute from one client IP (default: 300,
+                        0 disables)
+    -rate-limit-esp <n> Registrations and commands per minute per ESP
+                        (default: 30, 0 disables)
+    -esp-allow <cidr,...>
+                        Networks ESPs may register and poll from
+                        (default: any)
+    -cors-origin <origin,...>
+                        Web app origins allowed to call the API from a
+                        browser, e.g. https://app.example.com (* allows any)
+    -pin-esp-ip         Reject an ESP ID from any address but the one that
+                        first registered it
+    -duplicate-ids <policy>
+                        When two devices use one ESP ID: reject the
+                        newcomer, quarantine both, or allow (default: reject)
+    -pairing <mode>     Hold ESPs that register a new ID until an admin
+                        approves them (approve), and with code only with the
+                        code the ESP printed (default: off)
+    -esp-retention <duration>
+                        Remove ESPs not seen for this long, e.g. 30d
+                        (default: 0, keep forever)
+    -mqtt-broker <url>  MQTT broker for bridged devices (tcp:// or tls://);
+                        username, password and topic prefix go in the config
+    -cluster-redis <url>
+                        Share state with other servers through Redis
+                        (redis:// or rediss://); one node leads, the others
+                        forward requests to it
+    -cluster-advertise <url>
+                        URL the other nodes forward requests to
+                        (default: http://<hostname>:<port>)
+    -o <format>         Client output: table, plain (tab-separated, no colors
+                        or headers) or json (default: table)
+    -namespace <name>   Client commands treat bare ESP IDs as <name>/<id>
+                        and 'list' shows only that namespace
+    -q                  Print nothing; the exit code tells whether the
+                        command succeeded
+    -otlp-endpoint <url>
+                        Send OpenTelemetry traces to this OTLP/HTTP
+                        collector, e.g. http://tempo:4318 (default: the
+                        OTEL_EXPORTER_OTLP_ENDPOINT variable, or disabled)
+    -trace-sample <fraction>
+                        Share of traces to keep (default: 1)
+    -log-format <fmt>   Server log format: text or json (default: text)
+    -log-level <level>  Minimum log level: debug, info, warn or error
+                        (default: info)
+    -access-log         Log each HTTP request with its status, size and
+                        duration (default: true, -access-log=false disables)
+    -access-log-sample <fraction>
+                        Share of successful requests the access log keeps;
+                        errors and slow requests are always logged
+                        (default: 1)
+    -version            Print version
+    -help               Show this help
+
+EXIT STATUS:
+    0 success, 1 other failure, 2 invalid flags, 3 server unreachable,
+    4 unauthorized, 5 forbidden, 6 not found, 7 offline, 8 already up,
+    9 protected, 10 maintenance, 11 queue full, 12 rate limited,
+    13 waiting for approval, 14 duplicate ID, 15 conflict,
+    16 invalid request, 17 server error, 18 cooling down, 130 interrupted
+
+EXAMPLES:
+    # Start server on default port
+    wake-on-demand server
+
+    # Start server on custom port
+    wake-on-demand -port 9090 server
+
+    # Keep registered ESPs across restarts
+    wake-on-demand -registry /var/lib/wake-on-demand/registry.json server
+
+    # Require an admin key for control endpoints and a token for one ESP
+    wake-on-demand -admin-key s3cret -esp-token bedroom=t0ken server
+    wake-on-demand -admin-key s3cret on bedroom
+
+    # Let a roommate control only their own ESP
+    wake-on-demand -admin-key s3cret user add alex operator
+    wake-on-demand -admin-key s3cret user grant alex desk-pc
+    wake-on-demand -admin-key wod_... on desk-pc
+
+    # Run from a config file and check it first
+    wake-on-demand -config /etc/wake-on-demand/config.yaml config validate
+    wake-on-demand -config /etc/wake-on-demand/config.yaml server
+
+    # Serve HTTPS and talk to it with a self-signed CA
+    wake-on-demand -port 8443 -tls-cert server.crt -tls-key server.key server
+    wake-on-demand -server https://nas.lan:8443 -ca-cert ca.crt list
+
+    # Send commands to custom server
+    wake-on-demand -server http://192.168.1.100:8080 on bedroom
+
+    # List ESPs
+    wake-on-demand list
+
+    # Power on server
+    wake-on-demand on trashbin
+
+    # Power on and block until it answers probes, e.g. before a backup job
+    wake-on-demand up trashbin -wait 3m && rsync ...
+
+    # Show whether the machine behind an ESP is reachable over SSH
+    wake-on-demand target trashbin 192.168.1.20 ssh
+
+    # Power on at 8:00 and force off at 23:00 on weekdays
+    wake-on-demand schedule add trashbin "0 8 * * 1-5" on
+    wake-on-demand schedule add trashbin "0 23 * * 1-5" off
+
+    # Manage a host that supports Wake-on-LAN without an ESP
+    wake-on-demand add-wol nas 00:11:22:33:44:55 192.168.1.255
+    wake-on-demand on nas
+
+`, server.VERSION)
+}
+
+// --- Client Mode ---
+
+// parseCommandArgs reads "<esp_id> [-pulse <duration>]"; the flag may come
+// before or after the ID.
+func (cli *CLI) parseCommandArgs(cmd string, args []string) (string, wod.CommandOptions) {
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	pulse := fs.Duration("pulse", 0, "Power button pulse length for this command (e.g. 750ms)")
+	ttl := fs.Duration("ttl", 0, "Expire the command if it isn't delivered within this long (default: the server's -command-ttl)")
+	queue := fs.Bool("queue", false, "Queue the command if the ESP is offline, for its next poll")
+	dryRun := fs.Bool("dry-run", false, "Show what the server would do without sending the command")
+	priority := fs.String("priority", "", "Queue priority: low, normal (default) or urgent, which skips the device's rate limit")
+	key := fs.String("idempotency-key", "", "Send the command once per key, however often this is run (default: a new key, which still makes -retries safe)")
+	var force, override, afterCooldown *bool
+	if cmd == "on" {
+		force = fs.Bool("force", false, "Send the pulse even if the target is already up or booting")
+	}
+	if cmd == "on" || cmd == "off" {
+		afterCooldown = fs.Bool("after-cooldown", false, "Queue the command until the device's cooldown is over, if it is cooling down")
+	}
+	switch cmd {
+	case "off", "soft-off":
+		override = fs.Bool("override", false, "Force off a device marked protected (for soft-off, when it falls back to force), or one in maintenance (admins only)")
+	case "on", "action":
+		override = fs.Bool("override", false, "Send to a device in maintenance (admins only)")
+	}
+	if cmd == "off" {
+		fs.BoolVar(&cli.assumeYes, "yes", false, "Don't ask for confirmation")
+	}
+	fs.Usage = func() {
+		if cmd == "on" {
+			fmt.Println("Usage: wake-on-demand on <esp_id> [-pulse <duration>] [-ttl <duration>] [-queue] [-priority <p>] [-force] [-override] [-after-cooldown] [-dry-run]")
+		} else if cmd == "action" {
+			fmt.Println("Usage: wake-on-demand action <esp_id> [<action> [-ttl <duration>] [-queue] [-priority <p>] [-override] [-dry-run]]")
+		} else if cmd == "off" {
+			fmt.Println("Usage: wake-on-demand off <esp_id> [-pulse <duration>] [-ttl <duration>] [-queue] [-priority <p>] [-override] [-after-cooldown] [-yes] [-dry-run]")
+		} else if cmd == "soft-off" {
+			fmt.Println("Usage: wake-on-demand soft-off <esp_id> [-ttl <duration>] [-queue] [-priority <p>] [-override] [-dry-run]")
+		} else {
+			fmt.Printf("Usage: wake-on-demand %s <esp_id> [-pulse <duration>] [-ttl <duration>] [-queue] [-priority <p>] [-dry-run]\n", cmd)
+		}
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	rest := fs.Args()
+	if len(rest) < 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	fs.Parse(rest[1:])
+	var action string
+	if cmd == "action" && fs.NArg() > 0 {
+		action = fs.Arg(0)
+		fs.Parse(fs.Args()[1:])
+	}
+	if *pulse != 0 {
+		if cmd == "status" || cmd == "soft-off" || cmd == "action" {
+			fmt.Println("Error: -pulse only applies to on and off")
+			os.Exit(1)
+		}
+		if err := server.ValidatePulse(*pulse); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if *ttl < 0 {
+		fmt.Println("Error: -ttl must be positive")
+		os.Exit(1)
+	}
+	if _, err := server.ParsePriority(*priority); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	opts := wod.CommandOptions{Pulse: *pulse, TTL: *ttl, QueueIfOffline: *queue, Action: action, DryRun: *dryRun, Priority: *priority, IdempotencyKey: *key}
+	if force != nil {
+		opts.Force = *force
+	}
+	if override != nil {
+		opts.Override = *override
+	}
+	if afterCooldown != nil {
+		opts.AfterCooldown = *afterCooldown
+	}
+	return rest[0], opts
+}
+
+// confirmCommand asks before 'off' cuts the power, when standard input is
+// a terminal. Scripts, dry runs and -yes skip the prompt.
+func (cli *CLI) confirmCommand(cmd, espID string, opts wod.CommandOptions) {
+	if cmd != "off" || opts.DryRun || cli.assumeYes || !term.IsTerminal(int(os.Stdin.Fd())) {
+		return
+	}
+	target := espID
+	if name, ok := server.GroupRef(espID); ok {
+		target = "every member of @" + name
+	} else if alias := cli.aliasFor(espID); alias != "" {
+		target = fmt.Sprintf("%s (%s)", alias, espID)
+	}
+	fmt.Printf("Force %s off? Its power is cut without a shutdown. [y/N] ", target)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return
+	}
+	fmt.Println("Cancelled")
+	os.Exit(1)
+}
+
+func (cli *CLI) sendCommand(cmd, espID string, opts wod.CommandOptions) {
+	command, _ := server.ActionCommand(cmd)
+	cli.confirmCommand(cmd, espID, opts)
+	if name, ok := server.GroupRef(espID); ok {
+		cli.sendGroupCommand(cmd, name, wod.Command(command), opts)
+		return
+	}
+
+	result := cli.setCommand(espID, wod.Command(command), opts)
+	if command == server.CommandStatus && result.CommandID != "" {
+		cli.showStatusResult(espID, result)
+		return
+	}
+	switch cli.outputMode {
+	case outputJSON:
+		printJSON(result)
+		return
+	case outputPlain:
+		printRecord(result.ID, result.Command, result.Status, result.Delivery, result.CommandID)
+		return
+	}
+
+	pulseNote := ""
+	if result.DurationMS > 0 {
+		pulseNote = fmt.Sprintf(" (%s pulse)", time.Duration(result.DurationMS)*time.Millisecond)
+	}
+	if result.Status == "dry-run" {
+		showDryRun(cmd, espID, result, pulseNote)
+		return
+	}
+	if result.Fallback {
+		fmt.Printf("No agent online on %s, sending force shutdown instead\n", espID)
+		cmd = "off"
+	}
+	if result.Delivery == "wol" {
+		fmt.Printf("Magic packet sent to %s\n", espID)
+	} else if result.Delivery == "mqtt" {
+		fmt.Printf("Command '%s' published to %s over MQTT%s\n", cmd, espID, pulseNote)
+	} else if result.Status == "sent" {
+		fmt.Printf("Command '%s' sent to %s via %s\n", cmd, espID, result.Delivery)
+	} else if result.Delivery == "agent" && result.Status == "duplicate" {
+		fmt.Printf("Soft-off already pending for the agent on %s\n", espID)
+	} else if result.Delivery == "agent" {
+		fmt.Printf("Soft-off queued for the agent on %s\n", espID)
+	} else if result.Status == "duplicate" {
+		fmt.Printf("Command '%s' already queued for %s%s\n", cmd, espID, pulseNote)
+	} else if result.Offline {
+		fmt.Printf("%s is offline; command '%s' queued for when it polls again%s\n", espID, cmd, pulseNote)
+	} else {
+		fmt.Printf("Command '%s' queued for %s%s\n", cmd, espID, pulseNote)
+	}
+	if result.CommandID != "" {
+		fmt.Printf("Command ID: %s (check with: wake-on-demand result %s)\n", result.CommandID, result.CommandID)
+	}
+}
+
+func showDryRun(cmd, espID string, result *wod.CommandResponse, pulseNote string) {
+	fmt.Print("Dry run, nothing sent: ")
+	if result.Fallback {
+		fmt.Printf("no agent online on %s, so force shutdown would be sent instead; ", espID)
+		cmd = "off"
+	}
+	switch {
+	case result.Delivery == "wol":
+		fmt.Printf("a magic packet would be sent to %s\n", espID)
+	case result.Delivery == "mqtt":
+		fmt.Printf("'%s' would be published to %s over MQTT%s\n", cmd, espID, pulseNote)
+	case result.Delivery == "agent" && result.CommandID != "":
+		fmt.Printf("a soft-off is already pending for the agent on %s (%s)\n", espID, result.CommandID)
+	case result.Delivery == "agent":
+		fmt.Printf("a soft-off would be queued for the agent on %s\n", espID)
+	case result.Delivery != "poll" && result.Delivery != "push":
+		fmt.Printf("'%s' would be sent to %s via %s\n", cmd, espID, result.Delivery)
+	case result.CommandID != "":
+		fmt.Printf("'%s' is already queued for %s (%s)\n", cmd, espID, result.CommandID)
+	case result.Offline:
+		fmt.Printf("%s is offline; '%s' would be queued for when it polls again%s\n", espID, cmd, pulseNote)
+	default:
+		fmt.Printf("'%s' would be queued for %s and delivered by %s%s\n", cmd, espID, result.Delivery, pulseNote)
+	}
+}
+
+// setCommand sends a command to one device and exits with the CLI's
+// message if the server refuses it.
+func (cli *CLI) setCommand(espID string, command wod.Command, opts wod.CommandOptions) *wod.CommandResponse {
+	opts.IdempotencyKey = cmp.Or(opts.IdempotencyKey, newIdempotencyKey())
+	result, err := cli.apiClient().SetCommand(cli.clientCtx, espID, command, &opts)
+	switch {
+	case errors.Is(err, wod.ErrNotFound):
+		fmt.Printf("ESP '%s' not registered\n", espID)
+	case errors.Is(err, wod.ErrOffline):
+		fmt.Printf("ESP '%s' is offline (use -queue to deliver when it's back)\n", espID)
+	case errors.Is(err, wod.ErrQueueFull):
+		fmt.Printf("Command queue for %s is full (inspect with: wake-on-demand queue %s)\n", espID, espID)
+	case errors.Is(err, wod.ErrProtected):
+		fmt.Printf("%s is protected (use -override to force it off)\n", espID)
+	case errors.Is(err, wod.ErrMaintenance):
+		fmt.Printf("%s is in maintenance (an admin can send anyway with -override; end it with: wake-on-demand maintenance %s off)\n", espID, espID)
+	case errors.Is(err, wod.ErrIDConflict):
+		fmt.Printf("Error: %s has a duplicate ID conflict (see: wake-on-demand info %s)\n", espID, espID)
+	case errors.Is(err, wod.ErrPendingApproval):
+		fmt.Printf("Error: %s is waiting for approval (approve it with: wake-on-demand approve %s)\n", espID, espID)
+	case errors.Is(err, wod.ErrAlreadyUp):
+		fmt.Printf("Target of %s is already up or booting (use -force to send anyway)\n", espID)
+	case errors.Is(err, wod.ErrCooldown):
+		var apiErr *wod.APIError
+		errors.As(err, &apiErr)
+		fmt.Printf("%s is cooling down after a power command, %s left (use -after-cooldown to queue it until then)\n",
+			espID, apiErr.RetryAfter.Round(100*time.Millisecond))
+	case errors.Is(err, wod.ErrQuotaExceeded):
+		var apiErr *wod.APIError
+		errors.As(err, &apiErr)
+		fmt.Printf("Error: %s (an admin can send anyway with -override; see: wake-on-demand quota %s)\n", apiErr.Message, espID)
+	case err != nil:
+		cli.exitOnClientError(err)
+	}
+	if err != nil {
+		os.Exit(cli.exitStatus(err))
+	}
+	return result
+}
+
+func (cli *CLI) sendGroupCommand(cmd, name string, command wod.Command, opts wod.CommandOptions) {
+	opts.IdempotencyKey = cmp.Or(opts.IdempotencyKey, newIdempotencyKey())
+	result, err := cli.apiClient().SetGroupCommand(cli.clientCtx, name, command, &opts)
+	switch {
+	case errors.Is(err, wod.ErrNotFound):
+		fmt.Printf("Group @%s not found\n", name)
+		os.Exit(cli.exitStatus(err))
+	case err != nil:
+		cli.exitOnClientError(err)
+	}
+
+	switch cli.outputMode {
+	case outputJSON:
+		printJSON(result)
+	case outputPlain:
+		for _, r := range result.Results {
+			printRecord(r.ID, command, r.Status, r.Delivery, r.CommandID, r.Error)
+		}
+	}
+	if cli.outputMode != outputTable {
+		if result.Failed > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if len(result.Results) == 0 {
+		fmt.Printf("Group @%s has no members\n", name)
+		return
+	}
+	fmt.Printf("Command '%s' for @%s:\n", cmd, name)
+	for _, r := range result.Results {
+		switch r.Status {
+		case "failed":
+			fmt.Printf("  \033[31m✗\033[0m %-20s %s\n", r.ID, r.Error)
+		case "skipped":
+			fmt.Printf("  \033[90m-\033[0m %-20s %s\n", r.ID, r.Error)
+		case "dry-run":
+			fmt.Printf("  \033[90m?\033[0m %-20s would go via %s\n", r.ID, r.Delivery)
+		default:
+			fmt.Printf("  \033[32m✓\033[0m %-20s %s via %s (%s)\n", r.ID, r.Status, r.Delivery, r.CommandID)
+		}
+	}
+	if result.Failed > 0 {
+		fmt.Printf("%d of %d failed\n", result.Failed, len(result.Results))
+		os.Exit(1)
+	}
+}
+
+func powerColor(state string) string {
+	switch state {
+	case wod.PowerUp:
+		return "\033[32m" // green
+	case wod.PowerOff:
+		return "\033[31m" // red
+	case wod.PowerBooting, wod.PowerShuttingDown:
+		return "\033[33m" // yellow
+	}
+	return "\033[90m" // gray
+}
+
+// apiClient returns a client for -server using the CLI's key and TLS settings.
+func (cli *CLI) apiClient() *wod.Client {
+	return wod.New(cli.serverURL, wod.WithToken(cli.adminKey), wod.WithHTTPClient(cli.httpClient))
+}
+
+// exitOnClientError prints the CLI's message for a failed client call and exits.
+func (cli *CLI) exitOnClientError(err error) {
+	var apiErr *wod.APIError
+	isAPIErr := errors.As(err, &apiErr)
+	switch {
+	case cli.interrupted():
+		fmt.Println("Interrupted")
+		os.Exit(130)
+	case errors.Is(err, errRequestTimeout):
+		fmt.Printf("Error: No response from server at %s within %s (raise -request-timeout)\n", cli.serverLabel(), cli.requestTimeout)
+	case errors.Is(err, wod.ErrUnreachable):
+		fmt.Printf("Error: Could not connect to server at %s\n", cli.serverLabel())
+		fmt.Println("Is the server running? Start with: wake-on-demand server")
+	case errors.Is(err, wod.ErrUnauthorized):
+		fmt.Println("Error: Unauthorized (check -admin-key)")
+	case errors.Is(err, wod.ErrRateLimited):
+		fmt.Printf("Rate limited, try again in %s\n", apiErr.RetryAfter)
+	case isAPIErr:
+		fmt.Printf("Error: %s\n", apiErr.Message)
+	default:
+		fmt.Printf("Error: %v\n", err)
+	}
+	os.Exit(cli.exitStatus(err))
+}
+
+// exitOnRequestError reports a failed httpClient.Do like a client error.
+func (cli *CLI) exitOnRequestError(err error) {
+	cli.exitOnClientError(fmt.Errorf("%w: %w", wod.ErrUnreachable, err))
+}
+
+func responseError(resp *http.Response) string {
+	return wod.ResponseError(resp).Message
+}
+
+func (cli *CLI) listESPs(args []string) {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	group := fs.String("group", "", "Only members of this group")
+	online := fs.Bool("online", false, "Only online devices")
+	offline := fs.Bool("offline", false, "Only offline devices")
+	pending := fs.Bool("pending", false, "Only devices waiting for approval")
+	prefix := fs.String("prefix", "", "Only devices whose ID or alias starts with this")
+	sortBy := fs.String("sort", "", "Order by id, name or last_seen; prefix with - for descending (default: id)")
+	limit := fs.Int("limit", 0, "Show at most this many devices (default: all)")
+	all := fs.Bool("all", false, "With -limit, fetch the rest page by page")
+	fs.Usage = func() {
+		fmt.Println("Usage: wake-on-demand list [-group <name>] [-online|-offline] [-pending] [-prefix <p>] [-sort <key>] [-limit <n>] [-all]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *online && *offline || fs.NArg() > 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	opts := wod.ListOptions{Namespace: cli.clientNamespace, Group: strings.TrimPrefix(*group, "@"), Prefix: *prefix, Sort: *sortBy, Limit: *limit, Pending: *pending}
+	if *online || *offline {
+		opts.Online = online
+	}
+	filtered := *group != "" || *prefix != "" || opts.Online != nil || *pending
+	var esps []wod.Device
+	var more string
+	for {
+		page, err := cli.apiClient().ListPage(cli.clientCtx, opts)
+		if err != nil {
+			cli.exitOnClientError(err)
+		}
+		esps = append(esps, page.Devices...)
+		if page.NextCursor == "" || !*all {
+			if page.NextCursor != "" {
+				more = fmt.Sprintf("(%d of %d shown: use -all or a larger -limit)", len(esps), page.Total)
+			}
+			break
+		}
+		opts.Cursor = page.NextCursor
+	}
+	switch cli.outputMode {
+	case outputJSON:
+		printJSON(esps)
+		return
+	case outputPlain:
+		for _, esp := range esps {
+			printDeviceRecord(esp)
+		}
+		return
+	}
+
+	if len(esps) == 0 && filtered {
+		fmt.Println("No matching ESPs")
+	} else if len(esps) == 0 {
+		fmt.Println("No ESPs registered")
+	} else {
+		fmt.Println("Registered ESPs:")
+		for _, esp := range esps {
+			status := "●"
+			statusColor := "\033[32m" // green
+			if esp.Type == string(server.DeviceWoL) {
+				statusColor = "\033[90m" // gray, WoL hosts have no heartbeat
+			} else if esp.Conflict != nil || esp.PendingSince != nil {
+				statusColor = "\033[33m" // yellow
+			} else if esp.Maintenance != nil {
+				statusColor = "\033[35m" // magenta
+			} else if !esp.Online {
+				statusColor = "\033[31m" // red
+			}
+			name := esp.ID
+			if esp.Alias != "" {
+				name = fmt.Sprintf("%s (%s)", esp.Alias, esp.ID)
+			}
+			target := ""
+			if esp.Power != nil {
+				target = " power: " + powerColor(esp.Power.State) + esp.Power.State + "\033[0m"
+				if esp.Power.State == wod.PowerUnknown && esp.LastPower != nil {
+					target += " \033[90m(" + cli.lastPowerNote(esp.LastPower) + ")\033[0m"
+				}
+			} else if esp.LastPower != nil {
+				target = " power: \033[90m" + cli.lastPowerNote(esp.LastPower) + "\033[0m"
+			} else if esp.Target != nil {
+				switch {
+				case esp.TargetState == nil:
+					target = " target: \033[90munknown\033[0m"
+				case esp.TargetState.Up:
+					target = " target: \033[32mup\033[0m"
+				default:
+					target = " target: \033[31mdown\033[0m"
+				}
+			}
+			if esp.Type == string(server.DeviceWoL) {
+				fmt.Printf("  %s%s\033[0m %-20s [wol, last woken: %s]%s\n", statusColor, status, name, esp.LastSeen, target)
+				continue
+			}
+			details := ""
+			if t := esp.Telemetry; t != nil {
+				if t.Firmware != "" {
+					details += ", fw " + t.Firmware
+				}
+				if t.RSSI != nil {
+					details += fmt.Sprintf(", %d dBm", *t.RSSI)
+				}
+				if t.BatteryV != nil {
+					details += ", " + formatSupply(t)
+				}
+			}
+			if esp.Type != string(server.DeviceESP) {
+				details = ", " + esp.Type + details
+			}
+			if esp.Location != "" {
+				details += ", " + esp.Location
+			}
+			if esp.Agent != nil {
+				details += ", agent"
+			}
+			if len(esp.Actions) > 0 {
+				details += ", actions: " + formatActions(esp.Actions)
+			}
+			for _, g := range esp.Groups {
+				details += ", @" + g
+			}
+			fmt.Printf("  %s%s\033[0m %-20s [last seen: %s%s]%s\n", statusColor, status, name, esp.LastSeen, details, target)
+			if c := esp.Conflict; c != nil {
+				fmt.Printf("    \033[33mduplicate ID: %d devices, %s (see 'info %s')\033[0m\n", len(c.Senders), c.Policy, esp.ID)
+			}
+			if m := esp.Maintenance; m != nil {
+				fmt.Printf("    \033[35mMAINTENANCE %s\033[0m\n", cli.formatMaintenance(m))
+			}
+			if esp.PendingSince != nil {
+				fmt.Printf("    \033[33mwaiting for approval for %s (wake-on-demand approve %s)\033[0m\n", cli.now().Sub(*esp.PendingSince).Round(time.Second), esp.ID)
+			}
+		}
+	}
+	if more != "" {
+		fmt.Println(more)
+	}
+}
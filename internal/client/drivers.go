@@ -0,0 +1,66 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/smileyfaceskobochka/trashbin-daemon/internal/server"
+)
+
+// --- Client Mode ---
+
+func (cli *CLI) addDriverDevice(args []string) {
+	fs := flag.NewFlagSet("add-device", flag.ExitOnError)
+	user := fs.String("user", "", "Username for the device or BMC")
+	password := fs.String("password", "", "Password (or set WOD_DEVICE_PASSWORD)")
+	relay := fs.Int("relay", 0, "Relay or switch channel on multi-relay plugs")
+	gen := fs.Int("gen", 0, "Shelly API generation: 1 (default) or 2 for Plus/Pro devices")
+	fs.Usage = func() {
+		fmt.Println("Usage: wake-on-demand add-device <id> <tasmota|shelly|ipmi> <addr> [-user <name>] [-password <pass>] [-relay <n>] [-gen <1|2>]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	rest := fs.Args()
+	if len(rest) < 3 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	fs.Parse(rest[3:])
+	if *password == "" {
+		*password = os.Getenv("WOD_DEVICE_PASSWORD")
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"id":       rest[0],
+		"driver":   rest[1],
+		"addr":     rest[2],
+		"username": *user,
+		"password": *password,
+		"relay":    *relay,
+		"gen":      *gen,
+	})
+	req, _ := http.NewRequest(http.MethodPost, cli.serverURL+server.APIPrefix+"/driver-devices", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	cli.setAuthHeader(req)
+
+	resp, err := cli.httpClient.Do(req)
+	if err != nil {
+		cli.exitOnRequestError(err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		fmt.Printf("%s device '%s' added (%s)\n", rest[1], rest[0], rest[2])
+	case http.StatusUnauthorized:
+		fmt.Println("Error: Unauthorized (check -admin-key)")
+		os.Exit(exitUnauthorized)
+	default:
+		fmt.Printf("Error: %s\n", responseError(resp))
+		os.Exit(httpExitStatus(resp.StatusCode))
+	}
+}
@@ -0,0 +1,116 @@
+package client
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/smileyfaceskobochka/trashbin-daemon/internal/server"
+	wod "github.com/smileyfaceskobochka/trashbin-daemon/pkg/client"
+)
+
+// --- Client Mode ---
+
+// CLI exit statuses, so scripts can tell failures apart without parsing
+// output. Other failures exit with 1, flags that don't parse with 2 and an
+// interrupt with 130.
+const (
+	exitUnreachable    = 3
+	exitUnauthorized   = 4
+	exitForbidden      = 5
+	exitNotFound       = 6
+	exitOffline        = 7
+	exitAlreadyUp      = 8
+	exitProtected      = 9
+	exitMaintenance    = 10
+	exitQueueFull      = 11
+	exitRateLimited    = 12
+	exitPending        = 13
+	exitIDConflict     = 14
+	exitConflict       = 15
+	exitInvalidRequest = 16
+	exitServerError    = 17
+	exitCooldown       = 18
+	exitQuota          = 19
+)
+
+var codeExits = map[server.ErrorCode]int{
+	server.CodeUnauthorized:       exitUnauthorized,
+	server.CodeSignatureInvalid:   exitUnauthorized,
+	server.CodeForbidden:          exitForbidden,
+	server.CodeWrongPairingCode:   exitForbidden,
+	server.CodeNotFound:           exitNotFound,
+	server.CodeESPNotFound:        exitNotFound,
+	server.CodeESPOffline:         exitOffline,
+	server.CodeAlreadyUp:          exitAlreadyUp,
+	server.CodeProtected:          exitProtected,
+	server.CodeMaintenance:        exitMaintenance,
+	server.CodeQueueFull:          exitQueueFull,
+	server.CodeRateLimited:        exitRateLimited,
+	server.CodeCooldown:           exitCooldown,
+	server.CodeQuotaExceeded:      exitQuota,
+	server.CodePendingApproval:    exitPending,
+	server.CodeIDConflict:         exitIDConflict,
+	server.CodeConflict:           exitConflict,
+	server.CodeCommandFinished:    exitConflict,
+	server.CodeInvalidRequest:     exitInvalidRequest,
+	server.CodeInvalidJSON:        exitInvalidRequest,
+	server.CodeUnsupportedCommand: exitInvalidRequest,
+	server.CodeMethodNotAllowed:   exitInvalidRequest,
+	server.CodeTooLarge:           exitInvalidRequest,
+	server.CodeUnsupportedMedia:   exitInvalidRequest,
+	server.CodeInvalidConfig:      exitInvalidRequest,
+	server.CodeIdempotencyReused:  exitInvalidRequest,
+	server.CodeUpgradeRequired:    exitInvalidRequest,
+	server.CodeInternal:           exitServerError,
+	server.CodeWakeFailed:         exitServerError,
+	server.CodeUpstreamFailed:     exitServerError,
+	server.CodeUnavailable:        exitServerError,
+}
+
+// exitStatus is the exit status for a failed client call.
+func (cli *CLI) exitStatus(err error) int {
+	var apiErr *wod.APIError
+	switch {
+	case cli.interrupted():
+		return 130
+	case errors.Is(err, errRequestTimeout), errors.Is(err, wod.ErrUnreachable):
+		return exitUnreachable
+	case !errors.As(err, &apiErr):
+		return 1
+	}
+	if status, ok := codeExits[server.ErrorCode(apiErr.Code)]; ok {
+		return status
+	}
+	// A server from before error codes, or a code added since
+	switch {
+	case errors.Is(apiErr, wod.ErrOffline):
+		return exitOffline
+	case errors.Is(apiErr, wod.ErrQueueFull):
+		return exitQueueFull
+	}
+	return httpExitStatus(apiErr.StatusCode)
+}
+
+// httpExitStatus is the exit status for an error response by its HTTP
+// status alone, for commands that make their own requests.
+func httpExitStatus(status int) int {
+	switch {
+	case status == http.StatusUnauthorized:
+		return exitUnauthorized
+	case status == http.StatusForbidden:
+		return exitForbidden
+	case status == http.StatusNotFound:
+		return exitNotFound
+	case status == http.StatusConflict:
+		return exitConflict
+	case status == http.StatusLocked:
+		return exitMaintenance
+	case status == http.StatusTooManyRequests:
+		return exitRateLimited
+	case status >= 500:
+		return exitServerError
+	case status >= 400:
+		return exitInvalidRequest
+	}
+	return 1
+}
@@ -0,0 +1,122 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/smileyfaceskobochka/trashbin-daemon/internal/server"
+)
+
+// --- Client Mode ---
+
+func (cli *CLI) runEventsCommand(args []string) {
+	fs := flag.NewFlagSet("events", flag.ExitOnError)
+	since := fs.String("since", "", "Only events newer than this (duration like 24h, or RFC 3339 time)")
+	types := fs.String("type", "", "Comma-separated event types to show")
+	limit := fs.Int("limit", 50, "Maximum number of events")
+	all := fs.Bool("all", false, "Follow pagination and print every matching event")
+	fs.Usage = func() {
+		fmt.Println("Usage: wake-on-demand events [-since 24h] [-type command,acked] [-limit 50] [-all] [esp_id]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	q := url.Values{}
+	if fs.NArg() > 0 {
+		q.Set("esp_id", cli.resolveAlias(fs.Arg(0)))
+	}
+	if *since != "" {
+		q.Set("since", *since)
+	}
+	if *types != "" {
+		q.Set("type", *types)
+	}
+	q.Set("limit", strconv.Itoa(*limit))
+
+	printed := 0
+	collected := []server.Event{}
+	for {
+		page, next := cli.fetchEvents(q)
+		for _, e := range page {
+			switch cli.outputMode {
+			case outputJSON:
+				collected = append(collected, e)
+			case outputPlain:
+				printRecord(e.Time, e.Type, e.ESPID, e.Command, e.Actor, e.Detail, e.CommandID)
+			default:
+				printEvent(e)
+			}
+		}
+		printed += len(page)
+		if !*all || next == "" {
+			switch {
+			case cli.outputMode == outputJSON:
+				printJSON(map[string]interface{}{"events": collected, "next_cursor": next})
+			case cli.outputMode == outputPlain:
+			case printed == 0:
+				fmt.Println("No events")
+			case next != "":
+				fmt.Printf("(more events available: use -all or -limit)\n")
+			}
+			return
+		}
+		q.Set("cursor", next)
+	}
+}
+
+func (cli *CLI) fetchEvents(q url.Values) ([]server.Event, string) {
+	req, _ := http.NewRequest(http.MethodGet, cli.serverURL+server.APIPrefix+"/events?"+q.Encode(), nil)
+	cli.setAuthHeader(req)
+
+	resp, err := cli.httpClient.Do(req)
+	if err != nil {
+		cli.exitOnRequestError(err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized:
+		fmt.Println("Error: Unauthorized (check -admin-key)")
+		os.Exit(exitUnauthorized)
+	default:
+		fmt.Printf("Error: %s\n", responseError(resp))
+		os.Exit(httpExitStatus(resp.StatusCode))
+	}
+
+	var result struct {
+		Events     []server.Event `json:"events"`
+		NextCursor string         `json:"next_cursor"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		fmt.Println("Error decoding response")
+		os.Exit(1)
+	}
+	return result.Events, result.NextCursor
+}
+
+func printEvent(e server.Event) {
+	var line bytes.Buffer
+	fmt.Fprintf(&line, "%s  %-11s %-16s", e.Time.Local().Format(time.DateTime), e.Type, e.ESPID)
+	if e.Command != "" {
+		fmt.Fprintf(&line, " %s", e.Command)
+	}
+	if e.Actor != "" {
+		fmt.Fprintf(&line, " by %s", e.Actor)
+	}
+	if e.Detail != "" {
+		fmt.Fprintf(&line, " (%s)", e.Detail)
+	}
+	if e.CommandID != "" {
+		fmt.Fprintf(&line, " [%s]", e.CommandID)
+	}
+	fmt.Println(strings.TrimRight(line.String(), " "))
+}
@@ -0,0 +1,142 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/smileyfaceskobochka/trashbin-daemon/internal/server"
+)
+
+// --- Client Mode ---
+
+func (cli *CLI) runExport(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	format := fs.String("format", server.BundleFormatYML, "Output format: yaml or json")
+	out := fs.String("o", "", "Write to this file instead of stdout")
+	fs.Usage = func() {
+		fmt.Println("Usage: wake-on-demand export [-format yaml|json] [-o <file>]")
+		fmt.Println("The export holds token hashes and device secrets; keep it private")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *format != server.BundleFormatYML && *format != "json" {
+		fmt.Printf("Error: unknown format %q (use yaml or json)\n", *format)
+		os.Exit(1)
+	}
+
+	resp := cli.bundleRequest(http.MethodGet, "/admin/export?"+url.Values{"format": {*format}}.Encode(), nil)
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		fmt.Printf("Error: Could not read export: %v\n", err)
+		os.Exit(1)
+	}
+	if *out == "" {
+		os.Stdout.Write(data)
+		return
+	}
+	if err := os.WriteFile(*out, data, 0o600); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Exported to %s\n", *out)
+}
+
+func (cli *CLI) runImport(args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	replace := fs.Bool("replace", false, "Remove devices, groups, schedules, users and secrets the file doesn't list")
+	dryRun := fs.Bool("dry-run", false, "Only report what would change")
+	fs.Usage = func() {
+		fmt.Println("Usage: wake-on-demand import [-replace] [-dry-run] <file|->")
+		fmt.Println("Merges the file into the server's configuration, or replaces it with -replace")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	var data []byte
+	var err error
+	if fs.Arg(0) == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(fs.Arg(0))
+	}
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	// Checked here too, for a clearer error than the server's
+	if _, err := server.ParseBundle(data); err != nil {
+		fmt.Printf("Error: %s is not a valid export: %v\n", fs.Arg(0), err)
+		os.Exit(1)
+	}
+
+	mode := server.ImportMerge
+	if *replace {
+		mode = server.ImportReplace
+	}
+	q := url.Values{"mode": {mode}}
+	if *dryRun {
+		q.Set("dry_run", "true")
+	}
+	resp := cli.bundleRequest(http.MethodPost, "/admin/import?"+q.Encode(), data)
+	defer resp.Body.Close()
+	var result server.ImportResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		fmt.Println("Error decoding response")
+		os.Exit(1)
+	}
+
+	switch cli.outputMode {
+	case outputJSON:
+		printJSON(result)
+		return
+	case outputPlain:
+		printRecord(result)
+		return
+	}
+	verb := "Imported"
+	if result.DryRun {
+		verb = "Would import"
+	}
+	fmt.Printf("%s (%s):\n", verb, result.Mode)
+	for _, p := range result.Parts() {
+		fmt.Printf("  %-10s %d added, %d updated, %d removed\n", p.Name+":", p.Added, p.Updated, p.Removed)
+	}
+}
+
+func (cli *CLI) bundleRequest(method, path string, body []byte) *http.Response {
+	req, _ := http.NewRequest(method, cli.serverURL+server.APIPrefix+path, bytes.NewReader(body))
+	if body != nil {
+		req.Header.Set("Content-Type", "application/yaml")
+	}
+	cli.setAuthHeader(req)
+
+	resp, err := cli.httpClient.Do(req)
+	if err != nil {
+		cli.exitOnRequestError(err)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp
+	case http.StatusUnauthorized:
+		fmt.Println("Error: Unauthorized (check -admin-key)")
+	case http.StatusForbidden:
+		fmt.Println("Error: Export and import require the admin role")
+	default:
+		fmt.Printf("Error: %s\n", responseError(resp))
+	}
+	resp.Body.Close()
+	os.Exit(httpExitStatus(resp.StatusCode))
+	return nil
+}
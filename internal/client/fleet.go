@@ -0,0 +1,258 @@
+package client
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// simulate runs a fleet of simulated ESPs against one server, for load
+// tests and for trying protocol changes at scale. Each device is a
+// simulatedESP in its own goroutine, doing what simulate-esp does; the
+// fleet only adds the counters and the periodic summary.
+
+type fleetStat int
+
+const (
+	statRegistered fleetStat = iota
+	statPolls
+	statPollErrors
+	statCommands
+	statFailed
+	statStale
+	statReportErrors
+	statCount
+)
+
+// fleetStats counts what the devices of a fleet did. A nil *fleetStats
+// counts nothing, which is what a lone simulate-esp has.
+type fleetStats struct {
+	counters [statCount]atomic.Int64
+
+	mu        sync.Mutex
+	latencies []time.Duration // of polls since the last summary
+	cli       *CLI
+}
+
+func (f *fleetStats) poll(took time.Duration, err error) {
+	if f == nil || f.cli.interrupted() {
+		// Polls cut short by the end of the run aren't errors
+		return
+	}
+	f.counters[statPolls].Add(1)
+	if err != nil {
+		f.counters[statPollErrors].Add(1)
+	}
+	f.mu.Lock()
+	f.latencies = append(f.latencies, took)
+	f.mu.Unlock()
+}
+
+func (f *fleetStats) add(stat fleetStat) {
+	if f != nil {
+		f.counters[stat].Add(1)
+	}
+}
+
+// fleetSummary is one line of simulate's output.
+type fleetSummary struct {
+	Elapsed      string  `json:"elapsed"`
+	Devices      int64   `json:"devices"`
+	Polls        int64   `json:"polls"`
+	PollsPerSec  float64 `json:"polls_per_sec"`
+	PollErrors   int64   `json:"poll_errors"`
+	P50MS        float64 `json:"p50_ms,omitempty"`
+	P99MS        float64 `json:"p99_ms,omitempty"`
+	MaxMS        float64 `json:"max_ms,omitempty"`
+	Commands     int64   `json:"commands"`
+	Failed       int64   `json:"failed"`
+	Stale        int64   `json:"stale"`
+	ReportErrors int64   `json:"report_errors"`
+}
+
+// summary reports the totals, with rate and latencies over the polls since
+// the last call.
+func (f *fleetStats) summary(elapsed, since time.Duration, pollsBefore int64) fleetSummary {
+	f.mu.Lock()
+	latencies := f.latencies
+	f.latencies = nil
+	f.mu.Unlock()
+	slices.Sort(latencies)
+	at := func(q float64) float64 {
+		if len(latencies) == 0 {
+			return 0
+		}
+		return float64(latencies[int(q*float64(len(latencies)-1))].Microseconds()) / 1000
+	}
+	s := fleetSummary{
+		Elapsed:      elapsed.Round(time.Second).String(),
+		Devices:      f.counters[statRegistered].Load(),
+		Polls:        f.counters[statPolls].Load(),
+		PollErrors:   f.counters[statPollErrors].Load(),
+		P50MS:        at(0.5),
+		P99MS:        at(0.99),
+		MaxMS:        at(1),
+		Commands:     f.counters[statCommands].Load(),
+		Failed:       f.counters[statFailed].Load(),
+		Stale:        f.counters[statStale].Load(),
+		ReportErrors: f.counters[statReportErrors].Load(),
+	}
+	if since > 0 {
+		s.PollsPerSec = float64(s.Polls-pollsBefore) / since.Seconds()
+	}
+	return s
+}
+
+func (cli *CLI) printFleetSummary(s fleetSummary, final bool) {
+	switch {
+	case cli.outputMode == outputJSON:
+		printJSON(s)
+		return
+	case final:
+		fmt.Printf("Done after %s: %d devices, %d polls (%.1f/s), %d commands (%d failed, %d stale), %d poll errors, %d report errors\n",
+			s.Elapsed, s.Devices, s.Polls, s.PollsPerSec, s.Commands, s.Failed, s.Stale, s.PollErrors, s.ReportErrors)
+		return
+	}
+	fmt.Printf("%6s  %d devices  %.1f polls/s  p50 %.1fms  p99 %.1fms  max %.1fms  %d commands (%d failed, %d stale)  %d poll errors  %d report errors\n",
+		s.Elapsed, s.Devices, s.PollsPerSec, s.P50MS, s.P99MS, s.MaxMS, s.Commands, s.Failed, s.Stale, s.PollErrors, s.ReportErrors)
+}
+
+// quietHandler drops records below min, so a fleet of devices only logs
+// what goes wrong unless -log-level asks for more.
+type quietHandler struct {
+	slog.Handler
+	min slog.Level
+}
+
+func (h quietHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.min && h.Handler.Enabled(ctx, level)
+}
+
+func (h quietHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return quietHandler{h.Handler.WithAttrs(attrs), h.min}
+}
+
+func (h quietHandler) WithGroup(name string) slog.Handler {
+	return quietHandler{h.Handler.WithGroup(name), h.min}
+}
+
+func (cli *CLI) runSimulate(args []string) {
+	fs := flag.NewFlagSet("simulate", flag.ExitOnError)
+	count := fs.Int("count", 10, "Number of ESPs to simulate")
+	prefix := fs.String("prefix", "sim-", "ID prefix; devices are numbered from 1 after it")
+	interval := fs.Duration("poll-interval", 5*time.Second, "How often each ESP polls for commands")
+	wait := fs.Duration("wait", 0, "Long-poll each request for up to this long (max 60s)")
+	token := fs.String("token", "", "Token every ESP sends, e.g. a namespace token")
+	secret := fs.String("secret", "", "Device secret every ESP signs its requests with")
+	power := fs.String("power", "off", "Power state of the simulated machines at start (on or off)")
+	bootTime := fs.Duration("boot-time", 20*time.Second, "How long a machine takes to come up after 'on'")
+	shutdownTime := fs.Duration("shutdown-time", 10*time.Second, "How long a machine takes to go down after a short press while on")
+	failRate := fs.Float64("fail-rate", 0, "Fraction of commands to report as failed, 0 to 1")
+	latency := fs.Duration("latency", 0, "How long an ESP takes to act on a command before reporting, ±50%")
+	duration := fs.Duration("duration", 0, "Stop after this long (default: until Ctrl-C)")
+	every := fs.Duration("report", 10*time.Second, "How often to print a summary")
+	remove := fs.Bool("remove", false, "Remove the ESPs from the server when done (needs -admin-key when auth is on)")
+	fs.Usage = func() {
+		fmt.Println("Usage: wake-on-demand [-server <url>] simulate [-count 10] [-prefix sim-] [-poll-interval 5s] [-wait 25s] [-fail-rate 0] [-latency 0] [-duration 0] [-remove]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 0 || *count < 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if *power != "on" && *power != "off" {
+		fmt.Println("Error: -power must be on or off")
+		os.Exit(1)
+	}
+	if *failRate < 0 || *failRate > 1 {
+		fmt.Println("Error: -fail-rate must be between 0 and 1")
+		os.Exit(1)
+	}
+	if *interval <= 0 || *every <= 0 || *latency < 0 || *duration < 0 {
+		fmt.Println("Error: -poll-interval and -report must be positive, -latency and -duration can't be negative")
+		os.Exit(1)
+	}
+
+	// One connection per device instead of the default two per host, or
+	// every poll past those opens a new one
+	if t, ok := cli.clientTransport.(*http.Transport); ok {
+		t.MaxIdleConnsPerHost = *count
+	}
+	if *duration > 0 {
+		var cancel context.CancelFunc
+		cli.clientCtx, cancel = context.WithTimeout(cli.clientCtx, *duration)
+		defer cancel()
+	}
+	devlog := slog.New(quietHandler{slog.Default().Handler(), slog.LevelWarn}).With("component", "simulator")
+
+	stats := &fleetStats{cli: cli}
+	ids := make([]string, *count)
+	width := len(fmt.Sprint(*count))
+	var wg sync.WaitGroup
+	for i := range ids {
+		ids[i] = fmt.Sprintf("%s%0*d", *prefix, width, i+1)
+		s := &simulatedESP{
+			id: ids[i], token: *token, secret: *secret, firmware: "sim-1.0.0", model: "simulator", wait: *wait,
+			bootTime: *bootTime, shutdownTime: *shutdownTime, failRate: *failRate, latency: *latency, power: *power,
+			stats: stats, log: devlog.With("esp_id", ids[i]), fixedInterval: true, cli: cli,
+		}
+		wg.Go(func() {
+			// Spread the first polls over one interval instead of sending
+			// them all at once
+			select {
+			case <-time.After(*interval * time.Duration(i) / time.Duration(*count)):
+			case <-cli.clientCtx.Done():
+				return
+			}
+			s.run(*interval)
+		})
+	}
+	fmt.Printf("Simulating %d ESPs (%s to %s) against %s\n", *count, ids[0], ids[len(ids)-1], cli.serverURL)
+
+	start := cli.now()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	ticker := time.NewTicker(*every)
+	defer ticker.Stop()
+	last, lastPolls := start, int64(0)
+	for running := true; running; {
+		select {
+		case <-ticker.C:
+			now := cli.now()
+			s := stats.summary(now.Sub(start), now.Sub(last), lastPolls)
+			last, lastPolls = now, s.Polls
+			cli.printFleetSummary(s, false)
+		case <-done:
+			running = false
+		}
+	}
+	// Totals over the whole run; latencies are only kept per summary
+	total := stats.summary(cli.now().Sub(start), cli.now().Sub(start), 0)
+	total.P50MS, total.P99MS, total.MaxMS = 0, 0, 0
+	cli.printFleetSummary(total, true)
+
+	if *remove {
+		// The devices stopped because clientCtx is done, which would
+		// abort the removals too
+		cli.clientCtx = context.Background()
+		api := cli.apiClient()
+		removed := 0
+		for _, id := range ids {
+			if err := api.Remove(cli.clientCtx, id); err == nil {
+				removed++
+			}
+		}
+		fmt.Printf("Removed %d of %d ESPs\n", removed, len(ids))
+	}
+}
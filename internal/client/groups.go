@@ -0,0 +1,137 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/smileyfaceskobochka/trashbin-daemon/internal/server"
+)
+
+// --- Client Mode ---
+
+func (cli *CLI) runGroupCommand(args []string) {
+	if len(args) < 1 {
+		printGroupUsage()
+	}
+
+	switch args[0] {
+	case "create":
+		if len(args) < 2 {
+			printGroupUsage()
+		}
+		members := args[2:]
+		for i, id := range members {
+			members[i] = cli.resolveAlias(id)
+		}
+		body, _ := json.Marshal(map[string]interface{}{"name": args[1], "members": members})
+		resp := cli.groupRequest(http.MethodPost, "/groups", body)
+		defer resp.Body.Close()
+
+		var g server.Group
+		json.NewDecoder(resp.Body).Decode(&g)
+		if len(g.Members) == 0 {
+			fmt.Printf("Group @%s created\n", g.Name)
+		} else {
+			fmt.Printf("Group @%s created: %s\n", g.Name, strings.Join(g.Members, ", "))
+		}
+
+	case "list":
+		resp := cli.groupRequest(http.MethodGet, "/groups", nil)
+		defer resp.Body.Close()
+
+		var result struct {
+			Groups []server.Group `json:"groups"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			fmt.Println("Error decoding response")
+			os.Exit(1)
+		}
+		if len(result.Groups) == 0 {
+			fmt.Println("No groups")
+			return
+		}
+		fmt.Println("Groups:")
+		for _, g := range result.Groups {
+			members := "none"
+			if len(g.Members) > 0 {
+				members = strings.Join(g.Members, ", ")
+			}
+			fmt.Printf("  @%-15s %s\n", g.Name, members)
+		}
+
+	case "delete":
+		if len(args) < 2 {
+			printGroupUsage()
+		}
+		resp := cli.groupRequest(http.MethodDelete, "/groups?name="+url.QueryEscape(args[1]), nil)
+		resp.Body.Close()
+		fmt.Printf("Group @%s deleted\n", strings.TrimPrefix(args[1], "@"))
+
+	case "add", "remove":
+		if len(args) < 3 {
+			printGroupUsage()
+		}
+		method := http.MethodPost
+		if args[0] == "remove" {
+			method = http.MethodDelete
+		}
+		name := strings.TrimPrefix(args[1], "@")
+		for _, id := range args[2:] {
+			body, _ := json.Marshal(map[string]string{"name": name, "esp_id": cli.resolveAlias(id)})
+			resp := cli.groupRequest(method, "/groups/members", body)
+			resp.Body.Close()
+			if method == http.MethodPost {
+				fmt.Printf("Added %s to @%s\n", id, name)
+			} else {
+				fmt.Printf("Removed %s from @%s\n", id, name)
+			}
+		}
+
+	default:
+		printGroupUsage()
+	}
+}
+
+func printGroupUsage() {
+	fmt.Println(`Usage:
+  wake-on-demand group create <name> [esp_id...]
+  wake-on-demand group list
+  wake-on-demand group delete <name>
+  wake-on-demand group add <name> <esp_id>...
+  wake-on-demand group remove <name> <esp_id>...`)
+	os.Exit(1)
+}
+
+func (cli *CLI) groupRequest(method, path string, body []byte) *http.Response {
+	req, _ := http.NewRequest(method, cli.serverURL+server.APIPrefix+path, bytes.NewReader(body))
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	cli.setAuthHeader(req)
+
+	resp, err := cli.httpClient.Do(req)
+	if err != nil {
+		cli.exitOnRequestError(err)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		return resp
+	case http.StatusUnauthorized:
+		fmt.Println("Error: Unauthorized (check -admin-key)")
+	case http.StatusForbidden:
+		fmt.Println("Error: Managing groups requires the admin role")
+	case http.StatusNotFound:
+		fmt.Println("Error: Group not found")
+	default:
+		fmt.Printf("Error: %s\n", responseError(resp))
+	}
+	resp.Body.Close()
+	os.Exit(httpExitStatus(resp.StatusCode))
+	return nil
+}
@@ -0,0 +1,182 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	rand "math/rand/v2"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"time"
+
+	"github.com/smileyfaceskobochka/trashbin-daemon/internal/server"
+)
+
+// Client commands share httpClient, whose transport gives every request
+// attempt a deadline, retries idempotent requests with exponential backoff
+// and aborts whatever is in flight on Ctrl-C.
+
+const (
+	defaultRequestTimeout = 30 * time.Second
+	defaultRetries        = 2
+	retryBaseDelay        = 250 * time.Millisecond
+	retryMaxDelay         = 5 * time.Second
+)
+
+var (
+	errRequestTimeout = errors.New("no response")
+	errInterrupted    = errors.New("interrupted")
+)
+
+// httpclientState holds the CLI state kept in httpclient.go.
+type httpclientState struct {
+	requestTimeout time.Duration
+	requestRetries int
+	// clientCtx is cancelled by the first Ctrl-C in client mode; a second
+	// one kills the process as usual.
+	clientCtx context.Context
+}
+
+// watchInterrupt makes Ctrl-C cancel clientCtx.
+func (cli *CLI) watchInterrupt() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	cli.clientCtx = ctx
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+}
+
+// interrupted reports whether the user pressed Ctrl-C.
+func (cli *CLI) interrupted() bool {
+	return cli.clientCtx.Err() != nil
+}
+
+// retryTransport wraps the client transport with deadlines, retries and
+// interrupt handling.
+type retryTransport struct {
+	base http.RoundTripper
+	cli  *CLI
+}
+
+func (t retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	attempts := 1
+	if idempotent(req) {
+		attempts += max(t.cli.requestRetries, 0)
+	}
+
+	for attempt := 1; ; attempt++ {
+		resp, err := t.attempt(req)
+		if attempt == attempts || t.cli.interrupted() || req.Context().Err() != nil || !retryable(resp, err) {
+			return resp, err
+		}
+		delay := retryDelay(attempt, resp)
+		if resp != nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+		}
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-t.cli.clientCtx.Done():
+			return nil, errInterrupted
+		}
+	}
+}
+
+// attempt sends the request once, bound to the attempt deadline and to
+// clientCtx. Both stay in force until the body is closed.
+func (t retryTransport) attempt(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	if t.cli.requestTimeout > 0 {
+		ctx, cancel = context.WithTimeout(req.Context(), t.cli.requestTimeout)
+	}
+	stop := context.AfterFunc(t.cli.clientCtx, cancel)
+	release := func() {
+		stop()
+		cancel()
+	}
+
+	resp, err := t.base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		release()
+		switch {
+		case req.Context().Err() != nil:
+		case t.cli.interrupted():
+			return nil, errInterrupted
+		case errors.Is(ctx.Err(), context.DeadlineExceeded):
+			// Not the caller's deadline, which means something else to them
+			return nil, fmt.Errorf("%w after %s", errRequestTimeout, t.cli.requestTimeout)
+		}
+		return nil, err
+	}
+	resp.Body = &releaseBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+type releaseBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
+
+// idempotent reports whether a request may be sent again. POSTs are not
+// retried: a command whose response was lost may already be queued.
+func idempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+	case http.MethodPost:
+		if req.Header.Get(server.IdempotencyHeader) == "" {
+			return false
+		}
+	default:
+		return false
+	}
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// retryable covers network errors, timeouts and responses from a server
+// or proxy that is briefly unavailable. 503 without Retry-After is an
+// offline device, which retrying doesn't fix.
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusGatewayTimeout:
+		return true
+	case http.StatusServiceUnavailable:
+		return resp.Header.Get("Retry-After") != ""
+	}
+	return false
+}
+
+// retryDelay doubles from retryBaseDelay with jitter, or follows a short
+// Retry-After from the server.
+func retryDelay(attempt int, resp *http.Response) time.Duration {
+	if resp != nil {
+		if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs >= 0 {
+			return min(time.Duration(secs)*time.Second, retryMaxDelay)
+		}
+	}
+	delay := min(retryBaseDelay<<(attempt-1), retryMaxDelay)
+	return delay/2 + rand.N(delay/2+1)
+}
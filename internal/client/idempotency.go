@@ -0,0 +1,16 @@
+package client
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// --- Client Mode ---
+
+// newIdempotencyKey returns a random key, so the client's own retries of a
+// command can't send it twice.
+func newIdempotencyKey() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
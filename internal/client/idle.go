@@ -0,0 +1,89 @@
+package client
+
+import (
+	"bufio"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// --- Agent side ---
+
+// activitySampler measures what the idle policies look at. CPU usage needs
+// two samples, so the first check-in reports none.
+type activitySampler struct {
+	idle, total uint64
+}
+
+// sample returns the activity as check-in query parameters. Only Linux
+// has the /proc files it reads; elsewhere nothing is reported.
+func (s *activitySampler) sample() url.Values {
+	q := url.Values{}
+	if idle, total, ok := readCPUTimes(); ok {
+		if s.total != 0 && total > s.total {
+			busy := 1 - float64(idle-s.idle)/float64(total-s.total)
+			q.Set("cpu", strconv.FormatFloat(100*busy, 'f', 1, 64))
+		}
+		s.idle, s.total = idle, total
+	}
+	if data, err := os.ReadFile("/proc/loadavg"); err == nil {
+		if fields := strings.Fields(string(data)); len(fields) > 0 {
+			q.Set("load", fields[0])
+		}
+	}
+	if n, ok := countSSHSessions(); ok {
+		q.Set("ssh", strconv.Itoa(n))
+	}
+	return q
+}
+
+// readCPUTimes returns idle (including iowait) and total jiffies from the
+// first line of /proc/stat.
+func readCPUTimes() (idle, total uint64, ok bool) {
+	f, err := os.Open("/proc/stat")
+	if err != nil {
+		return 0, 0, false
+	}
+	defer f.Close()
+	line, err := bufio.NewReader(f).ReadString('\n')
+	fields := strings.Fields(line)
+	if err != nil || len(fields) < 6 || fields[0] != "cpu" {
+		return 0, 0, false
+	}
+	// user nice system idle iowait irq softirq steal; guest time is
+	// already counted in user
+	for i, field := range fields[1:min(len(fields), 9)] {
+		v, err := strconv.ParseUint(field, 10, 64)
+		if err != nil {
+			return 0, 0, false
+		}
+		total += v
+		if i == 3 || i == 4 {
+			idle += v
+		}
+	}
+	return idle, total, true
+}
+
+// countSSHSessions counts established TCP connections to local port 22.
+func countSSHSessions() (int, bool) {
+	count, found := 0, false
+	for _, path := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		found = true
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			// sl local_address rem_address st ...; st 01 is ESTABLISHED
+			fields := strings.Fields(scanner.Text())
+			if len(fields) > 3 && strings.HasSuffix(fields[1], ":0016") && fields[3] == "01" {
+				count++
+			}
+		}
+		f.Close()
+	}
+	return count, found
+}
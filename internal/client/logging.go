@@ -0,0 +1,17 @@
+package client
+
+import (
+	"log/slog"
+)
+
+// loggingState holds the CLI state kept in logging.go.
+type loggingState struct {
+	// baseLogger is the logger the component loggers derive from
+	baseLogger *slog.Logger
+}
+
+// logger returns a logger tagged with a subsystem name, for the client
+// commands that log, like the agent and the simulator.
+func (cli *CLI) logger(component string) *slog.Logger {
+	return cli.baseLogger.With("component", component)
+}
@@ -0,0 +1,218 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/smileyfaceskobochka/trashbin-daemon/internal/server"
+)
+
+const (
+	macroFollowPoll = 500 * time.Millisecond
+)
+
+// --- Client Mode ---
+
+// runMacroCommand starts a macro and prints its steps as they finish, until
+// the run is over or Ctrl-C; the run goes on on the server either way. It
+// exits non-zero when the run failed.
+func (cli *CLI) runMacroCommand(args []string) {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	detach := fs.Bool("detach", false, "Start the macro and return without following it")
+	fs.Usage = func() {
+		fmt.Println("Usage: wake-on-demand run [-detach] <macro>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	body, _ := json.Marshal(map[string]string{"name": fs.Arg(0)})
+	resp := cli.macroRequest(http.MethodPost, "/macros/run", body)
+	var run server.MacroRun
+	json.NewDecoder(resp.Body).Decode(&run)
+	resp.Body.Close()
+	if *detach {
+		if cli.outputMode == outputTable {
+			fmt.Printf("Macro %s started; see: wake-on-demand macros runs %s\n", run.Macro, run.Macro)
+			return
+		}
+		cli.printMacroRuns([]server.MacroRun{run})
+		return
+	}
+
+	if cli.outputMode == outputTable {
+		fmt.Printf("Running %s (%s)\n", run.Macro, run.ID)
+	}
+	printed := 0 // steps printed so far, they finish in order
+	for {
+		if cli.outputMode == outputTable {
+			for ; printed < len(run.Steps) && slices.Contains([]string{"ok", "failed", "skipped"}, run.Steps[printed].Status); printed++ {
+				printHookStep(run.Steps[printed])
+			}
+		}
+		if run.Status != "running" {
+			break
+		}
+		select {
+		case <-time.After(macroFollowPoll):
+		case <-cli.clientCtx.Done():
+			fmt.Fprintf(os.Stderr, "\nStill running on the server; see: wake-on-demand macros runs %s\n", run.Macro)
+			os.Exit(130)
+		}
+		resp := cli.macroRequest(http.MethodGet, "/macros/runs?"+url.Values{"id": {run.ID}}.Encode(), nil)
+		var result struct {
+			Runs []server.MacroRun `json:"runs"`
+		}
+		json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if len(result.Runs) == 0 {
+			fmt.Println("Error: the run is no longer kept by the server")
+			os.Exit(1)
+		}
+		run = result.Runs[0]
+	}
+
+	if cli.outputMode == outputTable {
+		fmt.Printf("%s %s in %s\n", run.Macro, run.Status, run.FinishedAt.Sub(run.StartedAt).Round(time.Millisecond))
+	} else {
+		cli.printMacroRuns([]server.MacroRun{run})
+	}
+	if run.Status != "ok" {
+		os.Exit(1)
+	}
+}
+
+func (cli *CLI) runMacrosCommand(args []string) {
+	if len(args) == 0 {
+		args = []string{"list"}
+	}
+	switch args[0] {
+	case "list":
+		resp := cli.macroRequest(http.MethodGet, "/macros", nil)
+		defer resp.Body.Close()
+		var result struct {
+			Macros []server.MacroInfo `json:"macros"`
+		}
+		json.NewDecoder(resp.Body).Decode(&result)
+		cli.printMacros(result.Macros)
+
+	case "runs":
+		fs := flag.NewFlagSet("macros runs", flag.ExitOnError)
+		limit := fs.Int("limit", server.DefaultHookRunPage, "Maximum number of runs")
+		fs.Usage = func() {
+			fmt.Println("Usage: wake-on-demand macros runs [-limit 20] [macro]")
+			fs.PrintDefaults()
+		}
+		fs.Parse(args[1:])
+		q := url.Values{"limit": {strconv.Itoa(*limit)}}
+		if fs.NArg() > 0 {
+			q.Set("macro", fs.Arg(0))
+		}
+		resp := cli.macroRequest(http.MethodGet, "/macros/runs?"+q.Encode(), nil)
+		defer resp.Body.Close()
+		var result struct {
+			Runs []server.MacroRun `json:"runs"`
+		}
+		json.NewDecoder(resp.Body).Decode(&result)
+		cli.printMacroRuns(result.Runs)
+
+	default:
+		fmt.Println(`Usage:
+  wake-on-demand macros [list]
+  wake-on-demand macros runs [-limit 20] [macro]
+  wake-on-demand run [-detach] <macro>`)
+		os.Exit(1)
+	}
+}
+
+func (cli *CLI) macroRequest(method, path string, body []byte) *http.Response {
+	req, _ := http.NewRequest(method, cli.serverURL+server.APIPrefix+path, bytes.NewReader(body))
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	cli.setAuthHeader(req)
+
+	resp, err := cli.httpClient.Do(req)
+	if err != nil {
+		cli.exitOnRequestError(err)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusAccepted:
+		return resp
+	case http.StatusUnauthorized:
+		fmt.Println("Error: Unauthorized (check -admin-key)")
+	default:
+		fmt.Printf("Error: %s\n", responseError(resp))
+	}
+	resp.Body.Close()
+	os.Exit(httpExitStatus(resp.StatusCode))
+	return nil
+}
+
+func (cli *CLI) printMacros(macros []server.MacroInfo) {
+	switch cli.outputMode {
+	case outputJSON:
+		printJSON(macros)
+		return
+	case outputPlain:
+		for _, m := range macros {
+			printRecord(m.Name, m.Running, strings.Join(m.Steps, ", "), m.Description)
+		}
+		return
+	}
+	if len(macros) == 0 {
+		fmt.Println("No macros")
+		return
+	}
+	for _, m := range macros {
+		line := m.Name
+		if m.Description != "" {
+			line += "  " + m.Description
+		}
+		if m.Running {
+			line += "  (running)"
+		}
+		fmt.Println(line)
+		for i, s := range m.Steps {
+			fmt.Printf("  %d. %s\n", i+1, s)
+		}
+	}
+}
+
+func (cli *CLI) printMacroRuns(runs []server.MacroRun) {
+	switch cli.outputMode {
+	case outputJSON:
+		printJSON(runs)
+		return
+	case outputPlain:
+		for _, run := range runs {
+			for _, s := range run.Steps {
+				printRecord(run.StartedAt, run.ID, run.Macro, run.Status, s.Name, s.Status, s.Attempts, s.DurationMS, s.Error)
+			}
+		}
+		return
+	}
+	if len(runs) == 0 {
+		fmt.Println("No macro runs")
+		return
+	}
+	for _, run := range runs {
+		fmt.Printf("%s  %s  %s  %s (%s)\n", run.StartedAt.Local().Format(time.DateTime), run.ID, run.Macro, run.Status, run.Actor)
+		for _, s := range run.Steps {
+			printHookStep(s)
+		}
+	}
+}
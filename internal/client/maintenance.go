@@ -0,0 +1,93 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/smileyfaceskobochka/trashbin-daemon/internal/server"
+	wod "github.com/smileyfaceskobochka/trashbin-daemon/pkg/client"
+)
+
+// --- Client Mode ---
+
+func (cli *CLI) runMaintenance(args []string) {
+	fs := flag.NewFlagSet("maintenance", flag.ExitOnError)
+	duration := fs.Duration("for", 0, "End maintenance by itself after this long (default: until turned off)")
+	reason := fs.String("reason", "", "Why the device is frozen, shown in list and info")
+	fs.Usage = func() {
+		fmt.Println("Usage: wake-on-demand maintenance <esp_id> on [-for 2h] [-reason <text>]")
+		fmt.Println("       wake-on-demand maintenance <esp_id> off")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	rest := fs.Args()
+	if len(rest) < 2 || rest[1] != "on" && rest[1] != "off" {
+		fs.Usage()
+		os.Exit(1)
+	}
+	fs.Parse(rest[2:])
+	espID, enabled := cli.resolveAlias(rest[0]), rest[1] == "on"
+	if *duration < 0 || !enabled && (*duration != 0 || *reason != "") {
+		fmt.Println("Error: -for must be positive, and -for and -reason only apply to 'on'")
+		os.Exit(1)
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{"id": espID, "enabled": enabled, "duration_ms": duration.Milliseconds(), "reason": *reason})
+	req, _ := http.NewRequest(http.MethodPost, cli.serverURL+server.APIPrefix+"/maintenance", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	cli.setAuthHeader(req)
+
+	resp, err := cli.httpClient.Do(req)
+	if err != nil {
+		cli.exitOnRequestError(err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized:
+		fmt.Println("Error: Unauthorized (check -admin-key)")
+		os.Exit(exitUnauthorized)
+	case http.StatusForbidden:
+		fmt.Println("Error: Only admins can change maintenance mode")
+		os.Exit(exitForbidden)
+	case http.StatusNotFound:
+		fmt.Printf("ESP '%s' not registered\n", espID)
+		os.Exit(exitNotFound)
+	default:
+		fmt.Printf("Error: %s\n", responseError(resp))
+		os.Exit(httpExitStatus(resp.StatusCode))
+	}
+	var result struct {
+		Maintenance *wod.Maintenance `json:"maintenance"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+	switch {
+	case cli.outputMode == outputJSON:
+		printJSON(result.Maintenance)
+	case result.Maintenance == nil:
+		fmt.Printf("%s is out of maintenance\n", espID)
+	default:
+		fmt.Printf("%s is in maintenance %s\n", espID, cli.formatMaintenance(result.Maintenance))
+	}
+}
+
+// formatMaintenance describes how long a device stays frozen, and why.
+func (cli *CLI) formatMaintenance(m *wod.Maintenance) string {
+	s := "until turned off"
+	if m.Until != nil {
+		s = fmt.Sprintf("until %s (%s left)", m.Until.Local().Format("Jan 2 15:04"), (*m.Until).Sub(cli.now()).Round(time.Minute))
+	}
+	if m.By != "" {
+		s += ", by " + m.By
+	}
+	if m.Reason != "" {
+		s += ": " + m.Reason
+	}
+	return s
+}
@@ -0,0 +1,173 @@
+package client
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/smileyfaceskobochka/trashbin-daemon/internal/server"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// --- Client Mode ---
+
+// discoveredServer is one server found over mDNS.
+type discoveredServer struct {
+	Name    string `json:"name"`
+	URL     string `json:"url"`
+	Version string `json:"version,omitempty"`
+}
+
+// discoverServers asks the local network for servers and collects the
+// answers that arrive within timeout.
+func discoverServers(timeout time.Duration) ([]discoveredServer, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	query, err := (&dnsmessage.Message{Questions: []dnsmessage.Question{
+		{Name: dnsmessage.MustNewName(server.MDNSService), Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET},
+	}}).Pack()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.WriteTo(query, server.MDNSGroup); err != nil {
+		return nil, fmt.Errorf("send mDNS query: %w", err)
+	}
+
+	type instance struct {
+		host string
+		port uint16
+		txt  []string
+		from net.IP
+	}
+	instances := make(map[string]*instance)
+	hosts := make(map[string]net.IP)
+	get := func(name string) *instance {
+		name = strings.ToLower(name)
+		if instances[name] == nil {
+			instances[name] = &instance{}
+		}
+		return instances[name]
+	}
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			break
+		}
+		var msg dnsmessage.Message
+		if msg.Unpack(buf[:n]) != nil || !msg.Header.Response {
+			continue
+		}
+		for _, rr := range append(msg.Answers, msg.Additionals...) {
+			name := rr.Header.Name.String()
+			switch body := rr.Body.(type) {
+			case *dnsmessage.PTRResource:
+				if strings.EqualFold(name, server.MDNSService) {
+					get(body.PTR.String()).from = src.IP
+				}
+			case *dnsmessage.SRVResource:
+				inst := get(name)
+				inst.host, inst.port = strings.ToLower(body.Target.String()), body.Port
+			case *dnsmessage.TXTResource:
+				get(name).txt = body.TXT
+			case *dnsmessage.AResource:
+				hosts[strings.ToLower(name)] = net.IP(body.A[:])
+			}
+		}
+	}
+
+	var found []discoveredServer
+	for name, inst := range instances {
+		if inst.port == 0 || !strings.HasSuffix(name, server.MDNSService) {
+			continue
+		}
+		ip := hosts[inst.host]
+		if ip == nil {
+			// Not every responder sends the A record along
+			ip = inst.from
+		}
+		if ip == nil {
+			continue
+		}
+		s := discoveredServer{Name: strings.TrimSuffix(name, "."+server.MDNSService)}
+		scheme := "http"
+		for _, kv := range inst.txt {
+			switch k, v, _ := strings.Cut(kv, "="); k {
+			case "tls":
+				if v == "1" {
+					scheme = "https"
+				}
+			case "version":
+				s.Version = v
+			}
+		}
+		s.URL = fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(ip.String(), fmt.Sprint(inst.port)))
+		found = append(found, s)
+	}
+	slices.SortFunc(found, func(a, b discoveredServer) int { return strings.Compare(a.Name, b.Name) })
+	return found, nil
+}
+
+// resolveAutoServer replaces -server auto with the first server found.
+func (cli *CLI) resolveAutoServer() {
+	found, err := discoverServers(2 * time.Second)
+	if err != nil {
+		fmt.Printf("Error: Could not discover a server: %v\n", err)
+		os.Exit(1)
+	}
+	if len(found) == 0 {
+		fmt.Println("Error: No server found over mDNS (is the server running with -mdns on this network?)")
+		os.Exit(1)
+	}
+	if len(found) > 1 {
+		fmt.Fprintf(os.Stderr, "Found %d servers, using %s (%s)\n", len(found), found[0].Name, found[0].URL)
+	}
+	cli.serverURL = found[0].URL
+}
+
+func (cli *CLI) runDiscover(args []string) {
+	fs := flag.NewFlagSet("discover", flag.ExitOnError)
+	timeout := fs.Duration("timeout", 2*time.Second, "How long to wait for answers")
+	fs.Usage = func() {
+		fmt.Println("Usage: wake-on-demand discover [-timeout 2s]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	found, err := discoverServers(*timeout)
+	if err != nil {
+		fmt.Printf("Error: Could not discover servers: %v\n", err)
+		os.Exit(1)
+	}
+	switch cli.outputMode {
+	case outputJSON:
+		printJSON(found)
+		return
+	case outputPlain:
+		for _, s := range found {
+			printRecord(s.Name, s.URL, s.Version)
+		}
+		return
+	}
+	if len(found) == 0 {
+		fmt.Println("No servers found")
+		return
+	}
+	fmt.Println("Servers found:")
+	for _, s := range found {
+		version := ""
+		if s.Version != "" {
+			version = " (v" + s.Version + ")"
+		}
+		fmt.Printf("  %-20s %s%s\n", s.Name, s.URL, version)
+	}
+}
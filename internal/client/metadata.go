@@ -0,0 +1,74 @@
+package client
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	wod "github.com/smileyfaceskobochka/trashbin-daemon/pkg/client"
+)
+
+// --- Client Mode ---
+
+func (cli *CLI) runEdit(args []string) {
+	fs := flag.NewFlagSet("edit", flag.ExitOnError)
+	alias := fs.String("alias", "", "Name usable in place of the ESP ID")
+	description := fs.String("description", "", "Free-form description")
+	location := fs.String("location", "", "Where the device is")
+	hostname := fs.String("hostname", "", "Hostname of the machine the ESP controls")
+	protected := fs.Bool("protected", false, "Reject 'off' unless sent with -override (-protected=false to clear)")
+	cooldown := fs.Duration("cooldown", 0, "Refuse on and off for this long after one reached the device (0 uses the server's -command-cooldown)")
+	fs.Usage = func() {
+		fmt.Println("Usage: wake-on-demand edit <esp_id> [-alias <name>] [-description <text>] [-location <text>] [-hostname <name>] [-protected[=false]] [-cooldown <duration>]")
+		fmt.Println("An empty value clears a field, e.g. -alias \"\"")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	rest := fs.Args()
+	if len(rest) < 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	fs.Parse(rest[1:])
+	espID := cli.resolveAlias(rest[0])
+
+	var u wod.MetadataUpdate
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "alias":
+			u.Alias = alias
+		case "description":
+			u.Description = description
+		case "location":
+			u.Location = location
+		case "hostname":
+			u.Hostname = hostname
+		case "protected":
+			u.Protected = protected
+		case "cooldown":
+			ms := cooldown.Milliseconds()
+			u.CooldownMS = &ms
+		}
+	})
+	if u == (wod.MetadataUpdate{}) {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	d, err := cli.apiClient().UpdateMetadata(cli.clientCtx, espID, u)
+	if errors.Is(err, wod.ErrNotFound) {
+		fmt.Printf("ESP '%s' not registered\n", espID)
+		os.Exit(cli.exitStatus(err))
+	} else if err != nil {
+		cli.exitOnClientError(err)
+	}
+	switch cli.outputMode {
+	case outputJSON:
+		printJSON(d)
+	case outputPlain:
+		printDeviceRecord(d.Device)
+	default:
+		fmt.Printf("Updated %s\n", d.ID)
+	}
+}
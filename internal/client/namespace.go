@@ -0,0 +1,25 @@
+package client
+
+import (
+	"strings"
+)
+
+// Namespaces keep separate sites on one server apart. An ESP ID of the
+// form "<namespace>/<name>", such as "home/nas", puts the device in that
+// namespace; IDs without a slash are in the default namespace. Users bound
+// to a namespace only see and control its devices, and a namespace token
+// lets every device of a site register with one shared secret.
+
+// namespaceState holds the CLI state kept in namespace.go.
+type namespaceState struct {
+	// clientNamespace qualifies bare ESP IDs given to client commands.
+	clientNamespace string
+}
+
+// qualifyID puts a bare ESP ID into the -namespace the client was given.
+func (cli *CLI) qualifyID(id string) string {
+	if cli.clientNamespace == "" || id == "" || id == "*" || strings.Contains(id, "/") {
+		return id
+	}
+	return cli.clientNamespace + "/" + id
+}
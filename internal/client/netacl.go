@@ -0,0 +1,37 @@
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/smileyfaceskobochka/trashbin-daemon/internal/server"
+)
+
+// --- Client Mode ---
+
+func (cli *CLI) resetPin(espID string) {
+	req, _ := http.NewRequest(http.MethodDelete, cli.serverURL+server.APIPrefix+"/pin?id="+url.QueryEscape(espID), nil)
+	cli.setAuthHeader(req)
+
+	resp, err := cli.httpClient.Do(req)
+	if err != nil {
+		cli.exitOnRequestError(err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		fmt.Printf("Pin for %s reset; the next registration pins it again\n", espID)
+	case http.StatusNotFound:
+		fmt.Printf("ESP '%s' not registered\n", espID)
+		os.Exit(exitNotFound)
+	case http.StatusUnauthorized:
+		fmt.Println("Error: Unauthorized (check -admin-key)")
+		os.Exit(exitUnauthorized)
+	default:
+		fmt.Printf("Error: %s\n", responseError(resp))
+		os.Exit(httpExitStatus(resp.StatusCode))
+	}
+}
@@ -0,0 +1,61 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/smileyfaceskobochka/trashbin-daemon/internal/server"
+)
+
+// --- Client Mode ---
+
+func (cli *CLI) runNotifyCommand(args []string) {
+	if len(args) < 1 || args[0] != "test" {
+		fmt.Println("Usage: wake-on-demand notify test")
+		os.Exit(1)
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, cli.serverURL+server.APIPrefix+"/notify-test", nil)
+	cli.setAuthHeader(req)
+	resp, err := cli.httpClient.Do(req)
+	if err != nil {
+		cli.exitOnRequestError(err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized:
+		fmt.Println("Error: Unauthorized (check -admin-key)")
+		os.Exit(exitUnauthorized)
+	default:
+		fmt.Printf("Error: %s\n", responseError(resp))
+		os.Exit(httpExitStatus(resp.StatusCode))
+	}
+
+	var result struct {
+		Results []struct {
+			Sink   string `json:"sink"`
+			Status string `json:"status"`
+			Error  string `json:"error"`
+		} `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		fmt.Println("Error decoding response")
+		os.Exit(1)
+	}
+	failed := false
+	for _, r := range result.Results {
+		if r.Status == "ok" {
+			fmt.Printf("  %-10s sent\n", r.Sink)
+		} else {
+			fmt.Printf("  %-10s failed: %s\n", r.Sink, r.Error)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,114 @@
+package client
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/smileyfaceskobochka/trashbin-daemon/internal/server"
+)
+
+// --- Client Mode ---
+
+func (cli *CLI) runOTACommand(args []string) {
+	if len(args) < 1 {
+		printOTAUsage()
+	}
+
+	switch args[0] {
+	case "upload":
+		if len(args) < 4 {
+			printOTAUsage()
+		}
+		data, err := os.ReadFile(args[3])
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		sum := sha256.Sum256(data)
+		path := "/ota?" + url.Values{
+			"model":   {args[1]},
+			"version": {args[2]},
+			"sha256":  {hex.EncodeToString(sum[:])},
+		}.Encode()
+		resp := cli.otaRequest(http.MethodPost, path, data)
+		defer resp.Body.Close()
+
+		var f server.Firmware
+		json.NewDecoder(resp.Body).Decode(&f)
+		fmt.Printf("Uploaded %s %s (%d bytes, sha256 %s)\n", f.Model, f.Version, f.Size, f.SHA256)
+
+	case "list":
+		resp := cli.otaRequest(http.MethodGet, "/ota", nil)
+		defer resp.Body.Close()
+
+		var result struct {
+			Firmware []server.Firmware `json:"firmware"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			fmt.Println("Error decoding response")
+			os.Exit(1)
+		}
+		if len(result.Firmware) == 0 {
+			fmt.Println("No firmware uploaded")
+			return
+		}
+		fmt.Println("Firmware:")
+		for _, f := range result.Firmware {
+			fmt.Printf("  %-16s %-12s %8d bytes  %s  %s\n", f.Model, f.Version, f.Size, f.UploadedAt.Local().Format(time.DateTime), f.SHA256[:12])
+		}
+
+	case "remove":
+		if len(args) < 3 {
+			printOTAUsage()
+		}
+		path := "/ota?" + url.Values{"model": {args[1]}, "version": {args[2]}}.Encode()
+		resp := cli.otaRequest(http.MethodDelete, path, nil)
+		resp.Body.Close()
+		fmt.Printf("Firmware %s %s removed\n", args[1], args[2])
+
+	default:
+		printOTAUsage()
+	}
+}
+
+func printOTAUsage() {
+	fmt.Println(`Usage:
+  wake-on-demand ota upload <model> <version> <file.bin>
+  wake-on-demand ota list
+  wake-on-demand ota remove <model> <version>`)
+	os.Exit(1)
+}
+
+func (cli *CLI) otaRequest(method, path string, body []byte) *http.Response {
+	req, _ := http.NewRequest(method, cli.serverURL+server.APIPrefix+path, bytes.NewReader(body))
+	if body != nil {
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	cli.setAuthHeader(req)
+
+	resp, err := cli.httpClient.Do(req)
+	if err != nil {
+		cli.exitOnRequestError(err)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		return resp
+	case http.StatusUnauthorized:
+		fmt.Println("Error: Unauthorized (check -admin-key)")
+	case http.StatusNotFound:
+		fmt.Println("Error: Firmware not found")
+	default:
+		fmt.Printf("Error: %s\n", responseError(resp))
+	}
+	resp.Body.Close()
+	os.Exit(httpExitStatus(resp.StatusCode))
+	return nil
+}
@@ -0,0 +1,138 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/smileyfaceskobochka/trashbin-daemon/internal/server"
+	wod "github.com/smileyfaceskobochka/trashbin-daemon/pkg/client"
+)
+
+// Output formats for client commands: table is the human format with
+// colors, plain prints one tab-separated record per line without colors or
+// headers, and json prints the server's response.
+type outputFormat string
+
+const (
+	outputTable outputFormat = "table"
+	outputPlain outputFormat = "plain"
+	outputJSON  outputFormat = "json"
+)
+
+// outputState holds the CLI state kept in output.go.
+type outputState struct {
+	outputMode outputFormat
+}
+
+func parseOutputFormat(s string) (outputFormat, error) {
+	switch f := outputFormat(strings.ToLower(s)); f {
+	case outputTable, outputPlain, outputJSON:
+		return f, nil
+	}
+	return "", fmt.Errorf("invalid output format %q (use json, table or plain)", s)
+}
+
+// setQuiet discards everything client commands print, leaving only the
+// exit code.
+func setQuiet() {
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		return
+	}
+	os.Stdout = devNull
+}
+
+func printJSON(v interface{}) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// printRecord prints one plain record. Empty fields become "-" so every
+// line has the same number of columns.
+func printRecord(fields ...interface{}) {
+	cols := make([]string, len(fields))
+	for i, f := range fields {
+		var s string
+		switch v := f.(type) {
+		case time.Time:
+			if !v.IsZero() {
+				s = v.Format(time.RFC3339)
+			}
+		case *time.Time:
+			if v != nil {
+				s = v.Format(time.RFC3339)
+			}
+		default:
+			s = fmt.Sprint(v)
+		}
+		if s == "" {
+			s = "-"
+		}
+		cols[i] = strings.ReplaceAll(s, "\t", " ")
+	}
+	fmt.Println(strings.Join(cols, "\t"))
+}
+
+// printDeviceRecord prints id, alias, type, state, power and last seen.
+func printDeviceRecord(d wod.Device) {
+	printRecord(d.ID, d.Alias, d.Type, deviceState(d), devicePower(d), d.LastSeen)
+}
+
+// lastPowerNote describes the last observed power state, e.g. "last off 5m0s ago".
+func (cli *CLI) lastPowerNote(p *wod.PowerReport) string {
+	return fmt.Sprintf("last %s %s ago", p.State, cli.now().Sub(p.At).Round(time.Second))
+}
+
+// deviceState is online, offline, or wol for hosts without an ESP; conflict
+// and pending win over both.
+func deviceState(d wod.Device) string {
+	if d.Type == string(server.DeviceWoL) {
+		return "wol"
+	} else if d.Conflict != nil {
+		return "conflict"
+	} else if d.PendingSince != nil {
+		return "pending"
+	} else if d.Online {
+		return "online"
+	}
+	return "offline"
+}
+
+func (cli *CLI) conflictSender(s wod.IDSender) string {
+	line := s.Addr
+	if s.Instance != "" {
+		line += " instance " + s.Instance
+	}
+	line += fmt.Sprintf(", last seen %s ago", cli.now().Sub(s.LastSeen).Round(time.Second))
+	if s.Rejected {
+		line += ", rejected"
+	}
+	return line
+}
+
+func (cli *CLI) formatActivity(a *wod.Activity) string {
+	s := (&server.AgentActivity{CPU: a.CPU, Load: a.Load, SSHSessions: a.SSHSessions}).String()
+	if s == "" {
+		s = "nothing reported"
+	}
+	return fmt.Sprintf("%s, %s ago", s, cli.now().Sub(a.ReportedAt).Round(time.Second))
+}
+
+// devicePower is the target's power state, or "" for devices without a
+// target.
+func devicePower(d wod.Device) string {
+	if d.Power != nil {
+		return d.Power.State
+	}
+	if d.Target != nil {
+		if d.TargetState != nil {
+			return server.UpDown(d.TargetState.Up)
+		}
+		return "unknown"
+	}
+	return ""
+}
@@ -0,0 +1,41 @@
+package client
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	wod "github.com/smileyfaceskobochka/trashbin-daemon/pkg/client"
+)
+
+// --- Client Mode ---
+
+func (cli *CLI) runApprove(args []string) {
+	fs := flag.NewFlagSet("approve", flag.ExitOnError)
+	code := fs.String("code", "", "Pairing code the device printed on its serial console")
+	fs.Usage = func() {
+		fmt.Println("Usage: wake-on-demand approve <esp_id> [-code <code>]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	rest := fs.Args()
+	if len(rest) < 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	fs.Parse(rest[1:])
+	espID := cli.resolveAlias(rest[0])
+
+	if err := cli.apiClient().Approve(cli.clientCtx, espID, *code); errors.Is(err, wod.ErrNotFound) {
+		fmt.Printf("ESP '%s' not registered\n", espID)
+		os.Exit(cli.exitStatus(err))
+	} else if err != nil {
+		cli.exitOnClientError(err)
+	}
+	if cli.outputMode == outputJSON {
+		printJSON(map[string]string{"status": "approved", "id": espID})
+		return
+	}
+	fmt.Printf("%s approved\n", espID)
+}
@@ -0,0 +1,115 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/smileyfaceskobochka/trashbin-daemon/internal/server"
+	wod "github.com/smileyfaceskobochka/trashbin-daemon/pkg/client"
+)
+
+// --- Client Mode ---
+
+func (cli *CLI) runUp(args []string) {
+	fs := flag.NewFlagSet("up", flag.ExitOnError)
+	wait := fs.Duration("wait", 5*time.Minute, "How long to wait for the target to come up (0 returns once sent)")
+	pulse := fs.Duration("pulse", 0, "Power button pulse length (e.g. 750ms)")
+	force := fs.Bool("force", false, "Send the pulse even if the target looks up")
+	ttl := fs.Duration("ttl", 0, "Expire the pulse if it isn't delivered within this long")
+	fs.Usage = func() {
+		fmt.Println("Usage: wake-on-demand up <esp_id> [-wait 5m] [-pulse <duration>] [-ttl <duration>] [-force]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	rest := fs.Args()
+	if len(rest) < 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	fs.Parse(rest[1:])
+	espID := cli.resolveAlias(rest[0])
+	if *pulse != 0 {
+		if err := server.ValidatePulse(*pulse); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	c := cli.apiClient()
+	ctx := cli.clientCtx
+	d, err := c.Info(ctx, espID)
+	if errors.Is(err, wod.ErrNotFound) {
+		fmt.Printf("ESP '%s' not registered\n", espID)
+		os.Exit(cli.exitStatus(err))
+	} else if err != nil {
+		cli.exitOnClientError(err)
+	}
+	if *wait > 0 && d.Power == nil {
+		fmt.Printf("Error: Nothing confirms the power state of %s; set a target or report 'power' from the ESP\n", espID)
+		os.Exit(1)
+	}
+
+	// Scripted output is the device once it is up, not the progress messages
+	human := cli.outputMode == outputTable
+	started := cli.now()
+	switch {
+	case d.Power != nil && d.Power.State == wod.PowerUp && !*force:
+		if human {
+			fmt.Printf("%s is already up\n", espID)
+		} else {
+			cli.printUpResult(d)
+		}
+		return
+	case d.Power != nil && d.Power.State == wod.PowerBooting && !*force:
+		if human {
+			fmt.Printf("%s is already booting\n", espID)
+		}
+	case human:
+		cli.sendCommand("on", espID, wod.CommandOptions{Pulse: *pulse, Force: *force, TTL: *ttl})
+	default:
+		cli.setCommand(espID, wod.CommandPulse, wod.CommandOptions{Pulse: *pulse, Force: *force, TTL: *ttl})
+	}
+	if *wait == 0 {
+		if !human {
+			if d, err = c.Info(ctx, espID); err != nil {
+				cli.exitOnClientError(err)
+			}
+			cli.printUpResult(d)
+		}
+		return
+	}
+
+	if human {
+		fmt.Printf("Waiting up to %s for %s to come up...\n", *wait, espID)
+	}
+	ctx, cancel := context.WithTimeout(ctx, *wait)
+	defer cancel()
+	d, err = c.WaitForPower(ctx, espID, wod.PowerUp, 2*time.Second)
+	if errors.Is(err, context.DeadlineExceeded) {
+		state := "unknown"
+		if d, err := c.Info(cli.clientCtx, espID); err == nil && d.Power != nil {
+			state = d.Power.State
+		}
+		fmt.Printf("Error: %s did not come up within %s (power: %s)\n", espID, *wait, state)
+		os.Exit(1)
+	} else if err != nil {
+		cli.exitOnClientError(err)
+	}
+	if !human {
+		cli.printUpResult(d)
+		return
+	}
+	fmt.Printf("%s is up after %s\n", espID, cli.now().Sub(started).Round(time.Second))
+}
+
+func (cli *CLI) printUpResult(d *wod.DeviceDetails) {
+	if cli.outputMode == outputJSON {
+		printJSON(d)
+	} else {
+		printDeviceRecord(d.Device)
+	}
+}
@@ -0,0 +1,96 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/smileyfaceskobochka/trashbin-daemon/internal/server"
+)
+
+// parseProbeSpec parses "icmp", "tcp:<port>" or "ssh[:<port>]".
+func parseProbeSpec(spec string) (server.ProbeType, int, error) {
+	kind, portStr, hasPort := strings.Cut(spec, ":")
+	port := 0
+	if hasPort {
+		p, err := strconv.Atoi(portStr)
+		if err != nil {
+			return "", 0, fmt.Errorf("invalid port %q", portStr)
+		}
+		port = p
+	}
+	return server.ProbeType(kind), port, nil
+}
+
+// --- Client Mode ---
+
+func (cli *CLI) setTarget(espID string, args []string) {
+	method := http.MethodPost
+	body := map[string]interface{}{"id": espID}
+
+	if len(args) == 1 && args[0] == "none" {
+		method = http.MethodDelete
+	} else {
+		fs := flag.NewFlagSet("target", flag.ExitOnError)
+		window := fs.Duration("verify", 0, "Verify wakes: pulse again if the target isn't up within this long")
+		retries := fs.Int("retries", 2, "Pulses to retry before a verified wake fails")
+		spec, rest := "icmp", args[1:]
+		if len(rest) > 0 && !strings.HasPrefix(rest[0], "-") {
+			spec, rest = rest[0], rest[1:]
+		}
+		fs.Parse(rest)
+		probe, port, err := parseProbeSpec(spec)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		t := server.Target{Host: args[0], Probe: probe, Port: port}
+		fs.Visit(func(f *flag.Flag) {
+			if f.Name == "verify" || f.Name == "retries" {
+				t.Verify = &server.WakeVerify{Window: *window, Retries: *retries}
+			}
+		})
+		if err := t.Validate(); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		body["host"], body["probe"], body["port"], body["verify"] = t.Host, t.Probe, t.Port, t.Verify
+	}
+
+	jsonData, _ := json.Marshal(body)
+	req, _ := http.NewRequest(method, cli.serverURL+server.APIPrefix+"/target", bytes.NewBuffer(jsonData))
+	req.Header.Set("Content-Type", "application/json")
+	cli.setAuthHeader(req)
+
+	resp, err := cli.httpClient.Do(req)
+	if err != nil {
+		cli.exitOnRequestError(err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if method == http.MethodDelete {
+			fmt.Printf("Target removed from %s\n", espID)
+		} else {
+			fmt.Printf("Target for %s set to %s (%s)\n", espID, args[0], body["probe"])
+			if v, _ := body["verify"].(*server.WakeVerify); v != nil {
+				fmt.Printf("Wakes are verified: up to %d retries, %s apart\n", v.Retries, v.RetryWindow())
+			}
+		}
+	case http.StatusUnauthorized:
+		fmt.Println("Error: Unauthorized (check -admin-key)")
+		os.Exit(exitUnauthorized)
+	case http.StatusNotFound:
+		fmt.Printf("ESP '%s' not registered\n", espID)
+		os.Exit(exitNotFound)
+	default:
+		fmt.Printf("Error: %s\n", responseError(resp))
+		os.Exit(httpExitStatus(resp.StatusCode))
+	}
+}
@@ -0,0 +1,184 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	wod "github.com/smileyfaceskobochka/trashbin-daemon/pkg/client"
+)
+
+// The proxy forwards TCP connections to a service on a machine that may be
+// asleep. When the target port doesn't answer, it sends 'on' for the
+// device that powers the machine and holds the connection until the port
+// opens, so e.g. 'ssh -p 2222 proxyhost' wakes the NAS transparently.
+
+const (
+	proxyDialTimeout   = 2 * time.Second
+	proxyRetryInterval = 2 * time.Second
+)
+
+type wakeProxy struct {
+	target      string
+	device      string
+	wakeTimeout time.Duration
+	log         *slog.Logger
+
+	mu       sync.Mutex
+	lastWake time.Time // when 'on' was last sent, so concurrent connections share one wake
+	cli      *CLI
+}
+
+func (cli *CLI) runProxy(args []string) {
+	fs := flag.NewFlagSet("proxy", flag.ExitOnError)
+	listen := fs.String("listen", "", "Address to accept connections on, e.g. :2222")
+	target := fs.String("target", "", "host:port of the service on the machine to wake")
+	device := fs.String("device", "", "ESP ID or alias that powers the machine on")
+	wakeTimeout := fs.Duration("wake-timeout", 3*time.Minute, "How long a connection waits for the target port to open")
+	fs.Usage = func() {
+		fmt.Println("Usage: wake-on-demand [-server <url>] proxy -listen <addr> -target <host:port> -device <esp_id> [-wake-timeout 3m]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *listen == "" || *target == "" || *device == "" {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if _, _, err := net.SplitHostPort(*target); err != nil {
+		fmt.Printf("Error: -target must be host:port: %v\n", err)
+		os.Exit(1)
+	}
+	if *wakeTimeout <= 0 {
+		fmt.Println("Error: -wake-timeout must be positive")
+		os.Exit(1)
+	}
+
+	p := &wakeProxy{target: *target, device: cli.resolveAlias(*device), wakeTimeout: *wakeTimeout, cli: cli}
+	p.log = cli.logger("proxy").With("target", p.target, "esp_id", p.device)
+	// Catch a mistyped device now rather than on the first connection
+	if _, err := cli.apiClient().Info(cli.clientCtx, p.device); errors.Is(err, wod.ErrNotFound) {
+		fmt.Printf("ESP '%s' not registered\n", p.device)
+		os.Exit(cli.exitStatus(err))
+	} else if err != nil {
+		cli.exitOnClientError(err)
+	}
+
+	ln, err := net.Listen("tcp", *listen)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	go func() {
+		<-cli.clientCtx.Done()
+		ln.Close()
+	}()
+	p.log.Info("Proxy listening", "listen", ln.Addr().String(), "wake_timeout", p.wakeTimeout.String())
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if cli.interrupted() {
+				p.log.Info("Proxy stopped")
+				return
+			}
+			p.log.Warn("Accept failed", "error", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go p.serve(conn)
+	}
+}
+
+func (p *wakeProxy) serve(conn net.Conn) {
+	defer conn.Close()
+	clog := p.log.With("client", conn.RemoteAddr().String())
+
+	upstream, err := net.DialTimeout("tcp", p.target, proxyDialTimeout)
+	if err != nil {
+		clog.Info("Target not answering, waking it", "error", err)
+		started := p.cli.now()
+		if upstream, err = p.wakeAndDial(); err != nil {
+			clog.Warn("Dropping connection", "error", err)
+			return
+		}
+		clog.Info("Target is up", "after", p.cli.now().Sub(started).Round(time.Second).String())
+	}
+	defer upstream.Close()
+
+	clog.Debug("Proxying connection")
+	pipe(conn, upstream)
+	clog.Debug("Connection closed")
+}
+
+// wakeAndDial sends 'on' unless another connection already did, then
+// dials the target until it answers or the wake timeout passes.
+func (p *wakeProxy) wakeAndDial() (net.Conn, error) {
+	p.wake()
+
+	ctx, cancel := context.WithTimeout(p.cli.clientCtx, p.wakeTimeout)
+	defer cancel()
+	dialer := net.Dialer{Timeout: proxyDialTimeout}
+	ticker := time.NewTicker(proxyRetryInterval)
+	defer ticker.Stop()
+	for {
+		conn, err := dialer.DialContext(ctx, "tcp", p.target)
+		if err == nil {
+			return conn, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("target did not open within %s", p.wakeTimeout)
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *wakeProxy) wake() {
+	p.mu.Lock()
+	if p.cli.now().Sub(p.lastWake) < p.wakeTimeout {
+		p.mu.Unlock()
+		return
+	}
+	p.lastWake = p.cli.now()
+	p.mu.Unlock()
+
+	resp, err := p.cli.apiClient().SetCommand(p.cli.clientCtx, p.device, wod.CommandPulse, nil)
+	switch {
+	case errors.Is(err, wod.ErrConflict):
+		p.log.Info("Target already up or booting, waiting for it", "error", err)
+	case err != nil:
+		p.log.Warn("Wake command failed", "error", err)
+		// Let the next connection try again
+		p.mu.Lock()
+		p.lastWake = time.Time{}
+		p.mu.Unlock()
+	default:
+		p.log.Info("Wake command sent", "command_id", resp.CommandID, "delivery", resp.Delivery)
+	}
+}
+
+// pipe copies both ways until both sides are done, passing half-closes on
+// so protocols that shut down their write side first keep working.
+func pipe(a, b net.Conn) {
+	var wg sync.WaitGroup
+	copyHalf := func(dst, src net.Conn) {
+		defer wg.Done()
+		io.Copy(dst, src)
+		if tc, ok := dst.(*net.TCPConn); ok {
+			tc.CloseWrite()
+		} else {
+			dst.Close()
+		}
+	}
+	wg.Add(2)
+	go copyHalf(a, b)
+	go copyHalf(b, a)
+	wg.Wait()
+}
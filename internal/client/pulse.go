@@ -0,0 +1,77 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/smileyfaceskobochka/trashbin-daemon/internal/server"
+)
+
+// --- Client Mode ---
+
+// parseDurationArg accepts "default" (firmware default) or a duration.
+func parseDurationArg(s string) (time.Duration, error) {
+	if s == "default" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return d, server.ValidatePulse(d)
+}
+
+func (cli *CLI) setPulse(espID string, args []string) {
+	pulse, err := parseDurationArg(args[0])
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	var force time.Duration
+	if len(args) > 1 {
+		if force, err = parseDurationArg(args[1]); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	jsonData, _ := json.Marshal(map[string]interface{}{
+		"id":       espID,
+		"pulse_ms": pulse.Milliseconds(),
+		"force_ms": force.Milliseconds(),
+	})
+	req, _ := http.NewRequest(http.MethodPost, cli.serverURL+server.APIPrefix+"/pulse", bytes.NewBuffer(jsonData))
+	req.Header.Set("Content-Type", "application/json")
+	cli.setAuthHeader(req)
+
+	resp, err := cli.httpClient.Do(req)
+	if err != nil {
+		cli.exitOnRequestError(err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		fmt.Printf("Pulse durations for %s: on %s, off %s\n", espID, formatPulse(pulse), formatPulse(force))
+	case http.StatusUnauthorized:
+		fmt.Println("Error: Unauthorized (check -admin-key)")
+		os.Exit(exitUnauthorized)
+	case http.StatusNotFound:
+		fmt.Printf("ESP '%s' not registered\n", espID)
+		os.Exit(exitNotFound)
+	default:
+		fmt.Printf("Error: %s\n", responseError(resp))
+		os.Exit(httpExitStatus(resp.StatusCode))
+	}
+}
+
+func formatPulse(d time.Duration) string {
+	if d == 0 {
+		return "firmware default"
+	}
+	return d.String()
+}
@@ -0,0 +1,93 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/smileyfaceskobochka/trashbin-daemon/internal/server"
+)
+
+// --- Client Mode ---
+
+func (cli *CLI) showQueue(espID string) {
+	resp := cli.queueRequest(http.MethodGet, espID)
+	defer resp.Body.Close()
+
+	var result struct {
+		ID       string                 `json:"id"`
+		Depth    int                    `json:"depth"`
+		MaxDepth int                    `json:"max_depth"`
+		Commands []server.CommandRecord `json:"commands"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		fmt.Println("Error decoding response")
+		os.Exit(1)
+	}
+	switch cli.outputMode {
+	case outputJSON:
+		printJSON(result)
+		return
+	case outputPlain:
+		for _, rec := range result.Commands {
+			printRecord(rec.ID, rec.Command, rec.QueuedAt, rec.ExpiresAt, rec.Priority)
+		}
+		return
+	}
+
+	if result.Depth == 0 {
+		fmt.Printf("No commands queued for %s\n", espID)
+		return
+	}
+
+	fmt.Printf("Queue for %s (%d/%d):\n", espID, result.Depth, result.MaxDepth)
+	for i, rec := range result.Commands {
+		expires := ""
+		if rec.ExpiresAt != nil {
+			expires = fmt.Sprintf(", expires in %s", (*rec.ExpiresAt).Sub(cli.now()).Round(time.Second))
+		}
+		priority := ""
+		if rec.Priority != "" && rec.Priority != server.PriorityNormal {
+			priority = ", " + string(rec.Priority)
+		}
+		fmt.Printf("  %d. %-8s %s [queued %s ago%s%s]\n", i+1, rec.Command, rec.ID, cli.now().Sub(rec.QueuedAt).Round(time.Second), expires, priority)
+	}
+}
+
+func (cli *CLI) flushESPQueue(espID string) {
+	resp := cli.queueRequest(http.MethodDelete, espID)
+	defer resp.Body.Close()
+
+	var result struct {
+		Dropped int `json:"dropped"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+	fmt.Printf("Flushed %d command(s) for %s\n", result.Dropped, espID)
+}
+
+func (cli *CLI) queueRequest(method, espID string) *http.Response {
+	req, _ := http.NewRequest(method, cli.serverURL+server.APIPrefix+"/queue?id="+url.QueryEscape(espID), nil)
+	cli.setAuthHeader(req)
+
+	resp, err := cli.httpClient.Do(req)
+	if err != nil {
+		cli.exitOnRequestError(err)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp
+	case http.StatusUnauthorized:
+		fmt.Println("Error: Unauthorized (check -admin-key)")
+	case http.StatusNotFound:
+		fmt.Printf("ESP '%s' not registered\n", espID)
+	default:
+		fmt.Printf("Error: %s\n", responseError(resp))
+	}
+	resp.Body.Close()
+	os.Exit(httpExitStatus(resp.StatusCode))
+	return nil
+}
@@ -0,0 +1,107 @@
+package client
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/smileyfaceskobochka/trashbin-daemon/internal/server"
+)
+
+// --- Client Mode ---
+
+func (cli *CLI) runQuotaCommand(args []string) {
+	if len(args) > 0 && args[0] == "reset" {
+		fs := flag.NewFlagSet("quota reset", flag.ExitOnError)
+		namespace := fs.String("namespace", "", "Reset the namespace's shared usage instead of a device's")
+		fs.Usage = func() {
+			fmt.Println("Usage: wake-on-demand quota reset <esp_id> | -namespace <name>")
+			fs.PrintDefaults()
+		}
+		fs.Parse(args[1:])
+		q := url.Values{}
+		switch {
+		case *namespace != "" && fs.NArg() == 0:
+			q.Set("namespace", *namespace)
+		case *namespace == "" && fs.NArg() == 1:
+			q.Set("esp_id", cli.resolveAlias(fs.Arg(0)))
+		default:
+			fs.Usage()
+			os.Exit(1)
+		}
+		resp := cli.quotaRequest(http.MethodDelete, "/quotas?"+q.Encode())
+		resp.Body.Close()
+		fmt.Println("Quota usage reset")
+		return
+	}
+
+	path := "/quotas"
+	if len(args) > 0 {
+		path += "?" + url.Values{"esp_id": {cli.resolveAlias(args[0])}}.Encode()
+	}
+	resp := cli.quotaRequest(http.MethodGet, path)
+	defer resp.Body.Close()
+	var result struct {
+		Quotas []server.QuotaStatus `json:"quotas"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+
+	switch cli.outputMode {
+	case outputJSON:
+		printJSON(result.Quotas)
+		return
+	case outputPlain:
+		for _, s := range result.Quotas {
+			printRecord(s.Scope, s.Name, s.CommandsLastHour, s.CommandsPerHour, s.ForceLastDay, s.ForcePerDay, s.RefusedForMS)
+		}
+		return
+	}
+	if len(result.Quotas) == 0 {
+		fmt.Println("No quotas configured")
+		return
+	}
+	limit := func(used, max int) string {
+		if max == 0 {
+			return fmt.Sprintf("%d", used)
+		}
+		return fmt.Sprintf("%d/%d", used, max)
+	}
+	fmt.Printf("%-10s %-24s %-16s %s\n", "SCOPE", "NAME", "COMMANDS (1H)", "FORCE-OFFS (24H)")
+	for _, s := range result.Quotas {
+		note := ""
+		if s.RefusedForMS > 0 {
+			note = fmt.Sprintf("used up, next in %s", (time.Duration(s.RefusedForMS) * time.Millisecond).Round(time.Second))
+		}
+		row := fmt.Sprintf("%-10s %-24s %-16s %-16s %s", s.Scope, s.Name, limit(s.CommandsLastHour, s.CommandsPerHour), limit(s.ForceLastDay, s.ForcePerDay), note)
+		fmt.Println(strings.TrimRight(row, " "))
+	}
+}
+
+func (cli *CLI) quotaRequest(method, path string) *http.Response {
+	req, _ := http.NewRequest(method, cli.serverURL+server.APIPrefix+path, nil)
+	cli.setAuthHeader(req)
+
+	resp, err := cli.httpClient.Do(req)
+	if err != nil {
+		cli.exitOnRequestError(err)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp
+	case http.StatusUnauthorized:
+		fmt.Println("Error: Unauthorized (check -admin-key)")
+	case http.StatusForbidden:
+		fmt.Println("Error: Quotas require the admin role")
+	default:
+		fmt.Printf("Error: %s\n", responseError(resp))
+	}
+	resp.Body.Close()
+	os.Exit(httpExitStatus(resp.StatusCode))
+	return nil
+}
@@ -0,0 +1,42 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/smileyfaceskobochka/trashbin-daemon/internal/server"
+)
+
+// runReload asks the server to reload its config.
+func (cli *CLI) runReload() {
+	req, _ := http.NewRequest(http.MethodPost, cli.serverURL+server.APIPrefix+"/admin/reload", nil)
+	cli.setAuthHeader(req)
+	resp, err := cli.httpClient.Do(req)
+	if err != nil {
+		cli.exitOnRequestError(err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized:
+		fmt.Println("Error: Unauthorized (check -admin-key)")
+		os.Exit(exitUnauthorized)
+	default:
+		fmt.Printf("Error: %s\n", responseError(resp))
+		os.Exit(httpExitStatus(resp.StatusCode))
+	}
+
+	var result server.ReloadResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		fmt.Println("Error decoding response")
+		os.Exit(1)
+	}
+	fmt.Printf("Reloaded %s\n", result.Config)
+	if len(result.NeedsRestart) > 0 {
+		fmt.Printf("Restart the server to apply: %s\n", strings.Join(result.NeedsRestart, ", "))
+	}
+}
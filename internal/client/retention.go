@@ -0,0 +1,22 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	wod "github.com/smileyfaceskobochka/trashbin-daemon/pkg/client"
+)
+
+// --- Client Mode ---
+
+func (cli *CLI) removeDevice(espID string) {
+	err := cli.apiClient().Remove(cli.clientCtx, espID)
+	if errors.Is(err, wod.ErrNotFound) {
+		fmt.Printf("ESP '%s' not registered\n", espID)
+		os.Exit(cli.exitStatus(err))
+	} else if err != nil {
+		cli.exitOnClientError(err)
+	}
+	fmt.Printf("Removed %s\n", espID)
+}
@@ -0,0 +1,119 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/smileyfaceskobochka/trashbin-daemon/internal/server"
+)
+
+// --- Client Mode ---
+
+func (cli *CLI) runScheduleCommand(args []string) {
+	if len(args) < 1 {
+		printScheduleUsage()
+	}
+
+	switch args[0] {
+	case "add":
+		if len(args) < 4 {
+			printScheduleUsage()
+		}
+		if _, err := server.ParseCron(args[2]); err != nil {
+			fmt.Printf("Error: Invalid cron expression: %v\n", err)
+			os.Exit(1)
+		}
+		body, _ := json.Marshal(map[string]string{
+			"esp_id": args[1],
+			"cron":   args[2],
+			"action": args[3],
+		})
+		resp := cli.scheduleRequest(http.MethodPost, "/schedules", body)
+		defer resp.Body.Close()
+
+		var s server.Schedule
+		json.NewDecoder(resp.Body).Decode(&s)
+		fmt.Printf("Schedule %s added: %s %s at \"%s\"\n", s.ID, s.Action, s.ESPID, s.Cron)
+
+	case "list":
+		resp := cli.scheduleRequest(http.MethodGet, "/schedules", nil)
+		defer resp.Body.Close()
+
+		var result struct {
+			Schedules []struct {
+				server.Schedule
+				NextRun *time.Time `json:"next_run"`
+			} `json:"schedules"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			fmt.Println("Error decoding response")
+			os.Exit(1)
+		}
+		if len(result.Schedules) == 0 {
+			fmt.Println("No schedules")
+			return
+		}
+		fmt.Println("Schedules:")
+		for _, s := range result.Schedules {
+			next := "never"
+			if s.NextRun != nil {
+				next = s.NextRun.Local().Format(time.DateTime)
+			}
+			fmt.Printf("  %s  %-6s %-16s %-16s [next: %s]\n", s.ID, s.Action, s.ESPID, s.Cron, next)
+			if s.LastError != "" {
+				fmt.Printf("      last run failed: %s\n", s.LastError)
+			}
+		}
+
+	case "remove":
+		if len(args) < 2 {
+			printScheduleUsage()
+		}
+		resp := cli.scheduleRequest(http.MethodDelete, "/schedules?id="+url.QueryEscape(args[1]), nil)
+		resp.Body.Close()
+		fmt.Printf("Schedule %s removed\n", args[1])
+
+	default:
+		printScheduleUsage()
+	}
+}
+
+func printScheduleUsage() {
+	fmt.Println(`Usage:
+  wake-on-demand schedule add <esp_id> "<cron>" <on|off|soft-off|status>
+  wake-on-demand schedule list
+  wake-on-demand schedule remove <schedule_id>`)
+	os.Exit(1)
+}
+
+func (cli *CLI) scheduleRequest(method, path string, body []byte) *http.Response {
+	req, _ := http.NewRequest(method, cli.serverURL+server.APIPrefix+path, bytes.NewReader(body))
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	cli.setAuthHeader(req)
+
+	resp, err := cli.httpClient.Do(req)
+	if err != nil {
+		cli.exitOnRequestError(err)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		return resp
+	case http.StatusUnauthorized:
+		fmt.Println("Error: Unauthorized (check -admin-key)")
+	case http.StatusNotFound:
+		fmt.Println("Error: Schedule not found")
+	default:
+		fmt.Printf("Error: %s\n", responseError(resp))
+	}
+	resp.Body.Close()
+	os.Exit(httpExitStatus(resp.StatusCode))
+	return nil
+}
@@ -0,0 +1,23 @@
+//go:build !windows
+
+package client
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+func (cli *CLI) runInstallService(args []string) {
+	cli.installSystemdService(args)
+}
+
+func (cli *CLI) runServiceControl(cmd string) {
+	action := strings.TrimSuffix(cmd, "-service")
+	if action == "uninstall" {
+		fmt.Println("Error: uninstall-service is for Windows services; remove the systemd unit with: make uninstall")
+	} else {
+		fmt.Printf("Error: %s is for Windows services; use: sudo systemctl %s wake-on-demand\n", cmd, action)
+	}
+	os.Exit(1)
+}
@@ -0,0 +1,154 @@
+package client
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/smileyfaceskobochka/trashbin-daemon/internal/server"
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+func (cli *CLI) runInstallService(args []string) {
+	fs := flag.NewFlagSet("install-service", flag.ExitOnError)
+	manual := fs.Bool("manual", false, "Don't start the service at boot")
+	start := fs.Bool("start", false, "Start the service once installed")
+	fs.Usage = func() {
+		fmt.Println("Usage: wake-on-demand [-port <port>] install-service [-manual] [-start] [-- server flags...]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	exe, err := os.Executable()
+	if err != nil {
+		fmt.Printf("Error: Could not find executable: %v\n", err)
+		os.Exit(1)
+	}
+	serverArgs := fs.Args()
+	if len(serverArgs) == 0 {
+		serverArgs = []string{"-data-dir", server.ServiceDataDir()}
+	}
+	serverArgs = append(append([]string{"-port", cli.servicePort}, serverArgs...), "server")
+
+	m := connectServiceManager()
+	defer m.Disconnect()
+	if s, err := m.OpenService(server.ServiceName); err == nil {
+		s.Close()
+		fmt.Printf("Error: Service %s is already installed (remove it with: wake-on-demand uninstall-service)\n", server.ServiceName)
+		os.Exit(1)
+	}
+
+	startType := uint32(mgr.StartAutomatic)
+	if *manual {
+		startType = mgr.StartManual
+	}
+	s, err := m.CreateService(server.ServiceName, exe, mgr.Config{
+		DisplayName: "Wake-On-Demand Server",
+		Description: "Powers machines on and off through ESP devices",
+		StartType:   startType,
+	}, serverArgs...)
+	if err != nil {
+		fmt.Printf("Error: Could not create service: %v\n", err)
+		os.Exit(1)
+	}
+	defer s.Close()
+	// Like Restart=always with RestartSec=5 in the systemd unit
+	restart := []mgr.RecoveryAction{{Type: mgr.ServiceRestart, Delay: 5 * time.Second}}
+	if err := s.SetRecoveryActions(restart, uint32((24 * time.Hour).Seconds())); err != nil {
+		fmt.Printf("Warning: Could not set restart on failure: %v\n", err)
+	}
+	fmt.Printf("Installed service %s: %s %s\n", server.ServiceName, exe, windows.ComposeCommandLine(serverArgs))
+	fmt.Printf("Logs go to %s\n", server.ServiceLogPath())
+
+	if *start {
+		cli.startService(s)
+		return
+	}
+	fmt.Println()
+	fmt.Println("To start: wake-on-demand start-service")
+}
+
+func (cli *CLI) runServiceControl(cmd string) {
+	m := connectServiceManager()
+	defer m.Disconnect()
+	s, err := m.OpenService(server.ServiceName)
+	if err != nil {
+		fmt.Printf("Error: Service %s is not installed (install it with: wake-on-demand install-service)\n", server.ServiceName)
+		os.Exit(1)
+	}
+	defer s.Close()
+
+	switch cmd {
+	case "start-service":
+		cli.startService(s)
+	case "stop-service":
+		cli.stopService(s)
+	case "uninstall-service":
+		if st, err := s.Query(); err == nil && st.State != svc.Stopped {
+			cli.stopService(s)
+		}
+		if err := s.Delete(); err != nil {
+			fmt.Printf("Error: Could not remove service: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Removed service %s\n", server.ServiceName)
+	}
+}
+
+func connectServiceManager() *mgr.Mgr {
+	m, err := mgr.Connect()
+	if err != nil {
+		fmt.Printf("Error: Could not connect to the service manager: %v\n", err)
+		if errors.Is(err, windows.ERROR_ACCESS_DENIED) {
+			fmt.Println("Run this from an elevated (administrator) prompt")
+		}
+		os.Exit(1)
+	}
+	return m
+}
+
+func (cli *CLI) startService(s *mgr.Service) {
+	if err := s.Start(); err != nil {
+		fmt.Printf("Error: Could not start service: %v\n", err)
+		os.Exit(1)
+	}
+	cli.waitService(s, svc.Running, "started")
+}
+
+func (cli *CLI) stopService(s *mgr.Service) {
+	if _, err := s.Control(svc.Stop); err != nil {
+		fmt.Printf("Error: Could not stop service: %v\n", err)
+		os.Exit(1)
+	}
+	cli.waitService(s, svc.Stopped, "stopped")
+}
+
+// waitService polls until the service reaches state, giving up after the
+// drain timeout and then some.
+func (cli *CLI) waitService(s *mgr.Service, state svc.State, done string) {
+	deadline := cli.now().Add(cli.drainTimeout + 30*time.Second)
+	for {
+		st, err := s.Query()
+		if err != nil {
+			fmt.Printf("Error: Could not query service: %v\n", err)
+			os.Exit(1)
+		}
+		if st.State == state {
+			fmt.Printf("Service %s %s\n", server.ServiceName, done)
+			return
+		}
+		if st.State == svc.Stopped && state == svc.Running {
+			fmt.Printf("Error: Service %s stopped right away; see %s\n", server.ServiceName, server.ServiceLogPath())
+			os.Exit(1)
+		}
+		if cli.now().After(deadline) {
+			fmt.Printf("Error: Service %s has not %s yet\n", server.ServiceName, done)
+			os.Exit(1)
+		}
+		time.Sleep(300 * time.Millisecond)
+	}
+}
@@ -0,0 +1,136 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/smileyfaceskobochka/trashbin-daemon/internal/server"
+)
+
+// --- Client Mode ---
+
+func (cli *CLI) runSecretCommand(args []string) {
+	if len(args) < 1 {
+		printSecretUsage()
+	}
+
+	switch args[0] {
+	case "issue":
+		if len(args) < 2 {
+			printSecretUsage()
+		}
+		body, _ := json.Marshal(map[string]string{"id": cli.resolveAlias(args[1])})
+		resp := cli.secretRequest(http.MethodPost, "/secrets", body)
+		defer resp.Body.Close()
+
+		var issued struct {
+			ID       string `json:"id"`
+			Secret   string `json:"secret"`
+			Replaced bool   `json:"replaced"`
+		}
+		json.NewDecoder(resp.Body).Decode(&issued)
+		switch cli.outputMode {
+		case outputJSON:
+			printJSON(issued)
+			return
+		case outputPlain:
+			printRecord(issued.ID, issued.Secret)
+			return
+		}
+		if issued.Replaced {
+			fmt.Printf("New secret issued for %s; the old one no longer works\n", issued.ID)
+		} else {
+			fmt.Printf("Secret issued for %s\n", issued.ID)
+		}
+		fmt.Printf("Secret: %s\n", issued.Secret)
+		fmt.Println("The secret is shown only once; flash it onto the ESP. Its unsigned requests are now rejected.")
+
+	case "list":
+		resp := cli.secretRequest(http.MethodGet, "/secrets", nil)
+		defer resp.Body.Close()
+
+		var result struct {
+			Secrets []server.DeviceSecretInfo `json:"secrets"`
+		}
+		json.NewDecoder(resp.Body).Decode(&result)
+		switch cli.outputMode {
+		case outputJSON:
+			printJSON(result.Secrets)
+			return
+		case outputPlain:
+			for _, s := range result.Secrets {
+				lastUsed := ""
+				if s.LastUsed != nil {
+					lastUsed = s.LastUsed.Format(time.RFC3339)
+				}
+				printRecord(s.ID, s.CreatedAt.Format(time.RFC3339), lastUsed)
+			}
+			return
+		}
+		if len(result.Secrets) == 0 {
+			fmt.Println("No device secrets issued")
+			return
+		}
+		fmt.Printf("%-24s %-20s %s\n", "ESP", "ISSUED", "LAST USED")
+		for _, s := range result.Secrets {
+			lastUsed := "never"
+			if s.LastUsed != nil {
+				lastUsed = s.LastUsed.Local().Format(time.DateTime)
+			}
+			fmt.Printf("%-24s %-20s %s\n", s.ID, s.CreatedAt.Local().Format(time.DateTime), lastUsed)
+		}
+
+	case "revoke":
+		if len(args) < 2 {
+			printSecretUsage()
+		}
+		resp := cli.secretRequest(http.MethodDelete, "/secrets?id="+url.QueryEscape(cli.resolveAlias(args[1])), nil)
+		resp.Body.Close()
+		fmt.Printf("Secret for %s revoked; it may send unsigned requests again\n", args[1])
+
+	default:
+		printSecretUsage()
+	}
+}
+
+func printSecretUsage() {
+	fmt.Println(`Usage:
+  wake-on-demand secret issue <esp_id>
+  wake-on-demand secret list
+  wake-on-demand secret revoke <esp_id>`)
+	os.Exit(1)
+}
+
+func (cli *CLI) secretRequest(method, path string, body []byte) *http.Response {
+	req, _ := http.NewRequest(method, cli.serverURL+server.APIPrefix+path, bytes.NewReader(body))
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	cli.setAuthHeader(req)
+
+	resp, err := cli.httpClient.Do(req)
+	if err != nil {
+		cli.exitOnRequestError(err)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		return resp
+	case http.StatusUnauthorized:
+		fmt.Println("Error: Unauthorized (check -admin-key)")
+	case http.StatusForbidden:
+		fmt.Println("Error: Managing device secrets requires the admin role")
+	case http.StatusNotFound:
+		fmt.Println("Error: No secret issued for this ESP")
+	default:
+		fmt.Printf("Error: %s\n", responseError(resp))
+	}
+	resp.Body.Close()
+	os.Exit(httpExitStatus(resp.StatusCode))
+	return nil
+}
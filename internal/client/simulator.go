@@ -0,0 +1,678 @@
+package client
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	rand "math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/smileyfaceskobochka/trashbin-daemon/internal/server"
+	wod "github.com/smileyfaceskobochka/trashbin-daemon/pkg/client"
+)
+
+// simulate-esp speaks the ESP side of the HTTP protocol the way the
+// reference firmware does, with a simulated machine on its relay, so the
+// server can be exercised without hardware. With -check it instead runs the
+// protocol conformance suite: a scripted exchange that firmware and server
+// changes must both keep passing.
+
+// simulatedESP is one simulated device and the machine it powers.
+type simulatedESP struct {
+	id       string
+	token    string
+	secret   string
+	nonce    string // reused instead of a fresh one when set, to test replays
+	instance string
+	firmware string
+	model    string
+	wait     time.Duration
+	log      *slog.Logger
+
+	bootTime     time.Duration
+	shutdownTime time.Duration
+	failRate     float64
+	latency      time.Duration // how long acting on a command takes, ±50%
+	actions      []server.CustomAction
+	features     []string // declared at registration; nil declares nothing
+	battery      float64  // starting voltage; 0 runs on mains
+	drain        float64  // volts lost per minute on battery
+	stats        *fleetStats
+	// fixedInterval ignores next_poll_ms, so load tests poll at a set rate
+	fixedInterval bool
+
+	started   time.Time
+	lastSeq   uint64 // highest command seq acted on since boot
+	power     string // on or off
+	nextPower string // set while booting or shutting down
+	powerAt   time.Time
+	cli       *CLI
+}
+
+// espPoll is the server's answer to GET /command.
+type espPoll struct {
+	Command    string `json:"command"`
+	CommandID  string `json:"command_id"`
+	DurationMS int    `json:"duration_ms"`
+	Action     string `json:"action"`
+	Pending    int    `json:"pending"`
+	Seq        uint64 `json:"seq"`
+	IssuedAt   int64  `json:"issued_at"`
+	MaxAgeS    int    `json:"max_age_s"`
+	NextPollMS *int64 `json:"next_poll_ms"`
+	OTA        *struct {
+		Version string `json:"version"`
+		URL     string `json:"url"`
+		SHA256  string `json:"sha256"`
+		Size    int64  `json:"size"`
+	} `json:"ota"`
+}
+
+func (cli *CLI) runSimulateESP(args []string) {
+	fs := flag.NewFlagSet("simulate-esp", flag.ExitOnError)
+	interval := fs.Duration("interval", 5*time.Second, "How often to poll for commands when the server sends no next_poll_ms")
+	wait := fs.Duration("wait", 0, "Long-poll each request for up to this long (max 60s)")
+	token := fs.String("token", "", "The ESP's token, if the server has one configured")
+	secret := fs.String("secret", "", "The ESP's device secret; requests are signed with it")
+	power := fs.String("power", "off", "Power state of the simulated machine at start (on or off)")
+	bootTime := fs.Duration("boot-time", 20*time.Second, "How long the machine takes to come up after 'on'")
+	shutdownTime := fs.Duration("shutdown-time", 10*time.Second, "How long the machine takes to go down after a short press while on")
+	failRate := fs.Float64("fail-rate", 0, "Fraction of commands to report as failed, 0 to 1")
+	latency := fs.Duration("latency", 0, "How long the ESP takes to act on a command before reporting, ±50%")
+	actions := fs.String("actions", "", "Comma-separated custom actions to declare (e.g. reset,kvm-toggle)")
+	features := fs.String("features", "all", "Comma-separated protocol features to declare, all, or none to register like firmware that predates negotiation")
+	firmware := fs.String("fw", "sim-1.0.0", "Firmware version to report")
+	model := fs.String("model", "simulator", "Hardware model to report, used for OTA")
+	battery := fs.Float64("battery", 0, "Run on a battery starting at this voltage (0 reports mains power)")
+	drain := fs.Float64("battery-drain", 0.01, "Volts the battery loses per minute")
+	check := fs.Bool("check", false, "Run the protocol conformance checks against the server and exit (needs -admin-key when auth is on)")
+	fs.Usage = func() {
+		fmt.Println("Usage: wake-on-demand [-server <url>] simulate-esp [-interval 5s] [-wait 25s] [-token <t>] [-secret <s>] [-power off] [-boot-time 20s] [-fail-rate 0] [-battery 0] [-features all] [-check] <esp_id>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if *power != "on" && *power != "off" {
+		fmt.Println("Error: -power must be on or off")
+		os.Exit(1)
+	}
+	if *failRate < 0 || *failRate > 1 {
+		fmt.Println("Error: -fail-rate must be between 0 and 1")
+		os.Exit(1)
+	}
+	if *latency < 0 {
+		fmt.Println("Error: -latency can't be negative")
+		os.Exit(1)
+	}
+	if *battery < 0 || *drain < 0 {
+		fmt.Println("Error: -battery and -battery-drain can't be negative")
+		os.Exit(1)
+	}
+
+	s := &simulatedESP{
+		id: fs.Arg(0), token: *token, secret: *secret, firmware: *firmware, model: *model, wait: *wait,
+		bootTime: *bootTime, shutdownTime: *shutdownTime, failRate: *failRate, latency: *latency, power: *power,
+		battery: *battery, drain: *drain, cli: cli,
+	}
+	for _, name := range server.SplitList(*actions) {
+		s.actions = append(s.actions, server.CustomAction{Name: name})
+	}
+	if err := server.ValidateActions(s.actions); err != nil {
+		fmt.Printf("Error: -actions: %v\n", err)
+		os.Exit(1)
+	}
+	switch *features {
+	case "all":
+		s.features = server.ServerFeatures
+	case "none":
+	default:
+		s.features = server.SplitList(*features)
+	}
+	s.log = cli.logger("simulator").With("esp_id", s.id)
+	if *check {
+		os.Exit(cli.runConformance(s))
+	}
+	s.run(*interval)
+}
+
+// boot is what the firmware does at power-up: pick a new instance token and
+// register.
+func (s *simulatedESP) boot() {
+	first := s.instance == ""
+	s.instance = server.NewCommandID()
+	s.started, s.lastSeq = s.cli.now(), 0
+	for {
+		err := s.register()
+		if err == nil {
+			s.log.Info("Registered", "instance", s.instance, "firmware", s.firmware, "power", s.power)
+			if first {
+				s.stats.add(statRegistered)
+			}
+			return
+		}
+		s.log.Warn("Registration failed", "error", err)
+		if !s.sleep(5 * time.Second) {
+			return
+		}
+	}
+}
+
+// sleep waits for d, or until interrupted, and reports whether it slept.
+func (s *simulatedESP) sleep(d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-s.cli.clientCtx.Done():
+		return false
+	}
+}
+
+func (s *simulatedESP) run(interval time.Duration) {
+	s.boot()
+	for {
+		s.advancePower()
+		poll, status, err := s.poll(s.wait)
+		switch {
+		case s.cli.interrupted():
+			s.log.Info("Simulator stopped")
+			return
+		case status == http.StatusNotFound:
+			// The server forgot us, e.g. after 'remove' or a lost registry
+			s.log.Info("Server does not know this ESP, registering again")
+			s.boot()
+			continue
+		case err != nil:
+			s.log.Warn("Poll failed", "error", err)
+		case poll.Command != "":
+			s.execute(poll)
+			if poll.Pending > 0 {
+				continue
+			}
+		case poll.OTA != nil && poll.OTA.Version != s.firmware:
+			s.update(poll.OTA.Version, poll.OTA.URL, poll.OTA.SHA256)
+			continue
+		}
+		if s.wait == 0 {
+			s.sleep(s.nextPoll(poll, interval))
+		}
+	}
+}
+
+// nextPoll follows the server's hint when the poll carried one, like
+// firmware should.
+func (s *simulatedESP) nextPoll(poll espPoll, interval time.Duration) time.Duration {
+	if poll.NextPollMS == nil || s.fixedInterval {
+		return interval
+	}
+	return time.Duration(*poll.NextPollMS) * time.Millisecond
+}
+
+// advancePower finishes a boot or shutdown whose time has come.
+func (s *simulatedESP) advancePower() {
+	if s.nextPower != "" && !s.cli.now().Before(s.powerAt) {
+		s.log.Info("Machine is " + s.nextPower)
+		s.power, s.nextPower = s.nextPower, ""
+	}
+}
+
+// execute acts on a delivered command and reports the outcome.
+func (s *simulatedESP) execute(poll espPoll) {
+	clog := s.log.With("command", poll.Command, "command_id", poll.CommandID)
+	s.stats.add(statCommands)
+	if err := s.fresh(poll); err != nil {
+		clog.Warn("Refusing command", "seq", poll.Seq, "error", err)
+		s.stats.add(statStale)
+		s.report(poll.CommandID, err, nil)
+		return
+	}
+	if s.latency > 0 {
+		s.sleep(s.latency/2 + rand.N(s.latency))
+	}
+	if s.failRate > 0 && rand.Float64() < s.failRate {
+		clog.Warn("Simulating a failed command")
+		s.stats.add(statFailed)
+		s.report(poll.CommandID, errors.New("simulated relay fault"), nil)
+		return
+	}
+
+	switch server.ESPCommand(poll.Command) {
+	case server.CommandPulse:
+		// A short press boots a machine that is off and asks a running one
+		// to shut down
+		if s.nextPower == "" {
+			if s.power == "off" {
+				s.nextPower, s.powerAt = "on", s.cli.now().Add(s.bootTime)
+			} else {
+				s.nextPower, s.powerAt = "off", s.cli.now().Add(s.shutdownTime)
+			}
+		}
+		clog.Info("Pressed the power button", "duration_ms", poll.DurationMS, "power", s.power, "next", s.nextPower)
+		s.report(poll.CommandID, nil, nil)
+	case server.CommandForce:
+		s.power, s.nextPower = "off", ""
+		clog.Info("Held the power button, machine is off", "duration_ms", poll.DurationMS)
+		s.report(poll.CommandID, nil, nil)
+	case server.CommandStatus:
+		clog.Info("Reporting status", "power", s.power)
+		s.report(poll.CommandID, nil, map[string]interface{}{"power": s.power, "uptime": int(s.cli.now().Sub(s.started).Seconds())})
+	case server.CommandAction:
+		for _, a := range s.actions {
+			if a.Name == poll.Action {
+				clog.Info("Ran custom action", "action", poll.Action)
+				s.report(poll.CommandID, nil, nil)
+				return
+			}
+		}
+		clog.Warn("Unknown action", "action", poll.Action)
+		s.report(poll.CommandID, fmt.Errorf("unknown action %q", poll.Action), nil)
+	default:
+		clog.Warn("Unknown command")
+		s.report(poll.CommandID, fmt.Errorf("unknown command %q", poll.Command), nil)
+	}
+}
+
+var errStale = errors.New("stale")
+
+// fresh refuses a command that is older than one already acted on since
+// boot, or that was issued longer than max_age_s ago.
+func (s *simulatedESP) fresh(poll espPoll) error {
+	if poll.Seq != 0 {
+		if poll.Seq <= s.lastSeq {
+			return fmt.Errorf("%w: seq %d is not after %d", errStale, poll.Seq, s.lastSeq)
+		}
+		s.lastSeq = poll.Seq
+	}
+	if poll.MaxAgeS > 0 && poll.IssuedAt > 0 {
+		if age := s.cli.now().Sub(time.Unix(poll.IssuedAt, 0)); age > time.Duration(poll.MaxAgeS)*time.Second {
+			return fmt.Errorf("%w: issued %s ago", errStale, age.Round(time.Second))
+		}
+	}
+	return nil
+}
+
+// update downloads an offered firmware image, checks its hash and
+// "reboots" into it.
+func (s *simulatedESP) update(version, path, sum string) {
+	ulog := s.log.With("version", version)
+	req, _ := http.NewRequest(http.MethodGet, s.cli.serverURL+path, nil)
+	s.authorize(req, nil)
+	resp, err := s.cli.httpClient.Do(req)
+	if err != nil {
+		ulog.Warn("Firmware download failed", "error", err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		ulog.Warn("Firmware download failed", "error", responseError(resp))
+		return
+	}
+	h := sha256.New()
+	size, err := io.Copy(h, resp.Body)
+	if err != nil {
+		ulog.Warn("Firmware download failed", "error", err)
+		return
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != sum {
+		ulog.Warn("Firmware hash mismatch, not flashing", "want", sum, "got", got)
+		return
+	}
+	ulog.Info("Firmware verified, rebooting into it", "size", size)
+	s.firmware = version
+	s.boot()
+}
+
+// authorize signs req when the ESP has a secret, and adds its token.
+func (s *simulatedESP) authorize(req *http.Request, body []byte) {
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+	if s.secret == "" {
+		return
+	}
+	timestamp := strconv.FormatInt(s.cli.now().Unix(), 10)
+	nonce := s.nonce
+	if nonce == "" {
+		nonce = server.NewCommandID()
+	}
+	req.Header.Set(server.TimestampHeader, timestamp)
+	req.Header.Set(server.NonceHeader, nonce)
+	req.Header.Set(server.SignatureHeader, server.SignRequest(s.secret, req.Method, req.URL.Path, req.URL.RawQuery, timestamp, nonce, body))
+}
+
+// send makes one protocol request and decodes a 200 response into out.
+func (s *simulatedESP) send(method, path string, query url.Values, body, out interface{}) (int, error) {
+	u := s.cli.serverURL + server.APIPrefix + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	var reader io.Reader
+	raw, ok := body.([]byte)
+	if !ok && body != nil {
+		raw, _ = json.Marshal(body)
+	}
+	if raw != nil {
+		reader = bytes.NewReader(raw)
+	}
+	req, _ := http.NewRequest(method, u, reader)
+	if reader != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	s.authorize(req, raw)
+	resp, err := s.cli.httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, fmt.Errorf("%s %s: %s", method, path, responseError(resp))
+	}
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp.StatusCode, fmt.Errorf("%s %s: %w", method, path, err)
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+func (s *simulatedESP) register() error {
+	body := map[string]interface{}{
+		"id": s.id, "instance": s.instance, "power": s.power,
+		"firmware": s.firmware, "model": s.model,
+	}
+	if s.actions != nil {
+		body["actions"] = s.actions
+	}
+	if s.features != nil {
+		body["protocol"], body["features"] = server.ProtocolVersion, s.features
+	}
+	var status struct {
+		Status      string `json:"status"`
+		PairingCode string `json:"pairing_code"`
+	}
+	_, err := s.send(http.MethodPost, "/register", nil, body, &status)
+	if err == nil && status.Status == "pending" {
+		// What real firmware prints on its serial console
+		s.log.Warn("Waiting for approval", "pairing_code", status.PairingCode)
+	}
+	return err
+}
+
+func (s *simulatedESP) poll(wait time.Duration) (espPoll, int, error) {
+	q := url.Values{
+		"id":       {s.id},
+		"instance": {s.instance},
+		"power":    {s.power},
+		"fw":       {s.firmware},
+		"model":    {s.model},
+		"rssi":     {strconv.Itoa(-50 - rand.IntN(20))},
+		"heap":     {strconv.Itoa(180000 + rand.IntN(20000))},
+		"uptime":   {strconv.Itoa(int(s.cli.now().Sub(s.started).Seconds()))},
+	}
+	if s.battery > 0 {
+		volts := max(s.battery-s.drain*s.cli.now().Sub(s.started).Minutes(), 0)
+		q.Set("src", "battery")
+		q.Set("vbat", strconv.FormatFloat(volts, 'f', 2, 64))
+	} else {
+		q.Set("src", "mains")
+	}
+	if wait > 0 {
+		q.Set("wait", wait.String())
+	}
+	var poll espPoll
+	start := s.cli.now()
+	status, err := s.send(http.MethodGet, "/command", q, nil, &poll)
+	s.stats.poll(s.cli.now().Sub(start), err)
+	return poll, status, err
+}
+
+// report acks a command, through /command-result when there is a result.
+func (s *simulatedESP) report(commandID string, failure error, result map[string]interface{}) {
+	if err := s.sendReport(commandID, failure, result); err != nil {
+		s.stats.add(statReportErrors)
+		s.log.Warn("Report failed", "command_id", commandID, "error", err)
+	}
+}
+
+func (s *simulatedESP) sendReport(commandID string, failure error, result map[string]interface{}) error {
+	report := server.CommandReport{ID: s.id, CommandID: commandID, Success: failure == nil, Result: result, Stale: errors.Is(failure, errStale)}
+	if failure != nil {
+		report.Error = failure.Error()
+	}
+	path := "/command-ack"
+	if result != nil {
+		path = "/command-result"
+	}
+	_, err := s.send(http.MethodPost, path, nil, report, nil)
+	return err
+}
+
+// --- Conformance checks ---
+
+// runConformance runs the protocol checks with s as the device and returns
+// the exit code. The ESP is removed again afterwards.
+func (cli *CLI) runConformance(s *simulatedESP) int {
+	api := cli.apiClient()
+	s.instance = server.NewCommandID()
+	s.started = cli.now()
+	failed, total := 0, 0
+	check := func(name string, fn func() error) {
+		total++
+		if err := fn(); err != nil {
+			failed++
+			fmt.Printf("FAIL  %s: %v\n", name, err)
+			return
+		}
+		fmt.Printf("ok    %s\n", name)
+	}
+	expectStatus := func(want int, got int, err error) error {
+		if got != want {
+			return fmt.Errorf("want HTTP %d, got %d (%v)", want, got, err)
+		}
+		return nil
+	}
+	// deliver queues cmd and polls it back
+	deliver := func(cmd wod.Command, opts *wod.CommandOptions) (string, espPoll, error) {
+		resp, err := api.SetCommand(cli.clientCtx, s.id, cmd, opts)
+		if err != nil {
+			return "", espPoll{}, fmt.Errorf("set-command: %w", err)
+		}
+		poll, _, err := s.poll(0)
+		if err != nil {
+			return resp.CommandID, poll, err
+		}
+		if poll.Command != string(cmd) || poll.CommandID != resp.CommandID {
+			return resp.CommandID, poll, fmt.Errorf("want %s %s, polled %q %q", cmd, resp.CommandID, poll.Command, poll.CommandID)
+		}
+		return resp.CommandID, poll, nil
+	}
+	expectRecord := func(commandID, state string) (*wod.CommandRecord, error) {
+		rec, err := api.CommandResult(cli.clientCtx, commandID)
+		if err != nil {
+			return nil, fmt.Errorf("command-result: %w", err)
+		}
+		if rec.Status != state {
+			return rec, fmt.Errorf("command %s is %s, want %s", commandID, rec.Status, state)
+		}
+		return rec, nil
+	}
+
+	fmt.Printf("Protocol conformance checks against %s as ESP %s\n", cli.serverURL, s.id)
+	check("register", s.register)
+	if failed > 0 {
+		fmt.Println("Cannot continue without a registration")
+		return 1
+	}
+	defer api.Remove(cli.clientCtx, s.id)
+
+	check("register rejects invalid JSON", func() error {
+		status, err := s.send(http.MethodPost, "/register", nil, []byte("{"), nil)
+		return expectStatus(http.StatusBadRequest, status, err)
+	})
+	check("poll without an ID is rejected", func() error {
+		status, err := s.send(http.MethodGet, "/command", nil, nil, nil)
+		return expectStatus(http.StatusBadRequest, status, err)
+	})
+	check("poll from an unregistered ESP gets 404", func() error {
+		status, err := s.send(http.MethodGet, "/command", url.Values{"id": {s.id + "-unregistered"}}, nil, nil)
+		return expectStatus(http.StatusNotFound, status, err)
+	})
+	check("idle poll returns no command", func() error {
+		poll, _, err := s.poll(0)
+		if err == nil && poll.Command != "" {
+			err = fmt.Errorf("got command %q", poll.Command)
+		}
+		return err
+	})
+	check("queued command is delivered with its ID and duration", func() error {
+		id, poll, err := deliver(wod.CommandPulse, &wod.CommandOptions{Pulse: 500 * time.Millisecond})
+		if err != nil {
+			return err
+		}
+		if poll.DurationMS != 500 {
+			return fmt.Errorf("duration_ms is %d, want 500", poll.DurationMS)
+		}
+		if _, err := expectRecord(id, wod.StateDelivered); err != nil {
+			return err
+		}
+		if err := s.sendReport(id, nil, nil); err != nil {
+			return err
+		}
+		_, err = expectRecord(id, wod.StateAcked)
+		return err
+	})
+	check("queue is delivered in order and reports what is pending", func() error {
+		first, err := api.SetCommand(cli.clientCtx, s.id, wod.CommandForce, nil)
+		if err != nil {
+			return err
+		}
+		second, err := api.SetCommand(cli.clientCtx, s.id, wod.CommandStatus, nil)
+		if err != nil {
+			return err
+		}
+		for i, want := range []string{first.CommandID, second.CommandID} {
+			poll, _, err := s.poll(0)
+			if err != nil {
+				return err
+			}
+			if poll.CommandID != want || poll.Pending != 1-i {
+				return fmt.Errorf("poll %d: got %s with %d pending, want %s with %d", i+1, poll.CommandID, poll.Pending, want, 1-i)
+			}
+			s.sendReport(poll.CommandID, nil, nil)
+		}
+		return nil
+	})
+	check("status result is stored with the command", func() error {
+		id, _, err := deliver(wod.CommandStatus, nil)
+		if err != nil {
+			return err
+		}
+		if err := s.sendReport(id, nil, map[string]interface{}{"power": "off"}); err != nil {
+			return err
+		}
+		rec, err := expectRecord(id, wod.StateAcked)
+		if err == nil && rec.Result["power"] != "off" {
+			err = fmt.Errorf("result is %v", rec.Result)
+		}
+		return err
+	})
+	check("failure report fails the command", func() error {
+		id, _, err := deliver(wod.CommandForce, nil)
+		if err != nil {
+			return err
+		}
+		if err := s.sendReport(id, errors.New("relay stuck"), nil); err != nil {
+			return err
+		}
+		rec, err := expectRecord(id, wod.StateFailed)
+		if err == nil && rec.Error != "relay stuck" {
+			err = fmt.Errorf("error is %q", rec.Error)
+		}
+		return err
+	})
+	var lastSeq uint64
+	check("commands carry a rising seq and issued_at", func() error {
+		for range 2 {
+			id, poll, err := deliver(wod.CommandStatus, nil)
+			if err != nil {
+				return err
+			}
+			s.sendReport(id, nil, nil)
+			if poll.Seq <= lastSeq {
+				return fmt.Errorf("seq %d is not after %d", poll.Seq, lastSeq)
+			}
+			if age := cli.now().Sub(time.Unix(poll.IssuedAt, 0)); age < -time.Minute || age > time.Minute {
+				return fmt.Errorf("issued_at is %d, %s off", poll.IssuedAt, age.Round(time.Second))
+			}
+			lastSeq = poll.Seq
+		}
+		return nil
+	})
+	check("stale refusal expires the command", func() error {
+		id, _, err := deliver(wod.CommandPulse, nil)
+		if err != nil {
+			return err
+		}
+		if err := s.sendReport(id, fmt.Errorf("%w: replayed", errStale), nil); err != nil {
+			return err
+		}
+		_, err = expectRecord(id, wod.StateExpired)
+		return err
+	})
+	if s.secret != "" {
+		check("unsigned poll is rejected", func() error {
+			unsigned := *s
+			unsigned.secret = ""
+			_, status, err := unsigned.poll(0)
+			return expectStatus(http.StatusUnauthorized, status, err)
+		})
+		check("replayed poll is rejected", func() error {
+			s.nonce = server.NewCommandID()
+			defer func() { s.nonce = "" }()
+			if _, _, err := s.poll(0); err != nil {
+				return err
+			}
+			_, status, err := s.poll(0)
+			return expectStatus(http.StatusUnauthorized, status, err)
+		})
+	}
+	check("long poll returns a command queued while waiting", func() error {
+		queued := make(chan error, 1)
+		go func() {
+			time.Sleep(500 * time.Millisecond)
+			_, err := api.SetCommand(cli.clientCtx, s.id, wod.CommandStatus, nil)
+			queued <- err
+		}()
+		started := cli.now()
+		poll, _, err := s.poll(10 * time.Second)
+		if qerr := <-queued; qerr != nil {
+			return qerr
+		}
+		if err != nil {
+			return err
+		}
+		if poll.Command != string(wod.CommandStatus) || cli.now().Sub(started) > 5*time.Second {
+			return fmt.Errorf("got %q after %s", poll.Command, cli.now().Sub(started).Round(time.Millisecond))
+		}
+		return s.sendReport(poll.CommandID, nil, nil)
+	})
+
+	if failed > 0 {
+		fmt.Printf("%d of %d checks failed\n", failed, total)
+		return 1
+	}
+	fmt.Printf("All %d checks passed\n", total)
+	return 0
+}
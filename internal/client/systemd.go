@@ -0,0 +1,87 @@
+package client
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// --- Client Mode ---
+
+func (cli *CLI) installSystemdService(args []string) {
+	fs := flag.NewFlagSet("install-service", flag.ExitOnError)
+	dir := fs.String("dir", "/etc/systemd/system", "Directory to write the unit files to")
+	user := fs.String("user", "root", "User the service runs as")
+	socket := fs.Bool("socket", false, "Also write a .socket unit and start the server on demand")
+	watchdog := fs.Duration("watchdog", 30*time.Second, "WatchdogSec for the service (0 disables)")
+	fs.Usage = func() {
+		fmt.Println("Usage: wake-on-demand [-port <port>] install-service [-dir <dir>] [-user <user>] [-socket] [-watchdog 30s] [-- server flags...]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	exe, err := os.Executable()
+	if err != nil {
+		fmt.Printf("Error: Could not find executable: %v\n", err)
+		os.Exit(1)
+	}
+	exe, _ = filepath.EvalSymlinks(exe)
+
+	serverArgs := fs.Args()
+	if len(serverArgs) == 0 {
+		serverArgs = []string{
+			"-registry", "/var/lib/wake-on-demand/registry.json",
+			"-schedules", "/var/lib/wake-on-demand/schedules.json",
+			"-users", "/var/lib/wake-on-demand/users.json",
+			"-events", "/var/lib/wake-on-demand/events.jsonl",
+			"-ota-dir", "/var/lib/wake-on-demand/firmware",
+		}
+	}
+	if !*socket {
+		serverArgs = append([]string{"-port", cli.servicePort}, serverArgs...)
+	}
+	execStart := strings.Join(append(append([]string{exe}, serverArgs...), "server"), " ")
+
+	var unit strings.Builder
+	unit.WriteString("[Unit]\nDescription=Wake-On-Demand Server\nAfter=network-online.target\nWants=network-online.target\n")
+	if *socket {
+		unit.WriteString("Requires=wake-on-demand.socket\n")
+	}
+	fmt.Fprintf(&unit, "\n[Service]\nType=notify\nNotifyAccess=main\nExecStart=%s\nExecReload=/bin/kill -HUP $MAINPID\nRestart=always\nRestartSec=5\nUser=%s\nStateDirectory=wake-on-demand\n", execStart, *user)
+	if *watchdog > 0 {
+		fmt.Fprintf(&unit, "WatchdogSec=%d\n", int(watchdog.Seconds()))
+	}
+	unit.WriteString("\n# Security options\nNoNewPrivileges=true\nPrivateTmp=true\nProtectSystem=strict\nProtectHome=true\n")
+	unit.WriteString("\n[Install]\nWantedBy=multi-user.target\n")
+
+	servicePath := filepath.Join(*dir, "wake-on-demand.service")
+	if err := os.WriteFile(servicePath, []byte(unit.String()), 0644); err != nil {
+		fmt.Printf("Error: Could not write unit file: %v\n", err)
+		if errors.Is(err, os.ErrPermission) {
+			fmt.Println("Try again with sudo")
+		}
+		os.Exit(1)
+	}
+	fmt.Printf("Wrote %s\n", servicePath)
+
+	enable := "wake-on-demand"
+	if *socket {
+		socketUnit := fmt.Sprintf("[Unit]\nDescription=Wake-On-Demand Server Socket\n\n[Socket]\nListenStream=%s\n\n[Install]\nWantedBy=sockets.target\n", cli.servicePort)
+		socketPath := filepath.Join(*dir, "wake-on-demand.socket")
+		if err := os.WriteFile(socketPath, []byte(socketUnit), 0644); err != nil {
+			fmt.Printf("Error: Could not write unit file: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Wrote %s\n", socketPath)
+		enable = "wake-on-demand.socket"
+	}
+
+	fmt.Println()
+	fmt.Println("To enable and start:")
+	fmt.Println("  sudo systemctl daemon-reload")
+	fmt.Printf("  sudo systemctl enable --now %s\n", enable)
+}
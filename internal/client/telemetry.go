@@ -0,0 +1,198 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/smileyfaceskobochka/trashbin-daemon/internal/server"
+	wod "github.com/smileyfaceskobochka/trashbin-daemon/pkg/client"
+)
+
+// --- Client Mode ---
+
+func (cli *CLI) showInfo(espID string) {
+	d, err := cli.apiClient().Info(cli.clientCtx, espID)
+	if errors.Is(err, wod.ErrNotFound) {
+		fmt.Printf("ESP '%s' not registered\n", espID)
+		os.Exit(cli.exitStatus(err))
+	} else if err != nil {
+		cli.exitOnClientError(err)
+	}
+	switch cli.outputMode {
+	case outputJSON:
+		printJSON(d)
+		return
+	case outputPlain:
+		printDeviceRecord(d.Device)
+		return
+	}
+
+	state := "offline"
+	if d.Online {
+		state = "online"
+	}
+	if d.Alias != "" {
+		fmt.Printf("%s (%s)\n", d.Alias, d.ID)
+	} else {
+		fmt.Println(d.ID)
+	}
+	fmt.Printf("  Type:        %s\n", d.Type)
+	if d.Description != "" {
+		fmt.Printf("  Description: %s\n", d.Description)
+	}
+	if d.Location != "" {
+		fmt.Printf("  Location:    %s\n", d.Location)
+	}
+	if d.Hostname != "" {
+		fmt.Printf("  Hostname:    %s\n", d.Hostname)
+	}
+	if d.Protected {
+		fmt.Println("  Protected:   off needs -override")
+	}
+	if d.Maintenance != nil {
+		fmt.Printf("  Maintenance: \033[35m%s\033[0m\n", cli.formatMaintenance(d.Maintenance))
+	}
+	if d.PendingSince != nil {
+		fmt.Printf("  Pairing:     \033[33mwaiting for approval since %s\033[0m\n", d.PendingSince.Local().Format("Jan 2 15:04"))
+	}
+	if d.Driver != nil {
+		fmt.Printf("  Driver:      %s at %s\n", d.Type, d.Driver.Addr)
+		if d.Driver.Relay != 0 {
+			fmt.Printf("  Relay:       %d\n", d.Driver.Relay)
+		}
+	}
+	if d.Type == string(server.DeviceWoL) {
+		fmt.Printf("  MAC:         %s\n", d.MAC)
+		fmt.Printf("  Broadcast:   %s\n", d.Broadcast)
+		fmt.Printf("  Last woken:  %s\n", d.LastSeen)
+	} else {
+		fmt.Printf("  State:       %s\n", state)
+		fmt.Printf("  Last seen:   %s\n", d.LastSeen)
+		if d.Driver == nil {
+			fmt.Printf("  Address:     %s\n", d.RemoteAddr)
+		}
+		if d.PinnedIP != "" {
+			fmt.Printf("  Pinned to:   %s\n", d.PinnedIP)
+		}
+		if c := d.Conflict; c != nil {
+			fmt.Printf("  \033[33mConflict:    %d devices use this ID (%s since %s)\033[0m\n", len(c.Senders), c.Policy, c.DetectedAt.Local().Format(time.DateTime))
+			for _, s := range c.Senders {
+				fmt.Printf("    %s\n", cli.conflictSender(s))
+			}
+		}
+		if d.Timeout != nil {
+			fmt.Printf("  Timeout:     %s\n", formatTimeout(*d.Timeout))
+		}
+		if len(d.Actions) > 0 {
+			fmt.Printf("  Actions:     %s\n", formatActions(d.Actions))
+		}
+		if d.Capabilities != nil {
+			fmt.Printf("  Protocol:    %s\n", formatCapabilities(d.Capabilities))
+		}
+		if d.Beacon != nil {
+			fmt.Printf("  Beacon:      %s\n", cli.formatBeacon(d.Beacon))
+		}
+		if d.PulseMS != 0 || d.ForceMS != 0 {
+			fmt.Printf("  Pulse:       on %s, off %s\n",
+				formatPulse(time.Duration(d.PulseMS)*time.Millisecond), formatPulse(time.Duration(d.ForceMS)*time.Millisecond))
+		}
+	}
+	if d.CooldownMS > 0 {
+		cooldown := (time.Duration(d.CooldownMS) * time.Millisecond).String()
+		if d.CooldownLeftMS > 0 {
+			cooldown += fmt.Sprintf(", %s left", (time.Duration(d.CooldownLeftMS) * time.Millisecond).Round(100*time.Millisecond))
+		}
+		fmt.Printf("  Cooldown:    %s\n", cooldown)
+	}
+	fmt.Printf("  Registered:  %s\n", d.RegisteredAt.Local().Format(time.DateTime))
+	fmt.Printf("  Pending:     %d\n", d.Pending)
+	if d.Agent != nil {
+		fmt.Printf("  Agent:       %s (%s, %s), last seen %s ago\n", d.Agent.Hostname, d.Agent.Host, d.Agent.OS, cli.now().Sub(d.Agent.LastSeen).Round(time.Second))
+		if a := d.Agent.Activity; a != nil {
+			fmt.Printf("  Activity:    %s\n", cli.formatActivity(a))
+		}
+	}
+	if d.SSH != "" {
+		fmt.Printf("  SSH:         %s (soft-off without an agent)\n", d.SSH)
+	}
+	for _, s := range d.Idle {
+		switch {
+		case s.Acted && s.DryRun:
+			fmt.Printf("  Idle:        %s since %s, action logged (dry run)\n", s.Policy, s.Since.Local().Format(time.DateTime))
+		case s.Acted:
+			fmt.Printf("  Idle:        %s since %s, action sent\n", s.Policy, s.Since.Local().Format(time.DateTime))
+		default:
+			fmt.Printf("  Idle:        %s since %s, acts in %s\n", s.Policy, s.Since.Local().Format(time.DateTime), max(s.ActsAt.Sub(cli.now()), 0).Round(time.Second))
+		}
+	}
+	if d.Target != nil {
+		target := "unknown"
+		if d.TargetState != nil {
+			target = server.UpDown(d.TargetState.Up)
+		}
+		fmt.Printf("  Target:      %s (%s)\n", &server.Target{Host: d.Target.Host, Probe: server.ProbeType(d.Target.Probe), Port: d.Target.Port}, target)
+	}
+	if p := d.Power; p != nil {
+		source := ""
+		if p.Source != "" {
+			source = ", from " + p.Source
+		}
+		if p.Since.IsZero() {
+			fmt.Printf("  Power:       %s\n", p.State)
+		} else {
+			fmt.Printf("  Power:       %s for %s%s\n", p.State, cli.now().Sub(p.Since).Round(time.Second), source)
+		}
+	}
+	if p := d.LastPower; p != nil && (d.Power == nil || d.Power.State == wod.PowerUnknown) {
+		fmt.Printf("  Last power:  %s, %s ago from %s\n", p.State, cli.now().Sub(p.At).Round(time.Second), p.Source)
+	}
+
+	t := d.Telemetry
+	if t == nil {
+		if d.Type != string(server.DeviceWoL) && d.Driver == nil {
+			fmt.Println("  Telemetry:   none reported")
+		}
+		return
+	}
+	fmt.Printf("  Telemetry (reported %s ago):\n", cli.now().Sub(t.ReportedAt).Round(time.Second))
+	if t.Firmware != "" {
+		fmt.Printf("    Firmware:  %s\n", t.Firmware)
+	}
+	if t.Model != "" {
+		fmt.Printf("    Model:     %s\n", t.Model)
+	}
+	if t.RSSI != nil {
+		fmt.Printf("    WiFi RSSI: %d dBm\n", *t.RSSI)
+	}
+	if t.FreeHeap != nil {
+		fmt.Printf("    Free heap: %d bytes\n", *t.FreeHeap)
+	}
+	if t.ChipTemp != nil {
+		fmt.Printf("    Chip temp: %.1f °C\n", *t.ChipTemp)
+	}
+	if t.Uptime != nil {
+		fmt.Printf("    Uptime:    %s\n", time.Duration(*t.Uptime)*time.Second)
+	}
+	if t.PowerSource != "" || t.BatteryV != nil {
+		fmt.Printf("    Supply:    %s\n", formatSupply(t))
+	}
+}
+
+// formatSupply describes what an ESP runs on, e.g. "battery, 3.71 V".
+func formatSupply(t *wod.Telemetry) string {
+	var parts []string
+	if t.PowerSource != "" {
+		parts = append(parts, t.PowerSource)
+	}
+	if t.BatteryV != nil {
+		v := fmt.Sprintf("%.2f V", *t.BatteryV)
+		if t.BatteryLow {
+			v = "\033[31m" + v + " (low)\033[0m"
+		}
+		parts = append(parts, v)
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,113 @@
+package client
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/smileyfaceskobochka/trashbin-daemon/internal/server"
+	wod "github.com/smileyfaceskobochka/trashbin-daemon/pkg/client"
+)
+
+// --- Client Mode ---
+
+func (cli *CLI) runTelemetry(args []string) {
+	fs := flag.NewFlagSet("telemetry", flag.ExitOnError)
+	metric := fs.String("metric", "", "Comma-separated metrics: rssi, chip_temp, free_heap, battery_v (default: all)")
+	since := fs.String("since", "24h", "Start of the history (e.g. 24h, 7d or 2026-10-01)")
+	step := fs.Duration("step", 0, "Average over steps of this length (default: raw samples, or what fits)")
+	list := fs.Bool("list", false, "Print every point instead of a summary")
+	fs.Usage = func() {
+		fmt.Println("Usage: wake-on-demand telemetry <esp_id> [-metric rssi] [-since 24h] [-step 1h] [-list]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	espID := cli.resolveAlias(fs.Arg(0))
+	fs.Parse(fs.Args()[1:])
+
+	report, err := cli.apiClient().TelemetryHistory(cli.clientCtx, espID, server.SplitList(*metric), *since, *step)
+	if errors.Is(err, wod.ErrNotFound) {
+		fmt.Printf("ESP '%s' not registered\n", espID)
+		os.Exit(cli.exitStatus(err))
+	} else if err != nil {
+		cli.exitOnClientError(err)
+	}
+
+	switch cli.outputMode {
+	case outputJSON:
+		printJSON(report)
+		return
+	case outputPlain:
+		for _, s := range report.Series {
+			for _, p := range s.Points {
+				printRecord(s.Metric, p.Time, p.Value)
+			}
+		}
+		return
+	}
+
+	fmt.Printf("Telemetry of %s since %s", espID, report.Since.Local().Format(time.DateTime))
+	if report.StepMS > 0 {
+		fmt.Printf(", averaged per %s", time.Duration(report.StepMS)*time.Millisecond)
+	}
+	fmt.Println()
+	for _, s := range report.Series {
+		if len(s.Points) == 0 {
+			fmt.Printf("  %-10s no samples\n", s.Metric)
+			continue
+		}
+		lo, hi, sum := math.Inf(1), math.Inf(-1), 0.0
+		for _, p := range s.Points {
+			lo, hi, sum = min(lo, p.Value), max(hi, p.Value), sum+p.Value
+		}
+		fmt.Printf("  %-10s %s  min %s  avg %s  max %s %s\n", s.Metric, sparkline(s.Points, 40),
+			formatMetric(lo), formatMetric(sum/float64(len(s.Points))), formatMetric(hi), s.Unit)
+		if *list {
+			for _, p := range s.Points {
+				fmt.Printf("    %s  %s\n", p.Time.Local().Format(time.DateTime), formatMetric(p.Value))
+			}
+		}
+	}
+}
+
+// sparkline draws the points as one line of at most width block
+// characters, averaging neighbours when there are more.
+func sparkline(points []wod.TelemetryPoint, width int) string {
+	const bars = "▁▂▃▄▅▆▇█"
+	blocks := []rune(bars)
+	n := min(len(points), width)
+	values := make([]float64, n)
+	for i := range n {
+		from, to := i*len(points)/n, (i+1)*len(points)/n
+		for _, p := range points[from:to] {
+			values[i] += p.Value
+		}
+		values[i] /= float64(to - from)
+	}
+	lo, hi := slices.Min(values), slices.Max(values)
+	var b strings.Builder
+	for _, v := range values {
+		i := len(blocks) / 2
+		if hi > lo {
+			i = int((v - lo) / (hi - lo) * float64(len(blocks)-1))
+		}
+		b.WriteRune(blocks[i])
+	}
+	return fmt.Sprintf("%-*s", width, b.String())
+}
+
+func formatMetric(v float64) string {
+	if v == math.Trunc(v) {
+		return fmt.Sprintf("%.0f", v)
+	}
+	return fmt.Sprintf("%.2f", v)
+}
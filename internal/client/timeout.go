@@ -0,0 +1,71 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/smileyfaceskobochka/trashbin-daemon/internal/server"
+	wod "github.com/smileyfaceskobochka/trashbin-daemon/pkg/client"
+)
+
+// --- Client Mode ---
+
+func (cli *CLI) setTimeout(espID, arg string) {
+	var timeout time.Duration
+	if arg != "auto" {
+		var err error
+		if timeout, err = time.ParseDuration(arg); err != nil || timeout <= 0 {
+			fmt.Printf("Error: invalid timeout %q (use a duration such as 10m, or auto)\n", arg)
+			os.Exit(1)
+		}
+	}
+
+	jsonData, _ := json.Marshal(map[string]interface{}{"id": espID, "timeout_ms": timeout.Milliseconds()})
+	req, _ := http.NewRequest(http.MethodPost, cli.serverURL+server.APIPrefix+"/timeout", bytes.NewBuffer(jsonData))
+	req.Header.Set("Content-Type", "application/json")
+	cli.setAuthHeader(req)
+
+	resp, err := cli.httpClient.Do(req)
+	if err != nil {
+		cli.exitOnRequestError(err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var result struct {
+			Timeout wod.Timeout `json:"timeout"`
+		}
+		json.NewDecoder(resp.Body).Decode(&result)
+		fmt.Printf("Offline timeout for %s: %s\n", espID, formatTimeout(result.Timeout))
+	case http.StatusUnauthorized:
+		fmt.Println("Error: Unauthorized (check -admin-key)")
+		os.Exit(exitUnauthorized)
+	case http.StatusNotFound:
+		fmt.Printf("ESP '%s' not registered\n", espID)
+		os.Exit(exitNotFound)
+	default:
+		fmt.Printf("Error: %s\n", responseError(resp))
+		os.Exit(httpExitStatus(resp.StatusCode))
+	}
+}
+
+// formatTimeout describes a device's offline timeout for the CLI.
+func formatTimeout(t wod.Timeout) string {
+	timeout := time.Duration(t.TimeoutMS) * time.Millisecond
+	interval := (time.Duration(t.PollIntervalMS) * time.Millisecond).Round(time.Second)
+	switch t.Source {
+	case server.TimeoutSourceManual:
+		return fmt.Sprintf("%s (set manually)", timeout)
+	case server.TimeoutSourceAdapt:
+		return fmt.Sprintf("%s (adaptive, polls every %s)", timeout.Round(time.Second), interval)
+	}
+	if t.PollIntervalMS > 0 {
+		return fmt.Sprintf("%s (server default, polls every %s)", timeout, interval)
+	}
+	return fmt.Sprintf("%s (server default)", timeout)
+}
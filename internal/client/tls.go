@@ -0,0 +1,43 @@
+package client
+
+import (
+	"crypto/tls"
+	"net/http"
+
+	"github.com/smileyfaceskobochka/trashbin-daemon/internal/server"
+)
+
+// tlsState holds the CLI state kept in tls.go.
+type tlsState struct {
+	clientCAFile   string
+	clientInsecure bool
+
+	httpClient *http.Client
+	// clientTransport is httpClient's transport without deadlines and
+	// retries, for streams such as watch that stay open.
+	clientTransport http.RoundTripper
+	// clientTLS is the TLS config built from -ca-cert and -insecure; nil
+	// means system defaults.
+	clientTLS *tls.Config
+}
+
+func (cli *CLI) setupHTTPClient() error {
+	if err := cli.setupClientTLS(); err != nil {
+		return err
+	}
+	cli.httpClient = &http.Client{Transport: retryTransport{base: cli.clientTransport, cli: cli}}
+	return nil
+}
+
+func (cli *CLI) setupClientTLS() error {
+	tlsConfig, err := server.LoadClientTLS(cli.clientCAFile, cli.clientInsecure)
+	if err != nil || tlsConfig == nil {
+		return err
+	}
+	cli.clientTLS = tlsConfig
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	cli.clientTransport = transport
+	return nil
+}
@@ -0,0 +1,310 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/smileyfaceskobochka/trashbin-daemon/internal/server"
+	wod "github.com/smileyfaceskobochka/trashbin-daemon/pkg/client"
+	"golang.org/x/term"
+)
+
+// The terminal UI redraws the whole screen with ANSI escapes on every
+// change; device lists are short enough that this never flickers.
+
+const (
+	tuiRequestTimeout = 5 * time.Second
+	tuiEventTypes     = "command,delivered,acked,failed,expired"
+)
+
+type tuiModel struct {
+	devices  []wod.Device
+	lastCmd  map[string]server.Event // newest command event per device
+	selected int
+	status   string
+	confirm  string // command waiting for 'y', e.g. off
+	updated  time.Time
+	cli      *CLI
+}
+
+func (cli *CLI) runTUI(args []string) {
+	fs := flag.NewFlagSet("tui", flag.ExitOnError)
+	refresh := fs.Duration("refresh", 2*time.Second, "How often to reload the device list")
+	fs.Usage = func() {
+		fmt.Println("Usage: wake-on-demand tui [-refresh <duration>]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *refresh < 500*time.Millisecond {
+		fmt.Println("Error: -refresh must be at least 500ms")
+		os.Exit(1)
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) || !term.IsTerminal(int(os.Stdout.Fd())) {
+		fmt.Println("Error: tui needs an interactive terminal")
+		os.Exit(1)
+	}
+	// Fail before taking over the screen if the server is unreachable
+	m := &tuiModel{lastCmd: make(map[string]server.Event), cli: cli}
+	if err := m.reload(); err != nil {
+		cli.exitOnClientError(err)
+	}
+
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Print("\033[?1049h\033[?25l")
+	defer func() {
+		fmt.Print("\033[?25h\033[?1049l")
+		term.Restore(fd, state)
+	}()
+
+	keys := make(chan string)
+	go readKeys(keys)
+	ticker := time.NewTicker(*refresh)
+	defer ticker.Stop()
+
+	for {
+		m.draw()
+		select {
+		case <-ticker.C:
+			if err := m.reload(); err != nil {
+				m.status = "Refresh failed: " + tuiError(err)
+			}
+		case key, ok := <-keys:
+			if !ok || !m.handleKey(key) {
+				return
+			}
+		}
+	}
+}
+
+// readKeys turns terminal input into key names: single characters, or
+// "up" and "down" for the arrow keys.
+func readKeys(keys chan<- string) {
+	defer close(keys)
+	buf := make([]byte, 16)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			return
+		}
+		switch s := string(buf[:n]); s {
+		case "\033[A", "\033OA":
+			keys <- "up"
+		case "\033[B", "\033OB":
+			keys <- "down"
+		default:
+			for _, r := range s {
+				keys <- string(r)
+			}
+		}
+	}
+}
+
+// handleKey reports false when the UI should exit.
+func (m *tuiModel) handleKey(key string) bool {
+	if m.confirm != "" {
+		cmd := m.confirm
+		m.confirm = ""
+		if key == "y" || key == "Y" {
+			m.send(cmd)
+		} else {
+			m.status = "Cancelled"
+		}
+		return true
+	}
+
+	switch key {
+	case "q", "\x03", "\x04":
+		return false
+	case "up", "k":
+		if m.selected > 0 {
+			m.selected--
+		}
+	case "down", "j":
+		if m.selected < len(m.devices)-1 {
+			m.selected++
+		}
+	case "o":
+		m.send(string(server.CommandPulse))
+	case "s":
+		m.send(string(server.CommandStatus))
+	case "f", "d":
+		cmd := string(server.CommandForce)
+		if key == "d" {
+			cmd = string(server.CommandSoftOff)
+		}
+		if d, ok := m.current(); ok {
+			m.confirm = cmd
+			m.status = fmt.Sprintf("Send %s to %s? (y/n)", cmd, d.ID)
+		}
+	case "r":
+		if err := m.reload(); err != nil {
+			m.status = "Refresh failed: " + tuiError(err)
+		} else {
+			m.status = "Refreshed"
+		}
+	}
+	return true
+}
+
+func (m *tuiModel) current() (wod.Device, bool) {
+	if m.selected < 0 || m.selected >= len(m.devices) {
+		return wod.Device{}, false
+	}
+	return m.devices[m.selected], true
+}
+
+func (m *tuiModel) send(cmd string) {
+	d, ok := m.current()
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), tuiRequestTimeout)
+	defer cancel()
+	resp, err := m.cli.apiClient().SetCommand(ctx, d.ID, wod.Command(cmd), nil)
+	if err != nil {
+		m.status = fmt.Sprintf("%s %s failed: %s", cmd, d.ID, tuiError(err))
+		return
+	}
+	m.status = fmt.Sprintf("%s %s: %s via %s", cmd, d.ID, resp.Status, resp.Delivery)
+	m.reload()
+}
+
+// reload fetches the device list and the recent command events.
+func (m *tuiModel) reload() error {
+	ctx, cancel := context.WithTimeout(context.Background(), tuiRequestTimeout)
+	defer cancel()
+
+	devices, err := m.cli.apiClient().List(ctx)
+	if err != nil {
+		return err
+	}
+	var selectedID string
+	if d, ok := m.current(); ok {
+		selectedID = d.ID
+	}
+	m.devices = devices
+	m.selected = min(m.selected, max(len(devices)-1, 0))
+	for i, d := range devices {
+		if d.ID == selectedID {
+			m.selected = i
+		}
+	}
+
+	// Command columns are best effort; viewers may not see every event
+	if events, err := m.cli.fetchRecentCommands(ctx); err == nil {
+		clear(m.lastCmd)
+		for _, e := range events {
+			if _, seen := m.lastCmd[e.ESPID]; !seen {
+				m.lastCmd[e.ESPID] = e
+			}
+		}
+	}
+	m.updated = m.cli.now()
+	return nil
+}
+
+// fetchRecentCommands returns command events, newest first.
+func (cli *CLI) fetchRecentCommands(ctx context.Context) ([]server.Event, error) {
+	q := url.Values{"type": {tuiEventTypes}, "limit": {"500"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, cli.serverURL+server.APIPrefix+"/events?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	cli.setAuthHeader(req)
+	resp, err := cli.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(responseError(resp))
+	}
+	var result struct {
+		Events []server.Event `json:"events"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return result.Events, nil
+}
+
+func tuiError(err error) string {
+	var apiErr *wod.APIError
+	switch {
+	case errors.Is(err, wod.ErrUnreachable):
+		return "server unreachable"
+	case errors.As(err, &apiErr):
+		return apiErr.Message
+	}
+	return err.Error()
+}
+
+func (m *tuiModel) draw() {
+	var b strings.Builder
+	line := func(format string, args ...interface{}) {
+		b.WriteString(fmt.Sprintf(format, args...))
+		b.WriteString("\033[K\r\n")
+	}
+
+	b.WriteString("\033[H")
+	line("\033[1mwake-on-demand\033[0m  %s  \033[90mupdated %s\033[0m", m.cli.serverURL, m.updated.Format(time.TimeOnly))
+	line("")
+	line("   \033[1m%-22s %-8s %-14s %-12s %s\033[0m", "DEVICE", "STATE", "POWER", "LAST SEEN", "LAST COMMAND")
+	if len(m.devices) == 0 {
+		line("   \033[90mNo devices registered\033[0m")
+	}
+	for i, d := range m.devices {
+		name := d.ID
+		if d.Alias != "" {
+			name = d.Alias + " (" + d.ID + ")"
+		}
+		state := deviceState(d)
+		color := "\033[31m"
+		switch state {
+		case "online":
+			color = "\033[32m"
+		case "wol":
+			color = "\033[36m"
+		}
+		power := devicePower(d)
+		if power == "" {
+			power = "-"
+		}
+		lastCmd := "-"
+		if e, ok := m.lastCmd[d.ID]; ok {
+			outcome := string(e.Type)
+			if e.Type == server.EventCommand {
+				outcome = "sent"
+			}
+			lastCmd = fmt.Sprintf("%s %s %s ago", e.Command, outcome, m.cli.now().Sub(e.Time).Round(time.Second))
+		}
+		cursor := "  "
+		if i == m.selected {
+			cursor = "\033[7m >"
+		}
+		row := fmt.Sprintf("%s %-22s %s%-8s\033[0m %-14s %-12s %s", cursor, server.Truncate(name, 22), color, state, power, d.LastSeen, lastCmd)
+		if i == m.selected {
+			row = strings.ReplaceAll(row, "\033[0m", "\033[0m\033[7m") + "\033[0m"
+		}
+		line("%s", row)
+	}
+	line("")
+	line("\033[90m↑/↓ select   o on   f off   d soft-off   s status   r refresh   q quit\033[0m")
+	line("%s", m.status)
+	b.WriteString("\033[J")
+	fmt.Print(b.String())
+}
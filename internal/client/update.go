@@ -0,0 +1,466 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/smileyfaceskobochka/trashbin-daemon/internal/server"
+	"golang.org/x/crypto/ssh"
+)
+
+// Self-update replaces the running binary with the newest release. A
+// release is a set of binaries named wake-on-demand_<version>_<os>_<arch>
+// with a SHA256SUMS file listing them and SHA256SUMS.sig, an OpenSSH
+// signature of that file made with
+//
+//	ssh-keygen -Y sign -f release_key -n wake-on-demand-release SHA256SUMS
+//
+// 'make release' builds one. Releases come from GitHub, or from a
+// directory served over HTTP(S) with -url. The signature is checked
+// against the release key built in (releaseKey) or set with
+// update.public_key, the download against its checksum, and the new binary
+// has to run before it is renamed over the old one, so a failed update
+// leaves the old binary in place.
+
+const (
+	defaultReleaseRepo = "smileyfaceskobochka/wake-on-demand"
+	releaseNamespace   = "wake-on-demand-release"
+	releaseSums        = "SHA256SUMS"
+	releaseSig         = "SHA256SUMS.sig"
+	maxReleaseBinary   = 256 << 20
+	updateTimeout      = 10 * time.Minute
+)
+
+// releaseKey is the authorized_keys line of the key releases are signed
+// with, set at build time with -ldflags "-X".
+var releaseKey string
+
+// VersionString is what -version prints: the version, the commit and date
+// it was built from and the Go toolchain.
+func VersionString() string {
+	s := "wake-on-demand v" + server.VERSION
+	var details []string
+	rev, date := server.BuildCommit()
+	if rev != "" {
+		details = append(details, "commit "+rev)
+	}
+	if date != "" {
+		details = append(details, "built "+date)
+	}
+	details = append(details, runtime.Version()+" "+runtime.GOOS+"/"+runtime.GOARCH)
+	return s + " (" + strings.Join(details, ", ") + ")"
+}
+
+// releasePlatform is the os_arch part of the release binary's name, with
+// the ARM version for 32-bit ARM.
+func releasePlatform() string {
+	arch := runtime.GOARCH
+	if arch == "arm" {
+		goarm := "7"
+		if info, ok := debug.ReadBuildInfo(); ok {
+			for _, s := range info.Settings {
+				if s.Key == "GOARM" && s.Value != "" {
+					goarm = s.Value[:1]
+				}
+			}
+		}
+		arch = "armv" + goarm
+	}
+	return runtime.GOOS + "_" + arch
+}
+
+// release is where a release's files are downloaded from.
+type release struct {
+	source string
+	files  map[string]string // GitHub asset URLs by name; nil for a directory
+	base   string
+}
+
+func (r release) url(name string) (string, error) {
+	if r.files == nil {
+		return r.base + "/" + name, nil
+	}
+	if u, ok := r.files[name]; ok {
+		return u, nil
+	}
+	return "", fmt.Errorf("%s has no %s", r.source, name)
+}
+
+// findRelease locates the release to update from: a directory when url is
+// set, the latest release of repo on GitHub otherwise.
+func findRelease(ctx context.Context, hc *http.Client, url, repo string) (release, error) {
+	if url != "" {
+		url = strings.TrimSuffix(url, "/")
+		return release{source: url, base: url}, nil
+	}
+	api := "https://api.github.com/repos/" + repo + "/releases/latest"
+	body, err := fetchRelease(ctx, hc, api, 1<<20)
+	if err != nil {
+		return release{}, err
+	}
+	var latest struct {
+		TagName string `json:"tag_name"`
+		Assets  []struct {
+			Name string `json:"name"`
+			URL  string `json:"browser_download_url"`
+		} `json:"assets"`
+	}
+	if err := json.Unmarshal(body, &latest); err != nil {
+		return release{}, fmt.Errorf("%s: %v", api, err)
+	}
+	r := release{source: repo + " " + latest.TagName, files: make(map[string]string)}
+	for _, a := range latest.Assets {
+		r.files[a.Name] = a.URL
+	}
+	return r, nil
+}
+
+func fetchRelease(ctx context.Context, hc *http.Client, url string, limit int64) ([]byte, error) {
+	resp, err := getRelease(ctx, hc, url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", url, err)
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("%s: over %d bytes", url, limit)
+	}
+	return data, nil
+}
+
+func getRelease(ctx context.Context, hc *http.Client, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "wake-on-demand/"+server.VERSION)
+	if strings.HasPrefix(url, "https://api.github.com/") {
+		req.Header.Set("Accept", "application/vnd.github+json")
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return resp, nil
+}
+
+// releaseBinary finds this platform's binary in SHA256SUMS and returns
+// its name, version and checksum.
+func releaseBinary(sums []byte) (name, version string, sum []byte, err error) {
+	suffix := "_" + releasePlatform()
+	if runtime.GOOS == "windows" {
+		suffix += ".exe"
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(sums))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		file := strings.TrimPrefix(fields[1], "*")
+		rest, ok := strings.CutPrefix(file, "wake-on-demand_")
+		if !ok || !strings.HasSuffix(rest, suffix) {
+			continue
+		}
+		if sum, err = hex.DecodeString(fields[0]); err != nil || len(sum) != sha256.Size {
+			return "", "", nil, fmt.Errorf("%s: invalid checksum for %s", releaseSums, file)
+		}
+		return file, strings.TrimSuffix(rest, suffix), sum, nil
+	}
+	return "", "", nil, fmt.Errorf("the release has no binary for %s", releasePlatform())
+}
+
+// compareVersions orders dotted versions numerically; a pre-release such
+// as 1.2.0-rc1 comes before the release.
+func compareVersions(a, b string) int {
+	a, preA, _ := strings.Cut(strings.TrimPrefix(a, "v"), "-")
+	b, preB, _ := strings.Cut(strings.TrimPrefix(b, "v"), "-")
+	partsA, partsB := strings.Split(a, "."), strings.Split(b, ".")
+	for i := range max(len(partsA), len(partsB)) {
+		var x, y int
+		if i < len(partsA) {
+			x, _ = strconv.Atoi(partsA[i])
+		}
+		if i < len(partsB) {
+			y, _ = strconv.Atoi(partsB[i])
+		}
+		if x != y {
+			return x - y
+		}
+	}
+	switch {
+	case preA == preB:
+		return 0
+	case preA == "":
+		return 1
+	case preB == "":
+		return -1
+	}
+	return strings.Compare(preA, preB)
+}
+
+// verifySSHSignature checks an armored signature made with ssh-keygen -Y
+// sign, in the format of OpenSSH's PROTOCOL.sshsig.
+func verifySSHSignature(key ssh.PublicKey, message, armored []byte, namespace string) error {
+	block, _ := pem.Decode(armored)
+	if block == nil || block.Type != "SSH SIGNATURE" {
+		return errors.New("not an SSH signature")
+	}
+	blob, ok := bytes.CutPrefix(block.Bytes, []byte("SSHSIG"))
+	if !ok {
+		return errors.New("not an SSH signature")
+	}
+	var sig struct {
+		Version   uint32
+		PublicKey []byte
+		Namespace string
+		Reserved  string
+		HashAlg   string
+		Signature []byte
+	}
+	if err := ssh.Unmarshal(blob, &sig); err != nil {
+		return err
+	}
+	if sig.Version != 1 {
+		return fmt.Errorf("unsupported signature version %d", sig.Version)
+	}
+	signer, err := ssh.ParsePublicKey(sig.PublicKey)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(signer.Marshal(), key.Marshal()) {
+		return fmt.Errorf("signed with another key (%s)", ssh.FingerprintSHA256(signer))
+	}
+	if sig.Namespace != namespace {
+		return fmt.Errorf("signed for %q, not %q", sig.Namespace, namespace)
+	}
+	var h hash.Hash
+	switch sig.HashAlg {
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return fmt.Errorf("unsupported hash %q", sig.HashAlg)
+	}
+	h.Write(message)
+	signed := append([]byte("SSHSIG"), ssh.Marshal(struct {
+		Namespace string
+		Reserved  string
+		HashAlg   string
+		Hash      []byte
+	}{sig.Namespace, sig.Reserved, sig.HashAlg, h.Sum(nil)})...)
+	var s ssh.Signature
+	if err := ssh.Unmarshal(sig.Signature, &s); err != nil {
+		return err
+	}
+	return key.Verify(signed, &s)
+}
+
+// downloadBinary saves the release binary next to the running one and
+// checks its checksum. The caller removes the file on failure.
+func downloadBinary(ctx context.Context, hc *http.Client, url, dir string, sum []byte) (string, error) {
+	resp, err := getRelease(ctx, hc, url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	f, err := os.CreateTemp(dir, ".wake-on-demand-update-*")
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), io.LimitReader(resp.Body, maxReleaseBinary+1))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	switch {
+	case err != nil:
+		return f.Name(), fmt.Errorf("%s: %v", url, err)
+	case n > maxReleaseBinary:
+		return f.Name(), fmt.Errorf("%s: over %d bytes", url, maxReleaseBinary)
+	case !bytes.Equal(h.Sum(nil), sum):
+		return f.Name(), fmt.Errorf("%s: checksum mismatch, got %x", url, h.Sum(nil))
+	}
+	return f.Name(), os.Chmod(f.Name(), 0o755)
+}
+
+// checkBinary runs the new binary, so one that can't run here never
+// replaces a working one.
+func (cli *CLI) checkBinary(path, version string) error {
+	ctx, cancel := context.WithTimeout(cli.clientCtx, 10*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, path, "-version").Output()
+	if err != nil {
+		return fmt.Errorf("the new binary doesn't run: %v", err)
+	}
+	if !strings.HasPrefix(string(out), "wake-on-demand v"+version) {
+		return fmt.Errorf("the new binary reports %q, not v%s", strings.TrimSpace(string(out)), version)
+	}
+	return nil
+}
+
+// replaceBinary renames the new binary over the old one. Windows can't
+// replace a running executable, but can rename it out of the way.
+func replaceBinary(newPath, exe string) error {
+	if runtime.GOOS == "windows" {
+		old := exe + ".old"
+		os.Remove(old)
+		if err := os.Rename(exe, old); err != nil {
+			return err
+		}
+		if err := os.Rename(newPath, exe); err != nil {
+			os.Rename(old, exe)
+			return err
+		}
+		return nil
+	}
+	return os.Rename(newPath, exe)
+}
+
+// --- Client Mode ---
+
+func (cli *CLI) runSelfUpdate(args []string) {
+	fs := flag.NewFlagSet("self-update", flag.ExitOnError)
+	check := fs.Bool("check", false, "Only report whether a newer release is available")
+	force := fs.Bool("force", false, "Install the release even if it isn't newer")
+	url := fs.String("url", cli.config.Update.URL, "Release directory to update from (default: the latest GitHub release)")
+	repo := fs.String("repo", cmp.Or(cli.config.Update.Repo, defaultReleaseRepo), "GitHub repository to take releases from")
+	publicKey := fs.String("public-key", cmp.Or(cli.config.Update.PublicKey, releaseKey), "Key releases are signed with, as an authorized_keys line or file")
+	checksumOnly := fs.Bool("checksum-only", false, "Trust SHA256SUMS without a signature")
+	fs.Usage = func() {
+		fmt.Println("Usage: wake-on-demand self-update [-check] [-force] [-url <dir>] [-repo <owner/name>] [-public-key <key>] [-checksum-only]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	var key ssh.PublicKey
+	if !*checksumOnly {
+		if *publicKey == "" {
+			fmt.Println("Error: no release key to check signatures with (set -public-key or update.public_key, or pass -checksum-only)")
+			os.Exit(1)
+		}
+		var err error
+		if key, err = server.ParseReleaseKey(*publicKey); err != nil {
+			fmt.Printf("Error: -public-key: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if cli.clientTLS != nil {
+		transport.TLSClientConfig = cli.clientTLS
+	}
+	hc := &http.Client{Transport: transport, Timeout: updateTimeout}
+	ctx := cli.clientCtx
+
+	rel, err := findRelease(ctx, hc, *url, *repo)
+	if err != nil {
+		cli.updateFailed(err)
+	}
+	sumsURL, err := rel.url(releaseSums)
+	if err != nil {
+		cli.updateFailed(err)
+	}
+	sums, err := fetchRelease(ctx, hc, sumsURL, 1<<20)
+	if err != nil {
+		cli.updateFailed(err)
+	}
+	if key != nil {
+		sigURL, err := rel.url(releaseSig)
+		if err != nil {
+			cli.updateFailed(err)
+		}
+		sig, err := fetchRelease(ctx, hc, sigURL, 64<<10)
+		if err != nil {
+			cli.updateFailed(err)
+		}
+		if err := verifySSHSignature(key, sums, sig, releaseNamespace); err != nil {
+			cli.updateFailed(fmt.Errorf("bad signature on %s: %v", releaseSums, err))
+		}
+	}
+	name, version, sum, err := releaseBinary(sums)
+	if err != nil {
+		cli.updateFailed(err)
+	}
+
+	newer := compareVersions(version, server.VERSION) > 0
+	switch {
+	case *check && newer:
+		fmt.Printf("Update available: v%s -> v%s (%s)\n", server.VERSION, version, rel.source)
+		return
+	case *check:
+		fmt.Printf("Up to date: v%s is the newest release (%s)\n", server.VERSION, rel.source)
+		return
+	case !newer && !*force:
+		fmt.Printf("Up to date: v%s is the newest release (-force installs v%s anyway)\n", server.VERSION, version)
+		return
+	}
+
+	exe, err := os.Executable()
+	if err == nil {
+		exe, err = filepath.EvalSymlinks(exe)
+	}
+	if err != nil {
+		cli.updateFailed(fmt.Errorf("can't find the running binary: %v", err))
+	}
+	binURL, err := rel.url(name)
+	if err != nil {
+		cli.updateFailed(err)
+	}
+	fmt.Printf("Downloading %s...\n", name)
+	tmp, err := downloadBinary(ctx, hc, binURL, filepath.Dir(exe), sum)
+	if err == nil {
+		err = cli.checkBinary(tmp, version)
+	}
+	if err == nil {
+		err = replaceBinary(tmp, exe)
+	}
+	if err != nil {
+		if tmp != "" {
+			os.Remove(tmp)
+		}
+		if errors.Is(err, os.ErrPermission) {
+			err = fmt.Errorf("%v (run as a user who may write %s)", err, filepath.Dir(exe))
+		}
+		cli.updateFailed(err)
+	}
+	fmt.Printf("Updated %s from v%s to v%s\n", exe, server.VERSION, version)
+	fmt.Println("Restart running servers and agents to use it, e.g. sudo systemctl restart wake-on-demand")
+}
+
+func (cli *CLI) updateFailed(err error) {
+	if cli.interrupted() {
+		os.Exit(130)
+	}
+	fmt.Printf("Error: %v\n", err)
+	os.Exit(1)
+}
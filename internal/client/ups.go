@@ -0,0 +1,69 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/smileyfaceskobochka/trashbin-daemon/internal/server"
+)
+
+// --- Client Mode ---
+
+func (cli *CLI) runUPS() {
+	req, _ := http.NewRequest(http.MethodGet, cli.serverURL+server.APIPrefix+"/ups", nil)
+	cli.setAuthHeader(req)
+
+	resp, err := cli.httpClient.Do(req)
+	if err != nil {
+		cli.exitOnRequestError(err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized:
+		fmt.Println("Error: Unauthorized (check -admin-key)")
+		os.Exit(exitUnauthorized)
+	case http.StatusNotFound:
+		fmt.Println("No UPS configured")
+		os.Exit(exitNotFound)
+	default:
+		fmt.Printf("Error: %s\n", responseError(resp))
+		os.Exit(httpExitStatus(resp.StatusCode))
+	}
+	var info server.UPSInfo
+	json.NewDecoder(resp.Body).Decode(&info)
+	if cli.outputMode == outputJSON {
+		printJSON(info)
+		return
+	}
+
+	fmt.Printf("UPS:      %s via %s", info.Address, info.Driver)
+	if info.Name != "" {
+		fmt.Printf(" (%s)", info.Name)
+	}
+	fmt.Println()
+	if info.Error != "" {
+		fmt.Printf("Error:    %s\n", info.Error)
+	}
+	if info.Reading == nil {
+		fmt.Println("Status:   unknown")
+		return
+	}
+	power := "mains"
+	if info.Reading.OnBattery {
+		power = "battery"
+	}
+	if info.Reading.LowBattery {
+		power += ", low"
+	}
+	fmt.Printf("Power:    %s (%s)\n", power, info.Reading.Status)
+	if s := info.Reading.String(); s != "" {
+		fmt.Printf("Battery:  %s\n", s)
+	}
+	if info.ChangedAt != nil {
+		fmt.Printf("Changed:  %s\n", info.ChangedAt.Local().Format("Jan 2 15:04:05"))
+	}
+}
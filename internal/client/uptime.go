@@ -0,0 +1,85 @@
+package client
+
+import (
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/smileyfaceskobochka/trashbin-daemon/internal/server"
+	wod "github.com/smileyfaceskobochka/trashbin-daemon/pkg/client"
+)
+
+// --- Client Mode ---
+
+func (cli *CLI) runUptime(args []string) {
+	fs := flag.NewFlagSet("uptime", flag.ExitOnError)
+	since := fs.String("since", "30d", "Start of the report (e.g. 30d, 72h or 2026-09-01)")
+	by := fs.String("by", "day", "Report uptime per day or week")
+	asCSV := fs.Bool("csv", false, "Print CSV")
+	fs.Usage = func() {
+		fmt.Println("Usage: wake-on-demand uptime <esp_id> [-since 30d] [-by day|week] [-csv]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	espID := cli.resolveAlias(fs.Arg(0))
+	fs.Parse(fs.Args()[1:])
+
+	report, err := cli.apiClient().Uptime(cli.clientCtx, espID, *since, *by)
+	if errors.Is(err, wod.ErrNotFound) {
+		fmt.Printf("No uptime for '%s': %v\n", espID, err)
+		os.Exit(cli.exitStatus(err))
+	} else if err != nil {
+		cli.exitOnClientError(err)
+	}
+
+	switch {
+	case *asCSV:
+		cw := csv.NewWriter(os.Stdout)
+		cw.Write(server.UptimeCSVHeader)
+		for _, b := range report.Buckets {
+			cw.Write(server.UptimeCSVRow(b.Start.Format(time.RFC3339), b.UpMS, b.DownMS, b.UnknownMS, b.Uptime))
+		}
+		b := report.Total
+		cw.Write(server.UptimeCSVRow("total", b.UpMS, b.DownMS, b.UnknownMS, b.Uptime))
+		cw.Flush()
+		return
+	case cli.outputMode == outputJSON:
+		printJSON(report)
+		return
+	case cli.outputMode == outputPlain:
+		for _, b := range report.Buckets {
+			printRecord(b.Start, formatUptime(b.Uptime), b.UpMS/1000, b.DownMS/1000, b.UnknownMS/1000)
+		}
+		return
+	}
+
+	layout := "Mon Jan 02"
+	fmt.Printf("Uptime of %s since %s\n", espID, report.Since.Local().Format(time.DateTime))
+	for _, b := range report.Buckets {
+		label := b.Start.Local().Format(layout)
+		if report.Bucket == "week" {
+			label = "week of " + label
+		}
+		fmt.Printf("  %-18s %8s  down %-10s unknown %s\n", label, formatUptime(b.Uptime), formatMS(b.DownMS), formatMS(b.UnknownMS))
+	}
+	fmt.Printf("  %-18s %8s  down %-10s unknown %s\n", "total", formatUptime(report.Total.Uptime), formatMS(report.Total.DownMS), formatMS(report.Total.UnknownMS))
+}
+
+func formatUptime(pct *float64) string {
+	if pct == nil {
+		return "-"
+	}
+	return strconv.FormatFloat(*pct, 'f', 2, 64) + "%"
+}
+
+func formatMS(ms int64) string {
+	return (time.Duration(ms) * time.Millisecond).Round(time.Second).String()
+}
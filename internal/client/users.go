@@ -0,0 +1,208 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/smileyfaceskobochka/trashbin-daemon/internal/server"
+	"golang.org/x/term"
+)
+
+// --- Client Mode ---
+
+func (cli *CLI) runUserCommand(args []string) {
+	if len(args) < 1 {
+		printUserUsage()
+	}
+
+	switch args[0] {
+	case "add":
+		if len(args) < 3 {
+			printUserUsage()
+		}
+		if !server.Role(args[2]).Valid() {
+			fmt.Printf("Error: Unknown role %q (use admin, operator or viewer)\n", args[2])
+			os.Exit(1)
+		}
+		namespace := optionalArg(args, 3)
+		if namespace != "" {
+			if err := server.ValidateNamespace(namespace); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		body, _ := json.Marshal(map[string]string{"name": args[1], "role": args[2], "namespace": namespace})
+		resp := cli.userRequest(http.MethodPost, "/users", body)
+		defer resp.Body.Close()
+
+		var created struct {
+			Name      string `json:"name"`
+			Role      string `json:"role"`
+			Namespace string `json:"namespace"`
+			Token     string `json:"token"`
+		}
+		json.NewDecoder(resp.Body).Decode(&created)
+		if created.Namespace != "" {
+			fmt.Printf("User %s added with role %s in namespace %s\n", created.Name, created.Role, created.Namespace)
+		} else {
+			fmt.Printf("User %s added with role %s\n", created.Name, created.Role)
+		}
+		fmt.Printf("Token: %s\n", created.Token)
+		fmt.Println("The token is shown only once; pass it to the client with -admin-key.")
+
+	case "list":
+		resp := cli.userRequest(http.MethodGet, "/users", nil)
+		defer resp.Body.Close()
+
+		var result struct {
+			Users []server.UserInfo `json:"users"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			fmt.Println("Error decoding response")
+			os.Exit(1)
+		}
+		if len(result.Users) == 0 {
+			fmt.Println("No users")
+			return
+		}
+		fmt.Println("Users:")
+		for _, u := range result.Users {
+			esps := "all"
+			if u.Role != server.RoleAdmin {
+				esps = "none"
+				if len(u.ESPs) > 0 {
+					esps = fmt.Sprint(u.ESPs)
+				}
+			}
+			if u.Namespace != "" {
+				esps += " in " + u.Namespace
+			}
+			password := ""
+			if u.Password {
+				password = "  (dashboard password)"
+			}
+			fmt.Printf("  %-16s %-9s ESPs: %s%s\n", u.Name, u.Role, esps, password)
+		}
+
+	case "remove":
+		if len(args) < 2 {
+			printUserUsage()
+		}
+		resp := cli.userRequest(http.MethodDelete, "/users?name="+url.QueryEscape(args[1]), nil)
+		resp.Body.Close()
+		fmt.Printf("User %s removed\n", args[1])
+
+	case "grant", "revoke":
+		if len(args) < 3 {
+			printUserUsage()
+		}
+		method := http.MethodPost
+		if args[0] == "revoke" {
+			method = http.MethodDelete
+		}
+		body, _ := json.Marshal(map[string]string{"name": args[1], "esp_id": cli.qualifyID(args[2])})
+		resp := cli.userRequest(method, "/users/acl", body)
+		resp.Body.Close()
+		if method == http.MethodPost {
+			fmt.Printf("Granted %s access to %s\n", args[1], args[2])
+		} else {
+			fmt.Printf("Revoked %s access to %s\n", args[1], args[2])
+		}
+
+	case "passwd":
+		if len(args) < 2 {
+			printUserUsage()
+		}
+		if len(args) > 2 && args[2] == "-clear" {
+			resp := cli.userRequest(http.MethodDelete, "/users/password?name="+url.QueryEscape(args[1]), nil)
+			resp.Body.Close()
+			fmt.Printf("Dashboard password of %s cleared\n", args[1])
+			return
+		}
+		password := readNewPassword()
+		body, _ := json.Marshal(map[string]string{"name": args[1], "password": password})
+		resp := cli.userRequest(http.MethodPost, "/users/password", body)
+		resp.Body.Close()
+		fmt.Printf("Dashboard password of %s set\n", args[1])
+
+	default:
+		printUserUsage()
+	}
+}
+
+// readNewPassword prompts twice on a terminal, or reads one line from
+// standard input so scripts can pipe the password in.
+func readNewPassword() string {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			fmt.Println("Error: No password on standard input")
+			os.Exit(1)
+		}
+		return strings.TrimRight(line, "\r\n")
+	}
+
+	prompt := func(label string) string {
+		fmt.Print(label)
+		b, err := term.ReadPassword(fd)
+		fmt.Println()
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		return string(b)
+	}
+	password := prompt("New password: ")
+	if prompt("Repeat password: ") != password {
+		fmt.Println("Error: Passwords do not match")
+		os.Exit(1)
+	}
+	return password
+}
+
+func printUserUsage() {
+	fmt.Println(`Usage:
+  wake-on-demand user add <name> <admin|operator|viewer> [namespace]
+  wake-on-demand user list
+  wake-on-demand user remove <name>
+  wake-on-demand user grant <name> <esp_id|*>
+  wake-on-demand user revoke <name> <esp_id|*>
+  wake-on-demand user passwd <name> [-clear]`)
+	os.Exit(1)
+}
+
+func (cli *CLI) userRequest(method, path string, body []byte) *http.Response {
+	req, _ := http.NewRequest(method, cli.serverURL+server.APIPrefix+path, bytes.NewReader(body))
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	cli.setAuthHeader(req)
+
+	resp, err := cli.httpClient.Do(req)
+	if err != nil {
+		cli.exitOnRequestError(err)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		return resp
+	case http.StatusUnauthorized:
+		fmt.Println("Error: Unauthorized (check -admin-key)")
+	case http.StatusForbidden:
+		fmt.Println("Error: Managing users requires the admin role")
+	case http.StatusNotFound:
+		fmt.Println("Error: User not found")
+	default:
+		fmt.Printf("Error: %s\n", responseError(resp))
+	}
+	resp.Body.Close()
+	os.Exit(httpExitStatus(resp.StatusCode))
+	return nil
+}
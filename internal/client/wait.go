@@ -0,0 +1,217 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/smileyfaceskobochka/trashbin-daemon/internal/server"
+	wod "github.com/smileyfaceskobochka/trashbin-daemon/pkg/client"
+)
+
+// waitCondition is one state 'wait' blocks for.
+type waitCondition struct {
+	name  string // completes "<esp_id> ...", e.g. "is online"
+	holds func(*wod.DeviceDetails) bool
+	// needs explains why the condition can never hold for d, if it can't
+	needs func(*wod.DeviceDetails) string
+}
+
+func needsTarget(d *wod.DeviceDetails) string {
+	if d.Target == nil {
+		return "no target is probed (set one with: wake-on-demand target)"
+	}
+	return ""
+}
+
+func needsPower(d *wod.DeviceDetails) string {
+	if d.Power == nil {
+		return "nothing confirms its power state; set a target or report 'power' from the ESP"
+	}
+	return ""
+}
+
+func powerCondition(state string) waitCondition {
+	name := "is powered " + state
+	if state == wod.PowerBooting {
+		name = "is booting"
+	}
+	return waitCondition{
+		name:  name,
+		holds: func(d *wod.DeviceDetails) bool { return d.Power != nil && d.Power.State == state },
+		needs: needsPower,
+	}
+}
+
+// describeWaitState summarizes what the conditions look at, for the timeout
+// message.
+func describeWaitState(d *wod.DeviceDetails) string {
+	if d == nil {
+		return "not registered"
+	}
+	parts := []string{"offline"}
+	if d.Online {
+		parts[0] = "online"
+	}
+	if d.Target != nil {
+		target := "unknown"
+		if d.TargetState != nil {
+			target = server.UpDown(d.TargetState.Up)
+		}
+		parts = append(parts, "target "+target)
+	}
+	if d.Power != nil {
+		parts = append(parts, "power "+d.Power.State)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// --- Client Mode ---
+
+func (cli *CLI) runWait(args []string) {
+	fs := flag.NewFlagSet("wait", flag.ExitOnError)
+	online := fs.Bool("online", false, "Wait until the ESP is online")
+	offline := fs.Bool("offline", false, "Wait until the ESP is offline")
+	targetUp := fs.Bool("target-up", false, "Wait until the target answers its probe")
+	targetDown := fs.Bool("target-down", false, "Wait until the target stops answering its probe")
+	power := fs.String("power", "", "Wait until the target's power state is up, off or booting")
+	timeout := fs.Duration("timeout", 5*time.Minute, "Give up after this long (0 waits forever)")
+	interval := fs.Duration("interval", 2*time.Second, "How often to check")
+	fs.Usage = func() {
+		fmt.Println("Usage: wake-on-demand wait <esp_id> [-online|-offline] [-target-up|-target-down] [-power <state>] [-timeout 5m] [-interval 2s]")
+		fmt.Println("Exits 0 once every given condition holds, 1 on timeout")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	rest := fs.Args()
+	if len(rest) < 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	fs.Parse(rest[1:])
+	espID := cli.resolveAlias(rest[0])
+
+	var conds []waitCondition
+	if *online && *offline || *targetUp && *targetDown {
+		fmt.Println("Error: -online/-offline and -target-up/-target-down are mutually exclusive")
+		os.Exit(1)
+	}
+	if *online {
+		conds = append(conds, waitCondition{name: "is online", holds: func(d *wod.DeviceDetails) bool { return d.Online }})
+	}
+	if *offline {
+		conds = append(conds, waitCondition{name: "is offline", holds: func(d *wod.DeviceDetails) bool { return !d.Online }})
+	}
+	if *targetUp {
+		conds = append(conds, waitCondition{name: "has its target up", needs: needsTarget,
+			holds: func(d *wod.DeviceDetails) bool { return d.TargetState != nil && d.TargetState.Up }})
+	}
+	if *targetDown {
+		conds = append(conds, waitCondition{name: "has its target down", needs: needsTarget,
+			holds: func(d *wod.DeviceDetails) bool { return d.TargetState != nil && !d.TargetState.Up }})
+	}
+	switch *power {
+	case "":
+	case wod.PowerUp, wod.PowerOff, wod.PowerBooting:
+		conds = append(conds, powerCondition(*power))
+	default:
+		fmt.Printf("Error: unknown power state %q (use up, off or booting)\n", *power)
+		os.Exit(1)
+	}
+	if len(conds) == 0 {
+		conds = append(conds, waitCondition{name: "is online", holds: func(d *wod.DeviceDetails) bool { return d.Online }})
+	}
+	if *interval <= 0 || *timeout < 0 {
+		fmt.Println("Error: -interval must be positive and -timeout can't be negative")
+		os.Exit(1)
+	}
+
+	names := make([]string, len(conds))
+	for i, c := range conds {
+		names[i] = c.name
+	}
+	want := strings.Join(names, " and ")
+
+	// check reports whether d meets every condition, or why it never will
+	check := func(d *wod.DeviceDetails) (bool, string) {
+		for _, c := range conds {
+			if c.needs != nil {
+				if reason := c.needs(d); reason != "" {
+					return false, reason
+				}
+			}
+		}
+		for _, c := range conds {
+			if !c.holds(d) {
+				return false, ""
+			}
+		}
+		return true, ""
+	}
+	exitImpossible := func(reason string) {
+		fmt.Printf("Error: Can't wait until %s %s: %s\n", espID, want, reason)
+		os.Exit(1)
+	}
+
+	c := cli.apiClient()
+	d, err := c.Info(cli.clientCtx, espID)
+	if err != nil && !errors.Is(err, wod.ErrNotFound) {
+		cli.exitOnClientError(err)
+	}
+	if d != nil {
+		met, reason := check(d)
+		if reason != "" {
+			exitImpossible(reason)
+		}
+		if met {
+			cli.printWaitResult(d, fmt.Sprintf("%s %s", espID, want))
+			return
+		}
+	}
+
+	if cli.outputMode == outputTable {
+		if *timeout > 0 {
+			fmt.Printf("Waiting up to %s until %s %s...\n", *timeout, espID, want)
+		} else {
+			fmt.Printf("Waiting until %s %s...\n", espID, want)
+		}
+	}
+	ctx := cli.clientCtx
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+	started := cli.now()
+	var impossible string
+	d, err = c.WaitForDevice(ctx, espID, *interval, func(d *wod.DeviceDetails) bool {
+		met, reason := check(d)
+		impossible = reason
+		return met || reason != ""
+	})
+	switch {
+	case impossible != "":
+		exitImpossible(impossible)
+	case errors.Is(err, context.DeadlineExceeded):
+		fmt.Printf("Error: Timed out after %s waiting until %s %s (%s)\n", *timeout, espID, want, describeWaitState(d))
+		os.Exit(1)
+	case err != nil:
+		cli.exitOnClientError(err)
+	}
+	cli.printWaitResult(d, fmt.Sprintf("%s %s after %s", espID, want, cli.now().Sub(started).Round(time.Second)))
+}
+
+func (cli *CLI) printWaitResult(d *wod.DeviceDetails, message string) {
+	switch cli.outputMode {
+	case outputJSON:
+		printJSON(d)
+	case outputPlain:
+		printDeviceRecord(d.Device)
+	default:
+		fmt.Println(message)
+	}
+}
@@ -0,0 +1,140 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/smileyfaceskobochka/trashbin-daemon/internal/server"
+)
+
+// --- Client Mode ---
+
+func (cli *CLI) runHooksCommand(args []string) {
+	if len(args) == 0 {
+		args = []string{"runs"}
+	}
+	switch args[0] {
+	case "runs":
+		fs := flag.NewFlagSet("hooks runs", flag.ExitOnError)
+		limit := fs.Int("limit", server.DefaultHookRunPage, "Maximum number of runs")
+		fs.Usage = func() {
+			fmt.Println("Usage: wake-on-demand hooks runs [-limit 20] [esp_id]")
+			fs.PrintDefaults()
+		}
+		fs.Parse(args[1:])
+		q := url.Values{"limit": {strconv.Itoa(*limit)}}
+		if fs.NArg() > 0 {
+			q.Set("esp_id", cli.resolveAlias(fs.Arg(0)))
+		}
+		resp := cli.hookRequest(http.MethodGet, "/hooks/runs?"+q.Encode(), nil)
+		defer resp.Body.Close()
+		var result struct {
+			Runs []server.HookRun `json:"runs"`
+		}
+		json.NewDecoder(resp.Body).Decode(&result)
+		cli.printHookRuns(result.Runs)
+
+	case "run":
+		if len(args) < 2 {
+			fmt.Println("Usage: wake-on-demand hooks run <esp_id>")
+			os.Exit(1)
+		}
+		body, _ := json.Marshal(map[string]string{"id": cli.resolveAlias(args[1])})
+		resp := cli.hookRequest(http.MethodPost, "/hooks/run", body)
+		defer resp.Body.Close()
+		var run server.HookRun
+		json.NewDecoder(resp.Body).Decode(&run)
+		if cli.outputMode == outputTable {
+			fmt.Printf("Wake hooks started for %s; see: wake-on-demand hooks runs %s\n", run.ESPID, run.ESPID)
+			return
+		}
+		cli.printHookRuns([]server.HookRun{run})
+
+	default:
+		fmt.Println(`Usage:
+  wake-on-demand hooks [runs] [-limit 20] [esp_id]
+  wake-on-demand hooks run <esp_id>`)
+		os.Exit(1)
+	}
+}
+
+func (cli *CLI) hookRequest(method, path string, body []byte) *http.Response {
+	req, _ := http.NewRequest(method, cli.serverURL+server.APIPrefix+path, bytes.NewReader(body))
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	cli.setAuthHeader(req)
+
+	resp, err := cli.httpClient.Do(req)
+	if err != nil {
+		cli.exitOnRequestError(err)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusAccepted:
+		return resp
+	case http.StatusUnauthorized:
+		fmt.Println("Error: Unauthorized (check -admin-key)")
+	case http.StatusForbidden:
+		fmt.Println("Error: Wake hooks require the admin role")
+	default:
+		fmt.Printf("Error: %s\n", responseError(resp))
+	}
+	resp.Body.Close()
+	os.Exit(httpExitStatus(resp.StatusCode))
+	return nil
+}
+
+func (cli *CLI) printHookRuns(runs []server.HookRun) {
+	switch cli.outputMode {
+	case outputJSON:
+		printJSON(runs)
+		return
+	case outputPlain:
+		for _, run := range runs {
+			for _, s := range run.Steps {
+				printRecord(run.StartedAt, run.ID, run.ESPID, run.Status, s.Name, s.Status, s.Attempts, s.DurationMS, s.Error)
+			}
+		}
+		return
+	}
+	if len(runs) == 0 {
+		fmt.Println("No wake hook runs")
+		return
+	}
+	for _, run := range runs {
+		fmt.Printf("%s  %s  %s  %s (%s)\n", run.StartedAt.Local().Format(time.DateTime), run.ID, run.ESPID, run.Status, run.Actor)
+		for _, s := range run.Steps {
+			printHookStep(s)
+		}
+	}
+}
+
+// printHookStep prints a step's outcome, and its output when it failed.
+func printHookStep(s server.HookStep) {
+	detail := ""
+	switch s.Status {
+	case "ok", "failed":
+		detail = fmt.Sprintf(" in %s", (time.Duration(s.DurationMS) * time.Millisecond).Round(time.Millisecond))
+		if s.Attempts > 1 {
+			detail += fmt.Sprintf(", %d attempts", s.Attempts)
+		}
+	}
+	if s.Error != "" {
+		detail += ": " + s.Error
+	}
+	fmt.Printf("  %-20s %s%s\n", s.Name, s.Status, detail)
+	if s.Status == "failed" && s.Output != "" {
+		for line := range strings.Lines(s.Output) {
+			fmt.Printf("    | %s\n", strings.TrimRight(line, "\n"))
+		}
+	}
+}
@@ -0,0 +1,385 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/smileyfaceskobochka/trashbin-daemon/internal/server"
+	wod "github.com/smileyfaceskobochka/trashbin-daemon/pkg/client"
+	"golang.org/x/term"
+)
+
+// watch keeps one connection to /ui/events, the stream the dashboard uses,
+// and redraws the device list when the server sends a new snapshot. The
+// server only sends when something changed, so an idle fleet costs a
+// keepalive every 15 seconds. Rows whose state or power changed are
+// highlighted for a while, and the latest changes are listed under the
+// table. When stdout isn't a terminal, or with -o json or plain, it prints
+// one line per change instead.
+
+const (
+	watchIdleTimeout  = 45 * time.Second // three missed keepalives
+	watchRetryMax     = 30 * time.Second
+	watchRecentChange = 8
+)
+
+// watchChange is a device's state or power changing between snapshots.
+type watchChange struct {
+	Time  time.Time `json:"time"`
+	ID    string    `json:"id"`
+	Alias string    `json:"alias,omitempty"`
+	Field string    `json:"field"` // state or power
+	From  string    `json:"from"`
+	To    string    `json:"to"`
+}
+
+type watchModel struct {
+	devices   []wod.Device
+	changed   map[string]time.Time // newest change per device
+	recent    []watchChange        // newest last
+	highlight time.Duration
+	updated   time.Time
+	status    string // why the stream is down, or ""
+	cli       *CLI
+}
+
+func (cli *CLI) runWatch(args []string) {
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	group := fs.String("group", "", "Only members of this group")
+	online := fs.Bool("online", false, "Only online devices")
+	offline := fs.Bool("offline", false, "Only offline devices")
+	prefix := fs.String("prefix", "", "Only devices whose ID or alias starts with this")
+	highlight := fs.Duration("highlight", 10*time.Second, "How long changed devices stay highlighted")
+	fs.Usage = func() {
+		fmt.Println("Usage: wake-on-demand watch [-group <name>] [-online|-offline] [-prefix <p>] [-highlight <d>]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *online && *offline || fs.NArg() > 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	q := url.Values{}
+	for name, value := range map[string]string{"namespace": cli.clientNamespace, "group": strings.TrimPrefix(*group, "@"), "prefix": *prefix} {
+		if value != "" {
+			q.Set(name, value)
+		}
+	}
+	if *online || *offline {
+		q.Set("online", fmt.Sprint(*online))
+	}
+
+	// Fail before taking over the screen if the server is unreachable or
+	// refuses the filters
+	stream, err := cli.openWatchStream(q)
+	if err != nil {
+		cli.exitOnClientError(err)
+	}
+	snapshots := make(chan []wod.Device)
+	status := make(chan string)
+	go stream.run(snapshots, status)
+
+	interactive := cli.outputMode == outputTable && term.IsTerminal(int(os.Stdout.Fd()))
+	if interactive {
+		fmt.Print("\033[?1049h\033[?25l")
+		defer fmt.Print("\033[?25h\033[?1049l")
+	}
+	m := &watchModel{changed: make(map[string]time.Time), highlight: *highlight, cli: cli}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	first := true
+	for {
+		select {
+		case devices := <-snapshots:
+			changes := m.update(devices, first)
+			first = false
+			if !interactive {
+				cli.printWatchChanges(changes)
+				continue
+			}
+		case s := <-status:
+			m.status = s
+			if !interactive {
+				if s == "" {
+					s = "reconnected"
+				}
+				fmt.Fprintln(os.Stderr, "Warning:", s)
+				continue
+			}
+		case <-ticker.C:
+			if !interactive {
+				continue
+			}
+		case <-cli.clientCtx.Done():
+			return
+		}
+		m.draw()
+	}
+}
+
+// update takes a new snapshot and returns what changed since the last one.
+// The first snapshot is the baseline.
+func (m *watchModel) update(devices []wod.Device, first bool) []watchChange {
+	now := m.cli.now()
+	var changes []watchChange
+	if !first {
+		for _, d := range devices {
+			i := slices.IndexFunc(m.devices, func(old wod.Device) bool { return old.ID == d.ID })
+			if i < 0 {
+				changes = append(changes, watchChange{now, d.ID, d.Alias, "state", "new", watchState(d)})
+				continue
+			}
+			old := m.devices[i]
+			if from, to := watchState(old), watchState(d); from != to {
+				changes = append(changes, watchChange{now, d.ID, d.Alias, "state", from, to})
+			}
+			if from, to := devicePower(old), devicePower(d); from != to {
+				changes = append(changes, watchChange{now, d.ID, d.Alias, "power", orDash(from), orDash(to)})
+			}
+		}
+		for _, old := range m.devices {
+			if !slices.ContainsFunc(devices, func(d wod.Device) bool { return d.ID == old.ID }) {
+				changes = append(changes, watchChange{now, old.ID, old.Alias, "state", watchState(old), "removed"})
+			}
+		}
+	}
+	for _, c := range changes {
+		m.changed[c.ID] = c.Time
+	}
+	m.recent = append(m.recent, changes...)
+	if len(m.recent) > watchRecentChange {
+		m.recent = m.recent[len(m.recent)-watchRecentChange:]
+	}
+	m.devices, m.updated = devices, now
+	return changes
+}
+
+// watchState is deviceState, or maintenance for an ESP in maintenance.
+func watchState(d wod.Device) string {
+	state := deviceState(d)
+	if d.Maintenance != nil && (state == "online" || state == "offline") {
+		return "maintenance"
+	}
+	return state
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func (c watchChange) String() string {
+	name := c.ID
+	if c.Alias != "" {
+		name = c.Alias + " (" + c.ID + ")"
+	}
+	return fmt.Sprintf("%s %s %s → %s", name, c.Field, c.From, c.To)
+}
+
+func (cli *CLI) printWatchChanges(changes []watchChange) {
+	for _, c := range changes {
+		switch cli.outputMode {
+		case outputJSON:
+			data, _ := json.Marshal(c)
+			fmt.Println(string(data))
+		case outputPlain:
+			printRecord(c.Time, c.ID, c.Alias, c.Field, c.From, c.To)
+		default:
+			fmt.Println(c.Time.Format(time.TimeOnly), c)
+		}
+	}
+}
+
+func (m *watchModel) draw() {
+	var b strings.Builder
+	line := func(format string, args ...interface{}) {
+		b.WriteString(fmt.Sprintf(format, args...))
+		b.WriteString("\033[K\n")
+	}
+
+	live := "\033[32m● live\033[0m"
+	if m.status != "" {
+		live = "\033[33m● " + m.status + "\033[0m"
+	}
+	b.WriteString("\033[H")
+	line("\033[1mwake-on-demand watch\033[0m  %s  %s  \033[90mupdated %s\033[0m", m.cli.serverURL, live, m.updated.Format(time.TimeOnly))
+	line("")
+	line("  \033[1m%-30s %-12s %-14s %s\033[0m", "DEVICE", "STATE", "POWER", "LAST SEEN")
+	if len(m.devices) == 0 {
+		line("  \033[90mNo devices\033[0m")
+	}
+	for _, d := range m.devices {
+		name := d.ID
+		if d.Alias != "" {
+			name = d.Alias + " (" + d.ID + ")"
+		}
+		state := watchState(d)
+		color := "\033[31m"
+		switch state {
+		case "online":
+			color = "\033[32m"
+		case "wol":
+			color = "\033[36m"
+		case "maintenance":
+			color = "\033[35m"
+		case "conflict", "pending":
+			color = "\033[33m"
+		}
+		power := orDash(devicePower(d))
+		row := fmt.Sprintf("  %-30s %s%-12s\033[0m %s%-14s\033[0m %s", server.Truncate(name, 30), color, state, powerColor(power), power, d.LastSeen)
+		if at, ok := m.changed[d.ID]; ok && m.cli.now().Sub(at) < m.highlight {
+			// Bold on reverse video, kept through the colour resets
+			row = "\033[1;7m" + strings.ReplaceAll(row, "\033[0m", "\033[0m\033[1;7m") + "\033[0m"
+		}
+		line("%s", row)
+	}
+	if len(m.recent) > 0 {
+		line("")
+		line("  \033[1mChanges\033[0m")
+		for _, c := range slices.Backward(m.recent) {
+			line("  \033[90m%s\033[0m  %s", c.Time.Format(time.TimeOnly), c)
+		}
+	}
+	line("")
+	line("\033[90mCtrl-C to quit\033[0m")
+	b.WriteString("\033[J")
+	fmt.Print(b.String())
+}
+
+// watchStream is the connection to /ui/events. It reconnects on its own
+// and resumes with a fresh snapshot.
+type watchStream struct {
+	query  url.Values
+	client *http.Client
+	resp   *http.Response
+	cancel context.CancelFunc
+	idle   *time.Timer
+	cli    *CLI
+}
+
+// openWatchStream connects once. The stream goes without the attempt
+// deadline of other requests; a timer that every line resets ends it when
+// the server goes quiet.
+func (cli *CLI) openWatchStream(q url.Values) (*watchStream, error) {
+	s := &watchStream{query: q, client: &http.Client{Transport: cli.clientTransport}, cli: cli}
+	return s, s.connect()
+}
+
+func (s *watchStream) connect() error {
+	ctx, cancel := context.WithCancel(s.cli.clientCtx)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.cli.serverURL+"/ui/events?"+s.query.Encode(), nil)
+	if err != nil {
+		cancel()
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	s.cli.setAuthHeader(req)
+	idle := time.AfterFunc(watchIdleTimeout, cancel)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		idle.Stop()
+		cancel()
+		if s.cli.interrupted() {
+			return errInterrupted
+		}
+		return fmt.Errorf("%w: %w", wod.ErrUnreachable, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		idle.Stop()
+		cancel()
+		defer resp.Body.Close()
+		return wod.ResponseError(resp)
+	}
+	s.resp, s.cancel, s.idle = resp, cancel, idle
+	return nil
+}
+
+// run reads snapshots until Ctrl-C, reconnecting with backoff when the
+// stream ends. status gets why it is down, and "" once it is back.
+func (s *watchStream) run(snapshots chan<- []wod.Device, status chan<- string) {
+	delay := time.Second
+	for {
+		if s.resp != nil {
+			err := s.read(snapshots)
+			s.idle.Stop()
+			s.cancel()
+			s.resp.Body.Close()
+			s.resp = nil
+			if s.cli.interrupted() {
+				return
+			}
+			status <- "reconnecting: " + watchError(err)
+			delay = time.Second
+		}
+		select {
+		case <-time.After(delay):
+		case <-s.cli.clientCtx.Done():
+			return
+		}
+		if err := s.connect(); err != nil {
+			if s.cli.interrupted() {
+				return
+			}
+			status <- "reconnecting: " + watchError(err)
+			delay = min(delay*2, watchRetryMax)
+			continue
+		}
+		status <- ""
+	}
+}
+
+// read parses server-sent events until the stream ends.
+func (s *watchStream) read(snapshots chan<- []wod.Device) error {
+	scanner := bufio.NewScanner(s.resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	var event, data string
+	for scanner.Scan() {
+		s.idle.Reset(watchIdleTimeout)
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if event == "esps" && data != "" {
+				var snapshot struct {
+					ESPs []wod.Device `json:"esps"`
+				}
+				if err := json.Unmarshal([]byte(data), &snapshot); err != nil {
+					return err
+				}
+				select {
+				case snapshots <- snapshot.ESPs:
+				case <-s.cli.clientCtx.Done():
+					return errInterrupted
+				}
+			}
+			event, data = "", ""
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data += strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return errors.New("stream closed by the server")
+}
+
+func watchError(err error) string {
+	if errors.Is(err, context.Canceled) {
+		return "no data from the server"
+	}
+	return tuiError(err)
+}
@@ -0,0 +1,177 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/smileyfaceskobochka/trashbin-daemon/internal/server"
+)
+
+// --- Client Mode ---
+
+func (cli *CLI) runWebhooksCommand(args []string) {
+	if len(args) == 0 {
+		args = []string{"list"}
+	}
+	switch args[0] {
+	case "list":
+		resp := cli.webhookRequest(http.MethodGet, "/webhooks", nil)
+		defer resp.Body.Close()
+		var result struct {
+			Webhooks []server.WebhookInfo `json:"webhooks"`
+		}
+		json.NewDecoder(resp.Body).Decode(&result)
+		switch cli.outputMode {
+		case outputJSON:
+			printJSON(result.Webhooks)
+			return
+		case outputPlain:
+			for _, h := range result.Webhooks {
+				printRecord(h.Name, h.URL, joinOr(h.Events, "all"), h.Signed, h.Queued)
+			}
+			return
+		}
+		if len(result.Webhooks) == 0 {
+			fmt.Println("No webhooks configured")
+			return
+		}
+		for _, h := range result.Webhooks {
+			signed := "unsigned"
+			if h.Signed {
+				signed = "signed"
+			}
+			fmt.Printf("%s  %s\n", h.Name, h.URL)
+			fmt.Printf("  Events:  %s\n", joinOr(h.Events, "all but poll"))
+			if len(h.Devices) > 0 {
+				fmt.Printf("  Devices: %s\n", strings.Join(h.Devices, ", "))
+			}
+			fmt.Printf("  %s, retries: %d, queued: %d\n", signed, h.Retries, h.Queued)
+		}
+
+	case "deliveries":
+		fs := flag.NewFlagSet("webhooks deliveries", flag.ExitOnError)
+		name := fs.String("webhook", "", "Only deliveries to this webhook")
+		status := fs.String("status", "", "Only deliveries with this status: queued, retrying, ok, failed or dropped")
+		limit := fs.Int("limit", server.DefaultDeliveryPage, "Maximum number of deliveries")
+		fs.Usage = func() {
+			fmt.Println("Usage: wake-on-demand webhooks deliveries [-webhook <name>] [-status <status>] [-limit 50] [esp_id]")
+			fs.PrintDefaults()
+		}
+		fs.Parse(args[1:])
+		q := url.Values{"limit": {strconv.Itoa(*limit)}}
+		if *name != "" {
+			q.Set("webhook", *name)
+		}
+		if *status != "" {
+			q.Set("status", *status)
+		}
+		if fs.NArg() > 0 {
+			q.Set("esp_id", cli.resolveAlias(fs.Arg(0)))
+		}
+		resp := cli.webhookRequest(http.MethodGet, "/webhooks/deliveries?"+q.Encode(), nil)
+		defer resp.Body.Close()
+		var result struct {
+			Deliveries []server.WebhookDelivery `json:"deliveries"`
+		}
+		json.NewDecoder(resp.Body).Decode(&result)
+		cli.printDeliveries(result.Deliveries, "No webhook deliveries")
+
+	case "test":
+		body := []byte("{}")
+		if len(args) > 1 {
+			body, _ = json.Marshal(map[string]string{"webhook": args[1]})
+		}
+		resp := cli.webhookRequest(http.MethodPost, "/webhooks/test", body)
+		defer resp.Body.Close()
+		var result struct {
+			Deliveries []server.WebhookDelivery `json:"deliveries"`
+		}
+		json.NewDecoder(resp.Body).Decode(&result)
+		if cli.outputMode == outputTable {
+			fmt.Println("Test event queued; see: wake-on-demand webhooks deliveries -limit 5")
+		}
+		cli.printDeliveries(result.Deliveries, "")
+
+	default:
+		fmt.Println(`Usage:
+  wake-on-demand webhooks [list]
+  wake-on-demand webhooks deliveries [-webhook <name>] [-status <status>] [-limit 50] [esp_id]
+  wake-on-demand webhooks test [name]`)
+		os.Exit(1)
+	}
+}
+
+func (cli *CLI) printDeliveries(list []server.WebhookDelivery, empty string) {
+	switch cli.outputMode {
+	case outputJSON:
+		printJSON(list)
+		return
+	case outputPlain:
+		for _, d := range list {
+			printRecord(d.CreatedAt, d.ID, d.Webhook, d.Event, d.ESPID, d.Status, d.Attempts, d.HTTPStatus, d.Error)
+		}
+		return
+	}
+	if len(list) == 0 {
+		if empty != "" {
+			fmt.Println(empty)
+		}
+		return
+	}
+	fmt.Printf("%-19s %-16s %-16s %-12s %-16s %-9s %s\n", "TIME", "ID", "WEBHOOK", "EVENT", "ESP", "STATUS", "DETAIL")
+	for _, d := range list {
+		detail := d.Error
+		if d.Status == "ok" {
+			detail = fmt.Sprintf("%d in %dms", d.HTTPStatus, d.DurationMS)
+		}
+		if d.Attempts > 1 {
+			detail = fmt.Sprintf("%s (attempt %d)", detail, d.Attempts)
+		}
+		if d.NextTry != nil {
+			detail += fmt.Sprintf(", next in %s", max((*d.NextTry).Sub(cli.now()), 0).Round(time.Second))
+		}
+		fmt.Printf("%-19s %-16s %-16s %-12s %-16s %-9s %s\n", d.CreatedAt.Local().Format(time.DateTime), d.ID, d.Webhook, d.Event, d.ESPID, d.Status, detail)
+	}
+}
+
+func joinOr(list []string, empty string) string {
+	if len(list) == 0 {
+		return empty
+	}
+	return strings.Join(list, ", ")
+}
+
+func (cli *CLI) webhookRequest(method, path string, body []byte) *http.Response {
+	req, _ := http.NewRequest(method, cli.serverURL+server.APIPrefix+path, bytes.NewReader(body))
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	cli.setAuthHeader(req)
+
+	resp, err := cli.httpClient.Do(req)
+	if err != nil {
+		cli.exitOnRequestError(err)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp
+	case http.StatusUnauthorized:
+		fmt.Println("Error: Unauthorized (check -admin-key)")
+	case http.StatusForbidden:
+		fmt.Println("Error: Webhooks require the admin role")
+	default:
+		fmt.Printf("Error: %s\n", responseError(resp))
+	}
+	resp.Body.Close()
+	os.Exit(httpExitStatus(resp.StatusCode))
+	return nil
+}
@@ -0,0 +1,50 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/smileyfaceskobochka/trashbin-daemon/internal/server"
+)
+
+// --- Client Mode ---
+
+func sendWoL(macStr, broadcast string) {
+	if err := server.SendMagicPacket(macStr, broadcast); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Magic packet sent to %s via %s\n", macStr, server.NormalizeBroadcast(broadcast))
+}
+
+func (cli *CLI) addWoLDevice(id, macStr, broadcast string) {
+	jsonData, _ := json.Marshal(map[string]string{
+		"id":        id,
+		"mac":       macStr,
+		"broadcast": broadcast,
+	})
+
+	req, _ := http.NewRequest(http.MethodPost, cli.serverURL+server.APIPrefix+"/wol-devices", bytes.NewBuffer(jsonData))
+	req.Header.Set("Content-Type", "application/json")
+	cli.setAuthHeader(req)
+
+	resp, err := cli.httpClient.Do(req)
+	if err != nil {
+		cli.exitOnRequestError(err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		fmt.Printf("WoL device '%s' added (%s)\n", id, macStr)
+	case http.StatusUnauthorized:
+		fmt.Println("Error: Unauthorized (check -admin-key)")
+		os.Exit(exitUnauthorized)
+	default:
+		fmt.Printf("Error: %s\n", responseError(resp))
+		os.Exit(httpExitStatus(resp.StatusCode))
+	}
+}
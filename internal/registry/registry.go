@@ -0,0 +1,141 @@
+// Package registry persists the server's device records so they survive
+// restarts. It is generic over the record type, which the server defines;
+// the store only needs a record's ID, from the key function it is given.
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// FormatVersion is written to every snapshot.
+const FormatVersion = 1
+
+// Store loads and saves the full set of records, keyed by ID.
+type Store[T any] interface {
+	Load() (map[string]T, error)
+	Save(records map[string]T) error
+}
+
+// Memory keeps nothing: Load always returns an empty set.
+type Memory[T any] struct{}
+
+func (Memory[T]) Load() (map[string]T, error) {
+	return make(map[string]T), nil
+}
+
+func (Memory[T]) Save(map[string]T) error {
+	return nil
+}
+
+// Snapshot is the persisted form of the records, shared by the file store
+// and other stores that embed it in their own state.
+type Snapshot[T any] struct {
+	Version int    `json:"version"`
+	SavedAt string `json:"saved_at"`
+	ESPs    []T    `json:"esps"`
+}
+
+// NewSnapshot captures records as of now.
+func NewSnapshot[T any](records map[string]T, now time.Time) Snapshot[T] {
+	s := Snapshot[T]{
+		Version: FormatVersion,
+		SavedAt: now.Format(time.RFC3339),
+		ESPs:    make([]T, 0, len(records)),
+	}
+	for _, r := range records {
+		s.ESPs = append(s.ESPs, r)
+	}
+	return s
+}
+
+// Records indexes the snapshot by key, dropping records without one.
+func (s Snapshot[T]) Records(key func(T) string) map[string]T {
+	records := make(map[string]T, len(s.ESPs))
+	for _, r := range s.ESPs {
+		if id := key(r); id != "" {
+			records[id] = r
+		}
+	}
+	return records
+}
+
+// File stores a snapshot as indented JSON, replaced atomically on save.
+type File[T any] struct {
+	path string
+	key  func(T) string
+	now  func() time.Time
+}
+
+type FileOption func(*fileOptions)
+
+type fileOptions struct {
+	now func() time.Time
+}
+
+// WithClock sets the clock used for SavedAt.
+func WithClock(now func() time.Time) FileOption {
+	return func(o *fileOptions) { o.now = now }
+}
+
+// NewFile returns a store at path. key returns a record's ID, or "" for
+// records that should be skipped.
+func NewFile[T any](path string, key func(T) string, opts ...FileOption) *File[T] {
+	o := fileOptions{now: time.Now}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return &File[T]{path: path, key: key, now: o.now}
+}
+
+// Load returns no records when the file doesn't exist yet.
+func (f *File[T]) Load() (map[string]T, error) {
+	data, err := os.ReadFile(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return make(map[string]T), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var s Snapshot[T]
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", f.path, err)
+	}
+	return s.Records(f.key), nil
+}
+
+func (f *File[T]) Save(records map[string]T) error {
+	data, err := json.MarshalIndent(NewSnapshot(records, f.now()), "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(f.path, data)
+}
+
+// WriteFileAtomic writes to a temp file and renames it so a crash never
+// leaves a truncated file behind.
+func WriteFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,87 @@
+package registry
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type record struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+func recordKey(r record) string { return r.ID }
+
+func TestFileRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registry.json")
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	f := NewFile(path, recordKey, WithClock(func() time.Time { return now }))
+
+	records := map[string]record{"a": {ID: "a", Name: "nas"}, "b": {ID: "b", Name: "desk"}}
+	if err := f.Save(records); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s Snapshot[record]
+	if err := json.Unmarshal(data, &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Version != FormatVersion || s.SavedAt != "2026-03-01T12:00:00Z" {
+		t.Errorf("snapshot version %d saved at %q, want %d at 2026-03-01T12:00:00Z", s.Version, s.SavedAt, FormatVersion)
+	}
+
+	loaded, err := f.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded) != len(records) {
+		t.Fatalf("loaded %d records, want %d", len(loaded), len(records))
+	}
+	for id, want := range records {
+		if loaded[id] != want {
+			t.Errorf("record %q = %+v, want %+v", id, loaded[id], want)
+		}
+	}
+}
+
+func TestFileLoadMissing(t *testing.T) {
+	f := NewFile(filepath.Join(t.TempDir(), "none.json"), recordKey)
+	records, err := f.Load()
+	if err != nil || len(records) != 0 {
+		t.Errorf("Load = %v, %v, want no records", records, err)
+	}
+}
+
+func TestFileLoadInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registry.json")
+	os.WriteFile(path, []byte("{"), 0o644)
+	if _, err := NewFile(path, recordKey).Load(); err == nil {
+		t.Error("Load of a truncated file = nil, want an error")
+	}
+}
+
+func TestRecordsSkipsEmptyKeys(t *testing.T) {
+	s := NewSnapshot(map[string]record{"a": {ID: "a"}, "": {}}, time.Now())
+	records := s.Records(recordKey)
+	if len(records) != 1 || records["a"].ID != "a" {
+		t.Errorf("Records = %v, want only a", records)
+	}
+}
+
+func TestMemory(t *testing.T) {
+	var m Memory[record]
+	if err := m.Save(map[string]record{"a": {ID: "a"}}); err != nil {
+		t.Fatal(err)
+	}
+	records, err := m.Load()
+	if err != nil || len(records) != 0 {
+		t.Errorf("Load = %v, %v, want no records", records, err)
+	}
+}
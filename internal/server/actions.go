@@ -0,0 +1,74 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// Custom actions are extra things a device can do besides pressing the
+// power button, such as a reset line or a KVM switch on another GPIO. The
+// firmware declares them by name when it registers and receives
+// {"command": "action", "action": "<name>"} when one is invoked.
+
+// CommandAction runs one of the device's declared custom actions.
+const CommandAction ESPCommand = "action"
+
+const maxCustomActions = 16
+
+var actionNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+// CustomAction is a named action a device declared at registration.
+type CustomAction struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+}
+
+func ValidateActions(actions []CustomAction) error {
+	if len(actions) > maxCustomActions {
+		return fmt.Errorf("at most %d actions can be declared, got %d", maxCustomActions, len(actions))
+	}
+	seen := make(map[string]bool)
+	for _, a := range actions {
+		if !actionNamePattern.MatchString(a.Name) {
+			return fmt.Errorf("invalid action name %q (lowercase letters, digits, '-' and '_', up to 32)", a.Name)
+		}
+		if seen[a.Name] {
+			return fmt.Errorf("action %q declared twice", a.Name)
+		}
+		seen[a.Name] = true
+	}
+	return nil
+}
+
+func (e *ESP) hasAction(name string) bool {
+	for _, a := range e.Actions {
+		if a.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAction rejects an action the device can't run. Must be called with
+// mu held.
+func checkAction(esp *ESP, cmd ESPCommand, opts commandOptions) error {
+	if cmd != CommandAction {
+		if opts.Action != "" {
+			return fmt.Errorf("%w: an action name only applies to the action command", errUnsupportedCommand)
+		}
+		return nil
+	}
+	if opts.Action == "" {
+		return fmt.Errorf("%w: missing action name", errUnsupportedCommand)
+	}
+	if esp.isWoL() || esp.isDriver() {
+		return fmt.Errorf("%w: %s device '%s' has no custom actions", errUnsupportedCommand, esp.deviceType(), esp.ID)
+	}
+	if !esp.supports(featureActions) {
+		return featureError(esp, "custom actions")
+	}
+	if !esp.hasAction(opts.Action) {
+		return fmt.Errorf("%w: '%s' has no action '%s'", errUnsupportedCommand, esp.ID, opts.Action)
+	}
+	return nil
+}
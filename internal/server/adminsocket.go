@@ -0,0 +1,51 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+)
+
+// With -admin-socket the control API is only served on a unix socket, so
+// local tooling can manage the server while the TCP listeners answer ESPs
+// and health probes only. The socket's file permissions are its
+// authentication: requests over it act as the admin.
+
+// adminsocketState holds the Server state kept in adminsocket.go.
+type adminsocketState struct {
+	// adminSocket is the path of the admin socket, empty when disabled.
+	adminSocket string
+}
+
+// adminSocketMode lets root and the socket's group in.
+const adminSocketMode = 0o660
+
+type adminConnKey struct{}
+
+// tagAdminConn is the http.Server ConnContext hook marking connections
+// accepted on the admin socket.
+func (srv *Server) tagAdminConn(ctx context.Context, c net.Conn) context.Context {
+	if srv.adminSocket != "" && c.LocalAddr().Network() == "unix" && c.LocalAddr().String() == srv.adminSocket {
+		return context.WithValue(ctx, adminConnKey{}, true)
+	}
+	return ctx
+}
+
+func fromAdminSocket(r *http.Request) bool {
+	admin, _ := r.Context().Value(adminConnKey{}).(bool)
+	return admin
+}
+
+// listenAdminSocket opens the admin socket.
+func (srv *Server) listenAdminSocket() (net.Listener, error) {
+	lns, err := listenAll([]listenAddr{{network: "unix", address: srv.adminSocket}})
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(srv.adminSocket, adminSocketMode); err != nil {
+		lns[0].Close()
+		return nil, err
+	}
+	return lns[0], nil
+}
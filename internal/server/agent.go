@@ -0,0 +1,123 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// CommandSoftOff asks the agent on the target machine to shut the OS down.
+const CommandSoftOff ESPCommand = "soft-off"
+
+// AgentState tracks the agent running on a device's target machine; it is
+// not persisted.
+type AgentState struct {
+	Host     string         `json:"host"`
+	Hostname string         `json:"hostname,omitempty"`
+	OS       string         `json:"os,omitempty"`
+	LastSeen time.Time      `json:"last_seen"`
+	Activity *AgentActivity `json:"activity,omitempty"`
+	Pending  *CommandRecord `json:"-"`
+}
+
+// agentOnline must be called with mu held.
+func (e *ESP) agentOnline(srv *Server) bool {
+	return e.Agent != nil && srv.now().Sub(e.Agent.LastSeen) < srv.timeoutDuration
+}
+
+// dispatchSoftOff hands soft-off to the agent. When no agent has checked in
+// recently, it logs in over SSH if the device has ssh: settings, and
+// devices with a power button get a forced shutdown otherwise.
+// Must be called with mu held.
+func (srv *Server) dispatchSoftOff(esp *ESP, opts commandOptions, actor string) (dispatchResult, error) {
+	if esp.agentOnline(srv) {
+		status := "duplicate"
+		if opts.DryRun {
+			status = statusDryRun
+		}
+		if rec := esp.Agent.Pending; rec != nil && !rec.finished() {
+			return dispatchResult{Record: rec, Status: status, Delivery: "agent"}, nil
+		}
+		if opts.DryRun {
+			return dispatchResult{Status: statusDryRun, Delivery: "agent"}, nil
+		}
+		rec := srv.newCommandRecord(esp.ID, CommandSoftOff)
+		rec.setTTL(opts.ttl(srv))
+		esp.Agent.Pending = rec
+		srv.recordEvent(Event{Type: EventCommand, ESPID: esp.ID, Actor: actor, Command: CommandSoftOff, CommandID: rec.ID, Detail: "agent"})
+		return dispatchResult{Record: rec, Status: "queued", Delivery: "agent"}, nil
+	}
+
+	if s, ok := srv.sshSettings(esp.ID); ok {
+		return srv.dispatchSSH(esp, s, opts, actor)
+	}
+	if esp.isWoL() {
+		return dispatchResult{}, fmt.Errorf("%w: no agent online for WoL device '%s'", errESPOffline, esp.ID)
+	}
+	// A BMC can ask the OS to shut down itself
+	if drv := srv.driverFor(esp); drv.Supports(CommandSoftOff) {
+		return drv.Send(esp, CommandSoftOff, 0, opts, actor)
+	}
+	if !opts.DryRun {
+		srv.logger("agent").Warn("Agent unreachable, falling back to force shutdown", "esp_id", esp.ID)
+	}
+	result, err := srv.dispatch(esp, CommandForce, opts, actor)
+	result.Fallback = true
+	return result, err
+}
+
+// agentHandler is polled by the agent. Each poll is a heartbeat and returns
+// the pending soft-off, if any.
+func (srv *Server) agentHandler(w http.ResponseWriter, r *http.Request) {
+	rlog := srv.requestLogger(r)
+
+	if r.Method != http.MethodGet {
+		writeError(w, CodeMethodNotAllowed, "only GET allowed")
+		return
+	}
+
+	q := r.URL.Query()
+	id := espID(r)
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	esp, exists := srv.espMap[id]
+	if !exists {
+		rlog.Warn("Agent for unregistered device", "esp_id", id)
+		writeError(w, CodeESPNotFound, "ESP not registered")
+		return
+	}
+
+	if !esp.agentOnline(srv) {
+		rlog.Info("Agent online", "esp_id", id, "hostname", q.Get("hostname"))
+		srv.recordEvent(Event{Type: EventOnline, ESPID: id, Actor: srv.requestActor(r), Detail: "agent"})
+	}
+	if esp.Agent == nil {
+		esp.Agent = &AgentState{}
+	}
+	esp.Agent.Host = srv.remoteHost(r)
+	esp.Agent.Hostname = q.Get("hostname")
+	esp.Agent.OS = q.Get("os")
+	esp.Agent.Activity = srv.activityFromQuery(q)
+	esp.Agent.LastSeen = srv.now()
+
+	resp := map[string]interface{}{"command": ""}
+	srv.expireQueue(esp)
+	if rec := esp.Agent.Pending; rec != nil {
+		esp.Agent.Pending = nil
+		if !rec.finished() {
+			srv.markDelivered(rec)
+			rlog.Info("Soft-off sent to agent", "esp_id", id, "command_id", rec.ID)
+			resp = rec.payload(srv)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+type AgentCommand struct {
+	Command   string `json:"command"`
+	CommandID string `json:"command_id"`
+}
@@ -0,0 +1,866 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const APIPrefix = "/api/v1"
+
+// apiState holds the Server state kept in api.go.
+type apiState struct {
+	router *http.ServeMux
+}
+
+// apiRoute is one endpoint of the versioned API. It is served under
+// apiPrefix with method patterns, and at its bare path as a legacy alias
+// for firmware and scripts written against the flat endpoints.
+type apiRoute struct {
+	path    string
+	scope   authScope
+	handler http.HandlerFunc
+	ops     []apiOp
+}
+
+// apiOp documents one method of a route for the OpenAPI spec. Body and
+// response are zero values whose types the schemas are generated from;
+// apiBinary and apiText stand for non-JSON payloads. A non-zero scope
+// overrides the route's for this method.
+type apiOp struct {
+	method   string
+	summary  string
+	query    []apiParam
+	headers  []apiParam
+	body     interface{}
+	response interface{}
+	status   int
+	scope    authScope
+}
+
+func (rt apiRoute) opScope(op apiOp) authScope {
+	if op.scope != scopePublic {
+		return op.scope
+	}
+	return rt.scope
+}
+
+type apiParam struct {
+	name     string
+	desc     string
+	required bool
+}
+
+type (
+	apiBinary []byte
+	apiText   string
+	// apiEventStream is a text/event-stream whose events carry data as JSON
+	apiEventStream struct{ data interface{} }
+)
+
+type statusResponse struct {
+	Status string `json:"status"`
+	ID     string `json:"id,omitempty"`
+}
+
+var (
+	espIDParam   = apiParam{"id", "ESP ID or alias", true}
+	modelParam   = apiParam{"model", "Hardware model", true}
+	versionParam = apiParam{"version", "Firmware version", true}
+)
+
+func (srv *Server) apiRoutes() []apiRoute {
+	acl := struct {
+		Name  string `json:"name"`
+		ESPID string `json:"esp_id"`
+	}{}
+	member := acl
+
+	return []apiRoute{
+		{"/register", scopeESP, srv.registerHandler, []apiOp{
+			{method: http.MethodPost, summary: "Register an ESP or refresh its registration",
+				body: struct {
+					ID       string         `json:"id"`
+					Power    string         `json:"power,omitempty"`
+					Instance string         `json:"instance,omitempty"`
+					Actions  []CustomAction `json:"actions,omitempty"`
+					// Protocol version and features the firmware speaks; without them it is taken to speak protocol 1
+					Protocol int      `json:"protocol,omitempty"`
+					Features []string `json:"features,omitempty"`
+					Telemetry
+				}{}, response: struct {
+					// registered, or pending (202) while the device waits for approval
+					Status      string `json:"status"`
+					Pairing     string `json:"pairing,omitempty"`
+					PairingCode string `json:"pairing_code,omitempty"`
+					// What was negotiated: the protocol version and features both sides use
+					Protocol   int      `json:"protocol"`
+					Features   []string `json:"features"`
+					BeaconPort int      `json:"beacon_port,omitempty"`
+				}{}},
+		}},
+		{"/command", scopeESP, srv.commandHandler, []apiOp{
+			{method: http.MethodGet, summary: "Poll for the next queued command",
+				query: []apiParam{
+					{"id", "ESP ID", true},
+					{"fw", "Firmware version", false},
+					{"model", "Hardware model", false},
+					{"rssi", "WiFi RSSI in dBm", false},
+					{"heap", "Free heap in bytes", false},
+					{"temp", "Chip temperature in °C", false},
+					{"uptime", "Uptime in seconds", false},
+					{"power", "Power sensor reading of the target (on or off)", false},
+					{"instance", "Token the firmware picked at boot, to detect duplicate IDs", false},
+					{"wait", "Hold the request until a command is queued, up to this long (e.g. 25s, max 60s)", false},
+				},
+				response: struct {
+					Command    string                 `json:"command"`
+					CommandID  string                 `json:"command_id,omitempty"`
+					DurationMS int                    `json:"duration_ms,omitempty"`
+					Pending    int                    `json:"pending,omitempty"`
+					OTA        map[string]interface{} `json:"ota,omitempty"`
+					// How long to wait before the next poll; 0 while more
+					// commands wait
+					NextPollMS int64 `json:"next_poll_ms"`
+					// Set while the device waits for approval
+					Pairing     string `json:"pairing,omitempty"`
+					PairingCode string `json:"pairing_code,omitempty"`
+				}{}},
+		}},
+		{"/ws", scopeESP, srv.wsHandler, []apiOp{
+			{method: http.MethodGet, summary: "Open the WebSocket push channel", query: []apiParam{{"id", "ESP ID", true}, {"instance", "Token the firmware picked at boot", false}}, status: http.StatusSwitchingProtocols},
+		}},
+		{"/command-ack", scopeESP, srv.commandAckHandler, []apiOp{
+			{method: http.MethodPost, summary: "Report the outcome of a delivered command", body: CommandReport{}, response: statusResponse{}},
+		}},
+		{"/command-result", scopeUser, srv.commandResultHandler, []apiOp{
+			{method: http.MethodGet, summary: "Get the delivery status of a command", query: []apiParam{{"id", "Command ID", true}}, response: CommandRecord{}},
+			{method: http.MethodPost, summary: "Report the outcome of a delivered command with a result payload", body: CommandReport{}, response: statusResponse{}, scope: scopeESP},
+		}},
+		{"/queue", scopeAdmin, srv.queueHandler, []apiOp{
+			{method: http.MethodGet, summary: "List commands waiting for an ESP", query: []apiParam{espIDParam},
+				response: struct {
+					ID       string          `json:"id"`
+					Depth    int             `json:"depth"`
+					MaxDepth int             `json:"max_depth"`
+					Commands []CommandRecord `json:"commands"`
+				}{}},
+			{method: http.MethodDelete, summary: "Drop all commands waiting for an ESP", query: []apiParam{espIDParam},
+				response: struct {
+					Status  string `json:"status"`
+					ID      string `json:"id"`
+					Dropped int    `json:"dropped"`
+				}{}},
+		}},
+		{"/schedules", scopeAdmin, srv.schedulesHandler, []apiOp{
+			{method: http.MethodGet, summary: "List schedules", response: struct {
+				Schedules []scheduleInfo `json:"schedules"`
+			}{}},
+			{method: http.MethodPost, summary: "Create a schedule",
+				body: struct {
+					ESPID  string `json:"esp_id"`
+					Cron   string `json:"cron"`
+					Action string `json:"action"`
+				}{}, response: Schedule{}},
+			{method: http.MethodDelete, summary: "Delete a schedule", query: []apiParam{{"id", "Schedule ID", true}}, response: statusResponse{}},
+		}},
+		{"/set-command", scopeUser, srv.withIdempotency(srv.setCommandHandler), []apiOp{
+			{method: http.MethodPost, summary: "Send a command to a device, or to every member of a group when id is @name (the response then has group, command, failed and per-member results)",
+				headers: []apiParam{{IdempotencyHeader, "Repeats with this key and the same body get the first response instead of sending again", false}},
+				body: struct {
+					ID         string `json:"id"`
+					Command    string `json:"command"`
+					DurationMS int    `json:"duration_ms,omitempty"`
+					Force      bool   `json:"force,omitempty"`
+					TTLMS      int    `json:"ttl_ms,omitempty"`
+					// Queue for an offline ESP's next poll instead of a 503
+					QueueIfOffline bool `json:"queue_if_offline,omitempty"`
+					// Queue on or off sent during the device's cooldown until it is over instead of a 429
+					AfterCooldown bool `json:"after_cooldown,omitempty"`
+					// Custom action to run, with command "action"
+					Action string `json:"action,omitempty"`
+					// Allow force for a protected device instead of a 403
+					Override bool `json:"override,omitempty"`
+					// Make the checks and report the delivery without sending; status is then "dry-run"
+					DryRun bool `json:"dry_run,omitempty"`
+					// low, normal (default) or urgent; urgent skips the device's rate limit and may displace a lower command from a full queue
+					Priority string `json:"priority,omitempty"`
+				}{},
+				response: struct {
+					Status     string `json:"status"`
+					ID         string `json:"id"`
+					Command    string `json:"command"`
+					Action     string `json:"action,omitempty"`
+					CommandID  string `json:"command_id"`
+					DurationMS int    `json:"duration_ms"`
+					Delivery   string `json:"delivery"`
+					Fallback   bool   `json:"fallback"`
+					Offline    bool   `json:"offline"`
+					QueueDepth int    `json:"queue_depth"`
+				}{}},
+		}},
+		{"/list", scopeUser, srv.listHandler, []apiOp{
+			{method: http.MethodGet, summary: "List devices, filtered, sorted and paged",
+				query: []apiParam{
+					{"namespace", "Only devices in this namespace", false},
+					{"online", "Only online (true) or offline (false) devices", false},
+					{"pending", "Only devices waiting for approval (true)", false},
+					{"group", "Only members of this group", false},
+					{"prefix", "Only devices whose ID or alias starts with this, ignoring case", false},
+					{"sort", "id (default), name or last_seen; prefix with - for descending", false},
+					{"limit", "Maximum number of devices (default: all, max 1000)", false},
+					{"cursor", "next_cursor from the previous page", false},
+				},
+				response: struct {
+					ESPs []ESPInfo `json:"esps"`
+					// How many devices matched, across all pages
+					Total      int    `json:"total"`
+					NextCursor string `json:"next_cursor,omitempty"`
+				}{}},
+		}},
+		{"/info", scopeUser, srv.infoHandler, []apiOp{
+			{method: http.MethodGet, summary: "Get device details", query: []apiParam{espIDParam}, response: deviceDetails{}},
+		}},
+		{"/users", scopeAdmin, srv.usersHandler, []apiOp{
+			{method: http.MethodGet, summary: "List users", response: struct {
+				Users []UserInfo `json:"users"`
+			}{}},
+			{method: http.MethodPost, summary: "Create a user and return its token",
+				body: struct {
+					Name string `json:"name"`
+					Role Role   `json:"role"`
+					// Limit the user to the devices of this namespace
+					Namespace string `json:"namespace,omitempty"`
+				}{},
+				response: struct {
+					Name      string `json:"name"`
+					Role      Role   `json:"role"`
+					Namespace string `json:"namespace"`
+					Token     string `json:"token"`
+				}{}},
+			{method: http.MethodDelete, summary: "Delete a user", query: []apiParam{{"name", "User name", true}}, response: statusResponse{}},
+		}},
+		{"/users/acl", scopeAdmin, srv.userACLHandler, []apiOp{
+			{method: http.MethodPost, summary: "Grant a user access to an ESP", body: acl, response: UserInfo{}},
+			{method: http.MethodDelete, summary: "Revoke a user's access to an ESP", body: acl, response: UserInfo{}},
+		}},
+		{"/users/password", scopeAdmin, srv.userPasswordHandler, []apiOp{
+			{method: http.MethodPost, summary: "Set a user's dashboard password",
+				body: struct {
+					Name     string `json:"name"`
+					Password string `json:"password"`
+				}{}, response: statusResponse{}},
+			{method: http.MethodDelete, summary: "Clear a user's dashboard password", query: []apiParam{{"name", "User name", true}}, response: statusResponse{}},
+		}},
+		{"/secrets", scopeAdmin, srv.secretsHandler, []apiOp{
+			{method: http.MethodGet, summary: "List the ESPs that have a device secret", response: struct {
+				Secrets []DeviceSecretInfo `json:"secrets"`
+			}{}},
+			{method: http.MethodPost, summary: "Issue a device secret for signed requests, replacing any old one",
+				body: struct {
+					ID string `json:"id"`
+				}{},
+				response: struct {
+					ID       string `json:"id"`
+					Secret   string `json:"secret"`
+					Replaced bool   `json:"replaced"`
+				}{}, status: http.StatusCreated},
+			{method: http.MethodDelete, summary: "Revoke an ESP's device secret", query: []apiParam{espIDParam}, response: statusResponse{}},
+		}},
+		{"/groups", scopeAdmin, srv.groupsHandler, []apiOp{
+			{method: http.MethodGet, summary: "List groups", response: struct {
+				Groups []Group `json:"groups"`
+			}{}},
+			{method: http.MethodPost, summary: "Create a group",
+				body: struct {
+					Name    string   `json:"name"`
+					Members []string `json:"members,omitempty"`
+				}{}, response: Group{}, status: http.StatusCreated},
+			{method: http.MethodDelete, summary: "Delete a group", query: []apiParam{{"name", "Group name", true}}, response: statusResponse{}},
+		}},
+		{"/groups/members", scopeAdmin, srv.groupMembersHandler, []apiOp{
+			{method: http.MethodPost, summary: "Add an ESP to a group", body: member, response: Group{}},
+			{method: http.MethodDelete, summary: "Remove an ESP from a group", body: member, response: Group{}},
+		}},
+		{"/esps/{id}", scopeAdmin, srv.deviceHandler, []apiOp{
+			{method: http.MethodPatch, summary: "Set a device's alias, description, location, hostname or protection from force-off; omitted fields are kept, empty strings clear them",
+				query: []apiParam{espIDParam}, body: metadataUpdate{}, response: deviceDetails{}},
+			{method: http.MethodDelete, summary: "Remove a device from the registry, dropping its queued commands and group memberships",
+				query: []apiParam{espIDParam}, response: statusResponse{}},
+		}},
+		{"/esps/{id}/commands", scopeUser, srv.historyHandler, []apiOp{
+			{method: http.MethodGet, summary: "List a device's most recent commands, newest first",
+				query:    []apiParam{espIDParam, {"limit", "Maximum number of commands (default and most kept: 50)", false}},
+				response: commandHistory{}},
+		}},
+		{"/esps/{id}/uptime", scopeUser, srv.uptimeHandler, []apiOp{
+			{method: http.MethodGet, summary: "Uptime of a device's target per day or week, from its probed up/down changes",
+				query: []apiParam{espIDParam,
+					{"since", "Start of the report: days (30d), a duration or a date (default: 30d, at most 400 days back)", false},
+					{"bucket", "day or week (default: day)", false},
+					{"format", "json or csv (default: json)", false}},
+				response: uptimeReport{}},
+		}},
+		{"/esps/{id}/telemetry", scopeUser, srv.telemetryHandler, []apiOp{
+			{method: http.MethodGet, summary: "A device's reported RSSI, chip temperature, free heap and battery voltage over time, for graphs",
+				query: []apiParam{espIDParam,
+					{"metric", "Comma-separated rssi, chip_temp, free_heap or battery_v (default: all)", false},
+					{"since", "Start: a duration, days (7d) or a date (default: 24h, at most the retention)", false},
+					{"step", "Average the samples over steps of this duration, e.g. 5m (default: raw samples, or a step that keeps a series under 2000 points)", false}},
+				response: telemetryReport{}},
+		}},
+		{"/pin", scopeAdmin, srv.pinHandler, []apiOp{
+			{method: http.MethodDelete, summary: "Reset an ESP's pinned source address",
+				query: []apiParam{{"id", "ESP ID or alias", true}}, response: statusResponse{}},
+		}},
+		{"/wol-devices", scopeAdmin, srv.wolDeviceHandler, []apiOp{
+			{method: http.MethodPost, summary: "Register a Wake-on-LAN device",
+				body: struct {
+					ID        string `json:"id"`
+					MAC       string `json:"mac"`
+					Broadcast string `json:"broadcast,omitempty"`
+				}{}, response: statusResponse{}},
+		}},
+		{"/driver-devices", scopeAdmin, srv.driverDeviceHandler, []apiOp{
+			{method: http.MethodPost, summary: "Register a smart plug or BMC the server controls itself", body: driverDeviceRequest{}, response: statusResponse{}},
+		}},
+		{"/target", scopeAdmin, srv.targetHandler, []apiOp{
+			{method: http.MethodPost, summary: "Set the host an ESP controls",
+				body: struct {
+					ID string `json:"id"`
+					Target
+				}{}, response: statusResponse{}},
+			{method: http.MethodDelete, summary: "Stop probing an ESP's target",
+				body: struct {
+					ID string `json:"id"`
+				}{}, response: statusResponse{}},
+		}},
+		{"/pulse", scopeAdmin, srv.pulseHandler, []apiOp{
+			{method: http.MethodPost, summary: "Set an ESP's default pulse lengths",
+				body: struct {
+					ID      string `json:"id"`
+					PulseMS int    `json:"pulse_ms"`
+					ForceMS int    `json:"force_ms"`
+				}{}, response: statusResponse{}},
+		}},
+		{"/timeout", scopeAdmin, srv.timeoutHandler, []apiOp{
+			{method: http.MethodPost, summary: "Set an ESP's offline timeout, or 0 for the adaptive one",
+				body: struct {
+					ID        string `json:"id"`
+					TimeoutMS int64  `json:"timeout_ms"`
+				}{}, response: struct {
+					Status  string      `json:"status"`
+					ID      string      `json:"id"`
+					Timeout TimeoutInfo `json:"timeout"`
+				}{}},
+		}},
+		{"/maintenance", scopeAdmin, srv.maintenanceHandler, []apiOp{
+			{method: http.MethodPost, summary: "Put a device in maintenance, refusing every command but status (423) until it ends, or take it out",
+				body: struct {
+					ID      string `json:"id"`
+					Enabled bool   `json:"enabled"`
+					// How long until maintenance ends by itself; 0 lasts until turned off
+					DurationMS int64  `json:"duration_ms,omitempty"`
+					Reason     string `json:"reason,omitempty"`
+				}{}, response: struct {
+					Status      string       `json:"status"`
+					ID          string       `json:"id"`
+					Maintenance *Maintenance `json:"maintenance"`
+				}{}},
+		}},
+		{"/approve", scopeAdmin, srv.approveHandler, []apiOp{
+			{method: http.MethodPost, summary: "Approve a device waiting for pairing, so it receives commands",
+				body: struct {
+					ID string `json:"id"`
+					// The code the device printed; needed with -pairing code, checked whenever given
+					Code string `json:"code,omitempty"`
+				}{}, response: struct {
+					Status string `json:"status"`
+					ID     string `json:"id"`
+				}{}},
+		}},
+		{"/agent", scopeESP, srv.agentHandler, []apiOp{
+			{method: http.MethodGet, summary: "Agent check-in, returns a pending soft-off",
+				query: []apiParam{{"id", "ESP ID", true}, {"hostname", "Target hostname", false}, {"os", "Target OS", false},
+					{"cpu", "CPU usage in percent since the last check-in", false}, {"load", "1-minute load average", false}, {"ssh", "Established SSH sessions", false}},
+				response: AgentCommand{}},
+		}},
+		{"/health", scopePublic, srv.healthHandler, []apiOp{
+			{method: http.MethodGet, summary: "Server health and device counts", response: struct {
+				Status  string         `json:"status"`
+				Version string         `json:"version"`
+				ESPs    map[string]int `json:"esps"`
+			}{}},
+		}},
+		{"/healthz", scopePublic, healthzHandler, []apiOp{
+			{method: http.MethodGet, summary: "Liveness probe", response: statusResponse{}},
+		}},
+		{"/readyz", scopePublic, srv.readyzHandler, []apiOp{
+			{method: http.MethodGet, summary: "Readiness probe, 503 until the registry is loaded and during shutdown",
+				response: statusResponse{}},
+		}},
+		{"/public/status", scopePublic, srv.publicStatusHandler, []apiOp{
+			{method: http.MethodGet, summary: "Device names and states for the status page (404 when it is disabled)", response: publicStatus{}},
+		}},
+		{"/ups", scopeUser, srv.upsHandler, []apiOp{
+			{method: http.MethodGet, summary: "Show the UPS the server follows and its last reading (404 when none is configured)", response: UPSInfo{}},
+		}},
+		{"/metrics", scopeAdmin, srv.metricsHandler, []apiOp{
+			{method: http.MethodGet, summary: "Prometheus metrics", response: apiText("")},
+		}},
+		{"/events", scopeUser, srv.eventsHandler, []apiOp{
+			{method: http.MethodGet, summary: "Read the audit log, newest first",
+				query: []apiParam{
+					{"esp_id", "Only events for this ESP", false},
+					{"since", "Only events newer than this duration", false},
+					{"type", "Comma-separated event types", false},
+					{"limit", "Maximum number of events", false},
+					{"cursor", "next_cursor from the previous page", false},
+				},
+				response: struct {
+					Events     []Event `json:"events"`
+					NextCursor string  `json:"next_cursor,omitempty"`
+				}{}},
+		}},
+		{"/events/stream", scopeUser, srv.eventStreamHandler, []apiOp{
+			{method: http.MethodGet, summary: "Server-sent events for registrations, online/offline changes and command delivery; resumes after Last-Event-ID",
+				query: []apiParam{
+					{"esp_id", "Only events for this ESP", false},
+					{"type", "Comma-separated stream event types", false},
+				},
+				response: apiEventStream{StreamEvent{}}},
+		}},
+		{"/ota", scopeAdmin, srv.otaHandler, []apiOp{
+			{method: http.MethodGet, summary: "List firmware images", response: struct {
+				Firmware []Firmware `json:"firmware"`
+			}{}},
+			{method: http.MethodPost, summary: "Upload a firmware image",
+				query: []apiParam{modelParam, versionParam, {"sha256", "Expected SHA256 of the image", false}},
+				body:  apiBinary(nil), response: Firmware{}},
+			{method: http.MethodDelete, summary: "Remove a firmware image", query: []apiParam{modelParam, versionParam}, response: statusResponse{}},
+		}},
+		{"/admin/reload", scopeAdmin, srv.reloadHandler, []apiOp{
+			{method: http.MethodPost, summary: "Re-read the config file and apply the settings that don't need a restart", response: ReloadResult{}},
+		}},
+		{"/admin/export", scopeAdmin, srv.exportHandler, []apiOp{
+			{method: http.MethodGet, summary: "Export devices, groups, schedules, users and device secrets as one bundle",
+				query: []apiParam{{"format", "json or yaml (default: json)", false}}, response: configBundle{}},
+		}},
+		{"/admin/import", scopeAdmin, srv.importHandler, []apiOp{
+			{method: http.MethodPost, summary: "Import a bundle from /admin/export (JSON or YAML); replace also removes what the bundle doesn't list",
+				query: []apiParam{{"mode", "merge or replace (default: merge)", false}, {"dry_run", "Only report what would change", false}},
+				body:  configBundle{}, response: ImportResult{}},
+		}},
+		{"/admin/backup", scopeAdmin, srv.backupHandler, []apiOp{
+			{method: http.MethodPost, summary: "Take a backup: a gzipped tar with the configuration bundle and the event log"},
+		}},
+		{"/admin/restore", scopeAdmin, srv.restoreHandler, []apiOp{
+			{method: http.MethodPost, summary: "Restore a backup from /admin/backup, replacing the configuration and the event log",
+				query: []apiParam{{"dry_run", "Only report what would change", false}}, response: RestoreResult{}},
+		}},
+		{"/webhooks", scopeAdmin, srv.webhooksHandler, []apiOp{
+			{method: http.MethodGet, summary: "List the configured webhooks; secrets are never returned", response: struct {
+				Webhooks []WebhookInfo `json:"webhooks"`
+			}{}},
+		}},
+		{"/webhooks/deliveries", scopeAdmin, srv.webhookDeliveriesHandler, []apiOp{
+			{method: http.MethodGet, summary: "List the most recent webhook deliveries, newest first",
+				query: []apiParam{{"webhook", "Only deliveries to this webhook", false}, {"status", "queued, retrying, ok, failed or dropped", false},
+					{"esp_id", "Only deliveries for this ESP", false}, {"limit", "Maximum number of deliveries (default: 50, most kept: 500)", false}},
+				response: struct {
+					Deliveries []WebhookDelivery `json:"deliveries"`
+				}{}},
+		}},
+		{"/webhooks/test", scopeAdmin, srv.webhookTestHandler, []apiOp{
+			{method: http.MethodPost, summary: "Queue a test event for one webhook, or every one, whatever its filters",
+				body: struct {
+					Webhook string `json:"webhook,omitempty"`
+				}{},
+				response: struct {
+					Deliveries []WebhookDelivery `json:"deliveries"`
+				}{}},
+		}},
+		{"/quotas", scopeAdmin, srv.quotasHandler, []apiOp{
+			{method: http.MethodGet, summary: "Show command quota usage of every device with a quota, or of one device and its namespace",
+				query: []apiParam{{"esp_id", "Only this ESP and its namespace", false}},
+				response: struct {
+					Quotas []QuotaStatus `json:"quotas"`
+				}{}},
+			{method: http.MethodDelete, summary: "Forget a device's or namespace's quota usage so far",
+				query: []apiParam{{"esp_id", "The ESP", false}, {"namespace", "The namespace, instead of an ESP", false}},
+				response: struct {
+					Status   string `json:"status"`
+					HadUsage bool   `json:"had_usage"`
+				}{}},
+		}},
+		{"/hooks/runs", scopeAdmin, srv.hookRunsHandler, []apiOp{
+			{method: http.MethodGet, summary: "List the most recent wake hook runs, newest first",
+				query: []apiParam{{"esp_id", "Only runs for this ESP", false}, {"limit", "Maximum number of runs (default: 20, most kept: 200)", false}},
+				response: struct {
+					Runs []HookRun `json:"runs"`
+				}{}},
+		}},
+		{"/hooks/run", scopeAdmin, srv.hookRunHandler, []apiOp{
+			{method: http.MethodPost, summary: "Run a device's wake hooks now, whatever its target's state",
+				body: struct {
+					ID string `json:"id"`
+				}{},
+				response: HookRun{}},
+		}},
+		{"/macros", scopeUser, srv.macrosHandler, []apiOp{
+			{method: http.MethodGet, summary: "List the macros the caller may run", response: struct {
+				Macros []MacroInfo `json:"macros"`
+			}{}},
+		}},
+		{"/macros/run", scopeUser, srv.macroRunHandler, []apiOp{
+			{method: http.MethodPost, summary: "Start a macro; follow its steps with /macros/runs?id=",
+				body: struct {
+					Name string `json:"name"`
+				}{},
+				response: MacroRun{}, status: http.StatusAccepted},
+		}},
+		{"/macros/runs", scopeUser, srv.macroRunsHandler, []apiOp{
+			{method: http.MethodGet, summary: "List the most recent macro runs, newest first, with the status of each step",
+				query: []apiParam{{"macro", "Only runs of this macro", false}, {"id", "Only this run", false}, {"limit", "Maximum number of runs (default: 20, most kept: 200)", false}},
+				response: struct {
+					Runs []MacroRun `json:"runs"`
+				}{}},
+		}},
+		{"/notify-test", scopeAdmin, srv.notifyTestHandler, []apiOp{
+			{method: http.MethodPost, summary: "Send a test notification through every sink", response: struct {
+				Results []map[string]string `json:"results"`
+			}{}},
+		}},
+		{"/ota/firmware", scopeESP, srv.firmwareHandler, []apiOp{
+			{method: http.MethodGet, summary: "Download a firmware image",
+				query:    []apiParam{{"id", "ESP ID", true}, {"model", "Hardware model, defaults to the reported one", false}, {"version", "Version, defaults to the latest", false}},
+				response: apiBinary(nil)},
+		}},
+	}
+}
+
+// registerAPI serves the API routes and their OpenAPI spec on router.
+func (srv *Server) registerAPI() {
+	routes := srv.apiRoutes()
+	spec, err := json.Marshal(openAPISpec(routes))
+	if err != nil {
+		srv.fatal("api", "Could not build OpenAPI spec", "error", err)
+	}
+
+	for _, rt := range routes {
+		for _, op := range rt.ops {
+			srv.routeMethods[rt.path] = append(srv.routeMethods[rt.path], op.method)
+			if op.method == http.MethodGet {
+				srv.routeMethods[rt.path] = append(srv.routeMethods[rt.path], http.MethodHead)
+			}
+		}
+	}
+	srv.routeMethods["/openapi.json"] = []string{http.MethodGet, http.MethodHead}
+
+	for _, rt := range routes {
+		h := srv.wrapHandler(rt.path, rt.scope, rt.handler)
+		// The legacy path has no method pattern, so it picks the handler
+		// for methods with their own scope itself
+		scoped := make(map[string]http.HandlerFunc)
+		for _, op := range rt.ops {
+			oh := h
+			if scope := rt.opScope(op); scope != rt.scope {
+				oh = srv.wrapHandler(rt.path, scope, rt.handler)
+				scoped[op.method] = oh
+			}
+			srv.router.HandleFunc(op.method+" "+APIPrefix+rt.path, oh)
+		}
+		// withCORS answers preflights before the scope is checked
+		srv.router.HandleFunc(http.MethodOptions+" "+APIPrefix+rt.path, h)
+		legacy := h
+		if len(scoped) > 0 {
+			legacy = func(w http.ResponseWriter, r *http.Request) {
+				if oh, ok := scoped[r.Method]; ok {
+					oh(w, r)
+					return
+				}
+				h(w, r)
+			}
+		}
+		srv.router.HandleFunc(rt.path, legacy)
+	}
+	openAPI := srv.wrapHandler("/openapi.json", scopePublic, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(spec)
+	})
+	srv.router.HandleFunc("GET "+APIPrefix+"/openapi.json", openAPI)
+	srv.router.HandleFunc(http.MethodOptions+" "+APIPrefix+"/openapi.json", openAPI)
+}
+
+// --- OpenAPI ---
+
+func openAPISpec(routes []apiRoute) map[string]interface{} {
+	schemas := map[string]interface{}{"Error": errorSchema()}
+	paths := make(map[string]interface{})
+
+	for _, rt := range routes {
+		item := make(map[string]interface{})
+		for _, op := range rt.ops {
+			item[strings.ToLower(op.method)] = openAPIOperation(rt, op, schemas)
+		}
+		paths[rt.path] = item
+	}
+	paths["/openapi.json"] = map[string]interface{}{
+		"get": map[string]interface{}{
+			"operationId": "getOpenAPI",
+			"summary":     "This document",
+			"security":    []interface{}{},
+			"responses":   map[string]interface{}{"200": map[string]interface{}{"description": "OK"}},
+		},
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "Wake-On-Demand",
+			"version": VERSION,
+		},
+		"servers": []interface{}{map[string]interface{}{"url": APIPrefix}},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"bearer": map[string]interface{}{
+					"type":        "http",
+					"scheme":      "bearer",
+					"description": "Admin key, user token or ESP token",
+				},
+			},
+		},
+		"security": []interface{}{map[string]interface{}{"bearer": []string{}}},
+	}
+}
+
+var scopeNames = map[authScope]string{
+	scopeESP:   "ESP token",
+	scopeUser:  "user token or admin key",
+	scopeAdmin: "admin role",
+}
+
+func openAPIOperation(rt apiRoute, op apiOp, schemas map[string]interface{}) map[string]interface{} {
+	status := op.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	ok := map[string]interface{}{"description": http.StatusText(status)}
+	if op.response != nil {
+		ok["content"] = openAPIContent(op.response, schemas)
+	}
+	responses := map[string]interface{}{
+		strconv.Itoa(status): ok,
+		"default":            errorResponseSpec("Error, told apart by its code"),
+	}
+
+	out := map[string]interface{}{
+		"operationId": operationID(op.method, rt.path),
+		"summary":     op.summary,
+		"responses":   responses,
+	}
+	scope := rt.opScope(op)
+	if scope == scopePublic {
+		out["security"] = []interface{}{}
+	} else {
+		out["description"] = "Requires " + scopeNames[scope] + "."
+		responses["401"] = errorResponseSpec("Unauthorized")
+	}
+	if scope == scopeUser {
+		responses["403"] = errorResponseSpec("Forbidden")
+	}
+
+	if len(op.query)+len(op.headers) > 0 {
+		params := make([]interface{}, 0, len(op.query)+len(op.headers))
+		for _, p := range op.query {
+			in := "query"
+			if strings.Contains(rt.path, "{"+p.name+"}") {
+				in = "path"
+			}
+			params = append(params, map[string]interface{}{
+				"name":        p.name,
+				"in":          in,
+				"description": p.desc,
+				"required":    p.required,
+				"schema":      map[string]interface{}{"type": "string"},
+			})
+		}
+		for _, p := range op.headers {
+			params = append(params, map[string]interface{}{
+				"name":        p.name,
+				"in":          "header",
+				"description": p.desc,
+				"required":    p.required,
+				"schema":      map[string]interface{}{"type": "string"},
+			})
+		}
+		out["parameters"] = params
+	}
+	if op.body != nil {
+		out["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content":  openAPIContent(op.body, schemas),
+		}
+	}
+	return out
+}
+
+func errorResponseSpec(description string) map[string]interface{} {
+	return map[string]interface{}{
+		"description": description,
+		"content": map[string]interface{}{
+			"application/json": map[string]interface{}{
+				"schema": map[string]interface{}{"$ref": "#/components/schemas/Error"},
+			},
+		},
+	}
+}
+
+// errorSchema describes the error envelope, listing each code with its
+// status.
+func errorSchema() map[string]interface{} {
+	codes := make([]string, len(errorCodes))
+	var desc strings.Builder
+	desc.WriteString("Stable code for scripts to branch on:\n")
+	for i, c := range errorCodes {
+		codes[i] = string(c.Code)
+		fmt.Fprintf(&desc, "\n- `%s` (%d): %s", c.Code, c.Status, c.Summary)
+	}
+	return map[string]interface{}{
+		"type":     "object",
+		"required": []string{"error"},
+		"properties": map[string]interface{}{
+			"error": map[string]interface{}{
+				"type":     "object",
+				"required": []string{"code", "message"},
+				"properties": map[string]interface{}{
+					"code":    map[string]interface{}{"type": "string", "enum": codes, "description": desc.String()},
+					"message": map[string]interface{}{"type": "string", "description": "For people; may change"},
+				},
+			},
+		},
+	}
+}
+
+func openAPIContent(v interface{}, schemas map[string]interface{}) map[string]interface{} {
+	switch v.(type) {
+	case apiBinary:
+		return map[string]interface{}{"application/octet-stream": map[string]interface{}{
+			"schema": map[string]interface{}{"type": "string", "format": "binary"},
+		}}
+	case apiText:
+		return map[string]interface{}{"text/plain": map[string]interface{}{
+			"schema": map[string]interface{}{"type": "string"},
+		}}
+	case apiEventStream:
+		return map[string]interface{}{"text/event-stream": map[string]interface{}{
+			"schema": jsonSchema(reflect.TypeOf(v.(apiEventStream).data), schemas),
+		}}
+	}
+	return map[string]interface{}{"application/json": map[string]interface{}{
+		"schema": jsonSchema(reflect.TypeOf(v), schemas),
+	}}
+}
+
+// operationID turns "POST", "/users/acl" into "postUsersAcl".
+func operationID(method, path string) string {
+	var b strings.Builder
+	b.WriteString(strings.ToLower(method))
+	upper := true
+	for _, r := range path {
+		if r == '/' || r == '-' || r == '{' || r == '}' {
+			upper = true
+			continue
+		}
+		if upper {
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// jsonSchema describes how encoding/json marshals t. Named structs are
+// added to schemas and referenced, anonymous ones are inlined.
+func jsonSchema(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == timeType {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": jsonSchema(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": jsonSchema(t.Elem(), schemas)}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return structSchema(t, schemas)
+		}
+		// Unexported types get exported names so generated clients can use them
+		name := strings.ToUpper(t.Name()[:1]) + t.Name()[1:]
+		if _, done := schemas[name]; !done {
+			// Placeholder first so self-references terminate
+			schemas[name] = nil
+			schemas[name] = structSchema(t, schemas)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]interface{}{}
+}
+
+func structSchema(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	props := make(map[string]interface{})
+	addStructFields(t, props, schemas)
+	return map[string]interface{}{"type": "object", "properties": props}
+}
+
+func addStructFields(t reflect.Type, props, schemas map[string]interface{}) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		ft := f.Type
+		if ft.Kind() == reflect.Pointer {
+			ft = ft.Elem()
+		}
+		if f.Anonymous && name == "" && ft.Kind() == reflect.Struct {
+			addStructFields(ft, props, schemas)
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = jsonSchema(f.Type, schemas)
+	}
+}
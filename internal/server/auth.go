@@ -0,0 +1,221 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+type authScope int
+
+const (
+	scopePublic authScope = iota
+	scopeESP
+	scopeUser
+	scopeAdmin
+)
+
+type AuthConfig struct {
+	AdminKey        string            `json:"admin_key"`
+	ESPTokens       map[string]string `json:"esp_tokens"`
+	NamespaceTokens map[string]string `json:"namespace_tokens"`
+}
+
+// tokenFlag collects repeated -esp-token id=token flags.
+type tokenFlag map[string]string
+
+func (t tokenFlag) String() string {
+	ids := make([]string, 0, len(t))
+	for id := range t {
+		ids = append(ids, id)
+	}
+	return strings.Join(ids, ",")
+}
+
+func (t tokenFlag) Set(value string) error {
+	id, token, ok := strings.Cut(value, "=")
+	if !ok || id == "" || token == "" {
+		return fmt.Errorf("expected <esp_id>=<token>, got %q", value)
+	}
+	t[id] = token
+	return nil
+}
+
+// authState holds the Server state kept in auth.go.
+type authState struct {
+	auth AuthConfig
+}
+
+// LoadAuthFile fills in the admin key and ESP tokens the config doesn't set
+// yet.
+func LoadAuthFile(path string, into *AuthConfig) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var file AuthConfig
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	// Flags take precedence over the file
+	if into.AdminKey == "" {
+		into.AdminKey = file.AdminKey
+	}
+	for id, token := range file.ESPTokens {
+		if _, exists := into.ESPTokens[id]; !exists {
+			into.ESPTokens[id] = token
+		}
+	}
+	for ns, token := range file.NamespaceTokens {
+		if _, exists := into.NamespaceTokens[ns]; !exists {
+			into.NamespaceTokens[ns] = token
+		}
+	}
+	return nil
+}
+
+// currentAuth returns the admin key and ESP tokens, which a reload may
+// replace. The token maps must not be modified.
+func (srv *Server) currentAuth() AuthConfig {
+	srv.settingsMu.RLock()
+	defer srv.settingsMu.RUnlock()
+	return srv.auth
+}
+
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	scheme, token, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+func tokenMatches(got, want string) bool {
+	return subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
+
+// errConflictingIDs rejects device requests that name one ESP in the query
+// string and another in the body.
+var errConflictingIDs = errors.New("the query and body name different ESP IDs")
+
+// requestESPID extracts the ESP ID from the query string and JSON body
+// without consuming the body for the wrapped handler. When both carry an
+// ID they must agree, so the token or signature checked is the one of the
+// device the handler acts for.
+func requestESPID(r *http.Request) (string, error) {
+	id := r.URL.Query().Get("id")
+	if r.Body == nil {
+		return id, nil
+	}
+
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), errorReader{err}))
+		return id, nil
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	var data struct {
+		ID string `json:"id"`
+	}
+	json.Unmarshal(body, &data)
+	switch {
+	case data.ID == "":
+		return id, nil
+	case id != "" && id != data.ID:
+		return "", errConflictingIDs
+	}
+	return data.ID, nil
+}
+
+type espIDKey struct{}
+
+// espID is the ESP ID withAuth checked a device request against. Device
+// handlers act for this ID only, never one they read themselves.
+func espID(r *http.Request) string {
+	id, _ := r.Context().Value(espIDKey{}).(string)
+	return id
+}
+
+func (srv *Server) withAuth(scope authScope, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rlog := srv.requestLogger(r)
+		token := bearerToken(r)
+
+		switch scope {
+		case scopeUser, scopeAdmin:
+			if srv.adminSocket != "" {
+				if !fromAdminSocket(r) {
+					rlog.Warn("Control request outside the admin socket")
+					writeError(w, CodeForbidden, "the control API is only served on the admin socket")
+					return
+				}
+				break
+			}
+			if !srv.authEnabled() {
+				break
+			}
+			p := srv.authenticate(token)
+			if token == "" {
+				// Browsers sign in to the dashboard with a session cookie
+				var ok bool
+				if p, ok = srv.sessionPrincipal(w, r); !ok {
+					return
+				}
+			}
+			if p == nil {
+				rlog.Warn("Invalid admin key or user token")
+				unauthorized(w)
+				return
+			}
+			if scope == scopeAdmin && !p.global() {
+				rlog.Warn("User lacks admin role", "user", p.Name)
+				writeError(w, CodeForbidden, "admin role required")
+				return
+			}
+			r = withPrincipal(r, p)
+			if p != adminPrincipal {
+				r = withLogger(r, rlog.With("user", p.Name))
+			}
+		case scopeESP:
+			id, err := requestESPID(r)
+			if err != nil {
+				rlog.Warn("Conflicting ESP IDs", "query_id", r.URL.Query().Get("id"))
+				writeError(w, CodeInvalidRequest, err.Error())
+				return
+			}
+			r = r.WithContext(context.WithValue(r.Context(), espIDKey{}, id))
+			ok, signed := srv.checkSignature(w, r)
+			if !ok {
+				return
+			}
+			if signed {
+				break
+			}
+			want, exists := srv.currentAuth().espToken(id)
+			if exists && !tokenMatches(token, want) {
+				rlog.Warn("Invalid ESP token", "esp_id", id)
+				unauthorized(w)
+				return
+			}
+		}
+
+		next(w, r)
+	}
+}
+
+func unauthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="wake-on-demand"`)
+	writeError(w, CodeUnauthorized, "unauthorized")
+}
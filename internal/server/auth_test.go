@@ -0,0 +1,71 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWithAuthESP(t *testing.T) {
+	srv := newServer()
+	srv.auth = AuthConfig{ESPTokens: map[string]string{"nas": "tok-nas", "other": "tok-other"}}
+
+	for _, tc := range []struct {
+		name   string
+		query  string
+		body   string
+		token  string
+		want   int
+		wantID string
+	}{
+		{name: "query id", query: "id=nas", token: "tok-nas", want: http.StatusOK, wantID: "nas"},
+		{name: "body id", body: `{"id":"nas"}`, token: "tok-nas", want: http.StatusOK, wantID: "nas"},
+		{name: "same id in both", query: "id=nas", body: `{"id":"nas"}`, token: "tok-nas", want: http.StatusOK, wantID: "nas"},
+		{name: "query id with a body without one", query: "id=nas", body: `{"success":true}`, token: "tok-nas", want: http.StatusOK, wantID: "nas"},
+		{name: "query id with a body that isn't JSON", query: "id=nas", body: "binary", token: "tok-nas", want: http.StatusOK, wantID: "nas"},
+		{name: "device without a token", query: "id=open", want: http.StatusOK, wantID: "open"},
+		{name: "wrong token", query: "id=nas", token: "tok-other", want: http.StatusUnauthorized},
+		{name: "missing token", body: `{"id":"nas"}`, want: http.StatusUnauthorized},
+		{name: "query names the token's device, body another", query: "id=other", body: `{"id":"nas"}`, token: "tok-other", want: http.StatusBadRequest},
+		{name: "body names the token's device, query another", query: "id=other", body: `{"id":"nas"}`, token: "tok-nas", want: http.StatusBadRequest},
+		{name: "open device in the query, protected one in the body", query: "id=open", body: `{"id":"nas"}`, want: http.StatusBadRequest},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var gotID, gotBody string
+			h := srv.withAuth(scopeESP, func(w http.ResponseWriter, r *http.Request) {
+				gotID = espID(r)
+				data, _ := io.ReadAll(r.Body)
+				gotBody = string(data)
+			})
+
+			req := httptest.NewRequest(http.MethodPost, "/command-ack?"+tc.query, strings.NewReader(tc.body))
+			if tc.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+			rec := httptest.NewRecorder()
+			h(rec, req)
+
+			if rec.Code != tc.want {
+				t.Fatalf("status = %d, want %d (%s)", rec.Code, tc.want, rec.Body.String())
+			}
+			if tc.want != http.StatusOK {
+				return
+			}
+			if gotID != tc.wantID {
+				t.Errorf("espID = %q, want %q", gotID, tc.wantID)
+			}
+			if gotBody != tc.body {
+				t.Errorf("handler read body %q, want %q", gotBody, tc.body)
+			}
+		})
+	}
+}
+
+func TestRequestESPIDConflict(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/register?id=a", strings.NewReader(`{"id":"b"}`))
+	if _, err := requestESPID(req); err != errConflictingIDs {
+		t.Errorf("requestESPID = %v, want errConflictingIDs", err)
+	}
+}
@@ -0,0 +1,479 @@
+package server
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	regstore "github.com/smileyfaceskobochka/trashbin-daemon/internal/registry"
+)
+
+// Backups: /admin/backup writes the server's state into one archive, a
+// gzipped tar with the export bundle (devices, groups, schedules, users
+// with their token hashes, device secrets) and the event log, and
+// /admin/restore puts it back. The registry and the event log are copied
+// under the same lock, so the archive doesn't hold events for devices it
+// doesn't have. A restore replaces the configuration like import -replace
+// and the event log with the archived one; event sequence numbers never go
+// back, so clients following the log don't miss what comes after. With
+// backup.interval set the server also takes backups on its own, into a
+// directory and/or an S3-compatible bucket.
+
+const (
+	backupVersion       = 1
+	maxBackupSize       = 64 << 20
+	BackupPrefix        = "wod-backup-"
+	BackupSuffix        = ".tar.gz"
+	defaultBackupKeep   = 7
+	minBackupInterval   = time.Minute
+	backupUploadTimeout = 2 * time.Minute
+	defaultS3Region     = "us-east-1"
+
+	backupManifestFile = "manifest.json"
+	backupConfigFile   = "config.json"
+	backupEventsFile   = "events.jsonl"
+)
+
+// BackupSettings configures automatic backups. Keep is how many archives
+// stay in Dir; old ones in the bucket are left to its lifecycle rules.
+type BackupSettings struct {
+	Interval time.Duration `yaml:"interval"`
+	Dir      string        `yaml:"dir"`
+	Keep     int           `yaml:"keep"` // default 7
+	S3       *S3Settings   `yaml:"s3"`
+}
+
+// S3Settings is an S3-compatible bucket, addressed path-style so MinIO and
+// friends work without DNS per bucket.
+type S3Settings struct {
+	Endpoint  string `yaml:"endpoint"` // e.g. https://s3.eu-central-1.amazonaws.com
+	Bucket    string `yaml:"bucket"`
+	Prefix    string `yaml:"prefix"`
+	Region    string `yaml:"region"` // default us-east-1
+	AccessKey string `yaml:"access_key"`
+	SecretKey string `yaml:"secret_key"`
+}
+
+func validateBackup(s BackupSettings) []error {
+	var errs []error
+	if s.Interval == 0 {
+		if s.Dir != "" || s.S3 != nil {
+			errs = append(errs, errors.New("backup.interval: must be set for automatic backups"))
+		}
+		return errs
+	}
+	if s.Interval < minBackupInterval {
+		errs = append(errs, fmt.Errorf("backup.interval: must be at least %s, got %v", minBackupInterval, s.Interval))
+	}
+	if s.Dir == "" && s.S3 == nil {
+		errs = append(errs, errors.New("backup: needs a dir or s3 to write to"))
+	}
+	if s.Keep < 0 {
+		errs = append(errs, fmt.Errorf("backup.keep: can't be negative, got %d", s.Keep))
+	}
+	if s3 := s.S3; s3 != nil {
+		if u, err := url.Parse(s3.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("backup.s3.endpoint: %q must be an http:// or https:// URL", s3.Endpoint))
+		}
+		if s3.Bucket == "" {
+			errs = append(errs, errors.New("backup.s3.bucket: cannot be empty"))
+		}
+		if s3.AccessKey == "" || s3.SecretKey == "" {
+			errs = append(errs, errors.New("backup.s3: access_key and secret_key are required"))
+		}
+	}
+	return errs
+}
+
+// backupManifest describes an archive.
+type backupManifest struct {
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	Server    string    `json:"server"`
+	Devices   int       `json:"devices"`
+	Schedules int       `json:"schedules"`
+	Users     int       `json:"users"`
+	Events    int       `json:"events"`
+}
+
+func (m backupManifest) filename() string {
+	return BackupPrefix + m.CreatedAt.UTC().Format("20060102T150405Z") + BackupSuffix
+}
+
+// backupArchive takes a snapshot of the server's state.
+func (srv *Server) backupArchive() ([]byte, backupManifest, error) {
+	var evs []Event
+	b := srv.buildBundle(func() {
+		srv.eventsMu.Lock()
+		evs = slices.Clone(srv.events)
+		srv.eventsMu.Unlock()
+	})
+	m := backupManifest{
+		Version: backupVersion, CreatedAt: b.ExportedAt, Server: VERSION,
+		Devices: len(b.Devices), Schedules: len(b.Schedules), Users: len(b.Users), Events: len(evs),
+	}
+
+	manifest, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, m, err
+	}
+	bundle, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return nil, m, err
+	}
+	var log bytes.Buffer
+	enc := json.NewEncoder(&log)
+	for _, e := range evs {
+		if err := enc.Encode(e); err != nil {
+			return nil, m, err
+		}
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, f := range []struct {
+		name string
+		data []byte
+	}{{backupManifestFile, manifest}, {backupConfigFile, bundle}, {backupEventsFile, log.Bytes()}} {
+		hdr := &tar.Header{Name: f.name, Mode: 0o600, Size: int64(len(f.data)), ModTime: m.CreatedAt}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return nil, m, err
+		}
+		if _, err := tw.Write(f.data); err != nil {
+			return nil, m, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, m, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, m, err
+	}
+	return buf.Bytes(), m, nil
+}
+
+// ReadBackup unpacks an archive from backupArchive.
+func ReadBackup(data []byte) (backupManifest, configBundle, []Event, error) {
+	var m backupManifest
+	var b configBundle
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return m, b, nil, fmt.Errorf("not a gzipped archive: %w", err)
+	}
+	files := make(map[string][]byte)
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return m, b, nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if files[hdr.Name], err = io.ReadAll(io.LimitReader(tr, maxBackupSize)); err != nil {
+			return m, b, nil, err
+		}
+	}
+
+	for _, name := range []string{backupManifestFile, backupConfigFile} {
+		if files[name] == nil {
+			return m, b, nil, fmt.Errorf("%s is missing", name)
+		}
+	}
+	if err := json.Unmarshal(files[backupManifestFile], &m); err != nil {
+		return m, b, nil, fmt.Errorf("%s: %w", backupManifestFile, err)
+	}
+	if m.Version < 1 || m.Version > backupVersion {
+		return m, b, nil, fmt.Errorf("unsupported backup version %d (this server reads %d)", m.Version, backupVersion)
+	}
+	if b, err = ParseBundle(files[backupConfigFile]); err != nil {
+		return m, b, nil, fmt.Errorf("%s: %w", backupConfigFile, err)
+	}
+
+	var evs []Event
+	scanner := bufio.NewScanner(bytes.NewReader(files[backupEventsFile]))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return m, b, nil, fmt.Errorf("%s line %d: %w", backupEventsFile, line, err)
+		}
+		evs = append(evs, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return m, b, nil, fmt.Errorf("%s: %w", backupEventsFile, err)
+	}
+	if len(evs) > maxEventsInMemory {
+		evs = evs[len(evs)-maxEventsInMemory:]
+	}
+	return m, b, evs, nil
+}
+
+// RestoreResult is an import result plus the events put back.
+type RestoreResult struct {
+	ImportResult
+	CreatedAt time.Time `json:"created_at"`
+	Events    int       `json:"events"`
+}
+
+// restoreBackup applies an archive. The bundle is checked with a dry run
+// first, so a bad archive leaves the event log alone.
+func (srv *Server) restoreBackup(m backupManifest, b configBundle, evs []Event, dryRun bool, actor string) (RestoreResult, error) {
+	result := RestoreResult{CreatedAt: m.CreatedAt, Events: len(evs)}
+	var err error
+	if result.ImportResult, err = srv.importBundle(b, ImportReplace, true, actor); err != nil || dryRun {
+		return result, err
+	}
+
+	srv.eventsMu.Lock()
+	srv.events = slices.Clone(evs)
+	if len(evs) > 0 {
+		srv.eventSeq = max(srv.eventSeq, evs[len(evs)-1].Seq)
+	}
+	err = srv.store.ReplaceEvents(srv.events)
+	srv.eventsMu.Unlock()
+	if err != nil {
+		srv.logger("backup").Error("Failed to write event log", "error", err)
+	}
+
+	result.ImportResult, err = srv.importBundle(b, ImportReplace, false, actor)
+	return result, err
+}
+
+// backupHandler serves POST /admin/backup.
+func (srv *Server) backupHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, CodeMethodNotAllowed, "only POST allowed")
+		return
+	}
+	data, m, err := srv.backupArchive()
+	if err != nil {
+		srv.requestLogger(r).Error("Backup failed", "error", err)
+		writeError(w, CodeInternal, "could not write backup")
+		return
+	}
+	srv.requestLogger(r).Info("Backup taken", "devices", m.Devices, "events", m.Events, "bytes", len(data))
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", m.filename()))
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
+
+// restoreHandler serves POST /admin/restore.
+func (srv *Server) restoreHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, CodeMethodNotAllowed, "only POST allowed")
+		return
+	}
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+
+	data, err := io.ReadAll(r.Body)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeError(w, CodeTooLarge, fmt.Sprintf("request body too large (limit %d bytes)", tooLarge.Limit))
+		return
+	} else if err != nil {
+		writeError(w, CodeInvalidRequest, "could not read body")
+		return
+	}
+	m, b, evs, err := ReadBackup(data)
+	if err != nil {
+		writeError(w, CodeInvalidRequest, "invalid backup: "+err.Error())
+		return
+	}
+	result, err := srv.restoreBackup(m, b, evs, dryRun, srv.requestActor(r))
+	if err != nil {
+		srv.requestLogger(r).Warn("Restore rejected", "error", err)
+		writeError(w, CodeInvalidConfig, "invalid backup: "+err.Error())
+		return
+	}
+	if !dryRun {
+		srv.requestLogger(r).Info("Backup restored", "created_at", m.CreatedAt, "events", len(evs))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// --- Automatic backups ---
+
+func (srv *Server) backupEnabled() bool {
+	return srv.config.Backup.Interval > 0
+}
+
+func (srv *Server) runBackups() {
+	srv.mu.Lock()
+	s := srv.config.Backup
+	srv.mu.Unlock()
+
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		srv.takeBackup(s)
+	}
+}
+
+func (srv *Server) takeBackup(s BackupSettings) {
+	blog := srv.logger("backup")
+	data, m, err := srv.backupArchive()
+	if err != nil {
+		blog.Error("Backup failed", "error", err)
+		srv.metricBackups.Inc("archive", "error")
+		return
+	}
+	name := m.filename()
+	if s.Dir != "" {
+		if err := writeBackupFile(s, name, data); err != nil {
+			blog.Error("Could not write backup", "dir", s.Dir, "error", err)
+			srv.metricBackups.Inc("dir", "error")
+		} else {
+			blog.Info("Backup written", "path", filepath.Join(s.Dir, name), "bytes", len(data))
+			srv.metricBackups.Inc("dir", "ok")
+		}
+	}
+	if s.S3 != nil {
+		if err := srv.uploadBackup(*s.S3, name, data); err != nil {
+			blog.Error("Could not upload backup", "bucket", s.S3.Bucket, "error", err)
+			srv.metricBackups.Inc("s3", "error")
+		} else {
+			blog.Info("Backup uploaded", "bucket", s.S3.Bucket, "key", s.S3.Prefix+name, "bytes", len(data))
+			srv.metricBackups.Inc("s3", "ok")
+		}
+	}
+}
+
+// writeBackupFile writes the archive into the directory and removes the
+// oldest ones beyond Keep.
+func writeBackupFile(s BackupSettings, name string, data []byte) error {
+	if err := regstore.WriteFileAtomic(filepath.Join(s.Dir, name), data); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, e := range entries {
+		if n := e.Name(); e.Type().IsRegular() && strings.HasPrefix(n, BackupPrefix) && strings.HasSuffix(n, BackupSuffix) {
+			names = append(names, n)
+		}
+	}
+	// The timestamps sort by name
+	slices.Sort(names)
+	keep := cmp.Or(s.Keep, defaultBackupKeep)
+	for _, n := range names[:max(len(names)-keep, 0)] {
+		if err := os.Remove(filepath.Join(s.Dir, n)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backupState holds the Server state kept in backup.go.
+type backupState struct {
+	backupHTTP *http.Client
+}
+
+// uploadBackup puts the archive into the bucket, signed with AWS
+// Signature Version 4.
+func (srv *Server) uploadBackup(s S3Settings, name string, data []byte) error {
+	var segments []string
+	for _, seg := range strings.Split(s.Bucket+"/"+s.Prefix+name, "/") {
+		segments = append(segments, awsEscape(seg))
+	}
+	path := "/" + strings.Join(segments, "/")
+	u, err := url.Parse(strings.TrimSuffix(s.Endpoint, "/") + path)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPut, u.String(), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/gzip")
+	signS3(req, s, u.EscapedPath(), data, srv.now())
+
+	resp, err := srv.backupHTTP.Do(req)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// signS3 adds the Signature Version 4 headers. Only host and the x-amz
+// headers are signed, which is all S3 requires.
+func signS3(req *http.Request, s S3Settings, path string, body []byte, now time.Time) {
+	region := cmp.Or(s.Region, defaultS3Region)
+	stamp := now.UTC().Format("20060102T150405Z")
+	date := stamp[:8]
+	sum := sha256.Sum256(body)
+	payload := hex.EncodeToString(sum[:])
+	req.Header.Set("X-Amz-Date", stamp)
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+
+	const signed = "host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{
+		req.Method, path, "",
+		"host:" + req.URL.Host, "x-amz-content-sha256:" + payload, "x-amz-date:" + stamp, "",
+		signed, payload,
+	}, "\n")
+	scope := date + "/" + region + "/s3/aws4_request"
+	hashed := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+
+	key := []byte("AWS4" + s.SecretKey)
+	for _, part := range []string{date, region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, scope, signed, hex.EncodeToString(hmacSHA256(key, toSign))))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// awsEscape percent-encodes everything but the unreserved characters, as
+// Signature Version 4 wants it.
+func awsEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
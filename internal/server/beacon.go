@@ -0,0 +1,227 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Beacons: with beacon.port set the server listens for UDP heartbeats, so
+// a device whose HTTP polls keep failing on bad Wi-Fi still counts as
+// online. A beacon is one small JSON datagram,
+//
+//	{"id": "desk", "ts": 1760443200, "nonce": "8f3a...", "sig": "..."}
+//
+// signed with the device secret: sig is the hex HMAC-SHA256 of
+// "beacon\n<id>\n<ts>\n<nonce>". Timestamps and nonces are checked like in
+// signed requests, and devices without a secret can't send beacons, since
+// anyone can forge UDP. Only registered devices are kept online; beacons
+// don't register. The server answers each beacon with
+//
+//	{"type": "ack" or "poll", "ts": ..., "pending": 2, "sig": "..."}
+//
+// signed as "<type>\n<id>\n<ts>\n<pending>", and sends an unasked "poll"
+// to the address of the last beacon when a command is queued, so the
+// device polls right away instead of at its next interval. Those nudges
+// only go to firmware that declared the beacon feature, and only while its
+// beacons are recent.
+
+const (
+	maxBeaconSize  = 512
+	beaconActor    = "beacon"
+	beaconAck      = "ack"
+	beaconPollNow  = "poll"
+	beaconReadLoop = time.Second
+)
+
+// BeaconSettings configures the UDP listener.
+type BeaconSettings struct {
+	Port    int    `yaml:"port"`    // 0 is off
+	Address string `yaml:"address"` // IP to listen on, default all
+}
+
+func validateBeacon(s BeaconSettings) []error {
+	var errs []error
+	if s.Port < 0 || s.Port > 65535 {
+		errs = append(errs, fmt.Errorf("beacon.port: must be between 1 and 65535, got %d", s.Port))
+	}
+	if s.Address != "" && net.ParseIP(s.Address) == nil {
+		errs = append(errs, fmt.Errorf("beacon.address: %q is not an IP address", s.Address))
+	}
+	return errs
+}
+
+// beaconPeer is where a device's beacons come from, for nudges.
+type beaconPeer struct {
+	addr   *net.UDPAddr
+	secret string
+	at     time.Time
+}
+
+// beaconMessage is a heartbeat from a device.
+type beaconMessage struct {
+	ID        string `json:"id"`
+	Timestamp int64  `json:"ts"`
+	Nonce     string `json:"nonce"`
+	Signature string `json:"sig"`
+}
+
+// beaconReply answers a beacon, or nudges the device to poll.
+type beaconReply struct {
+	Type      string `json:"type"`
+	Timestamp int64  `json:"ts"`
+	Pending   int    `json:"pending"`
+	Signature string `json:"sig"`
+}
+
+// beaconState holds the Server state kept in beacon.go.
+type beaconState struct {
+	// beaconConn is the listener, once it is open.
+	beaconConn atomic.Pointer[net.UDPConn]
+}
+
+func (srv *Server) beaconEnabled() bool {
+	return srv.config.Beacon.Port != 0
+}
+
+// beaconPort is the port beacons go to, or 0 when nothing listens.
+func (srv *Server) beaconPort() int {
+	if conn := srv.beaconConn.Load(); conn != nil {
+		return conn.LocalAddr().(*net.UDPAddr).Port
+	}
+	return 0
+}
+
+func beaconSignature(secret string, parts ...string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strings.Join(parts, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (srv *Server) startBeacon() {
+	srv.mu.Lock()
+	s := srv.config.Beacon
+	srv.mu.Unlock()
+
+	addr := &net.UDPAddr{IP: net.ParseIP(s.Address), Port: s.Port}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		srv.fatal("beacon", "Failed to listen for beacons", "addr", addr.String(), "error", err)
+	}
+	srv.beaconConn.Store(conn)
+	srv.onShutdown("close beacon listener", func() { conn.Close() })
+	srv.logger("beacon").Info("Listening for beacons", "addr", conn.LocalAddr().String())
+	go srv.runBeacon(conn)
+}
+
+func (srv *Server) runBeacon(conn *net.UDPConn) {
+	buf := make([]byte, maxBeaconSize+1)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			srv.logger("beacon").Warn("Could not read beacon", "error", err)
+			time.Sleep(beaconReadLoop)
+			continue
+		}
+		srv.metricBeacons.Inc(srv.handleBeacon(conn, buf[:n], addr))
+	}
+}
+
+// handleBeacon checks a beacon and marks the device seen. It returns the
+// result for wod_beacons_total.
+func (srv *Server) handleBeacon(conn *net.UDPConn, data []byte, addr *net.UDPAddr) string {
+	blog := srv.logger("beacon").With("from", addr.String())
+	var m beaconMessage
+	if len(data) > maxBeaconSize || json.Unmarshal(data, &m) != nil || validateESPID(m.ID) != nil {
+		blog.Debug("Malformed beacon")
+		return "malformed"
+	}
+	blog = blog.With("esp_id", m.ID)
+	secret, exists := srv.deviceSecret(m.ID)
+	if !exists {
+		blog.Debug("Beacon from a device without a secret")
+		return "unsigned"
+	}
+	now := srv.now()
+	if skew := now.Sub(time.Unix(m.Timestamp, 0)); skew > signatureWindow || skew < -signatureWindow {
+		blog.Debug("Stale beacon", "skew", skew)
+		return "stale"
+	}
+	ts := strconv.FormatInt(m.Timestamp, 10)
+	want := beaconSignature(secret, beaconActor, m.ID, ts, m.Nonce)
+	if len(m.Nonce) < minNonceLength || len(m.Nonce) > maxNonceLength || !hmac.Equal([]byte(m.Signature), []byte(want)) {
+		blog.Warn("Beacon with an invalid signature")
+		return "bad_signature"
+	}
+	if srv.useNonce(m.ID, m.Nonce, now) != nil {
+		blog.Warn("Replayed beacon")
+		return "replay"
+	}
+
+	srv.mu.Lock()
+	esp, exists := srv.espMap[m.ID]
+	if !exists || esp.isWoL() || esp.isMQTT() || esp.isDriver() {
+		srv.mu.Unlock()
+		blog.Debug("Beacon from an unregistered device")
+		return "unknown"
+	}
+	esp.markSeen(srv, beaconActor+"@"+addr.IP.String())
+	esp.beacon = &beaconPeer{addr: addr, secret: secret, at: now}
+	reply := srv.beaconFor(esp, beaconAck)
+	srv.mu.Unlock()
+
+	conn.WriteToUDP(reply, addr)
+	return "ok"
+}
+
+// beaconFor builds a signed reply; it asks for a poll whenever a command
+// can go. Must be called with mu held.
+func (srv *Server) beaconFor(esp *ESP, typ string) []byte {
+	pending := len(esp.Queue)
+	if pending > 0 && !srv.queueHeld(esp) {
+		typ = beaconPollNow
+	}
+	ts := srv.now().Unix()
+	reply := beaconReply{Type: typ, Timestamp: ts, Pending: pending,
+		Signature: beaconSignature(esp.beacon.secret, typ, esp.ID, strconv.FormatInt(ts, 10), strconv.Itoa(pending))}
+	data, _ := json.Marshal(reply)
+	return data
+}
+
+// nudgeBeacon tells a device that sends beacons to poll now, when a
+// command for it can go. Must be called with mu held.
+func (srv *Server) nudgeBeacon(esp *ESP) {
+	conn := srv.beaconConn.Load()
+	if conn == nil || esp.beacon == nil || !esp.supports(featureBeacon) || len(esp.Queue) == 0 || srv.queueHeld(esp) {
+		return
+	}
+	if timeout, _ := esp.offlineTimeout(srv); srv.now().Sub(esp.beacon.at) > timeout {
+		return
+	}
+	conn.WriteToUDP(srv.beaconFor(esp, beaconPollNow), esp.beacon.addr)
+	srv.metricBeaconNudges.Inc(esp.ID)
+}
+
+// beaconInfo is when and from where the last beacon came.
+type beaconInfo struct {
+	LastSeen time.Time `json:"last_seen"`
+	Addr     string    `json:"addr"`
+}
+
+// espBeacon must be called with mu held.
+func espBeacon(esp *ESP) *beaconInfo {
+	if esp.beacon == nil {
+		return nil
+	}
+	return &beaconInfo{LastSeen: esp.beacon.at, Addr: esp.beacon.addr.String()}
+}
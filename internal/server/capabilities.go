@@ -0,0 +1,115 @@
+package server
+
+import (
+	"fmt"
+	"slices"
+)
+
+// Capabilities: firmware tells the server at registration which protocol
+// version and features it speaks, with "protocol" and "features" in the
+// /register body, and the server answers with its own version and the
+// features both sides have. Behaviour that old firmware could trip over is
+// then only used with devices that declared it: pulse lengths, custom
+// actions, OTA offers and poll hints. Firmware that declares nothing is
+// taken to speak protocol 1, which has every feature that came before
+// negotiation, so it keeps working as it did. Features added later have
+// to be declared. Every registration negotiates afresh, so firmware
+// should declare its features each time.
+
+// ProtocolVersion is the ESP protocol the server speaks; 1 is the protocol
+// from before capabilities were negotiated.
+const ProtocolVersion = 2
+
+const (
+	featureLongPoll  = "long_poll" // GET /command?wait=
+	featureWebSocket = "websocket" // commands pushed over /ws
+	featureSigning   = "signing"   // signed requests
+	featureActions   = "actions"   // the action command
+	featureDuration  = "duration"  // duration_ms with pulse and force
+	featureOTA       = "ota"       // ota offers in poll responses
+	featurePollHint  = "poll_hint" // next_poll_ms in poll responses
+	featureBeacon    = "beacon"
+)
+
+// ServerFeatures are the features the server supports, in the order it
+// reports them.
+var ServerFeatures = []string{featureLongPoll, featureWebSocket, featureSigning, featureActions, featureDuration, featureOTA, featurePollHint, featureBeacon}
+
+// legacyFeatures are assumed for firmware that declares nothing. They are
+// the features from before negotiation; new ones don't belong here.
+var legacyFeatures = []string{featureLongPoll, featureWebSocket, featureSigning, featureActions, featureDuration, featureOTA, featurePollHint}
+
+// Capabilities is what was negotiated with the firmware: the lower of
+// both protocol versions, and the declared features the server knows.
+type Capabilities struct {
+	Protocol int      `json:"protocol"`
+	Features []string `json:"features"`
+}
+
+// negotiateCapabilities records what the firmware declared, or nil when it
+// declared nothing. Unknown features are dropped.
+func negotiateCapabilities(protocol int, features []string) (*Capabilities, []string) {
+	if protocol == 0 && features == nil {
+		return nil, nil
+	}
+	if protocol == 0 {
+		protocol = ProtocolVersion
+	}
+	caps := &Capabilities{Protocol: min(protocol, ProtocolVersion), Features: []string{}}
+	var unknown []string
+	for _, f := range ServerFeatures {
+		if slices.Contains(features, f) {
+			caps.Features = append(caps.Features, f)
+		}
+	}
+	for _, f := range features {
+		if !slices.Contains(ServerFeatures, f) {
+			unknown = append(unknown, f)
+		}
+	}
+	return caps, unknown
+}
+
+func validateFeatures(protocol int, features []string) error {
+	if protocol < 0 {
+		return fmt.Errorf("protocol must be positive, got %d", protocol)
+	}
+	if len(features) > 32 {
+		return fmt.Errorf("too many features (%d, at most 32)", len(features))
+	}
+	for _, f := range features {
+		if f == "" || len(f) > 32 {
+			return fmt.Errorf("invalid feature name %q", f)
+		}
+	}
+	return nil
+}
+
+// supports reports whether the firmware can handle feature. Must be
+// called with mu held.
+func (e *ESP) supports(feature string) bool {
+	if e.Capabilities == nil {
+		return slices.Contains(legacyFeatures, feature)
+	}
+	return slices.Contains(e.Capabilities.Features, feature)
+}
+
+// capabilityFields tells the firmware what was negotiated, in the register
+// response.
+func (srv *Server) capabilityFields(esp *ESP, resp map[string]interface{}) {
+	resp["protocol"] = ProtocolVersion
+	resp["features"] = ServerFeatures
+	if esp.Capabilities != nil {
+		resp["protocol"] = esp.Capabilities.Protocol
+		resp["features"] = esp.Capabilities.Features
+	}
+	if port := srv.beaconPort(); port != 0 && esp.supports(featureBeacon) {
+		resp["beacon_port"] = port
+	}
+}
+
+// featureError is errUnsupportedCommand for firmware that didn't declare a
+// feature.
+func featureError(esp *ESP, what string) error {
+	return fmt.Errorf("%w: the firmware on '%s' doesn't support %s", errUnsupportedCommand, esp.ID, what)
+}
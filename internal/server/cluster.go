@@ -0,0 +1,343 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	regstore "github.com/smileyfaceskobochka/trashbin-daemon/internal/registry"
+)
+
+// Clustering runs several servers against one Redis. The node holding the
+// leader lease does all the work: it serves the API, runs the monitor,
+// scheduler and prober, and writes the registry and command queues to
+// Redis. The others forward every request to it, and whichever gets the
+// lease after the leader goes away loads the shared state and takes over.
+
+const (
+	defaultClusterLease  = 15 * time.Second
+	defaultClusterPrefix = "wod"
+	minClusterLease      = 3 * time.Second
+
+	// Followers pass the client's address along, so ACLs, pinning and rate
+	// limits on the leader see the device rather than the follower. It is
+	// only trusted together with the cluster secret.
+	clusterClientAddrHeader = "X-WOD-Client-Addr"
+	clusterSecretHeader     = "X-WOD-Cluster-Secret"
+)
+
+// Lua scripts keep lease checks and writes atomic: only the holder may
+// renew or release the lease, or overwrite the shared state.
+const (
+	redisRenewScript   = `if redis.call('get', KEYS[1]) == ARGV[1] then return redis.call('pexpire', KEYS[1], ARGV[2]) end return 0`
+	redisReleaseScript = `if redis.call('get', KEYS[1]) == ARGV[1] then return redis.call('del', KEYS[1]) end return 0`
+	redisFencedSet     = `if redis.call('get', KEYS[1]) == ARGV[1] then redis.call('set', KEYS[2], ARGV[2]) return 1 end return 0`
+)
+
+// clusterNodeState holds the Server state kept in cluster.go.
+type clusterNodeState struct {
+	clusterSettings ClusterSettings
+	cluster         *clusterNode
+}
+
+func (srv *Server) clusterEnabled() bool {
+	return srv.clusterSettings.Redis != ""
+}
+
+type clusterNode struct {
+	redis    *redisClient
+	lease    time.Duration
+	holder   string // lease value: "<node_id> <advertise_url>"
+	leaseKey string
+	stateKey string
+
+	leader atomic.Bool
+
+	mu        sync.Mutex
+	leaderURL *url.URL // nil while no other node holds the lease
+}
+
+func (srv *Server) newClusterNode(s ClusterSettings) (*clusterNode, error) {
+	opts, err := parseRedisURL(s.Redis)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := url.Parse(s.Advertise); err != nil {
+		return nil, fmt.Errorf("invalid advertise URL: %w", err)
+	}
+	return &clusterNode{
+		redis:    newRedisClient(opts, srv.clientTLS),
+		lease:    s.Lease,
+		holder:   s.NodeID + " " + s.Advertise,
+		leaseKey: s.Prefix + ":leader",
+		stateKey: s.Prefix + ":state",
+	}, nil
+}
+
+// defaultNodeID names this node after the host and port.
+func (srv *Server) defaultNodeID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "wod"
+	}
+	return host + ":" + srv.serverPort
+}
+
+func (srv *Server) defaultAdvertiseURL() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	scheme := "http"
+	if srv.tlsEnabled() {
+		scheme = "https"
+	}
+	return scheme + "://" + host + ":" + srv.serverPort
+}
+
+// run waits for the leader lease, calls becomeLeader once it is held, and
+// then keeps it renewed. A leader that loses the lease exits so it can be
+// restarted as a follower; carrying on would let two nodes run the monitor
+// and overwrite each other's state.
+func (n *clusterNode) run(srv *Server, becomeLeader func()) {
+	clog := srv.logger("cluster")
+	ticker := time.NewTicker(n.lease / 3)
+	defer ticker.Stop()
+
+	for {
+		ok, err := n.acquire()
+		if err != nil {
+			clog.Error("Leader lease check failed", "error", err)
+		}
+		if ok {
+			break
+		}
+		n.refreshLeader(srv)
+		<-ticker.C
+	}
+
+	clog.Info("Acquired leader lease, loading shared state", "node", srv.clusterSettings.NodeID)
+	n.setLeaderURL(nil)
+	becomeLeader()
+	n.leader.Store(true)
+	clog.Info("Serving as cluster leader", "node", srv.clusterSettings.NodeID)
+
+	renewed := srv.now()
+	for range ticker.C {
+		if !n.leader.Load() {
+			return
+		}
+		// Heartbeats and queue changes don't save the registry themselves
+		srv.mu.Lock()
+		srv.saveRegistry()
+		srv.mu.Unlock()
+
+		ok, err := n.renew()
+		if !n.leader.Load() {
+			return
+		}
+		switch {
+		case err == nil && ok:
+			renewed = srv.now()
+		case err == nil:
+			srv.fatal("cluster", "Leader lease taken over by another node, exiting")
+		case srv.now().Sub(renewed) >= n.lease:
+			srv.fatal("cluster", "Leader lease expired while Redis was unreachable, exiting", "error", err)
+		default:
+			clog.Warn("Leader lease renewal failed", "error", err)
+		}
+	}
+}
+
+func (n *clusterNode) acquire() (bool, error) {
+	reply, err := n.redis.Do("SET", n.leaseKey, n.holder, "NX", "PX", leaseMillis(n.lease))
+	return reply == "OK", err
+}
+
+func (n *clusterNode) renew() (bool, error) {
+	reply, err := n.redis.Do("EVAL", redisRenewScript, "1", n.leaseKey, n.holder, leaseMillis(n.lease))
+	return reply == int64(1), err
+}
+
+// release hands the lease back on shutdown so a follower takes over without
+// waiting for it to expire.
+func (n *clusterNode) release(srv *Server) {
+	if !n.leader.Swap(false) {
+		return
+	}
+	if _, err := n.redis.Do("EVAL", redisReleaseScript, "1", n.leaseKey, n.holder); err != nil {
+		srv.logger("cluster").Error("Could not release leader lease", "error", err)
+	}
+	n.redis.Close()
+}
+
+// refreshLeader looks up which node holds the lease and where to reach it.
+func (n *clusterNode) refreshLeader(srv *Server) {
+	reply, err := n.redis.Do("GET", n.leaseKey)
+	if err != nil {
+		return
+	}
+	holder, _ := reply.(string)
+	_, addr, ok := strings.Cut(holder, " ")
+	if !ok || holder == n.holder {
+		n.setLeaderURL(nil)
+		return
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		n.setLeaderURL(nil)
+		return
+	}
+	n.mu.Lock()
+	if n.leaderURL == nil || n.leaderURL.String() != u.String() {
+		srv.logger("cluster").Info("Following cluster leader", "leader", strings.SplitN(holder, " ", 2)[0], "addr", addr)
+	}
+	n.leaderURL = u
+	n.mu.Unlock()
+}
+
+func (n *clusterNode) setLeaderURL(u *url.URL) {
+	n.mu.Lock()
+	n.leaderURL = u
+	n.mu.Unlock()
+}
+
+func (n *clusterNode) currentLeader() *url.URL {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.leaderURL
+}
+
+func leaseMillis(d time.Duration) string {
+	return fmt.Sprint(d.Milliseconds())
+}
+
+// withCluster forwards requests to the leader while this node is a
+// follower. Probes and metrics describe the node itself and are always
+// served locally.
+func (srv *Server) withCluster(next http.Handler) http.Handler {
+	if !srv.clusterEnabled() {
+		return next
+	}
+	transport := srv.clientTransport
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch strings.TrimPrefix(r.URL.Path, APIPrefix) {
+		case "/healthz", "/readyz", "/health", "/metrics":
+			next.ServeHTTP(w, r)
+			return
+		}
+		if srv.cluster.leader.Load() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		target := srv.cluster.currentLeader()
+		if target == nil {
+			w.Header().Set("Retry-After", "1")
+			writeError(w, CodeUnavailable, "no cluster leader")
+			return
+		}
+
+		r.Header.Set(clusterClientAddrHeader, srv.remoteHost(r))
+		if srv.clusterSettings.Secret != "" {
+			r.Header.Set(clusterSecretHeader, srv.clusterSettings.Secret)
+		}
+		proxy := &httputil.ReverseProxy{
+			Rewrite: func(pr *httputil.ProxyRequest) {
+				pr.SetURL(target)
+				pr.SetXForwarded()
+				pr.Out.Host = pr.In.Host
+			},
+			Transport: transport,
+			ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+				srv.logger("cluster").Warn("Forwarding to leader failed", "leader", target.String(), "path", r.URL.Path, "error", err)
+				writeError(w, CodeUpstreamFailed, "cluster leader unreachable")
+			},
+		}
+		proxy.ServeHTTP(w, r)
+	})
+}
+
+// forwardedClientAddr returns the address a follower forwarded the request
+// for, or "" unless the request carries the cluster secret.
+func (srv *Server) forwardedClientAddr(r *http.Request) string {
+	if srv.clusterSettings.Secret == "" {
+		return ""
+	}
+	addr := r.Header.Get(clusterClientAddrHeader)
+	if addr == "" {
+		return ""
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get(clusterSecretHeader)), []byte(srv.clusterSettings.Secret)) != 1 {
+		return ""
+	}
+	return addr
+}
+
+// redisRegistry keeps the registry and the command queues in one Redis key,
+// so a new leader picks up queued commands along with the devices.
+type redisRegistry struct {
+	node *clusterNode
+	srv  *Server
+}
+
+type clusterState struct {
+	regstore.Snapshot[*ESP]
+	Queues map[string][]*CommandRecord `json:"queues,omitempty"`
+}
+
+func (r redisRegistry) Load() (map[string]*ESP, error) {
+	esps := make(map[string]*ESP)
+
+	reply, err := r.node.redis.Do("GET", r.node.stateKey)
+	if err != nil {
+		return nil, err
+	}
+	data, ok := reply.(string)
+	if !ok {
+		return esps, nil
+	}
+
+	var state clusterState
+	if err := json.Unmarshal([]byte(data), &state); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", r.node.stateKey, err)
+	}
+	esps = state.Records(espKey)
+	for id, esp := range esps {
+		esp.Queue = state.Queues[id]
+	}
+	return esps, nil
+}
+
+func (r redisRegistry) Save(esps map[string]*ESP) error {
+	state := clusterState{
+		Snapshot: regstore.NewSnapshot(esps, r.srv.now()),
+		Queues:   make(map[string][]*CommandRecord),
+	}
+	for _, esp := range esps {
+		if len(esp.Queue) > 0 {
+			state.Queues[esp.ID] = esp.Queue
+		}
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	reply, err := r.node.redis.Do("EVAL", redisFencedSet, "2", r.node.leaseKey, r.node.stateKey, r.node.holder, string(data))
+	if err != nil {
+		return err
+	}
+	if reply != int64(1) {
+		return errors.New("not the cluster leader, state not saved")
+	}
+	return nil
+}
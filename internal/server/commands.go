@@ -0,0 +1,421 @@
+package server
+
+import (
+	"cmp"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type CommandState string
+
+const (
+	StateQueued    CommandState = "queued"
+	StateDelivered CommandState = "delivered"
+	StateAcked     CommandState = "acked"
+	StateFailed    CommandState = "failed"
+	// StateExpired is a command whose TTL ran out before it was delivered
+	StateExpired CommandState = "expired"
+)
+
+// CommandPriority orders a device's queue: urgent commands go ahead of
+// normal ones, and those ahead of low ones.
+type CommandPriority string
+
+const (
+	PriorityLow    CommandPriority = "low"
+	PriorityNormal CommandPriority = "normal"
+	PriorityUrgent CommandPriority = "urgent"
+)
+
+func ParsePriority(s string) (CommandPriority, error) {
+	switch p := CommandPriority(strings.ToLower(s)); p {
+	case "":
+		return PriorityNormal, nil
+	case PriorityLow, PriorityNormal, PriorityUrgent:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown priority %q (use low, normal or urgent)", s)
+}
+
+// rank orders priorities; records from before priorities existed are normal.
+func (p CommandPriority) rank() int {
+	switch p {
+	case PriorityLow:
+		return 0
+	case PriorityUrgent:
+		return 2
+	}
+	return 1
+}
+
+const (
+	commandRetention  = 24 * time.Hour
+	maxCommandRecords = 1000
+	// maxResultFields bounds the result payload an ESP may attach to a report
+	maxResultFields = 32
+)
+
+type CommandRecord struct {
+	ID          string       `json:"id"`
+	ESPID       string       `json:"esp_id"`
+	Command     ESPCommand   `json:"command"`
+	Action      string       `json:"action,omitempty"` // for CommandAction
+	DurationMS  int          `json:"duration_ms,omitempty"`
+	Actor       string       `json:"actor,omitempty"` // who sent it, as in the event log
+	Status      CommandState `json:"status"`
+	Error       string       `json:"error,omitempty"`
+	Seq         uint64       `json:"seq,omitempty"` // delivery order, see nextCommandSeq
+	QueuedAt    time.Time    `json:"queued_at"`
+	ExpiresAt   *time.Time   `json:"expires_at,omitempty"`
+	DeliveredAt *time.Time   `json:"delivered_at,omitempty"`
+	CompletedAt *time.Time   `json:"completed_at,omitempty"`
+	// Result is what the ESP reported along with the outcome, e.g.
+	// {"power": "on"} for status
+	Result map[string]interface{} `json:"result,omitempty"`
+	Verify *VerifyStatus          `json:"verify,omitempty"`
+	// Priority is where it went in the device's queue
+	Priority CommandPriority `json:"priority,omitempty"`
+}
+
+// CommandReport is an ESP's report on a delivered command, sent to
+// /command-ack or /command-result, or over MQTT.
+type CommandReport struct {
+	ID        string                 `json:"id"`
+	CommandID string                 `json:"command_id"`
+	Success   bool                   `json:"success"`
+	Error     string                 `json:"error,omitempty"`
+	Result    map[string]interface{} `json:"result,omitempty"`
+	Stale     bool                   `json:"stale,omitempty"` // refused as too old or a replay
+}
+
+// commandsState holds the Server state kept in commands.go.
+type commandsState struct {
+	// Command lifecycle records keyed by command ID; guarded by mu
+	commands map[string]*CommandRecord
+
+	// lastCommandSeq is the last sequence number handed out. Must be used with
+	// mu held.
+	lastCommandSeq uint64
+}
+
+func NewCommandID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// nextCommandSeq returns a number above any earlier one. Starting from the
+// clock keeps it rising across restarts, even with an in-memory registry,
+// so a device that stayed up doesn't take new commands for replays. Must
+// be called with mu held.
+func (srv *Server) nextCommandSeq() uint64 {
+	srv.lastCommandSeq = max(srv.lastCommandSeq+1, uint64(srv.now().UnixMilli()))
+	return srv.lastCommandSeq
+}
+
+func (c *CommandRecord) finished() bool {
+	return c.Status == StateAcked || c.Status == StateFailed || c.Status == StateExpired
+}
+
+// setTTL makes the command expire if it is still undelivered after ttl;
+// zero never expires.
+func (c *CommandRecord) setTTL(ttl time.Duration) {
+	if ttl > 0 {
+		expires := c.QueuedAt.Add(ttl)
+		c.ExpiresAt = &expires
+	}
+}
+
+func (c *CommandRecord) pastTTL(now time.Time) bool {
+	return c.Status == StateQueued && c.ExpiresAt != nil && now.After(*c.ExpiresAt)
+}
+
+func (c *CommandRecord) ttlReason() string {
+	return fmt.Sprintf("not delivered within %s", c.ExpiresAt.Sub(c.QueuedAt).Round(time.Second))
+}
+
+// newCommandRecord starts tracking a command. Must be called with mu held.
+func (srv *Server) newCommandRecord(espID string, cmd ESPCommand) *CommandRecord {
+	rec := &CommandRecord{
+		ID:       NewCommandID(),
+		ESPID:    espID,
+		Command:  cmd,
+		Status:   StateQueued,
+		QueuedAt: srv.now(),
+	}
+	srv.commands[rec.ID] = rec
+	srv.metricCommandsQueued.Inc(espID, string(cmd))
+	return rec
+}
+
+// markDelivered moves a queued command to delivered. Must be called with mu held.
+func (srv *Server) markDelivered(rec *CommandRecord) {
+	if rec.Status != StateQueued {
+		return
+	}
+	now := srv.now()
+	rec.Status = StateDelivered
+	rec.DeliveredAt = &now
+	srv.metricCommandsDelivered.Inc(rec.ESPID, string(rec.Command))
+	srv.recordEvent(Event{Type: EventDelivered, ESPID: rec.ESPID, Command: rec.Command, CommandID: rec.ID})
+}
+
+func (srv *Server) ackCommand(rec *CommandRecord) {
+	now := srv.now()
+	rec.Status = StateAcked
+	rec.CompletedAt = &now
+	if rec.Verify != nil && rec.Verify.UpAt == nil {
+		rec.Status = StateVerifying
+		rec.CompletedAt = nil
+	}
+	srv.metricCommandsAcked.Inc(rec.ESPID, string(rec.Command))
+	srv.recordEvent(Event{Type: EventAcked, ESPID: rec.ESPID, Command: rec.Command, CommandID: rec.ID})
+}
+
+func (srv *Server) failCommand(rec *CommandRecord, reason string) {
+	now := srv.now()
+	rec.Status = StateFailed
+	rec.Error = reason
+	rec.CompletedAt = &now
+	srv.metricCommandsFailed.Inc(rec.ESPID, string(rec.Command))
+	srv.recordEvent(Event{Type: EventFailed, ESPID: rec.ESPID, Command: rec.Command, CommandID: rec.ID, Detail: reason})
+}
+
+func (srv *Server) expireCommand(rec *CommandRecord, reason string) {
+	now := srv.now()
+	rec.Status = StateExpired
+	rec.Error = reason
+	rec.CompletedAt = &now
+	srv.metricCommandsExpired.Inc(rec.ESPID, string(rec.Command))
+	srv.logger("queue").Info("Command expired", "esp_id", rec.ESPID, "command", rec.Command, "command_id", rec.ID)
+	srv.recordEvent(Event{Type: EventExpired, ESPID: rec.ESPID, Command: rec.Command, CommandID: rec.ID, Detail: rec.Error})
+}
+
+var (
+	errUnknownCommand  = errors.New("unknown command")
+	errCommandFinished = errors.New("command already finished")
+)
+
+// settleCommand applies a device's report on a command. The report also
+// counts as a heartbeat, and a "power" field in its result as a power
+// sensor reading. Must be called with mu held.
+func (srv *Server) settleCommand(espID string, rep CommandReport) (*CommandRecord, error) {
+	rec, exists := srv.commands[rep.CommandID]
+	if !exists || rec.ESPID != espID {
+		return nil, errUnknownCommand
+	}
+	if rec.finished() {
+		return rec, errCommandFinished
+	}
+
+	// Soft-off is acknowledged by the agent, not the ESP
+	esp, exists := srv.espMap[espID]
+	if exists && rec.Command != CommandSoftOff {
+		esp.markSeen(srv, "")
+	}
+
+	srv.markDelivered(rec)
+	if len(rep.Result) > 0 {
+		rec.Result = rep.Result
+	}
+	if power, ok := rep.Result["power"].(string); ok && exists {
+		esp.powerSensor(srv, power)
+	}
+	switch {
+	case rep.Success:
+		srv.ackCommand(rec)
+	case rep.Stale:
+		// The device didn't act on it, so it counts as expired, not failed
+		srv.expireCommand(rec, "refused by the device: "+cmp.Or(rep.Error, "stale"))
+	default:
+		srv.failCommand(rec, rep.Error)
+	}
+	// Persists the outcome in the command history
+	srv.saveRegistry()
+	return rec, nil
+}
+
+// CommandHistorySize is how many commands each ESP's history keeps.
+const CommandHistorySize = 50
+
+// addHistory appends rec to the ESP's persisted command history, dropping
+// the oldest entry when it is full. Must be called with mu held.
+func (e *ESP) addHistory(rec *CommandRecord) {
+	if slices.Contains(e.History, rec) {
+		return
+	}
+	e.History = append(e.History, rec)
+	if over := len(e.History) - CommandHistorySize; over > 0 {
+		e.History = slices.Clone(e.History[over:])
+	}
+}
+
+// restoreHistory puts loaded history entries back in the command index so
+// delivered commands can still be acked after a restart. Queued commands
+// weren't saved with the queue unless clustered, so those are lost. Must
+// be called with mu held.
+func (srv *Server) restoreHistory(esp *ESP) {
+	for i, rec := range esp.History {
+		if live, exists := srv.commands[rec.ID]; exists {
+			esp.History[i] = live
+			continue
+		}
+		switch rec.Status {
+		case StateQueued, StateVerifying:
+			now := srv.now()
+			rec.Status = StateFailed
+			rec.Error = "dropped by a server restart"
+			rec.CompletedAt = &now
+		}
+		srv.commands[rec.ID] = rec
+	}
+}
+
+// pruneCommands drops old finished records. Must be called with mu held.
+func (srv *Server) pruneCommands() {
+	now := srv.now()
+	for id, rec := range srv.commands {
+		if rec.finished() && now.Sub(*rec.CompletedAt) > commandRetention {
+			delete(srv.commands, id)
+		}
+	}
+
+	for len(srv.commands) > maxCommandRecords {
+		var oldest *CommandRecord
+		for _, rec := range srv.commands {
+			if oldest == nil || rec.QueuedAt.Before(oldest.QueuedAt) {
+				oldest = rec
+			}
+		}
+		delete(srv.commands, oldest.ID)
+	}
+}
+
+func (srv *Server) commandAckHandler(w http.ResponseWriter, r *http.Request) {
+	rlog := srv.requestLogger(r)
+
+	if r.Method != http.MethodPost {
+		rlog.Warn("Method not allowed", "method", r.Method)
+		writeError(w, CodeMethodNotAllowed, "only POST allowed")
+		return
+	}
+
+	var data CommandReport
+	if err := decodeJSON(w, r, &data); err != nil {
+		rlog.Warn("Invalid JSON", "error", err)
+		return
+	}
+	data.ID = espID(r)
+	if len(data.Result) > maxResultFields {
+		writeError(w, CodeInvalidRequest, fmt.Sprintf("result has more than %d fields", maxResultFields))
+		return
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if esp, exists := srv.espMap[data.ID]; exists && !srv.checkPin(w, r, esp) {
+		return
+	}
+	rec, err := srv.settleCommand(data.ID, data)
+	switch {
+	case errors.Is(err, errUnknownCommand):
+		rlog.Warn("Ack for unknown command", "esp_id", data.ID, "command_id", data.CommandID)
+		writeError(w, CodeNotFound, "unknown command")
+		return
+	case errors.Is(err, errCommandFinished):
+		rlog.Warn("Ack for finished command", "esp_id", data.ID, "command_id", data.CommandID, "status", rec.Status)
+		writeError(w, CodeCommandFinished, fmt.Sprintf("command already %s", rec.Status))
+		return
+	}
+
+	if data.Success {
+		rlog.Info("Command acknowledged", "esp_id", data.ID, "command", rec.Command, "command_id", rec.ID, "result", rec.Result)
+	} else {
+		rlog.Warn("Command failed on ESP", "esp_id", data.ID, "command", rec.Command, "command_id", rec.ID, "error", data.Error)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": string(rec.Status)})
+}
+
+// commandResultHandler serves a command's record, and takes ESP reports
+// with a result payload on POST.
+func (srv *Server) commandResultHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		srv.commandAckHandler(w, r)
+		return
+	}
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		writeError(w, CodeInvalidRequest, "missing id")
+		return
+	}
+
+	srv.mu.Lock()
+	rec, exists := srv.commands[id]
+	var snapshot CommandRecord
+	if exists {
+		snapshot = *rec
+	}
+	srv.mu.Unlock()
+
+	if !exists || !requestPrincipal(r).canView(snapshot.ESPID) {
+		writeError(w, CodeNotFound, "unknown command")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snapshot)
+}
+
+// historyHandler serves GET /esps/{id}/commands, newest first.
+func (srv *Server) historyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, CodeMethodNotAllowed, "only GET allowed")
+		return
+	}
+	limit := CommandHistorySize
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			writeError(w, CodeInvalidRequest, "limit must be a positive number")
+			return
+		}
+		limit = n
+	}
+	id := srv.resolveAlias(r.PathValue("id"))
+
+	srv.mu.Lock()
+	esp, exists := srv.espMap[id]
+	history := []CommandRecord{}
+	if exists {
+		for _, rec := range slices.Backward(esp.History) {
+			if len(history) == limit {
+				break
+			}
+			history = append(history, *rec)
+		}
+	}
+	srv.mu.Unlock()
+
+	if !exists || !requestPrincipal(r).canView(id) {
+		writeError(w, CodeESPNotFound, "ESP not registered")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(commandHistory{ID: id, Commands: history})
+}
+
+type commandHistory struct {
+	ID       string          `json:"id"`
+	Commands []CommandRecord `json:"commands"`
+}
@@ -0,0 +1,523 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+type Config struct {
+	Port         string                `yaml:"port"`
+	Listen       []string              `yaml:"listen"`
+	AdminSocket  string                `yaml:"admin_socket"`
+	GRPCPort     string                `yaml:"grpc_port"`
+	Server       string                `yaml:"server"`
+	Timeout      time.Duration         `yaml:"timeout"`
+	DrainTimeout time.Duration         `yaml:"drain_timeout"`
+	QueueDepth   int                   `yaml:"queue_depth"`
+	CommandTTL   time.Duration         `yaml:"command_ttl"`
+	ProbeEvery   time.Duration         `yaml:"probe_interval"`
+	Store        string                `yaml:"store"`
+	Registry     string                `yaml:"registry"`
+	Schedules    string                `yaml:"schedules"`
+	Events       string                `yaml:"events"`
+	UptimeDir    string                `yaml:"uptime_dir"`
+	Groups       string                `yaml:"groups"`
+	OTADir       string                `yaml:"ota_dir"`
+	DataDir      string                `yaml:"data_dir"`
+	ESPRetention string                `yaml:"esp_retention"`
+	Auth         AuthSettings          `yaml:"auth"`
+	Aliases      map[string]string     `yaml:"aliases"`
+	Targets      map[string]Target     `yaml:"targets"`
+	VMs          map[string]VMSettings `yaml:"vms"`
+	TLS          TLSSettings           `yaml:"tls"`
+	Log          LogSettings           `yaml:"log"`
+	MQTT         MQTTSettings          `yaml:"mqtt"`
+	Telegram     TelegramSettings      `yaml:"telegram"`
+	MDNS         MDNSSettings          `yaml:"mdns"`
+	UPS          UPSSettings           `yaml:"ups"`
+	Tracing      TracingSettings       `yaml:"tracing"`
+	RateLimit    RateLimitSettings     `yaml:"rate_limit"`
+	ESPNetwork   ESPNetworkSettings    `yaml:"esp_network"`
+	CORS         CORSSettings          `yaml:"cors"`
+	Cluster      ClusterSettings       `yaml:"cluster"`
+	IdlePolicies []IdlePolicy          `yaml:"idle_policies"`
+
+	Notifications NotifySettings `yaml:"notifications"`
+	// Webhooks get audit events as JSON, see webhooks.go
+	Webhooks []WebhookSettings `yaml:"webhooks"`
+	// IdempotencyWindow is how long Idempotency-Key headers are remembered
+	IdempotencyWindow time.Duration `yaml:"idempotency_window"`
+	// CommandMaxAge is how long after delivery devices may act on a command
+	CommandMaxAge time.Duration `yaml:"command_max_age"`
+	// CommandCooldown is how long devices refuse on and off after one
+	CommandCooldown time.Duration `yaml:"command_cooldown"`
+	// MonitorGranularity is how late offline checks may run, to spread them
+	MonitorGranularity time.Duration `yaml:"monitor_granularity"`
+	// WebPush sends device state changes to browsers that subscribed from
+	// the dashboard
+	WebPush WebPushSettings `yaml:"web_push"`
+	// SSH has soft-off log in to targets without an agent, by ESP ID or
+	// alias
+	SSH map[string]SSHSettings `yaml:"ssh"`
+	// Poll sets the next_poll_ms hint in poll responses
+	Poll PollSettings `yaml:"poll"`
+	// Update is where self-update looks for releases
+	Update UpdateSettings `yaml:"update"`
+	// StatusPage is the read-only page at /status, see status.go
+	StatusPage StatusPageSettings `yaml:"status_page"`
+	// ServiceRegistry registers the server in Consul or etcd
+	ServiceRegistry ServiceRegistrySettings `yaml:"service_registry"`
+	// WakeHooks are steps to run once a woken target is up, by ESP ID or
+	// alias, see wakehooks.go
+	WakeHooks map[string][]WakeHook `yaml:"wake_hooks"`
+	// Quotas cap the commands devices get, see quota.go
+	Quotas QuotaSettings `yaml:"quotas"`
+	// Backup takes automatic backups, see backup.go
+	Backup BackupSettings `yaml:"backup"`
+	// Beacon listens for UDP heartbeats from devices, see beacon.go
+	Beacon BeaconSettings `yaml:"beacon"`
+	// TelemetryDir keeps the telemetry history, TelemetryHistory sets how
+	// much of it, see telemetryhistory.go
+	TelemetryDir     string                   `yaml:"telemetry_dir"`
+	TelemetryHistory TelemetryHistorySettings `yaml:"telemetry_history"`
+	// Macros are named sequences of steps for 'run', see macros.go
+	Macros map[string]Macro `yaml:"macros"`
+}
+
+type NotifySettings struct {
+	// WakeTimeout is how long a target may take to come up after 'on'
+	// before target_unreachable fires.
+	WakeTimeout time.Duration `yaml:"wake_timeout"`
+	// BatteryLow is the voltage under which battery_low fires for ESPs
+	// that report one; 0 turns the check off.
+	BatteryLow float64              `yaml:"battery_low"`
+	Sinks      []NotifySinkSettings `yaml:"sinks"`
+}
+
+// NotifySinkSettings configures one sink. Which fields apply depends on Type:
+// webhook uses URL, telegram BotToken and ChatID (URL overrides the API
+// endpoint), smtp Host, Username, Password, From and To.
+type NotifySinkSettings struct {
+	Type     string   `yaml:"type"`
+	Triggers []string `yaml:"triggers"`
+
+	URL      string   `yaml:"url"`
+	BotToken string   `yaml:"bot_token"`
+	ChatID   string   `yaml:"chat_id"`
+	Host     string   `yaml:"host"`
+	Username string   `yaml:"username"`
+	Password string   `yaml:"password"`
+	From     string   `yaml:"from"`
+	To       []string `yaml:"to"`
+}
+
+// RateLimitSettings are requests per minute; -1 disables a limit.
+type RateLimitSettings struct {
+	PerIP    int `yaml:"per_ip"`
+	IPBurst  int `yaml:"ip_burst"`
+	PerESP   int `yaml:"per_esp"`
+	ESPBurst int `yaml:"esp_burst"`
+}
+
+// ESPNetworkSettings restricts the addresses ESPs may connect from. Lists
+// take CIDRs or single addresses; empty lists allow any address.
+type ESPNetworkSettings struct {
+	RegisterAllow []string `yaml:"register_allow"`
+	// CommandAllow applies to polling, the WebSocket channel and acks
+	CommandAllow []string `yaml:"command_allow"`
+	// PinIP ties each ESP ID to the address that first registered it
+	PinIP bool `yaml:"pin_ip"`
+	// DuplicateIDs is reject, quarantine or allow; see claimID
+	DuplicateIDs string `yaml:"duplicate_ids"`
+	// Pairing is off, approve or code; see holdForPairing
+	Pairing string `yaml:"pairing"`
+}
+
+type MQTTSettings struct {
+	Broker      string `yaml:"broker"`
+	Username    string `yaml:"username"`
+	Password    string `yaml:"password"`
+	ClientID    string `yaml:"client_id"`
+	TopicPrefix string `yaml:"topic_prefix"`
+
+	AvailabilityTopic string `yaml:"availability_topic"`
+	Discovery         bool   `yaml:"discovery"`
+	DiscoveryPrefix   string `yaml:"discovery_prefix"`
+}
+
+// TelegramSettings configures the bot that takes commands from Telegram.
+// Only the chats listed in Chats may use it; API overrides the Bot API
+// endpoint.
+type TelegramSettings struct {
+	BotToken string  `yaml:"bot_token"`
+	Chats    []int64 `yaml:"chats"`
+	API      string  `yaml:"api"`
+}
+
+// MDNSSettings controls advertising the server over mDNS. Name is the
+// instance name clients see, the hostname by default.
+type MDNSSettings struct {
+	Enabled *bool  `yaml:"enabled"`
+	Name    string `yaml:"name"`
+}
+
+// UPSSettings connects to a NUT server (driver nut) or apcupsd to follow
+// mains power. Name is the UPS on the NUT server; Username and Password are
+// only needed if upsd asks for them.
+type UPSSettings struct {
+	Driver       string        `yaml:"driver"`
+	Address      string        `yaml:"address"`
+	Name         string        `yaml:"name"`
+	Username     string        `yaml:"username"`
+	Password     string        `yaml:"password"`
+	PollInterval time.Duration `yaml:"poll_interval"`
+	OnBattery    []UPSAction   `yaml:"on_battery"`
+	OnLowBattery []UPSAction   `yaml:"on_low_battery"`
+	OnRestore    []UPSAction   `yaml:"on_restore"`
+}
+
+// TracingSettings sends OpenTelemetry traces over OTLP/HTTP. Endpoint is
+// the collector's base URL (/v1/traces is added); Headers go with every
+// export, e.g. for authentication.
+type TracingSettings struct {
+	Endpoint    string            `yaml:"endpoint"`
+	Headers     map[string]string `yaml:"headers"`
+	ServiceName string            `yaml:"service_name"`
+	SampleRatio *float64          `yaml:"sample_ratio"`
+}
+
+// ClusterSettings configures running several servers against one Redis.
+// Advertise is the URL other nodes forward requests to; Secret lets the
+// leader trust the client address followers pass along.
+type ClusterSettings struct {
+	Redis     string        `yaml:"redis"`
+	NodeID    string        `yaml:"node_id"`
+	Advertise string        `yaml:"advertise"`
+	Secret    string        `yaml:"secret"`
+	Prefix    string        `yaml:"key_prefix"`
+	Lease     time.Duration `yaml:"lease"`
+}
+
+type LogSettings struct {
+	Format string            `yaml:"format"`
+	Level  string            `yaml:"level"`
+	Access AccessLogSettings `yaml:"access"`
+}
+
+type AuthSettings struct {
+	AdminKey  string            `yaml:"admin_key"`
+	ESPTokens map[string]string `yaml:"esp_tokens"`
+	// NamespaceTokens is the token the ESPs of a namespace register with,
+	// unless they have their own in ESPTokens
+	NamespaceTokens map[string]string `yaml:"namespace_tokens"`
+	Users           string            `yaml:"users_file"`
+	// Secrets is the file device secrets for signed requests are kept in
+	Secrets string `yaml:"secrets_file"`
+	// RequireSigned rejects unsigned requests from ESPs without a secret too
+	RequireSigned bool            `yaml:"require_signed"`
+	Sessions      SessionSettings `yaml:"sessions"`
+	OIDC          OIDCSettings    `yaml:"oidc"`
+}
+
+type TLSSettings struct {
+	Cert       string `yaml:"cert"`
+	Key        string `yaml:"key"`
+	ACMEDomain string `yaml:"acme_domain"`
+	ACMECache  string `yaml:"acme_cache"`
+	ACMEEmail  string `yaml:"acme_email"`
+	CA         string `yaml:"ca"`
+	Insecure   bool   `yaml:"insecure_skip_verify"`
+}
+
+// configState holds the Server state kept in config.go.
+type configState struct {
+	config     *Config
+	configPath string
+}
+
+// LoadConfig reads the YAML config file at path.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &Config{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// Validate reports everything wrong with the config, to print all at once.
+func (c *Config) Validate() []error {
+	var errs []error
+
+	if c.Port != "" {
+		if port, err := strconv.Atoi(c.Port); err != nil || port < 1 || port > 65535 {
+			errs = append(errs, fmt.Errorf("port: %q is not a valid TCP port", c.Port))
+		}
+	}
+
+	if _, err := parseListen(c.Listen); err != nil {
+		errs = append(errs, fmt.Errorf("listen: %v", err))
+	}
+
+	if c.GRPCPort != "" {
+		if port, err := strconv.Atoi(c.GRPCPort); err != nil || port < 1 || port > 65535 {
+			errs = append(errs, fmt.Errorf("grpc_port: %q is not a valid TCP port", c.GRPCPort))
+		}
+	}
+
+	if c.Server != "" {
+		u, err := url.Parse(c.Server)
+		switch {
+		case err == nil && u.Scheme == "unix":
+			if u.Path == "" {
+				errs = append(errs, fmt.Errorf("server: %q has no socket path", c.Server))
+			}
+		case err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "":
+			errs = append(errs, fmt.Errorf("server: %q must be an http://, https:// or unix:// URL", c.Server))
+		}
+	}
+
+	if c.Timeout < 0 {
+		errs = append(errs, fmt.Errorf("timeout: must be positive, got %v", c.Timeout))
+	}
+	if c.CommandTTL < 0 {
+		errs = append(errs, fmt.Errorf("command_ttl: must be positive, got %v", c.CommandTTL))
+	}
+	if c.QueueDepth < 0 {
+		errs = append(errs, fmt.Errorf("queue_depth: must be positive, got %d", c.QueueDepth))
+	}
+	if c.ProbeEvery < 0 {
+		errs = append(errs, fmt.Errorf("probe_interval: must be positive, got %v", c.ProbeEvery))
+	}
+	if c.CommandMaxAge < 0 {
+		errs = append(errs, fmt.Errorf("command_max_age: must be positive, got %v", c.CommandMaxAge))
+	}
+	if c.CommandCooldown < 0 || c.CommandCooldown > maxCooldown {
+		errs = append(errs, fmt.Errorf("command_cooldown: must be between 0 and %s, got %v", maxCooldown, c.CommandCooldown))
+	}
+	if c.MonitorGranularity < 0 || c.MonitorGranularity > maxMonitorGranularity {
+		errs = append(errs, fmt.Errorf("monitor_granularity: must be between 0 and %s, got %v", maxMonitorGranularity, c.MonitorGranularity))
+	}
+	if c.DrainTimeout < 0 {
+		errs = append(errs, fmt.Errorf("drain_timeout: must be positive, got %v", c.DrainTimeout))
+	}
+	if c.IdempotencyWindow < 0 {
+		errs = append(errs, fmt.Errorf("idempotency_window: must be positive, got %v", c.IdempotencyWindow))
+	}
+	if c.ESPRetention != "" {
+		if _, err := parseRetention(c.ESPRetention); err != nil {
+			errs = append(errs, fmt.Errorf("esp_retention: %v", err))
+		}
+	}
+
+	if c.Telegram.BotToken != "" && len(c.Telegram.Chats) == 0 {
+		errs = append(errs, errors.New("telegram: chats must list the chat IDs allowed to send commands"))
+	}
+	if c.MQTT.Broker != "" {
+		if _, _, err := parseMQTTBroker(c.MQTT.Broker); err != nil {
+			errs = append(errs, fmt.Errorf("mqtt.broker: %v", err))
+		}
+	}
+	for name, topic := range map[string]string{
+		"topic_prefix":       c.MQTT.TopicPrefix,
+		"availability_topic": c.MQTT.AvailabilityTopic,
+		"discovery_prefix":   c.MQTT.DiscoveryPrefix,
+	} {
+		if strings.ContainsAny(topic, "+#") {
+			errs = append(errs, fmt.Errorf("mqtt.%s: %q cannot contain MQTT wildcards", name, topic))
+		}
+	}
+
+	if c.Cluster.Redis != "" {
+		if _, err := parseRedisURL(c.Cluster.Redis); err != nil {
+			errs = append(errs, fmt.Errorf("cluster.redis: %v", err))
+		}
+	}
+	if c.Cluster.Advertise != "" {
+		u, err := url.Parse(c.Cluster.Advertise)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("cluster.advertise: %q must be an http:// or https:// URL", c.Cluster.Advertise))
+		}
+	}
+	if c.Cluster.Lease != 0 && c.Cluster.Lease < minClusterLease {
+		errs = append(errs, fmt.Errorf("cluster.lease: must be at least %v, got %v", minClusterLease, c.Cluster.Lease))
+	}
+
+	if _, err := parseCIDRs(c.ESPNetwork.RegisterAllow); err != nil {
+		errs = append(errs, fmt.Errorf("esp_network.register_allow: %v", err))
+	}
+	if _, err := parseCIDRs(c.ESPNetwork.CommandAllow); err != nil {
+		errs = append(errs, fmt.Errorf("esp_network.command_allow: %v", err))
+	}
+	if _, _, err := parseStoreSpec(c.Store); err != nil {
+		errs = append(errs, fmt.Errorf("store: %v", err))
+	}
+	if err := c.CORS.normalize().validate(); err != nil {
+		errs = append(errs, fmt.Errorf("cors: %v", err))
+	}
+	if c.ESPNetwork.DuplicateIDs != "" {
+		if _, err := parseDuplicatePolicy(c.ESPNetwork.DuplicateIDs); err != nil {
+			errs = append(errs, fmt.Errorf("esp_network.duplicate_ids: %v", err))
+		}
+	}
+	if c.ESPNetwork.Pairing != "" {
+		if _, err := parsePairingMode(c.ESPNetwork.Pairing); err != nil {
+			errs = append(errs, fmt.Errorf("esp_network.pairing: %v", err))
+		}
+	}
+	if c.RateLimit.PerIP < -1 || c.RateLimit.PerESP < -1 {
+		errs = append(errs, fmt.Errorf("rate_limit: limits must be positive, or -1 to disable"))
+	}
+	if c.RateLimit.IPBurst < 0 || c.RateLimit.ESPBurst < 0 {
+		errs = append(errs, fmt.Errorf("rate_limit: bursts must be positive"))
+	}
+
+	if c.Notifications.WakeTimeout < 0 {
+		errs = append(errs, fmt.Errorf("notifications.wake_timeout: must be positive, got %v", c.Notifications.WakeTimeout))
+	}
+	if c.Notifications.BatteryLow < 0 {
+		errs = append(errs, fmt.Errorf("notifications.battery_low: must be positive, got %v", c.Notifications.BatteryLow))
+	}
+	for i, sink := range c.Notifications.Sinks {
+		errs = append(errs, validateNotifySink(i, sink)...)
+	}
+	errs = append(errs, validateWebhooks(c.Webhooks)...)
+
+	for id, token := range c.Auth.ESPTokens {
+		if id == "" || token == "" {
+			errs = append(errs, fmt.Errorf("auth.esp_tokens: entry %q has an empty ID or token", id))
+		}
+	}
+	for ns, token := range c.Auth.NamespaceTokens {
+		if err := ValidateNamespace(ns); err != nil {
+			errs = append(errs, fmt.Errorf("auth.namespace_tokens: entry %q: %v", ns, err))
+		} else if token == "" {
+			errs = append(errs, fmt.Errorf("auth.namespace_tokens: entry %q has an empty token", ns))
+		}
+	}
+
+	if c.Auth.Sessions.TTL < 0 {
+		errs = append(errs, fmt.Errorf("auth.sessions.ttl: must be positive, got %v", c.Auth.Sessions.TTL))
+	}
+	errs = append(errs, validateOIDC(c.Auth.OIDC)...)
+
+	for alias, id := range c.Aliases {
+		if alias == "" || id == "" {
+			errs = append(errs, fmt.Errorf("aliases: entry %q has an empty alias or ESP ID", alias))
+			continue
+		}
+		if _, chained := c.Aliases[id]; chained {
+			errs = append(errs, fmt.Errorf("aliases: %q points to another alias %q", alias, id))
+		}
+	}
+
+	for id, target := range c.Targets {
+		if err := target.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("targets.%s: %v", id, err))
+		}
+	}
+
+	for name, vm := range c.VMs {
+		errs = append(errs, validateVM(name, vm)...)
+	}
+	for name, s := range c.SSH {
+		errs = append(errs, validateSSH(name, s)...)
+	}
+
+	errs = append(errs, validateUPS(c.UPS)...)
+	errs = append(errs, validateWebPush(c.WebPush)...)
+	errs = append(errs, validatePoll(c.Poll)...)
+	errs = append(errs, validateUpdate(c.Update)...)
+	errs = append(errs, validateStatusPage(c.StatusPage)...)
+	errs = append(errs, validateServiceRegistry(c.ServiceRegistry)...)
+	errs = append(errs, validateWakeHooks(c.WakeHooks)...)
+	errs = append(errs, validateQuotas(c.Quotas)...)
+	errs = append(errs, validateBackup(c.Backup)...)
+	errs = append(errs, validateBeacon(c.Beacon)...)
+	errs = append(errs, validateTelemetryHistory(c.TelemetryHistory)...)
+	errs = append(errs, validateMacros(c.Macros)...)
+
+	if c.Tracing.Endpoint != "" {
+		u, err := url.Parse(c.Tracing.Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("tracing.endpoint: %q must be an http:// or https:// URL", c.Tracing.Endpoint))
+		}
+	}
+	if r := c.Tracing.SampleRatio; r != nil && (*r < 0 || *r > 1) {
+		errs = append(errs, fmt.Errorf("tracing.sample_ratio: must be between 0 and 1, got %v", *r))
+	}
+
+	seenPolicies := make(map[string]bool)
+	for i, p := range c.IdlePolicies {
+		errs = append(errs, validateIdlePolicy(i, p, seenPolicies)...)
+	}
+
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		errs = append(errs, errors.New("tls: cert and key must be set together"))
+	}
+	if c.TLS.Cert != "" && c.TLS.ACMEDomain != "" {
+		errs = append(errs, errors.New("tls: acme_domain cannot be combined with cert/key"))
+	}
+	for _, path := range []string{c.TLS.Cert, c.TLS.Key, c.TLS.CA} {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			errs = append(errs, fmt.Errorf("tls: %v", err))
+		}
+	}
+
+	switch strings.ToLower(c.Log.Format) {
+	case "", "text", "json":
+	default:
+		errs = append(errs, fmt.Errorf("log.format: unknown format %q (use text or json)", c.Log.Format))
+	}
+	if _, err := ParseLogLevel(c.Log.Level); err != nil {
+		errs = append(errs, fmt.Errorf("log.level: %v", err))
+	}
+	if err := c.Log.Access.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("log.access: %v", err))
+	}
+
+	return errs
+}
+
+// resolveAlias maps an alias from the config or the registry to its ESP ID;
+// unknown names pass through.
+func (srv *Server) resolveAlias(name string) string {
+	if id, exists := srv.config.Aliases[name]; exists {
+		return id
+	}
+	if id, exists := srv.registryAlias(name); exists {
+		return id
+	}
+	return name
+}
+
+// aliasFor prefers the alias set with 'edit' over one from the config.
+func (srv *Server) aliasFor(id string) string {
+	if alias := srv.registryAliasFor(id); alias != "" {
+		return alias
+	}
+	for alias, target := range srv.config.Aliases {
+		if target == id {
+			return alias
+		}
+	}
+	return ""
+}
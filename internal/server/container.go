@@ -0,0 +1,137 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// containerState holds the Server state kept in container.go.
+type containerState struct {
+	// serverReady is set once the registry and other stores are loaded, and
+	// cleared again when shutdown starts.
+	serverReady atomic.Bool
+
+	dataDir string
+}
+
+// applyDataDir points every file the server writes that wasn't configured
+// explicitly into dataDir.
+func (srv *Server) applyDataDir() {
+	if srv.dataDir == "" {
+		return
+	}
+	for _, p := range []struct {
+		path *string
+		name string
+	}{
+		{&srv.registryPath, "registry.json"},
+		{&srv.schedulesPath, "schedules.json"},
+		{&srv.usersPath, "users.json"},
+		{&srv.secretsPath, "secrets.json"},
+		{&srv.groupsPath, "groups.json"},
+		{&srv.pushPath, "push.json"},
+		{&srv.eventsPath, "events.jsonl"},
+		{&srv.uptimeDir, "uptime"},
+		{&srv.telemetryDir, "telemetry"},
+		{&srv.otaDir, "firmware"},
+	} {
+		if *p.path == "" {
+			*p.path = filepath.Join(srv.dataDir, p.name)
+		}
+	}
+	if !srv.serverFlags["acme-cache"] && srv.config.TLS.ACMECache == "" {
+		srv.acmeCacheDir = filepath.Join(srv.dataDir, "acme")
+	}
+}
+
+// prepareDataDir creates the data directory and fails early if the server
+// can't write to it, which in containers usually means the volume is owned
+// by another user.
+func (srv *Server) prepareDataDir() {
+	if srv.dataDir == "" {
+		return
+	}
+	if err := os.MkdirAll(srv.dataDir, 0o750); err != nil {
+		srv.fatal("server", "Could not create data directory", "path", srv.dataDir, "error", err)
+	}
+	f, err := os.CreateTemp(srv.dataDir, ".write-test-*")
+	if err != nil {
+		srv.fatal("server", "Data directory is not writable", "path", srv.dataDir, "uid", os.Getuid(), "error", err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+}
+
+// withReadiness answers 503 until the server is ready, so requests that
+// arrive while stores are loading don't see an empty registry. Probes are
+// always served.
+func (srv *Server) withReadiness(path string, h http.HandlerFunc) http.HandlerFunc {
+	switch path {
+	case "/healthz", "/readyz", "/health":
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !srv.serverReady.Load() {
+			w.Header().Set("Retry-After", "1")
+			writeError(w, CodeUnavailable, "server is starting")
+			return
+		}
+		h(w, r)
+	}
+}
+
+// healthzHandler is the liveness probe: it succeeds whenever the server
+// answers HTTP, and never depends on devices or brokers.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// readyzHandler is the readiness probe: 503 while stores load and once
+// shutdown has begun.
+func (srv *Server) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !srv.serverReady.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{"status": "not ready"})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"status": "ready"})
+}
+
+// --- Client Mode ---
+
+// Healthcheck checks readiness of the server on this host, for Docker
+// HEALTHCHECK in images without curl.
+func (srv *Server) Healthcheck() error {
+	scheme := "http"
+	addr, dial := srv.localDialer()
+	transport := &http.Transport{DialContext: dial}
+	hc := &http.Client{Timeout: 5 * time.Second, Transport: transport}
+	if srv.tlsEnabled() {
+		// The certificate is issued for a public name, not localhost
+		scheme = "https"
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	url := fmt.Sprintf("%s://%s/readyz", scheme, addr)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	resp, err := hc.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("not ready: %s", resp.Status)
+	}
+	return nil
+}
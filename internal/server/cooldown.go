@@ -0,0 +1,127 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// Cooldowns: pressing the power button twice in quick succession can turn
+// a machine that was just switched on off again. After a pulse or force
+// reaches a device, further pulse and force commands are refused for the
+// device's cooldown with an error that says how long is left. Sent with
+// after_cooldown they are queued instead, and a power command already in
+// the queue is held, until the cooldown is over. Other commands aren't
+// affected, but wait behind a held one so the queue stays in order. The
+// cooldown is set per device with 'edit -cooldown', or for all devices
+// with -command-cooldown; it is off by default.
+
+const maxCooldown = 10 * time.Minute
+
+var (
+	errCooldown = errors.New("device is cooling down")
+)
+
+// cooldownState holds the Server state kept in cooldown.go.
+type cooldownState struct {
+	commandCooldown time.Duration
+}
+
+// cooldownError is errCooldown with the time left.
+type cooldownError struct {
+	ID       string
+	Cooldown time.Duration
+	Left     time.Duration
+}
+
+func (e *cooldownError) Error() string {
+	return fmt.Sprintf("%s: '%s' got a power command %s ago, %s of its %s cooldown left", errCooldown, e.ID,
+		(e.Cooldown - e.Left).Round(time.Second), e.Left.Round(100*time.Millisecond), e.Cooldown)
+}
+
+func (e *cooldownError) Unwrap() error { return errCooldown }
+
+func validateCooldown(d time.Duration) error {
+	if d < 0 || d > maxCooldown {
+		return fmt.Errorf("cooldown must be between 0 and %s, got %v", maxCooldown, d)
+	}
+	return nil
+}
+
+func isPowerCommand(cmd ESPCommand) bool {
+	return cmd == CommandPulse || cmd == CommandForce
+}
+
+// cooldown is the device's own cooldown, or the server's.
+func (e *ESP) cooldown(srv *Server) time.Duration {
+	if e.CooldownMS > 0 {
+		return time.Duration(e.CooldownMS) * time.Millisecond
+	}
+	return srv.commandCooldown
+}
+
+// cooldownLeft is how long power commands for the device must still wait.
+// The cooldown runs from the delivery of the last pulse or force. Must be
+// called with mu held.
+func (e *ESP) cooldownLeft(srv *Server, now time.Time) time.Duration {
+	cooldown := e.cooldown(srv)
+	if cooldown <= 0 {
+		return 0
+	}
+	for _, rec := range slices.Backward(e.History) {
+		if isPowerCommand(rec.Command) && rec.DeliveredAt != nil {
+			return max(rec.DeliveredAt.Add(cooldown).Sub(now), 0)
+		}
+	}
+	return 0
+}
+
+// checkCooldown refuses a power command during the cooldown, unless it is
+// to be queued until then. Only devices that poll have a queue to hold it
+// in. Must be called with mu held.
+func (srv *Server) checkCooldown(esp *ESP, cmd ESPCommand, opts commandOptions) error {
+	if !isPowerCommand(cmd) {
+		return nil
+	}
+	left := esp.cooldownLeft(srv, srv.now())
+	if left == 0 {
+		return nil
+	}
+	if opts.AfterCooldown && srv.driverFor(esp).Queues() {
+		return nil
+	}
+	return &cooldownError{ID: esp.ID, Cooldown: esp.cooldown(srv), Left: left}
+}
+
+// queueHeld reports whether the command at the head of the queue has to
+// wait for the cooldown, and if so makes sure the device gets it once the
+// cooldown is over. Must be called with mu held.
+func (srv *Server) queueHeld(esp *ESP) bool {
+	if len(esp.Queue) == 0 || !isPowerCommand(esp.Queue[0].Command) {
+		return false
+	}
+	left := esp.cooldownLeft(srv, srv.now())
+	if left == 0 {
+		return false
+	}
+	if esp.cooldownOver == nil {
+		esp.cooldownOver = time.AfterFunc(left, func() { srv.releaseQueue(esp) })
+	} else {
+		esp.cooldownOver.Reset(left)
+	}
+	return true
+}
+
+// releaseQueue runs when a held command's cooldown is over: it wakes held
+// polls and pushes to a WebSocket connection.
+func (srv *Server) releaseQueue(esp *ESP) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.espMap[esp.ID] != esp {
+		return
+	}
+	esp.signalCommand()
+	srv.nudgeBeacon(esp)
+	srv.pushCommands(esp)
+}
@@ -0,0 +1,182 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORS lets a web app served from another origin call the API. Origins are
+// matched exactly, or "*" allows any. Preflight requests are answered
+// before the rate limit and authentication, since browsers send them
+// without credentials.
+
+// CORSSettings configures cross-origin access. Empty method and header
+// lists allow each route's documented methods and the headers the API
+// reads.
+type CORSSettings struct {
+	AllowedOrigins   []string      `yaml:"allowed_origins"`
+	AllowedMethods   []string      `yaml:"allowed_methods"`
+	AllowedHeaders   []string      `yaml:"allowed_headers"`
+	AllowCredentials bool          `yaml:"allow_credentials"`
+	MaxAge           time.Duration `yaml:"max_age"`
+}
+
+// corsState holds the Server state kept in cors.go.
+type corsState struct {
+	cors CORSSettings // guarded by settingsMu
+
+	// routeMethods are the methods of each API route, for preflight
+	// answers and OPTIONS requests
+	routeMethods map[string][]string
+}
+
+var (
+	defaultCORSHeaders  = []string{"Authorization", "Content-Type", csrfHeader, "X-Request-ID", "Last-Event-ID"}
+	exposedCORSHeaders  = []string{"X-Request-ID", "Retry-After", "Content-Disposition"}
+	defaultRouteMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost}
+)
+
+const defaultCORSMaxAge = 10 * time.Minute
+
+func (c CORSSettings) enabled() bool {
+	return len(c.AllowedOrigins) > 0
+}
+
+func (c CORSSettings) validate() error {
+	for _, o := range c.AllowedOrigins {
+		if o == "*" {
+			if c.AllowCredentials {
+				return fmt.Errorf("allow_credentials can't be combined with origin \"*\"")
+			}
+			continue
+		}
+		u, err := url.Parse(o)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			return fmt.Errorf("invalid origin %q (use scheme://host[:port] or *)", o)
+		}
+	}
+	if c.MaxAge < 0 {
+		return fmt.Errorf("max_age must be positive")
+	}
+	return nil
+}
+
+// normalize trims origins the way browsers send them and fills in the
+// defaults.
+func (c CORSSettings) normalize() CORSSettings {
+	origins := make([]string, 0, len(c.AllowedOrigins))
+	for _, o := range c.AllowedOrigins {
+		if o = strings.TrimSuffix(strings.TrimSpace(o), "/"); o != "" {
+			origins = append(origins, o)
+		}
+	}
+	c.AllowedOrigins = origins
+	for i, m := range c.AllowedMethods {
+		c.AllowedMethods[i] = strings.ToUpper(strings.TrimSpace(m))
+	}
+	if len(c.AllowedHeaders) == 0 {
+		c.AllowedHeaders = defaultCORSHeaders
+	}
+	if c.MaxAge == 0 {
+		c.MaxAge = defaultCORSMaxAge
+	}
+	return c
+}
+
+// allowOrigin returns the Access-Control-Allow-Origin value for origin,
+// empty if it isn't allowed.
+func (c CORSSettings) allowOrigin(origin string) string {
+	for _, o := range c.AllowedOrigins {
+		if o == "*" {
+			return "*"
+		}
+		if strings.EqualFold(o, origin) {
+			return origin
+		}
+	}
+	return ""
+}
+
+func (srv *Server) pathMethods(path string) []string {
+	if methods, ok := srv.routeMethods[path]; ok {
+		return methods
+	}
+	return defaultRouteMethods
+}
+
+// methods are the methods a browser may use on path.
+func (c CORSSettings) methods(srv *Server, path string) []string {
+	methods := srv.pathMethods(path)
+	if len(c.AllowedMethods) == 0 {
+		return methods
+	}
+	var allowed []string
+	for _, m := range methods {
+		if slices.Contains(c.AllowedMethods, m) {
+			allowed = append(allowed, m)
+		}
+	}
+	return allowed
+}
+
+// withCORS adds CORS headers to responses for allowed origins and answers
+// OPTIONS requests, preflight or not, with the path's methods.
+func (srv *Server) withCORS(path string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		srv.settingsMu.RLock()
+		c := srv.cors
+		srv.settingsMu.RUnlock()
+
+		origin := r.Header.Get("Origin")
+		allowed := ""
+		if c.enabled() {
+			w.Header().Add("Vary", "Origin")
+			if origin != "" {
+				allowed = c.allowOrigin(origin)
+			}
+		}
+		if allowed != "" {
+			w.Header().Set("Access-Control-Allow-Origin", allowed)
+			if c.AllowCredentials {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+		}
+
+		if r.Method != http.MethodOptions {
+			if allowed != "" {
+				w.Header().Set("Access-Control-Expose-Headers", strings.Join(exposedCORSHeaders, ", "))
+			}
+			next(w, r)
+			return
+		}
+
+		w.Header().Set("Allow", strings.Join(append(slices.Clone(srv.pathMethods(path)), http.MethodOptions), ", "))
+		requested := r.Header.Get("Access-Control-Request-Method")
+		if origin == "" || requested == "" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		rlog := srv.requestLogger(r)
+		if allowed == "" {
+			rlog.Warn("CORS preflight from origin not allowed", "origin", origin)
+			writeError(w, CodeForbidden, "origin not allowed")
+			return
+		}
+		corsMethods := c.methods(srv, path)
+		if !slices.Contains(corsMethods, requested) {
+			rlog.Warn("CORS preflight for method not allowed", "origin", origin, "method", requested)
+			writeError(w, CodeMethodNotAllowed, fmt.Sprintf("method %s not allowed", requested))
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(corsMethods, ", "))
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(c.AllowedHeaders, ", "))
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(c.MaxAge.Seconds())))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
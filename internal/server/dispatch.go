@@ -0,0 +1,179 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	errESPOffline         = errors.New("ESP is offline")
+	errUnsupportedCommand = errors.New("command not supported")
+	errWakeFailed         = errors.New("failed to send magic packet")
+	errProtected          = errors.New("device is protected")
+)
+
+// statusDryRun is the status of a command sent with commandOptions.DryRun.
+const statusDryRun = "dry-run"
+
+// ActionCommand maps a user-facing action to the command sent to the device.
+func ActionCommand(action string) (ESPCommand, bool) {
+	switch action {
+	case "on":
+		return CommandPulse, true
+	case "off":
+		return CommandForce, true
+	case "status":
+		return CommandStatus, true
+	case "soft-off":
+		return CommandSoftOff, true
+	}
+	return "", false
+}
+
+// knownCommand reports whether cmd is one the server can send.
+func knownCommand(cmd ESPCommand) bool {
+	switch cmd {
+	case CommandPulse, CommandForce, CommandStatus, CommandSoftOff, CommandAction:
+		return true
+	}
+	return false
+}
+
+type dispatchResult struct {
+	Record   *CommandRecord
+	Status   string // queued, duplicate, sent or dry-run
+	Delivery string // poll, push, wol, mqtt, agent, ssh or the driver's device type
+	Fallback bool   // soft-off was sent as force because no agent was online
+	Offline  bool   // queued for an ESP that is offline
+}
+
+// dispatchCommand queues cmd for the device, or executes it right away for
+// devices the server drives itself. actor is recorded in the event log.
+// A dry run makes the same checks and reports the delivery without
+// sending anything. Must be called with mu held.
+func (srv *Server) dispatchCommand(esp *ESP, cmd ESPCommand, opts commandOptions, actor string) (dispatchResult, error) {
+	result, err := srv.dispatch(esp, cmd, opts, actor)
+	if opts.DryRun {
+		return result, err
+	}
+	if err != nil && result.Record == nil {
+		srv.recordEvent(Event{Type: EventRejected, ESPID: esp.ID, Actor: actor, Command: cmd, Detail: err.Error()})
+	}
+	if err == nil {
+		esp.powerCommand(srv, cmd)
+		if !opts.IgnoreQuota {
+			srv.chargeQuota(esp, cmd, result)
+		}
+	}
+	if rec := result.Record; rec != nil {
+		if rec.Actor == "" {
+			rec.Actor = actor
+		}
+		if err == nil {
+			srv.startVerify(esp, rec, actor)
+		}
+		esp.addHistory(rec)
+		srv.saveRegistry()
+	}
+	return result, err
+}
+
+func (srv *Server) dispatch(esp *ESP, cmd ESPCommand, opts commandOptions, actor string) (dispatchResult, error) {
+	if esp.Conflict != nil && esp.Conflict.Policy == duplicateQuarantine {
+		return dispatchResult{}, fmt.Errorf("%w: '%s' is quarantined because more than one device uses it", errIDConflict, esp.ID)
+	}
+	if err := srv.checkPairing(esp); err != nil {
+		return dispatchResult{}, err
+	}
+	if err := srv.checkMaintenance(esp, cmd, opts); err != nil {
+		return dispatchResult{}, err
+	}
+	if err := checkAlreadyUp(esp, cmd, opts); err != nil {
+		return dispatchResult{}, err
+	}
+	if err := srv.checkCooldown(esp, cmd, opts); err != nil {
+		return dispatchResult{}, err
+	}
+	if err := srv.checkQuota(esp, cmd, opts); err != nil {
+		return dispatchResult{}, err
+	}
+	if err := checkAction(esp, cmd, opts); err != nil {
+		return dispatchResult{}, err
+	}
+	if cmd == CommandForce && esp.Protected && !opts.Override {
+		return dispatchResult{}, fmt.Errorf("%w: '%s' can't be forced off without override", errProtected, esp.ID)
+	}
+	if cmd == CommandSoftOff {
+		return srv.dispatchSoftOff(esp, opts, actor)
+	}
+
+	duration, err := pulseDuration(esp, cmd, opts)
+	if err != nil {
+		return dispatchResult{}, err
+	}
+
+	drv := srv.driverFor(esp)
+	if !drv.Supports(cmd) {
+		return dispatchResult{}, fmt.Errorf("%w: %s device '%s' does not support '%s'", errUnsupportedCommand, esp.deviceType(), esp.ID, cmd)
+	}
+	return drv.Send(esp, cmd, duration, opts, actor)
+}
+
+// espDriver queues commands for ESPs, which poll for them or have them
+// pushed over their WebSocket.
+type espDriver struct {
+	srv *Server
+}
+
+// Supports leaves out soft-off, which goes to the host's agent instead.
+func (espDriver) Supports(cmd ESPCommand) bool { return cmd != CommandSoftOff }
+
+func (espDriver) Queues() bool { return true }
+
+func (d espDriver) Send(esp *ESP, cmd ESPCommand, duration time.Duration, opts commandOptions, actor string) (dispatchResult, error) {
+	if !esp.Online && !opts.QueueIfOffline {
+		return dispatchResult{}, fmt.Errorf("%w: ESP '%s' is offline", errESPOffline, esp.ID)
+	}
+	if opts.DryRun {
+		return d.srv.dryRunQueue(esp, cmd, opts, duration)
+	}
+	rec, duplicate, err := d.srv.enqueueCommand(esp, cmd, opts.Action, duration, opts.ttl(d.srv), opts.priority())
+	if err != nil {
+		return dispatchResult{}, fmt.Errorf("%w: command queue for '%s' is full (%d)", err, esp.ID, d.srv.maxQueueDepth)
+	}
+
+	result := dispatchResult{Record: rec, Status: "queued", Delivery: "poll", Offline: !esp.Online}
+	if duplicate {
+		result.Status = "duplicate"
+	}
+	detail := result.Status
+	if result.Offline {
+		detail += " while offline"
+	}
+	if rec.Priority != PriorityNormal {
+		detail += ", " + string(rec.Priority)
+	}
+	d.srv.recordEvent(Event{Type: EventCommand, ESPID: esp.ID, Actor: actor, Command: cmd, CommandID: rec.ID, Detail: detail})
+	if d.srv.pushCommands(esp) {
+		result.Delivery = "push"
+	}
+	return result, nil
+}
+
+// dryRunQueue reports what queueing cmd would do. The duplicate a real
+// send would return is included as the record.
+func (srv *Server) dryRunQueue(esp *ESP, cmd ESPCommand, opts commandOptions, duration time.Duration) (dispatchResult, error) {
+	result := dispatchResult{Status: statusDryRun, Delivery: "poll", Offline: !esp.Online}
+	if _, exists := srv.wsConns[esp.ID]; exists {
+		result.Delivery = "push"
+	}
+	if rec := srv.findQueued(esp, cmd, opts.Action, duration); rec != nil {
+		result.Record = rec
+		return result, nil
+	}
+	if len(esp.Queue) >= srv.maxQueueDepth && displaceable(esp, opts.priority()) < 0 {
+		return dispatchResult{}, fmt.Errorf("%w: command queue for '%s' is full (%d)", errQueueFull, esp.ID, srv.maxQueueDepth)
+	}
+	return result, nil
+}
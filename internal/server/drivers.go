@@ -0,0 +1,550 @@
+package server
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Drivers deliver commands, one for each kind of device, so dispatch sends
+// every command the same way. ESPs pick theirs up from a queue, by polling
+// or over their WebSocket (espDriver, dispatch.go), MQTT devices get them
+// published (mqtt.go) and WoL hosts get a magic packet (wol.go).
+//
+// Driver devices are the ones the server controls itself, without an ESP in
+// between: smart plugs over their HTTP API and servers through their BMC.
+// They get the same commands, power state and online tracking, with the
+// prober polling them in place of heartbeats.
+
+const driverTimeout = 10 * time.Second
+
+// driversState holds the Server state kept in drivers.go.
+type driversState struct {
+	driverHTTP *http.Client
+}
+
+// deviceDriver delivers commands to one kind of device.
+type deviceDriver interface {
+	// Supports reports whether the device can run cmd.
+	Supports(cmd ESPCommand) bool
+	// Queues reports whether commands wait for the device to pick them
+	// up, so they can be held while it is offline or cooling down.
+	Queues() bool
+	// Send delivers a command that passed dispatch's checks, or only
+	// reports the delivery for a dry run. Must be called with mu held.
+	Send(esp *ESP, cmd ESPCommand, duration time.Duration, opts commandOptions, actor string) (dispatchResult, error)
+}
+
+// driverFor must be called with mu held.
+func (srv *Server) driverFor(esp *ESP) deviceDriver {
+	switch {
+	case esp.isWoL():
+		return wolDriver{srv: srv}
+	case esp.isMQTT():
+		return mqttDriver{srv: srv}
+	}
+	if drv, ok := srv.powerDriverFor(esp); ok {
+		return directDriver{drv, srv}
+	}
+	return espDriver{srv: srv}
+}
+
+// powerDriver is implemented by each driver device's driver. Do runs pulse
+// (power on), force (power off) or soft-off; Powered reads the current
+// state.
+type powerDriver interface {
+	Do(ctx context.Context, cmd ESPCommand) error
+	Powered(ctx context.Context) (bool, error)
+	Supports(cmd ESPCommand) bool
+}
+
+// DriverConfig is how the server reaches a driver device. It is stored in
+// the registry, password included.
+type DriverConfig struct {
+	Addr     string `json:"addr"` // host[:port]
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	Relay    int    `json:"relay,omitempty"` // switch channel on multi-relay plugs
+	Gen      int    `json:"gen,omitempty"`   // Shelly API generation, 1 or 2
+}
+
+func (e *ESP) isDriver() bool {
+	return e.Driver != nil || e.isVM()
+}
+
+// newPowerDriver returns the driver for a device type, or false if the type
+// has none.
+func (srv *Server) newPowerDriver(t DeviceType, c DriverConfig) (powerDriver, bool) {
+	switch t {
+	case DeviceTasmota:
+		return tasmotaDriver{c, srv}, true
+	case DeviceShelly:
+		if c.Gen == 2 {
+			return shellyRPCDriver{c, srv}, true
+		}
+		return shellyDriver{c, srv}, true
+	case DeviceIPMI:
+		return ipmiDriver{c}, true
+	}
+	return nil, false
+}
+
+// powerDriverFor must be called with mu held.
+func (srv *Server) powerDriverFor(esp *ESP) (powerDriver, bool) {
+	switch {
+	case esp.isVM():
+		return srv.vmDriver(esp.ID)
+	case esp.Driver == nil:
+		return nil, false
+	}
+	return srv.newPowerDriver(esp.Type, *esp.Driver)
+}
+
+// directDriver sends commands to a driver device. They run in the
+// background, since drivers make network calls that must not hold mu.
+type directDriver struct {
+	drv powerDriver
+	srv *Server
+}
+
+// Supports allows status on every driver device: it reads the power state.
+func (d directDriver) Supports(cmd ESPCommand) bool {
+	return cmd == CommandStatus || d.drv.Supports(cmd)
+}
+
+func (directDriver) Queues() bool { return false }
+
+func (d directDriver) Send(esp *ESP, cmd ESPCommand, _ time.Duration, opts commandOptions, actor string) (dispatchResult, error) {
+	if !esp.Online {
+		return dispatchResult{}, fmt.Errorf("%w: %s device '%s' is unreachable", errESPOffline, esp.Type, esp.ID)
+	}
+	if opts.DryRun {
+		return dispatchResult{Status: statusDryRun, Delivery: string(esp.Type)}, nil
+	}
+	rec := d.srv.newCommandRecord(esp.ID, cmd)
+	d.srv.recordEvent(Event{Type: EventCommand, ESPID: esp.ID, Actor: actor, Command: cmd, CommandID: rec.ID, Detail: string(esp.Type)})
+	d.srv.markDelivered(rec)
+	go d.srv.runDriverCommand(esp.ID, d.drv, rec.ID, cmd)
+	return dispatchResult{Record: rec, Status: "sent", Delivery: string(esp.Type)}, nil
+}
+
+func (srv *Server) runDriverCommand(id string, drv powerDriver, commandID string, cmd ESPCommand) {
+	ctx, cancel := context.WithTimeout(context.Background(), driverTimeout)
+	defer cancel()
+
+	var err error
+	if cmd != CommandStatus {
+		err = drv.Do(ctx, cmd)
+	}
+	var on bool
+	if err == nil {
+		on, err = drv.Powered(ctx)
+	}
+
+	dlog := srv.logger("driver").With("esp_id", id, "command", cmd, "command_id", commandID)
+	report := CommandReport{CommandID: commandID, Success: err == nil}
+	if err != nil {
+		report.Error = err.Error()
+		dlog.Warn("Driver command failed", "error", err)
+	} else {
+		report.Result = map[string]interface{}{"power": onOff(on)}
+		dlog.Info("Driver command done", "power", onOff(on))
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if _, err := srv.settleCommand(id, report); err != nil {
+		dlog.Warn("Could not settle driver command", "error", err)
+	}
+}
+
+// pollDriver reads a driver device's power state. A successful read is its
+// heartbeat; a failed one takes it offline right away.
+func (srv *Server) pollDriver(id string, drv powerDriver) {
+	ctx, cancel := context.WithTimeout(context.Background(), driverTimeout)
+	defer cancel()
+	on, err := drv.Powered(ctx)
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	esp, exists := srv.espMap[id]
+	if !exists || !esp.isDriver() {
+		return
+	}
+	if err == nil {
+		esp.markSeen(srv, "")
+		esp.powerSensor(srv, onOff(on))
+		return
+	}
+	switch {
+	case esp.Online:
+		esp.Online = false
+		srv.logger("driver").Warn("Device unreachable", "esp_id", id, "error", err)
+		srv.recordEvent(Event{Type: EventOffline, ESPID: id, Detail: err.Error()})
+	case esp.LastSeen.IsZero():
+		// Never reached, most likely a wrong address or credentials
+		srv.logger("driver").Warn("Device not reachable yet", "esp_id", id, "error", err)
+	}
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
+
+// driverGet fetches a driver URL and decodes the JSON reply into out.
+func (srv *Server) driverGet(ctx context.Context, u string, setAuth func(*http.Request), out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	if setAuth != nil {
+		setAuth(req)
+	}
+	resp, err := srv.driverHTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("device returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("invalid reply from device: %w", err)
+	}
+	return nil
+}
+
+// --- Tasmota ---
+
+// tasmotaDriver uses the /cm command endpoint. Relay 0 addresses the first
+// (or only) relay.
+type tasmotaDriver struct {
+	c   DriverConfig
+	srv *Server
+}
+
+func (d tasmotaDriver) Supports(cmd ESPCommand) bool {
+	return cmd == CommandPulse || cmd == CommandForce
+}
+
+func (d tasmotaDriver) command(ctx context.Context, arg string) (bool, error) {
+	power := "Power"
+	if d.c.Relay > 0 {
+		power += fmt.Sprint(d.c.Relay)
+	}
+	q := url.Values{"cmnd": {strings.TrimSpace(power + " " + arg)}}
+	if d.c.Password != "" {
+		q.Set("user", cmp.Or(d.c.Username, "admin"))
+		q.Set("password", d.c.Password)
+	}
+	var reply map[string]interface{}
+	if err := d.srv.driverGet(ctx, "http://"+d.c.Addr+"/cm?"+q.Encode(), nil, &reply); err != nil {
+		return false, err
+	}
+	// Single-relay devices answer POWER even when asked for POWER1
+	for _, key := range []string{strings.ToUpper(power), "POWER"} {
+		if s, ok := reply[key].(string); ok {
+			return s == "ON", nil
+		}
+	}
+	if msg, ok := reply["Command"].(string); ok {
+		return false, fmt.Errorf("tasmota: %s", msg)
+	}
+	return false, errors.New("tasmota: no power state in reply")
+}
+
+func (d tasmotaDriver) Do(ctx context.Context, cmd ESPCommand) error {
+	arg := "On"
+	if cmd == CommandForce {
+		arg = "Off"
+	}
+	_, err := d.command(ctx, arg)
+	return err
+}
+
+func (d tasmotaDriver) Powered(ctx context.Context) (bool, error) {
+	return d.command(ctx, "")
+}
+
+// --- Shelly ---
+
+// shellyDriver speaks the Gen1 relay API with basic auth.
+type shellyDriver struct {
+	c   DriverConfig
+	srv *Server
+}
+
+func (d shellyDriver) Supports(cmd ESPCommand) bool {
+	return cmd == CommandPulse || cmd == CommandForce
+}
+
+func (d shellyDriver) relay(ctx context.Context, turn string) (bool, error) {
+	u := fmt.Sprintf("http://%s/relay/%d", d.c.Addr, d.c.Relay)
+	if turn != "" {
+		u += "?turn=" + turn
+	}
+	var reply struct {
+		IsOn bool `json:"ison"`
+	}
+	err := d.srv.driverGet(ctx, u, func(req *http.Request) {
+		if d.c.Password != "" {
+			req.SetBasicAuth(d.c.Username, d.c.Password)
+		}
+	}, &reply)
+	return reply.IsOn, err
+}
+
+func (d shellyDriver) Do(ctx context.Context, cmd ESPCommand) error {
+	turn := "on"
+	if cmd == CommandForce {
+		turn = "off"
+	}
+	_, err := d.relay(ctx, turn)
+	return err
+}
+
+func (d shellyDriver) Powered(ctx context.Context) (bool, error) {
+	return d.relay(ctx, "")
+}
+
+// shellyRPCDriver speaks the Gen2+ RPC API, whose authentication is HTTP
+// digest with SHA-256 and the fixed user "admin".
+type shellyRPCDriver struct {
+	c   DriverConfig
+	srv *Server
+}
+
+func (d shellyRPCDriver) Supports(cmd ESPCommand) bool {
+	return cmd == CommandPulse || cmd == CommandForce
+}
+
+func (d shellyRPCDriver) call(ctx context.Context, method string, q url.Values, out interface{}) error {
+	q.Set("id", fmt.Sprint(d.c.Relay))
+	u := "http://" + d.c.Addr + "/rpc/" + method + "?" + q.Encode()
+	if d.c.Password == "" {
+		return d.srv.driverGet(ctx, u, nil, out)
+	}
+
+	// Fetch a fresh challenge, then make the call with the digest answer
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := d.srv.driverHTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusOK {
+		// Authentication is turned off on the device
+		defer resp.Body.Close()
+		return json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(out)
+	}
+	resp.Body.Close()
+	challenge := resp.Header.Get("WWW-Authenticate")
+	if resp.StatusCode != http.StatusUnauthorized || challenge == "" {
+		return fmt.Errorf("shelly: expected a digest challenge, got %s", resp.Status)
+	}
+	auth, err := digestAuth(challenge, "admin", d.c.Password, http.MethodGet, req.URL.RequestURI())
+	if err != nil {
+		return err
+	}
+	return d.srv.driverGet(ctx, u, func(r *http.Request) { r.Header.Set("Authorization", auth) }, out)
+}
+
+func (d shellyRPCDriver) Do(ctx context.Context, cmd ESPCommand) error {
+	var reply map[string]interface{}
+	return d.call(ctx, "Switch.Set", url.Values{"on": {fmt.Sprint(cmd == CommandPulse)}}, &reply)
+}
+
+func (d shellyRPCDriver) Powered(ctx context.Context) (bool, error) {
+	var reply struct {
+		Output bool `json:"output"`
+	}
+	err := d.call(ctx, "Switch.GetStatus", url.Values{}, &reply)
+	return reply.Output, err
+}
+
+// digestAuth answers an RFC 7616 challenge with qop=auth.
+func digestAuth(challenge, user, password, method, uri string) (string, error) {
+	scheme, rest, _ := strings.Cut(challenge, " ")
+	if !strings.EqualFold(scheme, "Digest") {
+		return "", fmt.Errorf("unsupported auth scheme %q", scheme)
+	}
+	params := make(map[string]string)
+	for _, part := range strings.Split(rest, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if ok {
+			params[strings.ToLower(k)] = strings.Trim(v, `"`)
+		}
+	}
+	if alg := params["algorithm"]; alg != "" && !strings.EqualFold(alg, "SHA-256") {
+		return "", fmt.Errorf("unsupported digest algorithm %q", alg)
+	}
+
+	hash := func(s string) string {
+		sum := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	cnonce := hex.EncodeToString(b)
+	ha1 := hash(user + ":" + params["realm"] + ":" + password)
+	ha2 := hash(method + ":" + uri)
+	response := hash(strings.Join([]string{ha1, params["nonce"], "00000001", cnonce, "auth", ha2}, ":"))
+	return fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s", algorithm=SHA-256, qop=auth, nc=00000001, cnonce="%s", response="%s"`,
+		user, params["realm"], params["nonce"], uri, cnonce, response), nil
+}
+
+// --- IPMI ---
+
+// ipmiDriver runs ipmitool against the BMC over IPMI 2.0 (lanplus), which
+// covers iDRAC, iLO and most server boards. The password is passed in the
+// environment so it doesn't show up in the process list.
+type ipmiDriver struct {
+	c DriverConfig
+}
+
+func (d ipmiDriver) Supports(cmd ESPCommand) bool {
+	return cmd == CommandPulse || cmd == CommandForce || cmd == CommandSoftOff
+}
+
+func (d ipmiDriver) chassis(ctx context.Context, action string) (string, error) {
+	host, port := d.c.Addr, ""
+	if h, p, err := net.SplitHostPort(d.c.Addr); err == nil {
+		host, port = h, p
+	}
+	args := []string{"-I", "lanplus", "-H", host}
+	if port != "" {
+		args = append(args, "-p", port)
+	}
+	if d.c.Username != "" {
+		args = append(args, "-U", d.c.Username)
+	}
+	args = append(args, "-E", "chassis", "power", action)
+
+	cmd := exec.CommandContext(ctx, "ipmitool", args...)
+	cmd.Env = append(os.Environ(), "IPMI_PASSWORD="+d.c.Password)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Run(); err != nil {
+		if errors.Is(err, exec.ErrNotFound) {
+			return "", errors.New("ipmitool not found in PATH")
+		}
+		return "", fmt.Errorf("ipmitool: %s", cmp.Or(strings.TrimSpace(out.String()), err.Error()))
+	}
+	return strings.TrimSpace(out.String()), nil
+}
+
+func (d ipmiDriver) Do(ctx context.Context, cmd ESPCommand) error {
+	action := map[ESPCommand]string{CommandPulse: "on", CommandForce: "off", CommandSoftOff: "soft"}[cmd]
+	_, err := d.chassis(ctx, action)
+	return err
+}
+
+func (d ipmiDriver) Powered(ctx context.Context) (bool, error) {
+	out, err := d.chassis(ctx, "status")
+	if err != nil {
+		return false, err
+	}
+	// "Chassis Power is on"
+	switch {
+	case strings.HasSuffix(out, " on"):
+		return true, nil
+	case strings.HasSuffix(out, " off"):
+		return false, nil
+	}
+	return false, fmt.Errorf("ipmitool: unexpected status %q", out)
+}
+
+type driverDeviceRequest struct {
+	ID     string     `json:"id"`
+	Driver DeviceType `json:"driver"` // tasmota, shelly or ipmi
+	DriverConfig
+}
+
+func (srv *Server) driverDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	rlog := srv.requestLogger(r)
+
+	if r.Method != http.MethodPost {
+		rlog.Warn("Method not allowed", "method", r.Method)
+		writeError(w, CodeMethodNotAllowed, "only POST allowed")
+		return
+	}
+
+	var data driverDeviceRequest
+	if err := decodeJSON(w, r, &data); err != nil {
+		rlog.Warn("Invalid JSON", "error", err)
+		return
+	}
+	if strings.HasPrefix(data.ID, vmPrefix) {
+		writeError(w, CodeInvalidRequest, "IDs starting with vm: are reserved for VMs from the config file")
+		return
+	}
+	if err := validateESPID(data.ID); err != nil {
+		writeError(w, CodeInvalidRequest, err.Error())
+		return
+	}
+	if _, ok := srv.newPowerDriver(data.Driver, data.DriverConfig); !ok {
+		writeError(w, CodeInvalidRequest, fmt.Sprintf("unknown driver %q (use tasmota, shelly or ipmi)", data.Driver))
+		return
+	}
+	if data.Addr == "" {
+		writeError(w, CodeInvalidRequest, "addr cannot be empty")
+		return
+	}
+	if data.Gen != 0 && (data.Driver != DeviceShelly || data.Gen != 1 && data.Gen != 2) {
+		writeError(w, CodeInvalidRequest, "gen must be 1 or 2 and only applies to shelly")
+		return
+	}
+	if data.Relay < 0 {
+		writeError(w, CodeInvalidRequest, "relay cannot be negative")
+		return
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if existing, exists := srv.espMap[data.ID]; exists && existing.Type != data.Driver {
+		rlog.Warn("ID already in use", "esp_id", data.ID, "type", existing.Type)
+		writeError(w, CodeConflict, fmt.Sprintf("'%s' is already registered as a %s device", data.ID, existing.deviceType()))
+		return
+	}
+
+	esp := &ESP{
+		ID:           data.ID,
+		Type:         data.Driver,
+		Driver:       &data.DriverConfig,
+		RegisteredAt: srv.now(),
+	}
+	if existing, exists := srv.espMap[data.ID]; exists {
+		esp.RegisteredAt = existing.RegisteredAt
+		esp.LastPower = existing.LastPower
+	}
+	srv.espMap[data.ID] = esp
+	srv.saveRegistry()
+	rlog.Info("Driver device added", "esp_id", data.ID, "driver", data.Driver, "addr", data.Addr)
+	drv, _ := srv.powerDriverFor(esp)
+	go srv.pollDriver(data.ID, drv)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "added", "id": data.ID})
+}
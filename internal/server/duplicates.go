@@ -0,0 +1,210 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Two ESPs flashed with the same ID would otherwise share one entry and
+// take turns stealing its commands. Registrations and polls identify their
+// sender by the instance token the firmware picks at boot, or by source
+// address for firmware that sends none. A new sender takes the ID over,
+// which is what a reboot or a new DHCP lease looks like; the ID is in
+// conflict when the sender it replaced comes back within the ESP timeout.
+
+type duplicatePolicy string
+
+const (
+	duplicateReject     duplicatePolicy = "reject"     // the device that had the ID keeps it
+	duplicateQuarantine duplicatePolicy = "quarantine" // both devices are refused until one goes away
+	duplicateAllow      duplicatePolicy = "allow"
+)
+
+var (
+	errIDConflict = errors.New("duplicate ESP ID")
+)
+
+// duplicatesState holds the Server state kept in duplicates.go.
+type duplicatesState struct {
+	duplicateIDs duplicatePolicy
+}
+
+func parseDuplicatePolicy(s string) (duplicatePolicy, error) {
+	switch p := duplicatePolicy(s); p {
+	case duplicateReject, duplicateQuarantine, duplicateAllow:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown duplicate ID policy %q (use reject, quarantine or allow)", s)
+}
+
+// IDConflict describes the devices seen using one ESP ID.
+type IDConflict struct {
+	Policy     duplicatePolicy `json:"policy"`
+	DetectedAt time.Time       `json:"detected_at"`
+	Senders    []*IDSender     `json:"senders"`
+}
+
+type IDSender struct {
+	Instance string    `json:"instance,omitempty"`
+	Addr     string    `json:"addr"`
+	LastSeen time.Time `json:"last_seen"`
+	Rejected bool      `json:"rejected"`
+}
+
+func (s *IDSender) key() string {
+	if s.Instance != "" {
+		return s.Instance
+	}
+	return "addr " + s.Addr
+}
+
+func (s *IDSender) String() string {
+	if s.Instance != "" {
+		return fmt.Sprintf("%s (instance %s)", s.Addr, s.Instance)
+	}
+	return s.Addr
+}
+
+// find matches by instance, or by address for a device that rebooted with
+// a new instance token, as long as no other sender shares the address.
+func (c *IDConflict) find(sender IDSender) *IDSender {
+	var sameAddr []*IDSender
+	for _, s := range c.Senders {
+		if s.key() == sender.key() {
+			return s
+		}
+		if s.Addr == sender.Addr {
+			sameAddr = append(sameAddr, s)
+		}
+	}
+	if len(sameAddr) == 1 {
+		sameAddr[0].Instance = sender.Instance
+		return sameAddr[0]
+	}
+	return nil
+}
+
+// snapshot copies the conflict for API responses, which are encoded after
+// mu is released.
+func (c *IDConflict) snapshot() *IDConflict {
+	if c == nil {
+		return nil
+	}
+	cp := *c
+	cp.Senders = make([]*IDSender, len(c.Senders))
+	for i, s := range c.Senders {
+		sender := *s
+		cp.Senders[i] = &sender
+	}
+	return &cp
+}
+
+func (c *IDConflict) describe() string {
+	var parts []string
+	for _, s := range c.Senders {
+		part := s.String()
+		if s.Rejected {
+			part += " rejected"
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// claimID checks the request's sender against the device holding the ID
+// and writes a 409 itself when the sender is refused. Must be called with
+// mu held.
+func (srv *Server) claimID(w http.ResponseWriter, r *http.Request, esp *ESP, instance string) bool {
+	if srv.duplicateIDs == duplicateAllow {
+		return true
+	}
+	now := srv.now()
+	sender := IDSender{Instance: instance, Addr: srv.remoteHost(r), LastSeen: now}
+
+	if c := esp.Conflict; c != nil {
+		s := c.find(sender)
+		if s == nil {
+			// A third device, most likely another copy of the same image
+			s = &sender
+			s.Rejected = true
+			c.Senders = append(c.Senders, s)
+			srv.logger("esp").Warn("Another device uses a duplicate ESP ID", "esp_id", esp.ID, "sender", s.String())
+		}
+		s.LastSeen = now
+		if s.Rejected {
+			srv.requestLogger(r).Debug("Request from duplicate ESP refused", "esp_id", esp.ID, "sender", s.String())
+			writeError(w, CodeIDConflict, fmt.Sprintf("%s: '%s' is in use by another device", errIDConflict, esp.ID))
+			return false
+		}
+		return true
+	}
+
+	switch {
+	case esp.holder == nil || esp.holder.key() == sender.key():
+		esp.holder = &sender
+		return true
+	case now.Sub(esp.replaced[sender.key()]) < srv.timeoutDuration:
+		srv.startConflict(esp, &sender, esp.holder)
+		if srv.duplicateIDs == duplicateQuarantine {
+			writeError(w, CodeIDConflict, fmt.Sprintf("%s: '%s' is used by more than one device", errIDConflict, esp.ID))
+			return false
+		}
+		return true
+	}
+
+	if esp.replaced == nil {
+		esp.replaced = make(map[string]time.Time)
+	}
+	for key, at := range esp.replaced {
+		if now.Sub(at) >= srv.timeoutDuration {
+			delete(esp.replaced, key)
+		}
+	}
+	esp.replaced[esp.holder.key()] = now
+	srv.logger("esp").Debug("New sender took the ESP ID over", "esp_id", esp.ID, "previous", esp.holder.String(), "sender", sender.String())
+	esp.holder = &sender
+	return true
+}
+
+// startConflict records that the device that had the ID (original) came
+// back after newcomer took it over. Under reject the original keeps the ID.
+func (srv *Server) startConflict(esp *ESP, original, newcomer *IDSender) {
+	original.Rejected = srv.duplicateIDs == duplicateQuarantine
+	newcomer.Rejected = true
+	esp.Conflict = &IDConflict{Policy: srv.duplicateIDs, DetectedAt: srv.now(), Senders: []*IDSender{original, newcomer}}
+	esp.holder = original
+
+	detail := esp.Conflict.describe()
+	srv.logger("esp").Warn("Duplicate ESP ID detected", "esp_id", esp.ID, "policy", srv.duplicateIDs, "senders", detail)
+	srv.recordEvent(Event{Type: EventConflict, ESPID: esp.ID, Detail: detail})
+}
+
+// resolveConflict ends a conflict once at most one of the devices has been
+// seen within the ESP timeout. Called from the monitor with mu held.
+func (srv *Server) resolveConflict(esp *ESP, now time.Time) {
+	c := esp.Conflict
+	if c == nil {
+		return
+	}
+	var active []*IDSender
+	for _, s := range c.Senders {
+		if now.Sub(s.LastSeen) < srv.timeoutDuration {
+			active = append(active, s)
+		}
+	}
+	if len(active) > 1 {
+		return
+	}
+	if len(active) == 1 {
+		holder := *active[0]
+		holder.Rejected = false
+		esp.holder = &holder
+	}
+	esp.Conflict = nil
+	clear(esp.replaced)
+	srv.logger("monitor").Info("Duplicate ESP ID resolved", "esp_id", esp.ID)
+	srv.recordEvent(Event{Type: EventConflict, ESPID: esp.ID, Detail: "resolved"})
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Every error response is JSON with a stable code to branch on and a
+// message for people, which may change:
+//
+//	{"error":{"code":"esp_offline","message":"ESP 'nas' is offline"}}
+//
+// Each code always comes with the same HTTP status. New codes may be
+// added; clients should treat an unknown one by its status.
+
+type ErrorCode string
+
+const (
+	CodeInvalidRequest     ErrorCode = "invalid_request"
+	CodeInvalidJSON        ErrorCode = "invalid_json"
+	CodeUnsupportedCommand ErrorCode = "unsupported_command"
+	CodeUnauthorized       ErrorCode = "unauthorized"
+	CodeSignatureInvalid   ErrorCode = "signature_invalid"
+	CodeForbidden          ErrorCode = "forbidden"
+	CodeProtected          ErrorCode = "protected"
+	CodeWrongPairingCode   ErrorCode = "wrong_pairing_code"
+	CodeNotFound           ErrorCode = "not_found"
+	CodeESPNotFound        ErrorCode = "esp_not_found"
+	CodeMethodNotAllowed   ErrorCode = "method_not_allowed"
+	CodeConflict           ErrorCode = "conflict"
+	CodeAlreadyUp          ErrorCode = "already_up"
+	CodeIDConflict         ErrorCode = "id_conflict"
+	CodePendingApproval    ErrorCode = "pending_approval"
+	CodeCommandFinished    ErrorCode = "command_finished"
+	CodeTooLarge           ErrorCode = "too_large"
+	CodeUnsupportedMedia   ErrorCode = "unsupported_media_type"
+	CodeInvalidConfig      ErrorCode = "invalid_config"
+	CodeIdempotencyReused  ErrorCode = "idempotency_key_reused"
+	CodeMaintenance        ErrorCode = "maintenance"
+	CodeUpgradeRequired    ErrorCode = "upgrade_required"
+	CodeRateLimited        ErrorCode = "rate_limited"
+	CodeQueueFull          ErrorCode = "queue_full"
+	CodeCooldown           ErrorCode = "cooldown"
+	CodeQuotaExceeded      ErrorCode = "quota_exceeded"
+	CodeInternal           ErrorCode = "internal"
+	CodeWakeFailed         ErrorCode = "wake_failed"
+	CodeUpstreamFailed     ErrorCode = "upstream_failed"
+	CodeESPOffline         ErrorCode = "esp_offline"
+	CodeUnavailable        ErrorCode = "unavailable"
+)
+
+// errorCodes documents the codes, for the OpenAPI spec and the README.
+var errorCodes = []struct {
+	Code    ErrorCode
+	Status  int
+	Summary string
+}{
+	{CodeInvalidRequest, http.StatusBadRequest, "A parameter or field is missing or invalid"},
+	{CodeInvalidJSON, http.StatusBadRequest, "The body isn't valid JSON, or has unknown fields"},
+	{CodeUnsupportedCommand, http.StatusBadRequest, "The device can't run this command"},
+	{CodeUnauthorized, http.StatusUnauthorized, "No credentials, or wrong ones"},
+	{CodeSignatureInvalid, http.StatusUnauthorized, "A signed request is missing, invalid or replayed"},
+	{CodeForbidden, http.StatusForbidden, "Not allowed for this role, namespace, origin or address"},
+	{CodeProtected, http.StatusForbidden, "The device is protected; force off needs override"},
+	{CodeWrongPairingCode, http.StatusForbidden, "The pairing code doesn't match the device's"},
+	{CodeNotFound, http.StatusNotFound, "No such route, command, group, user or other resource"},
+	{CodeESPNotFound, http.StatusNotFound, "No device with this ID"},
+	{CodeMethodNotAllowed, http.StatusMethodNotAllowed, "The route doesn't take this method"},
+	{CodeConflict, http.StatusConflict, "It already exists, or is in use"},
+	{CodeAlreadyUp, http.StatusConflict, "The target is already up or booting; on needs force"},
+	{CodeIDConflict, http.StatusConflict, "More than one device uses the ESP ID"},
+	{CodePendingApproval, http.StatusConflict, "The device is waiting for approval"},
+	{CodeCommandFinished, http.StatusConflict, "The command was already acked, failed or expired"},
+	{CodeTooLarge, http.StatusRequestEntityTooLarge, "The body is over the route's limit"},
+	{CodeUnsupportedMedia, http.StatusUnsupportedMediaType, "The route doesn't take this content type"},
+	{CodeInvalidConfig, http.StatusUnprocessableEntity, "The config or import bundle doesn't validate"},
+	{CodeIdempotencyReused, http.StatusUnprocessableEntity, "The Idempotency-Key was used for a different request"},
+	{CodeMaintenance, http.StatusLocked, "The device is in maintenance"},
+	{CodeUpgradeRequired, http.StatusUpgradeRequired, "The WebSocket version isn't supported"},
+	{CodeRateLimited, http.StatusTooManyRequests, "Too many requests; wait for Retry-After"},
+	{CodeQueueFull, http.StatusTooManyRequests, "The device's command queue is full"},
+	{CodeCooldown, http.StatusTooManyRequests, "The device just got a power command; wait for Retry-After or use after_cooldown"},
+	{CodeQuotaExceeded, http.StatusTooManyRequests, "The device or its namespace used up a command quota; wait for Retry-After"},
+	{CodeInternal, http.StatusInternalServerError, "The server failed"},
+	{CodeWakeFailed, http.StatusInternalServerError, "The magic packet couldn't be sent"},
+	{CodeUpstreamFailed, http.StatusBadGateway, "The MQTT broker, sign-in provider or cluster leader failed"},
+	{CodeESPOffline, http.StatusServiceUnavailable, "The device is offline; queue_if_offline queues anyway"},
+	{CodeUnavailable, http.StatusServiceUnavailable, "The server is starting, or the feature isn't configured"},
+}
+
+var errorStatus = make(map[ErrorCode]int)
+
+func init() {
+	for _, c := range errorCodes {
+		errorStatus[c.Code] = c.Status
+	}
+}
+
+type errorResponse struct {
+	Error errorBody `json:"error"`
+}
+
+type errorBody struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+	// RetryAfterMS is set with Retry-After, in milliseconds
+	RetryAfterMS int64 `json:"retry_after_ms,omitempty"`
+}
+
+// writeError replies with the code's status and the error envelope, in
+// place of http.Error.
+func writeError(w http.ResponseWriter, code ErrorCode, message string) {
+	writeErrorBody(w, errorBody{Code: code, Message: message})
+}
+
+// writeRetryError is writeError for errors that go away by themselves,
+// with a Retry-After header.
+func writeRetryError(w http.ResponseWriter, code ErrorCode, message string, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	writeErrorBody(w, errorBody{Code: code, Message: message, RetryAfterMS: max(wait.Milliseconds(), 1)})
+}
+
+func writeErrorBody(w http.ResponseWriter, body errorBody) {
+	status, ok := errorStatus[body.Code]
+	if !ok {
+		status = http.StatusInternalServerError
+	}
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorResponse{Error: body})
+}
+
+// writeUnrouted answers requests no route matches: 405 for an API route
+// called with another method, 404 otherwise.
+func (srv *Server) writeUnrouted(w http.ResponseWriter, r *http.Request) {
+	if methods, ok := srv.routeMethods[strings.TrimPrefix(r.URL.Path, APIPrefix)]; ok && strings.HasPrefix(r.URL.Path, APIPrefix) {
+		w.Header().Set("Allow", strings.Join(methods, ", "))
+		writeError(w, CodeMethodNotAllowed, r.Method+" is not allowed on "+r.URL.Path)
+		return
+	}
+	writeError(w, CodeNotFound, "no route for "+r.URL.Path)
+}
+
+// commandErrorCode is the code for an error dispatchCommand returned.
+func commandErrorCode(err error) ErrorCode {
+	switch {
+	case errors.Is(err, errInvalidDuration):
+		return CodeInvalidRequest
+	case errors.Is(err, errUnsupportedCommand):
+		return CodeUnsupportedCommand
+	case errors.Is(err, errWakeFailed):
+		return CodeWakeFailed
+	case errors.Is(err, errPublishFailed):
+		return CodeUpstreamFailed
+	case errors.Is(err, errESPOffline):
+		return CodeESPOffline
+	case errors.Is(err, errIDConflict):
+		return CodeIDConflict
+	case errors.Is(err, errPending):
+		return CodePendingApproval
+	case errors.Is(err, errProtected):
+		return CodeProtected
+	case errors.Is(err, errMaintenance):
+		return CodeMaintenance
+	case errors.Is(err, errAlreadyUp):
+		return CodeAlreadyUp
+	case errors.Is(err, errQueueFull):
+		return CodeQueueFull
+	case errors.Is(err, errCooldown):
+		return CodeCooldown
+	case errors.Is(err, errQuota):
+		return CodeQuotaExceeded
+	}
+	return CodeInternal
+}
@@ -0,0 +1,881 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// VERSION is set at build time with -ldflags "-X
+// github.com/smileyfaceskobochka/trashbin-daemon/internal/server.VERSION=...";
+// see update.go for the other build metadata.
+var VERSION = "1.0.0"
+
+type ESPCommand string
+
+const (
+	CommandPulse  ESPCommand = "pulse"
+	CommandForce  ESPCommand = "force"
+	CommandStatus ESPCommand = "status"
+)
+
+type ESP struct {
+	ID          string           `json:"id"`
+	Type        DeviceType       `json:"type,omitempty"`
+	MAC         string           `json:"mac,omitempty"`
+	Broadcast   string           `json:"broadcast,omitempty"`
+	Queue       []*CommandRecord `json:"-"`
+	History     []*CommandRecord `json:"history,omitempty"` // the last commandHistorySize commands
+	Target      *Target          `json:"target,omitempty"`
+	TargetState *TargetState     `json:"-"`
+	Telemetry   *Telemetry       `json:"telemetry,omitempty"`
+	PulseMS     int              `json:"pulse_ms,omitempty"`
+	ForceMS     int              `json:"force_ms,omitempty"`
+	Agent       *AgentState      `json:"-"`
+	Power       *PowerInfo       `json:"-"`
+	LastPower   *PowerReport     `json:"last_power,omitempty"`
+	Driver      *DriverConfig    `json:"driver,omitempty"`
+	PinnedIP    string           `json:"pinned_ip,omitempty"`
+	Alias       string           `json:"alias,omitempty"`
+	Description string           `json:"description,omitempty"`
+	Location    string           `json:"location,omitempty"`
+	Hostname    string           `json:"hostname,omitempty"`
+	// Protected rejects force-off unless the command is sent with override
+	Protected bool           `json:"protected,omitempty"`
+	Actions   []CustomAction `json:"actions,omitempty"`
+	// Maintenance freezes the device, see checkMaintenance
+	Maintenance *Maintenance `json:"maintenance,omitempty"`
+	// Pairing is set while the device waits for approval, see holdForPairing
+	Pairing *Pairing `json:"pairing,omitempty"`
+	// Capabilities is what the firmware declared, nil for firmware that
+	// declared nothing; see supports
+	Capabilities *Capabilities `json:"capabilities,omitempty"`
+	// CooldownMS overrides -command-cooldown, see checkCooldown
+	CooldownMS int64 `json:"cooldown_ms,omitempty"`
+	// TimeoutMS overrides the offline timeout, PollIntervalMS is the median
+	// poll interval the adaptive one is based on
+	TimeoutMS      int64       `json:"timeout_ms,omitempty"`
+	PollIntervalMS int64       `json:"poll_interval_ms,omitempty"`
+	LastSeen       time.Time   `json:"last_seen"`
+	RegisteredAt   time.Time   `json:"registered_at"`
+	RemoteAddr     string      `json:"remote_addr"`
+	Online         bool        `json:"-"`
+	Conflict       *IDConflict `json:"-"`
+
+	ready     chan struct{}        // closed when a command is queued, see commandReady
+	longPolls int                  // polls currently held open
+	overdue   *time.Timer          // fires at the offline deadline, see armOfflineCheck
+	holder    *IDSender            // device currently using the ID, see claimID
+	replaced  map[string]time.Time // senders the ID was taken from recently
+	intervals []time.Duration      // recent gaps between heartbeats, see recordInterval
+
+	fastPollUntil time.Time   // polls are hinted fast until then, see hurryPolls
+	cooldownOver  *time.Timer // fires when a held command may go, see queueHeld
+	beacon        *beaconPeer // where its UDP beacons come from, see handleBeacon
+}
+
+// markSeen records a heartbeat, logging the return of an ESP that had gone
+// offline. Must be called with mu held.
+func (e *ESP) markSeen(srv *Server, actor string) {
+	if !e.Online {
+		srv.logger("monitor").Info("ESP is back online", "esp_id", e.ID)
+		srv.recordEvent(Event{Type: EventOnline, ESPID: e.ID, Actor: actor})
+	}
+	e.recordInterval(srv.now())
+	e.LastSeen = srv.now()
+	e.Online = true
+	srv.armOfflineCheck(e)
+}
+
+// espState holds the Server state kept in esp.go.
+type espState struct {
+	espMap          map[string]*ESP
+	mu              sync.Mutex
+	serverPort      string
+	timeoutDuration time.Duration
+	registryPath    string
+	drainTimeout    time.Duration
+	registry        Registry
+}
+
+// --- Server Mode ---
+
+func (srv *Server) runServer() {
+	srv.prepareDataDir()
+	srv.startTracing(srv.tracingSettings)
+	if srv.clusterEnabled() {
+		if srv.clusterSettings.NodeID == "" {
+			srv.clusterSettings.NodeID = srv.defaultNodeID()
+		}
+		if srv.clusterSettings.Advertise == "" {
+			srv.clusterSettings.Advertise = srv.defaultAdvertiseURL()
+		}
+		var err error
+		if srv.cluster, err = srv.newClusterNode(srv.clusterSettings); err != nil {
+			srv.fatal("cluster", "Invalid cluster settings", "error", err)
+		}
+	}
+	srv.registerAPI()
+	srv.handle("/ui/", scopePublic, srv.uiHandler())
+	srv.handle("/ui/events", scopeUser, srv.uiEventsHandler)
+	srv.handle("/ui/push/key", scopeUser, srv.pushKeyHandler)
+	srv.handle("/ui/push/subscribe", scopeUser, srv.pushSubscribeHandler)
+	srv.handle("/ui/push/unsubscribe", scopeUser, srv.pushUnsubscribeHandler)
+	srv.handle("/ui/push/test", scopeUser, srv.pushTestHandler)
+	srv.handle("/ui/session", scopePublic, srv.sessionHandler)
+	srv.handle("/ui/login", scopePublic, srv.loginHandler)
+	srv.handle("/ui/logout", scopePublic, srv.logoutHandler)
+	srv.handle("/ui/oidc/login", scopePublic, srv.oidcLoginHandler)
+	srv.handle("/ui/oidc/callback", scopePublic, srv.oidcCallbackHandler)
+	srv.handle("/status", scopePublic, srv.statusPageHandler)
+
+	hs := &http.Server{Handler: srv.withCluster(srv.logUnrouted(srv.router)), ConnContext: srv.tagAdminConn}
+	hs.RegisterOnShutdown(func() {
+		close(srv.uiStop)
+		close(srv.longPollStop)
+	})
+
+	ln, err := srv.activationListener()
+	if err != nil {
+		srv.fatal("systemd", "Could not use activation socket", "error", err)
+	}
+	lns := []net.Listener{ln}
+	if ln != nil {
+		srv.logger("systemd").Info("Using socket from systemd", "addr", ln.Addr().String())
+	} else if lns, err = listenAll(srv.listenAddrs()); err != nil {
+		srv.fatal("server", "Could not listen", "error", err)
+	}
+	if srv.adminSocket != "" {
+		adminLn, err := srv.listenAdminSocket()
+		if err != nil {
+			srv.fatal("server", "Could not open the admin socket", "path", srv.adminSocket, "error", err)
+		}
+		lns = append(lns, adminLn)
+	}
+	if srv.tlsEnabled() {
+		if err := srv.configureServerTLS(hs); err != nil {
+			srv.fatal("tls", "TLS setup failed", "error", err)
+		}
+	}
+	if srv.grpcEnabled() {
+		srv.startGRPC(hs)
+	}
+	if srv.mdnsEnabled {
+		srv.startMDNS(lns)
+	}
+
+	// Serve probes while the stores load; everything else gets 503 until
+	// serverReady is set
+	serveErr := make(chan error, len(lns))
+	for _, ln := range lns {
+		go func() {
+			if srv.tlsEnabled() {
+				serveErr <- hs.ServeTLS(ln, "", "")
+			} else {
+				serveErr <- hs.Serve(ln)
+			}
+		}()
+	}
+
+	var storeMode string
+	srv.store, storeMode, err = srv.openStore()
+	if err != nil {
+		srv.fatal("store", "Could not open store", "store", srv.storeSpec, "error", err)
+	}
+	// Registered before the registry save, so it runs after it
+	srv.onShutdown("close store", func() {
+		if err := srv.store.Close(); err != nil {
+			srv.logger("store").Error("Failed to close store", "error", err)
+		}
+	})
+	if srv.tracingEnabled() {
+		backend, _, _ := parseStoreSpec(srv.storeSpec)
+		srv.store = traceStore{Store: srv.store, backend: backend, srv: srv}
+	}
+	srv.registry = srv.store
+	if srv.clusterEnabled() {
+		// Followers keep an empty registry and forward everything until they
+		// get the lease
+		go srv.cluster.run(srv, func() {
+			srv.mu.Lock()
+			srv.registry = redisRegistry{node: srv.cluster, srv: srv}
+			srv.mu.Unlock()
+			srv.startServices()
+		})
+	} else {
+		srv.startServices()
+	}
+
+	tlsMode := "disabled"
+	switch {
+	case srv.acmeDomain != "":
+		tlsMode = "acme:" + srv.acmeDomain
+	case srv.tlsCertFile != "":
+		tlsMode = srv.tlsCertFile
+	}
+	registryMode, schedulesMode := "in-memory", "in-memory"
+	if srv.registryPath != "" {
+		registryMode = srv.registryPath
+	}
+	clusterMode := "disabled"
+	if srv.clusterEnabled() {
+		registryMode = "redis"
+		clusterMode = srv.clusterSettings.NodeID + " " + srv.clusterSettings.Advertise
+	}
+	if srv.schedulesPath != "" {
+		schedulesMode = srv.schedulesPath
+	}
+	adminMode := "disabled"
+	switch {
+	case srv.auth.AdminKey != "":
+		adminMode = "enabled"
+	case srv.authEnabled():
+		adminMode = "admin users only"
+	}
+	srv.usersMu.Lock()
+	userCount := len(srv.users)
+	srv.usersMu.Unlock()
+
+	startup := srv.logger("server")
+	startup.Info("Wake-On-Demand server starting",
+		"version", VERSION,
+		"addr", listenerAddrs(lns),
+		"esp_timeout", srv.timeoutDuration.String(),
+		"drain_timeout", srv.drainTimeout.String(),
+		"tls", tlsMode,
+		"config", srv.configPath,
+		"store", storeMode,
+		"registry", registryMode,
+		"schedules", schedulesMode,
+		"events", srv.eventsPath,
+		"uptime_dir", srv.uptimeDir,
+		"telemetry_dir", srv.telemetryDir,
+		"ota_dir", srv.otaDir,
+		"admin_key", adminMode,
+		"admin_socket", srv.adminSocket,
+		"users", userCount,
+		"esp_tokens", len(srv.auth.ESPTokens),
+		"namespace_tokens", len(srv.auth.NamespaceTokens),
+		"data_dir", srv.dataDir,
+		"dashboard", "/ui/",
+		"mqtt", srv.mqttSettings.Broker,
+		"cluster", clusterMode,
+		"notify_sinks", len(srv.notifySinks),
+		"rate_limit_ip", srv.ipLimiter.perMinute(),
+		"rate_limit_esp", srv.espLimiter.perMinute(),
+	)
+	if !srv.authEnabled() {
+		startup.Warn("No admin key or users configured, control endpoints are open")
+	}
+
+	if srv.clusterEnabled() {
+		// Hooks run in reverse, so the lease is released after the last save
+		srv.onShutdown("release cluster lease", func() { srv.cluster.release(srv) })
+	}
+	srv.onShutdown("save registry", func() {
+		srv.mu.Lock()
+		srv.saveRegistry()
+		srv.mu.Unlock()
+	})
+	// Hijacked WebSocket connections are not tracked by http.Server
+	srv.onShutdown("close websockets", srv.closeAllWS)
+	if srv.mqttEnabled() {
+		srv.onShutdown("disconnect mqtt", srv.closeMQTT)
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	srv.notifyShutdown(sigChan)
+	go srv.watchReload()
+
+	shutdownDone := make(chan struct{})
+	go func() {
+		<-sigChan
+		srv.serverReady.Store(false)
+		shutdownLog := srv.logger("shutdown")
+		shutdownLog.Info("Received shutdown signal, draining in-flight requests", "timeout", srv.drainTimeout.String())
+		sdNotify("STOPPING=1")
+		// Stop new traffic from being routed here while the rest drains
+		srv.stopServiceRegistration()
+
+		ctx, cancel := context.WithTimeout(context.Background(), srv.drainTimeout)
+		defer cancel()
+		if err := hs.Shutdown(ctx); err != nil {
+			shutdownLog.Error("Drain incomplete", "error", err)
+			hs.Close()
+		}
+
+		srv.runShutdownHooks()
+		shutdownLog.Info("Server stopped")
+		close(shutdownDone)
+	}()
+
+	srv.serverReady.Store(true)
+	sdNotify("READY=1\nSTATUS=Serving on " + listenerAddrs(lns))
+	if srv.serviceRegistryEnabled() {
+		srv.startServiceRegistration(lns)
+	}
+	if interval := watchdogInterval(); interval > 0 {
+		go srv.runWatchdog(interval)
+	}
+
+	if err := <-serveErr; !errors.Is(err, http.ErrServerClosed) {
+		srv.fatal("server", "Server failed", "error", err)
+	}
+	<-shutdownDone
+}
+
+// startServices loads the stores and starts the background loops. Cluster
+// followers call it only once they become leader.
+func (srv *Server) startServices() {
+	srv.loadRegistry()
+	srv.loadSchedules()
+	srv.loadUsers()
+	srv.loadDeviceSecrets()
+	srv.loadGroups()
+	srv.loadPush(srv.config.WebPush)
+	srv.loadEvents()
+	srv.loadUptime()
+	srv.loadTelemetryHistory()
+	srv.loadOTA()
+
+	go srv.monitorESPs()
+	go srv.runScheduler()
+	go srv.runProber()
+	go srv.runWakeVerifier()
+	go srv.runPusher()
+	if srv.notificationsEnabled() {
+		go srv.runNotifier()
+	}
+	if len(srv.config.IdlePolicies) > 0 {
+		go srv.runIdlePolicies()
+	}
+	if srv.telegramEnabled() {
+		go srv.runTelegramBot()
+	}
+	if srv.upsEnabled() {
+		go srv.runUPSMonitor()
+	}
+	if srv.mqttEnabled() {
+		go srv.runMQTT()
+		if srv.mqttSettings.Discovery {
+			go srv.runHADiscovery()
+		}
+	}
+	if srv.backupEnabled() {
+		go srv.runBackups()
+	}
+	if srv.beaconEnabled() {
+		srv.startBeacon()
+	}
+}
+
+func (srv *Server) handle(path string, scope authScope, h http.HandlerFunc) {
+	srv.router.HandleFunc(path, srv.wrapHandler(path, scope, h))
+}
+
+func (srv *Server) wrapHandler(path string, scope authScope, h http.HandlerFunc) http.HandlerFunc {
+	return srv.withTracing(path, srv.withRequestID(path, srv.withAccessLog(path, scope, srv.instrument(path, srv.withCORS(path, srv.withReadiness(path, srv.withRateLimit(path, srv.withNetworkACL(path, scope, withBodyLimit(path, srv.withAuth(scope, h))))))))))
+}
+
+func (srv *Server) registerHandler(w http.ResponseWriter, r *http.Request) {
+	clientIP := r.RemoteAddr
+	rlog := srv.requestLogger(r)
+	rlog.Debug("Register request")
+
+	if r.Method != http.MethodPost {
+		rlog.Warn("Method not allowed", "method", r.Method)
+		writeError(w, CodeMethodNotAllowed, "only POST allowed")
+		return
+	}
+
+	var data struct {
+		ID       string `json:"id"`
+		Power    string `json:"power"`
+		Instance string `json:"instance"`
+		// Actions are the custom actions the firmware supports; nil
+		// keeps the ones declared before
+		Actions []CustomAction `json:"actions"`
+		// Protocol and Features are what the firmware speaks, see
+		// negotiateCapabilities
+		Protocol int      `json:"protocol"`
+		Features []string `json:"features"`
+		Telemetry
+	}
+	if err := decodeJSON(w, r, &data); err != nil {
+		rlog.Warn("Invalid JSON", "error", err)
+		return
+	}
+	data.ID = espID(r)
+
+	if err := validateESPID(data.ID); err != nil {
+		rlog.Warn("Invalid ESP ID", "esp_id", data.ID, "error", err)
+		writeError(w, CodeInvalidRequest, err.Error())
+		return
+	}
+	if err := ValidateActions(data.Actions); err != nil {
+		rlog.Warn("Invalid actions", "esp_id", data.ID, "error", err)
+		writeError(w, CodeInvalidRequest, err.Error())
+		return
+	}
+	if err := validateFeatures(data.Protocol, data.Features); err != nil {
+		rlog.Warn("Invalid features", "esp_id", data.ID, "error", err)
+		writeError(w, CodeInvalidRequest, err.Error())
+		return
+	}
+	if !srv.allowESPRequest(w, r, data.ID) {
+		return
+	}
+
+	srv.mu.Lock()
+	if existing, exists := srv.espMap[data.ID]; exists && (existing.isWoL() || existing.isMQTT() || existing.isDriver()) {
+		srv.mu.Unlock()
+		rlog.Warn("ID belongs to another device type", "esp_id", data.ID, "type", existing.Type)
+		writeError(w, CodeConflict, fmt.Sprintf("'%s' is registered as a %s device", data.ID, existing.Type))
+		return
+	}
+	if existing, exists := srv.espMap[data.ID]; exists && (!srv.checkPin(w, r, existing) || !srv.claimID(w, r, existing, data.Instance)) {
+		srv.mu.Unlock()
+		return
+	}
+
+	now := srv.now()
+	if _, exists := srv.espMap[data.ID]; !exists {
+		srv.espMap[data.ID] = &ESP{
+			ID:           data.ID,
+			LastSeen:     now,
+			RegisteredAt: now,
+			RemoteAddr:   clientIP,
+			Online:       true,
+			Target:       srv.configTarget(data.ID),
+		}
+		srv.checkPin(w, r, srv.espMap[data.ID])
+		srv.claimID(w, r, srv.espMap[data.ID], data.Instance)
+		srv.holdForPairing(srv.espMap[data.ID])
+		srv.armOfflineCheck(srv.espMap[data.ID])
+		rlog.Info("New ESP registered", "esp_id", data.ID)
+	} else {
+		srv.espMap[data.ID].markSeen(srv, srv.requestActor(r))
+		srv.espMap[data.ID].RemoteAddr = clientIP
+		rlog.Info("ESP re-registered", "esp_id", data.ID)
+	}
+	srv.updateTelemetry(srv.espMap[data.ID], data.Telemetry)
+	if data.Power != "" {
+		srv.espMap[data.ID].powerSensor(srv, data.Power)
+	}
+	if data.Actions != nil {
+		srv.espMap[data.ID].Actions = data.Actions
+	}
+	caps, unknown := negotiateCapabilities(data.Protocol, data.Features)
+	if len(unknown) > 0 {
+		rlog.Debug("Firmware declared unknown features", "esp_id", data.ID, "features", strings.Join(unknown, ","))
+	}
+	srv.espMap[data.ID].Capabilities = caps
+	srv.recordEvent(Event{Type: EventRegister, ESPID: data.ID, Actor: srv.requestActor(r)})
+	srv.saveRegistry()
+	resp := map[string]interface{}{"status": "registered"}
+	srv.capabilityFields(srv.espMap[data.ID], resp)
+	status := http.StatusOK
+	if srv.espMap[data.ID].Pairing != nil {
+		resp["status"], status = "pending", http.StatusAccepted
+		pairingFields(srv.espMap[data.ID], resp)
+	}
+	srv.mu.Unlock()
+
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (srv *Server) commandHandler(w http.ResponseWriter, r *http.Request) {
+	id := espID(r)
+	rlog := srv.requestLogger(r)
+
+	if id == "" {
+		rlog.Warn("Poll without ESP ID")
+		writeError(w, CodeInvalidRequest, "missing id")
+		return
+	}
+	wait, err := parseLongPollWait(r.URL.Query().Get("wait"))
+	if err != nil {
+		writeError(w, CodeInvalidRequest, err.Error())
+		return
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	esp, exists := srv.espMap[id]
+	if !exists || esp.isWoL() || esp.isMQTT() || esp.isDriver() {
+		rlog.Warn("Poll from unregistered ESP", "esp_id", id)
+		writeError(w, CodeESPNotFound, "ESP not registered")
+		return
+	}
+	if !srv.checkPin(w, r, esp) || !srv.claimID(w, r, esp, r.URL.Query().Get("instance")) {
+		return
+	}
+
+	rlog.Debug("Poll", "esp_id", id)
+	esp.markSeen(srv, srv.requestActor(r))
+	srv.metricPolls.Inc(id)
+	srv.recordEvent(Event{Type: EventPoll, ESPID: id, Actor: srv.requestActor(r)})
+	srv.updateTelemetry(esp, srv.telemetryFromQuery(id, r.URL.Query()))
+	if power := r.URL.Query().Get("power"); power != "" {
+		esp.powerSensor(srv, power)
+	}
+
+	rec := srv.dequeueCommand(esp)
+	if rec == nil && wait > 0 {
+		rec = srv.waitForCommand(r, esp, wait)
+	}
+	resp := map[string]interface{}{"command": ""}
+	if rec != nil {
+		rlog.Info("Command sent to ESP", "esp_id", id, "command", rec.Command, "command_id", rec.ID)
+		resp = rec.payload(srv)
+		// Lets the ESP poll again right away instead of waiting a full interval
+		resp["pending"] = len(esp.Queue)
+	}
+	if esp.supports(featurePollHint) {
+		resp["next_poll_ms"] = srv.nextPoll(esp, srv.now()).Milliseconds()
+	}
+	pairingFields(esp, resp)
+	if offer := srv.otaOffer(esp); offer != nil {
+		resp["ota"] = offer
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	// Keep '&' in the OTA URL readable for small JSON parsers
+	enc.SetEscapeHTML(false)
+	enc.Encode(resp)
+}
+
+func (srv *Server) setCommandHandler(w http.ResponseWriter, r *http.Request) {
+	rlog := srv.requestLogger(r)
+	rlog.Debug("Set-command request")
+
+	if r.Method != http.MethodPost {
+		rlog.Warn("Method not allowed", "method", r.Method)
+		writeError(w, CodeMethodNotAllowed, "only POST allowed")
+		return
+	}
+
+	var data struct {
+		ID         string `json:"id"`
+		Command    string `json:"command"`
+		DurationMS int    `json:"duration_ms"`
+		Force      bool   `json:"force"`
+		TTLMS      int    `json:"ttl_ms"`
+		// QueueIfOffline keeps the command for an offline ESP's next poll
+		QueueIfOffline bool `json:"queue_if_offline"`
+		// AfterCooldown queues a power command until the cooldown is over
+		AfterCooldown bool `json:"after_cooldown"`
+		// Action names the custom action for the action command
+		Action string `json:"action"`
+		// Override allows force for a protected device
+		Override bool `json:"override"`
+		DryRun   bool `json:"dry_run"`
+		// Priority is low, normal (the default) or urgent
+		Priority string `json:"priority"`
+	}
+	if err := decodeJSON(w, r, &data); err != nil {
+		rlog.Warn("Invalid JSON", "error", err)
+		return
+	}
+	if data.DurationMS < 0 {
+		writeError(w, CodeInvalidRequest, "duration_ms must be positive")
+		return
+	}
+	if data.TTLMS < 0 {
+		writeError(w, CodeInvalidRequest, "ttl_ms must be positive")
+		return
+	}
+	if !knownCommand(ESPCommand(data.Command)) {
+		rlog.Warn("Unknown command", "command", data.Command)
+		writeError(w, CodeInvalidRequest, fmt.Sprintf("unknown command %q (use pulse, force, status, soft-off or action)", data.Command))
+		return
+	}
+	priority, err := ParsePriority(data.Priority)
+	if err != nil {
+		writeError(w, CodeInvalidRequest, err.Error())
+		return
+	}
+
+	opts := commandOptions{
+		Duration: time.Duration(data.DurationMS) * time.Millisecond,
+		Force:    data.Force,
+		TTL:      time.Duration(data.TTLMS) * time.Millisecond,
+
+		QueueIfOffline: data.QueueIfOffline,
+		AfterCooldown:  data.AfterCooldown,
+		Action:         data.Action,
+		Override:       data.Override,
+		DryRun:         data.DryRun,
+		Priority:       priority,
+
+		IgnoreMaintenance: data.Override && requestPrincipal(r).Role == RoleAdmin,
+		IgnoreQuota:       data.Override && requestPrincipal(r).Role == RoleAdmin,
+	}
+	if name, ok := GroupRef(data.ID); ok {
+		srv.setGroupCommand(w, r, name, ESPCommand(data.Command), opts)
+		return
+	}
+	data.ID = srv.resolveAlias(data.ID)
+
+	if p := requestPrincipal(r); !p.canControl(data.ID) {
+		rlog.Warn("User may not control ESP", "user", p.Name, "esp_id", data.ID)
+		writeError(w, CodeForbidden, fmt.Sprintf("not allowed to control '%s'", data.ID))
+		return
+	}
+	// Urgent commands get through while the device's limit is used up
+	if priority != PriorityUrgent && !srv.allowESPRequest(w, r, data.ID) {
+		return
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	esp, exists := srv.espMap[data.ID]
+	if !exists {
+		rlog.Warn("ESP not found", "esp_id", data.ID)
+		writeError(w, CodeESPNotFound, "ESP not registered")
+		return
+	}
+
+	var cooling *cooldownError
+	var quota *quotaError
+	result, err := srv.dispatchCommand(esp, ESPCommand(data.Command), opts, srv.requestActor(r))
+	switch {
+	case errors.Is(err, errInvalidDuration):
+		writeError(w, CodeInvalidRequest, err.Error())
+		return
+	case errors.Is(err, errUnsupportedCommand):
+		rlog.Warn("Unsupported command", "esp_id", data.ID, "command", data.Command)
+		writeError(w, CodeUnsupportedCommand, err.Error())
+		return
+	case errors.Is(err, errWakeFailed):
+		rlog.Error("Magic packet failed", "esp_id", data.ID, "error", err)
+		writeError(w, CodeWakeFailed, errWakeFailed.Error())
+		return
+	case errors.Is(err, errPublishFailed):
+		rlog.Error("MQTT publish failed", "esp_id", data.ID, "error", err)
+		writeError(w, CodeUpstreamFailed, err.Error())
+		return
+	case errors.Is(err, errESPOffline):
+		rlog.Warn("ESP offline", "esp_id", data.ID, "command", data.Command)
+		if !srv.driverFor(esp).Queues() {
+			writeError(w, CodeESPOffline, err.Error())
+			return
+		}
+		writeError(w, CodeESPOffline, fmt.Sprintf("ESP '%s' is offline (send with queue_if_offline to queue it anyway)", data.ID))
+		return
+	case errors.Is(err, errIDConflict):
+		writeError(w, CodeIDConflict, err.Error())
+		return
+	case errors.Is(err, errPending):
+		writeError(w, CodePendingApproval, err.Error())
+		return
+	case errors.Is(err, errProtected):
+		rlog.Warn("Force-off of protected ESP refused", "esp_id", data.ID)
+		writeError(w, CodeProtected, err.Error())
+		return
+	case errors.Is(err, errMaintenance):
+		rlog.Warn("Command for ESP in maintenance refused", "esp_id", data.ID, "command", data.Command)
+		writeError(w, CodeMaintenance, err.Error())
+		return
+	case errors.Is(err, errAlreadyUp):
+		rlog.Info("Target already up", "esp_id", data.ID, "power", esp.powerState())
+		writeError(w, CodeAlreadyUp, err.Error()+" (send with force to override)")
+		return
+	case errors.Is(err, errQueueFull):
+		rlog.Warn("Queue full", "esp_id", data.ID, "command", data.Command, "depth", len(esp.Queue))
+		writeError(w, CodeQueueFull, err.Error())
+		return
+	case errors.As(err, &cooling):
+		rlog.Info("Power command during cooldown refused", "esp_id", data.ID, "command", data.Command, "left", cooling.Left.Round(time.Millisecond).String())
+		writeRetryError(w, CodeCooldown, err.Error()+" (send with after_cooldown to queue it until then)", cooling.Left)
+		return
+	case errors.As(err, &quota):
+		rlog.Warn("Command over quota refused", "esp_id", data.ID, "command", data.Command, "quota", quota.Scope, "left", quota.Left.Round(time.Second).String())
+		writeRetryError(w, CodeQuotaExceeded, err.Error(), quota.Left)
+		return
+	}
+
+	if opts.DryRun {
+		rlog.Info("Command dry run", "esp_id", data.ID, "command", data.Command, "delivery", result.Delivery)
+		resp := map[string]interface{}{
+			"status":      result.Status,
+			"id":          data.ID,
+			"command":     data.Command,
+			"action":      data.Action,
+			"delivery":    result.Delivery,
+			"fallback":    result.Fallback,
+			"offline":     result.Offline,
+			"queue_depth": len(esp.Queue),
+		}
+		if duration, err := pulseDuration(esp, ESPCommand(data.Command), opts); err == nil {
+			resp["duration_ms"] = duration.Milliseconds()
+		}
+		// A real send would return the command already queued
+		if result.Record != nil {
+			resp["command_id"] = result.Record.ID
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	rec := result.Record
+	if result.Status == "duplicate" {
+		rlog.Info("Command already queued", "esp_id", data.ID, "command", data.Command, "command_id", rec.ID)
+	} else {
+		rlog.Info("Command "+result.Status, "esp_id", data.ID, "command", data.Command, "command_id", rec.ID, "delivery", result.Delivery)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":      result.Status,
+		"id":          data.ID,
+		"command":     data.Command,
+		"action":      rec.Action,
+		"command_id":  rec.ID,
+		"duration_ms": rec.DurationMS,
+		"delivery":    result.Delivery,
+		"fallback":    result.Fallback,
+		"offline":     result.Offline,
+		"queue_depth": len(esp.Queue),
+	})
+}
+
+type ESPInfo struct {
+	ID       string `json:"id"`
+	Alias    string `json:"alias,omitempty"`
+	Type     string `json:"type"`
+	Online   bool   `json:"online"`
+	LastSeen string `json:"last_seen"`
+
+	Description string `json:"description,omitempty"`
+	Location    string `json:"location,omitempty"`
+	Hostname    string `json:"hostname,omitempty"`
+	Protected   bool   `json:"protected,omitempty"`
+
+	Maintenance *Maintenance   `json:"maintenance,omitempty"`
+	Actions     []CustomAction `json:"actions,omitempty"`
+	Timeout     *TimeoutInfo   `json:"timeout,omitempty"`
+	Target      *Target        `json:"target,omitempty"`
+	TargetState *TargetState   `json:"target_state,omitempty"`
+	Telemetry   *Telemetry     `json:"telemetry,omitempty"`
+	Agent       *AgentState    `json:"agent,omitempty"`
+	Power       *PowerInfo     `json:"power,omitempty"`
+	LastPower   *PowerReport   `json:"last_power,omitempty"`
+	Groups      []string       `json:"groups,omitempty"`
+	Conflict    *IDConflict    `json:"conflict,omitempty"`
+	Idle        []IdleState    `json:"idle,omitempty"`
+
+	// PendingSince is set while the device waits for approval
+	PendingSince *time.Time `json:"pending_since,omitempty"`
+}
+
+// espInfo must be called with mu held.
+func (srv *Server) espInfo(esp *ESP) ESPInfo {
+	lastSeen := "never"
+	if !esp.LastSeen.IsZero() {
+		lastSeen = srv.now().Sub(esp.LastSeen).Round(time.Second).String() + " ago"
+	}
+	info := ESPInfo{
+		ID:       esp.ID,
+		Alias:    srv.aliasFor(esp.ID),
+		Type:     string(esp.deviceType()),
+		Online:   esp.Online,
+		LastSeen: lastSeen,
+
+		Description: esp.Description,
+		Location:    esp.Location,
+		Hostname:    esp.Hostname,
+		Protected:   esp.Protected,
+
+		Maintenance: esp.Maintenance,
+		Actions:     esp.Actions,
+		Timeout:     esp.timeoutInfo(srv),
+		Target:      esp.Target,
+		TargetState: esp.TargetState,
+		Telemetry:   esp.Telemetry,
+		LastPower:   esp.LastPower,
+		Conflict:    esp.Conflict.snapshot(),
+	}
+	if esp.Pairing != nil {
+		since := esp.Pairing.Since
+		info.PendingSince = &since
+	}
+	if esp.agentOnline(srv) {
+		agent := *esp.Agent
+		info.Agent = &agent
+	}
+	if esp.powerTracked() {
+		power := PowerInfo{State: PowerUnknown}
+		if esp.Power != nil {
+			power = *esp.Power
+		}
+		info.Power = &power
+	}
+	info.Groups = srv.espGroups(esp.ID)
+	info.Idle = srv.idleInfo(esp.ID)
+	return info
+}
+
+// snapshotESPs returns the devices p may see. Must be called with mu held.
+func (srv *Server) snapshotESPs(p *principal) []ESPInfo {
+	esps, _, _ := srv.listPage(p, listQuery{sort: "id"})
+	return esps
+}
+
+func (srv *Server) listHandler(w http.ResponseWriter, r *http.Request) {
+	rlog := srv.requestLogger(r)
+	rlog.Debug("List request")
+
+	lq, err := srv.parseListQuery(r.URL.Query())
+	if err != nil {
+		writeError(w, CodeInvalidRequest, err.Error())
+		return
+	}
+	srv.mu.Lock()
+	esps, total, next := srv.listPage(requestPrincipal(r), lq)
+	srv.mu.Unlock()
+
+	rlog.Info("Listed ESPs", "count", len(esps), "total", total)
+
+	resp := map[string]interface{}{"esps": esps, "total": total}
+	if next != "" {
+		resp["next_cursor"] = next
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (srv *Server) healthHandler(w http.ResponseWriter, r *http.Request) {
+	srv.mu.Lock()
+	espCount := len(srv.espMap)
+	onlineCount := 0
+	for _, esp := range srv.espMap {
+		if esp.Online {
+			onlineCount++
+		}
+	}
+	srv.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	rev, _ := BuildCommit()
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":  "ok",
+		"version": VERSION,
+		"commit":  rev,
+		"esps": map[string]int{
+			"total":  espCount,
+			"online": onlineCount,
+		},
+	})
+}
@@ -0,0 +1,239 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type EventType string
+
+const (
+	EventRegister   EventType = "register"
+	EventPoll       EventType = "poll"
+	EventCommand    EventType = "command"
+	EventRejected   EventType = "rejected"
+	EventDelivered  EventType = "delivered"
+	EventAcked      EventType = "acked"
+	EventFailed     EventType = "failed"
+	EventExpired    EventType = "expired"
+	EventOnline     EventType = "online"
+	EventOffline    EventType = "offline"
+	EventTargetUp   EventType = "target_up"
+	EventTargetDown EventType = "target_down"
+	EventPower      EventType = "power"
+	EventBattery    EventType = "battery"
+	EventFlush      EventType = "flush"
+	EventRemoved    EventType = "removed"
+	EventConflict   EventType = "conflict"
+	EventIdle       EventType = "idle"
+	EventReload     EventType = "reload"
+	EventImport     EventType = "import"
+
+	// EventMaintenance is a device entering or leaving maintenance
+	EventMaintenance EventType = "maintenance"
+	// EventUPS is the UPS switching between mains and battery
+	EventUPS EventType = "ups"
+	// EventPairing is a new device waiting for approval, or its approval
+	EventPairing EventType = "pairing"
+	// EventHook is a wake hook chain finishing
+	EventHook EventType = "hook"
+	// EventMacro is a macro run finishing
+	EventMacro EventType = "macro"
+)
+
+var eventTypes = []EventType{
+	EventRegister, EventPoll, EventCommand, EventRejected, EventDelivered, EventAcked, EventFailed, EventExpired,
+	EventOnline, EventOffline, EventTargetUp, EventTargetDown, EventPower, EventBattery, EventFlush, EventRemoved,
+	EventConflict, EventIdle, EventReload, EventImport, EventMaintenance, EventUPS, EventPairing, EventHook,
+	EventMacro,
+}
+
+const (
+	maxEventsInMemory = 10000
+	defaultEventPage  = 100
+	maxEventPage      = 1000
+)
+
+// Event is one entry of the audit log. Seq increases monotonically and is
+// used as the pagination cursor.
+type Event struct {
+	Seq       uint64     `json:"seq"`
+	Time      time.Time  `json:"time"`
+	Type      EventType  `json:"type"`
+	ESPID     string     `json:"esp_id,omitempty"`
+	Actor     string     `json:"actor,omitempty"`
+	Command   ESPCommand `json:"command,omitempty"`
+	CommandID string     `json:"command_id,omitempty"`
+	Detail    string     `json:"detail,omitempty"`
+}
+
+// eventsState holds the Server state kept in events.go.
+type eventsState struct {
+	eventsMu   sync.Mutex
+	events     []Event
+	eventSeq   uint64
+	eventsPath string
+}
+
+// loadEvents reads the tail of the event log from the store.
+func (srv *Server) loadEvents() {
+	list, err := srv.store.LoadEvents(maxEventsInMemory)
+	if err != nil {
+		srv.fatal("events", "Failed to load event log", "store", srv.storeSpec, "error", err)
+	}
+
+	srv.eventsMu.Lock()
+	defer srv.eventsMu.Unlock()
+	for _, e := range list {
+		srv.appendEvent(e)
+		srv.eventSeq = max(srv.eventSeq, e.Seq)
+	}
+	if len(list) > 0 {
+		srv.logger("events").Info("Event log loaded", "count", len(srv.events), "last_seq", srv.eventSeq)
+	}
+}
+
+// appendEvent must be called with eventsMu held (or before the server starts).
+func (srv *Server) appendEvent(e Event) {
+	srv.events = append(srv.events, e)
+	if len(srv.events) > maxEventsInMemory {
+		srv.events = slices.Delete(srv.events, 0, len(srv.events)-maxEventsInMemory)
+	}
+}
+
+// recordEvent appends an event to the audit log. It only takes eventsMu, so
+// it is safe to call with mu held.
+func (srv *Server) recordEvent(e Event) {
+	srv.eventsMu.Lock()
+	defer srv.eventsMu.Unlock()
+
+	srv.eventSeq++
+	e.Seq = srv.eventSeq
+	e.Time = srv.now()
+	srv.appendEvent(e)
+	srv.notifyEvent(e)
+	srv.webhookEvent(e)
+	srv.pushEvent(e)
+	srv.publishStream(e)
+
+	if err := srv.store.AppendEvent(e); err != nil {
+		srv.logger("events").Error("Failed to write event log", "error", err)
+	}
+}
+
+// requestActor describes who made a request for the audit log: the user
+// name when authenticated, and the client's address.
+func (srv *Server) requestActor(r *http.Request) string {
+	host := srv.remoteHost(r)
+	if p, ok := r.Context().Value(principalKey{}).(*principal); ok {
+		return p.Name + "@" + host
+	}
+	return host
+}
+
+// parseSince accepts an RFC 3339 timestamp or a duration such as 24h.
+func (srv *Server) parseSince(s string) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return srv.now().Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid since %q (use a duration like 24h or an RFC 3339 time)", s)
+	}
+	return t, nil
+}
+
+// eventsHandler returns events newest first. Pass next_cursor back as
+// ?cursor= to fetch the following (older) page.
+func (srv *Server) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, CodeMethodNotAllowed, "only GET allowed")
+		return
+	}
+
+	q := r.URL.Query()
+	espID := q.Get("esp_id")
+	if espID != "" {
+		espID = srv.resolveAlias(espID)
+	}
+
+	var since time.Time
+	if s := q.Get("since"); s != "" {
+		t, err := srv.parseSince(s)
+		if err != nil {
+			writeError(w, CodeInvalidRequest, err.Error())
+			return
+		}
+		since = t
+	}
+
+	var types []EventType
+	if t := q.Get("type"); t != "" {
+		for _, name := range strings.Split(t, ",") {
+			types = append(types, EventType(strings.TrimSpace(name)))
+		}
+	}
+
+	limit := defaultEventPage
+	if l := q.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 {
+			writeError(w, CodeInvalidRequest, "invalid limit")
+			return
+		}
+		limit = min(n, maxEventPage)
+	}
+
+	var cursor uint64
+	if c := q.Get("cursor"); c != "" {
+		n, err := strconv.ParseUint(c, 10, 64)
+		if err != nil {
+			writeError(w, CodeInvalidRequest, "invalid cursor")
+			return
+		}
+		cursor = n
+	}
+
+	p := requestPrincipal(r)
+	page := make([]Event, 0, limit)
+	var next uint64
+
+	srv.eventsMu.Lock()
+	for i := len(srv.events) - 1; i >= 0; i-- {
+		e := srv.events[i]
+		if cursor != 0 && e.Seq >= cursor {
+			continue
+		}
+		if e.Time.Before(since) {
+			break
+		}
+		if espID != "" && e.ESPID != espID {
+			continue
+		}
+		if len(types) > 0 && !slices.Contains(types, e.Type) {
+			continue
+		}
+		if e.ESPID == "" && !p.global() || e.ESPID != "" && !p.canView(e.ESPID) {
+			continue
+		}
+		if len(page) == limit {
+			next = page[len(page)-1].Seq
+			break
+		}
+		page = append(page, e)
+	}
+	srv.eventsMu.Unlock()
+
+	resp := map[string]interface{}{"events": page}
+	if next != 0 {
+		resp["next_cursor"] = strconv.FormatUint(next, 10)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
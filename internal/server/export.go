@@ -0,0 +1,664 @@
+package server
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// export and import move the server's configuration between servers: the
+// devices with their settings, groups, schedules, users and device secrets.
+// Runtime state (queues, telemetry, history, online status) stays behind.
+// The bundle holds token hashes and secrets, so it is admin only.
+
+const (
+	bundleVersion   = 1
+	maxImportSize   = 8 << 20
+	ImportMerge     = "merge"
+	ImportReplace   = "replace"
+	BundleFormatYML = "yaml"
+)
+
+// configBundle is the file export writes and import reads.
+type configBundle struct {
+	Version    int              `json:"version"`
+	ExportedAt time.Time        `json:"exported_at"`
+	Devices    []exportedDevice `json:"devices"`
+	Groups     []Group          `json:"groups,omitempty"`
+	Schedules  []*Schedule      `json:"schedules,omitempty"`
+	Users      []*User          `json:"users,omitempty"`
+	Secrets    []*DeviceSecret  `json:"secrets,omitempty"`
+}
+
+// exportedDevice is the configured part of an ESP.
+type exportedDevice struct {
+	ID           string         `json:"id"`
+	Type         DeviceType     `json:"type,omitempty"`
+	MAC          string         `json:"mac,omitempty"`
+	Broadcast    string         `json:"broadcast,omitempty"`
+	Alias        string         `json:"alias,omitempty"`
+	Description  string         `json:"description,omitempty"`
+	Location     string         `json:"location,omitempty"`
+	Hostname     string         `json:"hostname,omitempty"`
+	Protected    bool           `json:"protected,omitempty"`
+	Target       *Target        `json:"target,omitempty"`
+	Driver       *DriverConfig  `json:"driver,omitempty"`
+	PulseMS      int            `json:"pulse_ms,omitempty"`
+	ForceMS      int            `json:"force_ms,omitempty"`
+	TimeoutMS    int64          `json:"timeout_ms,omitempty"`
+	CooldownMS   int64          `json:"cooldown_ms,omitempty"`
+	Actions      []CustomAction `json:"actions,omitempty"`
+	RegisteredAt time.Time      `json:"registered_at"`
+}
+
+func exportDevice(esp *ESP) exportedDevice {
+	var driver *DriverConfig
+	if esp.Driver != nil {
+		d := *esp.Driver
+		driver = &d
+	}
+	var target *Target
+	if esp.Target != nil {
+		t := *esp.Target
+		target = &t
+	}
+	return exportedDevice{
+		ID: esp.ID, Type: esp.deviceType(), MAC: esp.MAC, Broadcast: esp.Broadcast,
+		Alias: esp.Alias, Description: esp.Description, Location: esp.Location, Hostname: esp.Hostname,
+		Protected: esp.Protected, Target: target, Driver: driver,
+		PulseMS: esp.PulseMS, ForceMS: esp.ForceMS, TimeoutMS: esp.TimeoutMS, CooldownMS: esp.CooldownMS,
+		Actions: slices.Clone(esp.Actions), RegisteredAt: esp.RegisteredAt,
+	}
+}
+
+// apply sets the configured fields of esp, leaving its runtime state.
+// Must be called with mu held.
+func (d exportedDevice) apply(srv *Server, esp *ESP) {
+	esp.Type = d.Type
+	esp.MAC, esp.Broadcast = d.MAC, d.Broadcast
+	esp.Alias, esp.Description, esp.Location, esp.Hostname = d.Alias, d.Description, d.Location, d.Hostname
+	esp.Protected = d.Protected
+	esp.Driver = d.Driver
+	esp.PulseMS, esp.ForceMS, esp.TimeoutMS = d.PulseMS, d.ForceMS, d.TimeoutMS
+	esp.CooldownMS = d.CooldownMS
+	esp.Actions = d.Actions
+	if !reflect.DeepEqual(esp.Target, d.Target) {
+		if esp.Target != nil && d.Target == nil {
+			srv.endUptime(esp.ID)
+		}
+		esp.Target = d.Target
+		esp.TargetState = nil
+	}
+}
+
+// buildBundle collects the configuration. Config-defined VMs are left out,
+// since the config brings them along. also, when set, runs with mu held
+// right after the devices are copied.
+func (srv *Server) buildBundle(also func()) configBundle {
+	b := configBundle{Version: bundleVersion, ExportedAt: srv.now().UTC(), Devices: []exportedDevice{}}
+
+	srv.mu.Lock()
+	for _, esp := range srv.espMap {
+		if !esp.isVM() {
+			b.Devices = append(b.Devices, exportDevice(esp))
+		}
+	}
+	if also != nil {
+		also()
+	}
+	srv.mu.Unlock()
+	slices.SortFunc(b.Devices, func(x, y exportedDevice) int { return cmp.Compare(x.ID, y.ID) })
+
+	srv.groupsMu.Lock()
+	b.Groups = srv.sortedGroups()
+	srv.groupsMu.Unlock()
+
+	srv.schedulesMu.Lock()
+	for _, s := range srv.sortedSchedules() {
+		c := *s
+		b.Schedules = append(b.Schedules, &c)
+	}
+	srv.schedulesMu.Unlock()
+
+	srv.usersMu.Lock()
+	for _, u := range srv.sortedUsers() {
+		c := *u
+		b.Users = append(b.Users, &c)
+	}
+	srv.usersMu.Unlock()
+
+	srv.secretsMu.Lock()
+	for _, s := range srv.deviceSecrets {
+		c := *s
+		b.Secrets = append(b.Secrets, &c)
+	}
+	srv.secretsMu.Unlock()
+	slices.SortFunc(b.Secrets, func(x, y *DeviceSecret) int { return cmp.Compare(x.ID, y.ID) })
+	return b
+}
+
+// bundleYAML renders a bundle as YAML with the same field names as the JSON.
+func bundleYAML(b configBundle) ([]byte, error) {
+	data, err := json.Marshal(b)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var tree interface{}
+	if err := dec.Decode(&tree); err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(yamlNumbers(tree))
+}
+
+// yamlNumbers turns json.Numbers into ints where they are whole, so large
+// values like timeout_ms don't come out in exponent notation.
+func yamlNumbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = yamlNumbers(e)
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = yamlNumbers(e)
+		}
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	}
+	return v
+}
+
+// ParseBundle reads a bundle in YAML or JSON (which YAML includes).
+// Unknown fields are rejected, like in request bodies.
+func ParseBundle(data []byte) (configBundle, error) {
+	var b configBundle
+	var tree interface{}
+	if err := yaml.Unmarshal(data, &tree); err != nil {
+		return b, err
+	}
+	if tree == nil {
+		return b, errors.New("empty file")
+	}
+	data, err := json.Marshal(tree)
+	if err != nil {
+		return b, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&b); err != nil {
+		return b, err
+	}
+	return b, nil
+}
+
+// importCounts says what an import changed, or would change, in one part.
+type importCounts struct {
+	Added   int `json:"added"`
+	Updated int `json:"updated"`
+	Removed int `json:"removed"`
+}
+
+type ImportResult struct {
+	Mode      string       `json:"mode"`
+	DryRun    bool         `json:"dry_run,omitempty"`
+	Devices   importCounts `json:"devices"`
+	Groups    importCounts `json:"groups"`
+	Schedules importCounts `json:"schedules"`
+	Users     importCounts `json:"users"`
+	Secrets   importCounts `json:"secrets"`
+}
+
+type namedCounts struct {
+	Name string
+	importCounts
+}
+
+func (r ImportResult) Parts() []namedCounts {
+	return []namedCounts{{"devices", r.Devices}, {"groups", r.Groups}, {"schedules", r.Schedules}, {"users", r.Users}, {"secrets", r.Secrets}}
+}
+
+// String summarizes the result for the event log, e.g.
+// "devices +2 ~1 -0, groups +0 ~0 -0, ...".
+func (r ImportResult) String() string {
+	var parts []string
+	for _, p := range r.Parts() {
+		parts = append(parts, fmt.Sprintf("%s +%d ~%d -%d", p.Name, p.Added, p.Updated, p.Removed))
+	}
+	return strings.Join(parts, ", ")
+}
+
+var deviceTypes = []DeviceType{DeviceESP, DeviceWoL, DeviceMQTT, DeviceTasmota, DeviceShelly, DeviceIPMI}
+
+// validateBundle checks everything up front, so an import applies fully or
+// not at all. keep are the devices that stay besides the bundle's (none
+// when replacing). Must be called with mu held.
+func (srv *Server) validateBundle(b *configBundle, keep map[string]*ESP) error {
+	if b.Version < 1 || b.Version > bundleVersion {
+		return fmt.Errorf("unsupported bundle version %d (this server reads %d)", b.Version, bundleVersion)
+	}
+
+	ids := make(map[string]bool)
+	for id := range keep {
+		ids[id] = true
+	}
+	for i := range b.Devices {
+		d := &b.Devices[i]
+		if err := validateESPID(d.ID); err != nil {
+			return fmt.Errorf("device %q: %w", d.ID, err)
+		}
+		if ids[d.ID] && keep[d.ID] == nil {
+			return fmt.Errorf("device %q is listed twice", d.ID)
+		}
+		d.Type = cmp.Or(d.Type, DeviceESP)
+		if !slices.Contains(deviceTypes, d.Type) {
+			return fmt.Errorf("device %q: unknown type %q", d.ID, d.Type)
+		}
+		if existing := srv.espMap[d.ID]; existing != nil && existing.isVM() {
+			return fmt.Errorf("device %q is a VM from the config", d.ID)
+		}
+		if d.Type == DeviceWoL {
+			mac, err := parseMAC(d.MAC)
+			if err != nil {
+				return fmt.Errorf("device %q: invalid mac: %w", d.ID, err)
+			}
+			d.MAC = mac.String()
+		}
+		if _, ok := srv.newPowerDriver(d.Type, DriverConfig{}); ok && (d.Driver == nil || d.Driver.Addr == "") {
+			return fmt.Errorf("device %q: %s needs a driver address", d.ID, d.Type)
+		}
+		if d.Target != nil {
+			if err := d.Target.Validate(); err != nil {
+				return fmt.Errorf("device %q: invalid target: %w", d.ID, err)
+			}
+		}
+		for _, ms := range []int{d.PulseMS, d.ForceMS} {
+			if ms == 0 {
+				continue
+			}
+			if err := ValidatePulse(time.Duration(ms) * time.Millisecond); err != nil {
+				return fmt.Errorf("device %q: %w", d.ID, err)
+			}
+		}
+		if d.TimeoutMS < 0 {
+			return fmt.Errorf("device %q: timeout_ms can't be negative", d.ID)
+		}
+		if err := validateCooldown(time.Duration(d.CooldownMS) * time.Millisecond); err != nil {
+			return fmt.Errorf("device %q: %w", d.ID, err)
+		}
+		if err := ValidateActions(d.Actions); err != nil {
+			return fmt.Errorf("device %q: %w", d.ID, err)
+		}
+		for _, f := range []string{d.Description, d.Location, d.Hostname} {
+			if len(f) > maxMetadataLen {
+				return fmt.Errorf("device %q: metadata fields are limited to %d characters", d.ID, maxMetadataLen)
+			}
+		}
+		delete(keep, d.ID)
+		ids[d.ID] = true
+	}
+	// Aliases are checked once every ID is known, since one may shadow an
+	// ID listed further down
+	aliases := make(map[string]string)
+	for id, esp := range keep {
+		if esp.Alias != "" {
+			aliases[esp.Alias] = id
+		}
+	}
+	for _, d := range b.Devices {
+		if d.Alias == "" {
+			continue
+		}
+		if !aliasPattern.MatchString(d.Alias) {
+			return fmt.Errorf("device %q: invalid alias %q", d.ID, d.Alias)
+		}
+		if ids[d.Alias] && d.Alias != d.ID {
+			return fmt.Errorf("device %q: alias %q is the ID of another device", d.ID, d.Alias)
+		}
+		if other, exists := aliases[d.Alias]; exists && other != d.ID {
+			return fmt.Errorf("device %q: alias %q is already used by '%s'", d.ID, d.Alias, other)
+		}
+		if other, exists := srv.config.Aliases[d.Alias]; exists && other != d.ID {
+			return fmt.Errorf("device %q: alias %q is configured for '%s'", d.ID, d.Alias, other)
+		}
+		aliases[d.Alias] = d.ID
+	}
+
+	seen := make(map[string]bool)
+	for _, g := range b.Groups {
+		if !groupNamePattern.MatchString(g.Name) || seen[g.Name] {
+			return fmt.Errorf("group %q: invalid or duplicate name", g.Name)
+		}
+		seen[g.Name] = true
+		for _, m := range g.Members {
+			if !ids[m] {
+				return fmt.Errorf("group %q: member '%s' is not a device", g.Name, m)
+			}
+		}
+	}
+	clear(seen)
+	for _, s := range b.Schedules {
+		if s.ID == "" || seen[s.ID] {
+			return fmt.Errorf("schedule %q: missing or duplicate id", s.ID)
+		}
+		seen[s.ID] = true
+		if s.ESPID == "" {
+			return fmt.Errorf("schedule %s: esp_id cannot be empty", s.ID)
+		}
+		if _, ok := ActionCommand(s.Action); !ok {
+			return fmt.Errorf("schedule %s: unknown action %q", s.ID, s.Action)
+		}
+		spec, err := ParseCron(s.Cron)
+		if err != nil {
+			return fmt.Errorf("schedule %s: invalid cron expression: %w", s.ID, err)
+		}
+		s.spec = spec
+	}
+	clear(seen)
+	for _, u := range b.Users {
+		if u.Name == "" || seen[u.Name] {
+			return fmt.Errorf("user %q: missing or duplicate name", u.Name)
+		}
+		seen[u.Name] = true
+		if !u.Role.Valid() {
+			return fmt.Errorf("user %s: unknown role %q", u.Name, u.Role)
+		}
+		if u.Namespace != "" {
+			if err := ValidateNamespace(u.Namespace); err != nil {
+				return fmt.Errorf("user %s: %w", u.Name, err)
+			}
+		}
+		if u.TokenHash == "" {
+			return fmt.Errorf("user %s: token_hash cannot be empty", u.Name)
+		}
+	}
+	clear(seen)
+	for _, s := range b.Secrets {
+		if err := validateESPID(s.ID); err != nil || seen[s.ID] {
+			return fmt.Errorf("secret %q: invalid or duplicate id", s.ID)
+		}
+		seen[s.ID] = true
+		if s.Secret == "" {
+			return fmt.Errorf("secret %s: secret cannot be empty", s.ID)
+		}
+	}
+	return nil
+}
+
+// importBundle applies a validated bundle. Merging adds and updates what
+// the bundle lists; replacing also removes everything it doesn't.
+func (srv *Server) importBundle(b configBundle, mode string, dryRun bool, actor string) (ImportResult, error) {
+	replace := mode == ImportReplace
+	result := ImportResult{Mode: mode, DryRun: dryRun}
+	ilog := srv.logger("import")
+
+	srv.mu.Lock()
+	keep := make(map[string]*ESP)
+	for id, esp := range srv.espMap {
+		if !replace || esp.isVM() {
+			keep[id] = esp
+		}
+	}
+	if err := srv.validateBundle(&b, keep); err != nil {
+		srv.mu.Unlock()
+		return result, err
+	}
+	listed := make(map[string]bool)
+	var probes []exportedDevice
+	for _, d := range b.Devices {
+		listed[d.ID] = true
+		esp, exists := srv.espMap[d.ID]
+		if exists {
+			cur := exportDevice(esp)
+			cur.RegisteredAt = d.RegisteredAt
+			if reflect.DeepEqual(cur, d) {
+				continue
+			}
+			result.Devices.Updated++
+		} else {
+			result.Devices.Added++
+		}
+		if dryRun {
+			continue
+		}
+		if !exists {
+			esp = &ESP{ID: d.ID, RegisteredAt: cmp.Or(d.RegisteredAt, srv.now())}
+			srv.espMap[d.ID] = esp
+		}
+		d.apply(srv, esp)
+		if d.Target != nil && esp.TargetState == nil {
+			probes = append(probes, d)
+		}
+	}
+	if replace {
+		for id, esp := range srv.espMap {
+			if listed[id] || esp.isVM() {
+				continue
+			}
+			result.Devices.Removed++
+			if !dryRun {
+				srv.removeESP(esp, actor, "not in the import")
+			}
+		}
+	}
+	if !dryRun {
+		srv.indexAliases()
+		srv.saveRegistry()
+	}
+	srv.mu.Unlock()
+	for _, d := range probes {
+		go srv.recordProbe(d.ID, srv.probeTarget(*d.Target))
+	}
+
+	srv.groupsMu.Lock()
+	listed = make(map[string]bool)
+	for _, g := range b.Groups {
+		listed[g.Name] = true
+		existing, exists := srv.groups[g.Name]
+		switch {
+		case !exists:
+			result.Groups.Added++
+		case slices.Equal(existing.Members, g.Members):
+			continue
+		default:
+			result.Groups.Updated++
+		}
+		if !dryRun {
+			g.CreatedAt = cmp.Or(g.CreatedAt, srv.now())
+			g.Members = slices.Clone(g.Members)
+			srv.groups[g.Name] = &g
+		}
+	}
+	if replace {
+		for name := range srv.groups {
+			if !listed[name] {
+				result.Groups.Removed++
+				if !dryRun {
+					delete(srv.groups, name)
+				}
+			}
+		}
+	}
+	if !dryRun {
+		srv.saveGroups()
+	}
+	srv.groupsMu.Unlock()
+
+	srv.schedulesMu.Lock()
+	listed = make(map[string]bool)
+	for _, s := range b.Schedules {
+		listed[s.ID] = true
+		existing, exists := srv.schedules[s.ID]
+		switch {
+		case !exists:
+			result.Schedules.Added++
+		case existing.ESPID == s.ESPID && existing.Cron == s.Cron && existing.Action == s.Action:
+			continue
+		default:
+			result.Schedules.Updated++
+		}
+		if !dryRun {
+			s.CreatedAt = cmp.Or(s.CreatedAt, srv.now())
+			srv.schedules[s.ID] = s
+		}
+	}
+	if replace {
+		for id := range srv.schedules {
+			if !listed[id] {
+				result.Schedules.Removed++
+				if !dryRun {
+					delete(srv.schedules, id)
+				}
+			}
+		}
+	}
+	if !dryRun {
+		srv.saveSchedules()
+	}
+	srv.schedulesMu.Unlock()
+
+	srv.usersMu.Lock()
+	listed = make(map[string]bool)
+	for _, u := range b.Users {
+		listed[u.Name] = true
+		existing, exists := srv.users[u.Name]
+		switch {
+		case !exists:
+			result.Users.Added++
+		case existing.Role == u.Role && existing.Namespace == u.Namespace && existing.TokenHash == u.TokenHash &&
+			existing.PasswordHash == u.PasswordHash && slices.Equal(existing.ESPs, u.ESPs):
+			continue
+		default:
+			result.Users.Updated++
+		}
+		if !dryRun {
+			u.CreatedAt = cmp.Or(u.CreatedAt, srv.now())
+			srv.users[u.Name] = u
+		}
+	}
+	if replace {
+		for name := range srv.users {
+			if !listed[name] {
+				result.Users.Removed++
+				if !dryRun {
+					delete(srv.users, name)
+				}
+			}
+		}
+	}
+	if !dryRun {
+		srv.saveUsers()
+	}
+	srv.usersMu.Unlock()
+
+	srv.secretsMu.Lock()
+	listed = make(map[string]bool)
+	for _, s := range b.Secrets {
+		listed[s.ID] = true
+		existing, exists := srv.deviceSecrets[s.ID]
+		switch {
+		case !exists:
+			result.Secrets.Added++
+		case existing.Secret == s.Secret:
+			continue
+		default:
+			result.Secrets.Updated++
+		}
+		if !dryRun {
+			s.CreatedAt = cmp.Or(s.CreatedAt, srv.now())
+			srv.deviceSecrets[s.ID] = s
+		}
+	}
+	if replace {
+		for id := range srv.deviceSecrets {
+			if !listed[id] {
+				result.Secrets.Removed++
+				if !dryRun {
+					delete(srv.deviceSecrets, id)
+				}
+			}
+		}
+	}
+	if !dryRun {
+		srv.saveDeviceSecrets()
+	}
+	srv.secretsMu.Unlock()
+
+	if dryRun {
+		return result, nil
+	}
+	ilog.Info("Configuration imported", "mode", mode, "actor", actor, "changes", result.String())
+	srv.recordEvent(Event{Type: EventImport, Actor: actor, Detail: mode + " " + result.String()})
+	return result, nil
+}
+
+// exportHandler serves GET /admin/export.
+func (srv *Server) exportHandler(w http.ResponseWriter, r *http.Request) {
+	b := srv.buildBundle(nil)
+	srv.requestLogger(r).Info("Configuration exported", "devices", len(b.Devices), "users", len(b.Users))
+
+	if r.URL.Query().Get("format") == BundleFormatYML {
+		data, err := bundleYAML(b)
+		if err != nil {
+			writeError(w, CodeInternal, "could not encode bundle")
+			return
+		}
+		w.Header().Set("Content-Type", "application/yaml")
+		w.Write(data)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(b)
+}
+
+// importHandler serves POST /admin/import.
+func (srv *Server) importHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	mode := cmp.Or(q.Get("mode"), ImportMerge)
+	if mode != ImportMerge && mode != ImportReplace {
+		writeError(w, CodeInvalidRequest, fmt.Sprintf("unknown mode %q (use merge or replace)", mode))
+		return
+	}
+	dryRun, _ := strconv.ParseBool(q.Get("dry_run"))
+
+	data, err := io.ReadAll(r.Body)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeError(w, CodeTooLarge, fmt.Sprintf("request body too large (limit %d bytes)", tooLarge.Limit))
+		return
+	} else if err != nil {
+		writeError(w, CodeInvalidRequest, "could not read body")
+		return
+	}
+	b, err := ParseBundle(data)
+	if err != nil {
+		writeError(w, CodeInvalidRequest, "invalid bundle: "+err.Error())
+		return
+	}
+	result, err := srv.importBundle(b, mode, dryRun, srv.requestActor(r))
+	if err != nil {
+		srv.requestLogger(r).Warn("Import rejected", "error", err)
+		writeError(w, CodeInvalidConfig, "invalid bundle: "+err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,325 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	regstore "github.com/smileyfaceskobochka/trashbin-daemon/internal/registry"
+)
+
+// Group is a named set of ESPs that can be commanded together as @name.
+type Group struct {
+	Name      string    `json:"name"`
+	Members   []string  `json:"members"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// groupsState holds the Server state kept in groups.go.
+type groupsState struct {
+	// groupsMu may be taken while holding mu, never the other way round.
+	groupsMu   sync.Mutex
+	groups     map[string]*Group
+	groupsPath string
+}
+
+var groupNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// GroupRef returns the group name if id is a group reference ("@lab").
+func GroupRef(id string) (string, bool) {
+	return strings.CutPrefix(id, "@")
+}
+
+func (srv *Server) loadGroups() {
+	if srv.groupsPath == "" {
+		return
+	}
+
+	data, err := os.ReadFile(srv.groupsPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		srv.fatal("groups", "Failed to load groups", "error", err)
+	}
+
+	var list []*Group
+	if err := json.Unmarshal(data, &list); err != nil {
+		srv.fatal("groups", "Failed to parse groups", "path", srv.groupsPath, "error", err)
+	}
+
+	srv.groupsMu.Lock()
+	defer srv.groupsMu.Unlock()
+	for _, g := range list {
+		srv.groups[g.Name] = g
+	}
+	srv.logger("groups").Info("Groups loaded", "count", len(srv.groups), "path", srv.groupsPath)
+}
+
+// saveGroups must be called with groupsMu held.
+func (srv *Server) saveGroups() {
+	if srv.groupsPath == "" {
+		return
+	}
+
+	data, err := json.MarshalIndent(srv.sortedGroups(), "", "  ")
+	if err != nil {
+		srv.logger("groups").Error("Failed to encode groups", "error", err)
+		return
+	}
+	if err := regstore.WriteFileAtomic(srv.groupsPath, data); err != nil {
+		srv.logger("groups").Error("Failed to save groups", "error", err)
+	}
+}
+
+// sortedGroups returns copies, so callers may use them after unlocking.
+// Must be called with groupsMu held.
+func (srv *Server) sortedGroups() []Group {
+	list := make([]Group, 0, len(srv.groups))
+	for _, g := range srv.groups {
+		list = append(list, Group{Name: g.Name, Members: slices.Clone(g.Members), CreatedAt: g.CreatedAt})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// groupMembers returns the members of a group, or false if it doesn't exist.
+func (srv *Server) groupMembers(name string) ([]string, bool) {
+	srv.groupsMu.Lock()
+	defer srv.groupsMu.Unlock()
+	g, exists := srv.groups[name]
+	if !exists {
+		return nil, false
+	}
+	return slices.Clone(g.Members), true
+}
+
+// removeFromGroups drops a removed ESP from every group.
+func (srv *Server) removeFromGroups(id string) {
+	srv.groupsMu.Lock()
+	defer srv.groupsMu.Unlock()
+	changed := false
+	for _, g := range srv.groups {
+		if slices.Contains(g.Members, id) {
+			g.Members = slices.DeleteFunc(g.Members, func(m string) bool { return m == id })
+			changed = true
+		}
+	}
+	if changed {
+		srv.saveGroups()
+	}
+}
+
+// espGroups returns the names of the groups an ESP belongs to.
+func (srv *Server) espGroups(id string) []string {
+	srv.groupsMu.Lock()
+	defer srv.groupsMu.Unlock()
+	var names []string
+	for _, g := range srv.groups {
+		if slices.Contains(g.Members, id) {
+			names = append(names, g.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (srv *Server) groupsHandler(w http.ResponseWriter, r *http.Request) {
+	rlog := srv.requestLogger(r)
+
+	switch r.Method {
+	case http.MethodGet:
+		srv.groupsMu.Lock()
+		list := srv.sortedGroups()
+		srv.groupsMu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string][]Group{"groups": list})
+
+	case http.MethodPost:
+		var data struct {
+			Name    string   `json:"name"`
+			Members []string `json:"members"`
+		}
+		if err := decodeJSON(w, r, &data); err != nil {
+			rlog.Warn("Invalid JSON", "error", err)
+			return
+		}
+		data.Name = strings.TrimPrefix(data.Name, "@")
+		if !groupNamePattern.MatchString(data.Name) {
+			writeError(w, CodeInvalidRequest, fmt.Sprintf("invalid group name %q (letters, digits, '.', '_' and '-')", data.Name))
+			return
+		}
+
+		g := &Group{Name: data.Name, Members: []string{}, CreatedAt: srv.now()}
+		for _, id := range data.Members {
+			if id = srv.resolveAlias(id); id != "" && !slices.Contains(g.Members, id) {
+				g.Members = append(g.Members, id)
+			}
+		}
+		sort.Strings(g.Members)
+
+		srv.groupsMu.Lock()
+		if _, exists := srv.groups[g.Name]; exists {
+			srv.groupsMu.Unlock()
+			writeError(w, CodeConflict, fmt.Sprintf("group '%s' already exists", g.Name))
+			return
+		}
+		srv.groups[g.Name] = g
+		srv.saveGroups()
+		created := Group{Name: g.Name, Members: slices.Clone(g.Members), CreatedAt: g.CreatedAt}
+		srv.groupsMu.Unlock()
+
+		rlog.Info("Group created", "group", g.Name, "members", len(created.Members))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(created)
+
+	case http.MethodDelete:
+		name := strings.TrimPrefix(r.URL.Query().Get("name"), "@")
+
+		srv.groupsMu.Lock()
+		_, exists := srv.groups[name]
+		delete(srv.groups, name)
+		if exists {
+			srv.saveGroups()
+		}
+		srv.groupsMu.Unlock()
+
+		if !exists {
+			writeError(w, CodeNotFound, "group not found")
+			return
+		}
+		rlog.Info("Group removed", "group", name)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "removed", "name": name})
+
+	default:
+		writeError(w, CodeMethodNotAllowed, "only GET, POST or DELETE allowed")
+	}
+}
+
+// groupMembersHandler adds (POST) or removes (DELETE) a group member.
+func (srv *Server) groupMembersHandler(w http.ResponseWriter, r *http.Request) {
+	rlog := srv.requestLogger(r)
+
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		writeError(w, CodeMethodNotAllowed, "only POST or DELETE allowed")
+		return
+	}
+
+	var data struct {
+		Name  string `json:"name"`
+		ESPID string `json:"esp_id"`
+	}
+	if err := decodeJSON(w, r, &data); err != nil {
+		rlog.Warn("Invalid JSON", "error", err)
+		return
+	}
+	if data.ESPID == "" {
+		writeError(w, CodeInvalidRequest, "esp_id cannot be empty")
+		return
+	}
+	data.Name = strings.TrimPrefix(data.Name, "@")
+	data.ESPID = srv.resolveAlias(data.ESPID)
+
+	srv.groupsMu.Lock()
+	defer srv.groupsMu.Unlock()
+
+	g, exists := srv.groups[data.Name]
+	if !exists {
+		writeError(w, CodeNotFound, "group not found")
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		if !slices.Contains(g.Members, data.ESPID) {
+			g.Members = append(g.Members, data.ESPID)
+			sort.Strings(g.Members)
+		}
+		rlog.Info("Group member added", "group", g.Name, "esp_id", data.ESPID)
+	} else {
+		g.Members = slices.DeleteFunc(g.Members, func(id string) bool { return id == data.ESPID })
+		rlog.Info("Group member removed", "group", g.Name, "esp_id", data.ESPID)
+	}
+	srv.saveGroups()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Group{Name: g.Name, Members: slices.Clone(g.Members), CreatedAt: g.CreatedAt})
+}
+
+// groupCommandResult is the outcome of a group command for one member.
+type groupCommandResult struct {
+	ID        string    `json:"id"`
+	Status    string    `json:"status"` // queued, duplicate, sent, dry-run, skipped or failed
+	CommandID string    `json:"command_id,omitempty"`
+	Delivery  string    `json:"delivery,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Code      ErrorCode `json:"code,omitempty"` // the error's code, see writeError
+}
+
+// setGroupCommand sends a command to every member of a group. Members that
+// fail don't stop the others; the response lists each outcome.
+func (srv *Server) setGroupCommand(w http.ResponseWriter, r *http.Request, name string, cmd ESPCommand, opts commandOptions) {
+	rlog := srv.requestLogger(r).With("group", name, "command", cmd)
+
+	members, exists := srv.groupMembers(name)
+	if !exists {
+		writeError(w, CodeNotFound, "group not found")
+		return
+	}
+	p := requestPrincipal(r)
+	for _, id := range members {
+		if !p.canControl(id) {
+			rlog.Warn("User may not control group member", "user", p.Name, "esp_id", id)
+			writeError(w, CodeForbidden, fmt.Sprintf("not allowed to control '%s'", id))
+			return
+		}
+	}
+
+	results := make([]groupCommandResult, 0, len(members))
+	failed := 0
+	srv.mu.Lock()
+	for _, id := range members {
+		res := groupCommandResult{ID: id}
+		esp, exists := srv.espMap[id]
+		if !exists {
+			res.Status, res.Error, res.Code = "failed", "ESP not registered", CodeESPNotFound
+			failed++
+			results = append(results, res)
+			continue
+		}
+		result, err := srv.dispatchCommand(esp, cmd, opts, srv.requestActor(r))
+		switch {
+		case errors.Is(err, errAlreadyUp):
+			res.Status, res.Error, res.Code = "skipped", err.Error(), CodeAlreadyUp
+		case err != nil:
+			res.Status, res.Error, res.Code = "failed", err.Error(), commandErrorCode(err)
+			failed++
+		default:
+			res.Status, res.Delivery = result.Status, result.Delivery
+		}
+		if result.Record != nil {
+			res.CommandID = result.Record.ID
+		}
+		results = append(results, res)
+	}
+	srv.mu.Unlock()
+
+	rlog.Info("Group command sent", "members", len(members), "failed", failed)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"group":   name,
+		"command": cmd,
+		"results": results,
+		"failed":  failed,
+	})
+}
@@ -0,0 +1,662 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/smileyfaceskobochka/trashbin-daemon/pkg/client"
+)
+
+// gRPC service for the messages in proto/wod.proto, on its own port. It is
+// built on net/http's HTTP/2 support. Unary calls are answered by the REST
+// handlers, so auth, rate limits and validation are the same for both APIs.
+
+const (
+	grpcService    = "/wod.v1.WakeOnDemand/"
+	grpcMaxMessage = 4 * 1024 * 1024
+)
+
+// gRPC status codes
+const (
+	grpcOK                 = 0
+	grpcInvalidArgument    = 3
+	grpcDeadlineExceeded   = 4
+	grpcNotFound           = 5
+	grpcPermissionDenied   = 7
+	grpcResourceExhausted  = 8
+	grpcFailedPrecondition = 9
+	grpcUnimplemented      = 12
+	grpcInternal           = 13
+	grpcUnavailable        = 14
+	grpcUnauthenticated    = 16
+)
+
+// grpcState holds the Server state kept in grpc.go.
+type grpcState struct {
+	grpcPort string
+}
+
+type grpcStatus struct {
+	code int
+	msg  string
+}
+
+func (s *grpcStatus) Error() string {
+	return fmt.Sprintf("grpc status %d: %s", s.code, s.msg)
+}
+
+type grpcUnary func(srv *Server, r *http.Request, in protoMessage) (*protoWriter, error)
+
+var grpcMethods = map[string]grpcUnary{
+	"ListESPs":         (*Server).grpcListESPs,
+	"GetESP":           (*Server).grpcGetESP,
+	"UpdateESP":        (*Server).grpcUpdateESP,
+	"RemoveESP":        (*Server).grpcRemoveESP,
+	"SendCommand":      (*Server).grpcSendCommand,
+	"SendGroupCommand": (*Server).grpcSendGroupCommand,
+	"GetCommand":       (*Server).grpcGetCommand,
+	"Health":           (*Server).grpcHealth,
+
+	"GetCommandHistory": (*Server).grpcGetCommandHistory,
+	"GetQueue":          (*Server).grpcGetQueue,
+	"FlushQueue":        (*Server).grpcFlushQueue,
+	"ListEvents":        (*Server).grpcListEvents,
+
+	"ListSchedules":  (*Server).grpcListSchedules,
+	"CreateSchedule": (*Server).grpcCreateSchedule,
+	"DeleteSchedule": (*Server).grpcDeleteSchedule,
+
+	"ListGroups":        (*Server).grpcListGroups,
+	"CreateGroup":       (*Server).grpcCreateGroup,
+	"DeleteGroup":       (*Server).grpcDeleteGroup,
+	"AddGroupMember":    (*Server).grpcAddGroupMember,
+	"RemoveGroupMember": (*Server).grpcRemoveGroupMember,
+
+	"ListUsers":       (*Server).grpcListUsers,
+	"CreateUser":      (*Server).grpcCreateUser,
+	"DeleteUser":      (*Server).grpcDeleteUser,
+	"GrantAccess":     (*Server).grpcGrantAccess,
+	"RevokeAccess":    (*Server).grpcRevokeAccess,
+	"SetUserPassword": (*Server).grpcSetUserPassword,
+
+	"SetTarget":    (*Server).grpcSetTarget,
+	"ClearTarget":  (*Server).grpcClearTarget,
+	"SetPulse":     (*Server).grpcSetPulse,
+	"AddWoLDevice": (*Server).grpcAddWoLDevice,
+	"ResetPin":     (*Server).grpcResetPin,
+	"GetMetrics":   (*Server).grpcGetMetrics,
+
+	"ListFirmware":   (*Server).grpcListFirmware,
+	"UploadFirmware": (*Server).grpcUploadFirmware,
+	"RemoveFirmware": (*Server).grpcRemoveFirmware,
+}
+
+func (srv *Server) grpcEnabled() bool {
+	return srv.grpcPort != ""
+}
+
+// grpcListenAddrs puts the gRPC port on each host the HTTP server listens
+// on, so -listen 127.0.0.1:8080 keeps gRPC local too. With only unix
+// sockets it listens on loopback.
+func (srv *Server) grpcListenAddrs() []listenAddr {
+	var addrs []listenAddr
+	seen := make(map[string]bool)
+	for _, addr := range srv.listenAddrs() {
+		if addr.network != "tcp" {
+			continue
+		}
+		host, _, _ := net.SplitHostPort(addr.address)
+		if !seen[host] {
+			seen[host] = true
+			addrs = append(addrs, listenAddr{network: "tcp", address: net.JoinHostPort(host, srv.grpcPort)})
+		}
+	}
+	if len(addrs) == 0 {
+		addrs = append(addrs, listenAddr{network: "tcp", address: net.JoinHostPort("127.0.0.1", srv.grpcPort)})
+	}
+	return addrs
+}
+
+// startGRPC serves the gRPC API next to the HTTP server, sharing its TLS
+// settings.
+func (srv *Server) startGRPC(tlsSrv *http.Server) {
+	var protocols http.Protocols
+	protocols.SetHTTP2(true)
+	if !srv.tlsEnabled() {
+		protocols.SetUnencryptedHTTP2(true)
+	}
+	hs := &http.Server{
+		Handler:   http.HandlerFunc(srv.grpcHandler),
+		Protocols: &protocols,
+	}
+	if srv.tlsEnabled() {
+		hs.TLSConfig = tlsSrv.TLSConfig.Clone()
+	}
+	addrs := srv.grpcListenAddrs()
+	lns, err := listenAll(addrs)
+	if err != nil {
+		srv.fatal("grpc", "Could not listen", "addr", addrs, "error", err)
+	}
+	srv.onShutdown("stop grpc", func() {
+		ctx, cancel := context.WithTimeout(context.Background(), srv.drainTimeout)
+		defer cancel()
+		if err := hs.Shutdown(ctx); err != nil {
+			hs.Close()
+		}
+	})
+
+	for _, ln := range lns {
+		go func() {
+			var err error
+			if srv.tlsEnabled() {
+				err = hs.ServeTLS(ln, "", "")
+			} else {
+				err = hs.Serve(ln)
+			}
+			if !errors.Is(err, http.ErrServerClosed) {
+				srv.fatal("grpc", "gRPC server failed", "error", err)
+			}
+		}()
+	}
+	srv.logger("grpc").Info("gRPC API listening", "addr", listenerAddrs(lns))
+}
+
+func (srv *Server) grpcHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.ProtoMajor != 2 || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		writeError(w, CodeUnsupportedMedia, "gRPC requests only")
+		return
+	}
+	name, ok := strings.CutPrefix(r.URL.Path, grpcService)
+	rlog := srv.logger("grpc").With("method", name, "client_ip", r.RemoteAddr)
+
+	w.Header().Set("Content-Type", "application/grpc+proto")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.WriteHeader(http.StatusOK)
+
+	if r.Header.Get("Grpc-Encoding") != "" && r.Header.Get("Grpc-Encoding") != "identity" {
+		writeGRPCStatus(w, grpcUnimplemented, "compression is not supported")
+		return
+	}
+	in, err := readGRPCMessage(r.Body)
+	if err != nil {
+		writeGRPCStatus(w, grpcInvalidArgument, err.Error())
+		return
+	}
+
+	if ok && name == "WatchESPs" {
+		err = srv.grpcWatchESPs(w, r)
+	} else if method, exists := grpcMethods[name]; ok && exists {
+		var out *protoWriter
+		if out, err = method(srv, r, in); err == nil {
+			writeGRPCMessage(w, out)
+		}
+	} else {
+		err = &grpcStatus{grpcUnimplemented, "unknown method " + r.URL.Path}
+	}
+
+	var st *grpcStatus
+	switch {
+	case err == nil:
+		writeGRPCStatus(w, grpcOK, "")
+		rlog.Debug("gRPC call")
+	case errors.As(err, &st):
+		rlog.Info("gRPC call failed", "code", st.code, "error", st.msg)
+		writeGRPCStatus(w, st.code, st.msg)
+	default:
+		rlog.Error("gRPC call failed", "error", err)
+		writeGRPCStatus(w, grpcInternal, err.Error())
+	}
+}
+
+func readGRPCMessage(body io.Reader) (protoMessage, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(body, header[:]); err != nil {
+		return nil, errors.New("missing request message")
+	}
+	if header[0] != 0 {
+		return nil, errors.New("compressed messages are not supported")
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > grpcMaxMessage {
+		return nil, fmt.Errorf("request message of %d bytes is too large", size)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(body, data); err != nil {
+		return nil, errors.New("truncated request message")
+	}
+	return decodeProto(data)
+}
+
+func writeGRPCMessage(w http.ResponseWriter, m *protoWriter) error {
+	frame := make([]byte, 5, 5+len(m.buf))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(m.buf)))
+	if _, err := w.Write(append(frame, m.buf...)); err != nil {
+		return err
+	}
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+func writeGRPCStatus(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	if msg != "" {
+		w.Header().Set("Grpc-Message", grpcEscape(msg))
+	}
+}
+
+// grpcEscape percent-encodes a status message as the gRPC spec requires.
+func grpcEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < 0x20 || c > 0x7e || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// callREST runs a request through the HTTP handlers with the caller's
+// credentials and decodes the JSON response into out. A []byte body is sent
+// as is, for firmware uploads; anything else is sent as JSON. An out of
+// *[]byte gets the response as is, for metrics.
+func (srv *Server) callREST(r *http.Request, method, path string, query url.Values, body, out interface{}) error {
+	var reader io.Reader = http.NoBody
+	contentType := "application/json"
+	if raw, ok := body.([]byte); ok {
+		reader, contentType = bytes.NewReader(raw), "application/octet-stream"
+	} else if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	target := APIPrefix + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(r.Context(), method, target, reader)
+	if err != nil {
+		return err
+	}
+	req.RemoteAddr = r.RemoteAddr
+	req.Header.Set("Content-Type", contentType)
+	if token := r.Header.Get("Authorization"); token != "" {
+		req.Header.Set("Authorization", token)
+	}
+
+	rec := &restRecorder{header: make(http.Header), code: http.StatusOK}
+	srv.withCluster(srv.router).ServeHTTP(rec, req)
+	if rec.code >= 300 {
+		message := strings.TrimSpace(rec.body.String())
+		var e errorResponse
+		if json.Unmarshal(rec.body.Bytes(), &e) == nil && e.Error.Message != "" {
+			message = e.Error.Message
+		}
+		return &grpcStatus{grpcCodeForHTTP(rec.code), message}
+	}
+	switch out := out.(type) {
+	case nil:
+		return nil
+	case *[]byte:
+		*out = rec.body.Bytes()
+		return nil
+	}
+	return json.Unmarshal(rec.body.Bytes(), out)
+}
+
+// restRecorder collects a handler's response for callREST.
+type restRecorder struct {
+	header      http.Header
+	code        int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (r *restRecorder) Header() http.Header { return r.header }
+
+func (r *restRecorder) WriteHeader(code int) {
+	if !r.wroteHeader {
+		r.code, r.wroteHeader = code, true
+	}
+}
+
+func (r *restRecorder) Write(b []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	return r.body.Write(b)
+}
+
+func grpcCodeForHTTP(code int) int {
+	switch code {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge:
+		return grpcInvalidArgument
+	case http.StatusUnauthorized:
+		return grpcUnauthenticated
+	case http.StatusForbidden:
+		return grpcPermissionDenied
+	case http.StatusNotFound:
+		return grpcNotFound
+	case http.StatusConflict, http.StatusLocked:
+		return grpcFailedPrecondition
+	case http.StatusTooManyRequests:
+		return grpcResourceExhausted
+	case http.StatusServiceUnavailable, http.StatusBadGateway:
+		return grpcUnavailable
+	case http.StatusGatewayTimeout:
+		return grpcDeadlineExceeded
+	case http.StatusNotImplemented:
+		return grpcUnimplemented
+	}
+	return grpcInternal
+}
+
+// --- RPCs ---
+
+func (srv *Server) grpcListESPs(r *http.Request, in protoMessage) (*protoWriter, error) {
+	var resp struct {
+		ESPs []client.Device `json:"esps"`
+	}
+	if err := srv.callREST(r, http.MethodGet, "/list", nil, nil, &resp); err != nil {
+		return nil, err
+	}
+	out := &protoWriter{}
+	for _, d := range resp.ESPs {
+		out.Message(1, srv.encodeDevice(d))
+	}
+	return out, nil
+}
+
+func (srv *Server) grpcGetESP(r *http.Request, in protoMessage) (*protoWriter, error) {
+	var d client.DeviceDetails
+	if err := srv.callREST(r, http.MethodGet, "/info", url.Values{"id": {in.String(1)}}, nil, &d); err != nil {
+		return nil, err
+	}
+	return srv.encodeDeviceDetails(d), nil
+}
+
+func (srv *Server) grpcUpdateESP(r *http.Request, in protoMessage) (*protoWriter, error) {
+	var u client.MetadataUpdate
+	for field, dst := range map[int]**string{2: &u.Alias, 3: &u.Description, 4: &u.Location, 5: &u.Hostname} {
+		if in.Has(field) {
+			value := in.String(field)
+			*dst = &value
+		}
+	}
+	var d client.DeviceDetails
+	if err := srv.callREST(r, http.MethodPatch, "/esps/"+url.PathEscape(in.String(1)), nil, u, &d); err != nil {
+		return nil, err
+	}
+	return srv.encodeDeviceDetails(d), nil
+}
+
+func (srv *Server) grpcRemoveESP(r *http.Request, in protoMessage) (*protoWriter, error) {
+	if err := srv.callREST(r, http.MethodDelete, "/esps/"+url.PathEscape(in.String(1)), nil, nil, nil); err != nil {
+		return nil, err
+	}
+	return &protoWriter{}, nil
+}
+
+func grpcCommandBody(id string, in protoMessage) map[string]interface{} {
+	body := map[string]interface{}{"id": id, "command": in.String(2)}
+	if ms := in.Int(3); ms != 0 {
+		body["duration_ms"] = ms
+	}
+	if in.Bool(4) {
+		body["force"] = true
+	}
+	if ms := in.Int(5); ms != 0 {
+		body["ttl_ms"] = ms
+	}
+	if action := in.String(6); action != "" {
+		body["action"] = action
+	}
+	for field, key := range map[int]string{7: "queue_if_offline", 8: "override", 9: "dry_run"} {
+		if in.Bool(field) {
+			body[key] = true
+		}
+	}
+	if priority := in.String(10); priority != "" {
+		body["priority"] = priority
+	}
+	return body
+}
+
+func (srv *Server) grpcSendCommand(r *http.Request, in protoMessage) (*protoWriter, error) {
+	id := in.String(1)
+	if strings.HasPrefix(id, "@") {
+		return nil, &grpcStatus{grpcInvalidArgument, "use SendGroupCommand for groups"}
+	}
+	var resp client.CommandResponse
+	if err := srv.callREST(r, http.MethodPost, "/set-command", nil, grpcCommandBody(id, in), &resp); err != nil {
+		return nil, err
+	}
+	out := &protoWriter{}
+	out.String(1, resp.Status)
+	out.String(2, resp.ID)
+	out.String(3, string(resp.Command))
+	out.String(4, resp.CommandID)
+	out.Int(5, int64(resp.DurationMS))
+	out.String(6, resp.Delivery)
+	out.Bool(7, resp.Fallback)
+	out.Int(8, int64(resp.QueueDepth))
+	out.Bool(9, resp.Offline)
+	return out, nil
+}
+
+func (srv *Server) grpcSendGroupCommand(r *http.Request, in protoMessage) (*protoWriter, error) {
+	var resp client.GroupCommandResponse
+	if err := srv.callREST(r, http.MethodPost, "/set-command", nil, grpcCommandBody("@"+strings.TrimPrefix(in.String(1), "@"), in), &resp); err != nil {
+		return nil, err
+	}
+	out := &protoWriter{}
+	out.String(1, resp.Group)
+	out.String(2, string(resp.Command))
+	for _, res := range resp.Results {
+		m := &protoWriter{}
+		m.String(1, res.ID)
+		m.String(2, res.Status)
+		m.String(3, res.CommandID)
+		m.String(4, res.Delivery)
+		m.String(5, res.Error)
+		out.Message(3, m)
+	}
+	out.Int(4, int64(resp.Failed))
+	return out, nil
+}
+
+func (srv *Server) grpcGetCommand(r *http.Request, in protoMessage) (*protoWriter, error) {
+	var rec client.CommandRecord
+	if err := srv.callREST(r, http.MethodGet, "/command-result", url.Values{"id": {in.String(1)}}, nil, &rec); err != nil {
+		return nil, err
+	}
+	return encodeCommandRecord(rec), nil
+}
+
+func encodeCommandRecord(rec client.CommandRecord) *protoWriter {
+	out := &protoWriter{}
+	out.String(1, rec.ID)
+	out.String(2, rec.ESPID)
+	out.String(3, string(rec.Command))
+	out.Int(4, int64(rec.DurationMS))
+	out.String(5, rec.Status)
+	out.String(6, rec.Error)
+	out.Time(7, rec.QueuedAt)
+	for field, t := range map[int]*time.Time{8: rec.ExpiresAt, 9: rec.DeliveredAt, 10: rec.CompletedAt} {
+		if t != nil {
+			out.Time(field, *t)
+		}
+	}
+	// Map fields are repeated key/value entry messages
+	for k, v := range rec.Result {
+		entry := &protoWriter{}
+		entry.String(1, k)
+		entry.String(2, fmt.Sprint(v))
+		out.Message(11, entry)
+	}
+	out.String(12, rec.Priority)
+	return out
+}
+
+func (srv *Server) grpcHealth(r *http.Request, in protoMessage) (*protoWriter, error) {
+	var h client.Health
+	if err := srv.callREST(r, http.MethodGet, "/health", nil, nil, &h); err != nil {
+		return nil, err
+	}
+	out := &protoWriter{}
+	out.String(1, h.Status)
+	out.String(2, h.Version)
+	out.Int(3, int64(h.ESPs.Total))
+	out.Int(4, int64(h.ESPs.Online))
+	return out, nil
+}
+
+// grpcWatchESPs streams device snapshots like the dashboard's event stream:
+// everything once, then each device that changed.
+func (srv *Server) grpcWatchESPs(w http.ResponseWriter, r *http.Request) error {
+	if srv.clusterEnabled() && !srv.cluster.leader.Load() {
+		return &grpcStatus{grpcUnavailable, "not the cluster leader"}
+	}
+	// The same checks as withAuth does for scopeUser; unary calls get them
+	// through callREST
+	p := adminPrincipal
+	switch {
+	case srv.adminSocket != "":
+		if !fromAdminSocket(r) {
+			return &grpcStatus{grpcPermissionDenied, "the control API is only served on the admin socket"}
+		}
+	case srv.authEnabled():
+		if p = srv.authenticate(bearerToken(r)); p == nil {
+			return &grpcStatus{grpcUnauthenticated, "unauthorized"}
+		}
+	}
+
+	ticker := time.NewTicker(uiRefreshInterval)
+	defer ticker.Stop()
+
+	last := make(map[string]string)
+	for {
+		srv.mu.Lock()
+		esps := srv.snapshotESPs(p)
+		srv.mu.Unlock()
+
+		seen := make(map[string]bool, len(esps))
+		for _, info := range esps {
+			seen[info.ID] = true
+			data, _ := json.Marshal(info)
+			var d client.Device
+			json.Unmarshal(data, &d)
+			// "12s ago" changes every second; heartbeats and repeated power
+			// readings alone are not a change
+			key := d
+			key.LastSeen = ""
+			if key.LastPower != nil {
+				lp := *key.LastPower
+				lp.At = time.Time{}
+				key.LastPower = &lp
+			}
+			keyData, _ := json.Marshal(key)
+			if last[info.ID] == string(keyData) {
+				continue
+			}
+			last[info.ID] = string(keyData)
+			update := &protoWriter{}
+			update.Message(1, srv.encodeDevice(d))
+			if err := writeGRPCMessage(w, update); err != nil {
+				return nil
+			}
+		}
+		for id := range last {
+			if seen[id] {
+				continue
+			}
+			delete(last, id)
+			esp := &protoWriter{}
+			esp.String(1, id)
+			update := &protoWriter{}
+			update.Message(1, esp)
+			update.Bool(2, true)
+			if err := writeGRPCMessage(w, update); err != nil {
+				return nil
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-r.Context().Done():
+			return nil
+		case <-srv.uiStop:
+			return nil
+		}
+	}
+}
+
+func (srv *Server) encodeDevice(d client.Device) *protoWriter {
+	m := &protoWriter{}
+	m.String(1, d.ID)
+	m.String(2, d.Alias)
+	m.String(3, d.Type)
+	m.Bool(4, d.Online)
+	m.Time(5, srv.lastSeenTime(d.LastSeen))
+	m.String(6, d.Description)
+	m.String(7, d.Location)
+	m.String(8, d.Hostname)
+	if d.Power != nil && d.Power.State != client.PowerUnknown {
+		m.String(9, d.Power.State)
+	}
+	if d.Target != nil {
+		m.String(10, d.Target.Host)
+	}
+	if d.TargetState != nil {
+		m.Bool(11, d.TargetState.Up)
+	}
+	for _, g := range d.Groups {
+		m.Bytes(12, []byte(g))
+	}
+	if d.Telemetry != nil {
+		m.String(13, d.Telemetry.Firmware)
+	}
+	if d.LastPower != nil {
+		m.String(14, d.LastPower.State)
+		m.Time(15, d.LastPower.At)
+	}
+	return m
+}
+
+// lastSeenTime turns the API's "12s ago" back into a time; "never" is zero.
+func (srv *Server) lastSeenTime(s string) time.Time {
+	d, err := time.ParseDuration(strings.TrimSuffix(s, " ago"))
+	if err != nil {
+		return time.Time{}
+	}
+	return srv.now().Add(-d)
+}
+
+func (srv *Server) encodeDeviceDetails(d client.DeviceDetails) *protoWriter {
+	m := &protoWriter{}
+	m.Message(1, srv.encodeDevice(d.Device))
+	m.String(2, d.MAC)
+	m.String(3, d.Broadcast)
+	m.Time(4, d.RegisteredAt)
+	m.String(5, d.RemoteAddr)
+	m.String(6, d.PinnedIP)
+	m.Int(7, int64(d.Pending))
+	m.Int(8, int64(d.PulseMS))
+	m.Int(9, int64(d.ForceMS))
+	return m
+}
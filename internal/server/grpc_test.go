@@ -0,0 +1,31 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// With -admin-socket, control calls are refused over TCP; the watch stream
+// must be too, or it leaks the device list.
+func TestWatchESPsAdminSocket(t *testing.T) {
+	srv := newServer()
+	srv.adminSocket = "/run/wod/admin.sock"
+
+	// Cancelled, so a stream that wrongly starts ends after one pass
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest(http.MethodPost, grpcService+"WatchESPs", nil).WithContext(ctx)
+	rec := httptest.NewRecorder()
+	err := srv.grpcWatchESPs(rec, req)
+
+	var st *grpcStatus
+	if !errors.As(err, &st) || st.code != grpcPermissionDenied {
+		t.Fatalf("grpcWatchESPs = %v, want PERMISSION_DENIED", err)
+	}
+	if rec.Body.Len() != 0 {
+		t.Errorf("streamed %d bytes before refusing", rec.Body.Len())
+	}
+}
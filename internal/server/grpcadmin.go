@@ -0,0 +1,410 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/smileyfaceskobochka/trashbin-daemon/pkg/client"
+)
+
+// gRPC calls for history, queues, events, schedules, groups, users, device
+// settings, metrics and firmware. Like the device calls in grpc.go, each one is a REST request.
+
+// --- History, queues and events ---
+
+func (srv *Server) grpcGetCommandHistory(r *http.Request, in protoMessage) (*protoWriter, error) {
+	var q url.Values
+	if limit := in.Int(2); limit > 0 {
+		q = url.Values{"limit": {strconv.FormatInt(limit, 10)}}
+	}
+	var resp struct {
+		ID       string                 `json:"id"`
+		Commands []client.CommandRecord `json:"commands"`
+	}
+	if err := srv.callREST(r, http.MethodGet, "/esps/"+url.PathEscape(in.String(1))+"/commands", q, nil, &resp); err != nil {
+		return nil, err
+	}
+	out := &protoWriter{}
+	out.String(1, resp.ID)
+	for _, rec := range resp.Commands {
+		out.Message(2, encodeCommandRecord(rec))
+	}
+	return out, nil
+}
+
+func (srv *Server) grpcGetQueue(r *http.Request, in protoMessage) (*protoWriter, error) {
+	var resp struct {
+		ID       string                 `json:"id"`
+		Depth    int                    `json:"depth"`
+		MaxDepth int                    `json:"max_depth"`
+		Commands []client.CommandRecord `json:"commands"`
+	}
+	if err := srv.callREST(r, http.MethodGet, "/queue", url.Values{"id": {in.String(1)}}, nil, &resp); err != nil {
+		return nil, err
+	}
+	out := &protoWriter{}
+	out.String(1, resp.ID)
+	out.Int(2, int64(resp.Depth))
+	out.Int(3, int64(resp.MaxDepth))
+	for _, rec := range resp.Commands {
+		out.Message(4, encodeCommandRecord(rec))
+	}
+	return out, nil
+}
+
+func (srv *Server) grpcFlushQueue(r *http.Request, in protoMessage) (*protoWriter, error) {
+	var resp struct {
+		ID      string `json:"id"`
+		Dropped int    `json:"dropped"`
+	}
+	if err := srv.callREST(r, http.MethodDelete, "/queue", url.Values{"id": {in.String(1)}}, nil, &resp); err != nil {
+		return nil, err
+	}
+	out := &protoWriter{}
+	out.String(1, resp.ID)
+	out.Int(2, int64(resp.Dropped))
+	return out, nil
+}
+
+func (srv *Server) grpcListEvents(r *http.Request, in protoMessage) (*protoWriter, error) {
+	q := url.Values{}
+	for field, key := range map[int]string{1: "esp_id", 2: "since", 5: "cursor"} {
+		if v := in.String(field); v != "" {
+			q.Set(key, v)
+		}
+	}
+	if types := in.Strings(3); len(types) > 0 {
+		q.Set("type", strings.Join(types, ","))
+	}
+	if limit := in.Int(4); limit > 0 {
+		q.Set("limit", strconv.FormatInt(limit, 10))
+	}
+	var resp struct {
+		Events     []Event `json:"events"`
+		NextCursor string  `json:"next_cursor"`
+	}
+	if err := srv.callREST(r, http.MethodGet, "/events", q, nil, &resp); err != nil {
+		return nil, err
+	}
+	out := &protoWriter{}
+	for _, e := range resp.Events {
+		m := &protoWriter{}
+		m.Int(1, int64(e.Seq))
+		m.Time(2, e.Time)
+		m.String(3, string(e.Type))
+		m.String(4, e.ESPID)
+		m.String(5, e.Actor)
+		m.String(6, string(e.Command))
+		m.String(7, e.CommandID)
+		m.String(8, e.Detail)
+		out.Message(1, m)
+	}
+	out.String(2, resp.NextCursor)
+	return out, nil
+}
+
+// --- Schedules ---
+
+func (srv *Server) grpcListSchedules(r *http.Request, in protoMessage) (*protoWriter, error) {
+	var resp struct {
+		Schedules []scheduleInfo `json:"schedules"`
+	}
+	if err := srv.callREST(r, http.MethodGet, "/schedules", nil, nil, &resp); err != nil {
+		return nil, err
+	}
+	out := &protoWriter{}
+	for _, s := range resp.Schedules {
+		out.Message(1, encodeSchedule(s))
+	}
+	return out, nil
+}
+
+func (srv *Server) grpcCreateSchedule(r *http.Request, in protoMessage) (*protoWriter, error) {
+	body := map[string]string{"esp_id": in.String(1), "cron": in.String(2), "action": in.String(3)}
+	var s scheduleInfo
+	if err := srv.callREST(r, http.MethodPost, "/schedules", nil, body, &s); err != nil {
+		return nil, err
+	}
+	return encodeSchedule(s), nil
+}
+
+func (srv *Server) grpcDeleteSchedule(r *http.Request, in protoMessage) (*protoWriter, error) {
+	if err := srv.callREST(r, http.MethodDelete, "/schedules", url.Values{"id": {in.String(1)}}, nil, nil); err != nil {
+		return nil, err
+	}
+	return &protoWriter{}, nil
+}
+
+func encodeSchedule(s scheduleInfo) *protoWriter {
+	m := &protoWriter{}
+	if s.Schedule == nil {
+		return m
+	}
+	m.String(1, s.ID)
+	m.String(2, s.ESPID)
+	m.String(3, s.Cron)
+	m.String(4, s.Action)
+	m.Time(5, s.CreatedAt)
+	if s.LastRun != nil {
+		m.Time(6, *s.LastRun)
+	}
+	m.String(7, s.LastError)
+	if s.NextRun != nil {
+		m.Time(8, *s.NextRun)
+	}
+	return m
+}
+
+// --- Groups ---
+
+func (srv *Server) grpcListGroups(r *http.Request, in protoMessage) (*protoWriter, error) {
+	var resp struct {
+		Groups []Group `json:"groups"`
+	}
+	if err := srv.callREST(r, http.MethodGet, "/groups", nil, nil, &resp); err != nil {
+		return nil, err
+	}
+	out := &protoWriter{}
+	for _, g := range resp.Groups {
+		out.Message(1, encodeGroup(g))
+	}
+	return out, nil
+}
+
+func (srv *Server) grpcCreateGroup(r *http.Request, in protoMessage) (*protoWriter, error) {
+	body := map[string]interface{}{"name": in.String(1), "members": in.Strings(2)}
+	var g Group
+	if err := srv.callREST(r, http.MethodPost, "/groups", nil, body, &g); err != nil {
+		return nil, err
+	}
+	return encodeGroup(g), nil
+}
+
+func (srv *Server) grpcDeleteGroup(r *http.Request, in protoMessage) (*protoWriter, error) {
+	if err := srv.callREST(r, http.MethodDelete, "/groups", url.Values{"name": {in.String(1)}}, nil, nil); err != nil {
+		return nil, err
+	}
+	return &protoWriter{}, nil
+}
+
+func (srv *Server) grpcAddGroupMember(r *http.Request, in protoMessage) (*protoWriter, error) {
+	return srv.grpcGroupMember(r, http.MethodPost, in)
+}
+
+func (srv *Server) grpcRemoveGroupMember(r *http.Request, in protoMessage) (*protoWriter, error) {
+	return srv.grpcGroupMember(r, http.MethodDelete, in)
+}
+
+func (srv *Server) grpcGroupMember(r *http.Request, method string, in protoMessage) (*protoWriter, error) {
+	body := map[string]string{"name": in.String(1), "esp_id": in.String(2)}
+	var g Group
+	if err := srv.callREST(r, method, "/groups/members", nil, body, &g); err != nil {
+		return nil, err
+	}
+	return encodeGroup(g), nil
+}
+
+func encodeGroup(g Group) *protoWriter {
+	m := &protoWriter{}
+	m.String(1, g.Name)
+	for _, id := range g.Members {
+		m.Bytes(2, []byte(id))
+	}
+	m.Time(3, g.CreatedAt)
+	return m
+}
+
+// --- Users ---
+
+func (srv *Server) grpcListUsers(r *http.Request, in protoMessage) (*protoWriter, error) {
+	var resp struct {
+		Users []UserInfo `json:"users"`
+	}
+	if err := srv.callREST(r, http.MethodGet, "/users", nil, nil, &resp); err != nil {
+		return nil, err
+	}
+	out := &protoWriter{}
+	for _, u := range resp.Users {
+		out.Message(1, encodeUser(u))
+	}
+	return out, nil
+}
+
+func (srv *Server) grpcCreateUser(r *http.Request, in protoMessage) (*protoWriter, error) {
+	body := map[string]string{"name": in.String(1), "role": in.String(2)}
+	if ns := in.String(3); ns != "" {
+		body["namespace"] = ns
+	}
+	var resp struct {
+		Name  string `json:"name"`
+		Role  Role   `json:"role"`
+		Token string `json:"token"`
+	}
+	if err := srv.callREST(r, http.MethodPost, "/users", nil, body, &resp); err != nil {
+		return nil, err
+	}
+	out := &protoWriter{}
+	out.String(1, resp.Name)
+	out.String(2, string(resp.Role))
+	out.String(3, resp.Token)
+	return out, nil
+}
+
+func (srv *Server) grpcDeleteUser(r *http.Request, in protoMessage) (*protoWriter, error) {
+	if err := srv.callREST(r, http.MethodDelete, "/users", url.Values{"name": {in.String(1)}}, nil, nil); err != nil {
+		return nil, err
+	}
+	return &protoWriter{}, nil
+}
+
+func (srv *Server) grpcGrantAccess(r *http.Request, in protoMessage) (*protoWriter, error) {
+	return srv.grpcUserACL(r, http.MethodPost, in)
+}
+
+func (srv *Server) grpcRevokeAccess(r *http.Request, in protoMessage) (*protoWriter, error) {
+	return srv.grpcUserACL(r, http.MethodDelete, in)
+}
+
+func (srv *Server) grpcUserACL(r *http.Request, method string, in protoMessage) (*protoWriter, error) {
+	body := map[string]string{"name": in.String(1), "esp_id": in.String(2)}
+	var u UserInfo
+	if err := srv.callREST(r, method, "/users/acl", nil, body, &u); err != nil {
+		return nil, err
+	}
+	return encodeUser(u), nil
+}
+
+// grpcSetUserPassword sets a dashboard password, or clears it when the
+// password is empty.
+func (srv *Server) grpcSetUserPassword(r *http.Request, in protoMessage) (*protoWriter, error) {
+	var err error
+	if password := in.String(2); password != "" {
+		err = srv.callREST(r, http.MethodPost, "/users/password", nil, map[string]string{"name": in.String(1), "password": password}, nil)
+	} else {
+		err = srv.callREST(r, http.MethodDelete, "/users/password", url.Values{"name": {in.String(1)}}, nil, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &protoWriter{}, nil
+}
+
+func encodeUser(u UserInfo) *protoWriter {
+	m := &protoWriter{}
+	m.String(1, u.Name)
+	m.String(2, string(u.Role))
+	m.String(3, u.Namespace)
+	for _, id := range u.ESPs {
+		m.Bytes(4, []byte(id))
+	}
+	m.Bool(5, u.Password)
+	m.Time(6, u.CreatedAt)
+	return m
+}
+
+// --- Device settings ---
+
+func (srv *Server) grpcSetTarget(r *http.Request, in protoMessage) (*protoWriter, error) {
+	body := map[string]interface{}{"id": in.String(1), "host": in.String(2), "probe": in.String(3)}
+	if port := in.Int(4); port != 0 {
+		body["port"] = port
+	}
+	if in.Has(5) || in.Has(6) {
+		body["verify"] = map[string]int64{"window_ms": in.Int(5), "retries": in.Int(6)}
+	}
+	if err := srv.callREST(r, http.MethodPost, "/target", nil, body, nil); err != nil {
+		return nil, err
+	}
+	return &protoWriter{}, nil
+}
+
+func (srv *Server) grpcClearTarget(r *http.Request, in protoMessage) (*protoWriter, error) {
+	if err := srv.callREST(r, http.MethodDelete, "/target", nil, map[string]string{"id": in.String(1)}, nil); err != nil {
+		return nil, err
+	}
+	return &protoWriter{}, nil
+}
+
+func (srv *Server) grpcSetPulse(r *http.Request, in protoMessage) (*protoWriter, error) {
+	body := map[string]interface{}{"id": in.String(1), "pulse_ms": in.Int(2), "force_ms": in.Int(3)}
+	if err := srv.callREST(r, http.MethodPost, "/pulse", nil, body, nil); err != nil {
+		return nil, err
+	}
+	return &protoWriter{}, nil
+}
+
+func (srv *Server) grpcAddWoLDevice(r *http.Request, in protoMessage) (*protoWriter, error) {
+	body := map[string]string{"id": in.String(1), "mac": in.String(2), "broadcast": in.String(3)}
+	if err := srv.callREST(r, http.MethodPost, "/wol-devices", nil, body, nil); err != nil {
+		return nil, err
+	}
+	return &protoWriter{}, nil
+}
+
+func (srv *Server) grpcResetPin(r *http.Request, in protoMessage) (*protoWriter, error) {
+	if err := srv.callREST(r, http.MethodDelete, "/pin", url.Values{"id": {in.String(1)}}, nil, nil); err != nil {
+		return nil, err
+	}
+	return &protoWriter{}, nil
+}
+
+// grpcGetMetrics returns the Prometheus text /metrics serves.
+func (srv *Server) grpcGetMetrics(r *http.Request, in protoMessage) (*protoWriter, error) {
+	var text []byte
+	if err := srv.callREST(r, http.MethodGet, "/metrics", nil, nil, &text); err != nil {
+		return nil, err
+	}
+	out := &protoWriter{}
+	out.Bytes(1, text)
+	return out, nil
+}
+
+// --- Firmware ---
+
+func (srv *Server) grpcListFirmware(r *http.Request, in protoMessage) (*protoWriter, error) {
+	var resp struct {
+		Firmware []Firmware `json:"firmware"`
+	}
+	if err := srv.callREST(r, http.MethodGet, "/ota", nil, nil, &resp); err != nil {
+		return nil, err
+	}
+	out := &protoWriter{}
+	for _, f := range resp.Firmware {
+		out.Message(1, encodeFirmware(f))
+	}
+	return out, nil
+}
+
+// grpcUploadFirmware takes the whole image in one message, so images are
+// limited to grpcMaxMessage; larger ones go through POST /ota.
+func (srv *Server) grpcUploadFirmware(r *http.Request, in protoMessage) (*protoWriter, error) {
+	q := url.Values{"model": {in.String(1)}, "version": {in.String(2)}}
+	if sum := in.String(3); sum != "" {
+		q.Set("sha256", sum)
+	}
+	var f Firmware
+	if err := srv.callREST(r, http.MethodPost, "/ota", q, in.Bytes(4), &f); err != nil {
+		return nil, err
+	}
+	return encodeFirmware(f), nil
+}
+
+func (srv *Server) grpcRemoveFirmware(r *http.Request, in protoMessage) (*protoWriter, error) {
+	q := url.Values{"model": {in.String(1)}, "version": {in.String(2)}}
+	if err := srv.callREST(r, http.MethodDelete, "/ota", q, nil, nil); err != nil {
+		return nil, err
+	}
+	return &protoWriter{}, nil
+}
+
+func encodeFirmware(f Firmware) *protoWriter {
+	m := &protoWriter{}
+	m.String(1, f.Model)
+	m.String(2, f.Version)
+	m.String(3, f.SHA256)
+	m.Int(4, f.Size)
+	m.Time(5, f.UploadedAt)
+	return m
+}
@@ -0,0 +1,228 @@
+package server
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	defaultDiscoveryPrefix = "homeassistant"
+	haSyncInterval         = 5 * time.Second
+)
+
+// haEntity is one retained message the discovery sync keeps up to date.
+type haEntity struct {
+	topic   string
+	payload string
+}
+
+var haObjectIDChars = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+func haObjectID(id string) string {
+	return "wod_" + haObjectIDChars.ReplaceAllString(id, "_")
+}
+
+// runHADiscovery publishes Home Assistant discovery configs and entity
+// states for every device, re-publishing only what changed. A new broker
+// session starts from scratch so retained messages are restored.
+func (srv *Server) runHADiscovery() {
+	hlog := srv.logger("homeassistant")
+	published := make(map[string]string)
+	session := 0
+
+	ticker := time.NewTicker(haSyncInterval)
+	defer ticker.Stop()
+	for ; ; <-ticker.C {
+		srv.mqttMu.Lock()
+		connected, current := srv.mqttActive != nil, srv.mqttSession
+		srv.mqttMu.Unlock()
+		if !connected {
+			continue
+		}
+		if current != session {
+			clear(published)
+			session = current
+		}
+
+		wanted := srv.haMessages()
+		for topic, payload := range wanted {
+			if published[topic] == payload {
+				continue
+			}
+			if err := srv.bridgePublish(topic, []byte(payload), true); err != nil {
+				hlog.Warn("Publish failed", "topic", topic, "error", err)
+				break
+			}
+			published[topic] = payload
+		}
+		// An empty retained config removes the entity from Home Assistant
+		for topic := range published {
+			if _, ok := wanted[topic]; ok {
+				continue
+			}
+			if strings.HasSuffix(topic, "/config") {
+				if err := srv.bridgePublish(topic, nil, true); err != nil {
+					break
+				}
+				hlog.Info("Removed entity", "topic", topic)
+			}
+			delete(published, topic)
+		}
+	}
+}
+
+// haMessages returns the retained topic/payload pairs describing every
+// registered device.
+func (srv *Server) haMessages() map[string]string {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	msgs := make(map[string]string)
+	for id, esp := range srv.espMap {
+		for _, e := range srv.haEntities(esp) {
+			msgs[e.topic] = e.payload
+		}
+		if !esp.isWoL() {
+			availability := "offline"
+			if esp.Online {
+				availability = "online"
+			}
+			msgs[srv.mqttTopic(id, "availability")] = availability
+		}
+		if esp.TargetState != nil {
+			power := "OFF"
+			if esp.TargetState.Up {
+				power = "ON"
+			}
+			msgs[srv.mqttTopic(id, "power")] = power
+		}
+	}
+	return msgs
+}
+
+// haEntities must be called with mu held.
+func (srv *Server) haEntities(esp *ESP) []haEntity {
+	objectID := haObjectID(esp.ID)
+	name := esp.ID
+	if alias := srv.aliasFor(esp.ID); alias != "" {
+		name = alias
+	}
+
+	device := map[string]interface{}{
+		"identifiers":  []string{objectID},
+		"name":         name,
+		"manufacturer": "wake-on-demand",
+		"model":        haModel(esp),
+	}
+	if esp.Telemetry != nil && esp.Telemetry.Firmware != "" {
+		device["sw_version"] = esp.Telemetry.Firmware
+	}
+
+	availability := []map[string]string{{"topic": srv.mqttSettings.AvailabilityTopic}}
+	if !esp.isWoL() {
+		availability = append(availability, map[string]string{"topic": srv.mqttTopic(esp.ID, "availability")})
+	}
+
+	power := map[string]interface{}{
+		"name":              "Power",
+		"unique_id":         objectID + "_power",
+		"command_topic":     srv.mqttTopic(esp.ID, "set"),
+		"payload_on":        "ON",
+		"payload_off":       "OFF",
+		"availability":      availability,
+		"availability_mode": "all",
+		"device":            device,
+		"icon":              "mdi:power",
+	}
+	// Without a probed target the switch can only be optimistic
+	if esp.Target != nil {
+		power["state_topic"] = srv.mqttTopic(esp.ID, "power")
+	} else {
+		power["optimistic"] = true
+	}
+
+	entities := []haEntity{srv.haConfig("switch", objectID, "power", power)}
+
+	if !esp.isWoL() {
+		entities = append(entities, srv.haConfig("binary_sensor", objectID, "online", map[string]interface{}{
+			"name":         "Online",
+			"unique_id":    objectID + "_online",
+			"device_class": "connectivity",
+			"state_topic":  srv.mqttTopic(esp.ID, "availability"),
+			"payload_on":   "online",
+			"payload_off":  "offline",
+			"availability": []map[string]string{{"topic": srv.mqttSettings.AvailabilityTopic}},
+			"device":       device,
+		}))
+	}
+	if esp.Target != nil {
+		entities = append(entities, srv.haConfig("binary_sensor", objectID, "target", map[string]interface{}{
+			"name":              "Target",
+			"unique_id":         objectID + "_target",
+			"device_class":      "power",
+			"state_topic":       srv.mqttTopic(esp.ID, "power"),
+			"availability":      availability,
+			"availability_mode": "all",
+			"device":            device,
+		}))
+	}
+	return entities
+}
+
+func (srv *Server) haConfig(component, objectID, entity string, config map[string]interface{}) haEntity {
+	payload, _ := json.Marshal(config)
+	return haEntity{
+		topic:   strings.Join([]string{srv.mqttSettings.DiscoveryPrefix, component, objectID, entity, "config"}, "/"),
+		payload: string(payload),
+	}
+}
+
+func haModel(esp *ESP) string {
+	switch esp.Type {
+	case DeviceWoL:
+		return "Wake-on-LAN host"
+	case DeviceMQTT:
+		return "MQTT relay"
+	case DeviceTasmota:
+		return "Tasmota plug"
+	case DeviceShelly:
+		return "Shelly plug"
+	case DeviceIPMI:
+		return "IPMI server"
+	}
+	return "ESP relay"
+}
+
+// haCommand handles the power switch: ON sends a short pulse, OFF a
+// soft-off, which is forced when the target has no agent.
+func (srv *Server) haCommand(id string, payload []byte) {
+	hlog := srv.logger("homeassistant").With("esp_id", id)
+
+	var cmd ESPCommand
+	switch strings.ToUpper(strings.TrimSpace(string(payload))) {
+	case "ON":
+		cmd = CommandPulse
+	case "OFF":
+		cmd = CommandSoftOff
+	default:
+		hlog.Warn("Unknown switch payload", "payload", string(payload))
+		return
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	esp, exists := srv.espMap[id]
+	if !exists {
+		hlog.Warn("Command for unknown device")
+		return
+	}
+	result, err := srv.dispatchCommand(esp, cmd, commandOptions{}, "homeassistant")
+	if err != nil {
+		hlog.Warn("Command rejected", "command", cmd, "error", err)
+		return
+	}
+	hlog.Info("Command sent", "command", cmd, "command_id", result.Record.ID, "delivery", result.Delivery)
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Requests to /set-command may carry an Idempotency-Key header. A retry
+// with the same key and body within the window gets the first response
+// again instead of sending a second command. Keys are scoped to the
+// caller, so two users can't see each other's responses.
+
+const (
+	IdempotencyHeader = "Idempotency-Key"
+	maxIdempotencyKey = 255
+	// maxIdempotencyEntries bounds the cache; the oldest entry goes first
+	maxIdempotencyEntries = 10000
+)
+
+type idempotentResponse struct {
+	fingerprint [sha256.Size]byte
+	done        chan struct{} // closed once the first request has finished
+	status      int
+	contentType string
+	body        []byte
+	expires     time.Time
+}
+
+// idempotencyState holds the Server state kept in idempotency.go.
+type idempotencyState struct {
+	// idempotencyMu guards the cache and the window
+	idempotencyMu    sync.Mutex
+	idempotencyCache map[string]*idempotentResponse
+	// idempotencyWindow is how long a key is remembered; 0 turns keys off
+	idempotencyWindow time.Duration
+}
+
+// pruneIdempotency drops expired keys, and the oldest ones above the
+// limit. Must be called with idempotencyMu held.
+func (srv *Server) pruneIdempotency(now time.Time) {
+	var oldestKey string
+	var oldest time.Time
+	for key, e := range srv.idempotencyCache {
+		if !isDone(e) {
+			continue
+		}
+		if now.After(e.expires) {
+			delete(srv.idempotencyCache, key)
+			continue
+		}
+		if oldestKey == "" || e.expires.Before(oldest) {
+			oldestKey, oldest = key, e.expires
+		}
+	}
+	if len(srv.idempotencyCache) >= maxIdempotencyEntries && oldestKey != "" {
+		delete(srv.idempotencyCache, oldestKey)
+	}
+}
+
+func isDone(e *idempotentResponse) bool {
+	select {
+	case <-e.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// withIdempotency replays the stored response for a repeated key. Errors
+// a retry could get past (5xx and 429) aren't stored.
+func (srv *Server) withIdempotency(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IdempotencyHeader)
+		srv.idempotencyMu.Lock()
+		window := srv.idempotencyWindow
+		srv.idempotencyMu.Unlock()
+		if key == "" || window <= 0 {
+			next(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKey {
+			writeError(w, CodeInvalidRequest, fmt.Sprintf("%s can be at most %d characters", IdempotencyHeader, maxIdempotencyKey))
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				writeError(w, CodeTooLarge, fmt.Sprintf("request body too large (limit %d bytes)", tooLarge.Limit))
+				return
+			}
+			writeError(w, CodeInvalidRequest, "could not read the request body")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		fingerprint := sha256.Sum256(body)
+		scoped := requestPrincipal(r).Name + "\x00" + key
+
+		now := srv.now()
+		srv.idempotencyMu.Lock()
+		srv.pruneIdempotency(now)
+		e, seen := srv.idempotencyCache[scoped]
+		if !seen {
+			e = &idempotentResponse{fingerprint: fingerprint, done: make(chan struct{})}
+			srv.idempotencyCache[scoped] = e
+		}
+		srv.idempotencyMu.Unlock()
+
+		switch {
+		case !seen:
+		case e.fingerprint != fingerprint:
+			writeError(w, CodeIdempotencyReused, fmt.Sprintf("%s was already used for a different request", IdempotencyHeader))
+			return
+		case !isDone(e):
+			writeError(w, CodeConflict, fmt.Sprintf("a request with this %s is still in progress", IdempotencyHeader))
+			return
+		default:
+			srv.requestLogger(r).Info("Replaying response for a repeated request", "idempotency_key", key, "status", e.status)
+			if e.contentType != "" {
+				w.Header().Set("Content-Type", e.contentType)
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(e.status)
+			w.Write(e.body)
+			return
+		}
+
+		rec := &idempotencyRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(rec, r)
+
+		srv.idempotencyMu.Lock()
+		defer srv.idempotencyMu.Unlock()
+		if rec.status >= 500 || rec.status == http.StatusTooManyRequests {
+			delete(srv.idempotencyCache, scoped)
+			close(e.done)
+			return
+		}
+		e.status, e.contentType, e.body = rec.status, rec.Header().Get("Content-Type"), rec.body.Bytes()
+		e.expires = srv.now().Add(window)
+		close(e.done)
+	}
+}
+
+// idempotencyRecorder keeps a copy of the response it passes through.
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (r *idempotencyRecorder) WriteHeader(code int) {
+	if !r.wroteHeader {
+		r.status, r.wroteHeader = code, true
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *idempotencyRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
@@ -0,0 +1,249 @@
+package server
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Idle policies power machines off when nobody uses them. The agent on the
+// target reports CPU usage, load and SSH sessions with every check-in; the
+// server evaluates each policy's thresholds against the latest report and
+// sends the policy's action once they have held for the policy's duration.
+
+const (
+	idleCheckInterval = 30 * time.Second
+	minIdleFor        = time.Minute
+)
+
+// IdlePolicy is one rule from idle_policies: in the config. Every threshold
+// that is set must hold; a metric the agent doesn't report counts as busy.
+type IdlePolicy struct {
+	Name    string   `yaml:"name"`
+	Devices []string `yaml:"devices"` // ESP IDs, aliases or @groups
+
+	CPUBelow       *float64 `yaml:"cpu_below"`  // percent across all cores
+	LoadBelow      *float64 `yaml:"load_below"` // 1-minute load average
+	MaxSSHSessions *int     `yaml:"max_ssh_sessions"`
+
+	For    time.Duration `yaml:"for"`
+	Action string        `yaml:"action"` // soft-off (default) or off
+	DryRun bool          `yaml:"dry_run"`
+	Notify bool          `yaml:"notify"`
+}
+
+func validateIdlePolicy(i int, p IdlePolicy, seen map[string]bool) []error {
+	var errs []error
+	prefix := fmt.Sprintf("idle_policies[%d]", i)
+	if p.Name != "" {
+		prefix = "idle_policies." + p.Name
+	}
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("%s: %s", prefix, fmt.Sprintf(format, args...)))
+	}
+	if p.Name == "" {
+		fail("name is required")
+	} else if seen[p.Name] {
+		fail("duplicate name")
+	}
+	seen[p.Name] = true
+	if len(p.Devices) == 0 {
+		fail("devices is required")
+	}
+	if p.CPUBelow == nil && p.LoadBelow == nil && p.MaxSSHSessions == nil {
+		fail("set at least one of cpu_below, load_below or max_ssh_sessions")
+	}
+	if p.For < minIdleFor {
+		fail("for must be at least %s", minIdleFor)
+	}
+	if p.Action != "" && p.Action != "soft-off" && p.Action != "off" {
+		fail("action must be soft-off or off, got %q", p.Action)
+	}
+	return errs
+}
+
+func (p *IdlePolicy) command() ESPCommand {
+	if p.Action == "off" {
+		return CommandForce
+	}
+	return CommandSoftOff
+}
+
+// AgentActivity is the agent's latest usage report. Nil fields weren't
+// reported, e.g. SSH sessions on Windows.
+type AgentActivity struct {
+	CPU         *float64  `json:"cpu,omitempty"`
+	Load        *float64  `json:"load,omitempty"`
+	SSHSessions *int      `json:"ssh_sessions,omitempty"`
+	ReportedAt  time.Time `json:"reported_at"`
+}
+
+func (srv *Server) activityFromQuery(q url.Values) *AgentActivity {
+	a := &AgentActivity{ReportedAt: srv.now()}
+	if v, err := strconv.ParseFloat(q.Get("cpu"), 64); err == nil {
+		a.CPU = &v
+	}
+	if v, err := strconv.ParseFloat(q.Get("load"), 64); err == nil {
+		a.Load = &v
+	}
+	if v, err := strconv.Atoi(q.Get("ssh")); err == nil {
+		a.SSHSessions = &v
+	}
+	if a.CPU == nil && a.Load == nil && a.SSHSessions == nil {
+		return nil
+	}
+	return a
+}
+
+func (a *AgentActivity) String() string {
+	var parts []string
+	if a.CPU != nil {
+		parts = append(parts, fmt.Sprintf("cpu %.1f%%", *a.CPU))
+	}
+	if a.Load != nil {
+		parts = append(parts, fmt.Sprintf("load %.2f", *a.Load))
+	}
+	if a.SSHSessions != nil {
+		parts = append(parts, fmt.Sprintf("%d ssh sessions", *a.SSHSessions))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// idle reports whether the activity meets every threshold of p.
+func (p *IdlePolicy) idle(a *AgentActivity) bool {
+	if a == nil {
+		return false
+	}
+	if p.CPUBelow != nil && (a.CPU == nil || *a.CPU >= *p.CPUBelow) {
+		return false
+	}
+	if p.LoadBelow != nil && (a.Load == nil || *a.Load >= *p.LoadBelow) {
+		return false
+	}
+	if p.MaxSSHSessions != nil && (a.SSHSessions == nil || *a.SSHSessions > *p.MaxSSHSessions) {
+		return false
+	}
+	return true
+}
+
+// IdleState is how long a device has met a policy, shown by 'info'.
+type IdleState struct {
+	Policy string    `json:"policy"`
+	Since  time.Time `json:"since"`
+	ActsAt time.Time `json:"acts_at"`
+	Acted  bool      `json:"acted"` // the action was sent (or logged, for dry runs)
+	DryRun bool      `json:"dry_run,omitempty"`
+}
+
+// idleInfo must be called with mu held.
+func (srv *Server) idleInfo(id string) []IdleState {
+	var states []IdleState
+	for _, s := range srv.idleStates[id] {
+		states = append(states, *s)
+	}
+	slices.SortFunc(states, func(a, b IdleState) int { return strings.Compare(a.Policy, b.Policy) })
+	return states
+}
+
+// idleState holds the Server state kept in idle.go.
+type idleState struct {
+	// idleStates is keyed by ESP ID, then policy name. Guarded by mu.
+	idleStates map[string]map[string]*IdleState
+}
+
+func (srv *Server) runIdlePolicies() {
+	ticker := time.NewTicker(idleCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		srv.mu.Lock()
+		srv.evaluateIdlePolicies(srv.now())
+		srv.mu.Unlock()
+	}
+}
+
+// evaluateIdlePolicies must be called with mu held.
+func (srv *Server) evaluateIdlePolicies(now time.Time) {
+	for i := range srv.config.IdlePolicies {
+		p := &srv.config.IdlePolicies[i]
+		for _, id := range srv.idlePolicyDevices(p) {
+			esp, exists := srv.espMap[id]
+			if !exists {
+				delete(srv.idleStates, id)
+				continue
+			}
+			var activity *AgentActivity
+			if esp.agentOnline(srv) {
+				activity = esp.Agent.Activity
+			}
+			if !p.idle(activity) {
+				delete(srv.idleStates[id], p.Name)
+				continue
+			}
+			if srv.idleStates[id] == nil {
+				srv.idleStates[id] = make(map[string]*IdleState)
+			}
+			state := srv.idleStates[id][p.Name]
+			if state == nil {
+				state = &IdleState{Policy: p.Name, Since: now, ActsAt: now.Add(p.For), DryRun: p.DryRun}
+				srv.idleStates[id][p.Name] = state
+			}
+			if !state.Acted && !now.Before(state.ActsAt) {
+				state.Acted = true
+				srv.applyIdlePolicy(p, esp, activity)
+			}
+		}
+	}
+}
+
+func (srv *Server) idlePolicyDevices(p *IdlePolicy) []string {
+	return srv.expandDeviceRefs(p.Devices)
+}
+
+// expandDeviceRefs resolves a config list of ESP IDs, aliases and @groups
+// to ESP IDs.
+func (srv *Server) expandDeviceRefs(refs []string) []string {
+	var ids []string
+	for _, ref := range refs {
+		if name, ok := GroupRef(ref); ok {
+			members, _ := srv.groupMembers(name)
+			ids = append(ids, members...)
+		} else {
+			ids = append(ids, srv.resolveAlias(ref))
+		}
+	}
+	return ids
+}
+
+// applyIdlePolicy sends the policy's action. Must be called with mu held.
+func (srv *Server) applyIdlePolicy(p *IdlePolicy, esp *ESP, activity *AgentActivity) {
+	cmd := p.command()
+	ilog := srv.logger("idle").With("policy", p.Name, "esp_id", esp.ID, "command", cmd)
+	reason := fmt.Sprintf("idle for %s (%s)", p.For, activity)
+	if esp.inMaintenance(srv) {
+		ilog.Debug("Idle policy skipped, device in maintenance")
+		return
+	}
+
+	var message string
+	if p.DryRun {
+		ilog.Info("Idle policy matched (dry run)", "activity", activity.String())
+		srv.recordEvent(Event{Type: EventIdle, ESPID: esp.ID, Actor: "idle:" + p.Name, Command: cmd, Detail: reason + ", dry run"})
+		message = fmt.Sprintf("%s has been %s; policy %s would send %s (dry run)", srv.deviceName(esp.ID), reason, p.Name, cmd)
+	} else {
+		srv.recordEvent(Event{Type: EventIdle, ESPID: esp.ID, Actor: "idle:" + p.Name, Command: cmd, Detail: reason})
+		result, err := srv.dispatchCommand(esp, cmd, commandOptions{Priority: PriorityLow, IgnoreQuota: true}, "idle:"+p.Name)
+		if err != nil {
+			ilog.Error("Idle policy action failed", "error", err)
+			message = fmt.Sprintf("%s has been %s, but %s failed: %v", srv.deviceName(esp.ID), reason, cmd, err)
+		} else {
+			ilog.Info("Idle policy fired", "command_id", result.Record.ID, "activity", activity.String())
+			message = fmt.Sprintf("%s has been %s; policy %s sent %s", srv.deviceName(esp.ID), reason, p.Name, cmd)
+		}
+	}
+	if p.Notify && srv.notificationsEnabled() {
+		srv.queueNotification(notification{Trigger: TriggerIdleShutdown, ESPID: esp.ID, Alias: srv.aliasFor(esp.ID), Command: cmd, Message: message, Time: srv.now()})
+	}
+}
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// /list takes filters (online, pending, group, prefix), a sort order and cursor
+// pagination. Without limit it returns every matching device, as it did
+// before paging existed. The cursor holds the sort key and ID of the last
+// device on the page, so devices added or removed between pages don't
+// shift the next one.
+
+const maxListPage = 1000
+
+// listQuery is the parsed query string of /list.
+type listQuery struct {
+	namespace string
+	online    *bool
+	pending   bool
+	members   []string // nil unless group is set
+	prefix    string
+	sort      string
+	desc      bool
+	limit     int
+	after     *listCursor
+}
+
+type listCursor struct {
+	key, id string
+}
+
+func (srv *Server) parseListQuery(q url.Values) (listQuery, error) {
+	lq := listQuery{namespace: q.Get("namespace"), prefix: strings.ToLower(q.Get("prefix")), sort: "id"}
+	if o := q.Get("online"); o != "" {
+		online, err := strconv.ParseBool(o)
+		if err != nil {
+			return lq, fmt.Errorf("online must be true or false, got %q", o)
+		}
+		lq.online = &online
+	}
+	if p := q.Get("pending"); p != "" {
+		pending, err := strconv.ParseBool(p)
+		if err != nil {
+			return lq, fmt.Errorf("pending must be true or false, got %q", p)
+		}
+		lq.pending = pending
+	}
+	if g := q.Get("group"); g != "" {
+		name, _ := GroupRef(g)
+		members, ok := srv.groupMembers(name)
+		if !ok {
+			return lq, fmt.Errorf("group %q does not exist", name)
+		}
+		lq.members = members
+		if lq.members == nil {
+			lq.members = []string{}
+		}
+	}
+	if s := q.Get("sort"); s != "" {
+		lq.sort, lq.desc = strings.CutPrefix(s, "-")
+		if lq.sort != "id" && lq.sort != "name" && lq.sort != "last_seen" {
+			return lq, fmt.Errorf("sort must be id, name or last_seen (prefix - for descending), got %q", s)
+		}
+	}
+	if l := q.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 {
+			return lq, errors.New("invalid limit")
+		}
+		lq.limit = min(n, maxListPage)
+	}
+	if c := q.Get("cursor"); c != "" {
+		raw, err := base64.RawURLEncoding.DecodeString(c)
+		key, id, ok := strings.Cut(string(raw), "\x00")
+		if err != nil || !ok {
+			return lq, errors.New("invalid cursor")
+		}
+		lq.after = &listCursor{key, id}
+	}
+	return lq, nil
+}
+
+// matches reports whether the device passes the filters. Must be called
+// with mu held.
+func (lq listQuery) matches(srv *Server, esp *ESP) bool {
+	if lq.namespace != "" && namespaceOf(esp.ID) != lq.namespace {
+		return false
+	}
+	if lq.online != nil && esp.Online != *lq.online {
+		return false
+	}
+	if lq.pending && esp.Pairing == nil {
+		return false
+	}
+	if lq.members != nil && !slices.Contains(lq.members, esp.ID) {
+		return false
+	}
+	if lq.prefix != "" && !strings.HasPrefix(strings.ToLower(esp.ID), lq.prefix) && !strings.HasPrefix(strings.ToLower(srv.aliasFor(esp.ID)), lq.prefix) {
+		return false
+	}
+	return true
+}
+
+// sortKey is what the device is ordered by before its ID. Must be called
+// with mu held.
+func (lq listQuery) sortKey(srv *Server, esp *ESP) string {
+	switch lq.sort {
+	case "name":
+		if alias := srv.aliasFor(esp.ID); alias != "" {
+			return strings.ToLower(alias)
+		}
+		return strings.ToLower(esp.ID)
+	case "last_seen":
+		// Zero-padded so the strings sort like the times
+		return fmt.Sprintf("%020d", max(esp.LastSeen.UnixNano(), 0))
+	}
+	return ""
+}
+
+// listPage filters, sorts and pages the devices p may see. It returns the
+// page, how many devices matched in all, and the cursor for the next page.
+// Must be called with mu held.
+func (srv *Server) listPage(p *principal, lq listQuery) ([]ESPInfo, int, string) {
+	type entry struct {
+		esp *ESP
+		key listCursor
+	}
+	var matched []entry
+	for id, esp := range srv.espMap {
+		if p.canView(id) && lq.matches(srv, esp) {
+			matched = append(matched, entry{esp, listCursor{lq.sortKey(srv, esp), id}})
+		}
+	}
+	compare := func(a, b listCursor) int {
+		c := strings.Compare(a.key, b.key)
+		if c == 0 {
+			c = strings.Compare(a.id, b.id)
+		}
+		if lq.desc {
+			c = -c
+		}
+		return c
+	}
+	slices.SortFunc(matched, func(a, b entry) int { return compare(a.key, b.key) })
+
+	start := 0
+	if lq.after != nil {
+		start = len(matched)
+		for i, e := range matched {
+			if compare(e.key, *lq.after) > 0 {
+				start = i
+				break
+			}
+		}
+	}
+	end := len(matched)
+	if lq.limit > 0 {
+		end = min(start+lq.limit, len(matched))
+	}
+
+	esps := make([]ESPInfo, 0, end-start)
+	for _, e := range matched[start:end] {
+		esps = append(esps, srv.espInfo(e.esp))
+	}
+	var next string
+	if end < len(matched) {
+		last := matched[end-1].key
+		next = base64.RawURLEncoding.EncodeToString([]byte(last.key + "\x00" + last.id))
+	}
+	return esps, len(matched), next
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strings"
+)
+
+// listenAddr is one address from -listen: a TCP host:port, or a unix
+// socket given as unix:<path> or an absolute path.
+type listenAddr struct {
+	network string
+	address string
+}
+
+func (a listenAddr) String() string {
+	if a.network == "unix" {
+		return "unix:" + a.address
+	}
+	return a.address
+}
+
+// listenState holds the Server state kept in listen.go.
+type listenState struct {
+	// serverListen holds the -listen addresses; empty listens on :<port>.
+	serverListen []listenAddr
+}
+
+func parseListenAddr(spec string) (listenAddr, error) {
+	if path, ok := strings.CutPrefix(spec, "unix:"); ok || strings.HasPrefix(spec, "/") {
+		if !ok {
+			path = spec
+		}
+		if path == "" {
+			return listenAddr{}, errors.New("unix socket path cannot be empty")
+		}
+		return listenAddr{network: "unix", address: path}, nil
+	}
+	host, port, err := net.SplitHostPort(spec)
+	if err != nil {
+		return listenAddr{}, fmt.Errorf("%q: %v (use host:port, [ipv6]:port or unix:<path>)", spec, err)
+	}
+	if _, err := net.LookupPort("tcp", port); err != nil {
+		return listenAddr{}, fmt.Errorf("%q: invalid port %q", spec, port)
+	}
+	return listenAddr{network: "tcp", address: net.JoinHostPort(host, port)}, nil
+}
+
+// parseListen parses a list of -listen addresses, given comma-separated
+// or one per entry.
+func parseListen(specs []string) ([]listenAddr, error) {
+	var addrs []listenAddr
+	for _, spec := range specs {
+		for _, s := range SplitList(spec) {
+			addr, err := parseListenAddr(s)
+			if err != nil {
+				return nil, err
+			}
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs, nil
+}
+
+// listenAddrs returns where the server listens.
+func (srv *Server) listenAddrs() []listenAddr {
+	if len(srv.serverListen) > 0 {
+		return srv.serverListen
+	}
+	return []listenAddr{{network: "tcp", address: ":" + srv.serverPort}}
+}
+
+// listenAll opens every listen address. A stale unix socket left by a
+// server that didn't shut down cleanly is replaced.
+func listenAll(addrs []listenAddr) ([]net.Listener, error) {
+	var lns []net.Listener
+	for _, addr := range addrs {
+		if addr.network == "unix" {
+			if info, err := os.Lstat(addr.address); err == nil && info.Mode()&fs.ModeSocket != 0 {
+				os.Remove(addr.address)
+			}
+		}
+		ln, err := net.Listen(addr.network, addr.address)
+		if err != nil {
+			for _, l := range lns {
+				l.Close()
+			}
+			return nil, err
+		}
+		lns = append(lns, ln)
+	}
+	return lns, nil
+}
+
+func listenerAddrs(lns []net.Listener) string {
+	addrs := make([]string, len(lns))
+	for i, ln := range lns {
+		addrs[i] = ln.Addr().String()
+		if ln.Addr().Network() == "unix" {
+			addrs[i] = "unix:" + addrs[i]
+		}
+	}
+	return strings.Join(addrs, ", ")
+}
+
+// localDialer returns an address to reach this server from the same host,
+// and a dial function for it, for the healthcheck.
+func (srv *Server) localDialer() (string, func(ctx context.Context, network, addr string) (net.Conn, error)) {
+	var d net.Dialer
+	for _, addr := range srv.listenAddrs() {
+		if addr.network != "tcp" {
+			continue
+		}
+		host, port, _ := net.SplitHostPort(addr.address)
+		switch ip := net.ParseIP(host); {
+		case host == "", ip != nil && ip.IsUnspecified() && ip.To4() != nil:
+			host = "127.0.0.1"
+		case ip != nil && ip.IsUnspecified():
+			host = "::1"
+		}
+		return net.JoinHostPort(host, port), d.DialContext
+	}
+	// Only unix sockets: any host name will do
+	path := srv.listenAddrs()[0].address
+	return "localhost", func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return d.DialContext(ctx, "unix", path)
+	}
+}
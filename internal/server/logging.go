@@ -0,0 +1,185 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	mrand "math/rand/v2"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// loggingState holds the Server state kept in logging.go.
+type loggingState struct {
+	// baseLogger is the logger the component and request loggers derive
+	// from
+	baseLogger *slog.Logger
+	// logLevel is the level of baseLogger's handler, changed on reload
+	logLevel *slog.LevelVar
+	// accessLog is the -access-log setup, guarded by settingsMu
+	accessLog accessLogConfig
+}
+
+// ParseLogLevel parses a -log-level or log.level value.
+func ParseLogLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info", "":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q (use debug, info, warn or error)", s)
+}
+
+// logger returns the default logger tagged with a subsystem name, for code
+// that does not run inside a request.
+func (srv *Server) logger(component string) *slog.Logger {
+	return srv.baseLogger.With("component", component)
+}
+
+// fatal logs at error level and exits, replacing log.Fatalf.
+func (srv *Server) fatal(component, msg string, args ...any) {
+	srv.logger(component).Error(msg, args...)
+	os.Exit(1)
+}
+
+type loggerKey struct{}
+
+// requestLogger returns the logger carrying the request's ID and client
+// address.
+func (srv *Server) requestLogger(r *http.Request) *slog.Logger {
+	if l, ok := r.Context().Value(loggerKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return srv.baseLogger
+}
+
+func withLogger(r *http.Request, l *slog.Logger) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), loggerKey{}, l))
+}
+
+// withRequestID tags each request with an ID, taken from X-Request-ID when
+// a proxy already set one, and echoes it back in the response.
+func (srv *Server) withRequestID(path string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if id == "" || len(id) > 64 {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+
+		l := srv.baseLogger.With(
+			"component", strings.Trim(path, "/"),
+			"request_id", id,
+			"client_ip", r.RemoteAddr,
+		)
+		if s, ok := r.Context().Value(spanKey{}).(*span); ok {
+			l = l.With(s.logAttrs()...)
+		}
+		next(w, withLogger(r, l))
+	}
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// AccessLogSettings configure the access log line written for every
+// request. Errors and slow requests are always logged; Sample keeps that
+// fraction of the rest. Unset fields keep the defaults.
+type AccessLogSettings struct {
+	Enabled *bool         `yaml:"enabled"`
+	Sample  *float64      `yaml:"sample"`
+	Slow    time.Duration `yaml:"slow"`
+}
+
+func (a AccessLogSettings) validate() error {
+	if a.Sample != nil && (*a.Sample < 0 || *a.Sample > 1) {
+		return fmt.Errorf("sample must be between 0 and 1, got %v", *a.Sample)
+	}
+	if a.Slow < 0 {
+		return fmt.Errorf("slow must be positive")
+	}
+	return nil
+}
+
+// accessLogConfig is the resolved access log setup.
+type accessLogConfig struct {
+	enabled bool
+	sample  float64
+	slow    time.Duration
+}
+
+// guarded by settingsMu
+
+const defaultSlowRequest = 2 * time.Second
+
+// withAccessLog logs each request once it has been answered, with the
+// request's logger so the line carries its ID. Successful ESP requests
+// (polls, acks, registrations) are logged at debug, like the handlers'
+// own poll logging.
+func (srv *Server) withAccessLog(path string, scope authScope, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		srv.settingsMu.RLock()
+		a := srv.accessLog
+		srv.settingsMu.RUnlock()
+		if !a.enabled {
+			next(w, r)
+			return
+		}
+
+		start := srv.now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(rec, r)
+		elapsed := srv.now().Sub(start)
+
+		slow := elapsed >= a.slow && rec.status != http.StatusSwitchingProtocols
+		level := slog.LevelInfo
+		switch {
+		case rec.status >= 500 || slow:
+			level = slog.LevelWarn
+		case rec.status >= 400:
+		case a.sample < 1 && mrand.Float64() >= a.sample:
+			return
+		case scope == scopeESP:
+			level = slog.LevelDebug
+		}
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", rec.status),
+			slog.Int64("bytes", rec.bytes),
+			slog.Float64("duration_ms", float64(elapsed.Microseconds())/1000),
+		}
+		if ua := r.UserAgent(); ua != "" {
+			attrs = append(attrs, slog.String("user_agent", ua))
+		}
+		if slow {
+			attrs = append(attrs, slog.Bool("slow", true))
+		}
+		srv.requestLogger(r).LogAttrs(r.Context(), level, "HTTP request", attrs...)
+	}
+}
+
+// logUnrouted gives requests no route matches, answered 404 or 405 by
+// writeUnrouted, a request ID and an access log line too.
+func (srv *Server) logUnrouted(mux *http.ServeMux) http.Handler {
+	unrouted := srv.withRequestID("http", srv.withAccessLog("http", scopePublic, srv.writeUnrouted))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, pattern := mux.Handler(r); pattern == "" {
+			unrouted(w, r)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,457 @@
+package server
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Macros are named sequences of steps configured under macros, e.g.
+// movie-night: wake the media PC, wait until it is up, then call a webhook
+// that starts Kodi. A step sends a command to a device, waits for a device
+// to reach a state, or runs a command or calls a URL like a wake hook;
+// delay, timeout, retries and on_failure work as for wake hooks. 'run
+// <macro>' starts one on the server and follows it step by step. Admins
+// can run every macro, operators the ones whose devices they all control.
+// Runs are kept in memory and recorded as macro events.
+
+const (
+	defaultMacroWait  = 5 * time.Minute
+	macroWaitInterval = time.Second
+)
+
+// Device states a step can wait for.
+var macroWaitStates = []string{"up", "off", "online", "offline"}
+
+// Commands a step can send, by their CLI names.
+var macroCommands = map[string]ESPCommand{
+	"on": CommandPulse, "off": CommandForce, "soft-off": CommandSoftOff, "status": CommandStatus, "action": CommandAction,
+}
+
+// Macro is a named sequence of steps.
+type Macro struct {
+	Description string      `yaml:"description"`
+	Steps       []MacroStep `yaml:"steps"`
+}
+
+// MacroStep is one step of a macro: Send a command to Device, Wait for
+// Device to reach a state, or a Command or URL as in a wake hook. A step
+// with none of them only waits its Delay.
+type MacroStep struct {
+	WakeHook `yaml:",inline"`
+	Device   string `yaml:"device"` // ESP ID or alias, for send and wait
+	Send     string `yaml:"send"`   // on, off, soft-off, status or action
+	Action   string `yaml:"action"` // the custom action, for send: action
+	Wait     string `yaml:"wait"`   // up, off, online or offline; timeout defaults to 5m
+}
+
+func (s MacroStep) name(i int) string {
+	switch {
+	case s.Name != "":
+		return s.Name
+	case s.Send == string(CommandAction):
+		return s.Action + " " + s.Device
+	case s.Send != "":
+		return s.Send + " " + s.Device
+	case s.Wait != "":
+		return s.Device + " " + s.Wait
+	case len(s.Command) == 0 && s.URL == "" && s.Delay > 0:
+		return "delay " + s.Delay.String()
+	}
+	return s.WakeHook.name(i)
+}
+
+func validateMacros(macros map[string]Macro) []error {
+	var errs []error
+	for name, m := range macros {
+		if !actionNamePattern.MatchString(name) {
+			errs = append(errs, fmt.Errorf("macros.%s: invalid name (lowercase letters, digits, '-' and '_', up to 32)", name))
+		}
+		if len(m.Steps) == 0 {
+			errs = append(errs, fmt.Errorf("macros.%s: steps are required", name))
+		}
+		for i, s := range m.Steps {
+			fail := func(format string, args ...interface{}) {
+				errs = append(errs, fmt.Errorf("macros.%s.steps[%d]: %s", name, i, fmt.Sprintf(format, args...)))
+			}
+			kinds := 0
+			for _, set := range []bool{s.Send != "", s.Wait != "", len(s.Command) > 0, s.URL != ""} {
+				if set {
+					kinds++
+				}
+			}
+			switch {
+			case kinds > 1:
+				fail("set one of send, wait, command or url")
+			case (s.Send != "" || s.Wait != "") && s.Device == "":
+				fail("device is required for send and wait")
+			case s.Send == "" && s.Wait == "" && s.Device != "":
+				fail("device is only used with send or wait")
+			case kinds == 0 && s.Delay == 0:
+				fail("send, wait, command, url or delay is required")
+			}
+			if _, ok := macroCommands[s.Send]; s.Send != "" && !ok {
+				fail("send must be on, off, soft-off, status or action, got %q", s.Send)
+			}
+			if s.Send == string(CommandAction) && !actionNamePattern.MatchString(s.Action) {
+				fail("invalid action name %q", s.Action)
+			} else if s.Send != string(CommandAction) && s.Action != "" {
+				fail("action is only used with send: action")
+			}
+			if s.Wait != "" && !slices.Contains(macroWaitStates, s.Wait) {
+				fail("wait must be up, off, online or offline, got %q", s.Wait)
+			}
+			validateHook(s.WakeHook, fail)
+		}
+	}
+	return errs
+}
+
+// macroDevices is every device the macro sends to or waits for. Must be
+// called with mu held.
+func (srv *Server) macroDevices(m Macro) []string {
+	var ids []string
+	for _, s := range m.Steps {
+		if s.Device != "" {
+			ids = append(ids, srv.resolveAlias(s.Device))
+		}
+	}
+	slices.Sort(ids)
+	return slices.Compact(ids)
+}
+
+// mayRun reports whether p may run the macro: admins of the whole server
+// every macro, other users the ones naming only devices they control.
+// Must be called with mu held.
+func (p *principal) mayRun(srv *Server, m Macro) bool {
+	if p.Role == RoleAdmin && p.Namespace == "" {
+		return true
+	}
+	ids := srv.macroDevices(m)
+	return len(ids) > 0 && !slices.ContainsFunc(ids, func(id string) bool { return !p.canControl(id) })
+}
+
+// MacroRun is one run of a macro.
+type MacroRun struct {
+	ID         string     `json:"id"`
+	Macro      string     `json:"macro"`
+	Actor      string     `json:"actor"`
+	Status     string     `json:"status"` // running, ok or failed
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Steps      []HookStep `json:"steps"`
+}
+
+// macrosState holds the Server state kept in macros.go.
+type macrosState struct {
+	macrosMu      sync.Mutex
+	macroRuns     []*MacroRun // oldest first, at most hookRunLogSize
+	macrosRunning map[string]bool
+}
+
+// startMacro runs the macro unless it is already running, and returns the
+// run, or nil. Must be called with mu held.
+func (srv *Server) startMacro(name string, m Macro, actor string) *MacroRun {
+	srv.macrosMu.Lock()
+	defer srv.macrosMu.Unlock()
+	if srv.macrosRunning[name] {
+		return nil
+	}
+	srv.macrosRunning[name] = true
+	run := &MacroRun{ID: NewCommandID(), Macro: name, Actor: actor, Status: "running", StartedAt: srv.now()}
+	for i, s := range m.Steps {
+		run.Steps = append(run.Steps, HookStep{Name: s.name(i), Status: "pending"})
+	}
+	srv.macroRuns = append(srv.macroRuns, run)
+	if len(srv.macroRuns) > hookRunLogSize {
+		srv.macroRuns = slices.Delete(srv.macroRuns, 0, len(srv.macroRuns)-hookRunLogSize)
+	}
+	go run.execute(srv, slices.Clone(m.Steps))
+	return run
+}
+
+func (run *MacroRun) execute(srv *Server, steps []MacroStep) {
+	mlog := srv.logger("macros").With("macro", run.Macro, "run_id", run.ID)
+	mlog.Info("Running macro", "steps", len(steps), "actor", run.Actor)
+	env := []string{"WOD_MACRO=" + run.Macro, "WOD_RUN_ID=" + run.ID}
+
+	failed, aborted := false, false
+	for i, s := range steps {
+		if aborted {
+			run.update(srv, i, func(st *HookStep) { st.Status = "skipped" })
+			continue
+		}
+		run.update(srv, i, func(st *HookStep) { st.Status = "running" })
+		start := srv.now()
+		if s.Delay > 0 {
+			time.Sleep(s.Delay)
+		}
+
+		body := map[string]interface{}{"run_id": run.ID, "macro": run.Macro, "step": s.name(i), "actor": run.Actor}
+		output, attempts, err := retryHook(s.Retries, func() (string, error) { return run.step(srv, s, body, env) })
+		elapsed := srv.now().Sub(start)
+		run.update(srv, i, func(st *HookStep) {
+			st.Attempts, st.DurationMS, st.Output = attempts, elapsed.Milliseconds(), output
+			st.Status = "ok"
+			if err != nil {
+				st.Status, st.Error = "failed", err.Error()
+			}
+		})
+
+		step := s.name(i)
+		if err == nil {
+			mlog.Info("Macro step done", "step", step, "duration", elapsed.Round(time.Millisecond).String())
+			continue
+		}
+		mlog.Warn("Macro step failed", "step", step, "attempts", attempts, "on_failure", s.onFailure(), "error", err)
+		switch s.onFailure() {
+		case hookAbort:
+			failed, aborted = true, true
+		case hookContinue:
+			failed = true
+		}
+	}
+
+	now := srv.now()
+	srv.macrosMu.Lock()
+	run.FinishedAt = &now
+	run.Status = "ok"
+	if failed {
+		run.Status = "failed"
+	}
+	delete(srv.macrosRunning, run.Macro)
+	detail := run.Macro + " " + run.summary()
+	srv.macrosMu.Unlock()
+
+	srv.metricMacros.Inc(run.Macro, run.Status)
+	mlog.Info("Macro finished", "status", run.Status)
+	srv.recordEvent(Event{Type: EventMacro, Actor: run.Actor, Detail: detail})
+}
+
+func (run *MacroRun) update(srv *Server, i int, fn func(*HookStep)) {
+	srv.macrosMu.Lock()
+	defer srv.macrosMu.Unlock()
+	fn(&run.Steps[i])
+}
+
+// summary is the run for the event log. Must be called with macrosMu held.
+func (run *MacroRun) summary() string {
+	parts := make([]string, len(run.Steps))
+	for i, s := range run.Steps {
+		parts[i] = s.Name + " " + s.Status
+	}
+	return run.Status + ": " + strings.Join(parts, ", ")
+}
+
+// step makes one attempt at s.
+func (run *MacroRun) step(srv *Server, s MacroStep, body map[string]interface{}, env []string) (string, error) {
+	switch {
+	case s.Send != "":
+		return run.send(srv, s)
+	case s.Wait != "":
+		return srv.waitForDevice(s.Device, s.Wait, cmp.Or(s.Timeout, defaultMacroWait))
+	case len(s.Command) > 0 || s.URL != "":
+		return s.WakeHook.run(srv, body, env)
+	}
+	return "", nil
+}
+
+// send queues the step's command like a schedule does, as
+// macro:<name>. 'on' for a target that is already up counts as done.
+func (run *MacroRun) send(srv *Server, s MacroStep) (string, error) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	id := srv.resolveAlias(s.Device)
+	esp, exists := srv.espMap[id]
+	if !exists {
+		return "", fmt.Errorf("ESP '%s' not registered", id)
+	}
+	result, err := srv.dispatchCommand(esp, macroCommands[s.Send], commandOptions{Action: s.Action}, "macro:"+run.Macro)
+	if errors.Is(err, errAlreadyUp) {
+		return "target already up", nil
+	} else if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s %s via %s", result.Status, result.Record.ID, result.Delivery), nil
+}
+
+// waitForDevice waits until the device's target is up or off, or the
+// device itself online or offline.
+func (srv *Server) waitForDevice(device, state string, timeout time.Duration) (string, error) {
+	start := srv.now()
+	for {
+		srv.mu.Lock()
+		id := srv.resolveAlias(device)
+		esp, exists := srv.espMap[id]
+		tracked, reached := false, false
+		if exists {
+			tracked = esp.powerTracked()
+			switch state {
+			case "up":
+				reached = esp.powerState() == PowerUp
+			case "off":
+				reached = esp.powerState() == PowerOff
+			case "online":
+				tracked, reached = true, esp.Online
+			case "offline":
+				tracked, reached = true, !esp.Online
+			}
+		}
+		srv.mu.Unlock()
+
+		switch {
+		case !exists:
+			return "", fmt.Errorf("ESP '%s' not registered", id)
+		case !tracked:
+			return "", fmt.Errorf("'%s' has no target or power sensor to tell when it is %s", id, state)
+		case reached:
+			return fmt.Sprintf("%s after %s", state, srv.now().Sub(start).Round(time.Second)), nil
+		case srv.now().Sub(start) >= timeout:
+			return "", fmt.Errorf("not %s after %s", state, timeout)
+		}
+		time.Sleep(macroWaitInterval)
+	}
+}
+
+// --- API ---
+
+// MacroInfo is a macro as GET /macros lists it.
+type MacroInfo struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	Steps       []string `json:"steps"`
+	Running     bool     `json:"running"`
+}
+
+// macrosHandler serves GET /macros, the macros the caller may run.
+func (srv *Server) macrosHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, CodeMethodNotAllowed, "only GET allowed")
+		return
+	}
+	p := requestPrincipal(r)
+	list := []MacroInfo{}
+	srv.mu.Lock()
+	for name, m := range srv.config.Macros {
+		if !p.mayRun(srv, m) {
+			continue
+		}
+		info := MacroInfo{Name: name, Description: m.Description, Steps: []string{}}
+		for i, s := range m.Steps {
+			info.Steps = append(info.Steps, s.name(i))
+		}
+		list = append(list, info)
+	}
+	srv.mu.Unlock()
+
+	srv.macrosMu.Lock()
+	for i := range list {
+		list[i].Running = srv.macrosRunning[list[i].Name]
+	}
+	srv.macrosMu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"macros": list})
+}
+
+// macroRunHandler serves POST /macros/run.
+func (srv *Server) macroRunHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, CodeMethodNotAllowed, "only POST allowed")
+		return
+	}
+	var data struct {
+		Name string `json:"name"`
+	}
+	if err := decodeJSON(w, r, &data); err != nil {
+		srv.requestLogger(r).Warn("Invalid JSON", "error", err)
+		return
+	}
+
+	p := requestPrincipal(r)
+	srv.mu.Lock()
+	m, exists := srv.config.Macros[data.Name]
+	if !exists {
+		srv.mu.Unlock()
+		writeError(w, CodeNotFound, fmt.Sprintf("no macro '%s'", data.Name))
+		return
+	}
+	if !p.mayRun(srv, m) {
+		srv.mu.Unlock()
+		srv.requestLogger(r).Warn("User may not run macro", "user", p.Name, "macro", data.Name)
+		writeError(w, CodeForbidden, fmt.Sprintf("not allowed to run '%s'", data.Name))
+		return
+	}
+	run := srv.startMacro(data.Name, m, srv.requestActor(r))
+	srv.mu.Unlock()
+	if run == nil {
+		writeError(w, CodeConflict, fmt.Sprintf("macro '%s' is already running", data.Name))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(run.copy(srv))
+}
+
+// macroRunsHandler serves GET /macros/runs, newest first, for the macros
+// the caller may run.
+func (srv *Server) macroRunsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, CodeMethodNotAllowed, "only GET allowed")
+		return
+	}
+	q := r.URL.Query()
+	limit := DefaultHookRunPage
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			writeError(w, CodeInvalidRequest, "limit must be a positive number")
+			return
+		}
+		limit = n
+	}
+
+	// Runs of macros the config no longer has are only for admins
+	p := requestPrincipal(r)
+	srv.mu.Lock()
+	allowed := func(name string) bool {
+		m, exists := srv.config.Macros[name]
+		return p.mayRun(srv, m) && (exists || p.Role == RoleAdmin && p.Namespace == "")
+	}
+	srv.macrosMu.Lock()
+	runs := []MacroRun{}
+	for _, run := range slices.Backward(srv.macroRuns) {
+		if len(runs) == limit {
+			break
+		}
+		if (q.Get("id") != "" && run.ID != q.Get("id")) || (q.Get("macro") != "" && run.Macro != q.Get("macro")) || !allowed(run.Macro) {
+			continue
+		}
+		c := *run
+		c.Steps = slices.Clone(run.Steps)
+		runs = append(runs, c)
+	}
+	srv.macrosMu.Unlock()
+	srv.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"runs": runs})
+}
+
+func (run *MacroRun) copy(srv *Server) MacroRun {
+	srv.macrosMu.Lock()
+	defer srv.macrosMu.Unlock()
+	c := *run
+	c.Steps = slices.Clone(run.Steps)
+	return c
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Maintenance mode freezes a device while someone works on it: every
+// command but status is refused, whether it comes from a user, a schedule,
+// an idle policy or a wake-on-connection proxy. Only admins can turn it on
+// or off, and send a command anyway with override. It ends by itself once
+// Until passes.
+
+var errMaintenance = errors.New("device is in maintenance")
+
+const maxMaintenance = 30 * 24 * time.Hour
+
+type Maintenance struct {
+	Since  time.Time  `json:"since"`
+	Until  *time.Time `json:"until,omitempty"`
+	By     string     `json:"by,omitempty"`
+	Reason string     `json:"reason,omitempty"`
+}
+
+func (m *Maintenance) String() string {
+	s := "until turned off"
+	if m.Until != nil {
+		s = "until " + m.Until.Format(time.RFC3339)
+	}
+	if m.Reason != "" {
+		s += ": " + m.Reason
+	}
+	return s
+}
+
+// inMaintenance reports whether the device is frozen. Must be called with
+// mu held.
+func (e *ESP) inMaintenance(srv *Server) bool {
+	return e.Maintenance != nil && (e.Maintenance.Until == nil || srv.now().Before(*e.Maintenance.Until))
+}
+
+// checkMaintenance refuses commands that would drive a frozen device.
+func (srv *Server) checkMaintenance(esp *ESP, cmd ESPCommand, opts commandOptions) error {
+	if cmd == CommandStatus || !esp.inMaintenance(srv) || opts.IgnoreMaintenance {
+		return nil
+	}
+	return fmt.Errorf("%w (%s); an admin can send with override", errMaintenance, esp.Maintenance)
+}
+
+// expireMaintenance ends maintenance whose time is up. Must be called with
+// mu held.
+func (srv *Server) expireMaintenance(esp *ESP, now time.Time) {
+	m := esp.Maintenance
+	if m == nil || m.Until == nil || now.Before(*m.Until) {
+		return
+	}
+	esp.Maintenance = nil
+	srv.logger("maintenance").Info("Maintenance ended", "esp_id", esp.ID, "since", m.Since.Format(time.RFC3339))
+	srv.recordEvent(Event{Type: EventMaintenance, ESPID: esp.ID, Detail: "ended, time is up"})
+	srv.saveRegistry()
+}
+
+func (srv *Server) maintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	rlog := srv.requestLogger(r)
+
+	var data struct {
+		ID         string `json:"id"`
+		Enabled    bool   `json:"enabled"`
+		DurationMS int64  `json:"duration_ms"`
+		Reason     string `json:"reason"`
+	}
+	if err := decodeJSON(w, r, &data); err != nil {
+		rlog.Warn("Invalid JSON", "error", err)
+		return
+	}
+	data.ID = srv.resolveAlias(data.ID)
+	duration := time.Duration(data.DurationMS) * time.Millisecond
+	if duration < 0 || duration > maxMaintenance {
+		writeError(w, CodeInvalidRequest, fmt.Sprintf("duration must be between 0 (until turned off) and %s, got %s", maxMaintenance, duration))
+		return
+	}
+	if len(data.Reason) > maxMetadataLen {
+		writeError(w, CodeInvalidRequest, fmt.Sprintf("reason can be at most %d characters", maxMetadataLen))
+		return
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	esp, exists := srv.espMap[data.ID]
+	if !exists {
+		rlog.Warn("ESP not found", "esp_id", data.ID)
+		writeError(w, CodeESPNotFound, "ESP not registered")
+		return
+	}
+	actor := srv.requestActor(r)
+	if data.Enabled {
+		m := &Maintenance{Since: srv.now(), By: actor, Reason: strings.TrimSpace(data.Reason)}
+		if esp.inMaintenance(srv) {
+			// Extending keeps when it started
+			m.Since = esp.Maintenance.Since
+		}
+		if duration > 0 {
+			until := srv.now().Add(duration)
+			m.Until = &until
+		}
+		esp.Maintenance = m
+		rlog.Info("Maintenance started", "esp_id", esp.ID, "until", m.Until, "reason", m.Reason)
+		srv.recordEvent(Event{Type: EventMaintenance, ESPID: esp.ID, Actor: actor, Detail: "started, " + m.String()})
+	} else if esp.Maintenance != nil {
+		esp.Maintenance = nil
+		rlog.Info("Maintenance ended", "esp_id", esp.ID)
+		srv.recordEvent(Event{Type: EventMaintenance, ESPID: esp.ID, Actor: actor, Detail: "ended"})
+	}
+	srv.saveRegistry()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "id": esp.ID, "maintenance": esp.Maintenance})
+}
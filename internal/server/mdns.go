@@ -0,0 +1,299 @@
+package server
+
+import (
+	"cmp"
+	"errors"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/ipv4"
+)
+
+// The server advertises itself over mDNS as a DNS-SD service, so ESPs and
+// the CLI (-server auto) can find it without a configured address. Only
+// IPv4 is advertised. A PTR query for the service type is answered with
+// the instance's SRV (host and port), TXT (API path, version, tls) and A
+// records.
+
+const (
+	MDNSService  = "_wake-on-demand._tcp.local."
+	mdnsServices = "_services._dns-sd._udp.local."
+	mdnsTTL      = 120
+	// legacyTTL caps the TTL of answers to one-shot queries (RFC 6762 6.7)
+	legacyTTL = 10
+	// cacheFlush marks records only this host answers for
+	cacheFlush = 1 << 15
+)
+
+var (
+	MDNSGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+)
+
+// mdnsState holds the Server state kept in mdns.go.
+type mdnsState struct {
+	mdnsEnabled bool
+	mdnsName    string
+}
+
+type mdnsResponder struct {
+	conn     *ipv4.PacketConn
+	instance dnsmessage.Name
+	host     dnsmessage.Name
+	port     uint16
+	txt      []string
+	// bindIP is the address the server listens on, nil for all of them
+	bindIP net.IP
+}
+
+// mdnsLabel makes s usable as a single DNS label.
+func mdnsLabel(s string) string {
+	s = strings.ReplaceAll(strings.TrimSpace(s), ".", "-")
+	if len(s) > 63 {
+		s = s[:63]
+	}
+	return s
+}
+
+// advertisedPort picks the first TCP listener that other hosts can reach.
+func advertisedPort(lns []net.Listener) (int, net.IP, bool) {
+	for _, ln := range lns {
+		addr, ok := ln.Addr().(*net.TCPAddr)
+		if !ok || addr.IP.IsLoopback() {
+			continue
+		}
+		if addr.IP.IsUnspecified() {
+			return addr.Port, nil, true
+		}
+		if ip4 := addr.IP.To4(); ip4 != nil {
+			return addr.Port, ip4, true
+		}
+	}
+	return 0, nil, false
+}
+
+// startMDNS advertises the server until it shuts down. Failing to is only
+// a warning; clients can still be given the address.
+func (srv *Server) startMDNS(lns []net.Listener) {
+	mlog := srv.logger("mdns")
+	port, bindIP, ok := advertisedPort(lns)
+	if !ok {
+		mlog.Debug("Not advertising; no TCP listener outside loopback")
+		return
+	}
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "wake-on-demand"
+	}
+	hostname, _, _ = strings.Cut(hostname, ".")
+	instance, err1 := dnsmessage.NewName(mdnsLabel(cmp.Or(srv.mdnsName, hostname)) + "." + MDNSService)
+	host, err2 := dnsmessage.NewName(mdnsLabel(hostname) + ".local.")
+	if err := errors.Join(err1, err2); err != nil {
+		mlog.Warn("Not advertising; invalid name", "error", err)
+		return
+	}
+
+	c, err := net.ListenMulticastUDP("udp4", nil, MDNSGroup)
+	if err != nil {
+		mlog.Warn("Not advertising; could not listen", "addr", MDNSGroup.String(), "error", err)
+		return
+	}
+	conn := ipv4.NewPacketConn(c)
+	for _, ifi := range multicastInterfaces() {
+		// Already joined on the default interface
+		conn.JoinGroup(&ifi, MDNSGroup)
+	}
+	// Not supported everywhere; answers then carry every address
+	conn.SetControlMessage(ipv4.FlagInterface, true)
+	conn.SetMulticastTTL(255)
+	conn.SetMulticastLoopback(true)
+
+	txt := []string{"path=" + APIPrefix, "version=" + VERSION}
+	if srv.tlsEnabled() {
+		txt = append(txt, "tls=1")
+	}
+	r := &mdnsResponder{conn: conn, instance: instance, host: host, port: uint16(port), txt: txt, bindIP: bindIP}
+	go r.serve()
+	go r.announce()
+	srv.onShutdown("mdns goodbye", func() {
+		r.multicast(0)
+		conn.Close()
+	})
+	mlog.Info("Advertising over mDNS", "instance", instance.String(), "port", port)
+}
+
+func multicastInterfaces() []net.Interface {
+	ifaces, _ := net.Interfaces()
+	return slices.DeleteFunc(ifaces, func(ifi net.Interface) bool {
+		return ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagMulticast == 0 || ifi.Flags&net.FlagLoopback != 0
+	})
+}
+
+// addrs returns the IPv4 addresses to answer with: those of the interface
+// a query came in on, or of every interface for ifIndex 0.
+func (r *mdnsResponder) addrs(ifIndex int) []net.IP {
+	if r.bindIP != nil {
+		return []net.IP{r.bindIP}
+	}
+	var ips []net.IP
+	for _, ifi := range multicastInterfaces() {
+		if ifIndex != 0 && ifi.Index != ifIndex {
+			continue
+		}
+		addrs, _ := ifi.Addrs()
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.To4() != nil && !ipnet.IP.IsLinkLocalUnicast() {
+				ips = append(ips, ipnet.IP.To4())
+			}
+		}
+	}
+	return ips
+}
+
+// records returns the service PTR followed by the instance's SRV, TXT and
+// A records.
+func (r *mdnsResponder) records(ttl uint32, ifIndex int) []dnsmessage.Resource {
+	hdr := func(name dnsmessage.Name, typ dnsmessage.Type, class dnsmessage.Class) dnsmessage.ResourceHeader {
+		return dnsmessage.ResourceHeader{Name: name, Type: typ, Class: class, TTL: ttl}
+	}
+	list := []dnsmessage.Resource{
+		{Header: hdr(dnsmessage.MustNewName(MDNSService), dnsmessage.TypePTR, dnsmessage.ClassINET), Body: &dnsmessage.PTRResource{PTR: r.instance}},
+		{Header: hdr(r.instance, dnsmessage.TypeSRV, dnsmessage.ClassINET|cacheFlush), Body: &dnsmessage.SRVResource{Target: r.host, Port: r.port}},
+		{Header: hdr(r.instance, dnsmessage.TypeTXT, dnsmessage.ClassINET|cacheFlush), Body: &dnsmessage.TXTResource{TXT: r.txt}},
+	}
+	for _, ip := range r.addrs(ifIndex) {
+		list = append(list, dnsmessage.Resource{Header: hdr(r.host, dnsmessage.TypeA, dnsmessage.ClassINET|cacheFlush), Body: &dnsmessage.AResource{A: [4]byte(ip)}})
+	}
+	return list
+}
+
+// answer splits the records matching qs into answers and additional
+// records.
+func (r *mdnsResponder) answer(qs []dnsmessage.Question, ttl uint32, ifIndex int) (answers, extra []dnsmessage.Resource) {
+	all := r.records(ttl, ifIndex)
+	ptr, instance, addrs := all[0], all[1:3], all[3:]
+	wants := func(q dnsmessage.Question, types ...dnsmessage.Type) bool {
+		return q.Type == dnsmessage.TypeALL || slices.Contains(types, q.Type)
+	}
+	for _, q := range qs {
+		switch name := q.Name.String(); {
+		case strings.EqualFold(name, mdnsServices) && wants(q, dnsmessage.TypePTR):
+			answers = append(answers, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET, TTL: ttl},
+				Body:   &dnsmessage.PTRResource{PTR: ptr.Header.Name},
+			})
+		case strings.EqualFold(name, MDNSService) && wants(q, dnsmessage.TypePTR):
+			answers = append(answers, ptr)
+			extra = append(extra, instance...)
+			extra = append(extra, addrs...)
+		case strings.EqualFold(name, r.instance.String()):
+			for _, rr := range instance {
+				if wants(q, rr.Header.Type) {
+					answers = append(answers, rr)
+				}
+			}
+			extra = append(extra, addrs...)
+		case strings.EqualFold(name, r.host.String()) && wants(q, dnsmessage.TypeA):
+			answers = append(answers, addrs...)
+		}
+	}
+	// Don't repeat an answer in the additional section
+	extra = slices.DeleteFunc(extra, func(rr dnsmessage.Resource) bool {
+		return slices.ContainsFunc(answers, func(a dnsmessage.Resource) bool { return a.Header.GoString() == rr.Header.GoString() })
+	})
+	return answers, extra
+}
+
+func (r *mdnsResponder) serve() {
+	buf := make([]byte, 9000)
+	for {
+		n, cm, src, err := r.conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		var p dnsmessage.Parser
+		h, err := p.Start(buf[:n])
+		if err != nil || h.Response {
+			continue
+		}
+		qs, err := p.AllQuestions()
+		if err != nil || len(qs) == 0 {
+			continue
+		}
+		ifIndex := 0
+		if cm != nil {
+			ifIndex = cm.IfIndex
+		}
+		from, _ := src.(*net.UDPAddr)
+		// Queries from another port than 5353 are one-shot lookups that
+		// expect a plain DNS reply
+		legacy := from != nil && from.Port != MDNSGroup.Port
+		ttl := uint32(mdnsTTL)
+		if legacy {
+			ttl = legacyTTL
+		}
+		answers, extra := r.answer(qs, ttl, ifIndex)
+		if len(answers) == 0 {
+			continue
+		}
+		msg := dnsmessage.Message{
+			Header:      dnsmessage.Header{Response: true, Authoritative: true},
+			Answers:     answers,
+			Additionals: extra,
+		}
+		unicast := legacy
+		if legacy {
+			msg.Header.ID = h.ID
+			msg.Questions = qs
+		}
+		for _, q := range qs {
+			// The QU bit: the querier asks for a unicast reply
+			if q.Class&cacheFlush != 0 {
+				unicast = true
+			}
+		}
+		packet, err := msg.Pack()
+		if err != nil {
+			continue
+		}
+		if unicast && from != nil {
+			r.conn.WriteTo(packet, nil, from)
+			continue
+		}
+		var out *ipv4.ControlMessage
+		if ifIndex != 0 {
+			out = &ipv4.ControlMessage{IfIndex: ifIndex}
+		}
+		r.conn.WriteTo(packet, out, MDNSGroup)
+	}
+}
+
+// announce sends the records unprompted twice, a second apart, so
+// listening clients learn about the server right away.
+func (r *mdnsResponder) announce() {
+	for i := range 2 {
+		if i > 0 {
+			time.Sleep(time.Second)
+		}
+		r.multicast(mdnsTTL)
+	}
+}
+
+// multicast sends the records to the group on every interface, each with
+// that interface's addresses. TTL 0 says goodbye.
+func (r *mdnsResponder) multicast(ttl uint32) {
+	for _, ifi := range multicastInterfaces() {
+		msg := dnsmessage.Message{Header: dnsmessage.Header{Response: true, Authoritative: true}, Answers: r.records(ttl, ifi.Index)}
+		packet, err := msg.Pack()
+		if err != nil {
+			return
+		}
+		r.conn.WriteTo(packet, &ipv4.ControlMessage{IfIndex: ifi.Index}, MDNSGroup)
+	}
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const maxMetadataLen = 256
+
+var aliasPattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]{0,63}$`)
+
+// metadataState holds the Server state kept in metadata.go.
+type metadataState struct {
+	// Aliases set with 'edit' are stored on the ESP in the registry and indexed
+	// here, so resolveAlias and aliasFor can be used while mu is held.
+	aliasMu   sync.Mutex
+	aliasToID map[string]string
+	idToAlias map[string]string
+}
+
+// metadataUpdate is the body of PATCH /esps/{id}. Fields left out are
+// unchanged; an empty string clears a field.
+type metadataUpdate struct {
+	Alias       *string `json:"alias,omitempty"`
+	Description *string `json:"description,omitempty"`
+	Location    *string `json:"location,omitempty"`
+	Hostname    *string `json:"hostname,omitempty"`
+	Protected   *bool   `json:"protected,omitempty"`
+	// CooldownMS overrides -command-cooldown; 0 uses it again
+	CooldownMS *int64 `json:"cooldown_ms,omitempty"`
+}
+
+// indexAliases rebuilds the alias index from the registry. Must be called
+// with mu held.
+func (srv *Server) indexAliases() {
+	srv.aliasMu.Lock()
+	defer srv.aliasMu.Unlock()
+	clear(srv.aliasToID)
+	clear(srv.idToAlias)
+	for id, esp := range srv.espMap {
+		if esp.Alias != "" {
+			srv.aliasToID[esp.Alias] = id
+			srv.idToAlias[id] = esp.Alias
+		}
+	}
+}
+
+func (srv *Server) registryAlias(name string) (string, bool) {
+	srv.aliasMu.Lock()
+	defer srv.aliasMu.Unlock()
+	id, ok := srv.aliasToID[name]
+	return id, ok
+}
+
+func (srv *Server) registryAliasFor(id string) string {
+	srv.aliasMu.Lock()
+	defer srv.aliasMu.Unlock()
+	return srv.idToAlias[id]
+}
+
+// validateAlias rejects aliases that would shadow another device's ID or
+// alias, or a group reference. Must be called with mu held.
+func (srv *Server) validateAlias(alias, id string) error {
+	if !aliasPattern.MatchString(alias) {
+		return fmt.Errorf("invalid alias %q (letters, digits, '.', '_' and '-', up to 64 characters)", alias)
+	}
+	if _, exists := srv.espMap[alias]; exists && alias != id {
+		return fmt.Errorf("alias %q is the ID of another device", alias)
+	}
+	if other, exists := srv.registryAlias(alias); exists && other != id {
+		return fmt.Errorf("alias %q is already used by '%s'", alias, other)
+	}
+	if other, exists := srv.config.Aliases[alias]; exists && other != id {
+		return fmt.Errorf("alias %q is configured for '%s'", alias, other)
+	}
+	return nil
+}
+
+// applyMetadata validates and applies an update. Must be called with mu held.
+func (srv *Server) applyMetadata(esp *ESP, u metadataUpdate) error {
+	if u.Alias != nil && *u.Alias != "" {
+		if err := srv.validateAlias(*u.Alias, esp.ID); err != nil {
+			return err
+		}
+	}
+	for _, f := range []*string{u.Description, u.Location, u.Hostname} {
+		if f != nil && len(*f) > maxMetadataLen {
+			return fmt.Errorf("metadata fields are limited to %d characters", maxMetadataLen)
+		}
+	}
+	if u.CooldownMS != nil {
+		if err := validateCooldown(time.Duration(*u.CooldownMS) * time.Millisecond); err != nil {
+			return err
+		}
+	}
+	if u.Alias != nil {
+		esp.Alias = *u.Alias
+	}
+	if u.Description != nil {
+		esp.Description = *u.Description
+	}
+	if u.Location != nil {
+		esp.Location = *u.Location
+	}
+	if u.Hostname != nil {
+		esp.Hostname = *u.Hostname
+	}
+	if u.Protected != nil {
+		esp.Protected = *u.Protected
+	}
+	if u.CooldownMS != nil {
+		esp.CooldownMS = *u.CooldownMS
+	}
+	srv.indexAliases()
+	return nil
+}
+
+// deviceHandler serves /esps/{id}: PATCH edits metadata, DELETE removes the
+// device.
+func (srv *Server) deviceHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPatch:
+		srv.metadataHandler(w, r)
+	case http.MethodDelete:
+		srv.removeHandler(w, r)
+	default:
+		writeError(w, CodeMethodNotAllowed, "only PATCH or DELETE allowed")
+	}
+}
+
+func (srv *Server) metadataHandler(w http.ResponseWriter, r *http.Request) {
+	rlog := srv.requestLogger(r)
+
+	var data metadataUpdate
+	if err := decodeJSON(w, r, &data); err != nil {
+		rlog.Warn("Invalid JSON", "error", err)
+		return
+	}
+	id := srv.resolveAlias(r.PathValue("id"))
+
+	srv.mu.Lock()
+	esp, exists := srv.espMap[id]
+	if !exists {
+		srv.mu.Unlock()
+		writeError(w, CodeESPNotFound, "ESP not registered")
+		return
+	}
+	if err := srv.applyMetadata(esp, data); err != nil {
+		srv.mu.Unlock()
+		writeError(w, CodeInvalidRequest, err.Error())
+		return
+	}
+	srv.saveRegistry()
+	details := srv.espDetails(esp)
+	srv.mu.Unlock()
+
+	rlog.Info("ESP metadata updated", "esp_id", id, "alias", details.Alias, "protected", details.Protected)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(details)
+}
@@ -0,0 +1,298 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metricsState holds the Server state kept in metrics.go.
+type metricsState struct {
+	startTime time.Time
+
+	metricCommandsQueued    *counterVec
+	metricCommandsDelivered *counterVec
+	metricCommandsAcked     *counterVec
+	metricCommandsFailed    *counterVec
+	metricCommandsExpired   *counterVec
+	metricPolls             *counterVec
+	metricRateLimited       *counterVec
+	metricNotifications     *counterVec
+	metricWebhooks          *counterVec
+	metricQuotaRefused      *counterVec
+	metricWakeHooks         *counterVec
+	metricMacros            *counterVec
+	metricBackups           *counterVec
+	metricBeacons           *counterVec
+	metricBeaconNudges      *counterVec
+	metricHTTPRequests      *counterVec
+	metricHTTPDuration      *histogramVec
+}
+
+type counterVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+}
+
+func (c *counterVec) Inc(labelValues ...string) {
+	c.mu.Lock()
+	c.values[strings.Join(labelValues, "\x00")]++
+	c.mu.Unlock()
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, key, "", ""), formatFloat(c.values[key]))
+	}
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	values map[string]*histogram
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, values: make(map[string]*histogram)}
+}
+
+func (h *histogramVec) Observe(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\x00")
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	hist, exists := h.values[key]
+	if !exists {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hist
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			hist.counts[i]++
+		}
+	}
+	hist.sum += v
+	hist.count++
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		hist := h.values[key]
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "le", formatFloat(bound)), hist.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "le", "+Inf"), hist.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, key, "", ""), formatFloat(hist.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, key, "", ""), hist.count)
+	}
+}
+
+func (srv *Server) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	srv.mu.Lock()
+	total := len(srv.espMap)
+	online := 0
+	for _, esp := range srv.espMap {
+		if esp.Online {
+			online++
+		}
+	}
+	queued := 0
+	batteries := make(map[string]float64)
+	for id, esp := range srv.espMap {
+		queued += len(esp.Queue)
+		if t := esp.Telemetry; t != nil && t.BatteryV != nil {
+			batteries[id] = *t.BatteryV
+		}
+	}
+	srv.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	rev, _ := BuildCommit()
+	writeGauge(bw, "wod_build_info", "Build information.", formatLabels([]string{"version", "commit"}, VERSION+"\x00"+rev, "", ""), 1)
+	writeGauge(bw, "wod_uptime_seconds", "Seconds since the server started.", "", srv.now().Sub(srv.startTime).Seconds())
+	writeGauge(bw, "wod_esps_registered", "Registered devices.", "", float64(total))
+	writeGauge(bw, "wod_esps_online", "Devices currently online.", "", float64(online))
+	writeGauge(bw, "wod_commands_pending", "Commands waiting in ESP queues.", "", float64(queued))
+	if srv.clusterEnabled() {
+		leader := 0.0
+		if srv.cluster.leader.Load() {
+			leader = 1
+		}
+		writeGauge(bw, "wod_cluster_leader", "Whether this node holds the cluster leader lease.", "", leader)
+	}
+	if srv.upsEnabled() {
+		srv.upsMu.Lock()
+		reading := srv.upsLast
+		srv.upsMu.Unlock()
+		if reading != nil {
+			onBattery := 0.0
+			if reading.OnBattery {
+				onBattery = 1
+			}
+			writeGauge(bw, "wod_ups_on_battery", "Whether the UPS runs on battery.", "", onBattery)
+			if reading.Charge != nil {
+				writeGauge(bw, "wod_ups_battery_charge_percent", "UPS battery charge.", "", *reading.Charge)
+			}
+		}
+	}
+
+	if len(batteries) > 0 {
+		name := "wod_esp_battery_volts"
+		fmt.Fprintf(bw, "# HELP %s Battery voltage last reported by each ESP.\n# TYPE %s gauge\n", name, name)
+		ids := make([]string, 0, len(batteries))
+		for id := range batteries {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			fmt.Fprintf(bw, "%s%s %s\n", name, formatLabels([]string{"esp_id"}, id, "", ""), formatFloat(batteries[id]))
+		}
+	}
+
+	srv.metricCommandsQueued.write(bw)
+	srv.metricCommandsDelivered.write(bw)
+	srv.metricCommandsAcked.write(bw)
+	srv.metricCommandsFailed.write(bw)
+	srv.metricCommandsExpired.write(bw)
+	srv.metricPolls.write(bw)
+	srv.metricRateLimited.write(bw)
+	srv.metricNotifications.write(bw)
+	srv.metricWebhooks.write(bw)
+	srv.metricWakeHooks.write(bw)
+	srv.metricMacros.write(bw)
+	srv.metricQuotaRefused.write(bw)
+	srv.metricBackups.write(bw)
+	srv.metricBeacons.write(bw)
+	srv.metricBeaconNudges.write(bw)
+	srv.metricHTTPRequests.write(bw)
+	srv.metricHTTPDuration.write(bw)
+	srv.writeUptimeMetrics(bw)
+}
+
+func writeGauge(w io.Writer, name, help, labels string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s%s %s\n", name, help, name, name, labels, formatFloat(value))
+}
+
+// statusRecorder captures the response code and size while still allowing
+// WebSocket upgrades through to the wrapped writer.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	s.status = code
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += int64(n)
+	return n, err
+}
+
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := s.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer does not support hijacking")
+	}
+	s.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+func (s *statusRecorder) Flush() {
+	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (srv *Server) instrument(path string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := srv.now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(rec, r)
+
+		srv.metricHTTPRequests.Inc(path, r.Method, strconv.Itoa(rec.status))
+		if rec.status != http.StatusSwitchingProtocols {
+			srv.metricHTTPDuration.Observe(srv.now().Sub(start).Seconds(), path, r.Method)
+		}
+	}
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names []string, key, extraName, extraValue string) string {
+	var parts []string
+	if len(names) > 0 {
+		values := strings.Split(key, "\x00")
+		for i, name := range names {
+			value := ""
+			if i < len(values) {
+				value = values[i]
+			}
+			parts = append(parts, name+`="`+labelEscaper.Replace(value)+`"`)
+		}
+	}
+	if extraName != "" {
+		parts = append(parts, extraName+`="`+labelEscaper.Replace(extraValue)+`"`)
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	rand "math/rand/v2"
+	"time"
+)
+
+// The monitor decides when a device has gone offline. Every heartbeat sets
+// the device's own timer for when its next poll is overdue, so a missed
+// poll is noticed right away instead of on a shared tick, and devices
+// aren't all checked and logged at once. Each check runs up to the
+// granularity late, at random. The timers start once the server is ready,
+// and count from then for devices last seen before, so a restart doesn't
+// mark devices offline before they had a chance to poll. A slower sweep
+// does the rest: retention, queue and maintenance expiry, and saving the
+// registry.
+
+const (
+	monitorSweepEvery     = 10 * time.Second
+	maxMonitorGranularity = time.Minute
+)
+
+// monitorState holds the Server state kept in monitor.go.
+type monitorState struct {
+	// monitorGranularity is how late an offline check may run; guarded by
+	// mu
+	monitorGranularity time.Duration
+	// monitorSince is when the monitor started, zero until then; guarded
+	// by mu
+	monitorSince time.Time
+}
+
+// offlineDeadline is when the device counts as offline unless it is seen
+// again. Must be called with mu held.
+func (e *ESP) offlineDeadline(srv *Server, now time.Time) time.Time {
+	timeout, _ := e.offlineTimeout(srv)
+	// An ESP waiting in a long poll is connected even if its last poll
+	// started more than a timeout ago
+	if e.longPolls > 0 {
+		return now.Add(timeout)
+	}
+	return maxTime(e.LastSeen, srv.monitorSince).Add(timeout)
+}
+
+// armOfflineCheck sets the device's timer for its offline deadline. Must
+// be called with mu held.
+func (srv *Server) armOfflineCheck(esp *ESP) {
+	if srv.monitorSince.IsZero() || esp.isWoL() || esp.isDriver() {
+		return
+	}
+	due := esp.offlineDeadline(srv, srv.now()).Sub(srv.now())
+	if srv.monitorGranularity > 0 {
+		due += rand.N(srv.monitorGranularity)
+	}
+	if esp.overdue == nil {
+		esp.overdue = time.AfterFunc(due, func() { srv.checkOffline(esp) })
+	} else {
+		esp.overdue.Reset(due)
+	}
+}
+
+// stopOfflineCheck must be called with mu held.
+func stopOfflineCheck(esp *ESP) {
+	if esp.overdue != nil {
+		esp.overdue.Stop()
+	}
+}
+
+// checkOffline runs from the device's timer.
+func (srv *Server) checkOffline(esp *ESP) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.espMap[esp.ID] != esp || !esp.Online {
+		return
+	}
+	now := srv.now()
+	if now.Before(esp.offlineDeadline(srv, now)) {
+		// Seen again or given a longer timeout since the timer was set
+		srv.armOfflineCheck(esp)
+		return
+	}
+	srv.markOffline(esp, now)
+}
+
+// markOffline must be called with mu held.
+func (srv *Server) markOffline(esp *ESP, now time.Time) {
+	esp.Online = false
+	ago := now.Sub(esp.LastSeen).Round(time.Second).String()
+	srv.logger("monitor").Warn("ESP went offline", "esp_id", esp.ID, "last_seen_ago", ago)
+	srv.recordEvent(Event{Type: EventOffline, ESPID: esp.ID, Detail: "last seen " + ago + " ago"})
+}
+
+func (srv *Server) monitorESPs() {
+	// Until the stores are loaded and requests let through, no device
+	// could have polled
+	for !srv.serverReady.Load() {
+		time.Sleep(100 * time.Millisecond)
+	}
+	srv.mu.Lock()
+	srv.monitorSince = srv.now()
+	for _, esp := range srv.espMap {
+		srv.armOfflineCheck(esp)
+	}
+	srv.mu.Unlock()
+
+	monitorLog := srv.logger("monitor")
+	for {
+		// Jittered so it doesn't line up with the other periodic loops
+		time.Sleep(monitorSweepEvery*9/10 + rand.N(monitorSweepEvery/5))
+		srv.mu.Lock()
+		now := srv.now()
+		for id, esp := range srv.espMap {
+			if esp.expired(srv, now) {
+				monitorLog.Info("ESP removed after retention", "esp_id", id, "last_seen", esp.LastSeen.Format(time.RFC3339))
+				srv.removeESP(esp, "retention", "not seen since "+esp.LastSeen.Format(time.RFC3339))
+				continue
+			}
+			if srv.expirePairing(esp, now) {
+				continue
+			}
+			srv.expireQueue(esp)
+			srv.expireMaintenance(esp, now)
+			if esp.isWoL() {
+				continue
+			}
+			// Driver devices go on- and offline with the prober's polls
+			if esp.isDriver() {
+				esp.expirePower(srv)
+				continue
+			}
+			// Catches a timeout shortened after the timer was set; the
+			// timer itself is due first otherwise
+			if esp.Online && now.After(esp.offlineDeadline(srv, now).Add(srv.monitorGranularity)) {
+				srv.markOffline(esp, now)
+			}
+			esp.expirePower(srv)
+			srv.resolveConflict(esp, now)
+		}
+		srv.pruneCommands()
+		srv.saveRegistry()
+		srv.mu.Unlock()
+	}
+}
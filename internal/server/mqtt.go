@@ -0,0 +1,323 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// A minimal MQTT 3.1.1 client: QoS 0 publish and subscribe, which is all the
+// bridge needs.
+
+const (
+	mqttConnect     = 1
+	mqttConnAck     = 2
+	mqttPublish     = 3
+	mqttPubAck      = 4
+	mqttSubscribe   = 8
+	mqttSubAck      = 9
+	mqttPingReq     = 12
+	mqttPingResp    = 13
+	mqttDisconnect  = 14
+	mqttMaxPacket   = 256 * 1024
+	mqttDialTimeout = 10 * time.Second
+)
+
+type mqttOptions struct {
+	Broker    string
+	ClientID  string
+	Username  string
+	Password  string
+	KeepAlive time.Duration
+
+	WillTopic   string
+	WillPayload []byte
+}
+
+type mqttConn struct {
+	conn      net.Conn
+	r         *bufio.Reader
+	keepAlive time.Duration
+
+	wmu    sync.Mutex
+	nextID uint16
+}
+
+var mqttConnAckErrors = map[byte]string{
+	1: "unacceptable protocol version",
+	2: "client identifier rejected",
+	3: "server unavailable",
+	4: "bad username or password",
+	5: "not authorized",
+}
+
+// dialMQTT connects to tcp://host[:1883] or tls://host[:8883].
+// parseMQTTBroker returns the host:port of a tcp:// or tls:// broker URL.
+func parseMQTTBroker(broker string) (string, bool, error) {
+	u, err := url.Parse(broker)
+	if err != nil {
+		return "", false, fmt.Errorf("invalid broker URL: %w", err)
+	}
+	if u.Host == "" {
+		return "", false, fmt.Errorf("broker URL %q has no host", broker)
+	}
+	switch u.Scheme {
+	case "tcp", "mqtt":
+		return hostWithDefaultPort(u.Host, "1883"), false, nil
+	case "tls", "ssl", "mqtts":
+		return hostWithDefaultPort(u.Host, "8883"), true, nil
+	}
+	return "", false, fmt.Errorf("unsupported broker scheme %q (use tcp:// or tls://)", u.Scheme)
+}
+
+func dialMQTT(opts mqttOptions, tlsConfig *tls.Config) (*mqttConn, error) {
+	addr, useTLS, err := parseMQTTBroker(opts.Broker)
+	if err != nil {
+		return nil, err
+	}
+
+	var conn net.Conn
+	dialer := &net.Dialer{Timeout: mqttDialTimeout}
+	if useTLS {
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := &mqttConn{conn: conn, r: bufio.NewReader(conn), keepAlive: opts.KeepAlive}
+	if err := c.handshake(opts); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func hostWithDefaultPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(host, port)
+}
+
+func (c *mqttConn) handshake(opts mqttOptions) error {
+	var flags byte = 0x02 // clean session
+	var payload []byte
+	payload = appendMQTTString(payload, opts.ClientID)
+	if opts.WillTopic != "" {
+		flags |= 0x04 | 0x20 // will flag, will retain
+		payload = appendMQTTString(payload, opts.WillTopic)
+		payload = appendMQTTBytes(payload, opts.WillPayload)
+	}
+	if opts.Username != "" {
+		flags |= 0x80
+		payload = appendMQTTString(payload, opts.Username)
+		if opts.Password != "" {
+			flags |= 0x40
+			payload = appendMQTTString(payload, opts.Password)
+		}
+	}
+
+	var body []byte
+	body = appendMQTTString(body, "MQTT")
+	body = append(body, 4, flags) // protocol level 4 = 3.1.1
+	body = binary.BigEndian.AppendUint16(body, uint16(opts.KeepAlive/time.Second))
+	body = append(body, payload...)
+
+	if err := c.write(mqttConnect<<4, body); err != nil {
+		return err
+	}
+
+	c.conn.SetReadDeadline(time.Now().Add(mqttDialTimeout))
+	kind, _, resp, err := c.readPacket()
+	if err != nil {
+		return err
+	}
+	if kind != mqttConnAck || len(resp) < 2 {
+		return errors.New("unexpected reply to CONNECT")
+	}
+	if code := resp[1]; code != 0 {
+		if msg, ok := mqttConnAckErrors[code]; ok {
+			return fmt.Errorf("broker refused connection: %s", msg)
+		}
+		return fmt.Errorf("broker refused connection (code %d)", code)
+	}
+	return nil
+}
+
+func (c *mqttConn) write(header byte, body []byte) error {
+	packet := []byte{header}
+	packet = appendMQTTLength(packet, len(body))
+	packet = append(packet, body...)
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	_, err := c.conn.Write(packet)
+	return err
+}
+
+func (c *mqttConn) readPacket() (kind, flags byte, body []byte, err error) {
+	header, err := c.r.ReadByte()
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		length += int(b&0x7F) * multiplier
+		if b&0x80 == 0 {
+			break
+		}
+		if i == 3 {
+			return 0, 0, nil, errors.New("malformed remaining length")
+		}
+		multiplier *= 128
+	}
+	if length > mqttMaxPacket {
+		return 0, 0, nil, fmt.Errorf("packet too large (%d bytes)", length)
+	}
+
+	body = make([]byte, length)
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return 0, 0, nil, err
+	}
+	return header >> 4, header & 0x0F, body, nil
+}
+
+func (c *mqttConn) packetID() uint16 {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.nextID++
+	if c.nextID == 0 {
+		c.nextID = 1
+	}
+	return c.nextID
+}
+
+func (c *mqttConn) subscribe(topics ...string) error {
+	body := binary.BigEndian.AppendUint16(nil, c.packetID())
+	for _, topic := range topics {
+		body = appendMQTTString(body, topic)
+		body = append(body, 0) // QoS 0
+	}
+	return c.write(mqttSubscribe<<4|0x02, body)
+}
+
+func (c *mqttConn) publish(topic string, payload []byte, retain bool) error {
+	var header byte = mqttPublish << 4
+	if retain {
+		header |= 0x01
+	}
+	body := appendMQTTString(nil, topic)
+	body = append(body, payload...)
+	return c.write(header, body)
+}
+
+// run reads packets until the connection fails, calling onMessage for each
+// PUBLISH and keeping the session alive with pings.
+func (c *mqttConn) run(onMessage func(topic string, payload []byte)) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(c.keepAlive / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if c.write(mqttPingReq<<4, nil) != nil {
+					c.conn.Close()
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(c.keepAlive * 3 / 2))
+		kind, flags, body, err := c.readPacket()
+		if err != nil {
+			return err
+		}
+
+		switch kind {
+		case mqttPublish:
+			topic, rest, err := readMQTTString(body)
+			if err != nil {
+				return err
+			}
+			if qos := flags >> 1 & 0x03; qos > 0 {
+				if len(rest) < 2 {
+					return errors.New("malformed PUBLISH")
+				}
+				c.write(mqttPubAck<<4, rest[:2])
+				rest = rest[2:]
+			}
+			onMessage(topic, rest)
+		case mqttSubAck:
+			for _, code := range body[min(2, len(body)):] {
+				if code == 0x80 {
+					return errors.New("broker rejected subscription")
+				}
+			}
+		case mqttPingResp:
+		}
+	}
+}
+
+func (c *mqttConn) close() {
+	c.write(mqttDisconnect<<4, nil)
+	c.conn.Close()
+}
+
+func appendMQTTLength(b []byte, n int) []byte {
+	for {
+		digit := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			digit |= 0x80
+		}
+		b = append(b, digit)
+		if n == 0 {
+			return b
+		}
+	}
+}
+
+func appendMQTTString(b []byte, s string) []byte {
+	return appendMQTTBytes(b, []byte(s))
+}
+
+func appendMQTTBytes(b, data []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(data)))
+	return append(b, data...)
+}
+
+func readMQTTString(b []byte) (string, []byte, error) {
+	if len(b) < 2 {
+		return "", nil, errors.New("malformed string")
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n {
+		return "", nil, errors.New("malformed string")
+	}
+	return string(b[2 : 2+n]), b[2+n:], nil
+}
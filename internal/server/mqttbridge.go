@@ -0,0 +1,268 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMQTTPrefix   = "wake-on-demand"
+	defaultMQTTClientID = "wake-on-demand"
+	mqttKeepAlive       = 30 * time.Second
+)
+
+var errPublishFailed = errors.New("failed to publish over MQTT")
+
+// mqttbridgeState holds the Server state kept in mqttbridge.go.
+type mqttbridgeState struct {
+	mqttSettings MQTTSettings
+
+	mqttMu      sync.Mutex
+	mqttActive  *mqttConn
+	mqttSession int
+}
+
+func (srv *Server) mqttEnabled() bool {
+	return srv.mqttSettings.Broker != ""
+}
+
+func (srv *Server) mqttTopic(parts ...string) string {
+	return srv.mqttSettings.TopicPrefix + "/" + strings.Join(parts, "/")
+}
+
+// runMQTT keeps the bridge connected, reconnecting with backoff.
+func (srv *Server) runMQTT() {
+	mlog := srv.logger("mqtt")
+	backoff := time.Second
+	for {
+		conn, err := dialMQTT(mqttOptions{
+			Broker:      srv.mqttSettings.Broker,
+			ClientID:    srv.mqttSettings.ClientID,
+			Username:    srv.mqttSettings.Username,
+			Password:    srv.mqttSettings.Password,
+			KeepAlive:   mqttKeepAlive,
+			WillTopic:   srv.mqttSettings.AvailabilityTopic,
+			WillPayload: []byte("offline"),
+		}, srv.clientTLS)
+		if err != nil {
+			mlog.Error("Broker connection failed", "broker", srv.mqttSettings.Broker, "error", err, "retry_in", backoff.String())
+			time.Sleep(backoff)
+			backoff = min(backoff*2, 30*time.Second)
+			continue
+		}
+		backoff = time.Second
+
+		kinds := []string{"status", "ack"}
+		if srv.mqttSettings.Discovery {
+			kinds = append(kinds, "set")
+		}
+		var topics []string
+		for _, kind := range kinds {
+			// Namespaced IDs take two topic levels
+			topics = append(topics, srv.mqttTopic("+", kind), srv.mqttTopic("+", "+", kind))
+		}
+		if err := conn.subscribe(topics...); err != nil {
+			mlog.Error("Subscribe failed", "error", err)
+			conn.close()
+			time.Sleep(backoff)
+			continue
+		}
+		conn.publish(srv.mqttSettings.AvailabilityTopic, []byte("online"), true)
+
+		srv.mqttMu.Lock()
+		srv.mqttActive = conn
+		srv.mqttSession++
+		srv.mqttMu.Unlock()
+		mlog.Info("Connected to broker", "broker", srv.mqttSettings.Broker, "prefix", srv.mqttSettings.TopicPrefix)
+
+		err = conn.run(srv.handleMQTTMessage)
+
+		srv.mqttMu.Lock()
+		srv.mqttActive = nil
+		srv.mqttMu.Unlock()
+		conn.conn.Close()
+		mlog.Warn("Broker connection lost", "error", err)
+		time.Sleep(backoff)
+	}
+}
+
+// bridgePublish sends a message if the bridge is connected.
+func (srv *Server) bridgePublish(topic string, payload []byte, retain bool) error {
+	srv.mqttMu.Lock()
+	conn := srv.mqttActive
+	srv.mqttMu.Unlock()
+	if conn == nil {
+		return errors.New("not connected to broker")
+	}
+	return conn.publish(topic, payload, retain)
+}
+
+func (srv *Server) closeMQTT() {
+	srv.mqttMu.Lock()
+	defer srv.mqttMu.Unlock()
+	if srv.mqttActive != nil {
+		srv.mqttActive.publish(srv.mqttSettings.AvailabilityTopic, []byte("offline"), true)
+		srv.mqttActive.close()
+	}
+}
+
+func (srv *Server) handleMQTTMessage(topic string, payload []byte) {
+	rest, ok := strings.CutPrefix(topic, srv.mqttSettings.TopicPrefix+"/")
+	if !ok {
+		return
+	}
+	i := strings.LastIndex(rest, "/")
+	if i <= 0 {
+		return
+	}
+	id, kind := rest[:i], rest[i+1:]
+	if validateESPID(id) != nil {
+		return
+	}
+
+	switch kind {
+	case "status":
+		srv.mqttStatus(id, payload)
+	case "ack":
+		srv.mqttAck(id, payload)
+	case "set":
+		srv.haCommand(id, payload)
+	}
+}
+
+// mqttStatus treats a status message as a heartbeat. "offline" (typically
+// the device's last will) marks the device offline right away; a JSON body
+// may carry telemetry.
+func (srv *Server) mqttStatus(id string, payload []byte) {
+	mlog := srv.logger("mqtt").With("esp_id", id)
+	status := strings.TrimSpace(string(payload))
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	esp, exists := srv.espMap[id]
+	if exists && !esp.isMQTT() {
+		mlog.Warn("Ignoring MQTT status for non-MQTT device", "type", esp.Type)
+		return
+	}
+
+	if status == "offline" {
+		if exists && esp.Online {
+			esp.Online = false
+			mlog.Warn("ESP went offline")
+			srv.recordEvent(Event{Type: EventOffline, ESPID: id, Actor: "mqtt", Detail: "status offline"})
+		}
+		return
+	}
+
+	now := srv.now()
+	if !exists {
+		esp = &ESP{
+			ID:           id,
+			Type:         DeviceMQTT,
+			RegisteredAt: now,
+			Target:       srv.configTarget(id),
+		}
+		srv.espMap[id] = esp
+		mlog.Info("New MQTT device registered")
+		srv.recordEvent(Event{Type: EventRegister, ESPID: id, Actor: "mqtt"})
+	} else if !esp.Online {
+		mlog.Info("ESP is back online")
+		srv.recordEvent(Event{Type: EventOnline, ESPID: id, Actor: "mqtt"})
+	}
+	esp.recordInterval(now)
+	esp.LastSeen = now
+	esp.Online = true
+	srv.armOfflineCheck(esp)
+	esp.RemoteAddr = "mqtt"
+	srv.metricPolls.Inc(id)
+	srv.recordEvent(Event{Type: EventPoll, ESPID: id, Actor: "mqtt"})
+
+	var report struct {
+		Telemetry
+		Power   string         `json:"power"`
+		Actions []CustomAction `json:"actions"`
+	}
+	if strings.HasPrefix(status, "{") && json.Unmarshal(payload, &report) == nil {
+		srv.updateTelemetry(esp, report.Telemetry)
+		if report.Power != "" {
+			esp.powerSensor(srv, report.Power)
+		}
+		if report.Actions != nil {
+			if err := ValidateActions(report.Actions); err != nil {
+				mlog.Warn("Ignoring invalid actions", "error", err)
+			} else {
+				esp.Actions = report.Actions
+			}
+		}
+	}
+	if !exists {
+		srv.saveRegistry()
+	}
+}
+
+func (srv *Server) mqttAck(id string, payload []byte) {
+	mlog := srv.logger("mqtt").With("esp_id", id)
+
+	var data CommandReport
+	if err := json.Unmarshal(payload, &data); err != nil {
+		mlog.Warn("Invalid ack payload", "error", err)
+		return
+	}
+	if len(data.Result) > maxResultFields {
+		mlog.Warn("Ack result has too many fields", "command_id", data.CommandID, "fields", len(data.Result))
+		data.Result = nil
+	}
+
+	srv.mu.Lock()
+	rec, err := srv.settleCommand(id, data)
+	srv.mu.Unlock()
+
+	switch {
+	case err != nil:
+		mlog.Warn("Ack rejected", "command_id", data.CommandID, "error", err)
+	case data.Success:
+		mlog.Info("Command acknowledged", "command", rec.Command, "command_id", rec.ID)
+	default:
+		mlog.Warn("Command failed on ESP", "command", rec.Command, "command_id", rec.ID, "error", data.Error)
+	}
+}
+
+// publishCommand sends a command to an MQTT device.
+func (srv *Server) publishCommand(rec *CommandRecord) error {
+	payload, _ := json.Marshal(rec.payload(srv))
+	return srv.bridgePublish(srv.mqttTopic(rec.ESPID, "command"), payload, false)
+}
+
+// mqttDriver publishes commands to MQTT devices. Nothing is kept for a
+// device that is offline, since it would miss the message.
+type mqttDriver struct {
+	srv *Server
+}
+
+func (mqttDriver) Supports(cmd ESPCommand) bool { return cmd != CommandSoftOff }
+
+func (mqttDriver) Queues() bool { return false }
+
+func (d mqttDriver) Send(esp *ESP, cmd ESPCommand, duration time.Duration, opts commandOptions, actor string) (dispatchResult, error) {
+	if !esp.Online {
+		return dispatchResult{}, fmt.Errorf("%w: ESP '%s' is offline", errESPOffline, esp.ID)
+	}
+	if opts.DryRun {
+		return dispatchResult{Status: statusDryRun, Delivery: "mqtt"}, nil
+	}
+	rec := d.srv.newCommandRecord(esp.ID, cmd)
+	rec.DurationMS = int(duration.Milliseconds())
+	rec.Action = opts.Action
+	d.srv.recordEvent(Event{Type: EventCommand, ESPID: esp.ID, Actor: actor, Command: cmd, CommandID: rec.ID, Detail: "mqtt"})
+	if err := d.srv.publishCommand(rec); err != nil {
+		d.srv.failCommand(rec, err.Error())
+		return dispatchResult{Record: rec}, fmt.Errorf("%w: %v", errPublishFailed, err)
+	}
+	d.srv.markDelivered(rec)
+	return dispatchResult{Record: rec, Status: "sent", Delivery: "mqtt"}, nil
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// namespaceOf returns the namespace of an ESP ID, "" for the default one.
+func namespaceOf(id string) string {
+	ns, _, found := strings.Cut(id, "/")
+	if !found {
+		return ""
+	}
+	return ns
+}
+
+func ValidateNamespace(ns string) error {
+	if ns == "" {
+		return errors.New("namespace cannot be empty")
+	}
+	if strings.Contains(ns, "/") {
+		return errors.New("namespace cannot contain '/'")
+	}
+	if !espIDPartPattern.MatchString(ns) || onlyDots(ns) {
+		return fmt.Errorf("invalid namespace %q (use letters, digits, '.', '-' and '_')", ns)
+	}
+	return nil
+}
+
+// onlyDots reports whether an ID segment is "." or "..", or any other run
+// of dots, which would name another directory in file names and paths.
+func onlyDots(s string) bool {
+	return strings.Trim(s, ".") == ""
+}
+
+// validateESPID checks an ID a device is created with: up to 64 letters,
+// digits, '.', '-' and '_', with at most one '/' after the namespace, and
+// no segment made only of dots.
+func validateESPID(id string) error {
+	if id == "" {
+		return errors.New("id cannot be empty")
+	}
+	if len(id) > maxESPIDLength {
+		return fmt.Errorf("id is longer than %d characters", maxESPIDLength)
+	}
+	ns, name, found := strings.Cut(id, "/")
+	if found && (ns == "" || name == "" || strings.Contains(name, "/")) {
+		return errors.New("id must be <name> or <namespace>/<name>")
+	}
+	if !espIDPartPattern.MatchString(ns) || onlyDots(ns) || found && (!espIDPartPattern.MatchString(name) || onlyDots(name)) {
+		return fmt.Errorf("invalid id %q (use letters, digits, '.', '-' and '_')", id)
+	}
+	return nil
+}
+
+// espToken returns the token an ESP must present: its own, or else the one
+// of its namespace.
+func (a AuthConfig) espToken(id string) (string, bool) {
+	if token, exists := a.ESPTokens[id]; exists {
+		return token, true
+	}
+	if ns := namespaceOf(id); ns != "" {
+		token, exists := a.NamespaceTokens[ns]
+		return token, exists
+	}
+	return "", false
+}
+
+// inNamespace reports whether p may see espID at all. Principals without
+// a namespace see every namespace.
+func (p *principal) inNamespace(espID string) bool {
+	return p.Namespace == "" || namespaceOf(espID) == p.Namespace
+}
+
+// global reports whether p administers the whole server rather than one
+// namespace.
+func (p *principal) global() bool {
+	return p.Role == RoleAdmin && p.Namespace == ""
+}
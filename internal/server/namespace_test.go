@@ -0,0 +1,46 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateESPIDRejects(t *testing.T) {
+	for _, id := range []string{
+		"",
+		".",
+		"..",
+		"...",
+		"../x",
+		"./x",
+		"x/..",
+		"x/.",
+		"../..",
+		"/x",
+		"x/",
+		"a/b/c",
+		"a b",
+		"nas?",
+		strings.Repeat("a", maxESPIDLength+1),
+	} {
+		if err := validateESPID(id); err == nil {
+			t.Errorf("validateESPID(%q) = nil, want an error", id)
+		}
+	}
+}
+
+func TestValidateESPIDAccepts(t *testing.T) {
+	for _, id := range []string{"nas", "esp-a1b2c3", "home/nas", "v1.2", ".hidden", "a..b", "lab.site/rack_1"} {
+		if err := validateESPID(id); err != nil {
+			t.Errorf("validateESPID(%q) = %v, want nil", id, err)
+		}
+	}
+}
+
+func TestValidateNamespaceRejectsDots(t *testing.T) {
+	for _, ns := range []string{".", "..", "...."} {
+		if err := ValidateNamespace(ns); err == nil {
+			t.Errorf("validateNamespace(%q) = nil, want an error", ns)
+		}
+	}
+}
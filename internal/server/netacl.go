@@ -0,0 +1,145 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// netaclState holds the Server state kept in netacl.go.
+type netaclState struct {
+	// ESP network access control. Allowlists restrict which source addresses
+	// may use the device endpoints; pinning ties an ESP ID to the address that
+	// first registered it, so another device on an allowed network can't take
+	// over the ID.
+	registerAllow []netip.Prefix
+	commandAllow  []netip.Prefix
+	pinESPIPs     bool
+}
+
+// parseCIDRs accepts prefixes and bare addresses, which match only themselves.
+func parseCIDRs(list []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address %q", s)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", s)
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
+
+// addrAllowed reports whether host is in one of the prefixes; an empty list
+// allows everything.
+func addrAllowed(prefixes []netip.Prefix, host string) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// withNetworkACL rejects device requests from addresses outside the
+// allowlist: registerAllow for registrations, commandAllow for every other
+// route and method with the ESP scope.
+func (srv *Server) withNetworkACL(path string, scope authScope, next http.HandlerFunc) http.HandlerFunc {
+	if scope != scopeESP {
+		return next
+	}
+	prefixes := &srv.commandAllow
+	if path == "/register" {
+		prefixes = &srv.registerAllow
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		srv.settingsMu.RLock()
+		allowed := *prefixes
+		srv.settingsMu.RUnlock()
+		if host := srv.remoteHost(r); !addrAllowed(allowed, host) {
+			srv.requestLogger(r).Warn("Source address not allowed", "addr", host)
+			writeError(w, CodeForbidden, "source address not allowed")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// checkPin pins an unpinned ESP to the request's source address, and
+// rejects requests from any other address once pinned. It writes the error
+// response itself. Must be called with mu held.
+func (srv *Server) checkPin(w http.ResponseWriter, r *http.Request, esp *ESP) bool {
+	if !srv.pinESPIPs {
+		return true
+	}
+	host := srv.remoteHost(r)
+	if esp.PinnedIP == "" {
+		esp.PinnedIP = host
+		srv.requestLogger(r).Info("ESP pinned to source address", "esp_id", esp.ID, "addr", host)
+		return true
+	}
+	if esp.PinnedIP == host {
+		return true
+	}
+	srv.requestLogger(r).Warn("ESP request from unpinned address", "esp_id", esp.ID, "addr", host, "pinned_ip", esp.PinnedIP)
+	srv.recordEvent(Event{Type: EventRejected, ESPID: esp.ID, Actor: srv.requestActor(r), Detail: "source address does not match pinned " + esp.PinnedIP})
+	writeError(w, CodeForbidden, fmt.Sprintf("'%s' is pinned to another address", esp.ID))
+	return false
+}
+
+// pinHandler clears an ESP's pinned address; the next registration pins it again.
+func (srv *Server) pinHandler(w http.ResponseWriter, r *http.Request) {
+	rlog := srv.requestLogger(r)
+
+	if r.Method != http.MethodDelete {
+		writeError(w, CodeMethodNotAllowed, "only DELETE allowed")
+		return
+	}
+	id := srv.resolveAlias(r.URL.Query().Get("id"))
+
+	srv.mu.Lock()
+	esp, exists := srv.espMap[id]
+	if !exists {
+		srv.mu.Unlock()
+		writeError(w, CodeESPNotFound, "ESP not registered")
+		return
+	}
+	previous := esp.PinnedIP
+	esp.PinnedIP = ""
+	srv.saveRegistry()
+	srv.mu.Unlock()
+
+	rlog.Info("ESP pin reset", "esp_id", id, "pinned_ip", previous)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "unpinned", "id": id})
+}
+
+// SplitList splits a flag value like "10.0.0.0/8, 192.168.1.0/24".
+func SplitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+// newACLServer returns a server with the register and command allowlists
+// set.
+func newACLServer(register, command string) *Server {
+	srv := newServer()
+	srv.registerAllow = []netip.Prefix{netip.MustParsePrefix(register)}
+	srv.commandAllow = []netip.Prefix{netip.MustParsePrefix(command)}
+	return srv
+}
+
+func TestWithNetworkACL(t *testing.T) {
+	srv := newACLServer("10.0.0.0/8", "192.168.0.0/16")
+
+	for _, tc := range []struct {
+		path   string
+		scope  authScope
+		remote string
+		want   int
+	}{
+		{"/register", scopeESP, "10.1.2.3", http.StatusOK},
+		{"/register", scopeESP, "192.168.1.2", http.StatusForbidden},
+		{"/command", scopeESP, "192.168.1.2", http.StatusOK},
+		{"/command", scopeESP, "10.1.2.3", http.StatusForbidden},
+		{"/command-result", scopeESP, "203.0.113.5", http.StatusForbidden},
+		{"/agent", scopeESP, "203.0.113.5", http.StatusForbidden},
+		{"/ota/firmware", scopeESP, "203.0.113.5", http.StatusForbidden},
+		{"/command-result", scopeUser, "203.0.113.5", http.StatusOK},
+		{"/list", scopeUser, "203.0.113.5", http.StatusOK},
+		{"/health", scopePublic, "203.0.113.5", http.StatusOK},
+	} {
+		h := srv.withNetworkACL(tc.path, tc.scope, func(w http.ResponseWriter, r *http.Request) {})
+		req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		req.RemoteAddr = tc.remote + ":4000"
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("%s (scope %v) from %s: status = %d, want %d", tc.path, tc.scope, tc.remote, rec.Code, tc.want)
+		}
+	}
+}
+
+// Every route and method with the ESP scope is behind an allowlist, and
+// nothing else is.
+func TestWithNetworkACLRoutes(t *testing.T) {
+	srv := newACLServer("10.0.0.0/8", "192.168.0.0/16")
+
+	for _, rt := range srv.apiRoutes() {
+		for _, op := range rt.ops {
+			scope := rt.opScope(op)
+			h := srv.withNetworkACL(rt.path, scope, func(w http.ResponseWriter, r *http.Request) {})
+			req := httptest.NewRequest(op.method, rt.path, nil)
+			req.RemoteAddr = "203.0.113.5:4000"
+			rec := httptest.NewRecorder()
+			h(rec, req)
+
+			want := http.StatusOK
+			if scope == scopeESP {
+				want = http.StatusForbidden
+			}
+			if rec.Code != want {
+				t.Errorf("%s %s: status = %d, want %d", op.method, rt.path, rec.Code, want)
+			}
+		}
+	}
+}
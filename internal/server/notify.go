@@ -0,0 +1,425 @@
+package server
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+type NotifyTrigger string
+
+const (
+	TriggerESPOffline        NotifyTrigger = "esp_offline"
+	TriggerESPOnline         NotifyTrigger = "esp_online"
+	TriggerCommandFailed     NotifyTrigger = "command_failed"
+	TriggerTargetUnreachable NotifyTrigger = "target_unreachable"
+	TriggerESPConflict       NotifyTrigger = "esp_conflict"
+	TriggerIdleShutdown      NotifyTrigger = "idle_shutdown"
+	TriggerBatteryLow        NotifyTrigger = "battery_low"
+	TriggerPower             NotifyTrigger = "power"
+	TriggerESPPending        NotifyTrigger = "esp_pending"
+	TriggerTest              NotifyTrigger = "test"
+)
+
+var notifyTriggers = []NotifyTrigger{TriggerESPOffline, TriggerESPOnline, TriggerCommandFailed, TriggerTargetUnreachable, TriggerESPConflict, TriggerIdleShutdown, TriggerBatteryLow, TriggerPower, TriggerESPPending}
+
+const (
+	defaultWakeTimeout = 5 * time.Minute
+	notifySendTimeout  = 10 * time.Second
+	defaultTelegramAPI = "https://api.telegram.org"
+)
+
+type notification struct {
+	Trigger   NotifyTrigger `json:"trigger"`
+	ESPID     string        `json:"esp_id,omitempty"`
+	Alias     string        `json:"alias,omitempty"`
+	Command   ESPCommand    `json:"command,omitempty"`
+	CommandID string        `json:"command_id,omitempty"`
+	Message   string        `json:"message"`
+	Time      time.Time     `json:"time"`
+}
+
+// notifier delivers a notification to one destination.
+type notifier interface {
+	send(ctx context.Context, n notification) error
+}
+
+type notifySink struct {
+	kind     string
+	triggers []NotifyTrigger // empty means all
+	notifier
+}
+
+func (s *notifySink) wants(t NotifyTrigger) bool {
+	return t == TriggerTest || len(s.triggers) == 0 || slices.Contains(s.triggers, t)
+}
+
+// notifyState holds the Server state kept in notify.go.
+type notifyState struct {
+	notifySinks  []*notifySink
+	notifyQueue  chan notification
+	notifyClient *http.Client
+	wakeTimeout  time.Duration
+	batteryLow   float64
+
+	// ESP ID → when its target must be up after an 'on'; guarded by wakeMu
+	wakeMu        sync.Mutex
+	wakeDeadlines map[string]time.Time
+}
+
+func (srv *Server) notificationsEnabled() bool {
+	return len(srv.currentSinks()) > 0
+}
+
+// currentSinks returns the sinks, which a reload may replace.
+func (srv *Server) currentSinks() []*notifySink {
+	srv.settingsMu.RLock()
+	defer srv.settingsMu.RUnlock()
+	return srv.notifySinks
+}
+
+// setupNotifications builds the sinks from an already validated config.
+func (srv *Server) setupNotifications(s NotifySettings) {
+	var sinks []*notifySink
+	for _, sc := range s.Sinks {
+		sink := &notifySink{kind: sc.Type}
+		for _, t := range sc.Triggers {
+			sink.triggers = append(sink.triggers, NotifyTrigger(t))
+		}
+		switch sc.Type {
+		case "webhook":
+			sink.notifier = webhookNotifier{url: sc.URL, srv: srv}
+		case "telegram":
+			api := sc.URL
+			if api == "" {
+				api = defaultTelegramAPI
+			}
+			sink.notifier = telegramNotifier{api: strings.TrimRight(api, "/"), token: sc.BotToken, chatID: sc.ChatID, srv: srv}
+		case "smtp":
+			sink.notifier = smtpNotifier{host: sc.Host, username: sc.Username, password: sc.Password, from: sc.From, to: sc.To}
+		}
+		sinks = append(sinks, sink)
+	}
+
+	srv.settingsMu.Lock()
+	defer srv.settingsMu.Unlock()
+	srv.notifySinks = sinks
+	srv.wakeTimeout = cmp.Or(s.WakeTimeout, defaultWakeTimeout)
+	srv.batteryLow = s.BatteryLow
+}
+
+// batteryThreshold returns the low battery voltage, 0 when unset.
+func (srv *Server) batteryThreshold() float64 {
+	srv.settingsMu.RLock()
+	defer srv.settingsMu.RUnlock()
+	return srv.batteryLow
+}
+
+func validateNotifySink(i int, sc NotifySinkSettings) []error {
+	var errs []error
+	prefix := fmt.Sprintf("notifications.sinks[%d]", i)
+	switch sc.Type {
+	case "webhook":
+		if u, err := url.Parse(sc.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("%s: url %q must be an http:// or https:// URL", prefix, sc.URL))
+		}
+	case "telegram":
+		if sc.BotToken == "" || sc.ChatID == "" {
+			errs = append(errs, fmt.Errorf("%s: telegram needs bot_token and chat_id", prefix))
+		}
+	case "smtp":
+		if _, _, err := net.SplitHostPort(sc.Host); err != nil {
+			errs = append(errs, fmt.Errorf("%s: host %q must be host:port", prefix, sc.Host))
+		}
+		if sc.From == "" || len(sc.To) == 0 {
+			errs = append(errs, fmt.Errorf("%s: smtp needs from and to", prefix))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("%s: unknown type %q (use webhook, telegram or smtp)", prefix, sc.Type))
+	}
+	for _, t := range sc.Triggers {
+		if !slices.Contains(notifyTriggers, NotifyTrigger(t)) {
+			errs = append(errs, fmt.Errorf("%s: unknown trigger %q", prefix, t))
+		}
+	}
+	return errs
+}
+
+func (srv *Server) deviceName(id string) string {
+	if alias := srv.aliasFor(id); alias != "" {
+		return alias
+	}
+	return id
+}
+
+// notifyEvent turns audit events into notifications. It is called from
+// recordEvent and must not block.
+func (srv *Server) notifyEvent(e Event) {
+	if !srv.notificationsEnabled() {
+		return
+	}
+
+	n := notification{ESPID: e.ESPID, Alias: srv.aliasFor(e.ESPID), Command: e.Command, CommandID: e.CommandID, Time: e.Time}
+	switch e.Type {
+	case EventOffline:
+		n.Trigger = TriggerESPOffline
+		n.Message = fmt.Sprintf("ESP %s went offline", srv.deviceName(e.ESPID))
+		if e.Detail != "" {
+			n.Message += " (" + e.Detail + ")"
+		}
+	case EventOnline:
+		// The agent coming up says nothing about the ESP
+		if e.Detail == "agent" {
+			return
+		}
+		n.Trigger = TriggerESPOnline
+		n.Message = fmt.Sprintf("ESP %s is back online", srv.deviceName(e.ESPID))
+	case EventConflict:
+		if e.Detail == "resolved" {
+			return
+		}
+		n.Trigger = TriggerESPConflict
+		n.Message = fmt.Sprintf("ESP ID %s is used by more than one device: %s", srv.deviceName(e.ESPID), e.Detail)
+	case EventBattery:
+		n.Trigger = TriggerBatteryLow
+		if strings.HasPrefix(e.Detail, "ok: ") {
+			n.Message = fmt.Sprintf("Battery of ESP %s recovered (%s)", srv.deviceName(e.ESPID), strings.TrimPrefix(e.Detail, "ok: "))
+		} else {
+			n.Message = fmt.Sprintf("Battery of ESP %s is low (%s)", srv.deviceName(e.ESPID), strings.TrimPrefix(e.Detail, "low: "))
+		}
+	case EventPairing:
+		if e.Detail == "approved" {
+			return
+		}
+		n.Trigger = TriggerESPPending
+		n.Message = fmt.Sprintf("New ESP %s is waiting for approval (%s)", e.ESPID, e.Detail)
+	case EventFailed:
+		n.Trigger = TriggerCommandFailed
+		n.Message = fmt.Sprintf("Command '%s' on %s failed: %s", e.Command, srv.deviceName(e.ESPID), e.Detail)
+	case EventExpired:
+		n.Trigger = TriggerCommandFailed
+		n.Message = fmt.Sprintf("Command '%s' on %s expired: %s", e.Command, srv.deviceName(e.ESPID), e.Detail)
+	case EventCommand:
+		if e.Command == CommandPulse {
+			srv.wakeMu.Lock()
+			srv.wakeDeadlines[e.ESPID] = e.Time.Add(srv.wakeTimeout)
+			srv.wakeMu.Unlock()
+		}
+		return
+	case EventTargetUp:
+		srv.wakeMu.Lock()
+		delete(srv.wakeDeadlines, e.ESPID)
+		srv.wakeMu.Unlock()
+		return
+	default:
+		return
+	}
+	srv.queueNotification(n)
+}
+
+func (srv *Server) queueNotification(n notification) {
+	select {
+	case srv.notifyQueue <- n:
+	default:
+		srv.logger("notify").Warn("Notification queue full, dropping", "trigger", n.Trigger, "esp_id", n.ESPID)
+	}
+}
+
+func (srv *Server) runNotifier() {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case n := <-srv.notifyQueue:
+			for _, sink := range srv.currentSinks() {
+				if sink.wants(n.Trigger) {
+					srv.deliverNotification(sink, n)
+				}
+			}
+		case <-ticker.C:
+			srv.checkWakeDeadlines()
+		}
+	}
+}
+
+func (srv *Server) deliverNotification(sink *notifySink, n notification) error {
+	ctx, cancel := context.WithTimeout(context.Background(), notifySendTimeout)
+	defer cancel()
+	ctx, s := srv.startSpan(ctx, "notify "+sink.kind, spanClient, "notify.sink", sink.kind, "notify.trigger", string(n.Trigger), "esp_id", n.ESPID)
+	defer s.finish(srv)
+	nlog := srv.logger("notify").With(s.logAttrs()...)
+
+	err := sink.send(ctx, n)
+	if err != nil {
+		s.fail(err)
+		srv.metricNotifications.Inc(sink.kind, string(n.Trigger), "error")
+		nlog.Error("Notification failed", "sink", sink.kind, "trigger", n.Trigger, "esp_id", n.ESPID, "error", err)
+		return err
+	}
+	srv.metricNotifications.Inc(sink.kind, string(n.Trigger), "ok")
+	nlog.Debug("Notification sent", "sink", sink.kind, "trigger", n.Trigger, "esp_id", n.ESPID)
+	return nil
+}
+
+// checkWakeDeadlines reports targets that are still not up once the wake
+// timeout after an 'on' has passed.
+func (srv *Server) checkWakeDeadlines() {
+	now := srv.now()
+	var expired []string
+	srv.wakeMu.Lock()
+	for id, deadline := range srv.wakeDeadlines {
+		if now.After(deadline) {
+			expired = append(expired, id)
+			delete(srv.wakeDeadlines, id)
+		}
+	}
+	srv.wakeMu.Unlock()
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for _, id := range expired {
+		esp, exists := srv.espMap[id]
+		if !exists || esp.Target == nil || esp.TargetState != nil && esp.TargetState.Up {
+			continue
+		}
+		msg := fmt.Sprintf("Target %s of %s did not come up within %s of 'on'", esp.Target, srv.deviceName(id), srv.wakeTimeout)
+		if esp.TargetState != nil && esp.TargetState.Error != "" {
+			msg += ": " + esp.TargetState.Error
+		}
+		srv.logger("notify").Warn("Target unreachable after wake", "esp_id", id, "timeout", srv.wakeTimeout.String())
+		srv.queueNotification(notification{Trigger: TriggerTargetUnreachable, ESPID: id, Alias: srv.aliasFor(id), Message: msg, Time: now})
+	}
+}
+
+// --- Sinks ---
+
+type webhookNotifier struct {
+	url string
+	srv *Server
+}
+
+func (w webhookNotifier) send(ctx context.Context, n notification) error {
+	body, _ := json.Marshal(n)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "wake-on-demand/"+VERSION)
+	injectTraceparent(req)
+	resp, err := w.srv.notifyClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+type telegramNotifier struct {
+	api, token, chatID string
+	srv                *Server
+}
+
+func (t telegramNotifier) send(ctx context.Context, n notification) error {
+	form := url.Values{"chat_id": {t.chatID}, "text": {n.Message}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.api+"/bot"+t.token+"/sendMessage", strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := t.srv.notifyClient.Do(req)
+	if err != nil {
+		// The URL carries the bot token, keep it out of the logs
+		return fmt.Errorf("telegram request failed: %w", errors.Unwrap(err))
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		OK          bool   `json:"ok"`
+		Description string `json:"description"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+	if !result.OK {
+		return fmt.Errorf("telegram returned %s: %s", resp.Status, result.Description)
+	}
+	return nil
+}
+
+type smtpNotifier struct {
+	host, username, password, from string
+	to                             []string
+}
+
+func (s smtpNotifier) send(ctx context.Context, n notification) error {
+	// Device IDs come from ESPs; keep them from injecting headers
+	subject := strings.NewReplacer("\r", " ", "\n", " ").Replace(n.Message)
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\nTo: %s\r\nSubject: [wake-on-demand] %s\r\nDate: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n",
+		s.from, strings.Join(s.to, ", "), subject, n.Time.Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "%s\r\n\r\nTrigger: %s\r\n", n.Message, n.Trigger)
+	if n.ESPID != "" {
+		fmt.Fprintf(&msg, "ESP: %s\r\n", n.ESPID)
+	}
+	if n.CommandID != "" {
+		fmt.Fprintf(&msg, "Command: %s (%s)\r\n", n.Command, n.CommandID)
+	}
+
+	var auth smtp.Auth
+	if s.username != "" {
+		host, _, _ := net.SplitHostPort(s.host)
+		auth = smtp.PlainAuth("", s.username, s.password, host)
+	}
+	// net/smtp has no context support, so bound it with a goroutine
+	done := make(chan error, 1)
+	go func() { done <- smtp.SendMail(s.host, auth, s.from, s.to, msg.Bytes()) }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// --- Test endpoint ---
+
+// notifyTestHandler sends a test notification through every sink and
+// reports the result per sink.
+func (srv *Server) notifyTestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, CodeMethodNotAllowed, "only POST allowed")
+		return
+	}
+	if !srv.notificationsEnabled() {
+		writeError(w, CodeNotFound, "no notification sinks configured")
+		return
+	}
+
+	n := notification{Trigger: TriggerTest, Message: "Test notification from wake-on-demand", Time: srv.now()}
+	sinks := srv.currentSinks()
+	results := make([]map[string]string, 0, len(sinks))
+	for _, sink := range sinks {
+		result := map[string]string{"sink": sink.kind, "status": "ok"}
+		if err := srv.deliverNotification(sink, n); err != nil {
+			result["status"] = "error"
+			result["error"] = err.Error()
+		}
+		results = append(results, result)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"results": results})
+}
@@ -0,0 +1,464 @@
+package server
+
+import (
+	"cmp"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Dashboard sign-in through an OpenID Connect provider such as Authentik or
+// Keycloak, using the authorization code flow with PKCE. The ID token is
+// checked against the provider's published keys; its user name is matched
+// to a local user first, so grants made with 'user grant' apply, and
+// otherwise the user's groups are mapped to a role.
+
+const (
+	oidcHTTPTimeout  = 10 * time.Second
+	oidcLoginTimeout = 10 * time.Minute
+	oidcClockSkew    = time.Minute
+)
+
+type OIDCSettings struct {
+	Issuer        string   `yaml:"issuer"`
+	ClientID      string   `yaml:"client_id"`
+	ClientSecret  string   `yaml:"client_secret"`
+	RedirectURL   string   `yaml:"redirect_url"` // https://<server>/ui/oidc/callback
+	Scopes        []string `yaml:"scopes"`
+	UsernameClaim string   `yaml:"username_claim"`
+	GroupsClaim   string   `yaml:"groups_claim"`
+	// Roles maps provider groups to roles for users without a local
+	// account. Operators and viewers mapped this way see every ESP.
+	Roles map[string]Role `yaml:"roles"`
+}
+
+func validateOIDC(s OIDCSettings) []error {
+	if reflect.DeepEqual(s, OIDCSettings{}) {
+		return nil
+	}
+	var errs []error
+	for name, value := range map[string]string{"issuer": s.Issuer, "redirect_url": s.RedirectURL} {
+		u, err := url.Parse(value)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("auth.oidc.%s: %q must be an http:// or https:// URL", name, value))
+		}
+	}
+	if s.ClientID == "" {
+		errs = append(errs, errors.New("auth.oidc.client_id: required"))
+	}
+	for group, role := range s.Roles {
+		if !role.Valid() {
+			errs = append(errs, fmt.Errorf("auth.oidc.roles.%s: unknown role %q (use admin, operator or viewer)", group, role))
+		}
+	}
+	return errs
+}
+
+type oidcProvider struct {
+	settings OIDCSettings
+	client   *http.Client
+
+	mu        sync.Mutex
+	meta      *oidcMetadata
+	keys      map[string]crypto.PublicKey
+	keysFetch time.Time
+	pending   map[string]*oidcLogin // by state
+}
+
+type oidcMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcLogin is a sign-in that went to the provider and hasn't come back.
+type oidcLogin struct {
+	nonce    string
+	verifier string
+	expires  time.Time
+}
+
+// oidcState holds the Server state kept in oidc.go.
+type oidcState struct {
+	oidcMu sync.Mutex
+	oidc   *oidcProvider
+}
+
+// setupOIDC replaces the provider when its settings changed. Discovery
+// waits for the first sign-in, so a provider that is down doesn't hold up
+// the server.
+func (srv *Server) setupOIDC(s OIDCSettings) {
+	srv.oidcMu.Lock()
+	defer srv.oidcMu.Unlock()
+	if s.Issuer == "" {
+		srv.oidc = nil
+		return
+	}
+	if srv.oidc != nil && reflect.DeepEqual(srv.oidc.settings, s) {
+		return
+	}
+	if len(s.Scopes) == 0 {
+		s.Scopes = []string{"openid", "profile", "email"}
+	}
+	if !slices.Contains(s.Scopes, "openid") {
+		s.Scopes = append([]string{"openid"}, s.Scopes...)
+	}
+	if s.UsernameClaim == "" {
+		s.UsernameClaim = "preferred_username"
+	}
+	if s.GroupsClaim == "" {
+		s.GroupsClaim = "groups"
+	}
+	srv.oidc = &oidcProvider{
+		settings: s,
+		client:   &http.Client{Timeout: oidcHTTPTimeout},
+		pending:  make(map[string]*oidcLogin),
+	}
+}
+
+func (srv *Server) currentOIDC() *oidcProvider {
+	srv.oidcMu.Lock()
+	defer srv.oidcMu.Unlock()
+	return srv.oidc
+}
+
+func (srv *Server) oidcEnabled() bool {
+	return srv.currentOIDC() != nil
+}
+
+func (p *oidcProvider) getJSON(u string, into any) error {
+	resp, err := p.client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(into)
+}
+
+func (p *oidcProvider) metadata() (*oidcMetadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.meta != nil {
+		return p.meta, nil
+	}
+	var meta oidcMetadata
+	if err := p.getJSON(strings.TrimSuffix(p.settings.Issuer, "/")+"/.well-known/openid-configuration", &meta); err != nil {
+		return nil, fmt.Errorf("discovery: %w", err)
+	}
+	if strings.TrimSuffix(meta.Issuer, "/") != strings.TrimSuffix(p.settings.Issuer, "/") {
+		return nil, fmt.Errorf("discovery: provider calls itself %q, not %q", meta.Issuer, p.settings.Issuer)
+	}
+	if meta.AuthorizationEndpoint == "" || meta.TokenEndpoint == "" || meta.JWKSURI == "" {
+		return nil, errors.New("discovery: provider metadata is missing endpoints")
+	}
+	p.meta = &meta
+	return p.meta, nil
+}
+
+// key returns the signing key with the given ID, refetching the key set at
+// most once a minute when the provider has rotated its keys.
+func (p *oidcProvider) key(srv *Server, kid string) (crypto.PublicKey, error) {
+	meta, err := p.metadata()
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	if srv.now().Sub(p.keysFetch) < time.Minute {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	p.keysFetch = srv.now()
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := p.getJSON(meta.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("fetch signing keys: %w", err)
+	}
+	p.keys = make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch k.Kty {
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(k.N)
+			e, errE := base64.RawURLEncoding.DecodeString(k.E)
+			if errN != nil || errE != nil || len(e) > 4 {
+				continue
+			}
+			p.keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			x, errX := base64.RawURLEncoding.DecodeString(k.X)
+			y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+			if k.Crv != "P-256" || errX != nil || errY != nil {
+				continue
+			}
+			p.keys[k.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		}
+	}
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// verify checks an ID token's signature (RS256 or ES256) and claims and
+// returns the claims.
+func (p *oidcProvider) verify(srv *Server, token, nonce string) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed ID token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("ID token header: %w", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("ID token signature: %w", err)
+	}
+	key, err := p.key(srv, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" || rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig) != nil {
+			return nil, errors.New("ID token signature does not verify")
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(sig) != 64 ||
+			!ecdsa.Verify(k, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+			return nil, errors.New("ID token signature does not verify")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported signing key %q", header.Kid)
+	}
+
+	var claims map[string]any
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("ID token claims: %w", err)
+	}
+	meta, _ := p.metadata()
+	if iss, _ := claims["iss"].(string); iss != meta.Issuer {
+		return nil, fmt.Errorf("ID token issued by %q", iss)
+	}
+	var audience []string
+	switch aud := claims["aud"].(type) {
+	case string:
+		audience = []string{aud}
+	case []any:
+		for _, a := range aud {
+			if s, ok := a.(string); ok {
+				audience = append(audience, s)
+			}
+		}
+	}
+	if !slices.Contains(audience, p.settings.ClientID) {
+		return nil, errors.New("ID token is for another client")
+	}
+	exp, _ := claims["exp"].(float64)
+	if srv.now().After(time.Unix(int64(exp), 0).Add(oidcClockSkew)) {
+		return nil, errors.New("ID token has expired")
+	}
+	if got, _ := claims["nonce"].(string); !tokenMatches(got, nonce) {
+		return nil, errors.New("ID token nonce does not match")
+	}
+	return claims, nil
+}
+
+func decodeJWTPart(part string, into any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, into)
+}
+
+// sessionFor maps verified claims to a session: the local user of the same
+// name, or the best role the user's groups are mapped to.
+func (p *oidcProvider) sessionFor(srv *Server, claims map[string]any) (*session, error) {
+	name, _ := claims[p.settings.UsernameClaim].(string)
+	if name == "" {
+		return nil, fmt.Errorf("ID token has no %q claim", p.settings.UsernameClaim)
+	}
+
+	srv.usersMu.Lock()
+	_, local := srv.users[name]
+	srv.usersMu.Unlock()
+	if local {
+		return &session{user: name}, nil
+	}
+
+	var role Role
+	groups, _ := claims[p.settings.GroupsClaim].([]any)
+	for _, g := range groups {
+		group, _ := g.(string)
+		switch r := p.settings.Roles[group]; {
+		case r == RoleAdmin, r == RoleOperator && role != RoleAdmin, r == RoleViewer && role == "":
+			role = r
+		}
+	}
+	if role == "" {
+		return nil, fmt.Errorf("%s has no local account and none of their groups has a role", name)
+	}
+	return &session{remote: &principal{Name: name, Role: role, ESPs: []string{"*"}}}, nil
+}
+
+// oidcLoginHandler serves GET /ui/oidc/login and sends the browser to the
+// provider.
+func (srv *Server) oidcLoginHandler(w http.ResponseWriter, r *http.Request) {
+	p := srv.currentOIDC()
+	if p == nil {
+		http.NotFound(w, r)
+		return
+	}
+	meta, err := p.metadata()
+	if err != nil {
+		srv.requestLogger(r).Error("OIDC provider unavailable", "error", err)
+		writeError(w, CodeUpstreamFailed, "sign-in provider unavailable")
+		return
+	}
+
+	state, login := randomToken(), &oidcLogin{nonce: randomToken(), verifier: randomToken(), expires: srv.now().Add(oidcLoginTimeout)}
+	p.mu.Lock()
+	for s, l := range p.pending {
+		if srv.now().After(l.expires) {
+			delete(p.pending, s)
+		}
+	}
+	p.pending[state] = login
+	p.mu.Unlock()
+
+	challenge := sha256.Sum256([]byte(login.verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.settings.ClientID},
+		"redirect_uri":          {p.settings.RedirectURL},
+		"scope":                 {strings.Join(p.settings.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {login.nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	target := meta.AuthorizationEndpoint
+	if strings.Contains(target, "?") {
+		target += "&" + q.Encode()
+	} else {
+		target += "?" + q.Encode()
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// oidcCallbackHandler serves GET /ui/oidc/callback, where the provider
+// sends the browser back with an authorization code.
+func (srv *Server) oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	rlog := srv.requestLogger(r)
+	p := srv.currentOIDC()
+	if p == nil {
+		http.NotFound(w, r)
+		return
+	}
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		rlog.Warn("OIDC sign-in refused by the provider", "error", e, "description", q.Get("error_description"))
+		writeError(w, CodeUnauthorized, "sign-in failed: "+e)
+		return
+	}
+
+	p.mu.Lock()
+	login := p.pending[q.Get("state")]
+	delete(p.pending, q.Get("state"))
+	p.mu.Unlock()
+	if login == nil || srv.now().After(login.expires) {
+		writeError(w, CodeInvalidRequest, "sign-in expired or was already used, try again")
+		return
+	}
+
+	idToken, err := p.exchange(q.Get("code"), login.verifier)
+	if err == nil {
+		var claims map[string]any
+		if claims, err = p.verify(srv, idToken, login.nonce); err == nil {
+			var s *session
+			if s, err = p.sessionFor(srv, claims); err == nil {
+				srv.startSession(w, r, s)
+				rlog.Info("Dashboard login through OIDC", "user", cmp.Or(s.user, s.remote.Name))
+				http.Redirect(w, r, "/ui/", http.StatusFound)
+				return
+			}
+		}
+	}
+	rlog.Warn("OIDC sign-in failed", "error", err)
+	writeError(w, CodeUnauthorized, "sign-in failed: "+err.Error())
+}
+
+// exchange trades an authorization code for an ID token.
+func (p *oidcProvider) exchange(code, verifier string) (string, error) {
+	meta, err := p.metadata()
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.settings.RedirectURL},
+		"code_verifier": {verifier},
+		"client_id":     {p.settings.ClientID},
+	}
+	req, _ := http.NewRequest(http.MethodPost, meta.TokenEndpoint, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if p.settings.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.settings.ClientID), url.QueryEscape(p.settings.ClientSecret))
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("token request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		IDToken     string `json:"id_token"`
+		Error       string `json:"error"`
+		Description string `json:"error_description"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+	if resp.StatusCode != http.StatusOK || result.IDToken == "" {
+		return "", fmt.Errorf("token request: %s %s %s", resp.Status, result.Error, result.Description)
+	}
+	return result.IDToken, nil
+}
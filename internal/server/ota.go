@@ -0,0 +1,300 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	regstore "github.com/smileyfaceskobochka/trashbin-daemon/internal/registry"
+)
+
+const maxFirmwareSize = 16 << 20
+
+// Firmware is one uploaded image. The newest upload for a model is the one
+// offered to its ESPs.
+type Firmware struct {
+	Model      string    `json:"model"`
+	Version    string    `json:"version"`
+	SHA256     string    `json:"sha256"`
+	Size       int64     `json:"size"`
+	UploadedAt time.Time `json:"uploaded_at"`
+}
+
+// otaState holds the Server state kept in ota.go.
+type otaState struct {
+	otaMu    sync.Mutex
+	firmware map[string][]*Firmware // by model, oldest first
+	otaDir   string
+}
+
+var otaNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+func (f *Firmware) path(srv *Server) string {
+	return filepath.Join(srv.otaDir, f.Model, f.Version+".bin")
+}
+
+func (srv *Server) loadOTA() {
+	if srv.otaDir == "" {
+		return
+	}
+
+	data, err := os.ReadFile(filepath.Join(srv.otaDir, "manifest.json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		srv.fatal("ota", "Failed to load firmware manifest", "error", err)
+	}
+
+	var list []*Firmware
+	if err := json.Unmarshal(data, &list); err != nil {
+		srv.fatal("ota", "Failed to parse firmware manifest", "dir", srv.otaDir, "error", err)
+	}
+
+	srv.otaMu.Lock()
+	defer srv.otaMu.Unlock()
+	for _, f := range list {
+		if _, err := os.Stat(f.path(srv)); err != nil {
+			srv.logger("ota").Warn("Skipping missing firmware image", "model", f.Model, "version", f.Version, "error", err)
+			continue
+		}
+		srv.firmware[f.Model] = append(srv.firmware[f.Model], f)
+	}
+	srv.logger("ota").Info("Firmware loaded", "images", len(list), "dir", srv.otaDir)
+}
+
+// saveOTA must be called with otaMu held.
+func (srv *Server) saveOTA() {
+	data, err := json.MarshalIndent(srv.sortedFirmware(), "", "  ")
+	if err != nil {
+		srv.logger("ota").Error("Failed to encode firmware manifest", "error", err)
+		return
+	}
+	if err := regstore.WriteFileAtomic(filepath.Join(srv.otaDir, "manifest.json"), data); err != nil {
+		srv.logger("ota").Error("Failed to save firmware manifest", "error", err)
+	}
+}
+
+// sortedFirmware must be called with otaMu held.
+func (srv *Server) sortedFirmware() []*Firmware {
+	list := make([]*Firmware, 0)
+	for _, versions := range srv.firmware {
+		list = append(list, versions...)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Model != list[j].Model {
+			return list[i].Model < list[j].Model
+		}
+		return list[i].UploadedAt.Before(list[j].UploadedAt)
+	})
+	return list
+}
+
+func (srv *Server) findFirmware(model, version string) *Firmware {
+	srv.otaMu.Lock()
+	defer srv.otaMu.Unlock()
+
+	versions := srv.firmware[model]
+	if version == "" && len(versions) > 0 {
+		return versions[len(versions)-1]
+	}
+	for _, f := range versions {
+		if f.Version == version {
+			return f
+		}
+	}
+	return nil
+}
+
+// otaOffer describes the update announced to an ESP in its poll response,
+// or nil when it already runs the latest image for its model. Must be called
+// with mu held.
+func (srv *Server) otaOffer(esp *ESP) map[string]interface{} {
+	if esp.Telemetry == nil || esp.Telemetry.Model == "" || !esp.supports(featureOTA) {
+		return nil
+	}
+	latest := srv.findFirmware(esp.Telemetry.Model, "")
+	if latest == nil || latest.Version == esp.Telemetry.Firmware {
+		return nil
+	}
+	return map[string]interface{}{
+		"version": latest.Version,
+		"url":     "/ota/firmware?id=" + url.QueryEscape(esp.ID) + "&version=" + url.QueryEscape(latest.Version),
+		"sha256":  latest.SHA256,
+		"size":    latest.Size,
+	}
+}
+
+func (srv *Server) otaHandler(w http.ResponseWriter, r *http.Request) {
+	rlog := srv.requestLogger(r)
+
+	if srv.otaDir == "" {
+		writeError(w, CodeUnavailable, "OTA storage not configured (start the server with -ota-dir)")
+		return
+	}
+
+	q := r.URL.Query()
+	model, version := q.Get("model"), q.Get("version")
+
+	switch r.Method {
+	case http.MethodGet:
+		srv.otaMu.Lock()
+		list := srv.sortedFirmware()
+		srv.otaMu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string][]*Firmware{"firmware": list})
+
+	case http.MethodPost:
+		if !otaNamePattern.MatchString(model) || !otaNamePattern.MatchString(version) {
+			writeError(w, CodeInvalidRequest, "model and version must be letters, digits, '.', '_' or '-'")
+			return
+		}
+		if srv.findFirmware(model, version) != nil {
+			writeError(w, CodeConflict, fmt.Sprintf("firmware %s %s already exists", model, version))
+			return
+		}
+
+		f := &Firmware{Model: model, Version: version, UploadedAt: srv.now()}
+		if err := os.MkdirAll(filepath.Dir(f.path(srv)), 0o755); err != nil {
+			rlog.Error("Failed to create firmware directory", "error", err)
+			writeError(w, CodeInternal, "failed to store firmware")
+			return
+		}
+		tmp, err := os.CreateTemp(filepath.Dir(f.path(srv)), ".upload-*")
+		if err != nil {
+			rlog.Error("Failed to create firmware file", "error", err)
+			writeError(w, CodeInternal, "failed to store firmware")
+			return
+		}
+		defer os.Remove(tmp.Name())
+
+		hash := sha256.New()
+		size, err := io.Copy(io.MultiWriter(tmp, hash), http.MaxBytesReader(w, r.Body, maxFirmwareSize))
+		tmp.Close()
+		if err != nil {
+			rlog.Warn("Firmware upload failed", "model", model, "version", version, "error", err)
+			writeError(w, CodeInvalidRequest, fmt.Sprintf("upload failed: %v", err))
+			return
+		}
+		if size == 0 {
+			writeError(w, CodeInvalidRequest, "empty firmware image")
+			return
+		}
+		f.Size = size
+		f.SHA256 = hex.EncodeToString(hash.Sum(nil))
+		if want := q.Get("sha256"); want != "" && !strings.EqualFold(want, f.SHA256) {
+			rlog.Warn("Firmware checksum mismatch", "model", model, "version", version, "expected", want, "got", f.SHA256)
+			writeError(w, CodeInvalidRequest, fmt.Sprintf("checksum mismatch: got %s", f.SHA256))
+			return
+		}
+		if err := os.Rename(tmp.Name(), f.path(srv)); err != nil {
+			rlog.Error("Failed to store firmware", "error", err)
+			writeError(w, CodeInternal, "failed to store firmware")
+			return
+		}
+
+		srv.otaMu.Lock()
+		srv.firmware[model] = append(srv.firmware[model], f)
+		srv.saveOTA()
+		srv.otaMu.Unlock()
+
+		rlog.Info("Firmware uploaded", "model", model, "version", version, "size", size, "sha256", f.SHA256)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(f)
+
+	case http.MethodDelete:
+		srv.otaMu.Lock()
+		var removed *Firmware
+		versions := srv.firmware[model]
+		for i, f := range versions {
+			if f.Version == version {
+				removed = f
+				srv.firmware[model] = append(versions[:i:i], versions[i+1:]...)
+				break
+			}
+		}
+		if removed != nil {
+			if len(srv.firmware[model]) == 0 {
+				delete(srv.firmware, model)
+			}
+			srv.saveOTA()
+		}
+		srv.otaMu.Unlock()
+
+		if removed == nil {
+			writeError(w, CodeNotFound, "firmware not found")
+			return
+		}
+		if err := os.Remove(removed.path(srv)); err != nil {
+			rlog.Warn("Failed to delete firmware image", "error", err)
+		}
+		rlog.Info("Firmware removed", "model", model, "version", version)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "removed", "model": model, "version": version})
+
+	default:
+		writeError(w, CodeMethodNotAllowed, "only GET, POST or DELETE allowed")
+	}
+}
+
+// firmwareHandler serves an image to an ESP. The model is the one the ESP
+// reported in its telemetry unless given explicitly; the version defaults
+// to the latest. Range requests let devices resume interrupted downloads.
+func (srv *Server) firmwareHandler(w http.ResponseWriter, r *http.Request) {
+	rlog := srv.requestLogger(r)
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, CodeMethodNotAllowed, "only GET allowed")
+		return
+	}
+
+	q := r.URL.Query()
+	id, model := espID(r), q.Get("model")
+	if model == "" {
+		srv.mu.Lock()
+		if esp, exists := srv.espMap[id]; exists && esp.Telemetry != nil {
+			model = esp.Telemetry.Model
+		}
+		srv.mu.Unlock()
+	}
+	if model == "" {
+		writeError(w, CodeInvalidRequest, "unknown hardware model (report it with model= or pass ?model=)")
+		return
+	}
+
+	f := srv.findFirmware(model, q.Get("version"))
+	if f == nil {
+		writeError(w, CodeNotFound, "firmware not found")
+		return
+	}
+	file, err := os.Open(f.path(srv))
+	if err != nil {
+		rlog.Error("Failed to open firmware image", "model", f.Model, "version", f.Version, "error", err)
+		writeError(w, CodeInternal, "firmware unavailable")
+		return
+	}
+	defer file.Close()
+
+	if r.Header.Get("Range") == "" {
+		rlog.Info("Firmware download", "esp_id", id, "model", f.Model, "version", f.Version)
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("ETag", `"`+f.SHA256+`"`)
+	w.Header().Set("X-Firmware-Version", f.Version)
+	w.Header().Set("X-Firmware-SHA256", f.SHA256)
+	http.ServeContent(w, r, f.Version+".bin", f.UploadedAt, file)
+}
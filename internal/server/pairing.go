@@ -0,0 +1,153 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"time"
+)
+
+// Pairing stops anyone who knows the server URL from adding devices. With
+// -pairing approve, an ESP registering an ID the server doesn't know is
+// held as pending: it may poll, but no command is sent to it until an admin
+// approves it. The register response carries a six-digit code for the
+// firmware to print on its serial console; with -pairing code the admin
+// has to enter it, which proves they are looking at the device. IDs with
+// their own token or secret were provisioned by an admin and skip the
+// wait. A device still pending after pendingTimeout is removed.
+
+type pairingMode string
+
+const (
+	pairingOff     pairingMode = "off"
+	pairingApprove pairingMode = "approve" // an admin approves new devices
+	pairingCode    pairingMode = "code"
+)
+
+const pendingTimeout = 24 * time.Hour
+
+var (
+	errPending     = errors.New("device is waiting for approval")
+	errPairingCode = errors.New("wrong pairing code")
+)
+
+// pairingState holds the Server state kept in pairing.go.
+type pairingState struct {
+	pairing pairingMode // guarded by mu
+}
+
+func parsePairingMode(s string) (pairingMode, error) {
+	switch m := pairingMode(s); m {
+	case pairingOff, pairingApprove, pairingCode:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown pairing mode %q (use off, approve or code)", s)
+}
+
+// Pairing is a device waiting for approval. Code is never returned by the
+// API, only to the device itself.
+type Pairing struct {
+	Since time.Time `json:"since"`
+	Code  string    `json:"code"`
+}
+
+// holdForPairing makes a newly registered device wait for approval unless
+// pairing is off or the ID was provisioned. Must be called with mu held.
+func (srv *Server) holdForPairing(esp *ESP) {
+	if srv.pairing == pairingOff || srv.provisioned(esp.ID) {
+		return
+	}
+	n, _ := rand.Int(rand.Reader, big.NewInt(1_000_000))
+	esp.Pairing = &Pairing{Since: srv.now(), Code: fmt.Sprintf("%06d", n)}
+	srv.logger("pairing").Warn("New ESP waiting for approval", "esp_id", esp.ID, "remote_addr", esp.RemoteAddr)
+	srv.recordEvent(Event{Type: EventPairing, ESPID: esp.ID, Detail: "pending, from " + esp.RemoteAddr})
+}
+
+// provisioned reports whether an admin gave the ID its own credentials.
+func (srv *Server) provisioned(id string) bool {
+	if _, exists := srv.currentAuth().ESPTokens[id]; exists {
+		return true
+	}
+	_, exists := srv.deviceSecret(id)
+	return exists
+}
+
+// checkPairing refuses commands for a device that isn't approved yet.
+func (srv *Server) checkPairing(esp *ESP) error {
+	if esp.Pairing == nil {
+		return nil
+	}
+	return fmt.Errorf("%w: '%s' registered %s ago (approve it with 'wake-on-demand approve %s')",
+		errPending, esp.ID, srv.now().Sub(esp.Pairing.Since).Round(time.Second), esp.ID)
+}
+
+// pairingFields is added to register and poll responses of a pending
+// device, so firmware can show the code again after a reboot.
+func pairingFields(esp *ESP, resp map[string]interface{}) {
+	if esp.Pairing != nil {
+		resp["pairing"] = "pending"
+		resp["pairing_code"] = esp.Pairing.Code
+	}
+}
+
+// expirePairing removes a device nobody approved in time, and reports
+// whether it did. Must be called with mu held.
+func (srv *Server) expirePairing(esp *ESP, now time.Time) bool {
+	if esp.Pairing == nil || now.Sub(esp.Pairing.Since) < pendingTimeout {
+		return false
+	}
+	srv.logger("pairing").Info("Pending ESP removed", "esp_id", esp.ID, "since", esp.Pairing.Since.Format(time.RFC3339))
+	srv.removeESP(esp, "pairing", "not approved within "+pendingTimeout.String())
+	return true
+}
+
+// approveHandler serves POST /approve.
+func (srv *Server) approveHandler(w http.ResponseWriter, r *http.Request) {
+	rlog := srv.requestLogger(r)
+
+	var data struct {
+		ID   string `json:"id"`
+		Code string `json:"code"`
+	}
+	if err := decodeJSON(w, r, &data); err != nil {
+		rlog.Warn("Invalid JSON", "error", err)
+		return
+	}
+	data.ID = srv.resolveAlias(data.ID)
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	esp, exists := srv.espMap[data.ID]
+	if !exists {
+		rlog.Warn("ESP not found", "esp_id", data.ID)
+		writeError(w, CodeESPNotFound, "ESP not registered")
+		return
+	}
+	if esp.Pairing == nil {
+		writeError(w, CodeConflict, fmt.Sprintf("'%s' is not waiting for approval", esp.ID))
+		return
+	}
+	// A code is checked whenever one is given, and needed in code mode
+	if data.Code != "" || srv.pairing == pairingCode {
+		if data.Code == "" {
+			writeError(w, CodeInvalidRequest, "code required: enter the pairing code the device printed")
+			return
+		}
+		if !tokenMatches(data.Code, esp.Pairing.Code) {
+			rlog.Warn("Wrong pairing code", "esp_id", esp.ID)
+			writeError(w, CodeWrongPairingCode, errPairingCode.Error())
+			return
+		}
+	}
+	esp.Pairing = nil
+	actor := srv.requestActor(r)
+	rlog.Info("ESP approved", "esp_id", esp.ID)
+	srv.recordEvent(Event{Type: EventPairing, ESPID: esp.ID, Actor: actor, Detail: "approved"})
+	srv.saveRegistry()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "approved", "id": esp.ID})
+}
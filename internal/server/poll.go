@@ -0,0 +1,106 @@
+package server
+
+import (
+	"cmp"
+	"fmt"
+	"time"
+)
+
+// Poll hints: every /command response carries next_poll_ms, how long the
+// ESP should wait before it polls again. Devices poll at the slow interval
+// while nothing is going on and at the fast one for a while after a
+// command was queued for them, and while their target is booting or
+// shutting down. The hint is 0 while more commands wait, or the time left
+// when the next one is held for the device's cooldown. It never exceeds
+// half the device's offline timeout, so one late poll doesn't take the
+// device offline; the adaptive timeout grows as the device polls slower.
+// Firmware that ignores the hint keeps its own interval.
+
+const (
+	defaultPollInterval = 5 * time.Second
+	defaultFastPoll     = time.Second
+	defaultFastPollFor  = time.Minute
+	minPollHint         = 100 * time.Millisecond
+	maxPollHint         = 24 * time.Hour
+)
+
+// PollSettings sets the hints; Devices overrides the intervals by ESP ID
+// or alias.
+type PollSettings struct {
+	Interval time.Duration `yaml:"interval"` // default 5s
+	Fast     time.Duration `yaml:"fast"`     // default 1s
+	// FastFor is how long polls stay fast after a command is queued
+	FastFor time.Duration           `yaml:"fast_for"`
+	Devices map[string]PollInterval `yaml:"devices"`
+}
+
+type PollInterval struct {
+	Interval time.Duration `yaml:"interval"`
+	Fast     time.Duration `yaml:"fast"`
+}
+
+func validatePoll(p PollSettings) []error {
+	var errs []error
+	check := func(name string, d time.Duration) {
+		if d != 0 && (d < minPollHint || d > maxPollHint) {
+			errs = append(errs, fmt.Errorf("poll.%s: must be between %s and %s, got %v", name, minPollHint, maxPollHint, d))
+		}
+	}
+	check("interval", p.Interval)
+	check("fast", p.Fast)
+	if p.FastFor < 0 {
+		errs = append(errs, fmt.Errorf("poll.fast_for: must be positive, got %v", p.FastFor))
+	}
+	for name, d := range p.Devices {
+		check("devices."+name+".interval", d.Interval)
+		check("devices."+name+".fast", d.Fast)
+	}
+	return errs
+}
+
+// pollIntervals are the slow and fast interval for the device.
+func (srv *Server) pollIntervals(id string) (slow, fast time.Duration) {
+	p := srv.config.Poll
+	slow, fast = cmp.Or(p.Interval, defaultPollInterval), cmp.Or(p.Fast, defaultFastPoll)
+	for name, d := range p.Devices {
+		if alias, ok := srv.config.Aliases[name]; ok {
+			name = alias
+		}
+		if srv.resolveAlias(name) == id {
+			slow, fast = cmp.Or(d.Interval, slow), cmp.Or(d.Fast, fast)
+			break
+		}
+	}
+	return slow, min(fast, slow)
+}
+
+// hurryPolls makes the device poll fast for a while, as more commands may
+// follow the one just queued. Must be called with mu held.
+func (srv *Server) hurryPolls(esp *ESP) {
+	esp.fastPollUntil = srv.now().Add(cmp.Or(srv.config.Poll.FastFor, defaultFastPollFor))
+}
+
+// nextPoll is the next_poll_ms hint for a poll response. Must be called
+// with mu held, after the command for this poll was dequeued.
+func (srv *Server) nextPoll(esp *ESP, now time.Time) time.Duration {
+	timeout, _ := esp.offlineTimeout(srv)
+	if len(esp.Queue) > 0 {
+		// A held command goes when the cooldown is over
+		if srv.queueHeld(esp) {
+			return min(max(esp.cooldownLeft(srv, now), minPollHint), timeout/2)
+		}
+		return 0
+	}
+	slow, fast := srv.pollIntervals(esp.ID)
+	next := slow
+	if now.Before(esp.fastPollUntil) || esp.powerInTransition() {
+		next = fast
+	}
+	return min(next, timeout/2)
+}
+
+// powerInTransition reports whether the target is booting or shutting
+// down. Must be called with mu held.
+func (e *ESP) powerInTransition() bool {
+	return e.Power != nil && (e.Power.State == PowerBooting || e.Power.State == PowerShuttingDown)
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+type PowerState string
+
+const (
+	PowerUnknown      PowerState = "unknown"
+	PowerOff          PowerState = "off"
+	PowerBooting      PowerState = "booting"
+	PowerUp           PowerState = "up"
+	PowerShuttingDown PowerState = "shutting_down"
+)
+
+const (
+	// powerTransitionTimeout is how long booting or shutting_down is kept
+	// while the probe still disagrees.
+	powerTransitionTimeout = 5 * time.Minute
+	// transitionProbeInterval is how often targets are probed while they
+	// boot or shut down.
+	transitionProbeInterval = 5 * time.Second
+)
+
+// errAlreadyUp rejects 'on' for a target that is already up or booting, so
+// the pulse doesn't turn it off again.
+var errAlreadyUp = errors.New("target is already up")
+
+// PowerInfo is the power state of the machine behind a device, derived from
+// target probes, the ESP's power sensor and the commands sent to it. It is
+// not persisted.
+type PowerInfo struct {
+	State  PowerState `json:"state"`
+	Since  time.Time  `json:"since"`
+	Source string     `json:"source,omitempty"` // probe, sensor or command
+	Sensor bool       `json:"sensor"`
+}
+
+// PowerReport is the last up/off observation of a target, from a probe,
+// the power sensor or a status result. Unlike PowerInfo it is persisted,
+// so it survives restarts and the ESP going offline.
+type PowerReport struct {
+	State  PowerState `json:"state"` // up or off
+	At     time.Time  `json:"at"`
+	Source string     `json:"source"`
+}
+
+// powerTracked reports whether anything can confirm the target's state.
+// Must be called with mu held.
+func (e *ESP) powerTracked() bool {
+	return e.Target != nil || e.Power != nil && e.Power.Sensor
+}
+
+func (e *ESP) powerState() PowerState {
+	if e.Power == nil {
+		return PowerUnknown
+	}
+	return e.Power.State
+}
+
+// setPower moves the state machine and records the transition. Must be
+// called with mu held.
+func (e *ESP) setPower(srv *Server, state PowerState, source string) {
+	if e.Power == nil {
+		e.Power = &PowerInfo{State: PowerUnknown}
+	}
+	prev := e.Power.State
+	if prev == state {
+		return
+	}
+	e.Power.State = state
+	e.Power.Since = srv.now()
+	e.Power.Source = source
+	srv.logger("power").Info("Power state changed", "esp_id", e.ID, "from", prev, "to", state, "source", source)
+	srv.recordEvent(Event{Type: EventPower, ESPID: e.ID, Detail: fmt.Sprintf("%s → %s (%s)", prev, state, source)})
+	if prev == PowerBooting && state == PowerUp {
+		srv.startWakeHooks(e, "wake")
+	}
+}
+
+// transitioning reports whether the target is booting or shutting down and
+// still within the transition timeout.
+func (e *ESP) transitioning(srv *Server) bool {
+	switch e.powerState() {
+	case PowerBooting, PowerShuttingDown:
+		return srv.now().Sub(e.Power.Since) < powerTransitionTimeout
+	}
+	return false
+}
+
+// powerCommand applies a command that was just sent. Must be called with mu held.
+func (e *ESP) powerCommand(srv *Server, cmd ESPCommand) {
+	if !e.powerTracked() {
+		return
+	}
+	switch cmd {
+	case CommandPulse:
+		if e.powerState() != PowerUp {
+			e.setPower(srv, PowerBooting, "command")
+		}
+	case CommandForce, CommandSoftOff:
+		if e.powerState() != PowerOff {
+			e.setPower(srv, PowerShuttingDown, "command")
+		}
+	}
+}
+
+// powerObserved applies a probe result or sensor reading. A target that is
+// still booting or shutting down keeps that state until the observation
+// agrees or the transition times out. Must be called with mu held.
+func (e *ESP) powerObserved(srv *Server, up bool, source string) {
+	observed := PowerOff
+	if up {
+		observed = PowerUp
+	}
+	e.LastPower = &PowerReport{State: observed, At: srv.now(), Source: source}
+
+	switch {
+	case up && e.powerState() == PowerShuttingDown && e.transitioning(srv):
+	case up:
+		e.setPower(srv, PowerUp, source)
+	case e.powerState() == PowerBooting && e.transitioning(srv):
+	default:
+		e.setPower(srv, PowerOff, source)
+	}
+}
+
+// expirePower forgets sensor-only state that can no longer be trusted: a
+// transition the sensor never confirmed, or any state once the ESP is
+// offline. Targets with a probe are corrected by the next probe instead.
+// Must be called with mu held.
+func (e *ESP) expirePower(srv *Server) {
+	if e.Target != nil || e.Power == nil || e.powerState() == PowerUnknown {
+		return
+	}
+	switch e.powerState() {
+	case PowerBooting, PowerShuttingDown:
+		if !e.transitioning(srv) {
+			e.setPower(srv, PowerUnknown, "timeout")
+			return
+		}
+	}
+	if !e.Online {
+		e.setPower(srv, PowerUnknown, "offline")
+	}
+}
+
+// powerSensor handles the ESP's power sensor reading ("on" or "off") sent
+// with polls and registrations. Must be called with mu held.
+func (e *ESP) powerSensor(srv *Server, value string) bool {
+	var on bool
+	switch value {
+	case "on", "1", "true":
+		on = true
+	case "off", "0", "false":
+	default:
+		return false
+	}
+	if e.Power == nil {
+		e.Power = &PowerInfo{State: PowerUnknown}
+	}
+	e.Power.Sensor = true
+	e.powerObserved(srv, on, "sensor")
+	return true
+}
+
+// checkAlreadyUp refuses a pulse when the target is known to be up or
+// booting, unless the caller forces it. Must be called with mu held.
+func checkAlreadyUp(esp *ESP, cmd ESPCommand, opts commandOptions) error {
+	if cmd != CommandPulse || opts.Force || !esp.powerTracked() {
+		return nil
+	}
+	switch state := esp.powerState(); state {
+	case PowerUp, PowerBooting:
+		return fmt.Errorf("%w: '%s' is %s", errAlreadyUp, esp.ID, state)
+	}
+	return nil
+}
@@ -0,0 +1,364 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+type ProbeType string
+
+const (
+	ProbeICMP ProbeType = "icmp"
+	ProbeTCP  ProbeType = "tcp"
+	ProbeSSH  ProbeType = "ssh"
+)
+
+const probeTimeout = 3 * time.Second
+
+// Target is the machine an ESP controls, probed to confirm its power state.
+type Target struct {
+	Host  string    `json:"host" yaml:"host"`
+	Probe ProbeType `json:"probe" yaml:"probe"`
+	Port  int       `json:"port,omitempty" yaml:"port"`
+	// Verify re-sends 'on' until the probe sees the target up
+	Verify *WakeVerify `json:"verify,omitempty" yaml:"verify"`
+}
+
+// TargetState is the result of the last probe; it is not persisted.
+type TargetState struct {
+	Up        bool      `json:"up"`
+	CheckedAt time.Time `json:"checked_at"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// probeState holds the Server state kept in probe.go.
+type probeState struct {
+	probeInterval time.Duration
+
+	icmpSeq struct {
+		sync.Mutex
+		n int
+	}
+}
+
+func (t *Target) Validate() error {
+	if t.Host == "" {
+		return errors.New("host cannot be empty")
+	}
+	switch t.Probe {
+	case ProbeICMP:
+	case ProbeTCP:
+		if t.Port < 1 || t.Port > 65535 {
+			return fmt.Errorf("tcp probe needs a port, got %d", t.Port)
+		}
+	case ProbeSSH:
+		if t.Port < 0 || t.Port > 65535 {
+			return fmt.Errorf("invalid port %d", t.Port)
+		}
+	default:
+		return fmt.Errorf("unknown probe type %q (use icmp, tcp or ssh)", t.Probe)
+	}
+	if t.Verify != nil {
+		return t.Verify.Validate()
+	}
+	return nil
+}
+
+func (t *Target) String() string {
+	switch t.Probe {
+	case ProbeTCP, ProbeSSH:
+		if t.Port != 0 {
+			return fmt.Sprintf("%s %s:%d", t.Probe, t.Host, t.Port)
+		}
+	}
+	return fmt.Sprintf("%s %s", t.Probe, t.Host)
+}
+
+func (srv *Server) probeTarget(t Target) error {
+	switch t.Probe {
+	case ProbeICMP:
+		return srv.probeICMP(t.Host)
+	case ProbeTCP:
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(t.Host, strconv.Itoa(t.Port)), probeTimeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case ProbeSSH:
+		return probeSSH(t)
+	}
+	return fmt.Errorf("unknown probe type %q", t.Probe)
+}
+
+func probeSSH(t Target) error {
+	port := t.Port
+	if port == 0 {
+		port = 22
+	}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(t.Host, strconv.Itoa(port)), probeTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(probeTimeout))
+	banner, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("no SSH banner: %w", err)
+	}
+	if !strings.HasPrefix(banner, "SSH-") {
+		return fmt.Errorf("unexpected banner %q", strings.TrimSpace(banner))
+	}
+	return nil
+}
+
+func (srv *Server) probeICMP(host string) error {
+	addr, err := net.ResolveIPAddr("ip4", host)
+	if err != nil {
+		return err
+	}
+
+	// Unprivileged ICMP sockets need net.ipv4.ping_group_range; fall back to raw
+	network, dst := "udp4", net.Addr(&net.UDPAddr{IP: addr.IP})
+	conn, err := icmp.ListenPacket(network, "0.0.0.0")
+	if err != nil {
+		network, dst = "ip4:icmp", addr
+		conn, err = icmp.ListenPacket(network, "0.0.0.0")
+		if err != nil {
+			return fmt.Errorf("icmp unavailable (needs ping_group_range or CAP_NET_RAW): %w", err)
+		}
+	}
+	defer conn.Close()
+
+	srv.icmpSeq.Lock()
+	srv.icmpSeq.n++
+	seq := srv.icmpSeq.n & 0xFFFF
+	srv.icmpSeq.Unlock()
+
+	msg := icmp.Message{
+		Type: ipv4.ICMPTypeEcho,
+		Body: &icmp.Echo{ID: os.Getpid() & 0xFFFF, Seq: seq, Data: []byte("wake-on-demand")},
+	}
+	packet, err := msg.Marshal(nil)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.WriteTo(packet, dst); err != nil {
+		return err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(probeTimeout))
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		reply, err := icmp.ParseMessage(1, buf[:n])
+		if err != nil || reply.Type != ipv4.ICMPTypeEchoReply {
+			continue
+		}
+		echo, ok := reply.Body.(*icmp.Echo)
+		if !ok || echo.Seq != seq || !sameHost(peer, addr.IP) {
+			continue
+		}
+		return nil
+	}
+}
+
+func sameHost(addr net.Addr, ip net.IP) bool {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP.Equal(ip)
+	case *net.IPAddr:
+		return a.IP.Equal(ip)
+	}
+	return false
+}
+
+// runProber probes every target each probeInterval, and targets that are
+// booting or shutting down every transitionProbeInterval so waiting clients
+// see them come up quickly.
+func (srv *Server) runProber() {
+	tick := min(srv.probeInterval, transitionProbeInterval)
+	every := max(1, int(srv.probeInterval/tick))
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	for n := 0; ; n++ {
+		srv.probeAll(n%every == 0)
+		<-ticker.C
+	}
+}
+
+// probeAll probes all targets, or only transitioning ones unless all is set.
+func (srv *Server) probeAll(all bool) {
+	type job struct {
+		id     string
+		target Target
+	}
+
+	srv.mu.Lock()
+	jobs := make([]job, 0)
+	drivers := make(map[string]powerDriver)
+	for id, esp := range srv.espMap {
+		if esp.Target != nil && (all || esp.transitioning(srv)) {
+			jobs = append(jobs, job{id: id, target: *esp.Target})
+		}
+		if drv, ok := srv.powerDriverFor(esp); ok && (all || esp.transitioning(srv)) {
+			drivers[id] = drv
+		}
+	}
+	srv.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for id, drv := range drivers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, s := srv.startSpan(context.Background(), "poll driver", spanClient, "esp_id", id)
+			srv.pollDriver(id, drv)
+			s.finish(srv)
+		}()
+	}
+	for _, j := range jobs {
+		wg.Add(1)
+		go func(j job) {
+			defer wg.Done()
+			_, s := srv.startSpan(context.Background(), "probe", spanClient, "esp_id", j.id, "probe", j.target.String())
+			err := srv.probeTarget(j.target)
+			s.set("probe.up", err == nil)
+			s.fail(err)
+			s.finish(srv)
+			srv.recordProbe(j.id, err)
+		}(j)
+	}
+	wg.Wait()
+}
+
+func (srv *Server) recordProbe(id string, err error) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	esp, exists := srv.espMap[id]
+	if !exists || esp.Target == nil {
+		return
+	}
+
+	state := &TargetState{Up: err == nil, CheckedAt: srv.now()}
+	if err != nil {
+		state.Error = err.Error()
+	}
+
+	prev := esp.TargetState
+	esp.TargetState = state
+	esp.powerObserved(srv, state.Up, "probe")
+	srv.recordUptime(id, state.Up)
+
+	plog := srv.logger("probe").With("esp_id", id, "probe", esp.Target.String())
+	switch {
+	case prev == nil:
+		plog.Info("Target "+UpDown(state.Up), "error", state.Error)
+	case prev.Up && !state.Up:
+		plog.Warn("Target went down", "error", state.Error)
+		srv.recordEvent(Event{Type: EventTargetDown, ESPID: id, Detail: state.Error})
+	case !prev.Up && state.Up:
+		plog.Info("Target is up")
+		srv.recordEvent(Event{Type: EventTargetUp, ESPID: id})
+	}
+}
+
+func UpDown(up bool) string {
+	if up {
+		return "up"
+	}
+	return "down"
+}
+
+// configTarget returns the target configured for the ESP in the config file.
+func (srv *Server) configTarget(id string) *Target {
+	return srv.configTargetIn(srv.config, id)
+}
+
+func (srv *Server) configTargetIn(c *Config, id string) *Target {
+	for name, target := range c.Targets {
+		if alias, ok := c.Aliases[name]; ok {
+			name = alias
+		}
+		if srv.resolveAlias(name) == id {
+			t := target
+			return &t
+		}
+	}
+	return nil
+}
+
+func (srv *Server) targetHandler(w http.ResponseWriter, r *http.Request) {
+	rlog := srv.requestLogger(r)
+
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		rlog.Warn("Method not allowed", "method", r.Method)
+		writeError(w, CodeMethodNotAllowed, "only POST or DELETE allowed")
+		return
+	}
+
+	var data struct {
+		ID string `json:"id"`
+		Target
+	}
+	if err := decodeJSON(w, r, &data); err != nil {
+		rlog.Warn("Invalid JSON", "error", err)
+		return
+	}
+	data.ID = srv.resolveAlias(data.ID)
+
+	if r.Method == http.MethodPost {
+		if err := data.Target.Validate(); err != nil {
+			writeError(w, CodeInvalidRequest, fmt.Sprintf("invalid target: %v", err))
+			return
+		}
+	}
+
+	srv.mu.Lock()
+	esp, exists := srv.espMap[data.ID]
+	if !exists {
+		srv.mu.Unlock()
+		rlog.Warn("ESP not found", "esp_id", data.ID)
+		writeError(w, CodeESPNotFound, "ESP not registered")
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		esp.Target = nil
+		esp.TargetState = nil
+		srv.endUptime(esp.ID)
+		rlog.Info("Target removed", "esp_id", data.ID)
+	} else {
+		t := data.Target
+		esp.Target = &t
+		esp.TargetState = nil
+		rlog.Info("Target set", "esp_id", data.ID, "probe", esp.Target.String())
+	}
+	srv.saveRegistry()
+	srv.mu.Unlock()
+
+	if r.Method == http.MethodPost {
+		go srv.recordProbe(data.ID, srv.probeTarget(data.Target))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok", "id": data.ID})
+}
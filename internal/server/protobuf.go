@@ -0,0 +1,151 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// A minimal protobuf codec for the messages in proto/wod.proto: varints,
+// strings, bytes and nested messages, which is all they use.
+
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+// protoWriter encodes fields in proto3 style, leaving out default values.
+type protoWriter struct {
+	buf []byte
+}
+
+func (p *protoWriter) tag(field, wire int) {
+	p.buf = binary.AppendUvarint(p.buf, uint64(field)<<3|uint64(wire))
+}
+
+func (p *protoWriter) String(field int, s string) {
+	if s == "" {
+		return
+	}
+	p.Bytes(field, []byte(s))
+}
+
+func (p *protoWriter) Bytes(field int, b []byte) {
+	p.tag(field, protoBytes)
+	p.buf = binary.AppendUvarint(p.buf, uint64(len(b)))
+	p.buf = append(p.buf, b...)
+}
+
+func (p *protoWriter) Int(field int, v int64) {
+	if v == 0 {
+		return
+	}
+	p.tag(field, protoVarint)
+	p.buf = binary.AppendUvarint(p.buf, uint64(v))
+}
+
+func (p *protoWriter) Bool(field int, b bool) {
+	if b {
+		p.Int(field, 1)
+	}
+}
+
+// Time writes Unix milliseconds, leaving out zero times.
+func (p *protoWriter) Time(field int, t time.Time) {
+	if !t.IsZero() {
+		p.Int(field, t.UnixMilli())
+	}
+}
+
+// Message writes a nested message, even an empty one, so the field is
+// present.
+func (p *protoWriter) Message(field int, m *protoWriter) {
+	p.Bytes(field, m.buf)
+}
+
+type protoField struct {
+	wire   int
+	varint uint64
+	bytes  []byte
+	list   [][]byte // every bytes value, for repeated fields
+}
+
+// protoMessage is a decoded message: the last value of each field, which is
+// what proto3 uses for scalars, and every value of repeated strings.
+type protoMessage map[int]protoField
+
+func decodeProto(data []byte) (protoMessage, error) {
+	m := make(protoMessage)
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, errors.New("truncated field tag")
+		}
+		data = data[n:]
+		field, wire := int(key>>3), int(key&7)
+
+		f := protoField{wire: wire}
+		switch wire {
+		case protoVarint:
+			if f.varint, n = binary.Uvarint(data); n <= 0 {
+				return nil, fmt.Errorf("field %d: truncated varint", field)
+			}
+			data = data[n:]
+		case protoBytes:
+			size, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < size {
+				return nil, fmt.Errorf("field %d: truncated bytes", field)
+			}
+			f.bytes = data[n : n+int(size)]
+			f.list = append(m[field].list, f.bytes)
+			data = data[n+int(size):]
+		case protoFixed64, protoFixed32:
+			size := 8
+			if wire == protoFixed32 {
+				size = 4
+			}
+			if len(data) < size {
+				return nil, fmt.Errorf("field %d: truncated fixed value", field)
+			}
+			data = data[size:]
+		default:
+			return nil, fmt.Errorf("field %d: unsupported wire type %d", field, wire)
+		}
+		m[field] = f
+	}
+	return m, nil
+}
+
+func (m protoMessage) String(field int) string {
+	return string(m[field].bytes)
+}
+
+func (m protoMessage) Bytes(field int) []byte {
+	return m[field].bytes
+}
+
+// Strings returns every value of a repeated string field.
+func (m protoMessage) Strings(field int) []string {
+	list := make([]string, len(m[field].list))
+	for i, b := range m[field].list {
+		list[i] = string(b)
+	}
+	return list
+}
+
+// Has reports whether a field was sent, for proto3 optional fields.
+func (m protoMessage) Has(field int) bool {
+	_, ok := m[field]
+	return ok
+}
+
+func (m protoMessage) Int(field int) int64 {
+	return int64(m[field].varint)
+}
+
+func (m protoMessage) Bool(field int) bool {
+	return m[field].varint != 0
+}
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	minPulse = 50 * time.Millisecond
+	maxPulse = 30 * time.Second
+)
+
+var errInvalidDuration = errors.New("invalid pulse duration")
+
+// commandOptions are the per-command parameters a caller may set.
+type commandOptions struct {
+	// Duration overrides the device's pulse length for pulse and force.
+	Duration time.Duration
+	// Force sends a pulse even if the target is already up or booting.
+	Force bool
+	// TTL overrides defaultCommandTTL for queued commands.
+	TTL time.Duration
+	// QueueIfOffline queues the command for an offline ESP to pick up when
+	// it polls again, instead of refusing it.
+	QueueIfOffline bool
+	// AfterCooldown queues a power command sent during the device's
+	// cooldown until it is over, instead of refusing it.
+	AfterCooldown bool
+	// Action is the custom action to run for CommandAction.
+	Action string
+	// Override allows force-off for a protected device.
+	Override bool
+	// IgnoreMaintenance lets an admin's command through to a device in
+	// maintenance.
+	IgnoreMaintenance bool
+	// IgnoreQuota neither checks nor counts the command against quotas,
+	// for the server's own commands and an admin's override.
+	IgnoreQuota bool
+	// DryRun makes the checks and reports the delivery without sending.
+	DryRun bool
+	// Priority places a queued command in the device's queue; empty is
+	// normal.
+	Priority CommandPriority
+}
+
+func (o commandOptions) priority() CommandPriority {
+	if o.Priority == "" {
+		return PriorityNormal
+	}
+	return o.Priority
+}
+
+func (o commandOptions) ttl(srv *Server) time.Duration {
+	if o.TTL > 0 {
+		return o.TTL
+	}
+	return srv.defaultCommandTTL
+}
+
+func ValidatePulse(d time.Duration) error {
+	if d < minPulse || d > maxPulse {
+		return fmt.Errorf("%w: %v is outside %v-%v", errInvalidDuration, d, minPulse, maxPulse)
+	}
+	return nil
+}
+
+// pulseDuration returns the pulse length to send with cmd: the explicit
+// override, else the device's configured default. Zero leaves it to the
+// firmware, which is all firmware without the duration feature can do.
+// Must be called with mu held.
+func pulseDuration(esp *ESP, cmd ESPCommand, opts commandOptions) (time.Duration, error) {
+	var d time.Duration
+	switch {
+	case opts.Duration != 0:
+		if cmd != CommandPulse && cmd != CommandForce {
+			return 0, fmt.Errorf("%w: a duration only applies to on and off", errUnsupportedCommand)
+		}
+		if esp.isWoL() || esp.isDriver() {
+			return 0, fmt.Errorf("%w: %s device '%s' has no power button", errUnsupportedCommand, esp.deviceType(), esp.ID)
+		}
+		if err := ValidatePulse(opts.Duration); err != nil {
+			return 0, err
+		}
+		d = opts.Duration
+	case cmd == CommandPulse:
+		d = time.Duration(esp.PulseMS) * time.Millisecond
+	case cmd == CommandForce:
+		d = time.Duration(esp.ForceMS) * time.Millisecond
+	}
+	if d != 0 && !esp.supports(featureDuration) {
+		return 0, featureError(esp, "pulse durations")
+	}
+	return d, nil
+}
+
+// payload is the message delivered to the device for a command. seq and
+// issued_at let the device refuse a replayed or stale command: see the
+// README's command freshness section. Must be called with mu held.
+func (c *CommandRecord) payload(srv *Server) map[string]interface{} {
+	if c.Seq == 0 {
+		c.Seq = srv.nextCommandSeq()
+	}
+	msg := map[string]interface{}{
+		"command":    string(c.Command),
+		"command_id": c.ID,
+		"seq":        c.Seq,
+		"issued_at":  srv.now().Unix(),
+	}
+	if srv.commandMaxAge > 0 {
+		msg["max_age_s"] = int(srv.commandMaxAge.Seconds())
+	}
+	if c.DurationMS > 0 {
+		msg["duration_ms"] = c.DurationMS
+	}
+	if c.Action != "" {
+		msg["action"] = c.Action
+	}
+	return msg
+}
+
+func (srv *Server) pulseHandler(w http.ResponseWriter, r *http.Request) {
+	rlog := srv.requestLogger(r)
+
+	if r.Method != http.MethodPost {
+		writeError(w, CodeMethodNotAllowed, "only POST allowed")
+		return
+	}
+
+	var data struct {
+		ID      string `json:"id"`
+		PulseMS int    `json:"pulse_ms"`
+		ForceMS int    `json:"force_ms"`
+	}
+	if err := decodeJSON(w, r, &data); err != nil {
+		rlog.Warn("Invalid JSON", "error", err)
+		return
+	}
+	data.ID = srv.resolveAlias(data.ID)
+
+	// Zero resets a command to the firmware default
+	for _, ms := range []int{data.PulseMS, data.ForceMS} {
+		if ms == 0 {
+			continue
+		}
+		if err := ValidatePulse(time.Duration(ms) * time.Millisecond); err != nil {
+			writeError(w, CodeInvalidRequest, err.Error())
+			return
+		}
+	}
+
+	srv.mu.Lock()
+	esp, exists := srv.espMap[data.ID]
+	if !exists {
+		srv.mu.Unlock()
+		rlog.Warn("ESP not found", "esp_id", data.ID)
+		writeError(w, CodeESPNotFound, "ESP not registered")
+		return
+	}
+	if esp.isWoL() || esp.isDriver() {
+		srv.mu.Unlock()
+		writeError(w, CodeInvalidRequest, fmt.Sprintf("%s device '%s' has no power button", esp.deviceType(), data.ID))
+		return
+	}
+	if (data.PulseMS != 0 || data.ForceMS != 0) && !esp.supports(featureDuration) {
+		srv.mu.Unlock()
+		writeError(w, CodeUnsupportedCommand, featureError(esp, "pulse durations").Error())
+		return
+	}
+	esp.PulseMS, esp.ForceMS = data.PulseMS, data.ForceMS
+	srv.saveRegistry()
+	srv.mu.Unlock()
+
+	rlog.Info("Pulse durations set", "esp_id", data.ID, "pulse_ms", data.PulseMS, "force_ms", data.ForceMS)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "id": data.ID, "pulse_ms": data.PulseMS, "force_ms": data.ForceMS})
+}
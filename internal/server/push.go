@@ -0,0 +1,598 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	regstore "github.com/smileyfaceskobochka/trashbin-daemon/internal/registry"
+)
+
+// Web Push lets the installed dashboard tell a phone when a device goes
+// on- or offline or its machine comes up or goes down, with the page
+// closed. The browser subscribes with the server's VAPID key (RFC 8292)
+// and hands back an endpoint at its push service; each message is
+// encrypted to the subscription's keys (RFC 8291) and POSTed there. A
+// subscription only hears about the devices its user can see. Without a
+// vapid_private_key in the config a key is generated and kept in the push
+// file next to the subscriptions, since changing it invalidates them all.
+
+const (
+	pushTTL         = time.Hour
+	pushSendTimeout = 10 * time.Second
+	pushRecordSize  = 4096
+	defaultPushSub  = "https://github.com/smileyfaceskobochka/wake-on-demand"
+)
+
+type WebPushSettings struct {
+	// File keeps the subscriptions and the generated key; empty keeps them
+	// in memory
+	File string `yaml:"file"`
+	// Subject is how push services can reach whoever runs the server, a
+	// mailto: or https: URL
+	Subject string `yaml:"subject"`
+	// PrivateKey is the VAPID key as the base64url P-256 scalar that
+	// web-push tools print
+	PrivateKey string `yaml:"vapid_private_key"`
+}
+
+// PushSubscription is one browser that asked for notifications. Who it
+// belongs to is kept so each message can be checked against what they may
+// see; local users are looked up again, so revoking a grant or removing
+// the user takes effect.
+type PushSubscription struct {
+	Endpoint  string    `json:"endpoint"`
+	P256DH    string    `json:"p256dh"`
+	Auth      string    `json:"auth"`
+	Name      string    `json:"name"`
+	Role      Role      `json:"role"`
+	Namespace string    `json:"namespace,omitempty"`
+	ESPs      []string  `json:"esps,omitempty"`
+	User      bool      `json:"user,omitempty"` // Name is a local user
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type pushFile struct {
+	PrivateKey    string              `json:"vapid_private_key,omitempty"`
+	Subscriptions []*PushSubscription `json:"subscriptions"`
+}
+
+type pushMessage struct {
+	ESPID string `json:"esp_id,omitempty"`
+	Title string `json:"title"`
+	Body  string `json:"body"`
+	// Tag makes a newer message about a device replace the last one
+	Tag     string `json:"tag,omitempty"`
+	URL     string `json:"url"`
+	trigger NotifyTrigger
+	urgency string
+}
+
+// pushState holds the Server state kept in push.go.
+type pushState struct {
+	pushMu        sync.Mutex
+	pushSubs      map[string]*PushSubscription // by endpoint
+	pushPath      string
+	pushKey       *ecdsa.PrivateKey
+	pushGenerated bool // pushKey was generated and belongs in the file
+	pushSubject   string
+	pushQueue     chan pushMessage
+	pushClient    *http.Client
+}
+
+func parseVAPIDKey(s string) (*ecdsa.PrivateKey, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, err
+	}
+	return ecdsa.ParseRawPrivateKey(elliptic.P256(), raw)
+}
+
+func validateWebPush(s WebPushSettings) []error {
+	var errs []error
+	if s.Subject != "" && !strings.HasPrefix(s.Subject, "mailto:") && !strings.HasPrefix(s.Subject, "https://") {
+		errs = append(errs, fmt.Errorf("web_push.subject %q must be a mailto: or https:// URL", s.Subject))
+	}
+	if s.PrivateKey != "" {
+		if _, err := parseVAPIDKey(s.PrivateKey); err != nil {
+			errs = append(errs, fmt.Errorf("web_push.vapid_private_key: not a base64url P-256 key: %v", err))
+		}
+	}
+	return errs
+}
+
+// loadPush reads the subscriptions and settles on the VAPID key.
+func (srv *Server) loadPush(s WebPushSettings) {
+	plog := srv.logger("push")
+	if s.Subject != "" {
+		srv.pushSubject = s.Subject
+	}
+	var file pushFile
+	if srv.pushPath != "" {
+		data, err := os.ReadFile(srv.pushPath)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+		case err != nil:
+			srv.fatal("push", "Failed to load push subscriptions", "error", err)
+		default:
+			if err := json.Unmarshal(data, &file); err != nil {
+				srv.fatal("push", "Failed to parse push subscriptions", "path", srv.pushPath, "error", err)
+			}
+		}
+	}
+
+	srv.pushMu.Lock()
+	defer srv.pushMu.Unlock()
+	for _, sub := range file.Subscriptions {
+		srv.pushSubs[sub.Endpoint] = sub
+	}
+	switch {
+	case s.PrivateKey != "":
+		srv.pushKey, _ = parseVAPIDKey(s.PrivateKey)
+	case file.PrivateKey != "":
+		key, err := parseVAPIDKey(file.PrivateKey)
+		if err != nil {
+			srv.fatal("push", "Invalid VAPID key in push file", "path", srv.pushPath, "error", err)
+		}
+		srv.pushKey, srv.pushGenerated = key, true
+	default:
+		srv.pushKey, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		srv.pushGenerated = true
+		if len(srv.pushSubs) > 0 {
+			plog.Warn("VAPID key changed, dropping push subscriptions made with the old one", "count", len(srv.pushSubs))
+			clear(srv.pushSubs)
+		}
+		srv.savePush()
+	}
+	if len(srv.pushSubs) > 0 {
+		plog.Info("Push subscriptions loaded", "count", len(srv.pushSubs), "path", srv.pushPath)
+	}
+}
+
+// savePush must be called with pushMu held.
+func (srv *Server) savePush() {
+	if srv.pushPath == "" {
+		return
+	}
+	file := pushFile{Subscriptions: make([]*PushSubscription, 0, len(srv.pushSubs))}
+	if srv.pushGenerated {
+		raw, _ := srv.pushKey.Bytes()
+		file.PrivateKey = base64.RawURLEncoding.EncodeToString(raw)
+	}
+	for _, sub := range srv.pushSubs {
+		file.Subscriptions = append(file.Subscriptions, sub)
+	}
+	slices.SortFunc(file.Subscriptions, func(a, b *PushSubscription) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		srv.logger("push").Error("Failed to encode push subscriptions", "error", err)
+		return
+	}
+	if err := regstore.WriteFileAtomic(srv.pushPath, data); err != nil {
+		srv.logger("push").Error("Failed to save push subscriptions", "error", err)
+	}
+}
+
+// vapidPublicKey is the uncompressed point browsers subscribe with.
+func (srv *Server) vapidPublicKey() []byte {
+	pub, _ := srv.pushKey.PublicKey.Bytes()
+	return pub
+}
+
+// principal returns who the subscription acts for, or nil once they are
+// gone.
+func (s *PushSubscription) principal(srv *Server) *principal {
+	if !s.User {
+		return &principal{Name: s.Name, Role: s.Role, Namespace: s.Namespace, ESPs: s.ESPs}
+	}
+	srv.usersMu.Lock()
+	defer srv.usersMu.Unlock()
+	u, exists := srv.users[s.Name]
+	if !exists {
+		return nil
+	}
+	return u.principal()
+}
+
+// pushEvent turns device state changes into push messages. It is called
+// from recordEvent and must not block.
+func (srv *Server) pushEvent(e Event) {
+	srv.pushMu.Lock()
+	none := len(srv.pushSubs) == 0
+	srv.pushMu.Unlock()
+	if none || e.ESPID == "" {
+		return
+	}
+
+	name := srv.deviceName(e.ESPID)
+	m := pushMessage{ESPID: e.ESPID, Tag: "esp-" + e.ESPID, URL: "/ui/", urgency: "normal"}
+	switch e.Type {
+	case EventOnline:
+		if e.Detail == "agent" {
+			return
+		}
+		m.trigger = TriggerESPOnline
+		m.Title, m.Body = name+" is online", "The ESP is polling again."
+	case EventOffline:
+		m.trigger = TriggerESPOffline
+		m.Title, m.Body = name+" went offline", "The ESP stopped polling"
+		if e.Detail != "" {
+			m.Body += " (" + e.Detail + ")"
+		}
+		m.urgency = "high"
+	case EventPower:
+		// Detail reads "off → up (probe)"; booting and shutting down are
+		// on the way to the states worth a message
+		_, to, _ := strings.Cut(e.Detail, " → ")
+		state, source, _ := strings.Cut(to, " ")
+		switch PowerState(state) {
+		case PowerUp:
+			m.Title = name + " is up"
+		case PowerOff:
+			m.Title = name + " is off"
+		default:
+			return
+		}
+		m.trigger = TriggerPower
+		m.Body = "Power state from " + strings.Trim(source, "()") + "."
+		m.Tag = "power-" + e.ESPID
+	default:
+		return
+	}
+	select {
+	case srv.pushQueue <- m:
+	default:
+		srv.logger("push").Warn("Push queue full, dropping", "esp_id", e.ESPID)
+	}
+}
+
+func (srv *Server) runPusher() {
+	for m := range srv.pushQueue {
+		srv.pushMu.Lock()
+		subs := make([]*PushSubscription, 0, len(srv.pushSubs))
+		for _, sub := range srv.pushSubs {
+			subs = append(subs, sub)
+		}
+		srv.pushMu.Unlock()
+
+		for _, sub := range subs {
+			p := sub.principal(srv)
+			if p == nil {
+				srv.dropSubscription(sub, "user removed")
+				continue
+			}
+			if m.ESPID != "" && !p.canView(m.ESPID) {
+				continue
+			}
+			srv.deliverPush(sub, m)
+		}
+	}
+}
+
+func (srv *Server) deliverPush(sub *PushSubscription, m pushMessage) error {
+	ctx, cancel := context.WithTimeout(context.Background(), pushSendTimeout)
+	defer cancel()
+	ctx, s := srv.startSpan(ctx, "notify push", spanClient, "notify.sink", "push", "notify.trigger", string(m.trigger), "esp_id", m.ESPID)
+	defer s.finish(srv)
+	plog := srv.logger("push").With(s.logAttrs()...).With("user", sub.Name, "esp_id", m.ESPID)
+
+	err := srv.sendPush(ctx, sub, m)
+	var gone errPushGone
+	switch {
+	case errors.As(err, &gone):
+		srv.dropSubscription(sub, gone.status)
+		srv.metricNotifications.Inc("push", string(m.trigger), "gone")
+		return err
+	case err != nil:
+		s.fail(err)
+		srv.metricNotifications.Inc("push", string(m.trigger), "error")
+		plog.Error("Push failed", "error", err)
+		return err
+	}
+	srv.metricNotifications.Inc("push", string(m.trigger), "ok")
+	plog.Debug("Push sent")
+	return nil
+}
+
+func (srv *Server) dropSubscription(sub *PushSubscription, reason string) {
+	srv.pushMu.Lock()
+	defer srv.pushMu.Unlock()
+	if srv.pushSubs[sub.Endpoint] == sub {
+		delete(srv.pushSubs, sub.Endpoint)
+		srv.savePush()
+		srv.logger("push").Info("Push subscription dropped", "user", sub.Name, "reason", reason)
+	}
+}
+
+// errPushGone is a push service saying the subscription no longer exists.
+type errPushGone struct{ status string }
+
+func (e errPushGone) Error() string { return "subscription gone: " + e.status }
+
+func (srv *Server) sendPush(ctx context.Context, sub *PushSubscription, m pushMessage) error {
+	payload, _ := json.Marshal(m)
+	body, err := encryptPush(sub, payload)
+	if err != nil {
+		return err
+	}
+	auth, err := srv.vapidAuthorization(sub.Endpoint)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("TTL", fmt.Sprint(int(pushTTL.Seconds())))
+	req.Header.Set("Urgency", m.urgency)
+	if m.Tag != "" {
+		// Topic is limited to 32 URL-safe characters
+		sum := sha256.Sum256([]byte(m.Tag))
+		req.Header.Set("Topic", hex.EncodeToString(sum[:16]))
+	}
+	req.Header.Set("Authorization", auth)
+	req.Header.Set("User-Agent", "wake-on-demand/"+VERSION)
+	resp, err := srv.pushClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return errPushGone{resp.Status}
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("push service returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// vapidAuthorization signs the ES256 JWT that identifies the server to the
+// push service at endpoint.
+func (srv *Server) vapidAuthorization(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	b64 := base64.RawURLEncoding
+	header := b64.EncodeToString([]byte(`{"typ":"JWT","alg":"ES256"}`))
+	claims, _ := json.Marshal(map[string]any{
+		"aud": u.Scheme + "://" + u.Host,
+		"exp": srv.now().Add(12 * time.Hour).Unix(),
+		"sub": srv.pushSubject,
+	})
+	unsigned := header + "." + b64.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, srv.pushKey, digest[:])
+	if err != nil {
+		return "", err
+	}
+	// JWS wants the bare 32-byte r and s, not ASN.1
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return fmt.Sprintf("vapid t=%s.%s, k=%s", unsigned, b64.EncodeToString(sig), b64.EncodeToString(srv.vapidPublicKey())), nil
+}
+
+// encryptPush encrypts payload to the subscription's keys as one aes128gcm
+// record (RFC 8188, keyed as RFC 8291 says).
+func encryptPush(sub *PushSubscription, payload []byte) ([]byte, error) {
+	b64 := base64.RawURLEncoding
+	uaRaw, err := b64.DecodeString(strings.TrimRight(sub.P256DH, "="))
+	if err != nil {
+		return nil, fmt.Errorf("p256dh: %w", err)
+	}
+	authSecret, err := b64.DecodeString(strings.TrimRight(sub.Auth, "="))
+	if err != nil {
+		return nil, fmt.Errorf("auth: %w", err)
+	}
+	uaPublic, err := ecdh.P256().NewPublicKey(uaRaw)
+	if err != nil {
+		return nil, fmt.Errorf("p256dh: %w", err)
+	}
+	asPrivate, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	asPublic := asPrivate.PublicKey().Bytes()
+	shared, err := asPrivate.ECDH(uaPublic)
+	if err != nil {
+		return nil, err
+	}
+
+	keyInfo := append(append([]byte("WebPush: info\x00"), uaRaw...), asPublic...)
+	ikm, err := hkdf.Key(sha256.New, shared, authSecret, string(keyInfo), 32)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	prk, err := hkdf.Extract(sha256.New, ikm, salt)
+	if err != nil {
+		return nil, err
+	}
+	cek, err := hkdf.Expand(sha256.New, prk, "Content-Encoding: aes128gcm\x00", 16)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := hkdf.Expand(sha256.New, prk, "Content-Encoding: nonce\x00", 12)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(payload)+1+gcm.Overhead() > pushRecordSize {
+		return nil, errors.New("payload too large")
+	}
+
+	// Header: salt, record size, key ID length and the key ID, which is
+	// the sender's public key
+	out := append(salt, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(out[16:], pushRecordSize)
+	out = append(out, byte(len(asPublic)))
+	out = append(out, asPublic...)
+	// 0x02 marks the last (and only) record
+	return gcm.Seal(out, nonce, append(payload, 2), nil), nil
+}
+
+// --- Handlers ---
+
+// pushKeyHandler serves GET /ui/push/key.
+func (srv *Server) pushKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, CodeMethodNotAllowed, "only GET allowed")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"public_key": base64.RawURLEncoding.EncodeToString(srv.vapidPublicKey())})
+}
+
+// pushSubscribeHandler serves POST /ui/push/subscribe with what the
+// browser's PushSubscription.toJSON() returns.
+func (srv *Server) pushSubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	rlog := srv.requestLogger(r)
+	if r.Method != http.MethodPost {
+		writeError(w, CodeMethodNotAllowed, "only POST allowed")
+		return
+	}
+	var data struct {
+		Endpoint       string `json:"endpoint"`
+		ExpirationTime *int64 `json:"expirationTime"`
+		Keys           struct {
+			P256DH string `json:"p256dh"`
+			Auth   string `json:"auth"`
+		} `json:"keys"`
+	}
+	if err := decodeJSON(w, r, &data); err != nil {
+		rlog.Warn("Invalid JSON", "error", err)
+		return
+	}
+	if u, err := url.Parse(data.Endpoint); err != nil || u.Scheme != "https" || u.Host == "" {
+		writeError(w, CodeInvalidRequest, "endpoint must be an https:// URL")
+		return
+	}
+	sub := &PushSubscription{Endpoint: data.Endpoint, P256DH: data.Keys.P256DH, Auth: data.Keys.Auth, CreatedAt: srv.now()}
+	// Checked here so a bad subscription fails now rather than on every
+	// message
+	if _, err := encryptPush(sub, nil); err != nil {
+		writeError(w, CodeInvalidRequest, "invalid subscription keys: "+err.Error())
+		return
+	}
+
+	p := requestPrincipal(r)
+	sub.Name, sub.Role, sub.Namespace, sub.ESPs = p.Name, p.Role, p.Namespace, slices.Clone(p.ESPs)
+	srv.usersMu.Lock()
+	_, sub.User = srv.users[p.Name]
+	srv.usersMu.Unlock()
+
+	srv.pushMu.Lock()
+	srv.pushSubs[sub.Endpoint] = sub
+	srv.savePush()
+	count := len(srv.pushSubs)
+	srv.pushMu.Unlock()
+
+	rlog.Info("Push subscription added", "subscriptions", count)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"status": "subscribed"})
+}
+
+// pushUnsubscribeHandler serves POST /ui/push/unsubscribe with the endpoint.
+// Users can only remove their own subscriptions, admins any.
+func (srv *Server) pushUnsubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	rlog := srv.requestLogger(r)
+	if r.Method != http.MethodPost {
+		writeError(w, CodeMethodNotAllowed, "only POST allowed")
+		return
+	}
+	var data struct {
+		Endpoint string `json:"endpoint"`
+	}
+	if err := decodeJSON(w, r, &data); err != nil {
+		rlog.Warn("Invalid JSON", "error", err)
+		return
+	}
+
+	p := requestPrincipal(r)
+	srv.pushMu.Lock()
+	sub, exists := srv.pushSubs[data.Endpoint]
+	allowed := exists && (sub.Name == p.Name || p.global())
+	if allowed {
+		delete(srv.pushSubs, data.Endpoint)
+		srv.savePush()
+	}
+	srv.pushMu.Unlock()
+	if !allowed {
+		// Someone else's subscription is as good as none
+		writeError(w, CodeNotFound, "no such subscription")
+		return
+	}
+
+	rlog.Info("Push subscription removed")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "unsubscribed"})
+}
+
+// pushTestHandler serves POST /ui/push/test, sending a message to the
+// caller's own subscriptions.
+func (srv *Server) pushTestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, CodeMethodNotAllowed, "only POST allowed")
+		return
+	}
+	p := requestPrincipal(r)
+	srv.pushMu.Lock()
+	var subs []*PushSubscription
+	for _, sub := range srv.pushSubs {
+		if sub.Name == p.Name {
+			subs = append(subs, sub)
+		}
+	}
+	srv.pushMu.Unlock()
+	if len(subs) == 0 {
+		writeError(w, CodeNotFound, "no push subscriptions for "+p.Name)
+		return
+	}
+
+	m := pushMessage{Title: "Wake-On-Demand", Body: "Test notification from " + p.Name, Tag: "test", URL: "/ui/", trigger: TriggerTest, urgency: "normal"}
+	sent, failed := 0, 0
+	for _, sub := range subs {
+		if srv.deliverPush(sub, m) == nil {
+			sent++
+		} else {
+			failed++
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"sent": sent, "failed": failed})
+}
@@ -0,0 +1,265 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// queueState holds the Server state kept in queue.go.
+type queueState struct {
+	maxQueueDepth int
+
+	// defaultCommandTTL is how long a queued command waits for delivery unless
+	// the sender sets its own TTL; zero keeps commands until delivered.
+	defaultCommandTTL time.Duration
+
+	// commandMaxAge is how long after delivery a device may still act on a
+	// command; zero lets it act whenever the command arrives.
+	commandMaxAge time.Duration
+
+	// longPollStop is closed on shutdown to release held polls.
+	longPollStop chan struct{}
+}
+
+var errQueueFull = errors.New("command queue is full")
+
+// enqueueCommand queues cmd behind the commands of the same or a higher
+// priority, unless an identical command is already waiting, in which case
+// that record is returned instead, moved up if cmd's priority is higher.
+// An urgent command that finds the queue full displaces the newest command
+// of a lower priority. Must be called with mu held.
+func (srv *Server) enqueueCommand(esp *ESP, cmd ESPCommand, action string, duration, ttl time.Duration, priority CommandPriority) (rec *CommandRecord, duplicate bool, err error) {
+	srv.expireQueue(esp)
+	if queued := srv.findQueued(esp, cmd, action, duration); queued != nil {
+		if priority.rank() > queued.Priority.rank() {
+			esp.Queue = slices.DeleteFunc(esp.Queue, func(r *CommandRecord) bool { return r == queued })
+			queued.Priority = priority
+			insertQueued(esp, queued)
+		}
+		return queued, true, nil
+	}
+	if len(esp.Queue) >= srv.maxQueueDepth {
+		victim := displaceable(esp, priority)
+		if victim < 0 {
+			return nil, false, errQueueFull
+		}
+		srv.failCommand(esp.Queue[victim], "displaced by an urgent command")
+		esp.Queue = slices.Delete(esp.Queue, victim, victim+1)
+	}
+
+	rec = srv.newCommandRecord(esp.ID, cmd)
+	rec.DurationMS = int(duration.Milliseconds())
+	rec.Action = action
+	rec.Priority = priority
+	rec.setTTL(ttl)
+	insertQueued(esp, rec)
+	esp.signalCommand()
+	srv.nudgeBeacon(esp)
+	srv.hurryPolls(esp)
+	return rec, false, nil
+}
+
+// insertQueued puts rec after every queued command of the same or a higher
+// priority. Must be called with mu held.
+func insertQueued(esp *ESP, rec *CommandRecord) {
+	i := len(esp.Queue)
+	for i > 0 && esp.Queue[i-1].Priority.rank() < rec.Priority.rank() {
+		i--
+	}
+	esp.Queue = slices.Insert(esp.Queue, i, rec)
+}
+
+// displaceable returns the index of the queued command an urgent one may
+// push out of a full queue, the newest of the lowest priority, or -1.
+// Must be called with mu held.
+func displaceable(esp *ESP, priority CommandPriority) int {
+	if priority != PriorityUrgent {
+		return -1
+	}
+	victim := -1
+	for i, rec := range esp.Queue {
+		if rec.Priority.rank() < PriorityUrgent.rank() && (victim < 0 || rec.Priority.rank() <= esp.Queue[victim].Priority.rank()) {
+			victim = i
+		}
+	}
+	return victim
+}
+
+// findQueued returns the queued command a new one would duplicate, if any.
+func (srv *Server) findQueued(esp *ESP, cmd ESPCommand, action string, duration time.Duration) *CommandRecord {
+	durationMS := int(duration.Milliseconds())
+	now := srv.now()
+	for _, queued := range esp.Queue {
+		if queued.Command == cmd && queued.Action == action && queued.DurationMS == durationMS && !queued.pastTTL(now) {
+			return queued
+		}
+	}
+	return nil
+}
+
+// maxLongPoll caps how long a poll with ?wait= is held open.
+const maxLongPoll = 60 * time.Second
+
+// parseLongPollWait reads the wait parameter, a duration ("25s") or a
+// number of seconds.
+func parseLongPollWait(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		secs, convErr := strconv.Atoi(s)
+		if convErr != nil {
+			return 0, fmt.Errorf("invalid wait %q", s)
+		}
+		d = time.Duration(secs) * time.Second
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("wait must be positive, got %s", s)
+	}
+	return min(d, maxLongPoll), nil
+}
+
+// commandReady returns a channel that is closed the next time a command is
+// queued for the ESP. Must be called with mu held.
+func (e *ESP) commandReady() <-chan struct{} {
+	if e.ready == nil {
+		e.ready = make(chan struct{})
+	}
+	return e.ready
+}
+
+// signalCommand wakes the ESP's held polls. Must be called with mu held.
+func (e *ESP) signalCommand() {
+	if e.ready != nil {
+		close(e.ready)
+		e.ready = nil
+	}
+}
+
+// waitForCommand holds a poll until a command is queued, wait expires, the
+// ESP hangs up or the server shuts down, and then dequeues like a normal
+// poll. mu is released while waiting. Must be called with mu held.
+func (srv *Server) waitForCommand(r *http.Request, esp *ESP, wait time.Duration) *CommandRecord {
+	ready := esp.commandReady()
+	esp.longPolls++
+	srv.mu.Unlock()
+
+	timer := time.NewTimer(wait)
+	select {
+	case <-ready:
+	case <-timer.C:
+	case <-r.Context().Done():
+	case <-srv.longPollStop:
+	}
+	timer.Stop()
+
+	srv.mu.Lock()
+	esp.longPolls--
+	esp.markSeen(srv, srv.requestActor(r))
+	// A command handed to a connection that is gone would be lost
+	if r.Context().Err() != nil {
+		return nil
+	}
+	return srv.dequeueCommand(esp)
+}
+
+// dequeueCommand pops the oldest command that hasn't expired and marks it
+// delivered, unless it is held for the cooldown. Must be called with mu held.
+func (srv *Server) dequeueCommand(esp *ESP) *CommandRecord {
+	srv.expireQueue(esp)
+	return srv.popCommand(esp)
+}
+
+// popCommand must be called with mu held.
+func (srv *Server) popCommand(esp *ESP) *CommandRecord {
+	if len(esp.Queue) == 0 || srv.queueHeld(esp) {
+		return nil
+	}
+	rec := esp.Queue[0]
+	esp.Queue[0] = nil
+	esp.Queue = esp.Queue[1:]
+	srv.markDelivered(rec)
+	return rec
+}
+
+// expireQueue removes commands whose TTL has run out, including a soft-off
+// waiting for the agent. Must be called with mu held.
+func (srv *Server) expireQueue(esp *ESP) {
+	now := srv.now()
+	esp.Queue = slices.DeleteFunc(esp.Queue, func(rec *CommandRecord) bool {
+		if rec.pastTTL(now) {
+			srv.expireCommand(rec, rec.ttlReason())
+			return true
+		}
+		return false
+	})
+	if esp.Agent != nil && esp.Agent.Pending != nil && esp.Agent.Pending.pastTTL(now) {
+		srv.expireCommand(esp.Agent.Pending, esp.Agent.Pending.ttlReason())
+		esp.Agent.Pending = nil
+	}
+}
+
+// flushQueue drops all queued commands. Must be called with mu held.
+func (srv *Server) flushQueue(esp *ESP) int {
+	n := len(esp.Queue)
+	for _, rec := range esp.Queue {
+		srv.failCommand(rec, "flushed from queue")
+	}
+	esp.Queue = nil
+	return n
+}
+
+func (srv *Server) queueHandler(w http.ResponseWriter, r *http.Request) {
+	rlog := srv.requestLogger(r)
+	id := srv.resolveAlias(r.URL.Query().Get("id"))
+
+	if id == "" {
+		rlog.Warn("Missing ESP ID")
+		writeError(w, CodeInvalidRequest, "missing id")
+		return
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	esp, exists := srv.espMap[id]
+	if !exists {
+		rlog.Warn("ESP not found", "esp_id", id)
+		writeError(w, CodeESPNotFound, "ESP not registered")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		queued := make([]CommandRecord, 0, len(esp.Queue))
+		for _, rec := range esp.Queue {
+			queued = append(queued, *rec)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id":        id,
+			"depth":     len(queued),
+			"max_depth": srv.maxQueueDepth,
+			"commands":  queued,
+		})
+	case http.MethodDelete:
+		n := srv.flushQueue(esp)
+		rlog.Info("Queue flushed", "esp_id", id, "dropped", n)
+		srv.recordEvent(Event{Type: EventFlush, ESPID: id, Actor: srv.requestActor(r), Detail: fmt.Sprintf("%d dropped", n)})
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":  "flushed",
+			"id":      id,
+			"dropped": n,
+		})
+	default:
+		rlog.Warn("Method not allowed", "method", r.Method)
+		writeError(w, CodeMethodNotAllowed, "only GET or DELETE allowed")
+	}
+}
@@ -0,0 +1,281 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Quotas cap how many commands a device gets, so a runaway script can't
+// queue hundreds of power commands. Each device may get commands_per_hour
+// commands in any hour, and force_per_day of them may be off or soft-off
+// in any 24 hours. The defaults apply to every device; devices: overrides
+// them per ESP ID or alias, and namespaces: adds limits that the devices
+// of a namespace share. A command over a quota is refused with 429 and a
+// Retry-After for when it would be allowed. Admins get through with
+// override. Quotas are for what clients send: schedules, idle policies,
+// the UPS, wake verification and the SSH fallback aren't counted. Usage is
+// kept in memory and starts from zero when the server starts.
+
+const (
+	quotaHour = time.Hour
+	quotaDay  = 24 * time.Hour
+)
+
+var errQuota = errors.New("quota exceeded")
+
+// QuotaLimits are the limits of a device or namespace; 0 is no limit.
+type QuotaLimits struct {
+	CommandsPerHour int `yaml:"commands_per_hour" json:"commands_per_hour,omitempty"`
+	ForcePerDay     int `yaml:"force_per_day" json:"force_per_day,omitempty"`
+}
+
+// QuotaSettings are the quotas: a default for every device, per-device
+// replacements for it (-1 lifts a default), and namespace totals.
+type QuotaSettings struct {
+	CommandsPerHour int                    `yaml:"commands_per_hour"`
+	ForcePerDay     int                    `yaml:"force_per_day"`
+	Devices         map[string]QuotaLimits `yaml:"devices"`
+	Namespaces      map[string]QuotaLimits `yaml:"namespaces"`
+}
+
+func validateQuotas(q QuotaSettings) []error {
+	var errs []error
+	check := func(field string, l QuotaLimits, min int) {
+		if l.CommandsPerHour < min {
+			errs = append(errs, fmt.Errorf("quotas%s.commands_per_hour: must be %d or more, got %d", field, min, l.CommandsPerHour))
+		}
+		if l.ForcePerDay < min {
+			errs = append(errs, fmt.Errorf("quotas%s.force_per_day: must be %d or more, got %d", field, min, l.ForcePerDay))
+		}
+	}
+	check("", QuotaLimits{q.CommandsPerHour, q.ForcePerDay}, 0)
+	for name, l := range q.Devices {
+		check(".devices."+name, l, -1)
+	}
+	for ns, l := range q.Namespaces {
+		if err := ValidateNamespace(ns); err != nil {
+			errs = append(errs, fmt.Errorf("quotas.namespaces.%s: %v", ns, err))
+		}
+		check(".namespaces."+ns, l, 0)
+	}
+	return errs
+}
+
+// quotaUse is one command that counted against a quota.
+type quotaUse struct {
+	at    time.Time
+	force bool
+}
+
+// quotaState holds the Server state kept in quota.go.
+type quotaState struct {
+	// quotaUsage is the last day of commands by device ("esp:<id>") and by
+	// namespace ("ns:<name>"). Guarded by mu.
+	quotaUsage map[string][]quotaUse
+}
+
+// deviceQuota is the device's limits. Must be called with mu held.
+func (srv *Server) deviceQuota(id string) QuotaLimits {
+	q := QuotaLimits{srv.config.Quotas.CommandsPerHour, srv.config.Quotas.ForcePerDay}
+	for name, l := range srv.config.Quotas.Devices {
+		if srv.resolveAlias(name) != id {
+			continue
+		}
+		if l.CommandsPerHour != 0 {
+			q.CommandsPerHour = max(l.CommandsPerHour, 0)
+		}
+		if l.ForcePerDay != 0 {
+			q.ForcePerDay = max(l.ForcePerDay, 0)
+		}
+	}
+	return q
+}
+
+// quotaScopes are the quotas that apply to a device: its own, then its
+// namespace's if that has one. Must be called with mu held.
+func (srv *Server) quotaScopes(id string) []quotaScope {
+	scopes := []quotaScope{{key: "esp:" + id, name: fmt.Sprintf("'%s'", id), limits: srv.deviceQuota(id)}}
+	if ns := namespaceOf(id); ns != "" {
+		if l, ok := srv.config.Quotas.Namespaces[ns]; ok {
+			scopes = append(scopes, quotaScope{key: "ns:" + ns, name: fmt.Sprintf("namespace '%s'", ns), limits: l})
+		}
+	}
+	return scopes
+}
+
+type quotaScope struct {
+	key, name string
+	limits    QuotaLimits
+}
+
+// used counts the scope's commands, or only force-offs, within window, and
+// returns when the limit-th newest of them leaves it.
+func (s quotaScope) used(srv *Server, now time.Time, window time.Duration, force bool, limit int) (int, time.Duration) {
+	var times []time.Time
+	for _, u := range srv.quotaUsage[s.key] {
+		if now.Sub(u.at) < window && (u.force || !force) {
+			times = append(times, u.at)
+		}
+	}
+	if limit <= 0 || len(times) < limit {
+		return len(times), 0
+	}
+	return len(times), times[len(times)-limit].Add(window).Sub(now)
+}
+
+// quotaError is errQuota with the quota that was hit.
+type quotaError struct {
+	Scope  string // 'esp-a' or namespace 'kids'
+	Limit  int
+	Window time.Duration
+	Force  bool
+	Left   time.Duration
+}
+
+func (e *quotaError) Error() string {
+	what, window := "commands", "hour"
+	if e.Force {
+		what = "force-offs"
+	}
+	if e.Window == quotaDay {
+		window = "24 hours"
+	}
+	return fmt.Sprintf("%s: %s had its %d %s in the last %s, the next is allowed in %s", errQuota, e.Scope, e.Limit, what, window,
+		e.Left.Round(time.Second))
+}
+
+func (e *quotaError) Unwrap() error { return errQuota }
+
+func isForceOff(cmd ESPCommand) bool {
+	return cmd == CommandForce || cmd == CommandSoftOff
+}
+
+// checkQuota refuses a command over one of the device's quotas. soft-off
+// counts towards force_per_day even though it only falls back to force
+// sometimes, so a script can't get around the limit with it. Must be
+// called with mu held.
+func (srv *Server) checkQuota(esp *ESP, cmd ESPCommand, opts commandOptions) error {
+	if opts.IgnoreQuota {
+		return nil
+	}
+	now := srv.now()
+	for _, s := range srv.quotaScopes(esp.ID) {
+		if l := s.limits.CommandsPerHour; l > 0 {
+			if n, left := s.used(srv, now, quotaHour, false, l); n >= l {
+				if !opts.DryRun {
+					srv.metricQuotaRefused.Inc(esp.ID, "commands_per_hour")
+				}
+				return &quotaError{Scope: s.name, Limit: l, Window: quotaHour, Left: left}
+			}
+		}
+		if l := s.limits.ForcePerDay; l > 0 && isForceOff(cmd) {
+			if n, left := s.used(srv, now, quotaDay, true, l); n >= l {
+				if !opts.DryRun {
+					srv.metricQuotaRefused.Inc(esp.ID, "force_per_day")
+				}
+				return &quotaError{Scope: s.name, Limit: l, Window: quotaDay, Force: true, Left: left}
+			}
+		}
+	}
+	return nil
+}
+
+// chargeQuota counts a command that was sent. Must be called with mu held.
+func (srv *Server) chargeQuota(esp *ESP, cmd ESPCommand, result dispatchResult) {
+	if result.Status == "duplicate" {
+		return
+	}
+	now := srv.now()
+	use := quotaUse{at: now, force: isForceOff(cmd)}
+	for _, s := range srv.quotaScopes(esp.ID) {
+		uses := slices.DeleteFunc(srv.quotaUsage[s.key], func(u quotaUse) bool { return now.Sub(u.at) >= quotaDay })
+		srv.quotaUsage[s.key] = append(uses, use)
+	}
+}
+
+// QuotaStatus is a device's or namespace's usage against its limits.
+type QuotaStatus struct {
+	Scope string `json:"scope"` // device or namespace
+	Name  string `json:"name"`
+	QuotaLimits
+	CommandsLastHour int `json:"commands_last_hour"`
+	ForceLastDay     int `json:"force_last_day"`
+	// RefusedForMS is how long until the next command is allowed, while
+	// commands_per_hour is used up
+	RefusedForMS int64 `json:"refused_for_ms,omitempty"`
+}
+
+// quotaStatus must be called with mu held.
+func (srv *Server) quotaStatus(scope, name string, s quotaScope) QuotaStatus {
+	now := srv.now()
+	st := QuotaStatus{Scope: scope, Name: name, QuotaLimits: s.limits}
+	var left time.Duration
+	st.CommandsLastHour, left = s.used(srv, now, quotaHour, false, s.limits.CommandsPerHour)
+	st.ForceLastDay, _ = s.used(srv, now, quotaDay, true, 0)
+	st.RefusedForMS = left.Milliseconds()
+	return st
+}
+
+// quotasHandler serves GET /quotas, the usage of every device with a quota
+// or ?esp_id='s and its namespace's, and DELETE /quotas?esp_id= or
+// ?namespace=, which forgets the usage so far.
+func (srv *Server) quotasHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	id, ns := srv.resolveAlias(q.Get("esp_id")), q.Get("namespace")
+
+	switch r.Method {
+	case http.MethodGet:
+		srv.mu.Lock()
+		quotas := []QuotaStatus{}
+		for espID := range srv.espMap {
+			if id != "" && espID != id {
+				continue
+			}
+			s := srv.quotaScopes(espID)[0]
+			if s.limits == (QuotaLimits{}) && len(srv.quotaUsage[s.key]) == 0 && id == "" {
+				continue
+			}
+			quotas = append(quotas, srv.quotaStatus("device", espID, s))
+		}
+		for name, l := range srv.config.Quotas.Namespaces {
+			if id != "" && namespaceOf(id) != name || ns != "" && name != ns {
+				continue
+			}
+			quotas = append(quotas, srv.quotaStatus("namespace", name, quotaScope{key: "ns:" + name, limits: l}))
+		}
+		srv.mu.Unlock()
+		if id != "" && len(quotas) == 0 {
+			writeError(w, CodeESPNotFound, "ESP not registered")
+			return
+		}
+		slices.SortFunc(quotas, func(a, b QuotaStatus) int {
+			return strings.Compare(a.Scope+"\x00"+a.Name, b.Scope+"\x00"+b.Name)
+		})
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"quotas": quotas})
+
+	case http.MethodDelete:
+		key := "ns:" + ns
+		if id != "" {
+			key = "esp:" + id
+		} else if ns == "" {
+			writeError(w, CodeInvalidRequest, "esp_id or namespace required")
+			return
+		}
+		srv.mu.Lock()
+		_, used := srv.quotaUsage[key]
+		delete(srv.quotaUsage, key)
+		srv.mu.Unlock()
+		srv.requestLogger(r).Info("Quota usage reset", "esp_id", id, "namespace", ns, "by", srv.requestActor(r))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"status": "reset", "had_usage": used})
+
+	default:
+		writeError(w, CodeMethodNotAllowed, "only GET and DELETE allowed")
+	}
+}
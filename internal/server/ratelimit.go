@@ -0,0 +1,157 @@
+package server
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a set of token buckets, one per key, each refilled at
+// rate tokens per second up to burst.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns nil when perMinute is zero, which disables limiting.
+func newRateLimiter(perMinute, burst int) *rateLimiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:    float64(perMinute) / 60,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+func (l *rateLimiter) burstSize() int {
+	if l == nil {
+		return 0
+	}
+	return int(l.burst)
+}
+
+func (l *rateLimiter) perMinute() int {
+	if l == nil {
+		return 0
+	}
+	return int(math.Round(l.rate * 60))
+}
+
+// allow takes a token for key. When the bucket is empty it returns false and
+// how long until the next token is available.
+func (l *rateLimiter) allow(srv *Server, key string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := srv.now()
+	l.sweep(now)
+
+	b, exists := l.buckets[key]
+	if !exists {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+// sweep drops buckets that have been full for a while so idle clients do
+// not accumulate. Must be called with l.mu held.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	refill := time.Duration(l.burst / l.rate * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.last) > refill {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// ratelimitState holds the Server state kept in ratelimit.go.
+type ratelimitState struct {
+	ipLimiter  *rateLimiter
+	espLimiter *rateLimiter
+}
+
+func (srv *Server) remoteHost(r *http.Request) string {
+	if addr := srv.forwardedClientAddr(r); addr != "" {
+		return addr
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (srv *Server) rejectRateLimited(w http.ResponseWriter, r *http.Request, path, limit, key string, wait time.Duration) {
+	srv.metricRateLimited.Inc(path, limit)
+	srv.requestLogger(r).Warn("Rate limited", "limit", limit, "key", key, "retry_after", wait.Round(time.Millisecond).String())
+	writeRetryError(w, CodeRateLimited, "rate limit exceeded", wait)
+}
+
+// withRateLimit applies the per-IP limit before authentication, so guessing
+// tokens is throttled too. The status page has its own.
+func (srv *Server) withRateLimit(path string, next http.HandlerFunc) http.HandlerFunc {
+	limit := "ip"
+	if isStatusPath(path) {
+		limit = "status"
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		host := srv.remoteHost(r)
+		srv.settingsMu.RLock()
+		limiter := srv.ipLimiter
+		if limit == "status" {
+			limiter = srv.statusLimiter
+		}
+		srv.settingsMu.RUnlock()
+		if ok, wait := limiter.allow(srv, host); !ok {
+			srv.rejectRateLimited(w, r, path, limit, host, wait)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// allowESPRequest applies the per-ESP limit to registrations and commands
+// aimed at one device, writing a 429 when it is exceeded.
+func (srv *Server) allowESPRequest(w http.ResponseWriter, r *http.Request, id string) bool {
+	srv.settingsMu.RLock()
+	limiter := srv.espLimiter
+	srv.settingsMu.RUnlock()
+	ok, wait := limiter.allow(srv, id)
+	if !ok {
+		srv.rejectRateLimited(w, r, r.URL.Path, "esp", id, wait)
+	}
+	return ok
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	regstore "github.com/smileyfaceskobochka/trashbin-daemon/internal/registry"
+)
+
+// Registry persists registered ESPs so they survive server restarts.
+type Registry = regstore.Store[*ESP]
+
+func (srv *Server) newRegistry(path string) Registry {
+	if path == "" {
+		return regstore.Memory[*ESP]{}
+	}
+	return regstore.NewFile(path, espKey, regstore.WithClock(srv.now))
+}
+
+func espKey(esp *ESP) string {
+	if esp == nil {
+		return ""
+	}
+	return esp.ID
+}
+
+func (srv *Server) loadRegistry() {
+	esps, err := srv.registry.Load()
+	if err != nil {
+		srv.fatal("registry", "Failed to load registry", "error", err)
+	}
+
+	now := srv.now()
+	for id, esp := range esps {
+		timeout, _ := esp.offlineTimeout(srv)
+		esp.Online = !esp.isWoL() && now.Sub(esp.LastSeen) < timeout
+		if t := srv.configTarget(id); t != nil {
+			esp.Target = t
+		}
+	}
+
+	srv.mu.Lock()
+	srv.espMap = esps
+	// Queues only come back from the cluster state and SQLite
+	for _, esp := range esps {
+		for _, rec := range esp.Queue {
+			srv.commands[rec.ID] = rec
+		}
+		srv.restoreHistory(esp)
+	}
+	srv.indexAliases()
+	srv.registerVMs()
+	srv.mu.Unlock()
+
+	if len(esps) > 0 {
+		srv.logger("registry").Info("Registry loaded", "count", len(esps), "path", srv.registryPath)
+	}
+}
+
+// saveRegistry must be called with mu held.
+func (srv *Server) saveRegistry() {
+	if err := srv.registry.Save(srv.espMap); err != nil {
+		srv.logger("registry").Error("Failed to save registry", "error", err)
+	}
+}
@@ -0,0 +1,429 @@
+package server
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/netip"
+	"os"
+	"reflect"
+	"slices"
+	"sync"
+	"time"
+)
+
+// SIGHUP and POST /admin/reload re-read the config file and apply what can
+// change without a restart: timeouts, tokens and network ACLs, rate limits,
+// notification sinks, aliases, targets, VMs and idle policies. Flags and
+// WOD_* variables keep precedence over the file, as at startup. Devices,
+// their queues and open connections are untouched.
+
+// reloadState holds the Server state kept in reload.go.
+type reloadState struct {
+	// serverFlags are the flags given on the command line (or through the
+	// environment), which a reload must not override.
+	serverFlags map[string]bool
+	// flags is the parsed command line the server was configured from
+	flags *flag.FlagSet
+
+	// settingsMu guards the reloadable settings that are read outside mu:
+	// auth, requireSigned, registerAllow, commandAllow, cors, accessLog, the rate limiters and notifySinks.
+	settingsMu sync.RWMutex
+
+	reloadMu sync.Mutex
+}
+
+// runtimeSettings are the options a reload can change, resolved from the
+// flags and a config.
+type runtimeSettings struct {
+	timeout      time.Duration
+	queueDepth   int
+	commandTTL   time.Duration
+	drainTimeout time.Duration
+	retention    time.Duration
+	idempotency  time.Duration
+	maxAge       time.Duration
+	cooldown     time.Duration
+	granularity  time.Duration
+
+	perIP, ipBurst   int
+	perESP, espBurst int
+	statusPage       StatusPageSettings
+
+	auth          AuthConfig
+	registerAllow []netip.Prefix
+	commandAllow  []netip.Prefix
+	pinIPs        bool
+	requireSigned bool
+	duplicates    duplicatePolicy
+	pairing       pairingMode
+	cors          CORSSettings
+	accessLog     accessLogConfig
+}
+
+// flagValue returns the value of the named flag, or its zero value when fs
+// doesn't define it.
+func flagValue[T any](fs *flag.FlagSet, name string) T {
+	var v T
+	if f := fs.Lookup(name); f != nil {
+		v, _ = f.Value.(flag.Getter).Get().(T)
+	}
+	return v
+}
+
+// resolveSettings applies the config over the flag defaults, leaving flags
+// that were set alone.
+func (srv *Server) resolveSettings(cfg *Config) (runtimeSettings, error) {
+	s := runtimeSettings{
+		timeout:      flagValue[time.Duration](srv.flags, "timeout"),
+		queueDepth:   flagValue[int](srv.flags, "queue-depth"),
+		commandTTL:   flagValue[time.Duration](srv.flags, "command-ttl"),
+		drainTimeout: flagValue[time.Duration](srv.flags, "drain-timeout"),
+		idempotency:  flagValue[time.Duration](srv.flags, "idempotency-window"),
+		maxAge:       flagValue[time.Duration](srv.flags, "command-max-age"),
+		cooldown:     flagValue[time.Duration](srv.flags, "command-cooldown"),
+		granularity:  flagValue[time.Duration](srv.flags, "monitor-granularity"),
+		retention:    flagValue[time.Duration](srv.flags, "esp-retention"),
+		perIP:        flagValue[int](srv.flags, "rate-limit-ip"),
+		ipBurst:      60,
+		perESP:       flagValue[int](srv.flags, "rate-limit-esp"),
+		espBurst:     10,
+	}
+	if !srv.serverFlags["timeout"] && cfg.Timeout > 0 {
+		s.timeout = cfg.Timeout
+	}
+	if !srv.serverFlags["queue-depth"] && cfg.QueueDepth > 0 {
+		s.queueDepth = cfg.QueueDepth
+	}
+	if s.queueDepth < 1 {
+		return s, errors.New("-queue-depth must be at least 1")
+	}
+	if !srv.serverFlags["command-ttl"] && cfg.CommandTTL != 0 {
+		s.commandTTL = cfg.CommandTTL
+	}
+	if s.commandTTL < 0 {
+		return s, errors.New("-command-ttl must be positive")
+	}
+	if !srv.serverFlags["command-max-age"] && cfg.CommandMaxAge != 0 {
+		s.maxAge = cfg.CommandMaxAge
+	}
+	if s.maxAge < 0 {
+		return s, errors.New("-command-max-age must be positive")
+	}
+	if !srv.serverFlags["command-cooldown"] && cfg.CommandCooldown != 0 {
+		s.cooldown = cfg.CommandCooldown
+	}
+	if s.cooldown < 0 || s.cooldown > maxCooldown {
+		return s, fmt.Errorf("-command-cooldown must be between 0 and %s", maxCooldown)
+	}
+	if !srv.serverFlags["monitor-granularity"] && cfg.MonitorGranularity != 0 {
+		s.granularity = cfg.MonitorGranularity
+	}
+	if s.granularity < 0 || s.granularity > maxMonitorGranularity {
+		return s, fmt.Errorf("-monitor-granularity must be between 0 and %s", maxMonitorGranularity)
+	}
+	if !srv.serverFlags["drain-timeout"] && cfg.DrainTimeout > 0 {
+		s.drainTimeout = cfg.DrainTimeout
+	}
+	if !srv.serverFlags["idempotency-window"] && cfg.IdempotencyWindow > 0 {
+		s.idempotency = cfg.IdempotencyWindow
+	}
+	if s.idempotency < 0 {
+		return s, errors.New("-idempotency-window must be positive")
+	}
+	if !srv.serverFlags["esp-retention"] {
+		// Validate has already checked it
+		s.retention, _ = parseRetention(cfg.ESPRetention)
+		if cfg.ESPRetention == "" {
+			s.retention = 0
+		}
+	}
+	if s.retention > 0 && s.retention < s.timeout {
+		return s, errors.New("-esp-retention must be longer than -timeout")
+	}
+
+	if !srv.serverFlags["rate-limit-ip"] && cfg.RateLimit.PerIP != 0 {
+		s.perIP = cfg.RateLimit.PerIP
+	}
+	if cfg.RateLimit.IPBurst > 0 {
+		s.ipBurst = cfg.RateLimit.IPBurst
+	}
+	if !srv.serverFlags["rate-limit-esp"] && cfg.RateLimit.PerESP != 0 {
+		s.perESP = cfg.RateLimit.PerESP
+	}
+	if cfg.RateLimit.ESPBurst > 0 {
+		s.espBurst = cfg.RateLimit.ESPBurst
+	}
+	s.statusPage = cfg.StatusPage
+
+	s.auth = AuthConfig{
+		AdminKey:        cmp.Or(flagValue[string](srv.flags, "admin-key"), cfg.Auth.AdminKey),
+		ESPTokens:       maps.Clone(srv.flags.Lookup("esp-token").Value.(tokenFlag)),
+		NamespaceTokens: maps.Clone(cfg.Auth.NamespaceTokens),
+	}
+	if s.auth.NamespaceTokens == nil {
+		s.auth.NamespaceTokens = make(map[string]string)
+	}
+	for id, token := range cfg.Auth.ESPTokens {
+		if _, exists := s.auth.ESPTokens[id]; !exists {
+			s.auth.ESPTokens[id] = token
+		}
+	}
+	if path := flagValue[string](srv.flags, "auth-file"); path != "" {
+		if err := LoadAuthFile(path, &s.auth); err != nil {
+			return s, fmt.Errorf("could not load auth file: %v", err)
+		}
+	}
+
+	registerCIDRs, commandCIDRs := cfg.ESPNetwork.RegisterAllow, cfg.ESPNetwork.CommandAllow
+	if srv.serverFlags["esp-allow"] {
+		allow := SplitList(flagValue[string](srv.flags, "esp-allow"))
+		registerCIDRs, commandCIDRs = allow, allow
+	}
+	var err error
+	if s.registerAllow, err = parseCIDRs(registerCIDRs); err == nil {
+		s.commandAllow, err = parseCIDRs(commandCIDRs)
+	}
+	if err != nil {
+		return s, fmt.Errorf("-esp-allow: %v", err)
+	}
+	s.pinIPs = flagValue[bool](srv.flags, "pin-esp-ip")
+	if !srv.serverFlags["pin-esp-ip"] {
+		s.pinIPs = cfg.ESPNetwork.PinIP
+	}
+	s.requireSigned = flagValue[bool](srv.flags, "require-signed")
+	if !srv.serverFlags["require-signed"] {
+		s.requireSigned = cfg.Auth.RequireSigned
+	}
+	duplicateName := flagValue[string](srv.flags, "duplicate-ids")
+	if !srv.serverFlags["duplicate-ids"] && cfg.ESPNetwork.DuplicateIDs != "" {
+		duplicateName = cfg.ESPNetwork.DuplicateIDs
+	}
+	if s.duplicates, err = parseDuplicatePolicy(duplicateName); err != nil {
+		return s, fmt.Errorf("-duplicate-ids: %v", err)
+	}
+	pairingName := flagValue[string](srv.flags, "pairing")
+	if !srv.serverFlags["pairing"] && cfg.ESPNetwork.Pairing != "" {
+		pairingName = cfg.ESPNetwork.Pairing
+	}
+	if s.pairing, err = parsePairingMode(pairingName); err != nil {
+		return s, fmt.Errorf("-pairing: %v", err)
+	}
+	s.cors = cfg.CORS
+	if srv.serverFlags["cors-origin"] {
+		s.cors.AllowedOrigins = SplitList(flagValue[string](srv.flags, "cors-origin"))
+	}
+	s.cors = s.cors.normalize()
+	if err := s.cors.validate(); err != nil {
+		return s, fmt.Errorf("-cors-origin: %v", err)
+	}
+	access := cfg.Log.Access
+	s.accessLog = accessLogConfig{
+		enabled: flagValue[bool](srv.flags, "access-log"),
+		sample:  flagValue[float64](srv.flags, "access-log-sample"),
+		slow:    cmp.Or(access.Slow, defaultSlowRequest),
+	}
+	if !srv.serverFlags["access-log"] && access.Enabled != nil {
+		s.accessLog.enabled = *access.Enabled
+	}
+	if !srv.serverFlags["access-log-sample"] && access.Sample != nil {
+		s.accessLog.sample = *access.Sample
+	}
+	if s.accessLog.sample < 0 || s.accessLog.sample > 1 {
+		return s, fmt.Errorf("-access-log-sample must be between 0 and 1")
+	}
+	return s, nil
+}
+
+// applySettings installs s. At runtime it must be called with mu held.
+func (srv *Server) applySettings(s runtimeSettings) {
+	srv.timeoutDuration = s.timeout
+	srv.maxQueueDepth = s.queueDepth
+	srv.defaultCommandTTL = s.commandTTL
+	srv.commandMaxAge = s.maxAge
+	srv.commandCooldown = s.cooldown
+	srv.monitorGranularity = s.granularity
+	srv.drainTimeout = s.drainTimeout
+	srv.espRetention = s.retention
+	srv.pinESPIPs = s.pinIPs
+	srv.duplicateIDs = s.duplicates
+	srv.pairing = s.pairing
+	srv.idempotencyMu.Lock()
+	srv.idempotencyWindow = s.idempotency
+	srv.idempotencyMu.Unlock()
+
+	srv.settingsMu.Lock()
+	defer srv.settingsMu.Unlock()
+	srv.auth = s.auth
+	srv.registerAllow, srv.commandAllow = s.registerAllow, s.commandAllow
+	srv.cors = s.cors
+	srv.accessLog = s.accessLog
+	srv.requireSigned = s.requireSigned
+	if srv.ipLimiter.perMinute() != s.perIP || srv.ipLimiter.burstSize() != s.ipBurst {
+		srv.ipLimiter = newRateLimiter(s.perIP, s.ipBurst)
+	}
+	if srv.espLimiter.perMinute() != s.perESP || srv.espLimiter.burstSize() != s.espBurst {
+		srv.espLimiter = newRateLimiter(s.perESP, s.espBurst)
+	}
+	srv.statusPage = s.statusPage
+	if perMinute := statusRateLimit(s.statusPage); srv.statusLimiter.perMinute() != perMinute {
+		srv.statusLimiter = newRateLimiter(perMinute, statusBurst)
+	}
+}
+
+// restartOnly lists the config sections a reload can't apply.
+var restartOnly = []struct {
+	name string
+	get  func(*Config) interface{}
+}{
+	{"port", func(c *Config) interface{} { return c.Port }},
+	{"listen", func(c *Config) interface{} { return c.Listen }},
+	{"admin_socket", func(c *Config) interface{} { return c.AdminSocket }},
+	{"grpc_port", func(c *Config) interface{} { return c.GRPCPort }},
+	{"probe_interval", func(c *Config) interface{} { return c.ProbeEvery }},
+	{"store", func(c *Config) interface{} { return c.Store }},
+	{"registry", func(c *Config) interface{} { return c.Registry }},
+	{"schedules", func(c *Config) interface{} { return c.Schedules }},
+	{"events", func(c *Config) interface{} { return c.Events }},
+	{"uptime_dir", func(c *Config) interface{} { return c.UptimeDir }},
+	{"telemetry_dir", func(c *Config) interface{} { return c.TelemetryDir }},
+	{"groups", func(c *Config) interface{} { return c.Groups }},
+	{"ota_dir", func(c *Config) interface{} { return c.OTADir }},
+	{"data_dir", func(c *Config) interface{} { return c.DataDir }},
+	{"auth.users_file", func(c *Config) interface{} { return c.Auth.Users }},
+	{"auth.secrets_file", func(c *Config) interface{} { return c.Auth.Secrets }},
+	{"tls", func(c *Config) interface{} { return c.TLS }},
+	{"log.format", func(c *Config) interface{} { return c.Log.Format }},
+	{"mqtt", func(c *Config) interface{} { return c.MQTT }},
+	{"telegram", func(c *Config) interface{} { return c.Telegram }},
+	{"mdns", func(c *Config) interface{} { return c.MDNS }},
+	{"ups", func(c *Config) interface{} { return c.UPS }},
+	{"service_registry", func(c *Config) interface{} { return c.ServiceRegistry }},
+	{"tracing", func(c *Config) interface{} { return c.Tracing }},
+	{"web_push", func(c *Config) interface{} { return c.WebPush }},
+	{"cluster", func(c *Config) interface{} { return c.Cluster }},
+	{"backup", func(c *Config) interface{} { return c.Backup }},
+	{"beacon", func(c *Config) interface{} { return c.Beacon }},
+}
+
+// ReloadResult reports what a reload changed.
+type ReloadResult struct {
+	Config string `json:"config"`
+	// NeedsRestart lists changed settings that only take effect on restart
+	NeedsRestart []string `json:"needs_restart,omitempty"`
+}
+
+// reloadConfig re-reads and applies the config file. On any error the
+// running settings are kept.
+func (srv *Server) reloadConfig(actor string) (ReloadResult, error) {
+	srv.reloadMu.Lock()
+	defer srv.reloadMu.Unlock()
+
+	result := ReloadResult{Config: srv.configPath}
+	if srv.configPath == "" {
+		return result, errors.New("the server was started without -config")
+	}
+	cfg, err := LoadConfig(srv.configPath)
+	if err != nil {
+		return result, err
+	}
+	if errs := cfg.Validate(); len(errs) > 0 {
+		return result, fmt.Errorf("invalid config: %w", errors.Join(errs...))
+	}
+	settings, err := srv.resolveSettings(cfg)
+	if err != nil {
+		return result, err
+	}
+
+	if !srv.serverFlags["log-level"] && cfg.Log.Level != "" {
+		level, _ := ParseLogLevel(cfg.Log.Level)
+		srv.logLevel.Set(level)
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	old := srv.config
+	for _, setting := range restartOnly {
+		if !reflect.DeepEqual(setting.get(old), setting.get(cfg)) {
+			result.NeedsRestart = append(result.NeedsRestart, setting.name)
+		}
+	}
+
+	srv.applySettings(settings)
+	hadSinks, hadPolicies := srv.notificationsEnabled(), len(old.IdlePolicies) > 0
+	srv.setupNotifications(cfg.Notifications)
+	srv.setupWebhooks(cfg.Webhooks)
+	srv.setupSessions(cfg.Auth.Sessions)
+	srv.setupOIDC(cfg.Auth.OIDC)
+	srv.config = cfg
+
+	// Config targets replace the ones they were applied from; targets set
+	// through the API stay
+	for id, esp := range srv.espMap {
+		oldTarget, newTarget := srv.configTargetIn(old, id), srv.configTarget(id)
+		switch {
+		case newTarget != nil:
+			esp.Target = newTarget
+		case oldTarget != nil && reflect.DeepEqual(esp.Target, oldTarget):
+			esp.Target = nil
+		}
+	}
+	srv.indexAliases()
+	srv.registerVMs()
+	srv.saveRegistry()
+
+	// The loops only run when there is something to do
+	if !hadSinks && srv.notificationsEnabled() {
+		go srv.runNotifier()
+	}
+	if !hadPolicies && len(srv.config.IdlePolicies) > 0 {
+		go srv.runIdlePolicies()
+	}
+	for id := range srv.idleStates {
+		for name := range srv.idleStates[id] {
+			if !slices.ContainsFunc(srv.config.IdlePolicies, func(p IdlePolicy) bool { return p.Name == name }) {
+				delete(srv.idleStates[id], name)
+			}
+		}
+	}
+
+	rlog := srv.logger("reload")
+	rlog.Info("Config reloaded", "config", srv.configPath, "by", actor,
+		"esp_timeout", srv.timeoutDuration.String(), "notify_sinks", len(srv.notifySinks), "idle_policies", len(srv.config.IdlePolicies))
+	if len(result.NeedsRestart) > 0 {
+		rlog.Warn("Some changes need a restart", "settings", result.NeedsRestart)
+	}
+	srv.recordEvent(Event{Type: EventReload, Actor: actor, Detail: srv.configPath})
+	return result, nil
+}
+
+// watchReload reloads the config on SIGHUP, or on Windows when the service
+// is sent a parameter change.
+func (srv *Server) watchReload() {
+	hup := make(chan os.Signal, 1)
+	srv.notifyReload(hup)
+	for range hup {
+		if _, err := srv.reloadConfig("SIGHUP"); err != nil {
+			srv.logger("reload").Error("Config reload failed, keeping the running config", "error", err)
+		}
+	}
+}
+
+func (srv *Server) reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, CodeMethodNotAllowed, "only POST allowed")
+		return
+	}
+	result, err := srv.reloadConfig(srv.requestActor(r))
+	if err != nil {
+		srv.requestLogger(r).Error("Config reload failed, keeping the running config", "error", err)
+		writeError(w, CodeInvalidConfig, "reload failed: "+err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
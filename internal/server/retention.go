@@ -0,0 +1,122 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// retentionState holds the Server state kept in retention.go.
+type retentionState struct {
+	// espRetention is how long an ESP may stay unseen before the monitor
+	// forgets it; zero keeps registrations forever.
+	espRetention time.Duration
+}
+
+// retentionFlag is a duration flag that also accepts days, e.g. 30d.
+type retentionFlag struct{ d *time.Duration }
+
+func (f retentionFlag) String() string {
+	if f.d == nil || *f.d == 0 {
+		return "0"
+	}
+	return f.d.String()
+}
+
+func (f retentionFlag) Get() any {
+	return *f.d
+}
+
+func (f retentionFlag) Set(s string) error {
+	d, err := parseRetention(s)
+	if err != nil {
+		return err
+	}
+	*f.d = d
+	return nil
+}
+
+// parseRetention accepts a Go duration or a whole number of days ("30d").
+// "0" disables retention.
+func parseRetention(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	var d time.Duration
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid retention %q (use e.g. 30d or 72h)", s)
+		}
+		d = time.Duration(n) * 24 * time.Hour
+	} else {
+		var err error
+		if d, err = time.ParseDuration(s); err != nil {
+			return 0, fmt.Errorf("invalid retention %q (use e.g. 30d or 72h)", s)
+		}
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("retention must be positive, got %s", s)
+	}
+	return d, nil
+}
+
+// expired reports whether the ESP has been unseen for longer than the
+// retention. WoL entries never check in, so they are only removed by hand.
+// Must be called with mu held.
+func (e *ESP) expired(srv *Server, now time.Time) bool {
+	return srv.espRetention > 0 && !e.isWoL() && e.longPolls == 0 && now.Sub(e.LastSeen) > srv.espRetention
+}
+
+// removeESP forgets a device: its registration, metadata, pin, queued
+// commands and group memberships. Schedules and user grants for the ID are kept, so a
+// device that registers again under it gets them back. Must be called with
+// mu held.
+func (srv *Server) removeESP(esp *ESP, actor, reason string) int {
+	if c, exists := srv.wsConns[esp.ID]; exists {
+		c.close()
+		delete(srv.wsConns, esp.ID)
+	}
+	dropped := srv.flushQueue(esp)
+	stopOfflineCheck(esp)
+	// Held polls answer empty, and the ESP's next poll gets 404
+	esp.signalCommand()
+	delete(srv.espMap, esp.ID)
+	srv.endUptime(esp.ID)
+	srv.indexAliases()
+	srv.removeFromGroups(esp.ID)
+	srv.saveRegistry()
+
+	detail := reason
+	if dropped > 0 {
+		detail = strings.TrimPrefix(fmt.Sprintf("%s, %d queued command(s) dropped", reason, dropped), ", ")
+	}
+	srv.recordEvent(Event{Type: EventRemoved, ESPID: esp.ID, Actor: actor, Detail: detail})
+	return dropped
+}
+
+// removeHandler serves DELETE /esps/{id}.
+func (srv *Server) removeHandler(w http.ResponseWriter, r *http.Request) {
+	rlog := srv.requestLogger(r)
+
+	if r.Method != http.MethodDelete {
+		writeError(w, CodeMethodNotAllowed, "only DELETE allowed")
+		return
+	}
+	id := srv.resolveAlias(r.PathValue("id"))
+
+	srv.mu.Lock()
+	esp, exists := srv.espMap[id]
+	if !exists {
+		srv.mu.Unlock()
+		writeError(w, CodeESPNotFound, "ESP not registered")
+		return
+	}
+	dropped := srv.removeESP(esp, srv.requestActor(r), "")
+	srv.mu.Unlock()
+
+	rlog.Info("ESP removed", "esp_id", id, "dropped", dropped)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "removed", "id": id})
+}
@@ -0,0 +1,227 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+type Schedule struct {
+	ID        string     `json:"id"`
+	ESPID     string     `json:"esp_id"`
+	Cron      string     `json:"cron"`
+	Action    string     `json:"action"`
+	CreatedAt time.Time  `json:"created_at"`
+	LastRun   *time.Time `json:"last_run,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+
+	spec *cronSpec
+}
+
+// schedulerState holds the Server state kept in scheduler.go.
+type schedulerState struct {
+	schedulesMu   sync.Mutex
+	schedules     map[string]*Schedule
+	schedulesPath string
+}
+
+func (srv *Server) loadSchedules() {
+	list, err := srv.store.LoadSchedules()
+	if err != nil {
+		srv.fatal("schedule", "Failed to load schedules", "error", err)
+	}
+	if len(list) == 0 {
+		return
+	}
+
+	srv.schedulesMu.Lock()
+	defer srv.schedulesMu.Unlock()
+	for _, s := range list {
+		spec, err := ParseCron(s.Cron)
+		if err != nil {
+			srv.logger("schedule").Warn("Skipping invalid schedule", "schedule_id", s.ID, "error", err)
+			continue
+		}
+		s.spec = spec
+		srv.schedules[s.ID] = s
+	}
+	srv.logger("schedule").Info("Schedules loaded", "count", len(srv.schedules))
+}
+
+// saveSchedules must be called with schedulesMu held.
+func (srv *Server) saveSchedules() {
+	if err := srv.store.SaveSchedules(srv.sortedSchedules()); err != nil {
+		srv.logger("schedule").Error("Failed to save schedules", "error", err)
+	}
+}
+
+// sortedSchedules must be called with schedulesMu held.
+func (srv *Server) sortedSchedules() []*Schedule {
+	list := make([]*Schedule, 0, len(srv.schedules))
+	for _, s := range srv.schedules {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt.Before(list[j].CreatedAt)
+	})
+	return list
+}
+
+func (srv *Server) runScheduler() {
+	for {
+		now := srv.now()
+		next := now.Truncate(time.Minute).Add(time.Minute)
+		time.Sleep(next.Sub(now))
+
+		tick := srv.now().Truncate(time.Minute)
+		srv.schedulesMu.Lock()
+		due := make([]*Schedule, 0)
+		for _, s := range srv.schedules {
+			if s.spec.matches(tick) {
+				due = append(due, s)
+			}
+		}
+		srv.schedulesMu.Unlock()
+
+		for _, s := range due {
+			srv.runSchedule(s, tick)
+		}
+	}
+}
+
+func (srv *Server) runSchedule(s *Schedule, at time.Time) {
+	cmd, _ := ActionCommand(s.Action)
+	id := srv.resolveAlias(s.ESPID)
+
+	srv.mu.Lock()
+	esp, exists := srv.espMap[id]
+	var err error
+	var result dispatchResult
+	if !exists {
+		err = fmt.Errorf("ESP '%s' not registered", id)
+	} else {
+		result, err = srv.dispatchCommand(esp, cmd, commandOptions{Priority: PriorityLow, IgnoreQuota: true}, "schedule:"+s.ID)
+	}
+	srv.mu.Unlock()
+
+	schedLog := srv.logger("schedule").With("schedule_id", s.ID, "esp_id", id, "command", cmd)
+	if errors.Is(err, errAlreadyUp) {
+		schedLog.Info("Schedule skipped, target already up")
+		err = nil
+	} else if errors.Is(err, errMaintenance) {
+		schedLog.Info("Schedule skipped, device in maintenance")
+	} else if errors.Is(err, errCooldown) {
+		schedLog.Info("Schedule skipped, device cooling down")
+	} else if err != nil {
+		schedLog.Error("Schedule failed", "error", err)
+	} else {
+		schedLog.Info("Schedule fired", "command_id", result.Record.ID)
+	}
+
+	srv.schedulesMu.Lock()
+	s.LastRun = &at
+	s.LastError = ""
+	if err != nil {
+		s.LastError = err.Error()
+	}
+	srv.saveSchedules()
+	srv.schedulesMu.Unlock()
+}
+
+type scheduleInfo struct {
+	*Schedule
+	NextRun *time.Time `json:"next_run,omitempty"`
+}
+
+func (srv *Server) schedulesHandler(w http.ResponseWriter, r *http.Request) {
+	rlog := srv.requestLogger(r)
+
+	switch r.Method {
+	case http.MethodGet:
+		srv.schedulesMu.Lock()
+		now := srv.now()
+		list := make([]scheduleInfo, 0, len(srv.schedules))
+		for _, s := range srv.sortedSchedules() {
+			copied := *s
+			info := scheduleInfo{Schedule: &copied}
+			if next := s.spec.next(now); !next.IsZero() {
+				info.NextRun = &next
+			}
+			list = append(list, info)
+		}
+		srv.schedulesMu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string][]scheduleInfo{"schedules": list})
+
+	case http.MethodPost:
+		var data struct {
+			ESPID  string `json:"esp_id"`
+			Cron   string `json:"cron"`
+			Action string `json:"action"`
+		}
+		if err := decodeJSON(w, r, &data); err != nil {
+			rlog.Warn("Invalid JSON", "error", err)
+			return
+		}
+		if data.ESPID == "" {
+			writeError(w, CodeInvalidRequest, "esp_id cannot be empty")
+			return
+		}
+		if _, ok := ActionCommand(data.Action); !ok {
+			writeError(w, CodeInvalidRequest, fmt.Sprintf("unknown action %q (use on, off, soft-off or status)", data.Action))
+			return
+		}
+		spec, err := ParseCron(data.Cron)
+		if err != nil {
+			writeError(w, CodeInvalidRequest, fmt.Sprintf("invalid cron expression: %v", err))
+			return
+		}
+
+		s := &Schedule{
+			ID:        NewCommandID(),
+			ESPID:     data.ESPID,
+			Cron:      data.Cron,
+			Action:    data.Action,
+			CreatedAt: srv.now(),
+			spec:      spec,
+		}
+
+		srv.schedulesMu.Lock()
+		srv.schedules[s.ID] = s
+		srv.saveSchedules()
+		srv.schedulesMu.Unlock()
+
+		rlog.Info("Schedule added", "schedule_id", s.ID, "esp_id", s.ESPID, "cron", s.Cron, "action", s.Action)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(s)
+
+	case http.MethodDelete:
+		id := r.URL.Query().Get("id")
+
+		srv.schedulesMu.Lock()
+		_, exists := srv.schedules[id]
+		delete(srv.schedules, id)
+		if exists {
+			srv.saveSchedules()
+		}
+		srv.schedulesMu.Unlock()
+
+		if !exists {
+			writeError(w, CodeNotFound, "schedule not found")
+			return
+		}
+		rlog.Info("Schedule removed", "schedule_id", id)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "removed", "id": id})
+
+	default:
+		writeError(w, CodeMethodNotAllowed, "only GET, POST or DELETE allowed")
+	}
+}
@@ -0,0 +1,482 @@
+// Package server is the wake-on-demand server: the device registry and
+// command queues behind the HTTP, WebSocket, gRPC and MQTT APIs, with the
+// schedules, hooks, notifiers and cluster support around them. main builds
+// one with New and serves with Run.
+package server
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Server is a wake-on-demand server: the device registry with its command
+// queues, the schedules, users and every other piece of state the HTTP,
+// gRPC and MQTT fronts share. Make one with New.
+type Server struct {
+	// now is the server's clock, see WithClock
+	now func() time.Time
+
+	adminsocketState
+	apiState
+	authState
+	backupState
+	beaconState
+	clusterNodeState
+	commandsState
+	configState
+	containerState
+	cooldownState
+	corsState
+	driversState
+	duplicatesState
+	espState
+	eventsState
+	groupsState
+	grpcState
+	idempotencyState
+	idleState
+	listenState
+	loggingState
+	macrosState
+	mdnsState
+	metadataState
+	metricsState
+	monitorState
+	mqttbridgeState
+	netaclState
+	notifyState
+	oidcState
+	otaState
+	pairingState
+	probeState
+	pushState
+	queueState
+	quotaState
+	ratelimitState
+	reloadState
+	retentionState
+	schedulerState
+	serviceregState
+	serviceState
+	sessionState
+	shutdownState
+	signingState
+	statusState
+	storeState
+	streamState
+	telegramBotState
+	telemetryhistoryState
+	tlsState
+	tracingState
+	uiState
+	upsState
+	uptimeState
+	usersState
+	verifyState
+	wakehooksState
+	webhooksState
+	websocketState
+}
+
+// Option changes how New builds a Server.
+type Option func(*Server)
+
+// WithClock makes the server read the time from now instead of the wall
+// clock, for tests. Network deadlines stay on the wall clock.
+func WithClock(now func() time.Time) Option {
+	return func(srv *Server) { srv.now = now }
+}
+
+// WithLogger sets the logger the server's component and request loggers
+// derive from, slog.Default() otherwise.
+func WithLogger(l *slog.Logger) Option {
+	return func(srv *Server) { srv.baseLogger = l }
+}
+
+// WithLogLevel sets the level var of WithLogger's handler, so a config
+// reload can change the level.
+func WithLogLevel(level *slog.LevelVar) Option {
+	return func(srv *Server) { srv.logLevel = level }
+}
+
+// WithStore makes the server keep its registry, schedules and events in s
+// instead of opening the -store backend. The server closes it on shutdown.
+func WithStore(s Store) Option {
+	return func(srv *Server) { srv.storeOverride = s }
+}
+
+// New returns a server set up from fs and cfg; see configure. fs must
+// have been parsed, with the server's flags defined by RegisterFlags.
+func New(fs *flag.FlagSet, cfg *Config, opts ...Option) (*Server, error) {
+	srv := newServer()
+	for _, opt := range opts {
+		opt(srv)
+	}
+	if err := srv.configure(fs, cfg); err != nil {
+		return nil, err
+	}
+	return srv, nil
+}
+
+// newServer returns a Server in its initial state: nothing loaded, no
+// flags applied.
+func newServer() *Server {
+	srv := &Server{now: time.Now}
+	srv.router = http.NewServeMux()
+	srv.auth = AuthConfig{ESPTokens: make(map[string]string)}
+	srv.backupHTTP = &http.Client{Timeout: backupUploadTimeout}
+	srv.commands = make(map[string]*CommandRecord)
+	srv.config = &Config{}
+	srv.routeMethods = make(map[string][]string)
+	srv.driverHTTP = &http.Client{Timeout: driverTimeout}
+	srv.duplicateIDs = duplicateReject
+	srv.espMap = make(map[string]*ESP)
+	srv.registry = srv.newRegistry("")
+	srv.groups = make(map[string]*Group)
+	srv.idempotencyCache = make(map[string]*idempotentResponse)
+	srv.idempotencyWindow = 24 * time.Hour
+	srv.idleStates = make(map[string]map[string]*IdleState)
+	srv.baseLogger = slog.Default()
+	srv.logLevel = new(slog.LevelVar)
+	srv.accessLog = accessLogConfig{enabled: true, sample: 1, slow: defaultSlowRequest}
+	srv.macrosRunning = map[string]bool{}
+	srv.mdnsEnabled = true
+	srv.aliasToID = make(map[string]string)
+	srv.idToAlias = make(map[string]string)
+	srv.startTime = srv.now()
+	srv.metricCommandsQueued = newCounterVec("wod_commands_queued_total", "Commands queued per ESP.", "esp_id", "command")
+	srv.metricCommandsDelivered = newCounterVec("wod_commands_delivered_total", "Commands delivered to ESPs.", "esp_id", "command")
+	srv.metricCommandsAcked = newCounterVec("wod_commands_acked_total", "Commands acknowledged as executed by ESPs.", "esp_id", "command")
+	srv.metricCommandsFailed = newCounterVec("wod_commands_failed_total", "Commands that failed or were dropped.", "esp_id", "command")
+	srv.metricCommandsExpired = newCounterVec("wod_commands_expired_total", "Commands whose TTL ran out before delivery.", "esp_id", "command")
+	srv.metricPolls = newCounterVec("wod_polls_total", "Command polls received per ESP.", "esp_id")
+	srv.metricRateLimited = newCounterVec("wod_rate_limited_total", "Requests rejected by rate limiting.", "path", "limit")
+	srv.metricNotifications = newCounterVec("wod_notifications_total", "Notifications sent per sink.", "sink", "trigger", "result")
+	srv.metricWebhooks = newCounterVec("wod_webhook_deliveries_total", "Webhook deliveries by their final result.", "webhook", "result")
+	srv.metricQuotaRefused = newCounterVec("wod_quota_refused_total", "Commands refused by a quota.", "esp_id", "quota")
+	srv.metricWakeHooks = newCounterVec("wod_wake_hook_runs_total", "Wake hook chains run, by result.", "esp_id", "result")
+	srv.metricMacros = newCounterVec("wod_macro_runs_total", "Macro runs, by result.", "macro", "result")
+	srv.metricBackups = newCounterVec("wod_backups_total", "Automatic backups, by target and result.", "target", "result")
+	srv.metricBeacons = newCounterVec("wod_beacons_total", "UDP beacons received, by result.", "result")
+	srv.metricBeaconNudges = newCounterVec("wod_beacon_nudges_total", "Poll nudges sent over UDP.", "esp_id")
+	srv.metricHTTPRequests = newCounterVec("wod_http_requests_total", "HTTP requests handled.", "path", "method", "code")
+	srv.metricHTTPDuration = newHistogramVec("wod_http_request_duration_seconds", "HTTP request latency.",
+		[]float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}, "path", "method")
+	srv.monitorGranularity = time.Second
+	srv.notifyQueue = make(chan notification, 100)
+	srv.notifyClient = &http.Client{Timeout: notifySendTimeout}
+	srv.wakeTimeout = defaultWakeTimeout
+	srv.wakeDeadlines = make(map[string]time.Time)
+	srv.firmware = make(map[string][]*Firmware)
+	srv.pairing = pairingOff
+	srv.probeInterval = 30 * time.Second
+	srv.pushSubs = make(map[string]*PushSubscription)
+	srv.pushSubject = defaultPushSub
+	srv.pushQueue = make(chan pushMessage, 100)
+	srv.pushClient = &http.Client{Timeout: pushSendTimeout}
+	srv.maxQueueDepth = 8
+	srv.defaultCommandTTL = 10 * time.Minute
+	srv.commandMaxAge = 2 * time.Minute
+	srv.longPollStop = make(chan struct{})
+	srv.quotaUsage = make(map[string][]quotaUse)
+	srv.serverFlags = make(map[string]bool)
+	srv.schedules = make(map[string]*Schedule)
+	srv.serviceHTTP = &http.Client{Timeout: serviceRegTimeout}
+	srv.sessions = make(map[string]*session)
+	srv.sessionSettings = SessionSettings{TTL: defaultSessionTTL}
+	srv.deviceSecrets = make(map[string]*DeviceSecret)
+	srv.seenNonces = make(map[string]time.Time)
+	srv.statusTemplate = template.Must(template.New("status").Funcs(template.FuncMap{
+		"class": stateClass,
+		"label": func(state string) string { return strings.ReplaceAll(state, "_", " ") },
+		"ago":   func(t *time.Time) string { return statusAge(srv.now().Sub(*t)) },
+		"time":  func(t time.Time) string { return t.Format("15:04:05") },
+	}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta http-equiv="refresh" content="` + fmt.Sprint(int(statusRefresh.Seconds())) + `">
+<title>{{.Title}}</title>
+<style>
+body { margin: 0; padding: 2rem 1rem; background: #111418; color: #e6e9ee; font: 14px/1.4 system-ui, -apple-system, "Segoe UI", sans-serif; }
+main { max-width: 40rem; margin: 0 auto; }
+h1 { font-size: 1.4rem; margin: 0 0 1rem; }
+ul { list-style: none; margin: 0; padding: 0; }
+li { display: flex; justify-content: space-between; align-items: center; background: #1b2027; border-radius: 6px; padding: .75rem 1rem; margin-bottom: .5rem; }
+.state { font-weight: 600; color: #8a94a3; }
+.state small { font-weight: normal; color: #8a94a3; margin-left: .5rem; }
+.up { color: #3fb950; }
+.down { color: #f85149; }
+.busy { color: #d29922; }
+footer, .empty { color: #8a94a3; margin-top: 1rem; }
+</style>
+</head>
+<body>
+<main>
+<h1>{{.Title}}</h1>
+{{if .Devices}}<ul>
+{{range .Devices}}<li><span>{{.Name}}</span><span class="state {{class .State}}">{{label .State}}{{if .Since}}<small>{{ago .Since}}</small>{{end}}</span></li>
+{{end}}</ul>
+{{else}}<p class="empty">No devices.</p>
+{{end}}<footer>Updated {{time .UpdatedAt}}</footer>
+</main>
+</body>
+</html>
+`))
+	srv.store = srv.newFileStore("", "", "")
+	srv.streamSubs = make(map[*streamSub]struct{})
+	srv.telegramClient = &http.Client{Timeout: telegramPollTimeout + 15*time.Second}
+	srv.telemetryHistory = make(map[string][]telemetrySample)
+	srv.clientTransport = http.DefaultTransport
+	srv.traceFlush = make(chan chan struct{})
+	srv.traceClient = &http.Client{Timeout: traceSendTimeout}
+	srv.uiStop = make(chan struct{})
+	srv.uptimeHistory = make(map[string][]uptimeSample)
+	srv.users = make(map[string]*User)
+	srv.wakeVerifications = make(map[string]*CommandRecord)
+	srv.hooksRunning = map[string]bool{}
+	srv.hookHTTP = &http.Client{}
+	srv.webhookHTTP = &http.Client{Timeout: webhookTimeout}
+	srv.wsConns = make(map[string]*wsConn)
+	return srv
+}
+
+// RegisterFlags defines the flags that configure the server.
+func RegisterFlags(fs *flag.FlagSet) {
+	fs.String("port", "8080", "Server port")
+	fs.String("admin-socket", "", "Serve the control API only on this unix socket")
+	fs.String("listen", "", "Comma-separated addresses to listen on: host:port, [ipv6]:port or unix:<path> (overrides -port)")
+	fs.String("grpc-port", "", "Port for the gRPC API (empty disables it)")
+	fs.Bool("mdns", true, "Advertise the server over mDNS")
+	fs.String("otlp-endpoint", "", "OTLP/HTTP collector to send traces to, e.g. http://tempo:4318 (empty disables tracing)")
+	fs.Float64("trace-sample", 1, "Share of traces to keep, 0 to 1")
+	fs.Duration("timeout", 30*time.Second, "ESP timeout duration")
+	fs.Duration("probe-interval", 30*time.Second, "Interval between target host probes")
+	fs.Int("queue-depth", 8, "Maximum number of queued commands per ESP")
+	fs.Duration("command-ttl", 10*time.Minute, "How long a queued command waits for delivery before it expires (0 never expires)")
+	fs.Duration("command-max-age", 2*time.Minute, "How long after delivery a device may still act on a command (0 disables the check)")
+	fs.Duration("command-cooldown", 0, "How long after an on or off reaches a device it refuses another one (0 disables cooldowns)")
+	fs.Duration("monitor-granularity", time.Second, "How late, at most, offline checks may run, spread at random (0 checks exactly on time)")
+	fs.Duration("drain-timeout", 10*time.Second, "Time to wait for in-flight requests on shutdown")
+	fs.Duration("idempotency-window", 24*time.Hour, "How long repeated Idempotency-Key requests get the first response (0 ignores the header)")
+	fs.String("store", storeFile, "Storage backend for ESPs, queues, schedules and events: file, memory or sqlite://<path>")
+	fs.String("registry", "", "Registry file for persisting ESPs (empty keeps them in memory)")
+	fs.String("schedules", "", "File for persisting power schedules (empty keeps them in memory)")
+	fs.String("users", "", "File for persisting user accounts (empty keeps them in memory)")
+	fs.String("secrets", "", "File for persisting device secrets used to sign ESP requests (empty keeps them in memory)")
+	fs.Bool("require-signed", false, "Reject unsigned requests from every ESP, not only those with a secret")
+	fs.String("groups", "", "File for persisting ESP groups (empty keeps them in memory)")
+	fs.String("ota-dir", "", "Directory for ESP firmware images served over OTA (empty disables OTA)")
+	fs.String("events", "", "Append-only event log file (empty keeps recent events in memory)")
+	fs.String("uptime-dir", "", "Directory for target uptime history (empty keeps it in memory)")
+	fs.String("telemetry-dir", "", "Directory for device telemetry history (empty keeps it in memory)")
+	fs.String("data-dir", "", "Directory for the registry, schedules, users, events, uptime history and firmware when not set individually")
+	fs.String("admin-key", "", "Admin API key for control endpoints")
+	fs.String("auth-file", "", "JSON file with admin_key and esp_tokens")
+	fs.Var(tokenFlag{}, "esp-token", "Per-ESP registration token as <esp_id>=<token> (repeatable)")
+	fs.String("tls-cert", "", "TLS certificate file for HTTPS")
+	fs.String("tls-key", "", "TLS private key file for HTTPS")
+	fs.String("acme-domain", "", "Obtain a Let's Encrypt certificate for this domain")
+	fs.String("acme-cache", "/var/lib/wake-on-demand/acme", "Directory for cached ACME certificates")
+	fs.String("acme-email", "", "Contact email for the ACME account")
+	fs.Int("rate-limit-ip", 300, "Requests per minute allowed from one client IP (0 disables)")
+	fs.Int("rate-limit-esp", 30, "Registrations and commands per minute allowed per ESP (0 disables)")
+	fs.String("esp-allow", "", "Comma-separated CIDRs ESPs may register and poll from (empty allows any)")
+	fs.String("cors-origin", "", "Comma-separated origins browsers may call the API from (* allows any)")
+	fs.Bool("pin-esp-ip", false, "Pin each ESP ID to the address that first registered it")
+	fs.String("duplicate-ids", string(duplicateReject), "What to do when two devices use one ESP ID: reject, quarantine or allow")
+	fs.String("pairing", string(pairingOff), "Hold new ESPs until an admin approves them: off, approve, or code (approving needs the code the ESP printed)")
+	fs.Var(retentionFlag{new(time.Duration)}, "esp-retention", "Remove ESPs not seen for this long, e.g. 30d (0 keeps them forever)")
+	fs.String("mqtt-broker", "", "MQTT broker URL for bridged devices (tcp:// or tls://)")
+	fs.String("cluster-redis", "", "Redis URL shared by clustered servers (empty runs standalone)")
+	fs.String("cluster-advertise", "", "URL other cluster nodes use to reach this one")
+	fs.Bool("access-log", true, "Log every HTTP request with its status, size and duration")
+	fs.Float64("access-log-sample", 1, "Fraction of successful requests the access log keeps (errors and slow requests are always logged)")
+}
+
+// configure resolves the server's settings from fs, which must have been
+// parsed, and cfg. Flags that were set take precedence over cfg.
+func (srv *Server) configure(fs *flag.FlagSet, cfg *Config) error {
+	srv.flags, srv.config = fs, cfg
+	fs.Visit(func(f *flag.Flag) { srv.serverFlags[f.Name] = true })
+	srv.configPath = flagValue[string](fs, "config")
+
+	srv.serverPort = flagValue[string](fs, "port")
+	if !srv.serverFlags["port"] && cfg.Port != "" {
+		srv.serverPort = cfg.Port
+	}
+	listen := cfg.Listen
+	if srv.serverFlags["listen"] {
+		listen = []string{flagValue[string](fs, "listen")}
+	}
+	var err error
+	if srv.serverListen, err = parseListen(listen); err != nil {
+		return fmt.Errorf("-listen: %v", err)
+	}
+	srv.adminSocket = flagValue[string](fs, "admin-socket")
+	if !srv.serverFlags["admin-socket"] && cfg.AdminSocket != "" {
+		srv.adminSocket = cfg.AdminSocket
+	}
+	srv.grpcPort = flagValue[string](fs, "grpc-port")
+	if !srv.serverFlags["grpc-port"] && cfg.GRPCPort != "" {
+		srv.grpcPort = cfg.GRPCPort
+	}
+	srv.mdnsEnabled, srv.mdnsName = flagValue[bool](fs, "mdns"), cfg.MDNS.Name
+	if !srv.serverFlags["mdns"] && cfg.MDNS.Enabled != nil {
+		srv.mdnsEnabled = *cfg.MDNS.Enabled
+	}
+	srv.tracingSettings = cfg.Tracing
+	if srv.serverFlags["otlp-endpoint"] {
+		srv.tracingSettings.Endpoint = flagValue[string](fs, "otlp-endpoint")
+	}
+	if srv.serverFlags["trace-sample"] || srv.tracingSettings.SampleRatio == nil {
+		ratio := flagValue[float64](fs, "trace-sample")
+		srv.tracingSettings.SampleRatio = &ratio
+	}
+	srv.tracingSettings = resolveTracing(srv.tracingSettings)
+	if r := *srv.tracingSettings.SampleRatio; r < 0 || r > 1 {
+		return fmt.Errorf("-trace-sample: must be between 0 and 1, got %v", r)
+	}
+	srv.probeInterval = flagValue[time.Duration](fs, "probe-interval")
+	if !srv.serverFlags["probe-interval"] && cfg.ProbeEvery > 0 {
+		srv.probeInterval = cfg.ProbeEvery
+	}
+	if srv.probeInterval <= 0 {
+		return errors.New("-probe-interval must be positive")
+	}
+	// Timeouts, limits, tokens and ACLs can be reloaded, so they are
+	// resolved by resolveSettings
+	settings, err := srv.resolveSettings(cfg)
+	if err != nil {
+		return err
+	}
+	srv.applySettings(settings)
+	srv.storeSpec = flagValue[string](fs, "store")
+	if !srv.serverFlags["store"] && cfg.Store != "" {
+		srv.storeSpec = cfg.Store
+	}
+	if _, _, err := parseStoreSpec(srv.storeSpec); err != nil {
+		return fmt.Errorf("-store: %v", err)
+	}
+	for _, p := range []struct {
+		path     *string
+		name     string
+		fromFile string
+	}{
+		{&srv.registryPath, "registry", cfg.Registry},
+		{&srv.schedulesPath, "schedules", cfg.Schedules},
+		{&srv.eventsPath, "events", cfg.Events},
+		{&srv.uptimeDir, "uptime-dir", cfg.UptimeDir},
+		{&srv.telemetryDir, "telemetry-dir", cfg.TelemetryDir},
+		{&srv.otaDir, "ota-dir", cfg.OTADir},
+		{&srv.usersPath, "users", cfg.Auth.Users},
+		{&srv.secretsPath, "secrets", cfg.Auth.Secrets},
+		{&srv.groupsPath, "groups", cfg.Groups},
+	} {
+		*p.path = flagValue[string](fs, p.name)
+		if !srv.serverFlags[p.name] && p.fromFile != "" {
+			*p.path = p.fromFile
+		}
+	}
+	srv.pushPath = cfg.WebPush.File
+
+	srv.setupNotifications(cfg.Notifications)
+	srv.setupWebhooks(cfg.Webhooks)
+	srv.setupSessions(cfg.Auth.Sessions)
+	srv.setupOIDC(cfg.Auth.OIDC)
+
+	srv.mqttSettings = cfg.MQTT
+	if srv.serverFlags["mqtt-broker"] {
+		srv.mqttSettings.Broker = flagValue[string](fs, "mqtt-broker")
+	}
+	if srv.mqttSettings.ClientID == "" {
+		srv.mqttSettings.ClientID = defaultMQTTClientID
+	}
+	if srv.mqttSettings.TopicPrefix == "" {
+		srv.mqttSettings.TopicPrefix = defaultMQTTPrefix
+	}
+	srv.mqttSettings.TopicPrefix = strings.Trim(srv.mqttSettings.TopicPrefix, "/")
+	if srv.mqttSettings.AvailabilityTopic == "" {
+		srv.mqttSettings.AvailabilityTopic = srv.mqttTopic("server", "availability")
+	}
+	if srv.mqttSettings.DiscoveryPrefix == "" {
+		srv.mqttSettings.DiscoveryPrefix = defaultDiscoveryPrefix
+	}
+
+	srv.clusterSettings = cfg.Cluster
+	if srv.serverFlags["cluster-redis"] {
+		srv.clusterSettings.Redis = flagValue[string](fs, "cluster-redis")
+	}
+	if srv.serverFlags["cluster-advertise"] {
+		srv.clusterSettings.Advertise = flagValue[string](fs, "cluster-advertise")
+	}
+	if srv.clusterSettings.Lease == 0 {
+		srv.clusterSettings.Lease = defaultClusterLease
+	}
+	if srv.clusterSettings.Prefix == "" {
+		srv.clusterSettings.Prefix = defaultClusterPrefix
+	}
+
+	srv.tlsCertFile = flagValue[string](fs, "tls-cert")
+	srv.tlsKeyFile = flagValue[string](fs, "tls-key")
+	if !srv.serverFlags["tls-cert"] && !srv.serverFlags["tls-key"] {
+		srv.tlsCertFile, srv.tlsKeyFile = cfg.TLS.Cert, cfg.TLS.Key
+	}
+	srv.acmeDomain = flagValue[string](fs, "acme-domain")
+	if !srv.serverFlags["acme-domain"] {
+		srv.acmeDomain = cfg.TLS.ACMEDomain
+	}
+	srv.acmeCacheDir = flagValue[string](fs, "acme-cache")
+	if !srv.serverFlags["acme-cache"] && cfg.TLS.ACMECache != "" {
+		srv.acmeCacheDir = cfg.TLS.ACMECache
+	}
+	srv.acmeEmail = flagValue[string](fs, "acme-email")
+	if !srv.serverFlags["acme-email"] {
+		srv.acmeEmail = cfg.TLS.ACMEEmail
+	}
+	// Connections the server makes itself (cluster peers, Redis, MQTT,
+	// Proxmox) trust the same CA as the client
+	caFile, insecure := flagValue[string](fs, "ca-cert"), flagValue[bool](fs, "insecure")
+	if !srv.serverFlags["ca-cert"] {
+		caFile = cfg.TLS.CA
+	}
+	if !srv.serverFlags["insecure"] {
+		insecure = cfg.TLS.Insecure
+	}
+	if srv.clientTLS, err = LoadClientTLS(caFile, insecure); err != nil {
+		return fmt.Errorf("could not load CA certificate: %v", err)
+	}
+	if srv.clientTLS != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = srv.clientTLS
+		srv.clientTransport = transport
+	}
+	srv.dataDir = flagValue[string](fs, "data-dir")
+	if !srv.serverFlags["data-dir"] && cfg.DataDir != "" {
+		srv.dataDir = cfg.DataDir
+	}
+	srv.applyDataDir()
+	if (srv.tlsCertFile == "") != (srv.tlsKeyFile == "") {
+		return errors.New("-tls-cert and -tls-key must be used together")
+	}
+	if srv.tlsCertFile != "" && srv.acmeDomain != "" {
+		return errors.New("-acme-domain cannot be combined with -tls-cert/-tls-key")
+	}
+	return nil
+}
+
+// Handler registers the API routes and returns the server's HTTP handler,
+// ready to serve from the stores as they are, without Run loading them.
+// It is for tests that serve the API themselves.
+func (srv *Server) Handler() http.Handler {
+	srv.registerAPI()
+	srv.serverReady.Store(true)
+	return srv.withCluster(srv.router)
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stubStore stands in for a store given to WithStore.
+type stubStore struct {
+	Store
+}
+
+func TestNewOptions(t *testing.T) {
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	RegisterFlags(fs)
+	if err := fs.Parse(nil); err != nil {
+		t.Fatal(err)
+	}
+	at := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	store := &stubStore{}
+	srv, err := New(fs, &Config{}, WithClock(func() time.Time { return at }), WithStore(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, mode, err := srv.openStore(); err != nil || got != store || mode != "custom" {
+		t.Errorf("openStore() = %v, %q, %v; want the store given to WithStore", got, mode, err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, APIPrefix+"/register", strings.NewReader(`{"id":"nas","power":"off"}`))
+	rec := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("register: %d %s", rec.Code, rec.Body)
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	esp := srv.espMap["nas"]
+	if esp == nil {
+		t.Fatal("nas not registered")
+	}
+	if !esp.LastSeen.Equal(at) {
+		t.Errorf("LastSeen = %v, want %v from WithClock", esp.LastSeen, at)
+	}
+}
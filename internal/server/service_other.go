@@ -0,0 +1,28 @@
+//go:build !windows
+
+package server
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// serviceState is what the server keeps for the Windows service manager,
+// nothing elsewhere.
+type serviceState struct{}
+
+// notifyShutdown relays the signals that stop the server: Ctrl-C and
+// SIGTERM from systemd, Docker or kill.
+func (srv *Server) notifyShutdown(ch chan<- os.Signal) {
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+}
+
+func (srv *Server) notifyReload(ch chan<- os.Signal) {
+	signal.Notify(ch, syscall.SIGHUP)
+}
+
+// Run serves until the process is told to stop.
+func (srv *Server) Run() {
+	srv.runServer()
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"cmp"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+)
+
+// On Windows the server can run under the service control manager. The
+// SCM's stop and shutdown requests are relayed like SIGTERM, and a
+// parameter change (sc control wake-on-demand paramchange) like SIGHUP.
+
+// ServiceName is the name the server is installed under as a Windows
+// service.
+const ServiceName = "wake-on-demand"
+
+// serviceState holds what the SCM's requests are relayed through.
+type serviceState struct {
+	// shutdownCh and reloadCh receive the SCM's requests while the server
+	// runs as a service
+	shutdownCh chan<- os.Signal
+	reloadCh   chan<- os.Signal
+}
+
+// A service has no console, so its output goes to a log file under
+// %ProgramData%. Set up before main parses the flags, so early errors end
+// up there too.
+func init() {
+	if isService, err := svc.IsWindowsService(); err != nil || !isService {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(ServiceLogPath()), 0o750); err != nil {
+		return
+	}
+	f, err := os.OpenFile(ServiceLogPath(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return
+	}
+	os.Stdout, os.Stderr = f, f
+}
+
+// ServiceDataDir is the -data-dir the service is installed with unless
+// other server flags are given.
+func ServiceDataDir() string {
+	return filepath.Join(cmp.Or(os.Getenv("ProgramData"), `C:\ProgramData`), "wake-on-demand")
+}
+
+// ServiceLogPath is where the service's output goes.
+func ServiceLogPath() string {
+	return filepath.Join(ServiceDataDir(), "server.log")
+}
+
+// notifyShutdown relays the events that stop the server: Ctrl-C and
+// Ctrl-Break (both os.Interrupt), closing the console, logging off and
+// system shutdown (syscall.SIGTERM), and the SCM's stop request. Windows
+// kills a console process a few seconds after a close event, so keep
+// -drain-timeout short when relying on it.
+func (srv *Server) notifyShutdown(ch chan<- os.Signal) {
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	srv.shutdownCh = ch
+}
+
+// notifyReload has no signal to watch on Windows; reloads come from the
+// SCM, the 'reload' command or the API.
+func (srv *Server) notifyReload(ch chan<- os.Signal) {
+	srv.reloadCh = ch
+}
+
+// send delivers sig without blocking; a request already pending covers it.
+func send(ch chan<- os.Signal, sig os.Signal) {
+	if ch == nil {
+		return
+	}
+	select {
+	case ch <- sig:
+	default:
+	}
+}
+
+// Run serves until the process is told to stop, under the service control
+// manager when it started the process.
+func (srv *Server) Run() {
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		srv.fatal("service", "Could not detect the service manager", "error", err)
+	}
+	if !isService {
+		srv.runServer()
+		return
+	}
+	if err := svc.Run(ServiceName, windowsService{srv}); err != nil {
+		srv.fatal("service", "Service failed", "error", err)
+	}
+}
+
+type windowsService struct {
+	srv *Server
+}
+
+func (w windowsService) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	srv := w.srv
+	svcLog := srv.logger("service")
+	status <- svc.Status{State: svc.StartPending}
+
+	done := make(chan struct{})
+	go func() {
+		srv.runServer()
+		close(done)
+	}()
+
+	const accepts = svc.AcceptStop | svc.AcceptShutdown | svc.AcceptParamChange
+	status <- svc.Status{State: svc.Running, Accepts: accepts}
+	svcLog.Info("Running as a Windows service", "name", ServiceName)
+	for {
+		select {
+		case <-done:
+			status <- svc.Status{State: svc.Stopped}
+			return false, 0
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending, WaitHint: uint32((srv.drainTimeout + 10*time.Second).Milliseconds())}
+				send(srv.shutdownCh, syscall.SIGTERM)
+			case svc.ParamChange:
+				send(srv.reloadCh, syscall.SIGHUP)
+				status <- svc.Status{State: svc.Running, Accepts: accepts}
+			}
+		}
+	}
+}
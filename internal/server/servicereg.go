@@ -0,0 +1,444 @@
+package server
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Service registration: with service_registry set, the server registers
+// itself in Consul or etcd once it is ready, so a service mesh or load
+// balancer can find it. Consul gets a service with a TTL check that the
+// server passes every TTL/3; etcd gets a key under a lease the server
+// keeps alive. If the server dies the check goes critical, or the key
+// expires, on its own. On shutdown the registration is removed before
+// in-flight requests drain, so nothing new is routed to the server. Both
+// are spoken over their HTTP APIs; a failed registration is retried and
+// never stops the server.
+
+const (
+	defaultConsulURL    = "http://127.0.0.1:8500"
+	defaultEtcdURL      = "http://127.0.0.1:2379"
+	defaultServiceName  = "wake-on-demand"
+	defaultServiceTTL   = 15 * time.Second
+	minServiceTTL       = 5 * time.Second
+	serviceRegTimeout   = 5 * time.Second
+	consulDeregisterTTL = 10 * time.Minute
+)
+
+// ServiceRegistrySettings configures registration. Token is Consul's ACL
+// token; Username and Password log in to etcd.
+type ServiceRegistrySettings struct {
+	Backend  string        `yaml:"backend"` // consul or etcd
+	URL      string        `yaml:"url"`
+	Token    string        `yaml:"token"`
+	Username string        `yaml:"username"`
+	Password string        `yaml:"password"`
+	Name     string        `yaml:"name"` // default wake-on-demand
+	ID       string        `yaml:"id"`   // default <name>-<hostname>-<port>
+	Address  string        `yaml:"address"`
+	Port     int           `yaml:"port"`
+	Tags     []string      `yaml:"tags"`
+	TTL      time.Duration `yaml:"ttl"`
+	// KeyPrefix is where etcd keys go, default /services/<name>/
+	KeyPrefix string `yaml:"key_prefix"`
+}
+
+func (s ServiceRegistrySettings) url() string {
+	if s.Backend == "etcd" {
+		return strings.TrimSuffix(cmp.Or(s.URL, defaultEtcdURL), "/")
+	}
+	return strings.TrimSuffix(cmp.Or(s.URL, defaultConsulURL), "/")
+}
+
+func (s ServiceRegistrySettings) ttl() time.Duration {
+	return cmp.Or(s.TTL, defaultServiceTTL)
+}
+
+func validateServiceRegistry(s ServiceRegistrySettings) []error {
+	var errs []error
+	if s.Backend == "" {
+		return nil
+	}
+	if s.Backend != "consul" && s.Backend != "etcd" {
+		errs = append(errs, fmt.Errorf("service_registry.backend: must be consul or etcd, got %q", s.Backend))
+	}
+	if u, err := url.Parse(s.url()); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, fmt.Errorf("service_registry.url: %q must be an http:// or https:// URL", s.URL))
+	}
+	if s.TTL != 0 && s.TTL < minServiceTTL {
+		errs = append(errs, fmt.Errorf("service_registry.ttl: must be at least %s, got %v", minServiceTTL, s.TTL))
+	}
+	if s.Port < 0 || s.Port > 65535 {
+		errs = append(errs, fmt.Errorf("service_registry.port: must be between 1 and 65535, got %d", s.Port))
+	}
+	return errs
+}
+
+// serviceInstance is what gets registered.
+type serviceInstance struct {
+	ID      string            `json:"id"`
+	Name    string            `json:"name"`
+	Address string            `json:"address,omitempty"`
+	Port    int               `json:"port"`
+	Tags    []string          `json:"tags,omitempty"`
+	Meta    map[string]string `json:"meta"`
+}
+
+// serviceBackend is Consul or etcd.
+type serviceBackend interface {
+	register(ctx context.Context, inst serviceInstance) error
+	// heartbeat renews the registration; errServiceGone means it has to be
+	// registered again
+	heartbeat(ctx context.Context, inst serviceInstance) error
+	deregister(ctx context.Context, inst serviceInstance) error
+}
+
+var errServiceGone = errors.New("registration is gone")
+
+// serviceStatusError is an error response from the backend, as opposed to
+// a network error.
+type serviceStatusError struct {
+	Status string
+	Body   string
+}
+
+func (e *serviceStatusError) Error() string { return e.Status + ": " + e.Body }
+
+// serviceregState holds the Server state kept in servicereg.go.
+type serviceregState struct {
+	serviceRegMu   sync.Mutex
+	serviceRegStop func() // set while registered
+	serviceHTTP    *http.Client
+}
+
+func (srv *Server) serviceRegistryEnabled() bool {
+	return srv.config.ServiceRegistry.Backend != ""
+}
+
+// startServiceRegistration registers the server, using the first listener
+// other hosts can reach for the port, and keeps the registration alive.
+func (srv *Server) startServiceRegistration(lns []net.Listener) {
+	s := srv.config.ServiceRegistry
+	dlog := srv.logger("discovery")
+	port, bindIP, _ := advertisedPort(lns)
+	port = cmp.Or(s.Port, port)
+	if port == 0 {
+		dlog.Warn("Not registering; no TCP listener outside loopback and no service_registry.port")
+		return
+	}
+	hostname, _ := os.Hostname()
+	hostname = cmp.Or(hostname, "localhost")
+	inst := serviceInstance{
+		Name:    cmp.Or(s.Name, defaultServiceName),
+		Address: s.Address,
+		Port:    port,
+		Tags:    s.Tags,
+		Meta:    map[string]string{"version": VERSION, "path": APIPrefix, "scheme": "http"},
+	}
+	inst.ID = cmp.Or(s.ID, fmt.Sprintf("%s-%s-%d", inst.Name, hostname, port))
+	if srv.tlsEnabled() {
+		inst.Meta["scheme"] = "https"
+	}
+	if inst.Address == "" && bindIP != nil {
+		inst.Address = bindIP.String()
+	}
+
+	var backend serviceBackend
+	switch s.Backend {
+	case "consul":
+		backend = &consulBackend{url: s.url(), token: s.Token, ttl: s.ttl(), srv: srv}
+	case "etcd":
+		if inst.Address == "" {
+			// Consul fills in the agent's address, etcd has nobody to ask
+			inst.Address = hostname
+		}
+		backend = &etcdBackend{url: s.url(), username: s.Username, password: s.Password, ttl: s.ttl(),
+			key: cmp.Or(s.KeyPrefix, "/services/"+inst.Name+"/") + inst.ID, srv: srv}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	var registered bool
+	go func() {
+		defer close(done)
+		registered = srv.runServiceRegistration(ctx, s.Backend, backend, inst, s.ttl())
+	}()
+	srv.serviceRegMu.Lock()
+	srv.serviceRegStop = func() {
+		cancel()
+		<-done
+		if !registered {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), serviceRegTimeout)
+		defer cancel()
+		if err := backend.deregister(ctx, inst); err != nil {
+			dlog.Warn("Could not deregister", "backend", s.Backend, "id", inst.ID, "error", err)
+			return
+		}
+		dlog.Info("Deregistered", "backend", s.Backend, "id", inst.ID)
+	}
+	srv.serviceRegMu.Unlock()
+}
+
+// stopServiceRegistration removes the registration. It is called when the
+// server starts draining.
+func (srv *Server) stopServiceRegistration() {
+	srv.serviceRegMu.Lock()
+	stop := srv.serviceRegStop
+	srv.serviceRegStop = nil
+	srv.serviceRegMu.Unlock()
+	if stop != nil {
+		stop()
+	}
+}
+
+// runServiceRegistration registers inst and renews it every ttl/3 until
+// ctx is cancelled, registering again whenever the backend lost it. It
+// reports whether inst was registered at the end.
+func (srv *Server) runServiceRegistration(ctx context.Context, name string, backend serviceBackend, inst serviceInstance, ttl time.Duration) bool {
+	dlog := srv.logger("discovery").With("backend", name, "id", inst.ID)
+	ticker := time.NewTicker(ttl / 3)
+	defer ticker.Stop()
+
+	registered, failing := false, false
+	for {
+		var err error
+		if registered {
+			if err = backend.heartbeat(ctx, inst); errors.Is(err, errServiceGone) {
+				dlog.Warn("Registration lost, registering again", "error", err)
+				registered = false
+			}
+		}
+		if !registered {
+			if err = backend.register(ctx, inst); err == nil {
+				registered = true
+				dlog.Info("Registered", "name", inst.Name, "address", inst.Address, "port", inst.Port, "ttl", ttl.String())
+			}
+		}
+		switch {
+		case err != nil && ctx.Err() != nil:
+			return registered
+		case err != nil && !failing:
+			dlog.Warn("Service registration failed, retrying", "error", err)
+			failing = true
+		case err == nil && failing:
+			dlog.Info("Service registration recovered")
+			failing = false
+		}
+
+		select {
+		case <-ctx.Done():
+			return registered
+		case <-ticker.C:
+		}
+	}
+}
+
+// serviceRequest sends a JSON request and decodes a JSON reply into out.
+// A 404 is errServiceGone.
+func (srv *Server) serviceRequest(ctx context.Context, method, target string, header http.Header, body, out interface{}) error {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, r)
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := srv.serviceHTTP.Do(req)
+	if err != nil {
+		// The URL may carry credentials
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			err = uerr.Err
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return fmt.Errorf("%w: %s", errServiceGone, bytes.TrimSpace(data))
+	case resp.StatusCode >= 300:
+		return &serviceStatusError{Status: resp.Status, Body: string(bytes.TrimSpace(data))}
+	case out != nil:
+		return json.Unmarshal(data, out)
+	}
+	return nil
+}
+
+// --- Consul ---
+
+type consulBackend struct {
+	url   string
+	token string
+	ttl   time.Duration
+	srv   *Server
+}
+
+func (c *consulBackend) header() http.Header {
+	h := make(http.Header)
+	if c.token != "" {
+		h.Set("X-Consul-Token", c.token)
+	}
+	return h
+}
+
+func (c *consulBackend) register(ctx context.Context, inst serviceInstance) error {
+	body := map[string]interface{}{
+		"ID":      inst.ID,
+		"Name":    inst.Name,
+		"Address": inst.Address,
+		"Port":    inst.Port,
+		"Tags":    inst.Tags,
+		"Meta":    inst.Meta,
+		"Check": map[string]interface{}{
+			"CheckID":                        "service:" + inst.ID,
+			"Name":                           "wake-on-demand TTL",
+			"TTL":                            c.ttl.String(),
+			"Status":                         "passing",
+			"DeregisterCriticalServiceAfter": consulDeregisterTTL.String(),
+		},
+	}
+	return c.srv.serviceRequest(ctx, http.MethodPut, c.url+"/v1/agent/service/register", c.header(), body, nil)
+}
+
+func (c *consulBackend) heartbeat(ctx context.Context, inst serviceInstance) error {
+	body := map[string]string{"Status": "passing", "Output": "ready, version " + VERSION}
+	err := c.srv.serviceRequest(ctx, http.MethodPut, c.url+"/v1/agent/check/update/"+url.PathEscape("service:"+inst.ID), c.header(), body, nil)
+	// Depending on the version Consul answers 404 or 500 for a check it
+	// doesn't know, e.g. after the agent lost its state. Registering again
+	// is harmless either way.
+	var status *serviceStatusError
+	if errors.As(err, &status) {
+		return fmt.Errorf("%w: %v", errServiceGone, err)
+	}
+	return err
+}
+
+func (c *consulBackend) deregister(ctx context.Context, inst serviceInstance) error {
+	return c.srv.serviceRequest(ctx, http.MethodPut, c.url+"/v1/agent/service/deregister/"+url.PathEscape(inst.ID), c.header(), nil, nil)
+}
+
+// --- etcd ---
+
+// etcdBackend uses the v3 JSON gateway. Keys and values are base64, and
+// 64-bit numbers are strings.
+type etcdBackend struct {
+	url      string
+	username string
+	password string
+	ttl      time.Duration
+	key      string
+
+	lease string
+	token string
+	srv   *Server
+}
+
+func (e *etcdBackend) call(ctx context.Context, path string, body, out interface{}) error {
+	h := make(http.Header)
+	if e.token != "" {
+		h.Set("Authorization", e.token)
+	}
+	err := e.srv.serviceRequest(ctx, http.MethodPost, e.url+path, h, body, out)
+	if err != nil && e.username != "" && strings.Contains(err.Error(), "invalid auth token") {
+		// Tokens expire; log in again once
+		if err = e.authenticate(ctx); err == nil {
+			h.Set("Authorization", e.token)
+			err = e.srv.serviceRequest(ctx, http.MethodPost, e.url+path, h, body, out)
+		}
+	}
+	return err
+}
+
+func (e *etcdBackend) authenticate(ctx context.Context) error {
+	var resp struct {
+		Token string `json:"token"`
+	}
+	body := map[string]string{"name": e.username, "password": e.password}
+	if err := e.srv.serviceRequest(ctx, http.MethodPost, e.url+"/v3/auth/authenticate", nil, body, &resp); err != nil {
+		return fmt.Errorf("etcd login: %w", err)
+	}
+	e.token = resp.Token
+	return nil
+}
+
+func (e *etcdBackend) register(ctx context.Context, inst serviceInstance) error {
+	if e.username != "" && e.token == "" {
+		if err := e.authenticate(ctx); err != nil {
+			return err
+		}
+	}
+	var grant struct {
+		ID string `json:"ID"`
+	}
+	if err := e.call(ctx, "/v3/lease/grant", map[string]int64{"TTL": int64(e.ttl.Seconds())}, &grant); err != nil {
+		return err
+	}
+	if grant.ID == "" {
+		return errors.New("etcd granted no lease")
+	}
+	value, err := json.Marshal(inst)
+	if err != nil {
+		return err
+	}
+	put := map[string]string{
+		"key":   base64.StdEncoding.EncodeToString([]byte(e.key)),
+		"value": base64.StdEncoding.EncodeToString(value),
+		"lease": grant.ID,
+	}
+	if err := e.call(ctx, "/v3/kv/put", put, nil); err != nil {
+		return err
+	}
+	e.lease = grant.ID
+	return nil
+}
+
+func (e *etcdBackend) heartbeat(ctx context.Context, inst serviceInstance) error {
+	var resp struct {
+		Result struct {
+			TTL string `json:"TTL"`
+		} `json:"result"`
+	}
+	if err := e.call(ctx, "/v3/lease/keepalive", map[string]string{"ID": e.lease}, &resp); err != nil {
+		return err
+	}
+	// An expired lease is kept alive with a TTL of 0 (or none at all), and
+	// the key went with it
+	if ttl, _ := strconv.ParseInt(resp.Result.TTL, 10, 64); ttl <= 0 {
+		return errServiceGone
+	}
+	return nil
+}
+
+func (e *etcdBackend) deregister(ctx context.Context, inst serviceInstance) error {
+	if e.lease == "" {
+		return nil
+	}
+	// Revoking the lease deletes the key
+	return e.call(ctx, "/v3/lease/revoke", map[string]string{"ID": e.lease}, nil)
+}
@@ -0,0 +1,258 @@
+package server
+
+import (
+	"cmp"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Browser sessions let people sign in to the dashboard with a password or
+// through an OIDC provider instead of pasting an API token into the page.
+// A session is a random cookie backed by server memory, so restarting the
+// server signs everyone out. Requests carrying a bearer token never look
+// at the cookie, and ESP endpoints never accept one.
+
+const (
+	sessionCookie     = "wod_session"
+	csrfHeader        = "X-CSRF-Token"
+	defaultSessionTTL = 12 * time.Hour
+)
+
+type SessionSettings struct {
+	TTL time.Duration `yaml:"ttl"`
+	// SecureCookie marks the cookie Secure behind a TLS-terminating proxy;
+	// it is always set when the server itself serves HTTPS
+	SecureCookie bool `yaml:"secure_cookie"`
+}
+
+// session is who a cookie belongs to. Local users and the admin key are
+// looked up again on every request, so removing a user or rotating the key
+// ends their sessions.
+type session struct {
+	id      string
+	csrf    string
+	user    string     // local user
+	keyHash string     // hash of the admin key it was opened with
+	remote  *principal // OIDC identity without a local user
+	expires time.Time
+}
+
+// sessionState holds the Server state kept in session.go.
+type sessionState struct {
+	sessionsMu      sync.Mutex
+	sessions        map[string]*session
+	sessionSettings SessionSettings
+}
+
+func (srv *Server) setupSessions(s SessionSettings) {
+	if s.TTL <= 0 {
+		s.TTL = defaultSessionTTL
+	}
+	srv.sessionsMu.Lock()
+	srv.sessionSettings = s
+	srv.sessionsMu.Unlock()
+}
+
+func randomToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// startSession opens a session for s and sets its cookie.
+func (srv *Server) startSession(w http.ResponseWriter, r *http.Request, s *session) {
+	now := srv.now()
+	srv.sessionsMu.Lock()
+	for id, old := range srv.sessions {
+		if now.After(old.expires) {
+			delete(srv.sessions, id)
+		}
+	}
+	s.id, s.csrf = randomToken(), randomToken()
+	s.expires = now.Add(srv.sessionSettings.TTL)
+	srv.sessions[s.id] = s
+	secure := srv.sessionSettings.SecureCookie
+	srv.sessionsMu.Unlock()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    s.id,
+		Path:     "/",
+		Expires:  s.expires,
+		HttpOnly: true,
+		Secure:   secure || r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (srv *Server) requestSession(r *http.Request) *session {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil
+	}
+	srv.sessionsMu.Lock()
+	defer srv.sessionsMu.Unlock()
+	s, exists := srv.sessions[cookie.Value]
+	if !exists {
+		return nil
+	}
+	if srv.now().After(s.expires) {
+		delete(srv.sessions, s.id)
+		return nil
+	}
+	return s
+}
+
+func (srv *Server) endSession(w http.ResponseWriter, r *http.Request) {
+	if s := srv.requestSession(r); s != nil {
+		srv.sessionsMu.Lock()
+		delete(srv.sessions, s.id)
+		srv.sessionsMu.Unlock()
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+}
+
+// principal returns who the session acts as, or nil once it no longer
+// stands for anyone.
+func (s *session) principal(srv *Server) *principal {
+	switch {
+	case s.user != "":
+		srv.usersMu.Lock()
+		defer srv.usersMu.Unlock()
+		u, exists := srv.users[s.user]
+		if !exists {
+			return nil
+		}
+		return u.principal()
+	case s.keyHash != "":
+		key := srv.currentAuth().AdminKey
+		if key == "" || !tokenMatches(hashToken(key), s.keyHash) {
+			return nil
+		}
+		return adminPrincipal
+	}
+	return s.remote
+}
+
+// sessionPrincipal authenticates a request by its session cookie. Requests
+// that change anything must echo the session's CSRF token in a header; when
+// one doesn't, sessionPrincipal writes a 403 and returns false.
+func (srv *Server) sessionPrincipal(w http.ResponseWriter, r *http.Request) (*principal, bool) {
+	s := srv.requestSession(r)
+	if s == nil {
+		return nil, true
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+	default:
+		if !tokenMatches(r.Header.Get(csrfHeader), s.csrf) {
+			srv.requestLogger(r).Warn("Session request without a valid CSRF token")
+			writeError(w, CodeForbidden, "missing or invalid "+csrfHeader+" header")
+			return nil, false
+		}
+	}
+	return s.principal(srv), true
+}
+
+// sessionStatus is what the dashboard asks for before showing anything.
+type sessionStatus struct {
+	AuthRequired  bool       `json:"auth_required"`
+	OIDC          bool       `json:"oidc"`
+	Authenticated bool       `json:"authenticated"`
+	Name          string     `json:"name,omitempty"`
+	Role          Role       `json:"role,omitempty"`
+	CSRFToken     string     `json:"csrf_token,omitempty"`
+	ExpiresAt     *time.Time `json:"expires_at,omitempty"`
+}
+
+func (srv *Server) writeSessionStatus(w http.ResponseWriter, s *session) {
+	status := sessionStatus{AuthRequired: srv.authEnabled(), OIDC: srv.oidcEnabled()}
+	if s != nil {
+		if p := s.principal(srv); p != nil {
+			status.Authenticated = true
+			status.Name, status.Role = p.Name, p.Role
+			status.CSRFToken = s.csrf
+			status.ExpiresAt = &s.expires
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(status)
+}
+
+// sessionHandler serves GET /ui/session.
+func (srv *Server) sessionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, CodeMethodNotAllowed, "only GET allowed")
+		return
+	}
+	srv.writeSessionStatus(w, srv.requestSession(r))
+}
+
+// loginHandler serves POST /ui/login with a user name and password, or
+// with an admin key or user token for accounts without a password.
+func (srv *Server) loginHandler(w http.ResponseWriter, r *http.Request) {
+	rlog := srv.requestLogger(r)
+	if r.Method != http.MethodPost {
+		writeError(w, CodeMethodNotAllowed, "only POST allowed")
+		return
+	}
+
+	var data struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+		Key      string `json:"key"`
+	}
+	if err := decodeJSON(w, r, &data); err != nil {
+		rlog.Warn("Invalid JSON", "error", err)
+		return
+	}
+
+	s := &session{}
+	switch {
+	case data.Username != "":
+		if !srv.checkPassword(data.Username, data.Password) {
+			rlog.Warn("Failed dashboard login", "user", data.Username)
+			writeError(w, CodeUnauthorized, "invalid user name or password")
+			return
+		}
+		s.user = data.Username
+	case data.Key != "":
+		p := srv.authenticate(data.Key)
+		if p == nil {
+			rlog.Warn("Failed dashboard login with a key")
+			writeError(w, CodeUnauthorized, "invalid admin key or user token")
+			return
+		}
+		if p == adminPrincipal {
+			s.keyHash = hashToken(data.Key)
+		} else {
+			s.user = p.Name
+		}
+	default:
+		writeError(w, CodeInvalidRequest, "username and password, or key, are required")
+		return
+	}
+
+	srv.startSession(w, r, s)
+	rlog.Info("Dashboard login", "user", cmp.Or(s.user, adminPrincipal.Name))
+	srv.writeSessionStatus(w, s)
+}
+
+// logoutHandler serves POST /ui/logout.
+func (srv *Server) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, CodeMethodNotAllowed, "only POST allowed")
+		return
+	}
+	if s := srv.requestSession(r); s != nil && !tokenMatches(r.Header.Get(csrfHeader), s.csrf) {
+		writeError(w, CodeForbidden, "missing or invalid "+csrfHeader+" header")
+		return
+	}
+	srv.endSession(w, r)
+	srv.writeSessionStatus(w, nil)
+}
@@ -0,0 +1,36 @@
+package server
+
+import (
+	"sync"
+)
+
+// shutdownState holds the Server state kept in shutdown.go.
+type shutdownState struct {
+	shutdownMu    sync.Mutex
+	shutdownHooks []shutdownHook
+}
+
+type shutdownHook struct {
+	name string
+	fn   func()
+}
+
+// onShutdown registers fn to run after the HTTP server has drained.
+// Hooks run in reverse registration order, like defers.
+func (srv *Server) onShutdown(name string, fn func()) {
+	srv.shutdownMu.Lock()
+	srv.shutdownHooks = append(srv.shutdownHooks, shutdownHook{name: name, fn: fn})
+	srv.shutdownMu.Unlock()
+}
+
+func (srv *Server) runShutdownHooks() {
+	srv.shutdownMu.Lock()
+	hooks := srv.shutdownHooks
+	srv.shutdownHooks = nil
+	srv.shutdownMu.Unlock()
+
+	for i := len(hooks) - 1; i >= 0; i-- {
+		srv.logger("shutdown").Info("Running hook", "hook", hooks[i].name)
+		hooks[i].fn()
+	}
+}
@@ -0,0 +1,316 @@
+package server
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	regstore "github.com/smileyfaceskobochka/trashbin-daemon/internal/registry"
+)
+
+// Signed requests: an ESP with a device secret signs every request with
+// HMAC-SHA256 over the method, path, query, a timestamp, a nonce and the
+// body's hash. The server checks the signature, rejects timestamps outside
+// signatureWindow and nonces it has seen within it. Secrets are issued by
+// an admin ('wake-on-demand secret issue') and flashed onto the device;
+// once an ESP has one, its unsigned requests are rejected.
+
+const (
+	TimestampHeader = "X-WOD-Timestamp"
+	NonceHeader     = "X-WOD-Nonce"
+	SignatureHeader = "X-WOD-Signature"
+
+	signatureWindow = 5 * time.Minute
+	minNonceLength  = 8
+	maxNonceLength  = 64
+)
+
+// DeviceSecret is the shared secret of one ESP.
+type DeviceSecret struct {
+	ID        string     `json:"id"`
+	Secret    string     `json:"secret"`
+	CreatedAt time.Time  `json:"created_at"`
+	LastUsed  *time.Time `json:"last_used,omitempty"`
+}
+
+// DeviceSecretInfo is a secret as listed, without the secret itself.
+type DeviceSecretInfo struct {
+	ID        string     `json:"id"`
+	CreatedAt time.Time  `json:"created_at"`
+	LastUsed  *time.Time `json:"last_used,omitempty"`
+}
+
+// signingState holds the Server state kept in signing.go.
+type signingState struct {
+	secretsMu     sync.Mutex
+	secretsPath   string
+	deviceSecrets map[string]*DeviceSecret
+
+	// seenNonces maps id+nonce to when it was used, for replay protection
+	seenNonces    map[string]time.Time
+	lastNonceScan time.Time
+
+	// requireSigned rejects unsigned requests from every ESP, not only
+	// those with a secret. Guarded by settingsMu.
+	requireSigned bool
+}
+
+var (
+	errSignatureMissing = errors.New("signed request required")
+	errSignatureInvalid = errors.New("invalid request signature")
+	errSignatureStale   = fmt.Errorf("timestamp more than %s from server time", signatureWindow)
+	errSignatureReplay  = errors.New("nonce already used")
+)
+
+func newDeviceSecret() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// SignRequest computes the signature of a request. The secret's text is the
+// HMAC key.
+func SignRequest(secret, method, path, rawQuery, timestamp, nonce string, body []byte) string {
+	sum := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%s\n%s", method, path, rawQuery, timestamp, nonce, hex.EncodeToString(sum[:]))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (srv *Server) loadDeviceSecrets() {
+	if srv.secretsPath == "" {
+		return
+	}
+
+	data, err := os.ReadFile(srv.secretsPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		srv.fatal("secrets", "Failed to load device secrets", "error", err)
+	}
+
+	var list []*DeviceSecret
+	if err := json.Unmarshal(data, &list); err != nil {
+		srv.fatal("secrets", "Failed to parse device secrets", "path", srv.secretsPath, "error", err)
+	}
+
+	srv.secretsMu.Lock()
+	defer srv.secretsMu.Unlock()
+	for _, s := range list {
+		srv.deviceSecrets[s.ID] = s
+	}
+	srv.logger("secrets").Info("Device secrets loaded", "count", len(srv.deviceSecrets), "path", srv.secretsPath)
+}
+
+// saveDeviceSecrets must be called with secretsMu held.
+func (srv *Server) saveDeviceSecrets() {
+	if srv.secretsPath == "" {
+		return
+	}
+
+	list := make([]*DeviceSecret, 0, len(srv.deviceSecrets))
+	for _, s := range srv.deviceSecrets {
+		list = append(list, s)
+	}
+	slices.SortFunc(list, func(a, b *DeviceSecret) int { return cmp.Compare(a.ID, b.ID) })
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		srv.logger("secrets").Error("Failed to encode device secrets", "error", err)
+		return
+	}
+	if err := regstore.WriteFileAtomic(srv.secretsPath, data); err != nil {
+		srv.logger("secrets").Error("Failed to save device secrets", "error", err)
+	}
+}
+
+// deviceSecret returns the secret of id, if it has one.
+func (srv *Server) deviceSecret(id string) (string, bool) {
+	srv.secretsMu.Lock()
+	defer srv.secretsMu.Unlock()
+	s, exists := srv.deviceSecrets[id]
+	if !exists {
+		return "", false
+	}
+	return s.Secret, true
+}
+
+// verifySignature checks the signature headers of a request from id. It
+// reads the body and leaves an unread copy behind for the handler.
+func (srv *Server) verifySignature(r *http.Request, id, secret string) error {
+	timestamp, nonce, signature := r.Header.Get(TimestampHeader), r.Header.Get(NonceHeader), r.Header.Get(SignatureHeader)
+	if timestamp == "" || nonce == "" || signature == "" {
+		return errSignatureMissing
+	}
+	secs, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: bad %s", errSignatureInvalid, TimestampHeader)
+	}
+	now := srv.now()
+	if skew := now.Sub(time.Unix(secs, 0)); skew > signatureWindow || skew < -signatureWindow {
+		return errSignatureStale
+	}
+	if len(nonce) < minNonceLength || len(nonce) > maxNonceLength {
+		return fmt.Errorf("%w: %s must be %d to %d characters", errSignatureInvalid, NonceHeader, minNonceLength, maxNonceLength)
+	}
+
+	var body []byte
+	if r.Body != nil {
+		body, err = io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), errorReader{err}))
+			return err
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	want := SignRequest(secret, r.Method, r.URL.Path, r.URL.RawQuery, timestamp, nonce, body)
+	if !hmac.Equal([]byte(signature), []byte(want)) {
+		return errSignatureInvalid
+	}
+
+	// Only a valid signature uses up its nonce
+	return srv.useNonce(id, nonce, now)
+}
+
+// useNonce records a nonce of id, or fails if it was used within the
+// signature window, and marks the secret used.
+func (srv *Server) useNonce(id, nonce string, now time.Time) error {
+	srv.secretsMu.Lock()
+	defer srv.secretsMu.Unlock()
+	if now.Sub(srv.lastNonceScan) > time.Minute {
+		for key, used := range srv.seenNonces {
+			if now.Sub(used) > 2*signatureWindow {
+				delete(srv.seenNonces, key)
+			}
+		}
+		srv.lastNonceScan = now
+	}
+	key := id + "\x00" + nonce
+	if _, seen := srv.seenNonces[key]; seen {
+		return errSignatureReplay
+	}
+	srv.seenNonces[key] = now
+	if s, exists := srv.deviceSecrets[id]; exists {
+		s.LastUsed = &now
+	}
+	return nil
+}
+
+// checkSignature authenticates an ESP request by its signature when the ESP
+// has a secret, or when signing is required of every ESP. The secret is
+// the one of espID(r), the device the handler acts for, which withAuth has
+// checked the query and body agree on. It writes the error response
+// itself. The second result reports whether the request was signed, so the
+// ESP's token isn't needed as well.
+func (srv *Server) checkSignature(w http.ResponseWriter, r *http.Request) (ok, signed bool) {
+	id := espID(r)
+	secret, exists := srv.deviceSecret(id)
+	if !exists {
+		srv.settingsMu.RLock()
+		required := srv.requireSigned
+		srv.settingsMu.RUnlock()
+		if !required {
+			return true, false
+		}
+	}
+	err := errSignatureMissing
+	if exists {
+		err = srv.verifySignature(r, id, secret)
+	}
+	if err == nil {
+		return true, true
+	}
+
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeError(w, CodeTooLarge, fmt.Sprintf("request body too large (limit %d bytes)", tooLarge.Limit))
+		return false, false
+	}
+	srv.requestLogger(r).Warn("Rejected ESP request signature", "esp_id", id, "error", err)
+	srv.recordEvent(Event{Type: EventRejected, ESPID: id, Actor: srv.requestActor(r), Detail: err.Error()})
+	w.Header().Set("WWW-Authenticate", `WOD-HMAC realm="wake-on-demand"`)
+	writeError(w, CodeSignatureInvalid, err.Error())
+	return false, false
+}
+
+// secretsHandler lists (GET), issues (POST) and revokes (DELETE) device
+// secrets. Issuing replaces any secret the ESP had.
+func (srv *Server) secretsHandler(w http.ResponseWriter, r *http.Request) {
+	rlog := srv.requestLogger(r)
+
+	switch r.Method {
+	case http.MethodGet:
+		srv.secretsMu.Lock()
+		list := make([]DeviceSecretInfo, 0, len(srv.deviceSecrets))
+		for _, s := range srv.deviceSecrets {
+			list = append(list, DeviceSecretInfo{ID: s.ID, CreatedAt: s.CreatedAt, LastUsed: s.LastUsed})
+		}
+		srv.secretsMu.Unlock()
+		slices.SortFunc(list, func(a, b DeviceSecretInfo) int { return cmp.Compare(a.ID, b.ID) })
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string][]DeviceSecretInfo{"secrets": list})
+
+	case http.MethodPost:
+		var data struct {
+			ID string `json:"id"`
+		}
+		if err := decodeJSON(w, r, &data); err != nil {
+			rlog.Warn("Invalid JSON", "error", err)
+			return
+		}
+		data.ID = srv.resolveAlias(data.ID)
+		if err := validateESPID(data.ID); err != nil {
+			writeError(w, CodeInvalidRequest, err.Error())
+			return
+		}
+
+		secret := &DeviceSecret{ID: data.ID, Secret: newDeviceSecret(), CreatedAt: srv.now()}
+		srv.secretsMu.Lock()
+		_, replaced := srv.deviceSecrets[data.ID]
+		srv.deviceSecrets[data.ID] = secret
+		srv.saveDeviceSecrets()
+		srv.secretsMu.Unlock()
+
+		rlog.Info("Device secret issued", "esp_id", data.ID, "replaced", replaced)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": data.ID, "secret": secret.Secret, "replaced": replaced})
+
+	case http.MethodDelete:
+		id := srv.resolveAlias(r.URL.Query().Get("id"))
+
+		srv.secretsMu.Lock()
+		_, exists := srv.deviceSecrets[id]
+		delete(srv.deviceSecrets, id)
+		if exists {
+			srv.saveDeviceSecrets()
+		}
+		srv.secretsMu.Unlock()
+
+		if !exists {
+			writeError(w, CodeNotFound, "no secret for this ESP")
+			return
+		}
+		rlog.Info("Device secret revoked", "esp_id", id)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "revoked", "id": id})
+
+	default:
+		writeError(w, CodeMethodNotAllowed, "only GET, POST or DELETE allowed")
+	}
+}
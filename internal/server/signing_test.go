@@ -0,0 +1,109 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newSigningServer returns a server with the given device secrets.
+func newSigningServer(secrets map[string]string) *Server {
+	srv := newServer()
+	for id, secret := range secrets {
+		srv.deviceSecrets[id] = &DeviceSecret{ID: id, Secret: secret}
+	}
+	return srv
+}
+
+// signedRequest builds a POST signed with secret, or unsigned when secret
+// is empty.
+func signedRequest(secret, target, body, nonce string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+	if secret != "" {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(TimestampHeader, ts)
+		req.Header.Set(NonceHeader, nonce)
+		req.Header.Set(SignatureHeader, SignRequest(secret, req.Method, req.URL.Path, req.URL.RawQuery, ts, nonce, []byte(body)))
+	}
+	return req
+}
+
+func TestCheckSignature(t *testing.T) {
+	srv := newSigningServer(map[string]string{"nas": "secret-nas", "other": "secret-other"})
+
+	for _, tc := range []struct {
+		name       string
+		id         string
+		secret     string
+		required   bool
+		wantOK     bool
+		wantSigned bool
+	}{
+		{name: "signed with the device's secret", id: "nas", secret: "secret-nas", wantOK: true, wantSigned: true},
+		{name: "unsigned from a device with a secret", id: "nas"},
+		{name: "signed with another device's secret", id: "nas", secret: "secret-other"},
+		{name: "unsigned from a device without a secret", id: "open", wantOK: true},
+		{name: "unsigned when signing is required", id: "open", required: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv.requireSigned = tc.required
+
+			req := signedRequest(tc.secret, "/command-ack", `{"id":"`+tc.id+`"}`, "nonce-"+tc.name)
+			req = req.WithContext(context.WithValue(req.Context(), espIDKey{}, tc.id))
+			rec := httptest.NewRecorder()
+			ok, signed := srv.checkSignature(rec, req)
+			if ok != tc.wantOK || signed != tc.wantSigned {
+				t.Errorf("checkSignature = %v, %v, want %v, %v (%s)", ok, signed, tc.wantOK, tc.wantSigned, rec.Body.String())
+			}
+			if !ok && rec.Code != http.StatusUnauthorized {
+				t.Errorf("status = %d, want %d", rec.Code, http.StatusUnauthorized)
+			}
+		})
+	}
+}
+
+func TestCheckSignatureReplay(t *testing.T) {
+	srv := newSigningServer(map[string]string{"nas": "secret-nas"})
+
+	for i, wantOK := range []bool{true, false} {
+		req := signedRequest("secret-nas", "/command?id=nas", "", "same-nonce")
+		req = req.WithContext(context.WithValue(req.Context(), espIDKey{}, "nas"))
+		if ok, _ := srv.checkSignature(httptest.NewRecorder(), req); ok != wantOK {
+			t.Errorf("request %d: ok = %v, want %v", i+1, ok, wantOK)
+		}
+	}
+}
+
+// The signature is checked against the device the handler acts for, so a
+// request signed by one device can't name another in its body.
+func TestWithAuthSignedIDs(t *testing.T) {
+	srv := newSigningServer(map[string]string{"nas": "secret-nas", "other": "secret-other"})
+
+	for _, tc := range []struct {
+		name   string
+		target string
+		body   string
+		secret string
+		want   int
+	}{
+		{name: "body id", target: "/register", body: `{"id":"nas"}`, secret: "secret-nas", want: http.StatusOK},
+		{name: "query and body agree", target: "/register?id=nas", body: `{"id":"nas"}`, secret: "secret-nas", want: http.StatusOK},
+		{name: "signed by the query's device, body names another", target: "/register?id=other", body: `{"id":"nas"}`, secret: "secret-other", want: http.StatusBadRequest},
+		{name: "device without a secret in the query, signed device in the body", target: "/register?id=open", body: `{"id":"nas"}`, secret: "secret-nas", want: http.StatusBadRequest},
+		{name: "unsigned, naming a device with a secret", target: "/register", body: `{"id":"nas"}`, want: http.StatusUnauthorized},
+		{name: "signed by another device", target: "/register", body: `{"id":"nas"}`, secret: "secret-other", want: http.StatusUnauthorized},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := srv.withAuth(scopeESP, func(w http.ResponseWriter, r *http.Request) {})
+			rec := httptest.NewRecorder()
+			h(rec, signedRequest(tc.secret, tc.target, tc.body, "nonce-"+tc.name))
+			if rec.Code != tc.want {
+				t.Errorf("status = %d, want %d (%s)", rec.Code, tc.want, rec.Body.String())
+			}
+		})
+	}
+}
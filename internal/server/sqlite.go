@@ -0,0 +1,357 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteStore keeps the server's state in one SQLite database, including
+// the command queues, which the file store drops on restart. Rows hold the
+// same JSON the files do; only the columns queries need are broken out.
+type sqliteStore struct {
+	db   *sql.DB
+	path string
+
+	// saved is the JSON last written for each ESP and queue, so a save
+	// only writes the rows that changed
+	saved       map[string]string
+	savedQueues map[string]string
+}
+
+const sqliteSchemaVersion = 1
+
+const sqliteSchema = `
+CREATE TABLE esps (
+	id   TEXT PRIMARY KEY,
+	data TEXT NOT NULL
+);
+CREATE TABLE queued_commands (
+	esp_id   TEXT PRIMARY KEY,
+	commands TEXT NOT NULL
+);
+CREATE TABLE schedules (
+	id   TEXT PRIMARY KEY,
+	data TEXT NOT NULL
+);
+CREATE TABLE events (
+	seq    INTEGER PRIMARY KEY,
+	time   TEXT NOT NULL,
+	type   TEXT NOT NULL,
+	esp_id TEXT NOT NULL,
+	data   TEXT NOT NULL
+);
+CREATE INDEX events_esp_id ON events (esp_id, seq);
+`
+
+// openSQLiteStore opens or creates the database at path. A new database
+// imports whatever the file store has at the configured paths, so
+// switching backends keeps the devices, schedules and events.
+func (srv *Server) openSQLiteStore(path string) (*sqliteStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return nil, err
+	}
+	dsn := "file:" + path + "?" + url.Values{"_pragma": {"busy_timeout(5000)", "journal_mode(WAL)", "foreign_keys(1)"}}.Encode()
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	// Saves are serialized by the callers' locks anyway
+	db.SetMaxOpenConns(1)
+
+	s := &sqliteStore{db: db, path: path, saved: make(map[string]string), savedQueues: make(map[string]string)}
+	created, err := s.migrate()
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("open %s: %w", path, err)
+	}
+	if created {
+		if err := s.importFiles(srv, srv.newFileStore(srv.registryPath, srv.schedulesPath, srv.eventsPath)); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("import into %s: %w", path, err)
+		}
+	}
+	return s, nil
+}
+
+// migrate creates the schema in a new database and reports whether it did.
+func (s *sqliteStore) migrate() (bool, error) {
+	var version int
+	if err := s.db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return false, err
+	}
+	switch {
+	case version == sqliteSchemaVersion:
+		return false, nil
+	case version > sqliteSchemaVersion:
+		return false, fmt.Errorf("database schema version %d is newer than this server's %d", version, sqliteSchemaVersion)
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(sqliteSchema); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", sqliteSchemaVersion)); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+func (s *sqliteStore) importFiles(srv *Server, files *fileStore) error {
+	defer files.Close()
+	ilog := srv.logger("store")
+
+	esps, err := files.Load()
+	if err != nil {
+		return err
+	}
+	if len(esps) > 0 {
+		if err := s.Save(esps); err != nil {
+			return err
+		}
+		ilog.Info("Imported registry", "count", len(esps), "path", srv.registryPath)
+	}
+
+	list, err := files.LoadSchedules()
+	if err != nil {
+		return err
+	}
+	if len(list) > 0 {
+		if err := s.SaveSchedules(list); err != nil {
+			return err
+		}
+		ilog.Info("Imported schedules", "count", len(list), "path", srv.schedulesPath)
+	}
+
+	evs, err := files.LoadEvents(1 << 30)
+	if err != nil {
+		return err
+	}
+	if len(evs) == 0 {
+		return nil
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, e := range evs {
+		if err := insertEvent(tx, e); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	ilog.Info("Imported event log", "count", len(evs), "path", srv.eventsPath)
+	return nil
+}
+
+// scanRows calls fn with the key and data of each row a two-column query
+// returns. The rows are closed before it returns, which matters with the
+// single connection.
+func (s *sqliteStore) scanRows(query string, fn func(key, data string) error) error {
+	rows, err := s.db.Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key, data string
+		if err := rows.Scan(&key, &data); err != nil {
+			return err
+		}
+		if err := fn(key, data); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *sqliteStore) Load() (map[string]*ESP, error) {
+	esps := make(map[string]*ESP)
+	err := s.scanRows("SELECT id, data FROM esps", func(id, data string) error {
+		var esp ESP
+		if err := json.Unmarshal([]byte(data), &esp); err != nil {
+			return fmt.Errorf("parse ESP %s: %w", id, err)
+		}
+		esps[id] = &esp
+		s.saved[id] = data
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.scanRows("SELECT esp_id, commands FROM queued_commands", func(id, data string) error {
+		esp, exists := esps[id]
+		if !exists {
+			return nil
+		}
+		if err := json.Unmarshal([]byte(data), &esp.Queue); err != nil {
+			return fmt.Errorf("parse queue of %s: %w", id, err)
+		}
+		s.savedQueues[id] = data
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return esps, nil
+}
+
+// Save writes the ESPs and queues that changed since the last save and
+// deletes those that are gone, in one transaction.
+func (s *sqliteStore) Save(esps map[string]*ESP) error {
+	rows := make(map[string]string, len(esps))
+	queues := make(map[string]string)
+	for id, esp := range esps {
+		data, err := json.Marshal(esp)
+		if err != nil {
+			return err
+		}
+		rows[id] = string(data)
+		if len(esp.Queue) > 0 {
+			data, err := json.Marshal(esp.Queue)
+			if err != nil {
+				return err
+			}
+			queues[id] = string(data)
+		}
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := syncRows(tx, "esps", "id", "data", s.saved, rows); err != nil {
+		return err
+	}
+	if err := syncRows(tx, "queued_commands", "esp_id", "commands", s.savedQueues, queues); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.saved, s.savedQueues = rows, queues
+	return nil
+}
+
+// syncRows makes table hold rows, given that it holds saved.
+func syncRows(tx *sql.Tx, table, keyColumn, dataColumn string, saved, rows map[string]string) error {
+	for key, data := range rows {
+		if saved[key] == data {
+			continue
+		}
+		if _, err := tx.Exec(fmt.Sprintf("INSERT OR REPLACE INTO %s (%s, %s) VALUES (?, ?)", table, keyColumn, dataColumn), key, data); err != nil {
+			return err
+		}
+	}
+	for key := range saved {
+		if _, exists := rows[key]; exists {
+			continue
+		}
+		if _, err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE %s = ?", table, keyColumn), key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqliteStore) LoadSchedules() ([]*Schedule, error) {
+	var list []*Schedule
+	err := s.scanRows("SELECT id, data FROM schedules ORDER BY id", func(id, data string) error {
+		var sched Schedule
+		if err := json.Unmarshal([]byte(data), &sched); err != nil {
+			return fmt.Errorf("parse schedule %s: %w", id, err)
+		}
+		list = append(list, &sched)
+		return nil
+	})
+	return list, err
+}
+
+func (s *sqliteStore) SaveSchedules(list []*Schedule) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM schedules"); err != nil {
+		return err
+	}
+	for _, sched := range list {
+		data, err := json.Marshal(sched)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("INSERT INTO schedules (id, data) VALUES (?, ?)", sched.ID, string(data)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) LoadEvents(limit int) ([]Event, error) {
+	var list []Event
+	query := fmt.Sprintf("SELECT seq, data FROM (SELECT seq, data FROM events ORDER BY seq DESC LIMIT %d) ORDER BY seq", limit)
+	err := s.scanRows(query, func(seq, data string) error {
+		var e Event
+		if err := json.Unmarshal([]byte(data), &e); err != nil {
+			return fmt.Errorf("parse event %s: %w", seq, err)
+		}
+		list = append(list, e)
+		return nil
+	})
+	return list, err
+}
+
+func (s *sqliteStore) AppendEvent(e Event) error {
+	return insertEvent(s.db, e)
+}
+
+func (s *sqliteStore) ReplaceEvents(list []Event) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM events"); err != nil {
+		return err
+	}
+	for _, e := range list {
+		if err := insertEvent(tx, e); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func insertEvent(db execer, e Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("INSERT OR REPLACE INTO events (seq, time, type, esp_id, data) VALUES (?, ?, ?, ?, ?)",
+		e.Seq, e.Time.UTC().Format(time.RFC3339Nano), string(e.Type), e.ESPID, string(data))
+	return err
+}
+
+func (s *sqliteStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,373 @@
+package server
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SSH shutdown is soft-off for machines that run no agent. When the config
+// has ssh: settings for a device, soft-off logs in to the target and runs
+// the shutdown command there. If that fails, or the target isn't seen off
+// within the timeout, the ESP forces it off instead. A target whose power
+// state isn't tracked counts as off once the command ran. Credentials stay
+// in the config and are never written to the registry.
+
+const (
+	defaultSSHCommand = "systemctl poweroff"
+	defaultSSHTimeout = 2 * time.Minute
+	// sshCommandTimeout covers connecting, logging in and running the
+	// command
+	sshCommandTimeout = 30 * time.Second
+	sshCheckInterval  = 5 * time.Second
+	// sshActor sends the forced shutdown when soft-off didn't work
+	sshActor = "ssh"
+)
+
+// SSHSettings configures soft-off over SSH for one device. The host key is
+// checked against HostKey if set, else against KnownHosts.
+type SSHSettings struct {
+	Host     string `yaml:"host"` // default the target's host
+	Port     int    `yaml:"port"` // default 22
+	User     string `yaml:"user"`
+	KeyFile  string `yaml:"key_file"` // unencrypted private key
+	Password string `yaml:"password"`
+	Command  string `yaml:"command"` // default systemctl poweroff
+
+	// HostKey pins the host key, as a known_hosts or authorized_keys line
+	// or a SHA256: fingerprint
+	HostKey string `yaml:"host_key"`
+	// KnownHosts is an OpenSSH known_hosts file, default ~/.ssh/known_hosts
+	KnownHosts            string `yaml:"known_hosts"`
+	InsecureIgnoreHostKey bool   `yaml:"insecure_ignore_host_key"`
+
+	// Timeout is how long the target may take to power off before the ESP
+	// forces it
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+func validateSSH(name string, s SSHSettings) []error {
+	var errs []error
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("ssh.%s: %s", name, fmt.Sprintf(format, args...)))
+	}
+	if s.User == "" {
+		fail("user is required")
+	}
+	if s.KeyFile == "" && s.Password == "" {
+		fail("key_file or password is required")
+	}
+	if s.KeyFile != "" {
+		if _, err := loadSSHKey(s.KeyFile); err != nil {
+			fail("key_file: %v", err)
+		}
+	}
+	if s.Port < 0 || s.Port > 65535 {
+		fail("invalid port %d", s.Port)
+	}
+	if s.Timeout < 0 {
+		fail("timeout must be positive, got %v", s.Timeout)
+	}
+	checks := 0
+	for _, set := range []bool{s.HostKey != "", s.KnownHosts != "", s.InsecureIgnoreHostKey} {
+		if set {
+			checks++
+		}
+	}
+	if checks > 1 {
+		fail("set only one of host_key, known_hosts and insecure_ignore_host_key")
+	} else if _, _, err := sshHostKeyCheck(s); err != nil {
+		fail("%v", err)
+	}
+	return errs
+}
+
+// sshSettings returns the ssh: settings configured for the ESP, looked up
+// by ID or alias like targets.
+func (srv *Server) sshSettings(id string) (SSHSettings, bool) {
+	for name, s := range srv.config.SSH {
+		if alias, ok := srv.config.Aliases[name]; ok {
+			name = alias
+		}
+		if srv.resolveAlias(name) == id {
+			return s, true
+		}
+	}
+	return SSHSettings{}, false
+}
+
+// sshAddr is where soft-off logs in, or "" when neither the settings nor
+// the target name a host. Must be called with mu held.
+func sshAddr(esp *ESP, s SSHSettings) string {
+	host := s.Host
+	if host == "" && esp.Target != nil {
+		host = esp.Target.Host
+	}
+	if host == "" {
+		return ""
+	}
+	port := s.Port
+	if port == 0 {
+		port = 22
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+func (s SSHSettings) timeout() time.Duration {
+	if s.Timeout == 0 {
+		return defaultSSHTimeout
+	}
+	return s.Timeout
+}
+
+// dispatchSSH starts soft-off over SSH. Must be called with mu held.
+func (srv *Server) dispatchSSH(esp *ESP, s SSHSettings, opts commandOptions, actor string) (dispatchResult, error) {
+	addr := sshAddr(esp, s)
+	if addr == "" {
+		return dispatchResult{}, fmt.Errorf("%w: no host to shut '%s' down over SSH (set ssh host, or a target)", errUnsupportedCommand, esp.ID)
+	}
+	if opts.DryRun {
+		return dispatchResult{Status: statusDryRun, Delivery: "ssh"}, nil
+	}
+	rec := srv.newCommandRecord(esp.ID, CommandSoftOff)
+	srv.recordEvent(Event{Type: EventCommand, ESPID: esp.ID, Actor: actor, Command: CommandSoftOff, CommandID: rec.ID, Detail: "ssh " + s.User + "@" + addr})
+	go srv.runSSHShutdown(esp.ID, s, addr, rec, opts.Override)
+	return dispatchResult{Record: rec, Status: "sent", Delivery: "ssh"}, nil
+}
+
+func (srv *Server) runSSHShutdown(id string, s SSHSettings, addr string, rec *CommandRecord, override bool) {
+	sshLog := srv.logger("ssh").With("esp_id", id, "addr", addr, "command_id", rec.ID)
+	err := runSSHCommand(s, addr)
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	esp, exists := srv.espMap[id]
+	if !exists || rec.finished() {
+		return
+	}
+	if err != nil {
+		sshLog.Warn("SSH shutdown failed, forcing off", "error", err)
+		srv.forceAfterSSH(esp, rec, err.Error(), override)
+		return
+	}
+	sshLog.Info("SSH shutdown command sent")
+	srv.markDelivered(rec)
+	if !esp.powerTracked() {
+		srv.ackCommand(rec)
+		return
+	}
+
+	deadline := srv.now().Add(s.timeout())
+	for {
+		srv.mu.Unlock()
+		time.Sleep(sshCheckInterval)
+		srv.mu.Lock()
+		esp, exists = srv.espMap[id]
+		if !exists || rec.finished() {
+			return
+		}
+		switch state := esp.powerState(); {
+		case state == PowerOff:
+			srv.ackCommand(rec)
+			return
+		case state != PowerShuttingDown:
+			// Someone turned it back on in the meantime
+			srv.failCommand(rec, fmt.Sprintf("target is %s again, not forcing it off", state))
+			return
+		case srv.now().After(deadline):
+			sshLog.Warn("Target still on after SSH shutdown, forcing off", "timeout", s.timeout())
+			srv.forceAfterSSH(esp, rec, fmt.Sprintf("target still on %s after the shutdown command", s.timeout()), override)
+			return
+		}
+	}
+}
+
+// forceAfterSSH fails the soft-off and has the ESP force the target off
+// instead. Must be called with mu held.
+func (srv *Server) forceAfterSSH(esp *ESP, rec *CommandRecord, reason string, override bool) {
+	result, err := srv.dispatchCommand(esp, CommandForce, commandOptions{Override: override, AfterCooldown: true, IgnoreQuota: true}, sshActor)
+	switch {
+	case err != nil:
+		srv.failCommand(rec, fmt.Sprintf("%s; force failed: %v", reason, err))
+	case result.Record != nil:
+		srv.failCommand(rec, fmt.Sprintf("%s; forcing off instead (%s)", reason, result.Record.ID))
+	default:
+		srv.failCommand(rec, reason+"; forcing off instead")
+	}
+}
+
+// runSSHCommand logs in and runs the shutdown command. A connection that
+// drops before the command exits counts as success, since that is what a
+// machine powering off looks like.
+func runSSHCommand(s SSHSettings, addr string) error {
+	cfg, err := sshClientConfig(s, addr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialTimeout("tcp", addr, driverTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(sshCommandTimeout))
+
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, cfg)
+	if err != nil {
+		return err
+	}
+	client := ssh.NewClient(c, chans, reqs)
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	out, err := session.CombinedOutput(cmp.Or(s.Command, defaultSSHCommand))
+	var exitErr *ssh.ExitError
+	var missing *ssh.ExitMissingError
+	switch {
+	case err == nil, errors.As(err, &missing):
+		return nil
+	case errors.As(err, &exitErr):
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return fmt.Errorf("command exited with %d: %s", exitErr.ExitStatus(), Truncate(msg, 200))
+		}
+		return fmt.Errorf("command exited with %d", exitErr.ExitStatus())
+	}
+	return err
+}
+
+func sshClientConfig(s SSHSettings, addr string) (*ssh.ClientConfig, error) {
+	cfg := &ssh.ClientConfig{User: s.User, Timeout: driverTimeout}
+	if s.KeyFile != "" {
+		signer, err := loadSSHKey(s.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Auth = append(cfg.Auth, ssh.PublicKeys(signer))
+	}
+	if s.Password != "" {
+		cfg.Auth = append(cfg.Auth, ssh.Password(s.Password))
+	}
+	check, algorithms, err := sshHostKeyCheck(s)
+	if err != nil {
+		return nil, err
+	}
+	cfg.HostKeyCallback = check
+	if algorithms == nil && s.HostKey == "" && !s.InsecureIgnoreHostKey {
+		algorithms = knownHostAlgorithms(check, addr)
+	}
+	cfg.HostKeyAlgorithms = algorithms
+	return cfg, nil
+}
+
+func loadSSHKey(path string) (ssh.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		return nil, errors.New("key has a passphrase, which isn't supported")
+	}
+	return signer, err
+}
+
+// sshHostKeyCheck returns the host key callback for the settings, and the
+// host key algorithms to ask for when a pinned key decides them.
+func sshHostKeyCheck(s SSHSettings) (ssh.HostKeyCallback, []string, error) {
+	switch {
+	case s.InsecureIgnoreHostKey:
+		return ssh.InsecureIgnoreHostKey(), nil, nil
+	case strings.HasPrefix(s.HostKey, "SHA256:"):
+		return func(_ string, _ net.Addr, key ssh.PublicKey) error {
+			if fp := ssh.FingerprintSHA256(key); fp != s.HostKey {
+				return fmt.Errorf("host key %s doesn't match host_key", fp)
+			}
+			return nil
+		}, nil, nil
+	case s.HostKey != "":
+		pinned, err := parsePinnedHostKey(s.HostKey)
+		if err != nil {
+			return nil, nil, fmt.Errorf("host_key: %v", err)
+		}
+		return func(_ string, _ net.Addr, key ssh.PublicKey) error {
+			if !bytes.Equal(key.Marshal(), pinned.Marshal()) {
+				return fmt.Errorf("host key %s doesn't match host_key", ssh.FingerprintSHA256(key))
+			}
+			return nil
+		}, keyAlgorithms(pinned.Type()), nil
+	}
+	path := s.KnownHosts
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, nil, fmt.Errorf("no host key check: set host_key, known_hosts or insecure_ignore_host_key (%v)", err)
+		}
+		path = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	check, err := knownhosts.New(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("known_hosts: %v", err)
+	}
+	return check, nil, nil
+}
+
+// parsePinnedHostKey takes the key from an authorized_keys line, or from a
+// known_hosts line as ssh-keyscan prints it.
+func parsePinnedHostKey(line string) (ssh.PublicKey, error) {
+	if key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line)); err == nil {
+		return key, nil
+	}
+	_, _, key, _, _, err := ssh.ParseKnownHosts([]byte(line))
+	return key, err
+}
+
+// knownHostAlgorithms asks for the host key types known_hosts has for addr,
+// so a server offering another type first isn't rejected. The callback is
+// probed with a throwaway key, which it refuses listing the known ones.
+func knownHostAlgorithms(check ssh.HostKeyCallback, addr string) []string {
+	pub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return nil
+	}
+	probe, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return nil
+	}
+	var keyErr *knownhosts.KeyError
+	if !errors.As(check(addr, &net.TCPAddr{IP: net.IPv4zero}, probe), &keyErr) {
+		return nil
+	}
+	var algorithms []string
+	for _, known := range keyErr.Want {
+		for _, a := range keyAlgorithms(known.Key.Type()) {
+			if !slices.Contains(algorithms, a) {
+				algorithms = append(algorithms, a)
+			}
+		}
+	}
+	return algorithms
+}
+
+// keyAlgorithms lists the host key algorithms that use a key type.
+func keyAlgorithms(keyType string) []string {
+	if keyType == ssh.KeyAlgoRSA {
+		return []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	}
+	return []string{keyType}
+}
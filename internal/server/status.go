@@ -0,0 +1,189 @@
+package server
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Status page: a read-only page anyone can open, for household members or
+// a wall display that shouldn't hold a token. /status renders it as HTML
+// and /api/v1/public/status as JSON. Both show only device names (the
+// alias where there is one) and states: no IDs, addresses, targets or
+// commands. The page is off by default and has its own per-IP rate limit,
+// applied instead of the general one, so a busy wall display doesn't use
+// up the budget of API clients on the same address.
+
+const (
+	defaultStatusTitle     = "Wake-on-Demand"
+	defaultStatusRateLimit = 30
+	statusBurst            = 10
+	statusRefresh          = 30 * time.Second
+)
+
+// StatusPageSettings configures the page. Devices lists the ESP IDs or
+// aliases to show; empty shows every approved device.
+type StatusPageSettings struct {
+	Enabled bool     `yaml:"enabled"`
+	Title   string   `yaml:"title"`
+	Devices []string `yaml:"devices"`
+	// RateLimit is requests per minute per IP; -1 disables it
+	RateLimit int `yaml:"rate_limit"`
+}
+
+// statusState holds the Server state kept in status.go.
+type statusState struct {
+	statusPage    StatusPageSettings // guarded by settingsMu
+	statusLimiter *rateLimiter
+
+	statusTemplate *template.Template
+}
+
+func validateStatusPage(s StatusPageSettings) []error {
+	var errs []error
+	if s.RateLimit < -1 {
+		errs = append(errs, fmt.Errorf("status_page.rate_limit: must be -1 or more, got %d", s.RateLimit))
+	}
+	for _, name := range s.Devices {
+		if name == "" {
+			errs = append(errs, errors.New("status_page.devices: empty device name"))
+		}
+	}
+	return errs
+}
+
+// statusRateLimit is the page's requests per minute, 0 when unlimited.
+func statusRateLimit(s StatusPageSettings) int {
+	switch {
+	case s.RateLimit < 0:
+		return 0
+	case s.RateLimit == 0:
+		return defaultStatusRateLimit
+	}
+	return s.RateLimit
+}
+
+func isStatusPath(path string) bool {
+	return path == "/status" || path == "/public/status"
+}
+
+type publicStatus struct {
+	Title     string         `json:"title"`
+	Devices   []publicDevice `json:"devices"`
+	UpdatedAt time.Time      `json:"updated_at"`
+}
+
+// publicDevice is all the status page tells about a device. State is the
+// power state where something tracks it, maintenance during a maintenance
+// window, and online or offline otherwise.
+type publicDevice struct {
+	Name  string     `json:"name"`
+	State string     `json:"state"`
+	Since *time.Time `json:"since,omitempty"`
+}
+
+// currentStatus builds the page, or returns false when it is disabled.
+func (srv *Server) currentStatus() (publicStatus, bool) {
+	srv.settingsMu.RLock()
+	s := srv.statusPage
+	srv.settingsMu.RUnlock()
+	if !s.Enabled {
+		return publicStatus{}, false
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	var shown map[string]bool
+	if len(s.Devices) > 0 {
+		shown = make(map[string]bool, len(s.Devices))
+		for _, name := range s.Devices {
+			shown[srv.resolveAlias(name)] = true
+		}
+	}
+	status := publicStatus{Title: cmp.Or(s.Title, defaultStatusTitle), Devices: []publicDevice{}, UpdatedAt: srv.now()}
+	for id, esp := range srv.espMap {
+		if esp.Pairing != nil || shown != nil && !shown[id] {
+			continue
+		}
+		d := publicDevice{Name: cmp.Or(srv.aliasFor(id), id)}
+		switch {
+		case esp.inMaintenance(srv):
+			d.State = "maintenance"
+		case esp.powerTracked() && esp.Power != nil:
+			d.State = string(esp.Power.State)
+			if since := esp.Power.Since; !since.IsZero() {
+				d.Since = &since
+			}
+		case esp.Online:
+			d.State = "online"
+		default:
+			d.State = "offline"
+		}
+		status.Devices = append(status.Devices, d)
+	}
+	slices.SortFunc(status.Devices, func(a, b publicDevice) int { return strings.Compare(a.Name, b.Name) })
+	return status, true
+}
+
+// publicStatusHandler serves GET /public/status.
+func (srv *Server) publicStatusHandler(w http.ResponseWriter, r *http.Request) {
+	status, ok := srv.currentStatus()
+	if !ok {
+		writeError(w, CodeNotFound, "status page is disabled")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(status)
+}
+
+// statusPageHandler serves GET /status.
+func (srv *Server) statusPageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, CodeMethodNotAllowed, "only GET allowed")
+		return
+	}
+	status, ok := srv.currentStatus()
+	if !ok {
+		writeError(w, CodeNotFound, "status page is disabled")
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'")
+	if err := srv.statusTemplate.Execute(w, status); err != nil {
+		srv.requestLogger(r).Warn("Could not render status page", "error", err)
+	}
+}
+
+func stateClass(state string) string {
+	switch state {
+	case "up", "online":
+		return "up"
+	case "off", "offline":
+		return "down"
+	case "booting", "shutting_down", "maintenance":
+		return "busy"
+	}
+	return ""
+}
+
+// statusAge is how long a state has lasted, coarse enough to read across
+// the room.
+func statusAge(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		return fmt.Sprintf("for %dm", int(d.Minutes()))
+	case d < 48*time.Hour:
+		return fmt.Sprintf("for %dh", int(d.Hours()))
+	}
+	return fmt.Sprintf("for %dd", int(d.Hours()/24))
+}
@@ -0,0 +1,242 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	regstore "github.com/smileyfaceskobochka/trashbin-daemon/internal/registry"
+)
+
+// Store persists the server's state: the registry of ESPs with their
+// queued commands, schedules and the event log. -store picks the backend;
+// the default keeps each part in its own file, or in memory when its path
+// isn't set. In a cluster the registry is kept in Redis instead, and only
+// schedules and events use the store.
+type Store interface {
+	Registry
+	LoadSchedules() ([]*Schedule, error)
+	SaveSchedules([]*Schedule) error
+	// LoadEvents returns up to limit of the newest events, oldest first.
+	LoadEvents(limit int) ([]Event, error)
+	AppendEvent(Event) error
+	// ReplaceEvents swaps the whole log for list, when a backup is restored
+	ReplaceEvents(list []Event) error
+	Close() error
+}
+
+// storeState holds the Server state kept in store.go.
+type storeState struct {
+	storeSpec string
+	// store starts out in memory, until the server opens the configured one
+	store Store
+	// storeOverride is the store given to WithStore, used instead of -store
+	storeOverride Store
+}
+
+const (
+	storeFile   = "file"
+	storeMemory = "memory"
+	storeSQLite = "sqlite"
+
+	defaultSQLiteName = "wod.db"
+)
+
+// parseStoreSpec splits a -store value into the backend and, for SQLite,
+// the database path. "sqlite" alone puts the database in the data
+// directory.
+func parseStoreSpec(spec string) (backend, path string, err error) {
+	switch {
+	case spec == "" || spec == storeFile:
+		return storeFile, "", nil
+	case spec == storeMemory:
+		return storeMemory, "", nil
+	case spec == storeSQLite:
+		return storeSQLite, "", nil
+	case strings.HasPrefix(spec, "sqlite://"):
+		path = strings.TrimPrefix(spec, "sqlite://")
+		if path == "" {
+			return "", "", fmt.Errorf("%q has no database path", spec)
+		}
+		return storeSQLite, path, nil
+	case strings.HasPrefix(spec, "postgres://"), strings.HasPrefix(spec, "postgresql://"):
+		return "", "", errors.New("postgres is not supported (use file, memory or sqlite://<path>)")
+	}
+	return "", "", fmt.Errorf("unknown store %q (use file, memory or sqlite://<path>)", spec)
+}
+
+// openStore opens the backend -store names. Must be called after the data
+// directory has been applied to the file paths.
+func (srv *Server) openStore() (Store, string, error) {
+	if srv.storeOverride != nil {
+		return srv.storeOverride, "custom", nil
+	}
+	backend, path, err := parseStoreSpec(srv.storeSpec)
+	if err != nil {
+		return nil, "", err
+	}
+	switch backend {
+	case storeMemory:
+		return srv.newFileStore("", "", ""), "in-memory", nil
+	case storeSQLite:
+		if path == "" {
+			if srv.dataDir == "" {
+				return nil, "", errors.New("-store sqlite needs a path (sqlite://<path>) or -data-dir")
+			}
+			path = filepath.Join(srv.dataDir, defaultSQLiteName)
+		}
+		s, err := srv.openSQLiteStore(path)
+		if err != nil {
+			return nil, "", err
+		}
+		return s, "sqlite:" + path, nil
+	}
+	return srv.newFileStore(srv.registryPath, srv.schedulesPath, srv.eventsPath), storeFile, nil
+}
+
+// fileStore keeps the registry as a JSON snapshot, schedules as a JSON
+// list and events as JSON lines, each at its own path. Parts without a
+// path are only kept in memory. Queued commands aren't saved.
+type fileStore struct {
+	Registry
+	schedulesPath string
+	eventsPath    string
+
+	eventsMu   sync.Mutex
+	eventsFile *os.File
+	srv        *Server
+}
+
+func (srv *Server) newFileStore(registryPath, schedulesPath, eventsPath string) *fileStore {
+	return &fileStore{Registry: srv.newRegistry(registryPath), schedulesPath: schedulesPath, eventsPath: eventsPath, srv: srv}
+}
+
+func (f *fileStore) LoadSchedules() ([]*Schedule, error) {
+	if f.schedulesPath == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(f.schedulesPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list []*Schedule
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", f.schedulesPath, err)
+	}
+	return list, nil
+}
+
+func (f *fileStore) SaveSchedules(list []*Schedule) error {
+	if f.schedulesPath == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	return regstore.WriteFileAtomic(f.schedulesPath, data)
+}
+
+// LoadEvents reads the log and opens it for appending.
+func (f *fileStore) LoadEvents(limit int) ([]Event, error) {
+	if f.eventsPath == "" {
+		return nil, nil
+	}
+
+	var list []Event
+	file, err := os.Open(f.eventsPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		skipped := 0
+		for scanner.Scan() {
+			var e Event
+			if json.Unmarshal(scanner.Bytes(), &e) != nil {
+				skipped++
+				continue
+			}
+			list = append(list, e)
+			if len(list) > 2*limit {
+				list = append(list[:0], list[len(list)-limit:]...)
+			}
+		}
+		file.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		if skipped > 0 {
+			f.srv.logger("events").Warn("Skipped unreadable event log lines", "count", skipped)
+		}
+	}
+	if len(list) > limit {
+		list = list[len(list)-limit:]
+	}
+
+	f.eventsMu.Lock()
+	defer f.eventsMu.Unlock()
+	f.eventsFile, err = os.OpenFile(f.eventsPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	return list, err
+}
+
+func (f *fileStore) AppendEvent(e Event) error {
+	f.eventsMu.Lock()
+	defer f.eventsMu.Unlock()
+	if f.eventsFile == nil {
+		return nil
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = f.eventsFile.Write(append(line, '\n'))
+	return err
+}
+
+// ReplaceEvents rewrites the log and reopens it for appending.
+func (f *fileStore) ReplaceEvents(list []Event) error {
+	f.eventsMu.Lock()
+	defer f.eventsMu.Unlock()
+	if f.eventsPath == "" {
+		return nil
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, e := range list {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	if f.eventsFile != nil {
+		f.eventsFile.Close()
+		f.eventsFile = nil
+	}
+	if err := regstore.WriteFileAtomic(f.eventsPath, buf.Bytes()); err != nil {
+		return err
+	}
+	var err error
+	f.eventsFile, err = os.OpenFile(f.eventsPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	return err
+}
+
+func (f *fileStore) Close() error {
+	f.eventsMu.Lock()
+	defer f.eventsMu.Unlock()
+	if f.eventsFile == nil {
+		return nil
+	}
+	err := f.eventsFile.Close()
+	f.eventsFile = nil
+	return err
+}
@@ -0,0 +1,222 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The event stream pushes registry changes to scripts and dashboards as
+// server-sent events. It is fed from recordEvent, so the stream and the
+// audit log share sequence numbers: a client that reconnects with
+// Last-Event-ID gets the events it missed from the in-memory log.
+
+const (
+	streamBuffer    = 64
+	streamKeepalive = 15 * time.Second
+)
+
+// StreamEvent is the data of one server-sent event; the SSE event name is
+// its Type.
+type StreamEvent struct {
+	Seq       uint64     `json:"seq"`
+	Time      time.Time  `json:"time"`
+	Type      string     `json:"type"`
+	ESPID     string     `json:"esp_id"`
+	Alias     string     `json:"alias,omitempty"`
+	Actor     string     `json:"actor,omitempty"`
+	Command   ESPCommand `json:"command,omitempty"`
+	CommandID string     `json:"command_id,omitempty"`
+	Detail    string     `json:"detail,omitempty"`
+}
+
+var streamTypes = []string{"esp_registered", "esp_online", "esp_offline", "command_queued", "command_delivered"}
+
+// streamEvent maps an audit event to its stream event, if it has one.
+func (srv *Server) streamEvent(e Event) (StreamEvent, bool) {
+	var typ string
+	switch e.Type {
+	case EventRegister:
+		typ = "esp_registered"
+	case EventOnline:
+		// The agent coming up says nothing about the ESP
+		if e.Detail == "agent" {
+			return StreamEvent{}, false
+		}
+		typ = "esp_online"
+	case EventOffline:
+		typ = "esp_offline"
+	case EventCommand:
+		typ = "command_queued"
+	case EventDelivered:
+		typ = "command_delivered"
+	default:
+		return StreamEvent{}, false
+	}
+	return StreamEvent{
+		Seq: e.Seq, Time: e.Time, Type: typ, ESPID: e.ESPID, Alias: srv.aliasFor(e.ESPID),
+		Actor: e.Actor, Command: e.Command, CommandID: e.CommandID, Detail: e.Detail,
+	}, true
+}
+
+// streamSub is one open stream. Its channel is closed when it falls
+// behind, which ends the stream; the client reconnects and catches up.
+type streamSub struct {
+	events chan StreamEvent
+}
+
+// streamState holds the Server state kept in stream.go.
+type streamState struct {
+	// streamSubs is guarded by eventsMu, so subscribing and replaying the log
+	// can't miss an event recorded in between.
+	streamSubs map[*streamSub]struct{}
+}
+
+// publishStream must be called with eventsMu held and must not block.
+func (srv *Server) publishStream(e Event) {
+	if len(srv.streamSubs) == 0 {
+		return
+	}
+	se, ok := srv.streamEvent(e)
+	if !ok {
+		return
+	}
+	for sub := range srv.streamSubs {
+		select {
+		case sub.events <- se:
+		default:
+			close(sub.events)
+			delete(srv.streamSubs, sub)
+		}
+	}
+}
+
+// subscribeStream registers a subscriber and returns the logged events
+// after lastSeq that it missed.
+func (srv *Server) subscribeStream(lastSeq uint64) (*streamSub, []StreamEvent) {
+	srv.eventsMu.Lock()
+	defer srv.eventsMu.Unlock()
+
+	var missed []StreamEvent
+	if lastSeq != 0 {
+		for _, e := range srv.events {
+			if e.Seq <= lastSeq {
+				continue
+			}
+			if se, ok := srv.streamEvent(e); ok {
+				missed = append(missed, se)
+			}
+		}
+	}
+	sub := &streamSub{events: make(chan StreamEvent, streamBuffer)}
+	srv.streamSubs[sub] = struct{}{}
+	return sub, missed
+}
+
+func (srv *Server) unsubscribeStream(sub *streamSub) {
+	srv.eventsMu.Lock()
+	defer srv.eventsMu.Unlock()
+	if _, ok := srv.streamSubs[sub]; ok {
+		delete(srv.streamSubs, sub)
+		close(sub.events)
+	}
+}
+
+// eventStreamHandler serves GET /events/stream. ?esp_id= and ?type= filter
+// like /events does.
+func (srv *Server) eventStreamHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, CodeMethodNotAllowed, "only GET allowed")
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, CodeInternal, "streaming not supported")
+		return
+	}
+
+	q := r.URL.Query()
+	espID := q.Get("esp_id")
+	if espID != "" {
+		espID = srv.resolveAlias(espID)
+	}
+	var types []string
+	if t := q.Get("type"); t != "" {
+		for _, name := range strings.Split(t, ",") {
+			name = strings.TrimSpace(name)
+			if !slices.Contains(streamTypes, name) {
+				writeError(w, CodeInvalidRequest, fmt.Sprintf("unknown event type %q (use %s)", name, strings.Join(streamTypes, ", ")))
+				return
+			}
+			types = append(types, name)
+		}
+	}
+	var lastSeq uint64
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		n, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			writeError(w, CodeInvalidRequest, "invalid Last-Event-ID")
+			return
+		}
+		lastSeq = n
+	}
+
+	p := requestPrincipal(r)
+	wanted := func(e StreamEvent) bool {
+		return (espID == "" || e.ESPID == espID) &&
+			(len(types) == 0 || slices.Contains(types, e.Type)) &&
+			p.canView(e.ESPID)
+	}
+
+	sub, missed := srv.subscribeStream(lastSeq)
+	defer srv.unsubscribeStream(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	rlog := srv.requestLogger(r)
+	rlog.Debug("Event stream opened", "replayed", len(missed))
+
+	// Tell EventSource how long to wait before reconnecting
+	fmt.Fprint(w, "retry: 3000\n\n")
+	for _, e := range missed {
+		if wanted(e) {
+			writeStreamEvent(w, e)
+		}
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(streamKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case e, open := <-sub.events:
+			if !open {
+				rlog.Warn("Event stream subscriber fell behind, closing")
+				return
+			}
+			if !wanted(e) {
+				continue
+			}
+			writeStreamEvent(w, e)
+			flusher.Flush()
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			rlog.Debug("Event stream closed")
+			return
+		case <-srv.uiStop:
+			return
+		}
+	}
+}
+
+func writeStreamEvent(w http.ResponseWriter, e StreamEvent) {
+	data, _ := json.Marshal(e)
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.Seq, e.Type, data)
+}
@@ -0,0 +1,434 @@
+package server
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The Telegram bot takes commands from the chats in telegram.chats:
+// /on, /off, /status and /list, with an inline keyboard to pick the device
+// when none is given. It long-polls the Bot API, so it needs no public URL.
+// Commands go through dispatchCommand like API requests and are recorded
+// with the actor telegram:<user>@<chat_id>.
+
+const (
+	telegramPollTimeout = 25 * time.Second
+	// Telegram caps callback data at 64 bytes
+	maxCallbackData = 64
+)
+
+// telegramBotState holds the Server state kept in telegram.go.
+type telegramBotState struct {
+	telegramClient *http.Client
+}
+
+type tgUser struct {
+	ID        int64  `json:"id"`
+	Username  string `json:"username"`
+	FirstName string `json:"first_name"`
+}
+
+type tgMessage struct {
+	MessageID int64   `json:"message_id"`
+	From      *tgUser `json:"from"`
+	Chat      struct {
+		ID int64 `json:"id"`
+	} `json:"chat"`
+	Text string `json:"text"`
+}
+
+type tgCallback struct {
+	ID      string     `json:"id"`
+	From    tgUser     `json:"from"`
+	Message *tgMessage `json:"message"`
+	Data    string     `json:"data"`
+}
+
+type tgUpdate struct {
+	UpdateID      int64       `json:"update_id"`
+	Message       *tgMessage  `json:"message"`
+	CallbackQuery *tgCallback `json:"callback_query"`
+}
+
+type tgButton struct {
+	Text         string `json:"text"`
+	CallbackData string `json:"callback_data"`
+}
+
+type tgKeyboard struct {
+	InlineKeyboard [][]tgButton `json:"inline_keyboard"`
+}
+
+type telegramBot struct {
+	api   string // base URL including the token, never logged
+	chats []int64
+}
+
+func (srv *Server) telegramEnabled() bool {
+	return srv.config.Telegram.BotToken != ""
+}
+
+// runTelegramBot polls for updates until the process exits, backing off
+// while the API is unreachable.
+func (srv *Server) runTelegramBot() {
+	api := strings.TrimRight(cmp.Or(srv.config.Telegram.API, defaultTelegramAPI), "/")
+	bot := &telegramBot{api: api + "/bot" + srv.config.Telegram.BotToken, chats: srv.config.Telegram.Chats}
+	tlog := srv.logger("telegram")
+	tlog.Info("Telegram bot started", "chats", len(bot.chats))
+
+	var offset int64
+	backoff := time.Second
+	for {
+		var updates []tgUpdate
+		err := bot.call(srv, context.Background(), "getUpdates", map[string]interface{}{
+			"offset": offset, "timeout": int(telegramPollTimeout.Seconds()),
+			"allowed_updates": []string{"message", "callback_query"},
+		}, &updates)
+		if err != nil {
+			tlog.Warn("Polling for updates failed", "error", err, "retry_in", backoff.String())
+			time.Sleep(backoff)
+			backoff = min(backoff*2, time.Minute)
+			continue
+		}
+		backoff = time.Second
+		for _, u := range updates {
+			offset = max(offset, u.UpdateID+1)
+			switch {
+			case u.Message != nil:
+				bot.handleMessage(srv, u.Message)
+			case u.CallbackQuery != nil:
+				bot.handleCallback(srv, u.CallbackQuery)
+			}
+		}
+	}
+}
+
+// call invokes a Bot API method and decodes its result into out.
+func (b *telegramBot) call(srv *Server, ctx context.Context, method string, params interface{}, out interface{}) error {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.api+"/"+method, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := srv.telegramClient.Do(req)
+	if err != nil {
+		// The URL carries the bot token, keep it out of the logs
+		return fmt.Errorf("telegram request failed: %w", errors.Unwrap(err))
+	}
+	defer resp.Body.Close()
+
+	var reply struct {
+		OK          bool            `json:"ok"`
+		Description string          `json:"description"`
+		Result      json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return fmt.Errorf("telegram %s: %s", method, resp.Status)
+	}
+	if !reply.OK {
+		return fmt.Errorf("telegram %s: %s", method, reply.Description)
+	}
+	if out != nil {
+		return json.Unmarshal(reply.Result, out)
+	}
+	return nil
+}
+
+func (b *telegramBot) send(srv *Server, chatID int64, text string, keyboard *tgKeyboard) {
+	params := map[string]interface{}{"chat_id": chatID, "text": text}
+	if keyboard != nil {
+		params["reply_markup"] = keyboard
+	}
+	if err := b.call(srv, context.Background(), "sendMessage", params, nil); err != nil {
+		srv.logger("telegram").Warn("Sending reply failed", "chat_id", chatID, "error", err)
+	}
+}
+
+// edit replaces a message's text and keyboard. Without a keyboard the
+// buttons go away, so a prompt can't be answered twice.
+func (b *telegramBot) edit(srv *Server, msg *tgMessage, text string, keyboard *tgKeyboard) {
+	params := map[string]interface{}{"chat_id": msg.Chat.ID, "message_id": msg.MessageID, "text": text}
+	if keyboard != nil {
+		params["reply_markup"] = keyboard
+	}
+	if err := b.call(srv, context.Background(), "editMessageText", params, nil); err != nil {
+		srv.logger("telegram").Warn("Editing message failed", "chat_id", msg.Chat.ID, "error", err)
+	}
+}
+
+func (b *telegramBot) allowed(chatID int64) bool {
+	return slices.Contains(b.chats, chatID)
+}
+
+// telegramActor names who sent a command, for the event log.
+func telegramActor(from *tgUser, chatID int64) string {
+	name := "unknown"
+	if from != nil {
+		name = cmp.Or(from.Username, from.FirstName, strconv.FormatInt(from.ID, 10))
+	}
+	return fmt.Sprintf("telegram:%s@%d", name, chatID)
+}
+
+const telegramHelp = `Commands:
+/list - all devices
+/status <device> - a device's state
+/on <device> - power a device on
+/off <device> - force a device off, after confirming
+
+Leave out the device to pick it from a list.`
+
+func (b *telegramBot) handleMessage(srv *Server, msg *tgMessage) {
+	tlog := srv.logger("telegram").With("chat_id", msg.Chat.ID)
+	if !strings.HasPrefix(msg.Text, "/") {
+		return
+	}
+	if !b.allowed(msg.Chat.ID) {
+		tlog.Warn("Command from a chat that is not allowed", "actor", telegramActor(msg.From, msg.Chat.ID))
+		b.send(srv, msg.Chat.ID, fmt.Sprintf("This chat is not allowed to control devices. Add %d to telegram.chats to allow it.", msg.Chat.ID), nil)
+		return
+	}
+
+	fields := strings.Fields(msg.Text)
+	// Commands in groups may be addressed as /on@mybot
+	name, _, _ := strings.Cut(strings.TrimPrefix(fields[0], "/"), "@")
+	arg := ""
+	if len(fields) > 1 {
+		arg = fields[1]
+	}
+	actor := telegramActor(msg.From, msg.Chat.ID)
+	tlog.Debug("Command received", "command", name, "device", arg, "actor", actor)
+
+	switch name {
+	case "start", "help":
+		b.send(srv, msg.Chat.ID, telegramHelp, nil)
+	case "list":
+		b.send(srv, msg.Chat.ID, srv.telegramList(), nil)
+	case "status", "on", "off":
+		if arg == "" {
+			b.pickDevice(srv, msg.Chat.ID, name)
+			return
+		}
+		b.send(srv, msg.Chat.ID, b.run(srv, name, srv.resolveAlias(arg), actor), b.confirmation(srv, name, srv.resolveAlias(arg)))
+	default:
+		b.send(srv, msg.Chat.ID, "Unknown command /"+name+"\n\n"+telegramHelp, nil)
+	}
+}
+
+// handleCallback runs a button press: "<command>:<esp_id>" from a device
+// list, or "confirm-off:<esp_id>" and "cancel" from an off prompt.
+func (b *telegramBot) handleCallback(srv *Server, cb *tgCallback) {
+	b.call(srv, context.Background(), "answerCallbackQuery", map[string]interface{}{"callback_query_id": cb.ID}, nil)
+	if cb.Message == nil {
+		return
+	}
+	chatID := cb.Message.Chat.ID
+	if !b.allowed(chatID) {
+		srv.logger("telegram").Warn("Button press from a chat that is not allowed", "chat_id", chatID)
+		return
+	}
+	actor := telegramActor(&cb.From, chatID)
+
+	name, id, _ := strings.Cut(cb.Data, ":")
+	switch name {
+	case "cancel":
+		b.edit(srv, cb.Message, "Cancelled", nil)
+	case "confirm-off":
+		b.edit(srv, cb.Message, b.runCommand(srv, CommandForce, id, actor), nil)
+	case "status", "on", "off":
+		b.edit(srv, cb.Message, b.run(srv, name, id, actor), b.confirmation(srv, name, id))
+	}
+}
+
+// run answers a device command. off only asks for confirmation; the
+// keyboard from confirmation goes with it.
+func (b *telegramBot) run(srv *Server, name, id, actor string) string {
+	switch name {
+	case "status":
+		return srv.telegramStatus(id)
+	case "off":
+		srv.mu.Lock()
+		esp, exists := srv.espMap[id]
+		protected := exists && esp.Protected
+		srv.mu.Unlock()
+		switch {
+		case !exists:
+			return fmt.Sprintf("%s is not registered", id)
+		case protected:
+			return fmt.Sprintf("%s is protected; force it off with the CLI and -override", srv.deviceName(id))
+		}
+		return fmt.Sprintf("Force %s off? Unsaved work on it is lost.", srv.deviceName(id))
+	}
+	return b.runCommand(srv, CommandPulse, id, actor)
+}
+
+// confirmation returns the buttons of an off prompt, or nil when run
+// didn't ask.
+func (b *telegramBot) confirmation(srv *Server, name, id string) *tgKeyboard {
+	if name != "off" {
+		return nil
+	}
+	srv.mu.Lock()
+	esp, exists := srv.espMap[id]
+	ask := exists && !esp.Protected
+	srv.mu.Unlock()
+	if !ask || len("confirm-off:"+id) > maxCallbackData {
+		return nil
+	}
+	return &tgKeyboard{InlineKeyboard: [][]tgButton{{
+		{Text: "Force off", CallbackData: "confirm-off:" + id},
+		{Text: "Cancel", CallbackData: "cancel"},
+	}}}
+}
+
+func (b *telegramBot) runCommand(srv *Server, cmd ESPCommand, id, actor string) string {
+	tlog := srv.logger("telegram").With("esp_id", id, "actor", actor)
+
+	srv.mu.Lock()
+	esp, exists := srv.espMap[id]
+	if !exists {
+		srv.mu.Unlock()
+		return fmt.Sprintf("%s is not registered", id)
+	}
+	result, err := srv.dispatchCommand(esp, cmd, commandOptions{}, actor)
+	srv.mu.Unlock()
+
+	action := "on"
+	if cmd == CommandForce {
+		action = "off"
+	}
+	switch {
+	case errors.Is(err, errAlreadyUp):
+		return fmt.Sprintf("%s is already up", srv.deviceName(id))
+	case errors.Is(err, errESPOffline):
+		return fmt.Sprintf("%s is offline, nothing was sent", srv.deviceName(id))
+	case err != nil:
+		tlog.Warn("Command rejected", "command", cmd, "error", err)
+		return fmt.Sprintf("Could not turn %s %s: %v", srv.deviceName(id), action, err)
+	}
+	tlog.Info("Command sent", "command", cmd, "command_id", result.Record.ID, "delivery", result.Delivery)
+	switch result.Status {
+	case "duplicate":
+		return fmt.Sprintf("'%s' is already queued for %s", action, srv.deviceName(id))
+	case "queued":
+		return fmt.Sprintf("Queued '%s' for %s", action, srv.deviceName(id))
+	}
+	return fmt.Sprintf("Sent '%s' to %s", action, srv.deviceName(id))
+}
+
+// pickDevice offers the devices as buttons.
+func (b *telegramBot) pickDevice(srv *Server, chatID int64, name string) {
+	srv.mu.Lock()
+	ids := make([]string, 0, len(srv.espMap))
+	for id, esp := range srv.espMap {
+		if name == "off" && esp.isWoL() {
+			continue
+		}
+		if len(name+":"+id) <= maxCallbackData {
+			ids = append(ids, id)
+		}
+	}
+	srv.mu.Unlock()
+	if len(ids) == 0 {
+		b.send(srv, chatID, "No devices registered", nil)
+		return
+	}
+	sort.Strings(ids)
+
+	var kb tgKeyboard
+	for i, id := range ids {
+		if i%2 == 0 {
+			kb.InlineKeyboard = append(kb.InlineKeyboard, nil)
+		}
+		row := &kb.InlineKeyboard[len(kb.InlineKeyboard)-1]
+		*row = append(*row, tgButton{Text: srv.deviceName(id), CallbackData: name + ":" + id})
+	}
+	b.send(srv, chatID, "Which device?", &kb)
+}
+
+func (srv *Server) telegramList() string {
+	srv.mu.Lock()
+	infos := make([]ESPInfo, 0, len(srv.espMap))
+	for _, esp := range srv.espMap {
+		infos = append(infos, srv.espInfo(esp))
+	}
+	srv.mu.Unlock()
+	if len(infos) == 0 {
+		return "No devices registered"
+	}
+	slices.SortFunc(infos, func(a, b ESPInfo) int { return cmp.Compare(a.ID, b.ID) })
+
+	var sb strings.Builder
+	for _, info := range infos {
+		fmt.Fprintf(&sb, "%s %s: %s\n", onlineMark(info), cmp.Or(info.Alias, info.ID), telegramState(info))
+	}
+	return strings.TrimSpace(sb.String())
+}
+
+func (srv *Server) telegramStatus(id string) string {
+	srv.mu.Lock()
+	esp, exists := srv.espMap[id]
+	if !exists {
+		srv.mu.Unlock()
+		return fmt.Sprintf("%s is not registered", id)
+	}
+	info := srv.espInfo(esp)
+	srv.mu.Unlock()
+
+	lines := []string{fmt.Sprintf("%s %s", onlineMark(info), cmp.Or(info.Alias, info.ID)), telegramState(info)}
+	if info.Type != string(DeviceWoL) {
+		lines = append(lines, "Last seen "+info.LastSeen)
+	}
+	if info.Location != "" {
+		lines = append(lines, "Location: "+info.Location)
+	}
+	if info.Power != nil && !info.Power.Since.IsZero() {
+		lines = append(lines, fmt.Sprintf("Power %s for %s", info.Power.State, srv.now().Sub(info.Power.Since).Round(time.Second)))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func onlineMark(info ESPInfo) string {
+	switch {
+	case info.Type == string(DeviceWoL):
+		return "⚪"
+	case info.Online:
+		return "🟢"
+	}
+	return "🔴"
+}
+
+// telegramState sums up a device in a few words, e.g. "online, target up".
+func telegramState(info ESPInfo) string {
+	state := "offline"
+	switch {
+	case info.Type == string(DeviceWoL):
+		state = "wake-on-LAN"
+	case info.Online:
+		state = "online"
+	}
+	if info.Target != nil {
+		target := "unknown"
+		if info.TargetState != nil {
+			target = UpDown(info.TargetState.Up)
+		}
+		state += ", target " + target
+	}
+	if info.Protected {
+		state += ", protected"
+	}
+	return state
+}
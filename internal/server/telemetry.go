@@ -0,0 +1,239 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Telemetry is the health data an ESP reports with its heartbeats. Fields
+// the ESP leaves out keep their last reported value.
+type Telemetry struct {
+	Firmware string   `json:"firmware,omitempty"`
+	Model    string   `json:"model,omitempty"`
+	RSSI     *int     `json:"rssi,omitempty"`
+	FreeHeap *int64   `json:"free_heap,omitempty"`
+	ChipTemp *float64 `json:"chip_temp,omitempty"`
+	Uptime   *int64   `json:"uptime,omitempty"`
+	// PowerSource is what the ESP itself runs on: mains, usb, battery or solar
+	PowerSource string   `json:"power_source,omitempty"`
+	BatteryV    *float64 `json:"battery_v,omitempty"`
+	// BatteryLow is set by the server while BatteryV is under the
+	// notifications.battery_low threshold
+	BatteryLow bool      `json:"battery_low,omitempty"`
+	ReportedAt time.Time `json:"reported_at"`
+}
+
+var powerSources = []string{"mains", "usb", "battery", "solar"}
+
+// batteryHysteresis is how far above the threshold the voltage must climb
+// before a low battery counts as recovered, so a reading hovering around
+// it doesn't alert on every heartbeat.
+const batteryHysteresis = 0.1
+
+func (t *Telemetry) empty() bool {
+	return t.Firmware == "" && t.Model == "" && t.RSSI == nil && t.FreeHeap == nil && t.ChipTemp == nil && t.Uptime == nil &&
+		t.PowerSource == "" && t.BatteryV == nil
+}
+
+// telemetryFromQuery reads telemetry from poll parameters
+// (fw, model, rssi, heap, temp, uptime, src, vbat). Malformed values are logged and skipped
+// so a firmware bug never blocks command delivery.
+func (srv *Server) telemetryFromQuery(id string, q url.Values) Telemetry {
+	t := Telemetry{Firmware: q.Get("fw"), Model: q.Get("model")}
+
+	parseInt := func(key string) *int64 {
+		v := q.Get(key)
+		if v == "" {
+			return nil
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			srv.logger("telemetry").Warn("Invalid telemetry value", "esp_id", id, "field", key, "value", v)
+			return nil
+		}
+		return &n
+	}
+
+	if n := parseInt("rssi"); n != nil {
+		rssi := int(*n)
+		t.RSSI = &rssi
+	}
+	t.FreeHeap = parseInt("heap")
+	t.Uptime = parseInt("uptime")
+	parseFloat := func(key string) *float64 {
+		v := q.Get(key)
+		if v == "" {
+			return nil
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			srv.logger("telemetry").Warn("Invalid telemetry value", "esp_id", id, "field", key, "value", v)
+			return nil
+		}
+		return &f
+	}
+	t.ChipTemp = parseFloat("temp")
+	t.BatteryV = parseFloat("vbat")
+	t.PowerSource = q.Get("src")
+	return t
+}
+
+// updateTelemetry merges a report into the ESP's telemetry. Must be called
+// with mu held.
+func (srv *Server) updateTelemetry(esp *ESP, t Telemetry) {
+	if t.empty() {
+		return
+	}
+
+	prev := esp.Telemetry
+	if prev == nil {
+		prev = &Telemetry{}
+	}
+	merged := *prev
+	if t.Firmware != "" {
+		if prev.Firmware != "" && prev.Firmware != t.Firmware {
+			srv.logger("telemetry").Info("Firmware changed", "esp_id", esp.ID, "from", prev.Firmware, "to", t.Firmware)
+		}
+		merged.Firmware = t.Firmware
+	}
+	if t.Model != "" {
+		merged.Model = t.Model
+	}
+	if t.RSSI != nil {
+		merged.RSSI = t.RSSI
+	}
+	if t.FreeHeap != nil {
+		merged.FreeHeap = t.FreeHeap
+	}
+	if t.ChipTemp != nil {
+		merged.ChipTemp = t.ChipTemp
+	}
+	if t.Uptime != nil {
+		if prev.Uptime != nil && *t.Uptime < *prev.Uptime {
+			srv.logger("telemetry").Warn("ESP rebooted", "esp_id", esp.ID, "uptime", *t.Uptime)
+		}
+		merged.Uptime = t.Uptime
+	}
+	if t.PowerSource != "" {
+		if !slices.Contains(powerSources, t.PowerSource) {
+			srv.logger("telemetry").Warn("Invalid telemetry value", "esp_id", esp.ID, "field", "power_source", "value", t.PowerSource)
+		} else {
+			if prev.PowerSource != "" && prev.PowerSource != t.PowerSource {
+				srv.logger("telemetry").Info("Power source changed", "esp_id", esp.ID, "from", prev.PowerSource, "to", t.PowerSource)
+			}
+			merged.PowerSource = t.PowerSource
+		}
+	}
+	if t.BatteryV != nil {
+		if *t.BatteryV < 0 || *t.BatteryV > 100 {
+			srv.logger("telemetry").Warn("Invalid telemetry value", "esp_id", esp.ID, "field", "battery_v", "value", *t.BatteryV)
+		} else {
+			merged.BatteryV = t.BatteryV
+			merged.BatteryLow = srv.checkBattery(esp, *t.BatteryV, prev.BatteryLow)
+		}
+	}
+	merged.ReportedAt = srv.now()
+	esp.Telemetry = &merged
+	srv.recordTelemetry(esp.ID, t)
+}
+
+// checkBattery records a battery event when the voltage crosses the
+// threshold and returns whether the battery is now low. Must be called with
+// mu held.
+func (srv *Server) checkBattery(esp *ESP, volts float64, wasLow bool) bool {
+	threshold := srv.batteryThreshold()
+	if threshold <= 0 {
+		return false
+	}
+	detail := fmt.Sprintf("%.2f V", volts)
+	switch {
+	case !wasLow && volts < threshold:
+		srv.logger("telemetry").Warn("Battery low", "esp_id", esp.ID, "volts", volts, "threshold", threshold)
+		srv.recordEvent(Event{Type: EventBattery, ESPID: esp.ID, Detail: "low: " + detail})
+		return true
+	case wasLow && volts >= threshold+batteryHysteresis:
+		srv.logger("telemetry").Info("Battery recovered", "esp_id", esp.ID, "volts", volts)
+		srv.recordEvent(Event{Type: EventBattery, ESPID: esp.ID, Detail: "ok: " + detail})
+		return false
+	}
+	return wasLow
+}
+
+type deviceDetails struct {
+	ESPInfo
+	MAC          string        `json:"mac,omitempty"`
+	Broadcast    string        `json:"broadcast,omitempty"`
+	RegisteredAt time.Time     `json:"registered_at"`
+	RemoteAddr   string        `json:"remote_addr"`
+	PinnedIP     string        `json:"pinned_ip,omitempty"`
+	Pending      int           `json:"pending"`
+	PulseMS      int           `json:"pulse_ms,omitempty"`
+	ForceMS      int           `json:"force_ms,omitempty"`
+	Driver       *DriverConfig `json:"driver,omitempty"`
+	SSH          string        `json:"ssh,omitempty"` // user@host:port soft-off logs in to
+	// CooldownMS is the device's cooldown, CooldownLeftMS what is left of it
+	CooldownMS     int64 `json:"cooldown_ms,omitempty"`
+	CooldownLeftMS int64 `json:"cooldown_left_ms,omitempty"`
+	// Capabilities is what the firmware declared at registration
+	Capabilities *Capabilities `json:"capabilities,omitempty"`
+	// Beacon is the last UDP beacon, nil if the device never sent one
+	Beacon *beaconInfo `json:"beacon,omitempty"`
+}
+
+func (srv *Server) infoHandler(w http.ResponseWriter, r *http.Request) {
+	id := srv.resolveAlias(r.URL.Query().Get("id"))
+
+	srv.mu.Lock()
+	esp, exists := srv.espMap[id]
+	if !exists || !requestPrincipal(r).canView(id) {
+		srv.mu.Unlock()
+		writeError(w, CodeESPNotFound, "ESP not registered")
+		return
+	}
+	details := srv.espDetails(esp)
+	srv.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(details)
+}
+
+// espDetails must be called with mu held.
+func (srv *Server) espDetails(esp *ESP) deviceDetails {
+	var driver *DriverConfig
+	if esp.Driver != nil {
+		d := *esp.Driver
+		d.Password = ""
+		driver = &d
+	} else if esp.isVM() {
+		driver = &DriverConfig{Addr: srv.vmAddr(esp.ID)}
+	}
+	var sshLogin string
+	if s, ok := srv.sshSettings(esp.ID); ok {
+		if addr := sshAddr(esp, s); addr != "" {
+			sshLogin = s.User + "@" + addr
+		}
+	}
+	return deviceDetails{
+		ESPInfo:      srv.espInfo(esp),
+		MAC:          esp.MAC,
+		Broadcast:    esp.Broadcast,
+		RegisteredAt: esp.RegisteredAt,
+		RemoteAddr:   esp.RemoteAddr,
+		PinnedIP:     esp.PinnedIP,
+		Pending:      len(esp.Queue),
+		PulseMS:      esp.PulseMS,
+		ForceMS:      esp.ForceMS,
+		Driver:       driver,
+		SSH:          sshLogin,
+
+		CooldownMS:     esp.cooldown(srv).Milliseconds(),
+		CooldownLeftMS: esp.cooldownLeft(srv, srv.now()).Milliseconds(),
+		Capabilities:   esp.Capabilities,
+		Beacon:         espBeacon(esp),
+	}
+}
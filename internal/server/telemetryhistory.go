@@ -0,0 +1,380 @@
+package server
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Telemetry history: the RSSI, chip temperature, free heap and battery
+// voltage devices report are sampled at most once per interval and kept
+// for the last few days, so they can be graphed. With -telemetry-dir the
+// samples are appended to one JSON lines segment per day, e.g.
+// 2026-10-14.jsonl; segments older than the retention are deleted, and the
+// rest are read back at startup.
+
+const (
+	defaultTelemetryDays     = 7
+	maxTelemetryDays         = 90
+	defaultTelemetryInterval = time.Minute
+	minTelemetryInterval     = 5 * time.Second
+	defaultTelemetrySince    = 24 * time.Hour
+	// maxTelemetryPoints caps a series; longer ones are averaged over a
+	// step that fits
+	maxTelemetryPoints = 2000
+)
+
+// TelemetryHistorySettings sets how often devices are sampled and for how
+// many days samples are kept.
+type TelemetryHistorySettings struct {
+	Interval time.Duration `yaml:"interval"` // default 1m
+	Days     int           `yaml:"days"`     // default 7
+}
+
+func (s TelemetryHistorySettings) interval() time.Duration {
+	return cmp.Or(s.Interval, defaultTelemetryInterval)
+}
+
+func (s TelemetryHistorySettings) retention() time.Duration {
+	return time.Duration(cmp.Or(s.Days, defaultTelemetryDays)) * 24 * time.Hour
+}
+
+func validateTelemetryHistory(s TelemetryHistorySettings) []error {
+	var errs []error
+	if s.Interval != 0 && s.Interval < minTelemetryInterval {
+		errs = append(errs, fmt.Errorf("telemetry_history.interval: must be at least %s, got %v", minTelemetryInterval, s.Interval))
+	}
+	if s.Days < 0 || s.Days > maxTelemetryDays {
+		errs = append(errs, fmt.Errorf("telemetry_history.days: must be between 1 and %d, got %d", maxTelemetryDays, s.Days))
+	}
+	return errs
+}
+
+type telemetrySample struct {
+	Time     time.Time `json:"t"`
+	ESPID    string    `json:"id"`
+	RSSI     *int      `json:"rssi,omitempty"`
+	ChipTemp *float64  `json:"chip_temp,omitempty"`
+	FreeHeap *int64    `json:"free_heap,omitempty"`
+	BatteryV *float64  `json:"battery_v,omitempty"`
+}
+
+type telemetryMetric struct {
+	name, unit string
+	get        func(telemetrySample) (float64, bool)
+}
+
+// telemetryMetrics are the graphed fields, in the order they are returned.
+var telemetryMetrics = []telemetryMetric{
+	{"rssi", "dBm", func(s telemetrySample) (float64, bool) {
+		if s.RSSI == nil {
+			return 0, false
+		}
+		return float64(*s.RSSI), true
+	}},
+	{"chip_temp", "°C", func(s telemetrySample) (float64, bool) {
+		if s.ChipTemp == nil {
+			return 0, false
+		}
+		return *s.ChipTemp, true
+	}},
+	{"free_heap", "bytes", func(s telemetrySample) (float64, bool) {
+		if s.FreeHeap == nil {
+			return 0, false
+		}
+		return float64(*s.FreeHeap), true
+	}},
+	{"battery_v", "V", func(s telemetrySample) (float64, bool) {
+		if s.BatteryV == nil {
+			return 0, false
+		}
+		return *s.BatteryV, true
+	}},
+}
+
+// telemetryhistoryState holds the Server state kept in telemetryhistory.go.
+type telemetryhistoryState struct {
+	telemetryMu      sync.Mutex
+	telemetryDir     string
+	telemetryHistory map[string][]telemetrySample // oldest first
+	telemetryFile    *os.File
+	telemetrySegment string
+}
+
+// loadTelemetryHistory reads the segments within the retention and deletes
+// older ones.
+func (srv *Server) loadTelemetryHistory() {
+	if srv.telemetryDir == "" {
+		return
+	}
+	if err := os.MkdirAll(srv.telemetryDir, 0o750); err != nil {
+		srv.fatal("telemetry", "Could not create telemetry directory", "path", srv.telemetryDir, "error", err)
+	}
+	srv.mu.Lock()
+	retention := srv.config.TelemetryHistory.retention()
+	srv.mu.Unlock()
+
+	cutoff := srv.now().Add(-retention)
+	srv.telemetryMu.Lock()
+	defer srv.telemetryMu.Unlock()
+	segments := srv.pruneTelemetrySegments(cutoff)
+	for _, path := range segments {
+		if err := srv.readTelemetrySegment(path, cutoff); err != nil {
+			srv.fatal("telemetry", "Could not read telemetry segment", "path", path, "error", err)
+		}
+	}
+	srv.logger("telemetry").Info("Telemetry history loaded", "devices", len(srv.telemetryHistory), "segments", len(segments), "path", srv.telemetryDir)
+
+	srv.onShutdown("close telemetry history", func() {
+		srv.telemetryMu.Lock()
+		if srv.telemetryFile != nil {
+			srv.telemetryFile.Close()
+			srv.telemetryFile = nil
+		}
+		srv.telemetryMu.Unlock()
+	})
+}
+
+// pruneTelemetrySegments deletes the segments that end before cutoff and
+// returns the others, oldest first. Must be called with telemetryMu held.
+func (srv *Server) pruneTelemetrySegments(cutoff time.Time) []string {
+	segments, err := filepath.Glob(filepath.Join(srv.telemetryDir, "*.jsonl"))
+	if err != nil {
+		srv.logger("telemetry").Error("Could not list telemetry segments", "path", srv.telemetryDir, "error", err)
+		return nil
+	}
+	slices.Sort(segments)
+	var kept []string
+	for _, path := range segments {
+		day, err := time.Parse(time.DateOnly, strings.TrimSuffix(filepath.Base(path), ".jsonl"))
+		if err == nil && day.AddDate(0, 0, 1).Before(cutoff) {
+			if err := os.Remove(path); err != nil {
+				srv.logger("telemetry").Warn("Could not delete telemetry segment", "path", path, "error", err)
+			}
+			continue
+		}
+		kept = append(kept, path)
+	}
+	return kept
+}
+
+func (srv *Server) readTelemetrySegment(path string, cutoff time.Time) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var s telemetrySample
+		if json.Unmarshal(scanner.Bytes(), &s) != nil || s.ESPID == "" || s.Time.Before(cutoff) {
+			continue
+		}
+		srv.telemetryHistory[s.ESPID] = append(srv.telemetryHistory[s.ESPID], s)
+	}
+	return scanner.Err()
+}
+
+// recordTelemetry samples a report, unless the device was sampled less
+// than an interval ago. Must be called with mu held; it takes telemetryMu.
+func (srv *Server) recordTelemetry(id string, t Telemetry) {
+	s := telemetrySample{Time: srv.now(), ESPID: id, RSSI: t.RSSI, ChipTemp: t.ChipTemp, FreeHeap: t.FreeHeap}
+	if t.BatteryV != nil && *t.BatteryV >= 0 && *t.BatteryV <= 100 {
+		s.BatteryV = t.BatteryV
+	}
+	if s.RSSI == nil && s.ChipTemp == nil && s.FreeHeap == nil && s.BatteryV == nil {
+		return
+	}
+	settings := srv.config.TelemetryHistory
+
+	srv.telemetryMu.Lock()
+	defer srv.telemetryMu.Unlock()
+	history := srv.telemetryHistory[id]
+	if n := len(history); n > 0 && s.Time.Sub(history[n-1].Time) < settings.interval() {
+		return
+	}
+	for len(history) > 0 && s.Time.Sub(history[0].Time) > settings.retention() {
+		history = history[1:]
+	}
+	srv.telemetryHistory[id] = append(history, s)
+
+	if srv.telemetryDir == "" {
+		return
+	}
+	if err := srv.writeTelemetrySample(s, settings.retention()); err != nil {
+		srv.logger("telemetry").Error("Failed to write telemetry history", "error", err)
+	}
+}
+
+// writeTelemetrySample must be called with telemetryMu held. Starting a
+// new day's segment deletes the expired ones and forgets samples of
+// devices that stopped reporting.
+func (srv *Server) writeTelemetrySample(s telemetrySample, retention time.Duration) error {
+	segment := s.Time.UTC().Format(time.DateOnly)
+	if srv.telemetryFile == nil || segment != srv.telemetrySegment {
+		if srv.telemetryFile != nil {
+			srv.telemetryFile.Close()
+		}
+		cutoff := s.Time.Add(-retention)
+		srv.pruneTelemetrySegments(cutoff)
+		for id, history := range srv.telemetryHistory {
+			i, _ := slices.BinarySearchFunc(history, cutoff, func(s telemetrySample, t time.Time) int { return s.Time.Compare(t) })
+			if i == len(history) {
+				delete(srv.telemetryHistory, id)
+			} else {
+				srv.telemetryHistory[id] = history[i:]
+			}
+		}
+		f, err := os.OpenFile(filepath.Join(srv.telemetryDir, segment+".jsonl"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			srv.telemetryFile = nil
+			return err
+		}
+		srv.telemetryFile, srv.telemetrySegment = f, segment
+	}
+	line, _ := json.Marshal(s)
+	_, err := srv.telemetryFile.Write(append(line, '\n'))
+	return err
+}
+
+// telemetryPoint is a sample, or with a step the average of the samples in
+// one step.
+type telemetryPoint struct {
+	Time  time.Time `json:"t"`
+	Value float64   `json:"v"`
+	Min   *float64  `json:"min,omitempty"`
+	Max   *float64  `json:"max,omitempty"`
+}
+
+type telemetrySeries struct {
+	Metric string           `json:"metric"`
+	Unit   string           `json:"unit"`
+	Points []telemetryPoint `json:"points"`
+}
+
+type telemetryReport struct {
+	ID    string    `json:"id"`
+	Since time.Time `json:"since"`
+	Until time.Time `json:"until"`
+	// StepMS is how much time each point averages, 0 for raw samples
+	StepMS int64             `json:"step_ms,omitempty"`
+	Series []telemetrySeries `json:"series"`
+}
+
+// telemetrySeriesFor collects one metric between since and until. Must be
+// called with telemetryMu held.
+func (srv *Server) telemetrySeriesFor(id string, metric int, since, until time.Time, step time.Duration) telemetrySeries {
+	m := telemetryMetrics[metric]
+	series := telemetrySeries{Metric: m.name, Unit: m.unit, Points: []telemetryPoint{}}
+	var sum float64
+	var count int
+	var cur *telemetryPoint
+	flush := func() {
+		if cur != nil {
+			cur.Value = sum / float64(count)
+			series.Points = append(series.Points, *cur)
+		}
+	}
+	for _, s := range srv.telemetryHistory[id] {
+		if s.Time.Before(since) || s.Time.After(until) {
+			continue
+		}
+		v, ok := m.get(s)
+		if !ok {
+			continue
+		}
+		if step == 0 {
+			series.Points = append(series.Points, telemetryPoint{Time: s.Time, Value: v})
+			continue
+		}
+		start := s.Time.Truncate(step)
+		if cur == nil || !cur.Time.Equal(start) {
+			flush()
+			lo, hi := v, v
+			cur, sum, count = &telemetryPoint{Time: start, Min: &lo, Max: &hi}, 0, 0
+		}
+		sum += v
+		count++
+		*cur.Min, *cur.Max = min(*cur.Min, v), max(*cur.Max, v)
+	}
+	flush()
+	return series
+}
+
+// telemetryHandler serves GET /esps/{id}/telemetry.
+func (srv *Server) telemetryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, CodeMethodNotAllowed, "only GET allowed")
+		return
+	}
+	q := r.URL.Query()
+	var metrics []int
+	for _, name := range SplitList(q.Get("metric")) {
+		i := slices.IndexFunc(telemetryMetrics, func(m telemetryMetric) bool { return m.name == name })
+		if i < 0 {
+			writeError(w, CodeInvalidRequest, fmt.Sprintf("unknown metric %q (use rssi, chip_temp, free_heap or battery_v)", name))
+			return
+		}
+		metrics = append(metrics, i)
+	}
+	if len(metrics) == 0 {
+		for i := range telemetryMetrics {
+			metrics = append(metrics, i)
+		}
+	}
+	now := srv.now()
+	since := now.Add(-defaultTelemetrySince)
+	if s := q.Get("since"); s != "" {
+		var err error
+		if since, err = srv.parseUptimeSince(s); err != nil {
+			writeError(w, CodeInvalidRequest, err.Error())
+			return
+		}
+	}
+	var step time.Duration
+	if s := q.Get("step"); s != "" {
+		var err error
+		if step, err = time.ParseDuration(s); err != nil || step < time.Second {
+			writeError(w, CodeInvalidRequest, fmt.Sprintf("invalid step %q (use e.g. 5m, at least 1s)", s))
+			return
+		}
+	}
+	id := srv.resolveAlias(r.PathValue("id"))
+
+	srv.mu.Lock()
+	_, exists := srv.espMap[id]
+	since = maxTime(since, now.Add(-srv.config.TelemetryHistory.retention()))
+	srv.mu.Unlock()
+	if !exists || !requestPrincipal(r).canView(id) {
+		writeError(w, CodeESPNotFound, "ESP not registered")
+		return
+	}
+
+	srv.telemetryMu.Lock()
+	// More points than a graph needs are averaged anyway
+	history := srv.telemetryHistory[id]
+	first, _ := slices.BinarySearchFunc(history, since, func(s telemetrySample, t time.Time) int { return s.Time.Compare(t) })
+	points := len(history) - first
+	if step > 0 {
+		points = min(points, int(now.Sub(since)/step))
+	}
+	if points > maxTelemetryPoints {
+		step = (now.Sub(since)/maxTelemetryPoints + time.Second - 1).Truncate(time.Second)
+	}
+	report := telemetryReport{ID: id, Since: since, Until: now, StepMS: step.Milliseconds()}
+	for _, m := range metrics {
+		report.Series = append(report.Series, srv.telemetrySeriesFor(id, m, since, now, step))
+	}
+	srv.telemetryMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// Adaptive timeout: a device that polls every few minutes would go offline
+// between polls under a global -timeout of 30s. The server keeps each
+// device's recent poll intervals and marks it offline after three times
+// their median instead, never sooner than -timeout. A timeout set per
+// device with 'wake-on-demand timeout' replaces both.
+
+const (
+	intervalSamples      = 20
+	minIntervalSamples   = 5
+	timeoutIntervals     = 3
+	maxAdaptiveTimeout   = 24 * time.Hour
+	minPollIntervalGap   = time.Second // quicker polls drain a queue, they aren't the interval
+	maxTimeoutOverride   = 7 * 24 * time.Hour
+	TimeoutSourceManual  = "manual"
+	TimeoutSourceAdapt   = "adaptive"
+	timeoutSourceDefault = "default"
+)
+
+// TimeoutInfo is the offline threshold in effect for a device.
+type TimeoutInfo struct {
+	TimeoutMS      int64  `json:"timeout_ms"`
+	Source         string `json:"source"` // manual, adaptive or default
+	PollIntervalMS int64  `json:"poll_interval_ms,omitempty"`
+}
+
+// recordInterval notes the gap since the device was last seen. Must be
+// called with mu held, before LastSeen is updated.
+func (e *ESP) recordInterval(now time.Time) {
+	if e.LastSeen.IsZero() {
+		return
+	}
+	gap := now.Sub(e.LastSeen)
+	if gap < minPollIntervalGap {
+		return
+	}
+	e.intervals = append(e.intervals, gap)
+	if len(e.intervals) > intervalSamples {
+		e.intervals = e.intervals[len(e.intervals)-intervalSamples:]
+	}
+	// Until there are enough samples the interval learnt before a restart
+	// stays in use
+	if len(e.intervals) >= minIntervalSamples {
+		sorted := slices.Clone(e.intervals)
+		slices.Sort(sorted)
+		e.PollIntervalMS = sorted[len(sorted)/2].Milliseconds()
+	}
+}
+
+// offlineTimeout is how long the device may go unseen before it counts as
+// offline.
+func (e *ESP) offlineTimeout(srv *Server) (time.Duration, string) {
+	if e.TimeoutMS > 0 {
+		return time.Duration(e.TimeoutMS) * time.Millisecond, TimeoutSourceManual
+	}
+	if e.PollIntervalMS > 0 {
+		adaptive := min(timeoutIntervals*time.Duration(e.PollIntervalMS)*time.Millisecond, maxAdaptiveTimeout)
+		if adaptive > srv.timeoutDuration {
+			return adaptive, TimeoutSourceAdapt
+		}
+	}
+	return srv.timeoutDuration, timeoutSourceDefault
+}
+
+func (e *ESP) timeoutInfo(srv *Server) *TimeoutInfo {
+	if e.isWoL() || e.isDriver() {
+		return nil
+	}
+	timeout, source := e.offlineTimeout(srv)
+	return &TimeoutInfo{TimeoutMS: timeout.Milliseconds(), Source: source, PollIntervalMS: e.PollIntervalMS}
+}
+
+func (srv *Server) timeoutHandler(w http.ResponseWriter, r *http.Request) {
+	rlog := srv.requestLogger(r)
+
+	if r.Method != http.MethodPost {
+		writeError(w, CodeMethodNotAllowed, "only POST allowed")
+		return
+	}
+
+	var data struct {
+		ID        string `json:"id"`
+		TimeoutMS int64  `json:"timeout_ms"`
+	}
+	if err := decodeJSON(w, r, &data); err != nil {
+		rlog.Warn("Invalid JSON", "error", err)
+		return
+	}
+	data.ID = srv.resolveAlias(data.ID)
+
+	// Zero goes back to the adaptive timeout
+	timeout := time.Duration(data.TimeoutMS) * time.Millisecond
+	if timeout != 0 && (timeout < time.Second || timeout > maxTimeoutOverride) {
+		writeError(w, CodeInvalidRequest, fmt.Sprintf("timeout must be between 1s and %s, got %s", maxTimeoutOverride, timeout))
+		return
+	}
+
+	srv.mu.Lock()
+	esp, exists := srv.espMap[data.ID]
+	if !exists {
+		srv.mu.Unlock()
+		rlog.Warn("ESP not found", "esp_id", data.ID)
+		writeError(w, CodeESPNotFound, "ESP not registered")
+		return
+	}
+	if esp.isWoL() || esp.isDriver() {
+		srv.mu.Unlock()
+		writeError(w, CodeInvalidRequest, fmt.Sprintf("%s device '%s' has no heartbeat to time out", esp.deviceType(), data.ID))
+		return
+	}
+	esp.TimeoutMS = data.TimeoutMS
+	srv.armOfflineCheck(esp)
+	info := esp.timeoutInfo(srv)
+	srv.saveRegistry()
+	srv.mu.Unlock()
+
+	rlog.Info("Offline timeout set", "esp_id", data.ID, "timeout", info.TimeoutMS, "source", info.Source)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "id": data.ID, "timeout": info})
+}
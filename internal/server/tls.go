@@ -0,0 +1,99 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// tlsState holds the Server state kept in tls.go.
+type tlsState struct {
+	tlsCertFile  string
+	tlsKeyFile   string
+	acmeDomain   string
+	acmeCacheDir string
+	acmeEmail    string
+
+	// clientTransport is the transport for connections the server makes,
+	// such as the cluster proxy, which forwards long-polls.
+	clientTransport http.RoundTripper
+	// clientTLS is the TLS config for those connections, built from
+	// -ca-cert and -insecure; nil means system defaults. Also used for
+	// MQTT over TLS.
+	clientTLS *tls.Config
+}
+
+func (srv *Server) tlsEnabled() bool {
+	return srv.tlsCertFile != "" || srv.acmeDomain != ""
+}
+
+// configureServerTLS prepares hs for HTTPS. With ACME it also starts the
+// HTTP-01 challenge listener on :80.
+func (srv *Server) configureServerTLS(hs *http.Server) error {
+	if srv.acmeDomain == "" {
+		cert, err := tls.LoadX509KeyPair(srv.tlsCertFile, srv.tlsKeyFile)
+		if err != nil {
+			return fmt.Errorf("load certificate: %w", err)
+		}
+		hs.TLSConfig = &tls.Config{
+			MinVersion:   tls.VersionTLS12,
+			Certificates: []tls.Certificate{cert},
+		}
+		return nil
+	}
+
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(srv.acmeDomain),
+		Cache:      autocert.DirCache(srv.acmeCacheDir),
+		Email:      srv.acmeEmail,
+	}
+	hs.TLSConfig = manager.TLSConfig()
+	hs.TLSConfig.MinVersion = tls.VersionTLS12
+
+	challenge := &http.Server{
+		Addr:              ":80",
+		Handler:           manager.HTTPHandler(nil),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := challenge.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			srv.logger("tls").Error("ACME challenge listener failed", "error", err)
+		}
+	}()
+	srv.onShutdown("stop ACME challenge listener", func() { challenge.Close() })
+	return nil
+}
+
+// LoadClientTLS builds the TLS config for outgoing connections that trust
+// caFile on top of the system roots, or skip verification. It returns nil
+// when neither is asked for.
+func LoadClientTLS(caFile string, insecure bool) (*tls.Config, error) {
+	if caFile == "" && !insecure {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	tlsConfig.InsecureSkipVerify = insecure
+	return tlsConfig, nil
+}
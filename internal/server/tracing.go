@@ -0,0 +1,394 @@
+package server
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Tracing sends OpenTelemetry spans to a collector over OTLP/HTTP with JSON
+// encoding: one per HTTP request, store operation, probe and notification.
+// Incoming W3C traceparent headers are continued, webhooks carry the
+// current one on, and request logs get the trace_id and span_id. Without an
+// endpoint no spans are made.
+
+const (
+	traceQueueSize   = 4096
+	traceBatchSize   = 512
+	traceFlushEvery  = 5 * time.Second
+	traceSendTimeout = 10 * time.Second
+)
+
+type spanKind int
+
+const (
+	spanInternal spanKind = 1
+	spanServer   spanKind = 2
+	spanClient   spanKind = 3
+)
+
+// span is one timed operation. A nil span is valid and does nothing, which
+// is what startSpan returns while tracing is off.
+type span struct {
+	traceID [16]byte
+	spanID  [8]byte
+	parent  [8]byte
+	sampled bool
+	name    string
+	kind    spanKind
+	start   time.Time
+	end     time.Time
+	attrs   []any
+	err     string
+}
+
+type spanKey struct{}
+
+// tracingState holds the Server state kept in tracing.go.
+type tracingState struct {
+	tracingSettings TracingSettings
+	traceQueue      chan *span
+	traceFlush      chan chan struct{}
+	tracingOn       bool
+	traceClient     *http.Client
+}
+
+// resolveTracing fills in the settings from the standard OTEL_* variables
+// where neither a flag, WOD_* variable nor the config set them.
+func resolveTracing(s TracingSettings) TracingSettings {
+	if s.Endpoint == "" {
+		if e := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"); e != "" {
+			s.Endpoint = e
+		} else if e := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); e != "" {
+			s.Endpoint = strings.TrimRight(e, "/") + "/v1/traces"
+		}
+	} else if !strings.HasSuffix(s.Endpoint, "/v1/traces") {
+		s.Endpoint = strings.TrimRight(s.Endpoint, "/") + "/v1/traces"
+	}
+	if s.Headers == nil {
+		s.Headers = make(map[string]string)
+	}
+	for _, pair := range strings.Split(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"), ",") {
+		if key, value, ok := strings.Cut(pair, "="); ok {
+			if _, set := s.Headers[strings.TrimSpace(key)]; !set {
+				s.Headers[strings.TrimSpace(key)] = strings.TrimSpace(value)
+			}
+		}
+	}
+	if s.ServiceName == "" {
+		s.ServiceName = cmp.Or(os.Getenv("OTEL_SERVICE_NAME"), "wake-on-demand")
+	}
+	if s.SampleRatio == nil {
+		ratio := 1.0
+		s.SampleRatio = &ratio
+	}
+	return s
+}
+
+func (srv *Server) tracingEnabled() bool {
+	return srv.tracingOn
+}
+
+// startTracing starts the exporter. Spans still queued at shutdown are sent
+// before the process exits.
+func (srv *Server) startTracing(s TracingSettings) {
+	if s.Endpoint == "" {
+		return
+	}
+	srv.tracingSettings = s
+	srv.traceQueue = make(chan *span, traceQueueSize)
+	srv.tracingOn = true
+	go srv.runTraceExporter()
+	srv.onShutdown("flush traces", func() {
+		done := make(chan struct{})
+		srv.traceFlush <- done
+		<-done
+	})
+	srv.logger("tracing").Info("Sending traces", "endpoint", s.Endpoint, "service", s.ServiceName, "sample_ratio", *s.SampleRatio)
+}
+
+// startSpan starts a span under the one in ctx, if any. attrs are key,
+// value pairs like slog's.
+func (srv *Server) startSpan(ctx context.Context, name string, kind spanKind, attrs ...any) (context.Context, *span) {
+	if !srv.tracingEnabled() {
+		return ctx, nil
+	}
+	s := &span{name: name, kind: kind, start: srv.now(), attrs: attrs}
+	rand.Read(s.spanID[:])
+	if parent, ok := ctx.Value(spanKey{}).(*span); ok && parent != nil {
+		s.traceID, s.parent, s.sampled = parent.traceID, parent.spanID, parent.sampled
+	} else {
+		rand.Read(s.traceID[:])
+		// Sampled by trace ID, so every service keeps or drops a trace alike
+		s.sampled = float64(binary.BigEndian.Uint64(s.traceID[8:])>>11)/(1<<53) < *srv.tracingSettings.SampleRatio
+	}
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+func (s *span) set(attrs ...any) {
+	if s != nil {
+		s.attrs = append(s.attrs, attrs...)
+	}
+}
+
+func (s *span) fail(err error) {
+	if s != nil && err != nil {
+		s.err = err.Error()
+	}
+}
+
+func (s *span) finish(srv *Server) {
+	if s == nil || !s.sampled {
+		return
+	}
+	s.end = srv.now()
+	select {
+	case srv.traceQueue <- s:
+	default:
+		// Dropping spans beats blocking requests on a slow collector
+	}
+}
+
+// logAttrs ties log lines to the span.
+func (s *span) logAttrs() []any {
+	if s == nil {
+		return nil
+	}
+	return []any{"trace_id", hex.EncodeToString(s.traceID[:]), "span_id", hex.EncodeToString(s.spanID[:])}
+}
+
+func (s *span) traceparent() string {
+	flags := "00"
+	if s.sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%x-%x-%s", s.traceID, s.spanID, flags)
+}
+
+// parseTraceparent reads a W3C traceparent header into a remote parent.
+func parseTraceparent(h string) *span {
+	parts := strings.Split(h, "-")
+	if len(parts) < 4 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return nil
+	}
+	var s span
+	if _, err := hex.Decode(s.traceID[:], []byte(parts[1])); err != nil || s.traceID == [16]byte{} {
+		return nil
+	}
+	if _, err := hex.Decode(s.spanID[:], []byte(parts[2])); err != nil || s.spanID == [8]byte{} {
+		return nil
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return nil
+	}
+	s.sampled = flags&1 == 1
+	return &s
+}
+
+// injectTraceparent passes the span in the request's context on to the
+// server it goes to.
+func injectTraceparent(req *http.Request) {
+	if s, ok := req.Context().Value(spanKey{}).(*span); ok && s != nil {
+		req.Header.Set("traceparent", s.traceparent())
+	}
+}
+
+// withTracing runs each request in a server span, continuing the caller's
+// trace when it sent a traceparent.
+func (srv *Server) withTracing(path string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !srv.tracingEnabled() {
+			next(w, r)
+			return
+		}
+		ctx := r.Context()
+		if parent := parseTraceparent(r.Header.Get("traceparent")); parent != nil {
+			ctx = context.WithValue(ctx, spanKey{}, parent)
+		}
+		ctx, s := srv.startSpan(ctx, r.Method+" "+path, spanServer,
+			"http.request.method", r.Method, "http.route", path, "url.path", r.URL.Path, "client.address", r.RemoteAddr)
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(rec, r.WithContext(ctx))
+		s.set("http.response.status_code", rec.status)
+		if rec.status >= 500 {
+			s.err = http.StatusText(rec.status)
+		}
+		s.finish(srv)
+	}
+}
+
+// traceStore records a span for every store operation.
+type traceStore struct {
+	Store
+	backend string
+	srv     *Server
+}
+
+func (t traceStore) trace(op string, fn func() error) error {
+	_, s := t.srv.startSpan(context.Background(), "store "+op, spanClient, "db.system", t.backend, "db.operation", op)
+	err := fn()
+	s.fail(err)
+	s.finish(t.srv)
+	return err
+}
+
+func (t traceStore) Load() (esps map[string]*ESP, err error) {
+	err = t.trace("load registry", func() (err error) {
+		esps, err = t.Store.Load()
+		return err
+	})
+	return esps, err
+}
+
+func (t traceStore) Save(esps map[string]*ESP) error {
+	return t.trace("save registry", func() error { return t.Store.Save(esps) })
+}
+
+func (t traceStore) LoadSchedules() (list []*Schedule, err error) {
+	err = t.trace("load schedules", func() (err error) {
+		list, err = t.Store.LoadSchedules()
+		return err
+	})
+	return list, err
+}
+
+func (t traceStore) SaveSchedules(list []*Schedule) error {
+	return t.trace("save schedules", func() error { return t.Store.SaveSchedules(list) })
+}
+
+func (t traceStore) LoadEvents(limit int) (list []Event, err error) {
+	err = t.trace("load events", func() (err error) {
+		list, err = t.Store.LoadEvents(limit)
+		return err
+	})
+	return list, err
+}
+
+func (t traceStore) AppendEvent(e Event) error {
+	return t.trace("append event", func() error { return t.Store.AppendEvent(e) })
+}
+
+func (t traceStore) ReplaceEvents(list []Event) error {
+	return t.trace("replace events", func() error { return t.Store.ReplaceEvents(list) })
+}
+
+// --- Export ---
+
+func (srv *Server) runTraceExporter() {
+	ticker := time.NewTicker(traceFlushEvery)
+	defer ticker.Stop()
+
+	var batch []*span
+	send := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := srv.exportSpans(batch); err != nil {
+			srv.logger("tracing").Warn("Could not send traces", "spans", len(batch), "error", err)
+		}
+		batch = nil
+	}
+	for {
+		select {
+		case s := <-srv.traceQueue:
+			if batch = append(batch, s); len(batch) >= traceBatchSize {
+				send()
+			}
+		case <-ticker.C:
+			send()
+		case done := <-srv.traceFlush:
+			for len(srv.traceQueue) > 0 {
+				batch = append(batch, <-srv.traceQueue)
+			}
+			send()
+			close(done)
+		}
+	}
+}
+
+func otlpAttrs(kv []any) []map[string]any {
+	var attrs []map[string]any
+	for i := 0; i+1 < len(kv); i += 2 {
+		var v map[string]any
+		switch value := kv[i+1].(type) {
+		case int:
+			v = map[string]any{"intValue": strconv.Itoa(value)}
+		case int64:
+			v = map[string]any{"intValue": strconv.FormatInt(value, 10)}
+		case bool:
+			v = map[string]any{"boolValue": value}
+		case float64:
+			v = map[string]any{"doubleValue": value}
+		default:
+			v = map[string]any{"stringValue": fmt.Sprint(value)}
+		}
+		attrs = append(attrs, map[string]any{"key": fmt.Sprint(kv[i]), "value": v})
+	}
+	return attrs
+}
+
+func (srv *Server) exportSpans(batch []*span) error {
+	spans := make([]map[string]any, 0, len(batch))
+	for _, s := range batch {
+		o := map[string]any{
+			"traceId":           hex.EncodeToString(s.traceID[:]),
+			"spanId":            hex.EncodeToString(s.spanID[:]),
+			"name":              s.name,
+			"kind":              s.kind,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        otlpAttrs(s.attrs),
+		}
+		if s.parent != [8]byte{} {
+			o["parentSpanId"] = hex.EncodeToString(s.parent[:])
+		}
+		if s.err != "" {
+			o["status"] = map[string]any{"code": 2, "message": s.err}
+		}
+		spans = append(spans, o)
+	}
+	hostname, _ := os.Hostname()
+	body, _ := json.Marshal(map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{"attributes": otlpAttrs([]any{
+				"service.name", srv.tracingSettings.ServiceName, "service.version", VERSION, "host.name", hostname,
+			})},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": "wake-on-demand", "version": VERSION},
+				"spans": spans,
+			}},
+		}},
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), traceSendTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, srv.tracingSettings.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "wake-on-demand/"+VERSION)
+	for key, value := range srv.tracingSettings.Headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := srv.traceClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("collector returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"mime"
+	"net/http"
+	"time"
+)
+
+//go:embed ui
+var uiFiles embed.FS
+
+const uiRefreshInterval = 2 * time.Second
+
+// uiState holds the Server state kept in ui.go.
+type uiState struct {
+	// uiStop is closed when the server starts shutting down so open event
+	// streams end instead of holding up the drain.
+	uiStop chan struct{}
+}
+
+func (srv *Server) uiHandler() http.HandlerFunc {
+	sub, err := fs.Sub(uiFiles, "ui")
+	if err != nil {
+		srv.fatal("ui", "Embedded dashboard missing", "error", err)
+	}
+	mime.AddExtensionType(".webmanifest", "application/manifest+json")
+	files := http.StripPrefix("/ui/", http.FileServer(http.FS(sub)))
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Browsers check for a new service worker on every visit, but only
+		// if nothing between them and the server caches it
+		if r.URL.Path == "/ui/sw.js" {
+			w.Header().Set("Cache-Control", "no-cache")
+		}
+		files.ServeHTTP(w, r)
+	}
+}
+
+// uiEventsHandler streams the device list as server-sent events, sending a
+// new snapshot whenever it changes. It takes the filters of /list, which
+// 'watch' uses.
+func (srv *Server) uiEventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, CodeInternal, "streaming not supported")
+		return
+	}
+	lq, err := srv.parseListQuery(r.URL.Query())
+	if err != nil {
+		writeError(w, CodeInvalidRequest, err.Error())
+		return
+	}
+	lq.limit, lq.after = 0, nil
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	rlog := srv.requestLogger(r)
+	rlog.Debug("Event stream opened")
+
+	ticker := time.NewTicker(uiRefreshInterval)
+	defer ticker.Stop()
+
+	var last []byte
+	keepalive := srv.now()
+	for {
+		srv.mu.Lock()
+		esps, _, _ := srv.listPage(requestPrincipal(r), lq)
+		srv.mu.Unlock()
+
+		data, _ := json.Marshal(map[string]interface{}{"esps": esps, "version": VERSION})
+		switch {
+		case !bytes.Equal(data, last):
+			fmt.Fprintf(w, "event: esps\ndata: %s\n\n", data)
+			flusher.Flush()
+			last, keepalive = data, srv.now()
+		case srv.now().Sub(keepalive) > 15*time.Second:
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+			keepalive = srv.now()
+		}
+
+		select {
+		case <-ticker.C:
+		case <-r.Context().Done():
+			rlog.Debug("Event stream closed")
+			return
+		case <-srv.uiStop:
+			return
+		}
+	}
+}
@@ -0,0 +1,327 @@
+"use strict";
+
+const loginForm = document.getElementById("login");
+const username = document.getElementById("username");
+const password = document.getElementById("password");
+const devices = document.getElementById("devices");
+const conn = document.getElementById("conn");
+const message = document.getElementById("message");
+
+// The dashboard signs in with a session cookie; keys are no longer kept in
+// the browser
+localStorage.removeItem("wod-admin-key");
+
+let csrfToken = "";
+let stream = null;
+
+loginForm.addEventListener("submit", async (e) => {
+  e.preventDefault();
+  const body = username.value
+    ? { username: username.value, password: password.value }
+    : { key: password.value };
+  const resp = await fetch("/ui/login", {
+    method: "POST",
+    headers: { "Content-Type": "application/json" },
+    body: JSON.stringify(body),
+  });
+  if (!resp.ok) {
+    showMessage(await errorMessage(resp), false);
+    return;
+  }
+  password.value = "";
+  applySession(await resp.json());
+  loadSession().then((s) => {
+  if (s.authenticated || !s.auth_required) connect();
+  else setConnected(false, "signed out");
+});
+});
+
+document.getElementById("logout").addEventListener("click", async () => {
+  if (stream) stream.abort();
+  const resp = await fetch("/ui/logout", { method: "POST", headers: headers() });
+  applySession(await resp.json());
+  setConnected(false, "signed out");
+  devices.replaceChildren();
+});
+
+async function loadSession() {
+  const resp = await fetch("/ui/session");
+  const session = await resp.json();
+  applySession(session);
+  return session;
+}
+
+function applySession(s) {
+  csrfToken = s.csrf_token || "";
+  loginForm.hidden = s.authenticated || !s.auth_required;
+  document.getElementById("sso").hidden = !s.oidc;
+  document.getElementById("account").hidden = !s.authenticated;
+  document.getElementById("whoami").textContent = s.authenticated ? `${s.name} (${s.role})` : "";
+}
+
+function headers(extra) {
+  const h = Object.assign({}, extra);
+  if (csrfToken) h["X-CSRF-Token"] = csrfToken;
+  return h;
+}
+
+// Errors come as {"error": {"code", "message"}}
+async function errorMessage(resp) {
+  const text = (await resp.text()).trim();
+  try {
+    return JSON.parse(text).error.message || text;
+  } catch {
+    return text || resp.statusText;
+  }
+}
+
+function setConnected(ok, text) {
+  conn.textContent = text;
+  conn.className = "conn " + (ok ? "online" : "offline");
+}
+
+function showMessage(text, ok) {
+  message.textContent = text;
+  message.className = ok ? "ok" : "";
+  message.hidden = !text;
+}
+
+// The stream is read with fetch and parsed by hand so a 401 can be told
+// apart from a dropped connection.
+async function connect() {
+  if (stream) stream.abort();
+  stream = new AbortController();
+  const signal = stream.signal;
+
+  try {
+    const resp = await fetch("/ui/events", { headers: headers(), signal });
+    if (resp.status === 401) {
+      setConnected(false, "signed out");
+      showMessage("Sign in to see devices", false);
+      loadSession();
+      return;
+    }
+    if (!resp.ok) throw new Error(await errorMessage(resp));
+
+    setConnected(true, "live");
+    showMessage("", true);
+
+    const reader = resp.body.getReader();
+    const decoder = new TextDecoder();
+    let buffer = "";
+    for (;;) {
+      const { value, done } = await reader.read();
+      if (done) break;
+      buffer += decoder.decode(value, { stream: true });
+      let idx;
+      while ((idx = buffer.indexOf("\n\n")) >= 0) {
+        handleEvent(buffer.slice(0, idx));
+        buffer = buffer.slice(idx + 2);
+      }
+    }
+  } catch (err) {
+    if (signal.aborted) return;
+  }
+
+  setConnected(false, "reconnecting…");
+  setTimeout(() => { if (!signal.aborted) connect(); }, 3000);
+}
+
+function handleEvent(raw) {
+  let event = "message";
+  const data = [];
+  for (const line of raw.split("\n")) {
+    if (line.startsWith("event:")) event = line.slice(6).trim();
+    else if (line.startsWith("data:")) data.push(line.slice(5).trim());
+  }
+  if (event !== "esps" || data.length === 0) return;
+
+  const snapshot = JSON.parse(data.join("\n"));
+  document.getElementById("version").textContent = "Server v" + snapshot.version;
+  render(snapshot.esps || []);
+}
+
+function el(tag, attrs, ...children) {
+  const node = document.createElement(tag);
+  Object.assign(node, attrs);
+  for (const child of children) {
+    node.append(child);
+  }
+  return node;
+}
+
+function render(esps) {
+  devices.replaceChildren();
+  if (esps.length === 0) {
+    devices.append(el("tr", {}, el("td", { colSpan: 6, className: "empty", textContent: "No ESPs registered" })));
+    return;
+  }
+
+  for (const esp of esps) {
+    const wol = esp.type === "wol";
+    const state = esp.pending_since ? "pending" : wol ? "wol" : esp.online ? "online" : "offline";
+    const name = esp.alias ? `${esp.alias} (${esp.id})` : esp.id;
+
+    let target = el("span", { className: "muted", textContent: "—" });
+    if (esp.power) {
+      const p = esp.power;
+      target = el("span", {
+        className: p.state === "off" ? "down" : p.state,
+        textContent: p.state.replace("_", " "),
+        title: (esp.target ? `${esp.target.probe} ${esp.target.host}` : "power sensor") + (p.source ? `, from ${p.source}` : ""),
+      });
+    } else if (esp.target) {
+      const s = esp.target_state;
+      const label = !s ? "unknown" : s.up ? "up" : "down";
+      target = el("span", {
+        className: label,
+        textContent: label,
+        title: `${esp.target.probe} ${esp.target.host}` + (s && s.error ? `: ${s.error}` : ""),
+      });
+    }
+
+    const actions = el("td", { className: "actions" });
+    if (esp.pending_since) {
+      const button = el("button", { textContent: "approve", className: "approve", title: "Waiting for approval since " + esp.pending_since });
+      button.addEventListener("click", () => approve(esp.id, button));
+      actions.append(button);
+    }
+    for (const action of esp.pending_since ? [] : ["on", "off", "status"]) {
+      const button = el("button", { textContent: action, className: action });
+      button.disabled = wol && action !== "on";
+      button.addEventListener("click", () => send(esp.id, action, button));
+      actions.append(button);
+    }
+
+    devices.append(el("tr", {},
+      el("td", { className: "state" }, el("span", { className: "dot " + state, textContent: "●", title: state })),
+      el("td", { className: "name", textContent: name, title: [esp.description, esp.location, telemetrySummary(esp.telemetry)].filter(Boolean).join("\n") }),
+      el("td", { className: "type", textContent: esp.type }),
+      el("td", { className: "seen", textContent: esp.last_seen }),
+      el("td", { className: "target" }, target),
+      actions,
+    ));
+  }
+}
+
+function telemetrySummary(t) {
+  if (!t) return "";
+  const parts = [];
+  if (t.firmware) parts.push("fw " + t.firmware);
+  if (t.rssi != null) parts.push(t.rssi + " dBm");
+  if (t.free_heap != null) parts.push(t.free_heap + " B free");
+  if (t.chip_temp != null) parts.push(t.chip_temp + " °C");
+  if (t.uptime != null) parts.push("up " + t.uptime + "s");
+  return parts.join(", ");
+}
+
+const actionCommands = { on: "pulse", off: "force", status: "status" };
+
+async function send(id, action, button) {
+  button.disabled = true;
+  try {
+    const resp = await fetch("/api/v1/set-command", {
+      method: "POST",
+      headers: headers({ "Content-Type": "application/json" }),
+      body: JSON.stringify({ id, command: actionCommands[action] }),
+    });
+    if (!resp.ok) {
+      showMessage(`${action} ${id}: ${await errorMessage(resp)}`, false);
+      return;
+    }
+    const result = await resp.json();
+    showMessage(`${action} ${id}: ${result.status} (command ${result.command_id})`, true);
+  } catch (err) {
+    showMessage(`${action} ${id}: ${err.message}`, false);
+  } finally {
+    button.disabled = false;
+  }
+}
+
+// The code is what the ESP printed on its serial console; the server only
+// insists on it with -pairing code
+async function approve(id, button) {
+  const code = prompt(`Pairing code ${id} printed (leave empty if not required)`);
+  if (code === null) return;
+  button.disabled = true;
+  try {
+    const resp = await fetch("/api/v1/approve", {
+      method: "POST",
+      headers: headers({ "Content-Type": "application/json" }),
+      body: JSON.stringify({ id, code: code.trim() }),
+    });
+    if (!resp.ok) {
+      showMessage(`approve ${id}: ${await errorMessage(resp)}`, false);
+      return;
+    }
+    showMessage(`${id} approved`, true);
+  } catch (err) {
+    showMessage(`approve ${id}: ${err.message}`, false);
+  } finally {
+    button.disabled = false;
+  }
+}
+
+// --- Install and push ---
+
+// Service workers and push only work over HTTPS or on localhost
+const pushButton = document.getElementById("push");
+let worker = null;
+
+if ("serviceWorker" in navigator && window.isSecureContext) {
+  navigator.serviceWorker.register("sw.js").then((reg) => {
+    worker = reg;
+    if ("PushManager" in window) updatePushButton();
+  });
+}
+
+async function updatePushButton() {
+  const sub = await worker.pushManager.getSubscription();
+  pushButton.textContent = sub ? "Mute" : "Notify me";
+  pushButton.title = sub ? "Stop notifications on this device" : "Get notified when devices go on- or offline";
+  pushButton.hidden = false;
+}
+
+pushButton.addEventListener("click", async () => {
+  pushButton.disabled = true;
+  try {
+    const sub = await worker.pushManager.getSubscription();
+    if (sub) {
+      await fetch("/ui/push/unsubscribe", {
+        method: "POST",
+        headers: headers({ "Content-Type": "application/json" }),
+        body: JSON.stringify({ endpoint: sub.endpoint }),
+      });
+      await sub.unsubscribe();
+      showMessage("Notifications off on this device", true);
+      return;
+    }
+
+    const keyResp = await fetch("/ui/push/key", { headers: headers() });
+    if (!keyResp.ok) throw new Error(await errorMessage(keyResp));
+    const { public_key } = await keyResp.json();
+    const created = await worker.pushManager.subscribe({ userVisibleOnly: true, applicationServerKey: base64url(public_key) });
+    const resp = await fetch("/ui/push/subscribe", {
+      method: "POST",
+      headers: headers({ "Content-Type": "application/json" }),
+      body: JSON.stringify(created.toJSON()),
+    });
+    if (!resp.ok) {
+      await created.unsubscribe();
+      throw new Error(await errorMessage(resp));
+    }
+    showMessage("Notifications on for this device", true);
+  } catch (err) {
+    showMessage(`Notifications: ${err.message}`, false);
+  } finally {
+    pushButton.disabled = false;
+    updatePushButton();
+  }
+});
+
+function base64url(s) {
+  const raw = atob(s.replace(/-/g, "+").replace(/_/g, "/"));
+  return Uint8Array.from(raw, (c) => c.charCodeAt(0));
+}
+
+connect();
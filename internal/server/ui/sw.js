@@ -0,0 +1,70 @@
+"use strict";
+
+// The service worker makes the dashboard installable, keeps its shell
+// around for when the network is flaky, and shows Web Push messages while
+// the page is closed. Device state is never cached: /ui/events and the API
+// always go to the server.
+
+const CACHE = "wod-shell-v1";
+const SHELL = ["./", "app.js", "style.css", "manifest.webmanifest", "icon-192.png"];
+
+self.addEventListener("install", (e) => {
+  e.waitUntil(caches.open(CACHE).then((c) => c.addAll(SHELL)).then(() => self.skipWaiting()));
+});
+
+self.addEventListener("activate", (e) => {
+  e.waitUntil(
+    caches.keys()
+      .then((keys) => Promise.all(keys.filter((k) => k !== CACHE).map((k) => caches.delete(k))))
+      .then(() => self.clients.claim()),
+  );
+});
+
+// Network first, so a new server version shows up right away; the cache
+// only answers when the server can't
+self.addEventListener("fetch", (e) => {
+  const url = new URL(e.request.url);
+  if (e.request.method !== "GET" || url.origin !== location.origin) return;
+  const shell = url.pathname.replace(/^\/ui\//, "") || "./";
+  if (!SHELL.includes(shell)) return;
+  e.respondWith(
+    fetch(e.request)
+      .then((resp) => {
+        if (resp.ok) {
+          const copy = resp.clone();
+          caches.open(CACHE).then((c) => c.put(e.request, copy));
+        }
+        return resp;
+      })
+      .catch(() => caches.match(e.request)),
+  );
+});
+
+self.addEventListener("push", (e) => {
+  let msg = { title: "Wake-On-Demand", body: "" };
+  try {
+    msg = e.data.json();
+  } catch (err) {
+    if (e.data) msg.body = e.data.text();
+  }
+  e.waitUntil(self.registration.showNotification(msg.title, {
+    body: msg.body,
+    tag: msg.tag,
+    icon: "icon-192.png",
+    badge: "icon-192.png",
+    data: { url: msg.url || "/ui/" },
+  }));
+});
+
+self.addEventListener("notificationclick", (e) => {
+  e.notification.close();
+  const url = e.notification.data.url;
+  e.waitUntil(
+    self.clients.matchAll({ type: "window" }).then((list) => {
+      for (const c of list) {
+        if (new URL(c.url).pathname.startsWith("/ui/")) return c.focus();
+      }
+      return self.clients.openWindow(url);
+    }),
+  );
+});
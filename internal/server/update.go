@@ -0,0 +1,82 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"runtime/debug"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Set with -ldflags "-X" like VERSION; commit and date fall back to what the
+// go tool recorded from git.
+var (
+	commit    string
+	buildDate string
+)
+
+// UpdateSettings configures self-update. PublicKey is an authorized_keys
+// line or a file holding one.
+type UpdateSettings struct {
+	URL       string `yaml:"url"`  // release directory; default the latest GitHub release
+	Repo      string `yaml:"repo"` // GitHub owner/name
+	PublicKey string `yaml:"public_key"`
+}
+
+func validateUpdate(s UpdateSettings) []error {
+	var errs []error
+	if s.URL != "" && !strings.HasPrefix(s.URL, "https://") && !strings.HasPrefix(s.URL, "http://") {
+		errs = append(errs, fmt.Errorf("update.url: must be an http:// or https:// URL, got %q", s.URL))
+	}
+	if s.Repo != "" && strings.Count(s.Repo, "/") != 1 {
+		errs = append(errs, fmt.Errorf("update.repo: must be owner/name, got %q", s.Repo))
+	}
+	if s.PublicKey != "" {
+		if _, err := ParseReleaseKey(s.PublicKey); err != nil {
+			errs = append(errs, fmt.Errorf("update.public_key: %v", err))
+		}
+	}
+	return errs
+}
+
+// BuildCommit is the commit and date the binary was built from, if known.
+func BuildCommit() (rev, date string) {
+	rev, date = commit, buildDate
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return rev, date
+	}
+	dirty := false
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			if rev == "" {
+				rev = s.Value[:min(len(s.Value), 7)]
+			}
+		case "vcs.time":
+			if date == "" {
+				date = s.Value
+			}
+		case "vcs.modified":
+			dirty = s.Value == "true"
+		}
+	}
+	if dirty && commit == "" && rev != "" {
+		rev += "-dirty"
+	}
+	return rev, date
+}
+
+// ParseReleaseKey reads an authorized_keys line, or a file holding one.
+func ParseReleaseKey(s string) (ssh.PublicKey, error) {
+	data := []byte(s)
+	if !strings.Contains(s, " ") {
+		var err error
+		if data, err = os.ReadFile(s); err != nil {
+			return nil, err
+		}
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	return key, err
+}
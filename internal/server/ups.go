@@ -0,0 +1,434 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The UPS monitor follows mains power through a NUT server (upsd) or
+// apcupsd. When the UPS switches to battery it runs the on_battery actions,
+// when the battery runs low on_low_battery, and once mains is back
+// on_restore. Each action works through its devices one at a time, stagger
+// apart, so a restore doesn't start every machine at once. A change of power
+// cancels whatever the previous one still had queued.
+
+const (
+	defaultUPSPoll  = 5 * time.Second
+	upsDialTimeout  = 5 * time.Second
+	upsQueryTimeout = 10 * time.Second
+)
+
+// UPSAction is one entry of the ups on_battery, on_low_battery and
+// on_restore lists. After delays the first device; Stagger spaces out the
+// rest.
+type UPSAction struct {
+	Devices []string      `yaml:"devices"` // ESP IDs, aliases or @groups
+	Action  string        `yaml:"action"`  // on, off or soft-off
+	After   time.Duration `yaml:"after"`
+	Stagger time.Duration `yaml:"stagger"`
+}
+
+// upsReading is one poll of the UPS.
+type upsReading struct {
+	Status     string   `json:"status"` // raw, e.g. "OL CHRG" or "ONBATT"
+	OnBattery  bool     `json:"on_battery"`
+	LowBattery bool     `json:"low_battery"`
+	Charge     *float64 `json:"battery_charge,omitempty"`  // percent
+	Runtime    *int     `json:"battery_runtime,omitempty"` // seconds
+}
+
+func (r upsReading) String() string {
+	var parts []string
+	if r.Charge != nil {
+		parts = append(parts, fmt.Sprintf("charge %.0f%%", *r.Charge))
+	}
+	if r.Runtime != nil {
+		parts = append(parts, fmt.Sprintf("%s left", time.Duration(*r.Runtime)*time.Second))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// upsState holds the Server state kept in ups.go.
+type upsState struct {
+	// upsMu guards the UPS state below
+	upsMu      sync.Mutex
+	upsLast    *upsReading
+	upsPolled  time.Time
+	upsChanged time.Time
+	upsErr     error
+	// upsCtx is cancelled by the next switch between mains and battery
+	upsCtx    context.Context
+	upsCancel context.CancelFunc
+}
+
+func (srv *Server) upsEnabled() bool {
+	return srv.config.UPS.Driver != ""
+}
+
+func (s UPSSettings) address() string {
+	if s.Address != "" {
+		return s.Address
+	}
+	if s.Driver == "apcupsd" {
+		return "localhost:3551"
+	}
+	return "localhost:3493"
+}
+
+func (s UPSSettings) upsName() string {
+	if s.Name != "" {
+		return s.Name
+	}
+	return "ups"
+}
+
+func validateUPS(s UPSSettings) []error {
+	var errs []error
+	if s.Driver == "" {
+		return nil
+	}
+	if s.Driver != "nut" && s.Driver != "apcupsd" {
+		errs = append(errs, fmt.Errorf("ups.driver: must be nut or apcupsd, got %q", s.Driver))
+	}
+	if _, _, err := net.SplitHostPort(s.address()); err != nil {
+		errs = append(errs, fmt.Errorf("ups.address: %v", err))
+	}
+	if s.PollInterval < 0 {
+		errs = append(errs, fmt.Errorf("ups.poll_interval: must be positive, got %v", s.PollInterval))
+	}
+	for list, actions := range map[string][]UPSAction{"on_battery": s.OnBattery, "on_low_battery": s.OnLowBattery, "on_restore": s.OnRestore} {
+		for i, a := range actions {
+			if len(a.Devices) == 0 {
+				errs = append(errs, fmt.Errorf("ups.%s[%d]: devices is required", list, i))
+			}
+			if cmd, ok := ActionCommand(a.Action); !ok || cmd == CommandStatus {
+				errs = append(errs, fmt.Errorf("ups.%s[%d]: action must be on, off or soft-off, got %q", list, i, a.Action))
+			}
+			if a.After < 0 || a.Stagger < 0 {
+				errs = append(errs, fmt.Errorf("ups.%s[%d]: after and stagger must be positive", list, i))
+			}
+		}
+	}
+	return errs
+}
+
+func pollUPS(s UPSSettings) (upsReading, error) {
+	if s.Driver == "apcupsd" {
+		return pollApcupsd(s)
+	}
+	return pollNUT(s)
+}
+
+// pollNUT reads the UPS variables from upsd over the NUT network protocol.
+func pollNUT(s UPSSettings) (upsReading, error) {
+	var reading upsReading
+	conn, err := net.DialTimeout("tcp", s.address(), upsDialTimeout)
+	if err != nil {
+		return reading, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(upsQueryTimeout))
+	r := bufio.NewReader(conn)
+
+	send := func(line string) (string, error) {
+		if _, err := fmt.Fprintf(conn, "%s\n", line); err != nil {
+			return "", err
+		}
+		reply, err := r.ReadString('\n')
+		reply = strings.TrimSpace(reply)
+		if err != nil {
+			return "", err
+		}
+		if strings.HasPrefix(reply, "ERR ") {
+			return "", fmt.Errorf("upsd: %s", strings.ToLower(strings.TrimPrefix(reply, "ERR ")))
+		}
+		return reply, nil
+	}
+	if s.Username != "" {
+		if _, err := send("USERNAME " + s.Username); err != nil {
+			return reading, err
+		}
+		if _, err := send("PASSWORD " + s.Password); err != nil {
+			return reading, err
+		}
+	}
+	if _, err := send("LIST VAR " + s.upsName()); err != nil {
+		return reading, err
+	}
+	vars := make(map[string]string)
+	prefix := "VAR " + s.upsName() + " "
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return reading, fmt.Errorf("upsd: %v", err)
+		}
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "END LIST") {
+			break
+		}
+		key, value, ok := strings.Cut(strings.TrimPrefix(line, prefix), " ")
+		if !ok {
+			continue
+		}
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		}
+		vars[key] = value
+	}
+	fmt.Fprintf(conn, "LOGOUT\n")
+
+	reading.Status = vars["ups.status"]
+	if reading.Status == "" {
+		return reading, errors.New("upsd did not report ups.status")
+	}
+	for _, flag := range strings.Fields(reading.Status) {
+		switch flag {
+		case "OB":
+			reading.OnBattery = true
+		case "LB":
+			reading.LowBattery = true
+		}
+	}
+	if v, err := strconv.ParseFloat(vars["battery.charge"], 64); err == nil {
+		reading.Charge = &v
+	}
+	if v, err := strconv.ParseFloat(vars["battery.runtime"], 64); err == nil {
+		seconds := int(v)
+		reading.Runtime = &seconds
+	}
+	return reading, nil
+}
+
+// pollApcupsd reads the status report from apcupsd's network information
+// server. Every message in either direction carries a 2-byte length; an
+// empty one ends the report.
+func pollApcupsd(s UPSSettings) (upsReading, error) {
+	var reading upsReading
+	conn, err := net.DialTimeout("tcp", s.address(), upsDialTimeout)
+	if err != nil {
+		return reading, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(upsQueryTimeout))
+
+	if _, err := conn.Write(append([]byte{0, 6}, "status"...)); err != nil {
+		return reading, err
+	}
+	r := bufio.NewReader(conn)
+	vars := make(map[string]string)
+	for {
+		var n uint16
+		if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+			return reading, fmt.Errorf("apcupsd: %v", err)
+		}
+		if n == 0 {
+			break
+		}
+		record := make([]byte, n)
+		if _, err := io.ReadFull(r, record); err != nil {
+			return reading, fmt.Errorf("apcupsd: %v", err)
+		}
+		if key, value, ok := strings.Cut(string(record), ":"); ok {
+			vars[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+
+	reading.Status = vars["STATUS"]
+	if reading.Status == "" {
+		return reading, errors.New("apcupsd did not report STATUS")
+	}
+	for _, flag := range strings.Fields(reading.Status) {
+		switch flag {
+		case "ONBATT":
+			reading.OnBattery = true
+		case "LOWBATT":
+			reading.LowBattery = true
+		case "COMMLOST":
+			return reading, errors.New("apcupsd lost contact with the UPS")
+		}
+	}
+	// Values carry their unit, e.g. "100.0 Percent" and "45.0 Minutes"
+	if f := strings.Fields(vars["BCHARGE"]); len(f) > 0 {
+		if v, err := strconv.ParseFloat(f[0], 64); err == nil {
+			reading.Charge = &v
+		}
+	}
+	if f := strings.Fields(vars["TIMELEFT"]); len(f) > 0 {
+		if v, err := strconv.ParseFloat(f[0], 64); err == nil {
+			seconds := int(v * 60)
+			reading.Runtime = &seconds
+		}
+	}
+	return reading, nil
+}
+
+// runUPSMonitor polls the UPS until the process exits. The first reading
+// only sets the baseline: a server started during an outage waits for the
+// next change before it acts.
+func (srv *Server) runUPSMonitor() {
+	s := srv.config.UPS
+	ulog := srv.logger("ups").With("driver", s.Driver, "address", s.address())
+	interval := s.PollInterval
+	if interval == 0 {
+		interval = defaultUPSPoll
+	}
+	ulog.Info("Watching UPS", "poll_interval", interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for ; ; <-ticker.C {
+		reading, err := pollUPS(s)
+		now := srv.now()
+
+		srv.upsMu.Lock()
+		prev, prevErr := srv.upsLast, srv.upsErr
+		srv.upsPolled, srv.upsErr = now, err
+		if err == nil {
+			srv.upsLast = &reading
+		}
+		srv.upsMu.Unlock()
+
+		if err != nil {
+			if prevErr == nil {
+				ulog.Warn("Cannot read the UPS", "error", err)
+			}
+			continue
+		}
+		if prevErr != nil {
+			ulog.Info("UPS readable again", "status", reading.Status)
+		}
+		switch {
+		case prev == nil:
+			ulog.Info("UPS status", "status", reading.Status, "on_battery", reading.OnBattery)
+		case reading.OnBattery && !prev.OnBattery:
+			srv.upsPowerChange(ulog, "on battery", reading, s.OnBattery, true)
+		case !reading.OnBattery && prev.OnBattery:
+			srv.upsPowerChange(ulog, "mains power restored", reading, s.OnRestore, true)
+		}
+		if prev != nil && reading.LowBattery && !prev.LowBattery {
+			srv.upsPowerChange(ulog, "battery low", reading, s.OnLowBattery, false)
+		}
+	}
+}
+
+// upsPowerChange records a change of power and starts its actions. A
+// switch between mains and battery cancels what the last one still had
+// queued; a low battery adds to the outage's actions.
+func (srv *Server) upsPowerChange(ulog *slog.Logger, change string, reading upsReading, actions []UPSAction, cancelPrevious bool) {
+	detail := change
+	if s := reading.String(); s != "" {
+		detail += ": " + s
+	}
+	ulog.Info("UPS "+change, "status", reading.Status, "actions", len(actions))
+
+	srv.upsMu.Lock()
+	srv.upsChanged = srv.now()
+	if cancelPrevious && srv.upsCancel != nil {
+		srv.upsCancel()
+		srv.upsCancel = nil
+	}
+	if srv.upsCancel == nil {
+		srv.upsCtx, srv.upsCancel = context.WithCancel(context.Background())
+	}
+	ctx := srv.upsCtx
+	srv.upsMu.Unlock()
+
+	srv.mu.Lock()
+	srv.recordEvent(Event{Type: EventUPS, Actor: "ups", Detail: detail})
+	srv.mu.Unlock()
+	if srv.notificationsEnabled() {
+		srv.queueNotification(notification{Trigger: TriggerPower, Message: "UPS " + srv.config.UPS.upsName() + ": " + detail, Time: srv.now()})
+	}
+
+	start := srv.now()
+	for _, a := range actions {
+		go srv.runUPSAction(ctx, a, start, change)
+	}
+}
+
+// runUPSAction sends the action to each of its devices in turn.
+func (srv *Server) runUPSAction(ctx context.Context, a UPSAction, start time.Time, change string) {
+	cmd, _ := ActionCommand(a.Action)
+	srv.mu.Lock()
+	ids := srv.expandDeviceRefs(a.Devices)
+	srv.mu.Unlock()
+
+	for i, id := range ids {
+		alog := srv.logger("ups").With("esp_id", id, "command", cmd, "change", change)
+		wait := start.Add(a.After + time.Duration(i)*a.Stagger).Sub(srv.now())
+		select {
+		case <-ctx.Done():
+			alog.Info("UPS action cancelled, power changed again", "skipped", len(ids)-i)
+			return
+		case <-time.After(wait):
+		}
+
+		srv.mu.Lock()
+		esp, exists := srv.espMap[id]
+		if !exists {
+			srv.mu.Unlock()
+			alog.Warn("UPS action skipped, ESP not registered")
+			continue
+		}
+		result, err := srv.dispatchCommand(esp, cmd, commandOptions{Priority: PriorityUrgent, AfterCooldown: true, IgnoreQuota: true}, "ups")
+		srv.mu.Unlock()
+		switch {
+		case errors.Is(err, errAlreadyUp):
+			alog.Info("UPS action skipped, target already up")
+		case err != nil:
+			alog.Warn("UPS action failed", "error", err)
+		default:
+			alog.Info("UPS action sent", "status", result.Status, "delivery", result.Delivery)
+		}
+	}
+}
+
+type UPSInfo struct {
+	Driver    string      `json:"driver"`
+	Address   string      `json:"address"`
+	Name      string      `json:"name,omitempty"`
+	Reading   *upsReading `json:"reading,omitempty"`
+	Error     string      `json:"error,omitempty"`
+	LastPoll  *time.Time  `json:"last_poll,omitempty"`
+	ChangedAt *time.Time  `json:"changed_at,omitempty"`
+}
+
+func (srv *Server) upsHandler(w http.ResponseWriter, r *http.Request) {
+	if !srv.upsEnabled() {
+		writeError(w, CodeNotFound, "no UPS configured")
+		return
+	}
+	info := UPSInfo{Driver: srv.config.UPS.Driver, Address: srv.config.UPS.address()}
+	if srv.config.UPS.Driver == "nut" {
+		info.Name = srv.config.UPS.upsName()
+	}
+	srv.upsMu.Lock()
+	info.Reading = srv.upsLast
+	if srv.upsErr != nil {
+		info.Error = srv.upsErr.Error()
+	}
+	if !srv.upsPolled.IsZero() {
+		polled := srv.upsPolled
+		info.LastPoll = &polled
+	}
+	if !srv.upsChanged.IsZero() {
+		changed := srv.upsChanged
+		info.ChangedAt = &changed
+	}
+	srv.upsMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
@@ -0,0 +1,394 @@
+package server
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Uptime history: every change of a target's probed state is recorded, and
+// uptime per day or week is computed from the changes. With -uptime-dir the
+// changes are appended to one JSON lines segment per month, e.g.
+// 2026-10.jsonl, and read back at startup. Time the server wasn't running
+// or the state wasn't known counts as unknown, not as down.
+
+const (
+	uptimeRetention = 400 * 24 * time.Hour
+	stateUnknown    = "unknown"
+)
+
+type uptimeSample struct {
+	Time  time.Time `json:"t"`
+	ESPID string    `json:"id"`
+	State string    `json:"state"` // up, down or unknown
+}
+
+// uptimeState holds the Server state kept in uptime.go.
+type uptimeState struct {
+	uptimeMu      sync.Mutex
+	uptimeDir     string
+	uptimeHistory map[string][]uptimeSample // oldest first
+	uptimeFile    *os.File
+	uptimeSegment string
+}
+
+// loadUptime reads the segments of the last uptimeRetention. Targets whose
+// state was known when the server stopped are unknown until probed again.
+func (srv *Server) loadUptime() {
+	if srv.uptimeDir != "" {
+		if err := os.MkdirAll(srv.uptimeDir, 0o750); err != nil {
+			srv.fatal("uptime", "Could not create uptime directory", "path", srv.uptimeDir, "error", err)
+		}
+		segments, err := filepath.Glob(filepath.Join(srv.uptimeDir, "*.jsonl"))
+		if err != nil {
+			srv.fatal("uptime", "Could not list uptime segments", "path", srv.uptimeDir, "error", err)
+		}
+		slices.Sort(segments)
+		cutoff := srv.now().Add(-uptimeRetention)
+		for _, path := range segments {
+			if month, err := time.Parse("2006-01", strings.TrimSuffix(filepath.Base(path), ".jsonl")); err == nil && month.AddDate(0, 1, 0).Before(cutoff) {
+				continue
+			}
+			if err := srv.readUptimeSegment(path); err != nil {
+				srv.fatal("uptime", "Could not read uptime segment", "path", path, "error", err)
+			}
+		}
+		srv.logger("uptime").Info("Uptime history loaded", "targets", len(srv.uptimeHistory), "segments", len(segments), "path", srv.uptimeDir)
+	}
+
+	srv.markUptimeUnknown()
+	srv.onShutdown("close uptime history", func() {
+		srv.markUptimeUnknown()
+		srv.uptimeMu.Lock()
+		if srv.uptimeFile != nil {
+			srv.uptimeFile.Close()
+			srv.uptimeFile = nil
+		}
+		srv.uptimeMu.Unlock()
+	})
+}
+
+func (srv *Server) readUptimeSegment(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var s uptimeSample
+		if json.Unmarshal(scanner.Bytes(), &s) != nil || s.ESPID == "" {
+			continue
+		}
+		srv.uptimeHistory[s.ESPID] = append(srv.uptimeHistory[s.ESPID], s)
+	}
+	return scanner.Err()
+}
+
+// markUptimeUnknown ends every known state at startup and shutdown.
+func (srv *Server) markUptimeUnknown() {
+	srv.uptimeMu.Lock()
+	defer srv.uptimeMu.Unlock()
+	now := srv.now()
+	for id := range srv.uptimeHistory {
+		srv.addUptimeSample(uptimeSample{Time: now, ESPID: id, State: stateUnknown})
+	}
+}
+
+// recordUptime notes a target's probed state. It only takes uptimeMu, so it
+// is safe to call with mu held.
+func (srv *Server) recordUptime(id string, up bool) {
+	srv.uptimeMu.Lock()
+	defer srv.uptimeMu.Unlock()
+	srv.addUptimeSample(uptimeSample{Time: srv.now(), ESPID: id, State: UpDown(up)})
+}
+
+// endUptime stops the clock for a target that is no longer probed, so the
+// time until a new one is set counts as unknown.
+func (srv *Server) endUptime(id string) {
+	srv.uptimeMu.Lock()
+	defer srv.uptimeMu.Unlock()
+	if len(srv.uptimeHistory[id]) > 0 {
+		srv.addUptimeSample(uptimeSample{Time: srv.now(), ESPID: id, State: stateUnknown})
+	}
+}
+
+// addUptimeSample must be called with uptimeMu held.
+func (srv *Server) addUptimeSample(s uptimeSample) {
+	history := srv.uptimeHistory[s.ESPID]
+	if n := len(history); n > 0 && history[n-1].State == s.State {
+		return
+	}
+	// Drop changes before the retention, keeping the one the state at the
+	// cutoff comes from
+	if len(history) > 1 && s.Time.Sub(history[1].Time) > uptimeRetention {
+		history = history[1:]
+	}
+	srv.uptimeHistory[s.ESPID] = append(history, s)
+
+	if srv.uptimeDir == "" {
+		return
+	}
+	if err := srv.writeUptimeSample(s); err != nil {
+		srv.logger("uptime").Error("Failed to write uptime history", "error", err)
+	}
+}
+
+func (srv *Server) writeUptimeSample(s uptimeSample) error {
+	segment := s.Time.UTC().Format("2006-01")
+	if srv.uptimeFile == nil || segment != srv.uptimeSegment {
+		if srv.uptimeFile != nil {
+			srv.uptimeFile.Close()
+		}
+		f, err := os.OpenFile(filepath.Join(srv.uptimeDir, segment+".jsonl"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			srv.uptimeFile = nil
+			return err
+		}
+		srv.uptimeFile, srv.uptimeSegment = f, segment
+	}
+	line, _ := json.Marshal(s)
+	_, err := srv.uptimeFile.Write(append(line, '\n'))
+	return err
+}
+
+// UptimeBucket is one day or week of a target's uptime.
+type UptimeBucket struct {
+	Start     time.Time `json:"start"`
+	UpMS      int64     `json:"up_ms"`
+	DownMS    int64     `json:"down_ms"`
+	UnknownMS int64     `json:"unknown_ms"`
+	// Uptime is the percentage of the known time the target was up,
+	// omitted when nothing is known
+	Uptime *float64 `json:"uptime,omitempty"`
+}
+
+func (b *UptimeBucket) add(state string, d time.Duration) {
+	switch state {
+	case "up":
+		b.UpMS += d.Milliseconds()
+	case "down":
+		b.DownMS += d.Milliseconds()
+	default:
+		b.UnknownMS += d.Milliseconds()
+	}
+}
+
+func (b *UptimeBucket) finish() {
+	if known := b.UpMS + b.DownMS; known > 0 {
+		pct := float64(b.UpMS) * 100 / float64(known)
+		b.Uptime = &pct
+	}
+}
+
+type uptimeReport struct {
+	ID      string         `json:"id"`
+	Since   time.Time      `json:"since"`
+	Until   time.Time      `json:"until"`
+	Bucket  string         `json:"bucket"` // day or week
+	Total   UptimeBucket   `json:"total"`
+	Buckets []UptimeBucket `json:"buckets"`
+}
+
+// bucketStart returns the start of the day or week (from Monday) t is in,
+// in the server's time zone.
+func bucketStart(t time.Time, bucket string) time.Time {
+	y, m, d := t.Date()
+	day := time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+	if bucket == "week" {
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	}
+	return day
+}
+
+// computeUptime adds up how long the target was in each state between since
+// and until. Must be called with uptimeMu held.
+func (srv *Server) computeUptime(id string, since, until time.Time, bucket string) uptimeReport {
+	report := uptimeReport{ID: id, Since: since, Until: until, Bucket: bucket, Total: UptimeBucket{Start: since}}
+	history := srv.uptimeHistory[id]
+
+	for start := since; start.Before(until); {
+		end := bucketStart(start, bucket).AddDate(0, 0, 1)
+		if bucket == "week" {
+			end = bucketStart(start, bucket).AddDate(0, 0, 7)
+		}
+		end = minTime(end, until)
+
+		b := UptimeBucket{Start: start}
+		state := stateUnknown
+		from := start
+		for _, s := range history {
+			if !s.Time.After(start) {
+				state = s.State
+				continue
+			}
+			if !s.Time.Before(end) {
+				break
+			}
+			b.add(state, s.Time.Sub(from))
+			state, from = s.State, s.Time
+		}
+		b.add(state, end.Sub(from))
+
+		report.Total.UpMS += b.UpMS
+		report.Total.DownMS += b.DownMS
+		report.Total.UnknownMS += b.UnknownMS
+		b.finish()
+		report.Buckets = append(report.Buckets, b)
+		start = end
+	}
+	report.Total.finish()
+	return report
+}
+
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+// parseUptimeSince accepts a number of days (30d), a duration or a date.
+func (srv *Server) parseUptimeSince(s string) (time.Time, error) {
+	if d, err := parseRetention(s); err == nil {
+		return srv.now().Add(-d), nil
+	}
+	if t, err := time.ParseInLocation(time.DateOnly, s, time.Local); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid since %q (use e.g. 30d, 72h, 2026-09-01 or an RFC 3339 time)", s)
+}
+
+// uptimeHandler serves GET /esps/{id}/uptime, as JSON or with ?format=csv
+// as CSV.
+func (srv *Server) uptimeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, CodeMethodNotAllowed, "only GET allowed")
+		return
+	}
+	q := r.URL.Query()
+	since := srv.now().AddDate(0, 0, -30)
+	if s := q.Get("since"); s != "" {
+		var err error
+		if since, err = srv.parseUptimeSince(s); err != nil {
+			writeError(w, CodeInvalidRequest, err.Error())
+			return
+		}
+	}
+	since = maxTime(since, srv.now().Add(-uptimeRetention))
+	bucket := cmp.Or(q.Get("bucket"), "day")
+	if bucket != "day" && bucket != "week" {
+		writeError(w, CodeInvalidRequest, fmt.Sprintf("invalid bucket %q (use day or week)", bucket))
+		return
+	}
+	format := q.Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		writeError(w, CodeInvalidRequest, fmt.Sprintf("invalid format %q (use json or csv)", format))
+		return
+	}
+	id := srv.resolveAlias(r.PathValue("id"))
+
+	srv.mu.Lock()
+	esp, exists := srv.espMap[id]
+	hasTarget := exists && esp.Target != nil
+	srv.mu.Unlock()
+	if !exists || !requestPrincipal(r).canView(id) {
+		writeError(w, CodeESPNotFound, "ESP not registered")
+		return
+	}
+
+	srv.uptimeMu.Lock()
+	_, recorded := srv.uptimeHistory[id]
+	report := srv.computeUptime(id, since, srv.now(), bucket)
+	srv.uptimeMu.Unlock()
+	if !hasTarget && !recorded {
+		writeError(w, CodeNotFound, fmt.Sprintf("'%s' has no target to track", id))
+		return
+	}
+
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", strings.ReplaceAll(id, "/", "_")+"-uptime.csv"))
+		writeUptimeCSV(w, report)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+var UptimeCSVHeader = []string{"start", "up_seconds", "down_seconds", "unknown_seconds", "uptime_percent"}
+
+// UptimeCSVRow is one line of the CSV export, which the server and the
+// client write the same way.
+func UptimeCSVRow(label string, upMS, downMS, unknownMS int64, pct *float64) []string {
+	row := []string{label, strconv.FormatInt(upMS/1000, 10), strconv.FormatInt(downMS/1000, 10), strconv.FormatInt(unknownMS/1000, 10), ""}
+	if pct != nil {
+		row[4] = strconv.FormatFloat(*pct, 'f', 3, 64)
+	}
+	return row
+}
+
+func writeUptimeCSV(w io.Writer, r uptimeReport) {
+	cw := csv.NewWriter(w)
+	cw.Write(UptimeCSVHeader)
+	for _, b := range r.Buckets {
+		cw.Write(UptimeCSVRow(b.Start.Format(time.RFC3339), b.UpMS, b.DownMS, b.UnknownMS, b.Uptime))
+	}
+	b := r.Total
+	cw.Write(UptimeCSVRow("total", b.UpMS, b.DownMS, b.UnknownMS, b.Uptime))
+	cw.Flush()
+}
+
+// uptimeWindows are the windows exported as wod_target_uptime_ratio.
+var uptimeWindows = []struct {
+	label string
+	d     time.Duration
+}{
+	{"24h", 24 * time.Hour},
+	{"7d", 7 * 24 * time.Hour},
+	{"30d", 30 * 24 * time.Hour},
+}
+
+func (srv *Server) writeUptimeMetrics(w io.Writer) {
+	srv.uptimeMu.Lock()
+	defer srv.uptimeMu.Unlock()
+
+	name := "wod_target_uptime_ratio"
+	fmt.Fprintf(w, "# HELP %s Fraction of the window the target was up, of the time its state was known.\n# TYPE %s gauge\n", name, name)
+	now := srv.now()
+	ids := make([]string, 0, len(srv.uptimeHistory))
+	for id := range srv.uptimeHistory {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	for _, id := range ids {
+		for _, win := range uptimeWindows {
+			total := srv.computeUptime(id, now.Add(-win.d), now, "week").Total
+			if total.Uptime == nil {
+				continue
+			}
+			fmt.Fprintf(w, "%s%s %s\n", name, formatLabels([]string{"esp_id"}, id, "window", win.label), formatFloat(*total.Uptime/100))
+		}
+	}
+}
@@ -0,0 +1,416 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	regstore "github.com/smileyfaceskobochka/trashbin-daemon/internal/registry"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type Role string
+
+const (
+	RoleAdmin    Role = "admin"
+	RoleOperator Role = "operator"
+	RoleViewer   Role = "viewer"
+)
+
+func (r Role) Valid() bool {
+	return r == RoleAdmin || r == RoleOperator || r == RoleViewer
+}
+
+// User is a named account with its own token, and optionally a password
+// for signing in to the dashboard. Admins see every ESP; operators and
+// viewers only the ESPs they have been granted ("*" grants all). A user
+// bound to a namespace sees nothing outside it, and an admin bound to one
+// cannot manage the server itself.
+type User struct {
+	Name         string    `json:"name"`
+	Role         Role      `json:"role"`
+	Namespace    string    `json:"namespace,omitempty"`
+	TokenHash    string    `json:"token_hash"`
+	PasswordHash string    `json:"password_hash,omitempty"` // bcrypt
+	ESPs         []string  `json:"esps,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// usersState holds the Server state kept in users.go.
+type usersState struct {
+	usersMu   sync.Mutex
+	users     map[string]*User
+	usersPath string
+}
+
+// principal is the identity a request was authenticated as.
+type principal struct {
+	Name      string
+	Role      Role
+	Namespace string
+	ESPs      []string
+}
+
+// adminPrincipal is used for the admin key, and for every request when
+// authentication is disabled.
+var adminPrincipal = &principal{Name: "admin", Role: RoleAdmin}
+
+type principalKey struct{}
+
+func withPrincipal(r *http.Request, p *principal) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), principalKey{}, p))
+}
+
+func requestPrincipal(r *http.Request) *principal {
+	if p, ok := r.Context().Value(principalKey{}).(*principal); ok {
+		return p
+	}
+	return adminPrincipal
+}
+
+func (p *principal) canView(espID string) bool {
+	if !p.inNamespace(espID) {
+		return false
+	}
+	return p.Role == RoleAdmin || slices.Contains(p.ESPs, "*") || slices.Contains(p.ESPs, espID)
+}
+
+func (p *principal) canControl(espID string) bool {
+	return p.Role != RoleViewer && p.canView(espID)
+}
+
+func (u *User) principal() *principal {
+	return &principal{Name: u.Name, Role: u.Role, Namespace: u.Namespace, ESPs: slices.Clone(u.ESPs)}
+}
+
+// authEnabled reports whether control requests need a token at all.
+// Configuring OIDC counts, since it is pointless with an open dashboard.
+func (srv *Server) authEnabled() bool {
+	if srv.currentAuth().AdminKey != "" || srv.oidcEnabled() {
+		return true
+	}
+	srv.usersMu.Lock()
+	defer srv.usersMu.Unlock()
+	return len(srv.users) > 0
+}
+
+// authenticate maps a bearer token to the admin key or a user.
+func (srv *Server) authenticate(token string) *principal {
+	if token == "" {
+		return nil
+	}
+	if key := srv.currentAuth().AdminKey; key != "" && tokenMatches(token, key) {
+		return adminPrincipal
+	}
+
+	hash := hashToken(token)
+	srv.usersMu.Lock()
+	defer srv.usersMu.Unlock()
+	for _, u := range srv.users {
+		if tokenMatches(hash, u.TokenHash) {
+			return u.principal()
+		}
+	}
+	return nil
+}
+
+// checkPassword reports whether password is the dashboard password of the
+// named user. Unknown users cost as much as a wrong password.
+func (srv *Server) checkPassword(name, password string) bool {
+	srv.usersMu.Lock()
+	u, exists := srv.users[name]
+	hash := ""
+	if exists {
+		hash = u.PasswordHash
+	}
+	srv.usersMu.Unlock()
+
+	if hash == "" {
+		bcrypt.CompareHashAndPassword(unknownUserHash(), []byte(password))
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+var unknownUserHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte(newUserToken()), bcrypt.DefaultCost)
+	return hash
+})
+
+const minPasswordLength = 8
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func newUserToken() string {
+	b := make([]byte, 20)
+	rand.Read(b)
+	return "wod_" + hex.EncodeToString(b)
+}
+
+func (srv *Server) loadUsers() {
+	if srv.usersPath == "" {
+		return
+	}
+
+	data, err := os.ReadFile(srv.usersPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		srv.fatal("users", "Failed to load users", "error", err)
+	}
+
+	var list []*User
+	if err := json.Unmarshal(data, &list); err != nil {
+		srv.fatal("users", "Failed to parse users", "path", srv.usersPath, "error", err)
+	}
+
+	srv.usersMu.Lock()
+	defer srv.usersMu.Unlock()
+	for _, u := range list {
+		if !u.Role.Valid() {
+			srv.logger("users").Warn("Skipping user with unknown role", "user", u.Name, "role", u.Role)
+			continue
+		}
+		srv.users[u.Name] = u
+	}
+	srv.logger("users").Info("Users loaded", "count", len(srv.users), "path", srv.usersPath)
+}
+
+// saveUsers must be called with usersMu held.
+func (srv *Server) saveUsers() {
+	if srv.usersPath == "" {
+		return
+	}
+
+	data, err := json.MarshalIndent(srv.sortedUsers(), "", "  ")
+	if err != nil {
+		srv.logger("users").Error("Failed to encode users", "error", err)
+		return
+	}
+	if err := regstore.WriteFileAtomic(srv.usersPath, data); err != nil {
+		srv.logger("users").Error("Failed to save users", "error", err)
+	}
+}
+
+// sortedUsers must be called with usersMu held.
+func (srv *Server) sortedUsers() []*User {
+	list := make([]*User, 0, len(srv.users))
+	for _, u := range srv.users {
+		list = append(list, u)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+type UserInfo struct {
+	Name      string    `json:"name"`
+	Role      Role      `json:"role"`
+	Namespace string    `json:"namespace,omitempty"`
+	ESPs      []string  `json:"esps"`
+	Password  bool      `json:"password"` // can sign in to the dashboard
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (u *User) info() UserInfo {
+	return UserInfo{Name: u.Name, Role: u.Role, Namespace: u.Namespace, ESPs: slices.Clone(u.ESPs), Password: u.PasswordHash != "", CreatedAt: u.CreatedAt}
+}
+
+func (srv *Server) usersHandler(w http.ResponseWriter, r *http.Request) {
+	rlog := srv.requestLogger(r)
+
+	switch r.Method {
+	case http.MethodGet:
+		srv.usersMu.Lock()
+		list := make([]UserInfo, 0, len(srv.users))
+		for _, u := range srv.sortedUsers() {
+			list = append(list, u.info())
+		}
+		srv.usersMu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string][]UserInfo{"users": list})
+
+	case http.MethodPost:
+		var data struct {
+			Name      string `json:"name"`
+			Role      Role   `json:"role"`
+			Namespace string `json:"namespace"`
+		}
+		if err := decodeJSON(w, r, &data); err != nil {
+			rlog.Warn("Invalid JSON", "error", err)
+			return
+		}
+		if data.Name == "" {
+			writeError(w, CodeInvalidRequest, "name cannot be empty")
+			return
+		}
+		if !data.Role.Valid() {
+			writeError(w, CodeInvalidRequest, fmt.Sprintf("unknown role %q (use admin, operator or viewer)", data.Role))
+			return
+		}
+		if data.Namespace != "" {
+			if err := ValidateNamespace(data.Namespace); err != nil {
+				writeError(w, CodeInvalidRequest, err.Error())
+				return
+			}
+		}
+
+		token := newUserToken()
+		srv.usersMu.Lock()
+		if _, exists := srv.users[data.Name]; exists {
+			srv.usersMu.Unlock()
+			writeError(w, CodeConflict, fmt.Sprintf("user '%s' already exists", data.Name))
+			return
+		}
+		srv.users[data.Name] = &User{Name: data.Name, Role: data.Role, Namespace: data.Namespace, TokenHash: hashToken(token), CreatedAt: srv.now()}
+		srv.saveUsers()
+		srv.usersMu.Unlock()
+
+		rlog.Info("User added", "user", data.Name, "role", data.Role, "namespace", data.Namespace)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{"name": data.Name, "role": string(data.Role), "namespace": data.Namespace, "token": token})
+
+	case http.MethodDelete:
+		name := r.URL.Query().Get("name")
+
+		srv.usersMu.Lock()
+		_, exists := srv.users[name]
+		delete(srv.users, name)
+		if exists {
+			srv.saveUsers()
+		}
+		srv.usersMu.Unlock()
+
+		if !exists {
+			writeError(w, CodeNotFound, "user not found")
+			return
+		}
+		rlog.Info("User removed", "user", name)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "removed", "name": name})
+
+	default:
+		writeError(w, CodeMethodNotAllowed, "only GET, POST or DELETE allowed")
+	}
+}
+
+// userACLHandler grants (POST) or revokes (DELETE) a user's access to an ESP.
+func (srv *Server) userACLHandler(w http.ResponseWriter, r *http.Request) {
+	rlog := srv.requestLogger(r)
+
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		writeError(w, CodeMethodNotAllowed, "only POST or DELETE allowed")
+		return
+	}
+
+	var data struct {
+		Name  string `json:"name"`
+		ESPID string `json:"esp_id"`
+	}
+	if err := decodeJSON(w, r, &data); err != nil {
+		rlog.Warn("Invalid JSON", "error", err)
+		return
+	}
+	if data.ESPID == "" {
+		writeError(w, CodeInvalidRequest, "esp_id cannot be empty")
+		return
+	}
+	if data.ESPID != "*" {
+		data.ESPID = srv.resolveAlias(data.ESPID)
+	}
+
+	srv.usersMu.Lock()
+	defer srv.usersMu.Unlock()
+
+	u, exists := srv.users[data.Name]
+	if !exists {
+		writeError(w, CodeNotFound, "user not found")
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		if !slices.Contains(u.ESPs, data.ESPID) {
+			u.ESPs = append(u.ESPs, data.ESPID)
+			sort.Strings(u.ESPs)
+		}
+		rlog.Info("Access granted", "user", u.Name, "esp_id", data.ESPID)
+	} else {
+		u.ESPs = slices.DeleteFunc(u.ESPs, func(id string) bool { return id == data.ESPID })
+		rlog.Info("Access revoked", "user", u.Name, "esp_id", data.ESPID)
+	}
+	srv.saveUsers()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(u.info())
+}
+
+// userPasswordHandler sets (POST) or clears (DELETE) a user's dashboard
+// password.
+func (srv *Server) userPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	rlog := srv.requestLogger(r)
+
+	var data struct {
+		Name     string `json:"name"`
+		Password string `json:"password"`
+	}
+	switch r.Method {
+	case http.MethodPost:
+		if err := decodeJSON(w, r, &data); err != nil {
+			rlog.Warn("Invalid JSON", "error", err)
+			return
+		}
+		if len(data.Password) < minPasswordLength {
+			writeError(w, CodeInvalidRequest, fmt.Sprintf("password must be at least %d characters", minPasswordLength))
+			return
+		}
+	case http.MethodDelete:
+		data.Name = r.URL.Query().Get("name")
+	default:
+		writeError(w, CodeMethodNotAllowed, "only POST or DELETE allowed")
+		return
+	}
+
+	var hash []byte
+	if data.Password != "" {
+		var err error
+		if hash, err = bcrypt.GenerateFromPassword([]byte(data.Password), bcrypt.DefaultCost); err != nil {
+			writeError(w, CodeInvalidRequest, err.Error())
+			return
+		}
+	}
+
+	srv.usersMu.Lock()
+	u, exists := srv.users[data.Name]
+	if exists {
+		u.PasswordHash = string(hash)
+		srv.saveUsers()
+	}
+	srv.usersMu.Unlock()
+
+	if !exists {
+		writeError(w, CodeNotFound, "user not found")
+		return
+	}
+	status := "password set"
+	if hash == nil {
+		status = "password cleared"
+	}
+	rlog.Info("Dashboard "+status, "user", data.Name)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": status, "name": data.Name})
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// Request bodies are capped before any handler reads them, and JSON bodies
+// are decoded strictly: unknown fields and trailing data are rejected, so a
+// typo in a field name is an error instead of a silently ignored option.
+
+// maxRequestBody is the body limit for every route not in bodyLimits.
+const maxRequestBody = 64 << 10
+
+// bodyLimits raises the limit for routes that take large uploads.
+var bodyLimits = map[string]int64{
+	"/ota":           maxFirmwareSize,
+	"/admin/import":  maxImportSize,
+	"/admin/restore": maxBackupSize,
+}
+
+const maxESPIDLength = 64
+
+var espIDPartPattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+func withBodyLimit(path string, next http.HandlerFunc) http.HandlerFunc {
+	limit, exists := bodyLimits[path]
+	if !exists {
+		limit = maxRequestBody
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Body != nil {
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+		}
+		next(w, r)
+	}
+}
+
+// decodeJSON strictly decodes the request body into v. On failure it
+// writes the error response, 413 for a body over the limit and 400
+// otherwise, and returns the error for the caller to log.
+func decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	if err == nil && dec.More() {
+		err = errors.New("unexpected data after the JSON object")
+	}
+	if err == nil {
+		return nil
+	}
+
+	var tooLarge *http.MaxBytesError
+	var typeErr *json.UnmarshalTypeError
+	var syntaxErr *json.SyntaxError
+	switch {
+	case errors.As(err, &tooLarge):
+		writeError(w, CodeTooLarge, fmt.Sprintf("request body too large (limit %d bytes)", tooLarge.Limit))
+	case errors.Is(err, io.EOF):
+		writeError(w, CodeInvalidJSON, "invalid JSON: empty body")
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		writeError(w, CodeInvalidJSON, "invalid JSON: body ends in the middle of a value")
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		writeError(w, CodeInvalidJSON, fmt.Sprintf("invalid JSON: field %q must be %s, got %s", typeErr.Field, jsonKind(typeErr.Type.Kind()), typeErr.Value))
+	case errors.As(err, &syntaxErr):
+		writeError(w, CodeInvalidJSON, fmt.Sprintf("invalid JSON at byte %d: %v", syntaxErr.Offset, err))
+	default:
+		// Unknown fields come back as `json: unknown field "x"`
+		writeError(w, CodeInvalidJSON, "invalid JSON: "+strings.TrimPrefix(err.Error(), "json: "))
+	}
+	return err
+}
+
+// jsonKind names a Go kind the way a JSON client would know it.
+func jsonKind(kind reflect.Kind) string {
+	switch kind {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	case reflect.Map, reflect.Struct:
+		return "an object"
+	}
+	return "a number"
+}
+
+// errorReader fails every read with err; requestESPID leaves it behind a
+// body it couldn't read in full, so the handler sees the same error.
+type errorReader struct{ err error }
+
+func (e errorReader) Read([]byte) (int, error) { return 0, e.err }
@@ -0,0 +1,214 @@
+package server
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Verified wake: some machines ignore the odd power button press, so a
+// target configured with verify only counts 'on' as done once its probe
+// sees it up. If it isn't up within the window the pulse is sent again, and
+// after the last retry the command fails, which notifies command_failed
+// sinks.
+
+const (
+	defaultVerifyWindow = 2 * time.Minute
+	maxVerifyRetries    = 10
+	verifyInterval      = 5 * time.Second
+	// verifyActor sends the retries, and its pulses aren't verified again
+	verifyActor = "verify"
+)
+
+// StateVerifying is a pulse the device has acked whose target isn't up yet.
+const StateVerifying CommandState = "verifying"
+
+// WakeVerify is set on a target to verify its wakes.
+type WakeVerify struct {
+	Window  time.Duration `yaml:"window"`
+	Retries int           `yaml:"retries"`
+}
+
+type wakeVerifyJSON struct {
+	WindowMS int64 `json:"window_ms,omitempty"`
+	Retries  int   `json:"retries"`
+}
+
+func (v WakeVerify) MarshalJSON() ([]byte, error) {
+	return json.Marshal(wakeVerifyJSON{WindowMS: v.Window.Milliseconds(), Retries: v.Retries})
+}
+
+func (v *WakeVerify) UnmarshalJSON(data []byte) error {
+	var j wakeVerifyJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	*v = WakeVerify{Window: time.Duration(j.WindowMS) * time.Millisecond, Retries: j.Retries}
+	return nil
+}
+
+func (v *WakeVerify) Validate() error {
+	if v.Window < 0 {
+		return fmt.Errorf("verify window must be positive, got %v", v.Window)
+	}
+	if v.Retries < 0 || v.Retries > maxVerifyRetries {
+		return fmt.Errorf("verify retries must be between 0 and %d, got %d", maxVerifyRetries, v.Retries)
+	}
+	return nil
+}
+
+func (v *WakeVerify) RetryWindow() time.Duration {
+	return cmp.Or(v.Window, defaultVerifyWindow)
+}
+
+// VerifyStatus is the progress of a verified wake, reported with its
+// command.
+type VerifyStatus struct {
+	Attempts int        `json:"attempts"` // pulses sent so far
+	Retries  int        `json:"retries"`
+	WindowMS int64      `json:"window_ms"`
+	PulseAt  time.Time  `json:"pulse_at"` // when the last retry was sent
+	UpAt     *time.Time `json:"up_at,omitempty"`
+}
+
+// verifyState holds the Server state kept in verify.go.
+type verifyState struct {
+	// wakeVerifications holds the verified pulse of each ESP whose target isn't
+	// up yet; guarded by mu.
+	wakeVerifications map[string]*CommandRecord
+}
+
+// startVerify starts verifying a pulse that was just sent. Must be called
+// with mu held.
+func (srv *Server) startVerify(esp *ESP, rec *CommandRecord, actor string) {
+	if rec.Command != CommandPulse || rec.Verify != nil || actor == verifyActor || rec.finished() && rec.Status != StateAcked {
+		return
+	}
+	if esp.Target == nil || esp.Target.Verify == nil {
+		return
+	}
+	v := esp.Target.Verify
+	rec.Verify = &VerifyStatus{Attempts: 1, Retries: v.Retries, WindowMS: v.RetryWindow().Milliseconds(), PulseAt: srv.now()}
+	// Devices the server drives itself are done as soon as the pulse is sent
+	if rec.Status == StateAcked {
+		rec.Status = StateVerifying
+		rec.CompletedAt = nil
+	}
+	srv.wakeVerifications[esp.ID] = rec
+}
+
+// window returns when the current attempt started and how long it has.
+func (v *VerifyStatus) window(rec *CommandRecord) (time.Time, time.Duration) {
+	since := v.PulseAt
+	if v.Attempts == 1 && rec.DeliveredAt != nil {
+		since = *rec.DeliveredAt
+	}
+	return since, time.Duration(v.WindowMS) * time.Millisecond
+}
+
+func (srv *Server) runWakeVerifier() {
+	ticker := time.NewTicker(verifyInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		srv.checkWakeVerifications()
+	}
+}
+
+// checkWakeVerifications probes the targets of pending verified wakes and
+// settles or retries them.
+func (srv *Server) checkWakeVerifications() {
+	type job struct {
+		id     string
+		target Target
+		rec    *CommandRecord
+		err    error
+	}
+
+	srv.mu.Lock()
+	var jobs []*job
+	for id, rec := range srv.wakeVerifications {
+		esp, exists := srv.espMap[id]
+		if !exists || esp.Target == nil || rec.finished() {
+			delete(srv.wakeVerifications, id)
+			continue
+		}
+		// The first window starts once the ESP has the pulse
+		if rec.Status == StateQueued {
+			continue
+		}
+		jobs = append(jobs, &job{id: id, target: *esp.Target, rec: rec})
+	}
+	srv.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, j := range jobs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			j.err = srv.probeTarget(j.target)
+			srv.recordProbe(j.id, j.err)
+		}()
+	}
+	wg.Wait()
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for _, j := range jobs {
+		esp, exists := srv.espMap[j.id]
+		if !exists || srv.wakeVerifications[j.id] != j.rec {
+			continue
+		}
+		srv.verifyAttempt(esp, j.rec, j.err == nil)
+	}
+}
+
+// verifyAttempt settles a verified wake once its target is up, or retries
+// or fails it once the window has passed. Must be called with mu held.
+func (srv *Server) verifyAttempt(esp *ESP, rec *CommandRecord, up bool) {
+	v := rec.Verify
+	vlog := srv.logger("verify").With("esp_id", esp.ID, "command_id", rec.ID, "attempt", v.Attempts)
+	now := srv.now()
+
+	if up {
+		v.UpAt = &now
+		if rec.Status == StateVerifying {
+			rec.Status = StateAcked
+			rec.CompletedAt = &now
+		}
+		delete(srv.wakeVerifications, esp.ID)
+		vlog.Info("Wake verified, target is up")
+		srv.saveRegistry()
+		return
+	}
+
+	since, window := v.window(rec)
+	if now.Sub(since) < window {
+		return
+	}
+	if v.Attempts > v.Retries {
+		delete(srv.wakeVerifications, esp.ID)
+		vlog.Warn("Target did not come up, giving up", "window", window.String())
+		srv.failCommand(rec, fmt.Sprintf("target did not come up after %d pulse(s), %s each", v.Attempts, window))
+		srv.saveRegistry()
+		return
+	}
+
+	vlog.Warn("Target not up yet, pulsing again", "window", window.String())
+	opts := commandOptions{Force: true, AfterCooldown: true, IgnoreQuota: true, Duration: time.Duration(rec.DurationMS) * time.Millisecond}
+	if _, err := srv.dispatchCommand(esp, CommandPulse, opts, verifyActor); err != nil {
+		delete(srv.wakeVerifications, esp.ID)
+		reason := "retry failed: " + err.Error()
+		if errors.Is(err, errESPOffline) {
+			reason = "ESP went offline before the target came up"
+		}
+		srv.failCommand(rec, reason)
+		srv.saveRegistry()
+		return
+	}
+	v.Attempts++
+	v.PulseAt = now
+	srv.saveRegistry()
+}
@@ -0,0 +1,230 @@
+package server
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strings"
+)
+
+// Virtual machines are declared under vms: in the config file and show up
+// as driver devices named "vm:<name>", started and stopped through Proxmox
+// VE or libvirt. Their credentials stay in the config and are never written
+// to the registry.
+
+const vmPrefix = "vm:"
+
+// VMSettings configures one VM. Proxmox uses URL, Node, VMID, Kind, Token
+// and InsecureSkipVerify; libvirt uses URI and Domain.
+type VMSettings struct {
+	Driver string `yaml:"driver"` // proxmox or libvirt
+
+	URL                string `yaml:"url"`  // https://pve:8006
+	Node               string `yaml:"node"` // cluster node the VM runs on
+	VMID               int    `yaml:"vmid"`
+	Kind               string `yaml:"kind"`  // qemu (default) or lxc
+	Token              string `yaml:"token"` // API token: user@realm!tokenid=secret
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+
+	URI    string `yaml:"uri"`    // default qemu:///system
+	Domain string `yaml:"domain"` // default the VM's name
+}
+
+func validateVM(name string, vm VMSettings) []error {
+	var errs []error
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("vms.%s: %s", name, fmt.Sprintf(format, args...)))
+	}
+	if name == "" || strings.ContainsAny(name, " /") {
+		fail("name must be non-empty without spaces or slashes")
+	}
+	switch vm.Driver {
+	case "proxmox":
+		if u, err := url.Parse(vm.URL); err != nil || u.Host == "" || (u.Scheme != "https" && u.Scheme != "http") {
+			fail("url must be an http(s) URL, got %q", vm.URL)
+		}
+		if vm.Node == "" {
+			fail("node is required")
+		}
+		if vm.VMID <= 0 {
+			fail("vmid must be positive")
+		}
+		if vm.Kind != "" && vm.Kind != "qemu" && vm.Kind != "lxc" {
+			fail("kind must be qemu or lxc, got %q", vm.Kind)
+		}
+		if user, _, ok := strings.Cut(vm.Token, "="); !ok || !strings.Contains(user, "!") {
+			fail("token must look like user@realm!tokenid=secret")
+		}
+	case "libvirt":
+	default:
+		fail("unknown driver %q (use proxmox or libvirt)", vm.Driver)
+	}
+	return errs
+}
+
+func (e *ESP) isVM() bool {
+	return e.Type == DeviceVM
+}
+
+// vmDriver returns the driver for a "vm:<name>" device.
+func (srv *Server) vmDriver(id string) (powerDriver, bool) {
+	name := strings.TrimPrefix(id, vmPrefix)
+	vm, ok := srv.config.VMs[name]
+	if !ok {
+		return nil, false
+	}
+	if vm.Driver == "libvirt" {
+		return libvirtDriver{uri: cmp.Or(vm.URI, "qemu:///system"), domain: cmp.Or(vm.Domain, name)}, true
+	}
+	return proxmoxDriver{vm, srv}, true
+}
+
+// vmAddr describes where a VM is managed, for 'info'.
+func (srv *Server) vmAddr(id string) string {
+	vm := srv.config.VMs[strings.TrimPrefix(id, vmPrefix)]
+	if vm.Driver == "libvirt" {
+		return fmt.Sprintf("libvirt %s", cmp.Or(vm.URI, "qemu:///system"))
+	}
+	return fmt.Sprintf("proxmox %s (node %s, %s %d)", vm.URL, vm.Node, cmp.Or(vm.Kind, "qemu"), vm.VMID)
+}
+
+// registerVMs adds a device for every configured VM and drops the ones
+// no longer in the config. Must be called with mu held.
+func (srv *Server) registerVMs() {
+	for name := range srv.config.VMs {
+		id := vmPrefix + name
+		if existing, exists := srv.espMap[id]; exists && existing.isVM() {
+			continue
+		} else if exists {
+			srv.logger("vm").Warn("Device ID already in use, VM not added", "esp_id", id, "type", existing.Type)
+			continue
+		}
+		srv.espMap[id] = &ESP{ID: id, Type: DeviceVM, RegisteredAt: srv.now()}
+		srv.logger("vm").Info("VM added", "esp_id", id, "driver", srv.config.VMs[name].Driver)
+	}
+	for id, esp := range srv.espMap {
+		if _, configured := srv.config.VMs[strings.TrimPrefix(id, vmPrefix)]; esp.isVM() && !configured {
+			srv.removeESP(esp, "config", "VM removed from the config")
+		}
+	}
+}
+
+// --- Proxmox ---
+
+type proxmoxDriver struct {
+	vm  VMSettings
+	srv *Server
+}
+
+func (d proxmoxDriver) Supports(cmd ESPCommand) bool {
+	return cmd == CommandPulse || cmd == CommandForce || cmd == CommandSoftOff
+}
+
+func (d proxmoxDriver) client() *http.Client {
+	tlsConfig := d.srv.clientTLS
+	if d.vm.InsecureSkipVerify {
+		tlsConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	return &http.Client{
+		Timeout:   driverTimeout,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig, Proxy: http.ProxyFromEnvironment, DisableKeepAlives: true},
+	}
+}
+
+// call sends a request to the VM's status endpoint and decodes "data".
+func (d proxmoxDriver) call(ctx context.Context, method, action string, out interface{}) error {
+	u := fmt.Sprintf("%s/api2/json/nodes/%s/%s/%d/status/%s", strings.TrimSuffix(d.vm.URL, "/"),
+		url.PathEscape(d.vm.Node), cmp.Or(d.vm.Kind, "qemu"), d.vm.VMID, action)
+	req, err := http.NewRequestWithContext(ctx, method, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "PVEAPIToken="+d.vm.Token)
+
+	resp, err := d.client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode != http.StatusOK {
+		// Proxmox puts the reason in the status line
+		return fmt.Errorf("proxmox: %s", resp.Status)
+	}
+	var reply struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(body, &reply); err != nil {
+		return fmt.Errorf("proxmox: invalid reply: %w", err)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(reply.Data, out)
+}
+
+// Do starts the task and returns; the prober sees the VM come up or down.
+func (d proxmoxDriver) Do(ctx context.Context, cmd ESPCommand) error {
+	action := map[ESPCommand]string{CommandPulse: "start", CommandForce: "stop", CommandSoftOff: "shutdown"}[cmd]
+	return d.call(ctx, http.MethodPost, action, nil)
+}
+
+func (d proxmoxDriver) Powered(ctx context.Context) (bool, error) {
+	var status struct {
+		Status string `json:"status"` // running or stopped
+	}
+	if err := d.call(ctx, http.MethodGet, "current", &status); err != nil {
+		return false, err
+	}
+	return status.Status == "running", nil
+}
+
+// --- libvirt ---
+
+// libvirtDriver runs virsh, which handles every connection URI libvirt
+// supports, including qemu+ssh:// to remote hosts.
+type libvirtDriver struct {
+	uri    string
+	domain string
+}
+
+func (d libvirtDriver) Supports(cmd ESPCommand) bool {
+	return cmd == CommandPulse || cmd == CommandForce || cmd == CommandSoftOff
+}
+
+func (d libvirtDriver) virsh(ctx context.Context, action string) (string, error) {
+	cmd := exec.CommandContext(ctx, "virsh", "-c", d.uri, action, d.domain)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Run(); err != nil {
+		if errors.Is(err, exec.ErrNotFound) {
+			return "", errors.New("virsh not found in PATH")
+		}
+		return "", fmt.Errorf("virsh: %s", cmp.Or(strings.TrimSpace(out.String()), err.Error()))
+	}
+	return strings.TrimSpace(out.String()), nil
+}
+
+func (d libvirtDriver) Do(ctx context.Context, cmd ESPCommand) error {
+	action := map[ESPCommand]string{CommandPulse: "start", CommandForce: "destroy", CommandSoftOff: "shutdown"}[cmd]
+	_, err := d.virsh(ctx, action)
+	return err
+}
+
+func (d libvirtDriver) Powered(ctx context.Context) (bool, error) {
+	state, err := d.virsh(ctx, "domstate")
+	if err != nil {
+		return false, err
+	}
+	// running, idle, paused, in shutdown, shut off, crashed, pmsuspended
+	return state == "running" || state == "idle" || state == "in shutdown", nil
+}
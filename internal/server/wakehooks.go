@@ -0,0 +1,431 @@
+package server
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Wake hooks: a chain of steps to run once a woken target is up, e.g.
+// mount a share on it and start a backup. A chain is configured per device
+// under wake_hooks and starts when the target goes from booting to up,
+// which is what a probe or power sensor confirms after 'on'; devices
+// whose power isn't tracked never start one. Steps run in order, each a
+// local command or a URL to call, with its own delay, timeout and retries.
+// What happens when a step fails is up to its on_failure: abort skips the
+// rest of the chain, continue runs it but fails the chain, ignore doesn't
+// count the failure. Runs are kept in memory and recorded as hook events;
+// 'hooks run' starts a chain by hand.
+
+const (
+	defaultHookTimeout = time.Minute
+	maxHookTimeout     = time.Hour
+	maxHookDelay       = time.Hour
+	maxHookRetries     = 10
+	hookRetryDelay     = 5 * time.Second
+	hookOutputSize     = 2048
+	hookRunLogSize     = 200
+	DefaultHookRunPage = 20
+)
+
+// Step failure policies.
+const (
+	hookAbort    = "abort"
+	hookContinue = "continue"
+	hookIgnore   = "ignore"
+)
+
+// WakeHook is one step of a chain: Command runs locally without a shell,
+// URL is called with a JSON body and signed like a webhook when Secret is
+// set.
+type WakeHook struct {
+	Name    string   `yaml:"name"`
+	Command []string `yaml:"command"`
+	URL     string   `yaml:"url"`
+	Method  string   `yaml:"method"` // default POST
+	Secret  string   `yaml:"secret"`
+	// Delay is how long to wait before the step, e.g. for services on the
+	// target to start
+	Delay     time.Duration `yaml:"delay"`
+	Timeout   time.Duration `yaml:"timeout"` // default 1m
+	Retries   int           `yaml:"retries"`
+	OnFailure string        `yaml:"on_failure"` // abort (default), continue or ignore
+}
+
+func (h WakeHook) name(i int) string {
+	if h.Name != "" {
+		return h.Name
+	}
+	if len(h.Command) > 0 {
+		return h.Command[0]
+	}
+	return fmt.Sprintf("step %d", i+1)
+}
+
+func (h WakeHook) onFailure() string {
+	return cmp.Or(h.OnFailure, hookAbort)
+}
+
+func validateWakeHooks(chains map[string][]WakeHook) []error {
+	var errs []error
+	for device, chain := range chains {
+		for i, h := range chain {
+			fail := func(format string, args ...interface{}) {
+				errs = append(errs, fmt.Errorf("wake_hooks.%s[%d]: %s", device, i, fmt.Sprintf(format, args...)))
+			}
+			switch {
+			case len(h.Command) > 0 && h.URL != "":
+				fail("set either command or url, not both")
+			case len(h.Command) == 0 && h.URL == "":
+				fail("command or url is required")
+			}
+			validateHook(h, fail)
+		}
+	}
+	return errs
+}
+
+// validateHook checks the fields wake hooks share with macro steps.
+func validateHook(h WakeHook, fail func(format string, args ...interface{})) {
+	if len(h.Command) > 0 && h.Command[0] == "" {
+		fail("empty command")
+	}
+	if h.URL != "" {
+		if u, err := url.Parse(h.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fail("url %q must be an http:// or https:// URL", h.URL)
+		}
+	}
+	if h.Method != "" && !slices.Contains([]string{http.MethodGet, http.MethodPost, http.MethodPut}, strings.ToUpper(h.Method)) {
+		fail("method must be GET, POST or PUT, got %q", h.Method)
+	}
+	if h.Delay < 0 || h.Delay > maxHookDelay {
+		fail("delay must be between 0 and %s, got %v", maxHookDelay, h.Delay)
+	}
+	if h.Timeout < 0 || h.Timeout > maxHookTimeout {
+		fail("timeout must be between 0 and %s, got %v", maxHookTimeout, h.Timeout)
+	}
+	if h.Retries < 0 || h.Retries > maxHookRetries {
+		fail("retries must be between 0 and %d, got %d", maxHookRetries, h.Retries)
+	}
+	if !slices.Contains([]string{"", hookAbort, hookContinue, hookIgnore}, h.OnFailure) {
+		fail("on_failure must be abort, continue or ignore, got %q", h.OnFailure)
+	}
+}
+
+// wakeHooks is the device's chain. Must be called with mu held.
+func (srv *Server) wakeHooks(id string) []WakeHook {
+	for name, chain := range srv.config.WakeHooks {
+		if srv.resolveAlias(name) == id {
+			return chain
+		}
+	}
+	return nil
+}
+
+// HookRun is one run of a chain.
+type HookRun struct {
+	ID         string     `json:"id"`
+	ESPID      string     `json:"esp_id"`
+	Actor      string     `json:"actor"`  // wake, or who started it by hand
+	Status     string     `json:"status"` // running, ok or failed
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Steps      []HookStep `json:"steps"`
+
+	alias string
+}
+
+// HookStep is the outcome of one step. Output is the end of what a
+// command printed, or of the response body.
+type HookStep struct {
+	Name       string `json:"name"`
+	Status     string `json:"status"` // pending, running, ok, failed or skipped
+	Attempts   int    `json:"attempts"`
+	DurationMS int64  `json:"duration_ms"`
+	Output     string `json:"output,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// wakehooksState holds the Server state kept in wakehooks.go.
+type wakehooksState struct {
+	hooksMu      sync.Mutex
+	hookRuns     []*HookRun      // oldest first, at most hookRunLogSize
+	hooksRunning map[string]bool // ESP IDs with a chain running
+	hookHTTP     *http.Client
+}
+
+// startWakeHooks runs the device's chain unless one is already running,
+// and returns the run, or nil. Must be called with mu held.
+func (srv *Server) startWakeHooks(esp *ESP, actor string) *HookRun {
+	chain := srv.wakeHooks(esp.ID)
+	if len(chain) == 0 {
+		return nil
+	}
+	host := ""
+	if esp.Target != nil {
+		host = esp.Target.Host
+	}
+	alias := srv.aliasFor(esp.ID)
+	env := []string{"WOD_ESP_ID=" + esp.ID, "WOD_ALIAS=" + alias, "WOD_TARGET_HOST=" + host}
+
+	srv.hooksMu.Lock()
+	defer srv.hooksMu.Unlock()
+	if srv.hooksRunning[esp.ID] {
+		srv.logger("hooks").Warn("Wake hooks already running, not starting again", "esp_id", esp.ID)
+		return nil
+	}
+	srv.hooksRunning[esp.ID] = true
+	run := &HookRun{ID: NewCommandID(), ESPID: esp.ID, Actor: actor, Status: "running", StartedAt: srv.now(), alias: alias}
+	for i, h := range chain {
+		run.Steps = append(run.Steps, HookStep{Name: h.name(i), Status: "pending"})
+	}
+	srv.hookRuns = append(srv.hookRuns, run)
+	if len(srv.hookRuns) > hookRunLogSize {
+		srv.hookRuns = slices.Delete(srv.hookRuns, 0, len(srv.hookRuns)-hookRunLogSize)
+	}
+	go run.execute(srv, slices.Clone(chain), env)
+	return run
+}
+
+func (run *HookRun) execute(srv *Server, chain []WakeHook, env []string) {
+	hlog := srv.logger("hooks").With("esp_id", run.ESPID, "run_id", run.ID)
+	hlog.Info("Running wake hooks", "steps", len(chain), "actor", run.Actor)
+	env = append(env, "WOD_RUN_ID="+run.ID)
+
+	failed, aborted := false, false
+	for i, h := range chain {
+		if aborted {
+			run.update(srv, i, func(s *HookStep) { s.Status = "skipped" })
+			continue
+		}
+		if h.Delay > 0 {
+			time.Sleep(h.Delay)
+		}
+		run.update(srv, i, func(s *HookStep) { s.Status = "running" })
+
+		body := map[string]interface{}{
+			"run_id": run.ID, "esp_id": run.ESPID, "alias": run.alias, "step": h.name(i), "actor": run.Actor,
+		}
+		start := srv.now()
+		output, attempts, err := retryHook(h.Retries, func() (string, error) { return h.run(srv, body, env) })
+		elapsed := srv.now().Sub(start)
+		run.update(srv, i, func(s *HookStep) {
+			s.Attempts, s.DurationMS, s.Output = attempts, elapsed.Milliseconds(), output
+			s.Status = "ok"
+			if err != nil {
+				s.Status, s.Error = "failed", err.Error()
+			}
+		})
+
+		step := h.name(i)
+		if err == nil {
+			hlog.Info("Wake hook done", "step", step, "duration", elapsed.Round(time.Millisecond).String())
+			continue
+		}
+		hlog.Warn("Wake hook failed", "step", step, "attempts", attempts, "on_failure", h.onFailure(), "error", err)
+		switch h.onFailure() {
+		case hookAbort:
+			failed, aborted = true, true
+		case hookContinue:
+			failed = true
+		}
+	}
+
+	now := srv.now()
+	srv.hooksMu.Lock()
+	run.FinishedAt = &now
+	run.Status = "ok"
+	if failed {
+		run.Status = "failed"
+	}
+	delete(srv.hooksRunning, run.ESPID)
+	detail := run.summary()
+	srv.hooksMu.Unlock()
+
+	srv.metricWakeHooks.Inc(run.ESPID, run.Status)
+	hlog.Info("Wake hooks finished", "status", run.Status)
+	srv.recordEvent(Event{Type: EventHook, ESPID: run.ESPID, Actor: run.Actor, Detail: detail})
+}
+
+func (run *HookRun) update(srv *Server, i int, fn func(*HookStep)) {
+	srv.hooksMu.Lock()
+	defer srv.hooksMu.Unlock()
+	fn(&run.Steps[i])
+}
+
+// summary is the run for the event log. Must be called with hooksMu held.
+func (run *HookRun) summary() string {
+	parts := make([]string, len(run.Steps))
+	for i, s := range run.Steps {
+		parts[i] = s.Name + " " + s.Status
+	}
+	return run.Status + ": " + strings.Join(parts, ", ")
+}
+
+// retryHook makes up to retries more attempts, hookRetryDelay apart, until
+// one works, and returns the last output and error.
+func retryHook(retries int, attempt func() (string, error)) (output string, attempts int, err error) {
+	for attempts <= retries {
+		if attempts > 0 {
+			time.Sleep(hookRetryDelay)
+		}
+		attempts++
+		if output, err = attempt(); err == nil {
+			break
+		}
+	}
+	return output, attempts, err
+}
+
+// run makes one attempt at the step, posting body to its URL.
+func (h WakeHook) run(srv *Server, payload map[string]interface{}, env []string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), cmp.Or(h.Timeout, defaultHookTimeout))
+	defer cancel()
+	if len(h.Command) > 0 {
+		cmd := exec.CommandContext(ctx, h.Command[0], h.Command[1:]...)
+		cmd.Env = append(os.Environ(), env...)
+		out, err := cmd.CombinedOutput()
+		if ctx.Err() != nil {
+			err = fmt.Errorf("timed out after %s", cmp.Or(h.Timeout, defaultHookTimeout))
+		}
+		return hookOutput(out), err
+	}
+
+	body, _ := json.Marshal(payload)
+	method := strings.ToUpper(cmp.Or(h.Method, http.MethodPost))
+	var r io.Reader
+	if method != http.MethodGet {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, h.URL, r)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "wake-on-demand/"+VERSION)
+	if h.Secret != "" {
+		ts := strconv.FormatInt(srv.now().Unix(), 10)
+		req.Header.Set(TimestampHeader, ts)
+		req.Header.Set(SignatureHeader, "sha256="+webhookSignature(h.Secret, ts, body))
+	}
+	resp, err := srv.hookHTTP.Do(req)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			// Keep the URL, which may carry a token, out of the log
+			err = urlErr.Err
+		}
+		return "", err
+	}
+	defer resp.Body.Close()
+	out, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return hookOutput(out), fmt.Errorf("returned %s", resp.Status)
+	}
+	return hookOutput(out), nil
+}
+
+// hookOutput keeps the end of out, where errors usually are.
+func hookOutput(out []byte) string {
+	out = bytes.TrimSpace(out)
+	if len(out) > hookOutputSize {
+		out = append([]byte("…"), out[len(out)-hookOutputSize:]...)
+	}
+	return strings.ToValidUTF8(string(out), "")
+}
+
+// --- API ---
+
+// hookRunsHandler serves GET /hooks/runs.
+func (srv *Server) hookRunsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, CodeMethodNotAllowed, "only GET allowed")
+		return
+	}
+	q := r.URL.Query()
+	id := srv.resolveAlias(q.Get("esp_id"))
+	limit := DefaultHookRunPage
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			writeError(w, CodeInvalidRequest, "limit must be a positive number")
+			return
+		}
+		limit = n
+	}
+
+	srv.hooksMu.Lock()
+	runs := []HookRun{}
+	for _, run := range slices.Backward(srv.hookRuns) {
+		if len(runs) == limit {
+			break
+		}
+		if id != "" && run.ESPID != id {
+			continue
+		}
+		c := *run
+		c.Steps = slices.Clone(run.Steps)
+		runs = append(runs, c)
+	}
+	srv.hooksMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"runs": runs})
+}
+
+// hookRunHandler serves POST /hooks/run, which starts a device's chain by
+// hand whatever its target's state.
+func (srv *Server) hookRunHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, CodeMethodNotAllowed, "only POST allowed")
+		return
+	}
+	var data struct {
+		ID string `json:"id"`
+	}
+	if err := decodeJSON(w, r, &data); err != nil {
+		srv.requestLogger(r).Warn("Invalid JSON", "error", err)
+		return
+	}
+	data.ID = srv.resolveAlias(data.ID)
+
+	srv.mu.Lock()
+	esp, exists := srv.espMap[data.ID]
+	if !exists {
+		srv.mu.Unlock()
+		writeError(w, CodeESPNotFound, "ESP not registered")
+		return
+	}
+	if len(srv.wakeHooks(esp.ID)) == 0 {
+		srv.mu.Unlock()
+		writeError(w, CodeNotFound, fmt.Sprintf("'%s' has no wake hooks", esp.ID))
+		return
+	}
+	run := srv.startWakeHooks(esp, srv.requestActor(r))
+	srv.mu.Unlock()
+	if run == nil {
+		writeError(w, CodeConflict, fmt.Sprintf("wake hooks for '%s' are already running", data.ID))
+		return
+	}
+
+	srv.hooksMu.Lock()
+	c := *run
+	c.Steps = slices.Clone(run.Steps)
+	srv.hooksMu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(c)
+}
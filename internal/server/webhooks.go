@@ -0,0 +1,469 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	rand "math/rand/v2"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Webhooks feed automations such as n8n or Node-RED, next to the
+// notifications meant for people: every audit event a webhook asks for,
+// e.g. delivered when an ESP picked a command up, is POSTed to it as JSON.
+// With a secret the body is signed like ESP requests are: X-WOD-Timestamp
+// carries the Unix time and X-WOD-Signature "sha256=" and the hex
+// HMAC-SHA256 of the timestamp, a '.' and the body. Failed deliveries are
+// retried with backoff, in order, one webhook not holding up another. The
+// last deliveries are kept in memory for GET /api/v1/webhooks/deliveries.
+
+const (
+	webhookTimeout        = 10 * time.Second
+	webhookQueueSize      = 200
+	defaultWebhookRetries = 5
+	maxWebhookRetries     = 20
+	webhookRetryBase      = time.Second
+	webhookRetryMax       = 5 * time.Minute
+	webhookLogSize        = 500
+	DefaultDeliveryPage   = 50
+
+	eventHeader    = "X-WOD-Event"
+	deliveryHeader = "X-WOD-Delivery"
+
+	// eventWebhookTest is only sent by POST /webhooks/test
+	eventWebhookTest EventType = "test"
+)
+
+// WebhookSettings configures one webhook.
+type WebhookSettings struct {
+	// Name identifies it in the delivery log; default: the URL's host
+	Name string `yaml:"name"`
+	URL  string `yaml:"url"`
+	// Events are the event types to send, e.g. [delivered, acked]; empty
+	// means all but poll
+	Events []string `yaml:"events"`
+	// Devices limits it to these ESP IDs or aliases
+	Devices []string `yaml:"devices"`
+	// Secret signs the payloads
+	Secret string `yaml:"secret"`
+	// Retries is how often a failed delivery is retried (default 5, -1
+	// for never)
+	Retries int `yaml:"retries"`
+}
+
+func (s WebhookSettings) name() string {
+	if s.Name != "" {
+		return s.Name
+	}
+	u, _ := url.Parse(s.URL)
+	return u.Host
+}
+
+func (s WebhookSettings) retries() int {
+	switch {
+	case s.Retries < 0:
+		return 0
+	case s.Retries == 0:
+		return defaultWebhookRetries
+	}
+	return s.Retries
+}
+
+func (s WebhookSettings) wants(srv *Server, e Event) bool {
+	if len(s.Events) == 0 {
+		if e.Type == EventPoll {
+			return false
+		}
+	} else if !slices.Contains(s.Events, string(e.Type)) {
+		return false
+	}
+	if len(s.Devices) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(s.Devices, func(name string) bool { return srv.resolveAlias(name) == e.ESPID })
+}
+
+func validateWebhooks(hooks []WebhookSettings) []error {
+	var errs []error
+	names := make(map[string]bool)
+	for i, h := range hooks {
+		prefix := fmt.Sprintf("webhooks[%d]", i)
+		if u, err := url.Parse(h.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("%s: url %q must be an http:// or https:// URL", prefix, h.URL))
+			continue
+		}
+		if name := h.name(); names[name] {
+			errs = append(errs, fmt.Errorf("%s: name %q is used twice (give each webhook its own name)", prefix, name))
+		} else {
+			names[name] = true
+		}
+		for _, t := range h.Events {
+			if !slices.Contains(eventTypes, EventType(t)) {
+				errs = append(errs, fmt.Errorf("%s: unknown event type %q", prefix, t))
+			}
+		}
+		if h.Retries > maxWebhookRetries {
+			errs = append(errs, fmt.Errorf("%s: retries must be at most %d, got %d", prefix, maxWebhookRetries, h.Retries))
+		}
+	}
+	return errs
+}
+
+// webhook is a configured webhook and the worker delivering its queue. A
+// reload changes its settings in place, so queued deliveries survive it.
+type webhook struct {
+	settings WebhookSettings // guarded by webhooksMu
+	queue    chan *WebhookDelivery
+	stop     chan struct{}
+}
+
+// WebhookDelivery is one event sent, or being sent, to a webhook.
+type WebhookDelivery struct {
+	ID         string     `json:"id"`
+	Webhook    string     `json:"webhook"`
+	Event      EventType  `json:"event"`
+	EventSeq   uint64     `json:"event_seq,omitempty"`
+	ESPID      string     `json:"esp_id,omitempty"`
+	Status     string     `json:"status"` // queued, retrying, ok, failed or dropped
+	Attempts   int        `json:"attempts"`
+	HTTPStatus int        `json:"http_status,omitempty"` // of the last attempt
+	Error      string     `json:"error,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastTry    *time.Time `json:"last_attempt,omitempty"`
+	NextTry    *time.Time `json:"next_attempt,omitempty"`
+	DurationMS int64      `json:"duration_ms,omitempty"` // of the last attempt
+
+	body []byte
+}
+
+// webhookPayload is the body POSTed for an event.
+type webhookPayload struct {
+	DeliveryID string `json:"delivery_id"`
+	Webhook    string `json:"webhook"`
+	Event
+	Alias string `json:"alias,omitempty"`
+}
+
+// webhooksState holds the Server state kept in webhooks.go.
+type webhooksState struct {
+	webhooksMu  sync.Mutex
+	webhooks    []*webhook
+	webhookLog  []*WebhookDelivery // oldest first, at most webhookLogSize
+	webhookHTTP *http.Client
+}
+
+// setupWebhooks installs the webhooks of an already validated config,
+// keeping the queues of the ones whose name didn't change.
+func (srv *Server) setupWebhooks(hooks []WebhookSettings) {
+	srv.webhooksMu.Lock()
+	defer srv.webhooksMu.Unlock()
+	old := make(map[string]*webhook)
+	for _, h := range srv.webhooks {
+		old[h.settings.name()] = h
+	}
+	var next []*webhook
+	for _, s := range hooks {
+		if h, ok := old[s.name()]; ok {
+			h.settings = s
+			delete(old, s.name())
+			next = append(next, h)
+			continue
+		}
+		h := &webhook{settings: s, queue: make(chan *WebhookDelivery, webhookQueueSize), stop: make(chan struct{})}
+		go h.run(srv)
+		next = append(next, h)
+	}
+	for _, h := range old {
+		close(h.stop)
+	}
+	srv.webhooks = next
+}
+
+// webhookEvent queues e for the webhooks that want it. It is called from
+// recordEvent and must not block.
+func (srv *Server) webhookEvent(e Event) {
+	srv.webhooksMu.Lock()
+	defer srv.webhooksMu.Unlock()
+	for _, h := range srv.webhooks {
+		if h.settings.wants(srv, e) {
+			h.enqueue(srv, e)
+		}
+	}
+}
+
+// enqueue must be called with webhooksMu held.
+func (h *webhook) enqueue(srv *Server, e Event) *WebhookDelivery {
+	name := h.settings.name()
+	d := &WebhookDelivery{
+		ID: NewCommandID(), Webhook: name, Event: e.Type, EventSeq: e.Seq, ESPID: e.ESPID,
+		Status: "queued", CreatedAt: srv.now(),
+	}
+	d.body, _ = json.Marshal(webhookPayload{DeliveryID: d.ID, Webhook: name, Event: e, Alias: srv.aliasFor(e.ESPID)})
+	srv.webhookLog = append(srv.webhookLog, d)
+	if len(srv.webhookLog) > webhookLogSize {
+		srv.webhookLog = slices.Delete(srv.webhookLog, 0, len(srv.webhookLog)-webhookLogSize)
+	}
+	select {
+	case h.queue <- d:
+	default:
+		d.Status, d.Error = "dropped", "queue full"
+		srv.metricWebhooks.Inc(name, "dropped")
+		srv.logger("webhook").Warn("Webhook queue full, dropping", "webhook", name, "event", e.Type, "esp_id", e.ESPID)
+	}
+	return d
+}
+
+func (h *webhook) run(srv *Server) {
+	for {
+		select {
+		case d := <-h.queue:
+			h.deliver(srv, d)
+		case <-h.stop:
+			srv.webhooksMu.Lock()
+			for len(h.queue) > 0 {
+				d := <-h.queue
+				d.Status, d.Error = "dropped", "webhook removed from the config"
+			}
+			srv.webhooksMu.Unlock()
+			return
+		}
+	}
+}
+
+// deliver sends d until it gets a 2xx, fails for good or runs out of
+// retries.
+func (h *webhook) deliver(srv *Server, d *WebhookDelivery) {
+	for {
+		srv.webhooksMu.Lock()
+		s := h.settings
+		d.Attempts++
+		attempt := d.Attempts
+		srv.webhooksMu.Unlock()
+
+		start := srv.now()
+		status, retryAfter, err := s.post(srv, d)
+		now := srv.now()
+		retry := err != nil && retryableWebhook(status) && attempt <= s.retries()
+
+		srv.webhooksMu.Lock()
+		d.LastTry, d.NextTry = &now, nil
+		d.HTTPStatus, d.DurationMS, d.Error = status, now.Sub(start).Milliseconds(), ""
+		var delay time.Duration
+		switch {
+		case err == nil:
+			d.Status = "ok"
+		case retry:
+			d.Status, d.Error = "retrying", err.Error()
+			delay = webhookDelay(attempt, retryAfter)
+			at := now.Add(delay)
+			d.NextTry = &at
+		default:
+			d.Status, d.Error = "failed", err.Error()
+		}
+		srv.webhooksMu.Unlock()
+
+		wlog := srv.logger("webhook").With("webhook", d.Webhook, "delivery_id", d.ID, "event", d.Event, "esp_id", d.ESPID, "attempt", attempt)
+		switch {
+		case err == nil:
+			srv.metricWebhooks.Inc(d.Webhook, "ok")
+			wlog.Debug("Webhook delivered", "status", status)
+			return
+		case !retry:
+			srv.metricWebhooks.Inc(d.Webhook, "failed")
+			wlog.Error("Webhook delivery failed", "error", err)
+			return
+		}
+		wlog.Warn("Webhook delivery failed, retrying", "error", err, "retry_in", delay.Round(time.Second).String())
+		select {
+		case <-time.After(delay):
+		case <-h.stop:
+			srv.webhooksMu.Lock()
+			d.Status, d.NextTry = "dropped", nil
+			d.Error = "webhook removed from the config; last error: " + d.Error
+			srv.webhooksMu.Unlock()
+			return
+		}
+	}
+}
+
+// post makes one attempt, returning the response status and, for a 429 or
+// 503, Retry-After.
+func (s WebhookSettings) post(srv *Server, d *WebhookDelivery) (int, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+	ctx, sp := srv.startSpan(ctx, "webhook "+d.Webhook, spanClient, "webhook.name", d.Webhook, "webhook.event", string(d.Event), "esp_id", d.ESPID)
+	defer sp.finish(srv)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(d.body))
+	if err != nil {
+		return 0, 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "wake-on-demand/"+VERSION)
+	req.Header.Set(eventHeader, string(d.Event))
+	req.Header.Set(deliveryHeader, d.ID)
+	if s.Secret != "" {
+		ts := strconv.FormatInt(srv.now().Unix(), 10)
+		req.Header.Set(TimestampHeader, ts)
+		req.Header.Set(SignatureHeader, "sha256="+webhookSignature(s.Secret, ts, d.body))
+	}
+	injectTraceparent(req)
+	resp, err := srv.webhookHTTP.Do(req)
+	if err != nil {
+		sp.fail(err)
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			// Keep the URL, which may carry a token, out of the log
+			err = urlErr.Err
+		}
+		return 0, 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		err := fmt.Errorf("webhook returned %s", resp.Status)
+		sp.fail(err)
+		secs, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+		return resp.StatusCode, time.Duration(secs) * time.Second, err
+	}
+	return resp.StatusCode, 0, nil
+}
+
+func webhookSignature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// retryableWebhook reports whether a failed attempt may succeed later: a
+// network error (status 0), a timeout, rate limiting or a server error.
+func retryableWebhook(status int) bool {
+	return status == 0 || status == http.StatusRequestTimeout || status == http.StatusTooManyRequests || status >= 500
+}
+
+// webhookDelay doubles from webhookRetryBase with jitter, or follows the
+// receiver's Retry-After.
+func webhookDelay(attempt int, retryAfter time.Duration) time.Duration {
+	if retryAfter > 0 {
+		return min(retryAfter, webhookRetryMax)
+	}
+	delay := min(webhookRetryBase<<min(attempt-1, 20), webhookRetryMax)
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// --- API ---
+
+type WebhookInfo struct {
+	Name    string   `json:"name"`
+	URL     string   `json:"url"`
+	Events  []string `json:"events,omitempty"`
+	Devices []string `json:"devices,omitempty"`
+	Signed  bool     `json:"signed"`
+	Retries int      `json:"retries"`
+	Queued  int      `json:"queued"`
+}
+
+// webhooksHandler serves GET /webhooks.
+func (srv *Server) webhooksHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, CodeMethodNotAllowed, "only GET allowed")
+		return
+	}
+	srv.webhooksMu.Lock()
+	list := make([]WebhookInfo, 0, len(srv.webhooks))
+	for _, h := range srv.webhooks {
+		s := h.settings
+		u, _ := url.Parse(s.URL)
+		list = append(list, WebhookInfo{
+			Name: s.name(), URL: u.Redacted(), Events: s.Events, Devices: s.Devices,
+			Signed: s.Secret != "", Retries: s.retries(), Queued: len(h.queue),
+		})
+	}
+	srv.webhooksMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"webhooks": list})
+}
+
+// webhookDeliveriesHandler serves GET /webhooks/deliveries, newest first.
+func (srv *Server) webhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, CodeMethodNotAllowed, "only GET allowed")
+		return
+	}
+	q := r.URL.Query()
+	limit := DefaultDeliveryPage
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			writeError(w, CodeInvalidRequest, "limit must be a positive number")
+			return
+		}
+		limit = min(n, webhookLogSize)
+	}
+	name, status, espID := q.Get("webhook"), q.Get("status"), srv.resolveAlias(q.Get("esp_id"))
+
+	srv.webhooksMu.Lock()
+	list := []WebhookDelivery{}
+	for _, d := range slices.Backward(srv.webhookLog) {
+		if len(list) == limit {
+			break
+		}
+		if (name == "" || d.Webhook == name) && (status == "" || d.Status == status) && (espID == "" || d.ESPID == espID) {
+			list = append(list, *d)
+		}
+	}
+	srv.webhooksMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"deliveries": list})
+}
+
+// webhookTestHandler serves POST /webhooks/test: it queues a test event for
+// one webhook, or all of them, whatever their filters.
+func (srv *Server) webhookTestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, CodeMethodNotAllowed, "only POST allowed")
+		return
+	}
+	var data struct {
+		Webhook string `json:"webhook"`
+	}
+	if r.ContentLength != 0 {
+		if err := decodeJSON(w, r, &data); err != nil {
+			return
+		}
+	}
+
+	e := Event{Type: eventWebhookTest, Time: srv.now(), Actor: srv.requestActor(r), Detail: "Test delivery from wake-on-demand"}
+	srv.webhooksMu.Lock()
+	list := []WebhookDelivery{}
+	for _, h := range srv.webhooks {
+		if data.Webhook == "" || h.settings.name() == data.Webhook {
+			list = append(list, *h.enqueue(srv, e))
+		}
+	}
+	srv.webhooksMu.Unlock()
+	switch {
+	case len(list) > 0:
+	case data.Webhook != "":
+		writeError(w, CodeNotFound, fmt.Sprintf("no webhook named %q", data.Webhook))
+		return
+	default:
+		writeError(w, CodeNotFound, "no webhooks configured")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"deliveries": list})
+}
@@ -0,0 +1,382 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+)
+
+const wsMaxMessageSize = 64 << 10
+
+type wsFrame struct {
+	opcode  byte
+	payload []byte
+}
+
+type wsConn struct {
+	id       string
+	conn     net.Conn
+	rw       *bufio.ReadWriter
+	send     chan wsFrame
+	done     chan struct{}
+	closeOne sync.Once
+}
+
+// websocketState holds the Server state kept in websocket.go.
+type websocketState struct {
+	// ESP IDs with an open push channel; guarded by mu
+	wsConns map[string]*wsConn
+}
+
+func (srv *Server) wsHandler(w http.ResponseWriter, r *http.Request) {
+	id := espID(r)
+	clientIP := r.RemoteAddr
+	rlog := srv.requestLogger(r).With("esp_id", id)
+
+	if id == "" {
+		rlog.Warn("Missing ESP ID")
+		writeError(w, CodeInvalidRequest, "missing id")
+		return
+	}
+
+	if !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") {
+		rlog.Warn("Not a WebSocket upgrade")
+		writeError(w, CodeInvalidRequest, "expected WebSocket upgrade")
+		return
+	}
+
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" || r.Header.Get("Sec-WebSocket-Version") != "13" {
+		rlog.Warn("Unsupported WebSocket handshake")
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		writeError(w, CodeUpgradeRequired, "unsupported WebSocket version")
+		return
+	}
+
+	srv.mu.Lock()
+	esp, exists := srv.espMap[id]
+	pinned := exists && srv.checkPin(w, r, esp) && srv.claimID(w, r, esp, r.URL.Query().Get("instance"))
+	srv.mu.Unlock()
+	if !exists {
+		rlog.Warn("ESP not registered")
+		writeError(w, CodeESPNotFound, "ESP not registered")
+		return
+	}
+	if !pinned {
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		writeError(w, CodeInternal, "WebSocket not supported")
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		rlog.Error("Hijack failed", "error", err)
+		return
+	}
+
+	sum := sha1.Sum([]byte(key + wsGUID))
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	rw.WriteString("Upgrade: websocket\r\n")
+	rw.WriteString("Connection: Upgrade\r\n")
+	rw.WriteString("Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return
+	}
+
+	c := &wsConn{
+		id:   id,
+		conn: conn,
+		rw:   rw,
+		send: make(chan wsFrame, 8),
+		done: make(chan struct{}),
+	}
+
+	srv.mu.Lock()
+	if old, exists := srv.wsConns[id]; exists {
+		old.close()
+	}
+	srv.wsConns[id] = c
+	esp.markSeen(srv, srv.requestActor(r))
+	esp.RemoteAddr = clientIP
+	// Deliver anything queued while the ESP was polling or disconnected
+	srv.pushCommands(esp)
+	srv.mu.Unlock()
+
+	rlog.Info("ESP connected")
+
+	go c.writeLoop(srv)
+	c.readLoop(srv)
+
+	srv.mu.Lock()
+	if srv.wsConns[id] == c {
+		delete(srv.wsConns, id)
+	}
+	srv.mu.Unlock()
+	c.close()
+
+	rlog.Info("ESP disconnected")
+}
+
+// pushCommands hands queued commands to the ESP's push channel, if any.
+// Must be called with mu held.
+func (srv *Server) pushCommands(esp *ESP) bool {
+	c, exists := srv.wsConns[esp.ID]
+	if !exists {
+		return false
+	}
+
+	pushed := false
+	srv.expireQueue(esp)
+	for len(esp.Queue) > 0 && !srv.queueHeld(esp) {
+		rec := esp.Queue[0]
+		payload, _ := json.Marshal(rec.payload(srv))
+		select {
+		case c.send <- wsFrame{opcode: wsOpText, payload: payload}:
+		default:
+			// Writer is backed up; leave the rest for the next poll
+			return pushed
+		}
+
+		srv.popCommand(esp)
+		srv.logger("ws").Info("Command pushed to ESP", "esp_id", esp.ID, "command", rec.Command, "command_id", rec.ID)
+		pushed = true
+	}
+	return pushed
+}
+
+func (srv *Server) closeAllWS() {
+	srv.mu.Lock()
+	conns := make([]*wsConn, 0, len(srv.wsConns))
+	for _, c := range srv.wsConns {
+		conns = append(conns, c)
+	}
+	srv.mu.Unlock()
+
+	for _, c := range conns {
+		select {
+		case c.send <- wsFrame{opcode: wsOpClose, payload: []byte{0x03, 0xE9}}: // 1001 going away
+		default:
+		}
+	}
+
+	// Give writers a moment to flush the close frame before dropping the sockets
+	deadline := time.After(time.Second)
+	for _, c := range conns {
+		select {
+		case <-c.done:
+		case <-deadline:
+		}
+		c.close()
+	}
+}
+
+func (c *wsConn) close() {
+	c.closeOne.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+func (c *wsConn) touch(srv *Server) {
+	srv.mu.Lock()
+	if esp, exists := srv.espMap[c.id]; exists {
+		esp.markSeen(srv, "")
+	}
+	srv.mu.Unlock()
+}
+
+func (c *wsConn) readLoop(srv *Server) {
+	var message []byte
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(srv.timeoutDuration))
+		fin, opcode, payload, err := readWSFrame(c.rw.Reader)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				srv.logger("ws").Warn("Read failed", "esp_id", c.id, "error", err)
+			}
+			return
+		}
+
+		switch opcode {
+		case wsOpPing:
+			c.touch(srv)
+			c.queue(wsFrame{opcode: wsOpPong, payload: payload})
+		case wsOpPong:
+			c.touch(srv)
+		case wsOpClose:
+			c.queue(wsFrame{opcode: wsOpClose, payload: payload})
+			return
+		case wsOpText, wsOpBinary, wsOpContinuation:
+			message = append(message, payload...)
+			if len(message) > wsMaxMessageSize {
+				srv.logger("ws").Warn("Message too large", "esp_id", c.id)
+				return
+			}
+			if fin {
+				// Any message from the ESP counts as a heartbeat
+				c.touch(srv)
+				c.handleMessage(srv, message)
+				message = message[:0]
+			}
+		}
+	}
+}
+
+// handleMessage picks telemetry and the power sensor reading out of
+// {"telemetry": {...}, "power": "on"} messages.
+func (c *wsConn) handleMessage(srv *Server, message []byte) {
+	var msg struct {
+		Telemetry *Telemetry `json:"telemetry"`
+		Power     string     `json:"power"`
+	}
+	if json.Unmarshal(message, &msg) != nil || msg.Telemetry == nil && msg.Power == "" {
+		return
+	}
+
+	srv.mu.Lock()
+	if esp, exists := srv.espMap[c.id]; exists {
+		if msg.Telemetry != nil {
+			srv.updateTelemetry(esp, *msg.Telemetry)
+		}
+		if msg.Power != "" {
+			esp.powerSensor(srv, msg.Power)
+		}
+	}
+	srv.mu.Unlock()
+}
+
+func (c *wsConn) queue(frame wsFrame) {
+	select {
+	case c.send <- frame:
+	case <-c.done:
+	}
+}
+
+func (c *wsConn) writeLoop(srv *Server) {
+	pingInterval := srv.timeoutDuration / 3
+	if pingInterval <= 0 {
+		pingInterval = 10 * time.Second
+	}
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+
+	for {
+		var frame wsFrame
+		select {
+		case frame = <-c.send:
+		case <-ticker.C:
+			frame = wsFrame{opcode: wsOpPing}
+		case <-c.done:
+			return
+		}
+
+		c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		if err := writeWSFrame(c.rw.Writer, frame.opcode, frame.payload); err != nil {
+			c.close()
+			return
+		}
+		if frame.opcode == wsOpClose {
+			c.close()
+			return
+		}
+	}
+}
+
+func readWSFrame(r *bufio.Reader) (fin bool, opcode byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(r, header[:]); err != nil {
+		return
+	}
+	fin = header[0]&0x80 != 0
+	opcode = header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7F)
+
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(r, ext[:]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(r, ext[:]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if length > wsMaxMessageSize {
+		err = errors.New("frame too large")
+		return
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err = io.ReadFull(r, mask[:]); err != nil {
+			return
+		}
+	}
+
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return
+}
+
+func writeWSFrame(w *bufio.Writer, opcode byte, payload []byte) error {
+	w.WriteByte(0x80 | opcode)
+	switch n := len(payload); {
+	case n < 126:
+		w.WriteByte(byte(n))
+	case n <= 0xFFFF:
+		w.WriteByte(126)
+		binary.Write(w, binary.BigEndian, uint16(n))
+	default:
+		w.WriteByte(127)
+		binary.Write(w, binary.BigEndian, uint64(n))
+	}
+	w.Write(payload)
+	return w.Flush()
+}
+
+func headerContains(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
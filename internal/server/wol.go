@@ -0,0 +1,180 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+type DeviceType string
+
+const (
+	DeviceESP  DeviceType = "esp"
+	DeviceWoL  DeviceType = "wol"
+	DeviceMQTT DeviceType = "mqtt"
+
+	// Driver devices, see drivers.go
+	DeviceTasmota DeviceType = "tasmota"
+	DeviceShelly  DeviceType = "shelly"
+	DeviceIPMI    DeviceType = "ipmi"
+	DeviceVM      DeviceType = "vm"
+)
+
+const defaultWoLBroadcast = "255.255.255.255:9"
+
+func (e *ESP) isWoL() bool {
+	return e.Type == DeviceWoL
+}
+
+func (e *ESP) isMQTT() bool {
+	return e.Type == DeviceMQTT
+}
+
+// deviceType is the device's type; registry entries from before types
+// existed are ESPs.
+func (e *ESP) deviceType() DeviceType {
+	if e.Type == "" {
+		return DeviceESP
+	}
+	return e.Type
+}
+
+func magicPacket(mac net.HardwareAddr) []byte {
+	packet := bytes.Repeat([]byte{0xFF}, 6)
+	for i := 0; i < 16; i++ {
+		packet = append(packet, mac...)
+	}
+	return packet
+}
+
+func parseMAC(s string) (net.HardwareAddr, error) {
+	mac, err := net.ParseMAC(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(mac) != 6 {
+		return nil, fmt.Errorf("%s is not a 48-bit MAC address", s)
+	}
+	return mac, nil
+}
+
+func NormalizeBroadcast(addr string) string {
+	if addr == "" {
+		return defaultWoLBroadcast
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return net.JoinHostPort(addr, "9")
+	}
+	return addr
+}
+
+func SendMagicPacket(macStr, broadcast string) error {
+	mac, err := parseMAC(macStr)
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.Dial("udp", NormalizeBroadcast(broadcast))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write(magicPacket(mac))
+	return err
+}
+
+// wakeWoL sends the magic packet for a WoL device. Must be called with mu held.
+func (srv *Server) wakeWoL(esp *ESP) error {
+	if err := SendMagicPacket(esp.MAC, esp.Broadcast); err != nil {
+		return err
+	}
+	esp.LastSeen = srv.now()
+	srv.logger("wol").Info("Magic packet sent", "esp_id", esp.ID, "mac", esp.MAC, "broadcast", NormalizeBroadcast(esp.Broadcast))
+	return nil
+}
+
+// wolDriver wakes WoL devices. They only turn on, and they are woken
+// whether or not they look online.
+type wolDriver struct {
+	srv *Server
+}
+
+func (wolDriver) Supports(cmd ESPCommand) bool { return cmd == CommandPulse }
+
+func (wolDriver) Queues() bool { return false }
+
+func (d wolDriver) Send(esp *ESP, cmd ESPCommand, _ time.Duration, opts commandOptions, actor string) (dispatchResult, error) {
+	if opts.DryRun {
+		return dispatchResult{Status: statusDryRun, Delivery: "wol"}, nil
+	}
+	rec := d.srv.newCommandRecord(esp.ID, cmd)
+	d.srv.recordEvent(Event{Type: EventCommand, ESPID: esp.ID, Actor: actor, Command: cmd, CommandID: rec.ID, Detail: "wol"})
+	if err := d.srv.wakeWoL(esp); err != nil {
+		d.srv.failCommand(rec, err.Error())
+		return dispatchResult{Record: rec}, fmt.Errorf("%w: %v", errWakeFailed, err)
+	}
+	// A magic packet is fire-and-forget, so it is done once sent
+	d.srv.markDelivered(rec)
+	d.srv.ackCommand(rec)
+	return dispatchResult{Record: rec, Status: "sent", Delivery: "wol"}, nil
+}
+
+func (srv *Server) wolDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	rlog := srv.requestLogger(r)
+	rlog.Debug("WoL device request")
+
+	if r.Method != http.MethodPost {
+		rlog.Warn("Method not allowed", "method", r.Method)
+		writeError(w, CodeMethodNotAllowed, "only POST allowed")
+		return
+	}
+
+	var data struct {
+		ID        string `json:"id"`
+		MAC       string `json:"mac"`
+		Broadcast string `json:"broadcast"`
+	}
+	if err := decodeJSON(w, r, &data); err != nil {
+		rlog.Warn("Invalid JSON", "error", err)
+		return
+	}
+
+	if err := validateESPID(data.ID); err != nil {
+		rlog.Warn("Invalid device ID", "esp_id", data.ID, "error", err)
+		writeError(w, CodeInvalidRequest, err.Error())
+		return
+	}
+
+	mac, err := parseMAC(data.MAC)
+	if err != nil {
+		rlog.Warn("Invalid MAC", "esp_id", data.ID, "error", err)
+		writeError(w, CodeInvalidRequest, "invalid mac")
+		return
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if existing, exists := srv.espMap[data.ID]; exists && !existing.isWoL() {
+		rlog.Warn("ID already used by an ESP", "esp_id", data.ID)
+		writeError(w, CodeConflict, fmt.Sprintf("'%s' is already registered as an ESP", data.ID))
+		return
+	}
+
+	srv.espMap[data.ID] = &ESP{
+		ID:           data.ID,
+		Type:         DeviceWoL,
+		MAC:          mac.String(),
+		Broadcast:    data.Broadcast,
+		RegisteredAt: srv.now(),
+	}
+	srv.saveRegistry()
+	rlog.Info("WoL device added", "esp_id", data.ID, "mac", mac.String())
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "added", "id": data.ID})
+}
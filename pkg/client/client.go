@@ -0,0 +1,529 @@
+// Package client talks to a wake-on-demand server over its /api/v1 HTTP API.
+//
+//	c := client.New("http://nas:8080", client.WithToken(os.Getenv("WOD_TOKEN")))
+//	resp, err := c.SetCommand(ctx, "bedroom", client.CommandPulse, nil)
+//	if errors.Is(err, client.ErrOffline) {
+//		...
+//	}
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const apiPrefix = "/api/v1"
+
+// Errors returned by Client methods. Failed requests return an *APIError,
+// which matches the sentinel for its error code, or for its status code
+// when the server sent none, with errors.Is.
+var (
+	ErrUnreachable  = errors.New("server unreachable")
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrForbidden    = errors.New("forbidden")
+	ErrNotFound     = errors.New("not found")
+	ErrConflict     = errors.New("conflict")
+	ErrOffline      = errors.New("device offline")
+	ErrRateLimited  = errors.New("rate limited")
+	ErrQueueFull    = errors.New("command queue full")
+	ErrMaintenance  = errors.New("device in maintenance")
+
+	// These are narrower than ErrForbidden and ErrConflict, and only
+	// match servers that send error codes.
+	ErrProtected       = errors.New("device protected")
+	ErrAlreadyUp       = errors.New("target already up")
+	ErrIDConflict      = errors.New("duplicate ESP ID")
+	ErrPendingApproval = errors.New("device waiting for approval")
+	ErrCooldown        = errors.New("device cooling down")
+	ErrQuotaExceeded   = errors.New("command quota used up")
+)
+
+// APIError is a non-2xx response from the server.
+type APIError struct {
+	StatusCode int
+	// Code is the server's error code, e.g. "esp_offline"; see the Error
+	// schema in the OpenAPI spec. Empty for servers that don't send one.
+	Code    string
+	Message string
+	// RetryAfter is set when the server rate limited the request, or the
+	// device is cooling down after a power command.
+	RetryAfter time.Duration
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+func (e *APIError) Is(target error) bool {
+	switch target {
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized
+	case ErrForbidden:
+		return e.StatusCode == http.StatusForbidden
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrConflict:
+		return e.StatusCode == http.StatusConflict
+	case ErrOffline:
+		return e.is("esp_offline", e.StatusCode == http.StatusServiceUnavailable)
+	case ErrRateLimited:
+		return e.is("rate_limited", e.StatusCode == http.StatusTooManyRequests && e.RetryAfter > 0)
+	case ErrMaintenance:
+		return e.StatusCode == http.StatusLocked
+	case ErrQueueFull:
+		// Without a code, a full queue is a 429 without Retry-After
+		return e.is("queue_full", e.StatusCode == http.StatusTooManyRequests && e.RetryAfter == 0)
+	case ErrProtected:
+		return e.Code == "protected"
+	case ErrAlreadyUp:
+		return e.Code == "already_up"
+	case ErrIDConflict:
+		return e.Code == "id_conflict"
+	case ErrPendingApproval:
+		return e.Code == "pending_approval"
+	case ErrCooldown:
+		return e.Code == "cooldown"
+	case ErrQuotaExceeded:
+		return e.Code == "quota_exceeded"
+	}
+	return false
+}
+
+// is matches code, or by status for servers that send no codes.
+func (e *APIError) is(code string, byStatus bool) bool {
+	if e.Code != "" {
+		return e.Code == code
+	}
+	return byStatus
+}
+
+// Client is safe for concurrent use.
+type Client struct {
+	baseURL    string
+	token      string
+	httpClient *http.Client
+}
+
+type Option func(*Client)
+
+// WithToken authenticates requests with an admin key or user token.
+func WithToken(token string) Option {
+	return func(c *Client) { c.token = token }
+}
+
+// WithHTTPClient replaces http.DefaultClient, e.g. for custom TLS or timeouts.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.httpClient = hc }
+}
+
+// New returns a client for the server at baseURL (e.g. "http://nas:8080").
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		httpClient: http.DefaultClient,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// SetCommand sends cmd to a device. opts may be nil.
+func (c *Client) SetCommand(ctx context.Context, espID string, cmd Command, opts *CommandOptions) (*CommandResponse, error) {
+	var resp CommandResponse
+	if err := c.doWithHeader(ctx, http.MethodPost, "/set-command", nil, commandHeader(opts), commandBody(espID, cmd, opts), &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// SetGroupCommand sends cmd to every member of a group. A member failing
+// is reported in its result rather than as an error. opts may be nil.
+func (c *Client) SetGroupCommand(ctx context.Context, group string, cmd Command, opts *CommandOptions) (*GroupCommandResponse, error) {
+	var resp GroupCommandResponse
+	if err := c.doWithHeader(ctx, http.MethodPost, "/set-command", nil, commandHeader(opts), commandBody("@"+group, cmd, opts), &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func commandHeader(opts *CommandOptions) http.Header {
+	if opts == nil || opts.IdempotencyKey == "" {
+		return nil
+	}
+	return http.Header{"Idempotency-Key": {opts.IdempotencyKey}}
+}
+
+func commandBody(id string, cmd Command, opts *CommandOptions) map[string]interface{} {
+	data := map[string]interface{}{"id": id, "command": cmd}
+	if opts != nil && opts.Pulse != 0 {
+		data["duration_ms"] = opts.Pulse.Milliseconds()
+	}
+	if opts != nil && opts.Force {
+		data["force"] = true
+	}
+	if opts != nil && opts.TTL != 0 {
+		data["ttl_ms"] = opts.TTL.Milliseconds()
+	}
+	if opts != nil && opts.QueueIfOffline {
+		data["queue_if_offline"] = true
+	}
+	if opts != nil && opts.AfterCooldown {
+		data["after_cooldown"] = true
+	}
+	if opts != nil && opts.Action != "" {
+		data["action"] = opts.Action
+	}
+	if opts != nil && opts.Override {
+		data["override"] = true
+	}
+	if opts != nil && opts.DryRun {
+		data["dry_run"] = true
+	}
+	if opts != nil && opts.Priority != "" {
+		data["priority"] = opts.Priority
+	}
+	return data
+}
+
+// List returns the devices the token may see.
+func (c *Client) List(ctx context.Context) ([]Device, error) {
+	return c.ListNamespace(ctx, "")
+}
+
+// ListNamespace returns the devices the token may see in one namespace,
+// or in all of them when namespace is empty.
+func (c *Client) ListNamespace(ctx context.Context, namespace string) ([]Device, error) {
+	var resp struct {
+		ESPs []Device `json:"esps"`
+	}
+	var query url.Values
+	if namespace != "" {
+		query = url.Values{"namespace": {namespace}}
+	}
+	if err := c.do(ctx, http.MethodGet, "/list", query, nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.ESPs, nil
+}
+
+// ListOptions filters, sorts and pages ListPage. Zero values don't filter.
+type ListOptions struct {
+	Namespace string
+	Online    *bool
+	Group     string
+	Prefix    string // matches the ID or alias, ignoring case
+	Sort      string // id, name or last_seen; prefix with - for descending
+	Limit     int    // 0 returns every match
+	Cursor    string // NextCursor of the previous page
+	Pending   bool   // only devices waiting for approval
+}
+
+// DevicePage is one page of devices. Total counts the matches on all pages.
+type DevicePage struct {
+	Devices    []Device `json:"esps"`
+	Total      int      `json:"total"`
+	NextCursor string   `json:"next_cursor,omitempty"`
+}
+
+// ListPage returns the devices matching opts, one page at a time.
+func (c *Client) ListPage(ctx context.Context, opts ListOptions) (*DevicePage, error) {
+	query := url.Values{}
+	for name, value := range map[string]string{"namespace": opts.Namespace, "group": opts.Group, "prefix": opts.Prefix, "sort": opts.Sort, "cursor": opts.Cursor} {
+		if value != "" {
+			query.Set(name, value)
+		}
+	}
+	if opts.Online != nil {
+		query.Set("online", strconv.FormatBool(*opts.Online))
+	}
+	if opts.Limit > 0 {
+		query.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	if opts.Pending {
+		query.Set("pending", "true")
+	}
+	var page DevicePage
+	if err := c.do(ctx, http.MethodGet, "/list", query, nil, &page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+// Info returns one device by ID or alias.
+func (c *Client) Info(ctx context.Context, espID string) (*DeviceDetails, error) {
+	var d DeviceDetails
+	if err := c.do(ctx, http.MethodGet, "/info", url.Values{"id": {espID}}, nil, &d); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// UpdateMetadata sets a device's alias, description, location or hostname.
+// The alias can then be used in place of the ID.
+func (c *Client) UpdateMetadata(ctx context.Context, espID string, m MetadataUpdate) (*DeviceDetails, error) {
+	var d DeviceDetails
+	if err := c.do(ctx, http.MethodPatch, "/esps/"+url.PathEscape(espID), nil, m, &d); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// Remove deletes a device from the server's registry.
+func (c *Client) Remove(ctx context.Context, espID string) error {
+	return c.do(ctx, http.MethodDelete, "/esps/"+url.PathEscape(espID), nil, nil, nil)
+}
+
+// Approve lets a device that registered by itself receive commands. code
+// is the pairing code it printed, which the server may require.
+func (c *Client) Approve(ctx context.Context, espID, code string) error {
+	return c.do(ctx, http.MethodPost, "/approve", nil, map[string]string{"id": espID, "code": code}, nil)
+}
+
+// CommandResult returns the delivery status of a command.
+func (c *Client) CommandResult(ctx context.Context, commandID string) (*CommandRecord, error) {
+	var rec CommandRecord
+	if err := c.do(ctx, http.MethodGet, "/command-result", url.Values{"id": {commandID}}, nil, &rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+// History returns a device's most recent commands, newest first. limit 0
+// returns everything the server keeps.
+func (c *Client) History(ctx context.Context, espID string, limit int) ([]CommandRecord, error) {
+	var q url.Values
+	if limit > 0 {
+		q = url.Values{"limit": {strconv.Itoa(limit)}}
+	}
+	var resp struct {
+		Commands []CommandRecord `json:"commands"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/esps/"+url.PathEscape(espID)+"/commands", q, nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Commands, nil
+}
+
+// Uptime returns the uptime of the device's target since a time such as
+// "30d", "72h" or "2026-09-01", per "day" or "week". Empty arguments use
+// the server's defaults: 30 days, per day.
+func (c *Client) Uptime(ctx context.Context, espID, since, bucket string) (*UptimeReport, error) {
+	q := url.Values{}
+	if since != "" {
+		q.Set("since", since)
+	}
+	if bucket != "" {
+		q.Set("bucket", bucket)
+	}
+	var report UptimeReport
+	if err := c.do(ctx, http.MethodGet, "/esps/"+url.PathEscape(espID)+"/uptime", q, nil, &report); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+// TelemetryHistory returns a device's telemetry since a time, e.g. "24h" or
+// "7d". No metrics returns all of them; a step of 0 returns raw samples,
+// unless there are too many for one graph.
+func (c *Client) TelemetryHistory(ctx context.Context, espID string, metrics []string, since string, step time.Duration) (*TelemetryReport, error) {
+	q := url.Values{}
+	if len(metrics) > 0 {
+		q.Set("metric", strings.Join(metrics, ","))
+	}
+	if since != "" {
+		q.Set("since", since)
+	}
+	if step > 0 {
+		q.Set("step", step.String())
+	}
+	var report TelemetryReport
+	if err := c.do(ctx, http.MethodGet, "/esps/"+url.PathEscape(espID)+"/telemetry", q, nil, &report); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+// Health returns the server's health summary. It needs no token.
+func (c *Client) Health(ctx context.Context) (*Health, error) {
+	var h Health
+	if err := c.do(ctx, http.MethodGet, "/health", nil, nil, &h); err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+// WaitForOnline polls the device every interval until it is online, and
+// returns ctx's error if the context ends first. A device that has not
+// registered yet counts as offline.
+func (c *Client) WaitForOnline(ctx context.Context, espID string, interval time.Duration) (*DeviceDetails, error) {
+	return c.WaitForDevice(ctx, espID, interval, func(d *DeviceDetails) bool { return d.Online })
+}
+
+// WaitForDevice polls the device every interval until cond holds, and
+// returns ctx's error if the context ends first. cond isn't called while
+// the device is not registered. The device last seen is returned with
+// ctx's error, nil if it never was.
+func (c *Client) WaitForDevice(ctx context.Context, espID string, interval time.Duration, cond func(*DeviceDetails) bool) (*DeviceDetails, error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var last *DeviceDetails
+	for {
+		d, err := c.Info(ctx, espID)
+		switch {
+		case err == nil:
+			last = d
+			if cond(d) {
+				return d, nil
+			}
+		case errors.Is(err, ErrNotFound):
+			last = nil
+		case ctx.Err() != nil:
+			return last, ctx.Err()
+		default:
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			return last, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// WaitForCommand polls a command every interval until it is finished, and
+// returns ctx's error if the context ends first.
+func (c *Client) WaitForCommand(ctx context.Context, commandID string, interval time.Duration) (*CommandRecord, error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		rec, err := c.CommandResult(ctx, commandID)
+		if err != nil {
+			return nil, err
+		}
+		if rec.Finished() {
+			return rec, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// WaitForPower polls the device every interval until its target reaches
+// state (one of the Power* constants), and returns ctx's error if the
+// context ends first.
+func (c *Client) WaitForPower(ctx context.Context, espID, state string, interval time.Duration) (*DeviceDetails, error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		d, err := c.Info(ctx, espID)
+		if err != nil {
+			return nil, err
+		}
+		if d.Power != nil && d.Power.State == state {
+			return d, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body, out interface{}) error {
+	return c.doWithHeader(ctx, method, path, query, nil, body, out)
+}
+
+func (c *Client) doWithHeader(ctx context.Context, method, path string, query url.Values, header http.Header, body, out interface{}) error {
+	u := c.baseURL + apiPrefix + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("%w: %w", ErrUnreachable, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return ResponseError(resp)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("decode response: %w", err)
+	}
+	return nil
+}
+
+// ResponseError reads the error from a non-2xx response, for callers making
+// their own requests. Error bodies are {"error":{"code":...,"message":...}};
+// a plain-text body becomes the message.
+func ResponseError(resp *http.Response) *APIError {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	e := &APIError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(body))}
+	var envelope struct {
+		Error struct {
+			Code         string `json:"code"`
+			Message      string `json:"message"`
+			RetryAfterMS int64  `json:"retry_after_ms"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(body, &envelope) == nil && envelope.Error.Code != "" {
+		e.Code, e.Message = envelope.Error.Code, envelope.Error.Message
+	}
+	if e.Message == "" {
+		e.Message = resp.Status
+	}
+	if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		e.RetryAfter = time.Duration(secs) * time.Second
+	}
+	// The header is in whole seconds
+	if ms := envelope.Error.RetryAfterMS; ms > 0 {
+		e.RetryAfter = time.Duration(ms) * time.Millisecond
+	}
+	return e
+}
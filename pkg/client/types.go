@@ -0,0 +1,412 @@
+package client
+
+import "time"
+
+// Command is a command understood by devices.
+type Command string
+
+const (
+	CommandPulse   Command = "pulse"    // short press, powers the target on
+	CommandForce   Command = "force"    // long press, forces the target off
+	CommandStatus  Command = "status"   // asks the ESP to report in
+	CommandSoftOff Command = "soft-off" // OS shutdown through the target's agent
+	CommandAction  Command = "action"   // a custom action the device declared
+)
+
+// Command priorities, see CommandOptions.Priority.
+const (
+	PriorityLow    = "low"
+	PriorityNormal = "normal"
+	PriorityUrgent = "urgent"
+)
+
+// Device types reported in Device.Type.
+const (
+	DeviceESP  = "esp"
+	DeviceWoL  = "wol"
+	DeviceMQTT = "mqtt"
+)
+
+// Device is one entry of the server's device list.
+type Device struct {
+	ID       string `json:"id"`
+	Alias    string `json:"alias,omitempty"`
+	Type     string `json:"type"`
+	Online   bool   `json:"online"`
+	LastSeen string `json:"last_seen"`
+
+	Description string `json:"description,omitempty"`
+	Location    string `json:"location,omitempty"`
+	Hostname    string `json:"hostname,omitempty"`
+	Protected   bool   `json:"protected,omitempty"`
+
+	// Maintenance is set while the device refuses every command but status
+	Maintenance *Maintenance `json:"maintenance,omitempty"`
+	Actions     []Action     `json:"actions,omitempty"`
+	Timeout     *Timeout     `json:"timeout,omitempty"`
+	Target      *Target      `json:"target,omitempty"`
+	TargetState *TargetState `json:"target_state,omitempty"`
+	Telemetry   *Telemetry   `json:"telemetry,omitempty"`
+	Agent       *Agent       `json:"agent,omitempty"`
+	Power       *Power       `json:"power,omitempty"`
+	LastPower   *PowerReport `json:"last_power,omitempty"`
+	Groups      []string     `json:"groups,omitempty"`
+	Conflict    *IDConflict  `json:"conflict,omitempty"`
+	Idle        []IdleState  `json:"idle,omitempty"`
+
+	// PendingSince is set while the device waits for an admin to approve it
+	PendingSince *time.Time `json:"pending_since,omitempty"`
+}
+
+// Maintenance says since when, until when, by whom and why a device is
+// frozen. Until is nil when it lasts until turned off.
+type Maintenance struct {
+	Since  time.Time  `json:"since"`
+	Until  *time.Time `json:"until,omitempty"`
+	By     string     `json:"by,omitempty"`
+	Reason string     `json:"reason,omitempty"`
+}
+
+// DeviceDetails is a Device with the fields only returned for a single device.
+type DeviceDetails struct {
+	Device
+	MAC          string    `json:"mac,omitempty"`
+	Broadcast    string    `json:"broadcast,omitempty"`
+	RegisteredAt time.Time `json:"registered_at"`
+	RemoteAddr   string    `json:"remote_addr"`
+	PinnedIP     string    `json:"pinned_ip,omitempty"`
+	Pending      int       `json:"pending"`
+	PulseMS      int       `json:"pulse_ms,omitempty"`
+	ForceMS      int       `json:"force_ms,omitempty"`
+	Driver       *Driver   `json:"driver,omitempty"`
+	SSH          string    `json:"ssh,omitempty"` // user@host:port soft-off logs in to
+	// CooldownMS is how long after an on or off the device refuses
+	// another, CooldownLeftMS how much of it is left
+	CooldownMS     int64 `json:"cooldown_ms,omitempty"`
+	CooldownLeftMS int64 `json:"cooldown_left_ms,omitempty"`
+	// Capabilities is nil for firmware that declared nothing
+	Capabilities *Capabilities `json:"capabilities,omitempty"`
+	// Beacon is the last UDP beacon, nil if the device never sent one
+	Beacon *Beacon `json:"beacon,omitempty"`
+}
+
+// Beacon is when and from which address a device's last beacon came.
+type Beacon struct {
+	LastSeen time.Time `json:"last_seen"`
+	Addr     string    `json:"addr"`
+}
+
+// Capabilities is the protocol version and features negotiated with the
+// firmware.
+type Capabilities struct {
+	Protocol int      `json:"protocol"`
+	Features []string `json:"features"`
+}
+
+// Driver is how the server reaches a tasmota, shelly or ipmi device. The
+// password is never returned.
+type Driver struct {
+	Addr     string `json:"addr"`
+	Username string `json:"username,omitempty"`
+	Relay    int    `json:"relay,omitempty"`
+	Gen      int    `json:"gen,omitempty"`
+}
+
+// Timeout is how long a device may go unseen before it counts as offline.
+type Timeout struct {
+	TimeoutMS      int64  `json:"timeout_ms"`
+	Source         string `json:"source"` // manual, adaptive or default
+	PollIntervalMS int64  `json:"poll_interval_ms,omitempty"`
+}
+
+// UptimeReport is a target's uptime per day or week.
+type UptimeReport struct {
+	ID      string         `json:"id"`
+	Since   time.Time      `json:"since"`
+	Until   time.Time      `json:"until"`
+	Bucket  string         `json:"bucket"` // day or week
+	Total   UptimeBucket   `json:"total"`
+	Buckets []UptimeBucket `json:"buckets"`
+}
+
+// UptimeBucket is how long the target was up, down and in an unknown state
+// in one day or week.
+type UptimeBucket struct {
+	Start     time.Time `json:"start"`
+	UpMS      int64     `json:"up_ms"`
+	DownMS    int64     `json:"down_ms"`
+	UnknownMS int64     `json:"unknown_ms"`
+	// Uptime is the percentage of the known time the target was up, nil
+	// when its state was never known.
+	Uptime *float64 `json:"uptime,omitempty"`
+}
+
+// TelemetryReport is a device's telemetry history, one series per metric.
+type TelemetryReport struct {
+	ID    string    `json:"id"`
+	Since time.Time `json:"since"`
+	Until time.Time `json:"until"`
+	// StepMS is how much time each point averages, 0 for raw samples
+	StepMS int64             `json:"step_ms,omitempty"`
+	Series []TelemetrySeries `json:"series"`
+}
+
+// TelemetrySeries is the history of one metric: rssi, chip_temp, free_heap
+// or battery_v.
+type TelemetrySeries struct {
+	Metric string           `json:"metric"`
+	Unit   string           `json:"unit"`
+	Points []TelemetryPoint `json:"points"`
+}
+
+// TelemetryPoint is a sample, or the average of a step's samples with
+// their minimum and maximum.
+type TelemetryPoint struct {
+	Time  time.Time `json:"t"`
+	Value float64   `json:"v"`
+	Min   *float64  `json:"min,omitempty"`
+	Max   *float64  `json:"max,omitempty"`
+}
+
+// Action is a custom action a device declared, run with CommandAction.
+type Action struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+}
+
+// Target is the machine an ESP controls.
+type Target struct {
+	Host  string `json:"host"`
+	Probe string `json:"probe"`
+	Port  int    `json:"port,omitempty"`
+}
+
+// TargetState is the result of the last probe of a target.
+type TargetState struct {
+	Up        bool      `json:"up"`
+	CheckedAt time.Time `json:"checked_at"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// Telemetry is the health data an ESP last reported.
+type Telemetry struct {
+	Firmware    string    `json:"firmware,omitempty"`
+	Model       string    `json:"model,omitempty"`
+	RSSI        *int      `json:"rssi,omitempty"`
+	FreeHeap    *int64    `json:"free_heap,omitempty"`
+	ChipTemp    *float64  `json:"chip_temp,omitempty"`
+	Uptime      *int64    `json:"uptime,omitempty"`
+	PowerSource string    `json:"power_source,omitempty"`
+	BatteryV    *float64  `json:"battery_v,omitempty"`
+	BatteryLow  bool      `json:"battery_low,omitempty"`
+	ReportedAt  time.Time `json:"reported_at"`
+}
+
+// Agent is the shutdown agent running on a device's target.
+type Agent struct {
+	Host     string    `json:"host"`
+	Hostname string    `json:"hostname,omitempty"`
+	OS       string    `json:"os,omitempty"`
+	LastSeen time.Time `json:"last_seen"`
+	Activity *Activity `json:"activity,omitempty"`
+}
+
+// Activity is the target's usage as last reported by the agent. Fields the
+// agent can't measure on its OS are nil.
+type Activity struct {
+	CPU         *float64  `json:"cpu,omitempty"` // percent across all cores
+	Load        *float64  `json:"load,omitempty"`
+	SSHSessions *int      `json:"ssh_sessions,omitempty"`
+	ReportedAt  time.Time `json:"reported_at"`
+}
+
+// IdleState is set while the device meets an idle policy's thresholds.
+type IdleState struct {
+	Policy string    `json:"policy"`
+	Since  time.Time `json:"since"`
+	ActsAt time.Time `json:"acts_at"` // when the policy's action is due
+	Acted  bool      `json:"acted"`
+	DryRun bool      `json:"dry_run,omitempty"`
+}
+
+// Power states reported in Power.State.
+const (
+	PowerUnknown      = "unknown"
+	PowerOff          = "off"
+	PowerBooting      = "booting"
+	PowerUp           = "up"
+	PowerShuttingDown = "shutting_down"
+)
+
+// Power is the power state of a device's target. It is only reported when a
+// target probe or the ESP's power sensor can confirm it.
+type Power struct {
+	State  string    `json:"state"`
+	Since  time.Time `json:"since"`
+	Source string    `json:"source,omitempty"` // probe, sensor or command
+	Sensor bool      `json:"sensor"`
+}
+
+// PowerReport is the last time a probe, the power sensor or a status
+// result saw the target up or off. It is kept while the live state is
+// unknown, e.g. after a restart or while the ESP is offline.
+type PowerReport struct {
+	State  string    `json:"state"` // up or off
+	At     time.Time `json:"at"`
+	Source string    `json:"source"` // probe or sensor
+}
+
+// IDConflict is set while more than one device registers or polls with
+// the device's ID. Rejected senders get 409 Conflict until they go away.
+type IDConflict struct {
+	Policy     string     `json:"policy"` // reject or quarantine
+	DetectedAt time.Time  `json:"detected_at"`
+	Senders    []IDSender `json:"senders"`
+}
+
+type IDSender struct {
+	Instance string    `json:"instance,omitempty"` // boot token sent by the firmware
+	Addr     string    `json:"addr"`
+	LastSeen time.Time `json:"last_seen"`
+	Rejected bool      `json:"rejected"`
+}
+
+// MetadataUpdate changes a device's metadata with UpdateMetadata. Nil
+// fields are left as they are; empty strings clear them.
+type MetadataUpdate struct {
+	Alias       *string `json:"alias,omitempty"`
+	Description *string `json:"description,omitempty"`
+	Location    *string `json:"location,omitempty"`
+	Hostname    *string `json:"hostname,omitempty"`
+	// Protected makes the server reject force-off without Override
+	Protected *bool `json:"protected,omitempty"`
+	// CooldownMS sets the device's cooldown after on and off; 0 uses the
+	// server's
+	CooldownMS *int64 `json:"cooldown_ms,omitempty"`
+}
+
+// CommandOptions are optional parameters for SetCommand.
+type CommandOptions struct {
+	// Pulse overrides the power button press length for pulse and force.
+	Pulse time.Duration
+	// Force sends a pulse even if the target is already up or booting,
+	// which the server otherwise rejects with ErrConflict.
+	Force bool
+	// TTL is how long a queued command may wait for delivery before it
+	// expires; zero uses the server's default.
+	TTL time.Duration
+	// QueueIfOffline queues the command for an offline device's next poll
+	// instead of failing with ErrOffline.
+	QueueIfOffline bool
+	// AfterCooldown queues a pulse or force sent during the device's
+	// cooldown until it is over, instead of failing with ErrCooldown.
+	AfterCooldown bool
+	// Action names the custom action to run with CommandAction.
+	Action string
+	// Override lets force-off through for a protected device, which the
+	// server otherwise rejects with ErrForbidden.
+	Override bool
+	// DryRun asks the server what it would do without sending anything;
+	// the response has status "dry-run".
+	DryRun bool
+	// Priority is PriorityLow, PriorityNormal (the default) or
+	// PriorityUrgent. Urgent commands skip the device's rate limit and may
+	// push a lower one out of a full queue.
+	Priority string
+	// IdempotencyKey makes retries safe: the server answers a repeat with
+	// the same key and options with the first response instead of sending
+	// the command again.
+	IdempotencyKey string
+}
+
+// CommandResponse is the server's answer to SetCommand.
+type CommandResponse struct {
+	Status     string  `json:"status"` // queued, duplicate, sent or dry-run
+	ID         string  `json:"id"`
+	Command    Command `json:"command"`
+	Action     string  `json:"action,omitempty"`
+	CommandID  string  `json:"command_id"`
+	DurationMS int     `json:"duration_ms"`
+	Delivery   string  `json:"delivery"` // poll, push, wol, mqtt or agent
+	Fallback   bool    `json:"fallback"` // soft-off was sent as force
+	Offline    bool    `json:"offline"`  // queued for a device that is offline
+	QueueDepth int     `json:"queue_depth"`
+}
+
+// GroupCommandResponse is the server's answer to SetGroupCommand.
+type GroupCommandResponse struct {
+	Group   string               `json:"group"`
+	Command Command              `json:"command"`
+	Results []GroupCommandResult `json:"results"`
+	Failed  int                  `json:"failed"`
+}
+
+// GroupCommandResult is the outcome for one member of a group.
+type GroupCommandResult struct {
+	ID        string `json:"id"`
+	Status    string `json:"status"` // queued, duplicate, sent, skipped or failed
+	CommandID string `json:"command_id,omitempty"`
+	Delivery  string `json:"delivery,omitempty"`
+	Error     string `json:"error,omitempty"`
+	Code      string `json:"code,omitempty"` // the error's code, as in APIError
+}
+
+// Command states reported in CommandRecord.Status.
+const (
+	StateQueued    = "queued"
+	StateDelivered = "delivered"
+	StateAcked     = "acked"
+	StateFailed    = "failed"
+	StateExpired   = "expired" // not delivered before its TTL ran out
+	// StateVerifying is a verified wake whose target isn't up yet
+	StateVerifying = "verifying"
+)
+
+// CommandRecord tracks a command from queueing to acknowledgement.
+type CommandRecord struct {
+	ID          string     `json:"id"`
+	ESPID       string     `json:"esp_id"`
+	Command     Command    `json:"command"`
+	Action      string     `json:"action,omitempty"`
+	DurationMS  int        `json:"duration_ms,omitempty"`
+	Actor       string     `json:"actor,omitempty"` // who sent it, e.g. "alex@10.0.0.5" or "schedule:<id>"
+	Status      string     `json:"status"`
+	Error       string     `json:"error,omitempty"`
+	Seq         uint64     `json:"seq,omitempty"` // delivery order, rising per server
+	QueuedAt    time.Time  `json:"queued_at"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	DeliveredAt *time.Time `json:"delivered_at,omitempty"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	// Result is the payload the ESP reported with the outcome, e.g.
+	// {"power": "on"} for status.
+	Result map[string]interface{} `json:"result,omitempty"`
+	// Verify is set on pulses to targets with verified wake.
+	Verify *Verification `json:"verify,omitempty"`
+	// Priority is low, normal or urgent for queued commands.
+	Priority string `json:"priority,omitempty"`
+}
+
+// Verification is the progress of a verified wake.
+type Verification struct {
+	Attempts int        `json:"attempts"`
+	Retries  int        `json:"retries"`
+	WindowMS int64      `json:"window_ms"`
+	PulseAt  time.Time  `json:"pulse_at"`
+	UpAt     *time.Time `json:"up_at,omitempty"`
+}
+
+// Finished reports whether the device has acked, or the command failed or
+// expired.
+func (c *CommandRecord) Finished() bool {
+	return c.Status == StateAcked || c.Status == StateFailed || c.Status == StateExpired
+}
+
+// Health is the server's health summary.
+type Health struct {
+	Status  string `json:"status"`
+	Version string `json:"version"`
+	ESPs    struct {
+		Total  int `json:"total"`
+		Online int `json:"online"`
+	} `json:"esps"`
+}